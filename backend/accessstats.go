@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Access statistics count what gets read, to show which layers and areas
+// are worth caching. Nothing about the caller is kept: counters are per UTC
+// day and per layer, bbox bucket (the tile-aligned bucket bboxCached uses),
+// export format or feature, buffered in memory and added to the
+// access_stats collection every ACCESS_STATS_FLUSH_INTERVAL (1m). Days older
+// than ACCESS_STATS_RETENTION (90d) expire. GET /stats/usage leaves out
+// buckets and features read fewer than ACCESS_STATS_MIN_COUNT (5) times, so
+// a single user's area of interest doesn't show. ACCESS_STATS=false turns
+// counting off.
+type AccessStat struct {
+	ID       string    `bson:"_id" json:"-"`
+	Day      string    `bson:"day" json:"day"`
+	Date     time.Time `bson:"date" json:"-"`
+	Kind     string    `bson:"kind" json:"kind"`
+	Key      string    `bson:"key" json:"key"`
+	BBox     []float64 `bson:"bbox,omitempty" json:"bbox,omitempty"`
+	Count    int64     `bson:"count" json:"count"`
+	Features int64     `bson:"features" json:"features"`
+	Bytes    int64     `bson:"bytes" json:"bytes"`
+}
+
+const (
+	accessLayer   = "layer"
+	accessBBox    = "bbox"
+	accessExport  = "export"
+	accessFeature = "feature"
+)
+
+type accessStatKey struct {
+	day, kind, key string
+}
+
+type accessCounter struct {
+	bbox                   []float64
+	count, features, bytes int64
+}
+
+var (
+	accessStats        *mongo.Collection
+	accessStatsEnabled       = true
+	accessMinCount     int64 = 5
+	// accessMaxKeys bounds the counters held between flushes; past it only
+	// keys already counted go up, which mostly drops one-off features
+	accessMaxKeys = 10000
+	// accessFeatureIDs is the most features a response can hold for them to
+	// count as read one by one; a full layer listing says nothing about
+	// which of its features are popular
+	accessFeatureIDs = 50
+
+	accessMu       sync.Mutex
+	accessCounters = map[accessStatKey]*accessCounter{}
+)
+
+func setupAccessStats() {
+	accessStats = db.Collection(getenv("MONGO_ACCESS_STATS_COLLECTION", "access_stats"))
+	accessStatsEnabled = getenv("ACCESS_STATS", "true") != "false"
+	if v, err := strconv.ParseInt(getenv("ACCESS_STATS_MIN_COUNT", ""), 10, 64); err == nil && v >= 0 {
+		accessMinCount = v
+	}
+	if v, err := strconv.Atoi(getenv("ACCESS_STATS_MAX_KEYS", "")); err == nil && v > 0 {
+		accessMaxKeys = v
+	}
+	retention := 90 * 24 * time.Hour
+	if d, err := time.ParseDuration(getenv("ACCESS_STATS_RETENTION", "")); err == nil && d > 0 {
+		retention = d
+	}
+	if _, err := accessStats.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "date", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds()))},
+		{Keys: bson.D{{Key: "kind", Value: 1}, {Key: "day", Value: 1}}},
+	}); err != nil {
+		log.Printf("access stats index create warning: %v", err)
+	}
+	flush := time.Minute
+	if d, err := time.ParseDuration(getenv("ACCESS_STATS_FLUSH_INTERVAL", "")); err == nil && d > 0 {
+		flush = d
+	}
+	go func() {
+		for range time.Tick(flush) {
+			flushAccessStats()
+		}
+	}()
+}
+
+// accessTally is what one request served, filled in by the handler
+type accessTally struct {
+	mu     sync.Mutex
+	layers map[string]int64
+	ids    []string
+}
+
+type accessTallyKey struct{}
+
+// countServed notes n features of layer served to r; ids feed the popular
+// feature counts. It does nothing outside accessCounted.
+func countServed(r *http.Request, layer string, n int, ids ...string) {
+	t, _ := r.Context().Value(accessTallyKey{}).(*accessTally)
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if n > 0 {
+		t.layers[layer] += int64(n)
+	}
+	if len(t.ids) <= accessFeatureIDs {
+		t.ids = append(t.ids, ids...)
+	}
+	t.mu.Unlock()
+}
+
+// servedBy copies what r was served, so replayed responses count the same
+func servedBy(r *http.Request) *accessTally {
+	t, _ := r.Context().Value(accessTallyKey{}).(*accessTally)
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := &accessTally{layers: make(map[string]int64, len(t.layers)), ids: append([]string(nil), t.ids...)}
+	for k, v := range t.layers {
+		c.layers[k] = v
+	}
+	return c
+}
+
+// replayServed counts a stored tally again for r
+func replayServed(r *http.Request, t *accessTally) {
+	if t == nil {
+		return
+	}
+	for layer, n := range t.layers {
+		countServed(r, layer, int(n))
+	}
+	countServed(r, "", 0, t.ids...)
+}
+
+// byteCounter is a statusRecorder that also counts the body
+type byteCounter struct {
+	statusRecorder
+	bytes int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	n, err := b.statusRecorder.Write(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// accessCounted counts successful responses of next. export names the
+// format for downloads; listings that ask for ?format= count as exports of
+// that format too.
+func accessCounted(export string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !accessStatsEnabled || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		query := r.URL.Query()
+		format := export
+		if f := query.Get("format"); f != "" {
+			if format != "" {
+				format += "-" + f
+			} else {
+				format = f
+			}
+		}
+		var bucket string
+		var snapped BBox
+		if minLon, minLat, maxLon, maxLat, ok := parseBBox(query.Get("bbox")); ok {
+			snapped, bucket, _ = snapBBox(BBox{minLon, minLat, maxLon, maxLat})
+		}
+
+		t := &accessTally{layers: map[string]int64{}}
+		r = r.WithContext(context.WithValue(r.Context(), accessTallyKey{}, t))
+		rec := &byteCounter{statusRecorder: statusRecorder{ResponseWriter: w}}
+		next(rec, r)
+		if rec.status < 200 || rec.status >= 300 {
+			return
+		}
+
+		day := time.Now().UTC().Format("2006-01-02")
+		var total int64
+		for _, n := range t.layers {
+			total += n
+		}
+		accessMu.Lock()
+		defer accessMu.Unlock()
+		for layer, n := range t.layers {
+			var bytes int64
+			if len(t.layers) == 1 {
+				bytes = rec.bytes
+			}
+			addAccessLocked(accessStatKey{day, accessLayer, layer}, nil, 1, n, bytes)
+		}
+		if bucket != "" {
+			bbox := []float64{snapped.MinLon, snapped.MinLat, snapped.MaxLon, snapped.MaxLat}
+			addAccessLocked(accessStatKey{day, accessBBox, bucket}, bbox, 1, total, rec.bytes)
+		}
+		if format != "" {
+			addAccessLocked(accessStatKey{day, accessExport, format}, nil, 1, total, rec.bytes)
+		}
+		if len(t.ids) > accessFeatureIDs {
+			return
+		}
+		for _, id := range t.ids {
+			addAccessLocked(accessStatKey{day, accessFeature, id}, nil, 1, 0, 0)
+		}
+	}
+}
+
+func addAccessLocked(k accessStatKey, bbox []float64, count, features, bytes int64) {
+	c, ok := accessCounters[k]
+	if !ok {
+		if len(accessCounters) >= accessMaxKeys {
+			return
+		}
+		c = &accessCounter{bbox: bbox}
+		accessCounters[k] = c
+	}
+	c.count += count
+	c.features += features
+	c.bytes += bytes
+}
+
+func flushAccessStats() {
+	accessMu.Lock()
+	pending := accessCounters
+	accessCounters = map[accessStatKey]*accessCounter{}
+	accessMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	models := make([]mongo.WriteModel, 0, len(pending))
+	for k, c := range pending {
+		date, _ := time.Parse("2006-01-02", k.day)
+		insert := bson.M{"day": k.day, "date": date, "kind": k.kind, "key": k.key}
+		if c.bbox != nil {
+			insert["bbox"] = c.bbox
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": k.day + "|" + k.kind + "|" + k.key}).
+			SetUpdate(bson.M{
+				"$setOnInsert": insert,
+				"$inc":         bson.M{"count": c.count, "features": c.features, "bytes": c.bytes},
+			}).
+			SetUpsert(true))
+	}
+	if _, err := accessStats.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false)); err != nil {
+		// dropped rather than retried: these are estimates and a retry could
+		// count a partly applied batch twice
+		log.Printf("access stats flush warning: %v", err)
+	}
+}
+
+// AccessTotal is one row of GET /stats/usage
+type AccessTotal struct {
+	Key      string    `bson:"_id" json:"key"`
+	BBox     []float64 `bson:"bbox,omitempty" json:"bbox,omitempty"`
+	Count    int64     `bson:"count" json:"count"`
+	Features int64     `bson:"features" json:"features,omitempty"`
+	Bytes    int64     `bson:"bytes" json:"bytes,omitempty"`
+}
+
+type AccessReport struct {
+	Since           string        `json:"since"`
+	Days            int           `json:"days"`
+	MinCount        int64         `json:"min_count"`
+	TopLayers       []AccessTotal `json:"top_layers"`
+	BusiestBBoxes   []AccessTotal `json:"busiest_bboxes"`
+	Exports         []AccessTotal `json:"exports"`
+	PopularFeatures []AccessTotal `json:"popular_features"`
+}
+
+func topAccess(c context.Context, kind, since string, min int64, limit int) ([]AccessTotal, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"kind": kind, "day": bson.M{"$gte": since}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":      "$key",
+			"bbox":     bson.M{"$first": "$bbox"},
+			"count":    bson.M{"$sum": "$count"},
+			"features": bson.M{"$sum": "$features"},
+			"bytes":    bson.M{"$sum": "$bytes"},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gte": min}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: limit}},
+	}
+	cur, err := accessStats.Aggregate(c, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	out := []AccessTotal{}
+	if err := cur.All(c, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GET /stats/usage?days=30&limit=20
+// Most read layers, bbox buckets, features and export formats over the last
+// days (today included). Counts still buffered on an instance show up after
+// its next flush.
+func accessStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	query := r.URL.Query()
+	days := 30
+	if v := query.Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 366 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid days", FieldError{Field: "days", Message: "must be between 1 and 366"})
+			return
+		}
+		days = n
+	}
+	limit := 20
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, 1-days).Format("2006-01-02")
+	report := AccessReport{Since: since, Days: days, MinCount: accessMinCount}
+	for _, part := range []struct {
+		kind string
+		min  int64
+		dst  *[]AccessTotal
+	}{
+		{accessLayer, 1, &report.TopLayers},
+		{accessBBox, accessMinCount, &report.BusiestBBoxes},
+		{accessExport, 1, &report.Exports},
+		{accessFeature, accessMinCount, &report.PopularFeatures},
+	} {
+		rows, err := topAccess(r.Context(), part.kind, since, part.min, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		*part.dst = rows
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
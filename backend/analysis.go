@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Selection picks the input features of an analysis: explicit ids, or a
+// filter using the same parameters as GET /features
+type Selection struct {
+	IDs    []string         `json:"ids"`
+	Filter *SelectionFilter `json:"filter"`
+}
+
+// SelectionFilter mirrors the layer/bbox/admin listing parameters
+type SelectionFilter struct {
+	Layer string `json:"layer"`
+	BBox  string `json:"bbox"`
+	Admin string `json:"admin"`
+}
+
+// maximum number of input vertices for Delaunay based analyses
+const maxAnalysisPoints = 20000
+
+// selectionError is a selection that can't be run as sent, as opposed to a
+// failure reading its features
+type selectionError string
+
+func (e selectionError) Error() string { return string(e) }
+
+// writeSelectionError reports loadSelection's error
+func writeSelectionError(w http.ResponseWriter, err error) {
+	if e, ok := err.(selectionError); ok {
+		writeError(w, http.StatusBadRequest, "validation_failed", e.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+}
+
+// query builds the Mongo filter for the selection. Only approved features
+// are used, like public listings.
+func (sel Selection) query() (bson.M, error) {
+	q := bson.M{"status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	if len(sel.IDs) > 0 {
+		oids := make(bson.A, 0, len(sel.IDs))
+		for _, id := range sel.IDs {
+			oid, err := primitive.ObjectIDFromHex(id)
+			if err != nil {
+				return nil, selectionError(fmt.Sprintf("invalid id %q", id))
+			}
+			oids = append(oids, oid)
+		}
+		q["_id"] = bson.M{"$in": oids}
+		return q, nil
+	}
+	if sel.Filter == nil {
+		return nil, selectionError("ids or filter required")
+	}
+	if sel.Filter.Layer != "" {
+		q["layer"] = sel.Filter.Layer
+	}
+	if sel.Filter.BBox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(sel.Filter.BBox)
+		if !ok {
+			return nil, selectionError("invalid bbox")
+		}
+		q["geometry"] = bson.M{"$geoWithin": bson.M{"$box": bson.A{
+			bson.A{minLon, minLat},
+			bson.A{maxLon, maxLat},
+		}}}
+	}
+	if sel.Filter.Admin != "" {
+		area, err := adminAreaFilter(sel.Filter.Admin)
+		if err == mongo.ErrNoDocuments {
+			return nil, selectionError(fmt.Sprintf("unknown admin area %q", sel.Filter.Admin))
+		} else if err != nil {
+			return nil, err
+		}
+		q["$and"] = bson.A{area}
+	}
+	return q, nil
+}
+
+// loadSelection returns the matching features, at most maxFeatures, read
+// from the heavy-read collection
+func loadSelection(r *http.Request, sel Selection) ([]FeatureDoc, error) {
+	ctx := r.Context()
+	q, err := sel.query()
+	if err != nil {
+		return nil, err
+	}
+	applyVisibilityFilter(r, q)
+	cur, err := readsFor(r).Find(ctx, q, options.Find().SetLimit(maxFeatures))
+	if err != nil {
+		return nil, err
+	}
+	var docs []FeatureDoc
+	err = cur.All(ctx, &docs)
+	for i := range docs {
+		revealDoc(r, &docs[i])
+	}
+	return docs, err
+}
+
+// selectionPositions collects every vertex of the given features
+func selectionPositions(docs []FeatureDoc) []Position {
+	var ps []Position
+	for _, d := range docs {
+		g, err := parseGeometry(d.Geometry)
+		if err != nil {
+			continue
+		}
+		ps = append(ps, g.allPositions()...)
+	}
+	return ps
+}
+
+// SaveAs asks an analysis endpoint to store its result as a new feature
+type SaveAs struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Layer       string `json:"layer"`
+}
+
+// saveAnalysisFeature stores a generated geometry as an approved feature
+func saveAnalysisFeature(r *http.Request, save SaveAs, g Geometry, props bson.M) (string, error) {
+	now := time.Now().UTC()
+	doc := FeatureDoc{
+		Name:        save.Name,
+		Description: save.Description,
+		Layer:       save.Layer,
+		Geometry:    g.BSON(),
+		Properties:  props,
+		Status:      statusApproved,
+		CreatedBy:   userID(r),
+		UpdatedBy:   userID(r),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	res, err := collection.InsertOne(r.Context(), doc)
+	if err != nil {
+		return "", err
+	}
+	return res.InsertedID.(primitive.ObjectID).Hex(), nil
+}
+
+// POST /analysis/hull { ids | filter, alpha, save }
+// alpha (meters) > 0 computes a concave alpha shape instead of the convex hull
+func hullHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Selection
+		Alpha float64 `json:"alpha"`
+		Save  *SaveAs `json:"save"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if body.Save != nil && !requireRole(w, r, "editor") {
+		return
+	}
+	if body.Alpha < 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid alpha", FieldError{Field: "alpha", Message: "must be a positive distance in meters"})
+		return
+	}
+	docs, err := loadSelection(r, body.Selection)
+	if err != nil {
+		writeSelectionError(w, err)
+		return
+	}
+	ps := selectionPositions(docs)
+
+	var g Geometry
+	method := "convex"
+	if body.Alpha > 0 {
+		method = "concave"
+		if len(ps) > maxAnalysisPoints {
+			writeError(w, http.StatusRequestEntityTooLarge, "result_too_large", fmt.Sprintf("concave hull supports at most %d vertices", maxAnalysisPoints))
+			return
+		}
+		var polys [][][]Position
+		if !runGeometry(w, r, func() { polys = alphaShape(ps, body.Alpha) }) {
+			return
+		}
+		switch len(polys) {
+		case 0:
+			writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "no triangles left at this alpha; increase it")
+			return
+		case 1:
+			g = Geometry{Type: "Polygon", Rings: polys[0]}
+		default:
+			g = Geometry{Type: "MultiPolygon", Polygons: polys}
+		}
+	} else {
+		var ring []Position
+		if !runGeometry(w, r, func() { ring = convexHull(ps) }) {
+			return
+		}
+		if ring == nil {
+			writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "need at least 3 non-collinear points")
+			return
+		}
+		g = Geometry{Type: "Polygon", Rings: [][]Position{ring}}
+	}
+
+	props := bson.M{"method": method, "feature_count": len(docs), "point_count": len(ps)}
+	if body.Alpha > 0 {
+		props["alpha"] = body.Alpha
+	}
+	if body.Save != nil {
+		gs, err := layerGeometries(body.Save.Layer, g)
+		if err == nil && len(gs) > 1 {
+			err = splitRefused(body.Save.Layer, g, len(gs))
+		}
+		if err != nil {
+			writeExtentError(w, err)
+			return
+		}
+		id, err := saveAnalysisFeature(r, *body.Save, gs[0], props)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return
+		}
+		props["id"] = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GeoJSONFeature{Type: "Feature", Geometry: g.BSON(), Properties: props})
+}
+
+// POST /analysis/voronoi { ids | filter, boundary_code | boundary, target_layer }
+// builds Thiessen polygons around the selected point features, clipped to an
+// admin boundary, a GeoJSON polygon, or by default the sites' extent padded
+// by 10%. With target_layer the cells are stored as a new layer of that id,
+// 409 when it already exists.
+func voronoiHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Selection
+		BoundaryCode string      `json:"boundary_code"`
+		Boundary     interface{} `json:"boundary"`
+		TargetLayer  string      `json:"target_layer"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if body.TargetLayer != "" && !requireRole(w, r, "editor") {
+		return
+	}
+	if body.TargetLayer != "" && !layerIDPattern.MatchString(body.TargetLayer) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid target layer id", FieldError{Field: "target_layer", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+	docs, err := loadSelection(r, body.Selection)
+	if err != nil {
+		writeSelectionError(w, err)
+		return
+	}
+
+	// one site per distinct point location
+	var sites []Position
+	var siteDocs []FeatureDoc
+	seen := map[[2]float64]bool{}
+	for _, d := range docs {
+		g, err := parseGeometry(d.Geometry)
+		if err != nil || g.Type != "Point" {
+			continue
+		}
+		k := [2]float64{g.Point[0], g.Point[1]}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		sites = append(sites, g.Point)
+		siteDocs = append(siteDocs, d)
+	}
+	if len(sites) < 2 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "need at least 2 distinct point features")
+		return
+	}
+	if len(sites) > maxAnalysisPoints {
+		writeError(w, http.StatusRequestEntityTooLarge, "result_too_large", fmt.Sprintf("voronoi supports at most %d sites", maxAnalysisPoints))
+		return
+	}
+
+	var clipTo [][][]Position
+	switch {
+	case body.BoundaryCode != "":
+		var b BoundaryDoc
+		if err := boundaries.FindOne(r.Context(), bson.M{"code": body.BoundaryCode}).Decode(&b); err != nil {
+			writeError(w, http.StatusBadRequest, "validation_failed", "unknown boundary", FieldError{Field: "boundary_code", Message: "no boundary with this code"})
+			return
+		}
+		g, _ := parseGeometry(b.Geometry)
+		clipTo = polygonsOf(g)
+	case body.Boundary != nil:
+		g, err := parseGeometry(body.Boundary)
+		if err != nil || (g.Type != "Polygon" && g.Type != "MultiPolygon") {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid boundary", FieldError{Field: "boundary", Message: "must be a Polygon or MultiPolygon"})
+			return
+		}
+		clipTo = polygonsOf(g)
+	default:
+		minLon, minLat, maxLon, maxLat := sites[0][0], sites[0][1], sites[0][0], sites[0][1]
+		for _, s := range sites {
+			minLon, maxLon = math.Min(minLon, s[0]), math.Max(maxLon, s[0])
+			minLat, maxLat = math.Min(minLat, s[1]), math.Max(maxLat, s[1])
+		}
+		padX, padY := (maxLon-minLon)*0.1+1e-4, (maxLat-minLat)*0.1+1e-4
+		minLon, maxLon, minLat, maxLat = minLon-padX, maxLon+padX, minLat-padY, maxLat+padY
+		clipTo = [][][]Position{{{{minLon, minLat}, {maxLon, minLat}, {maxLon, maxLat}, {minLon, maxLat}, {minLon, minLat}}}}
+	}
+
+	var cells [][][]Position
+	if !runGeometry(w, r, func() { cells = voronoiCells(sites, clipTo) }) {
+		return
+	}
+	now := time.Now().UTC()
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	var toInsert []interface{}
+	for i, rings := range cells {
+		if len(rings) == 0 {
+			continue
+		}
+		g := Geometry{Type: "Polygon", Rings: rings[:1]}
+		if len(rings) > 1 {
+			g = Geometry{Type: "MultiPolygon"}
+			for _, ring := range rings {
+				g.Polygons = append(g.Polygons, [][]Position{ring})
+			}
+		}
+		props := bson.M{"site_id": siteDocs[i].ID.Hex(), "site_name": siteDocs[i].Name}
+		fc.Features = append(fc.Features, GeoJSONFeature{Type: "Feature", Geometry: g.BSON(), Properties: props})
+		if body.TargetLayer != "" {
+			toInsert = append(toInsert, FeatureDoc{
+				Name:       siteDocs[i].Name,
+				Layer:      body.TargetLayer,
+				Geometry:   g.BSON(),
+				Properties: props,
+				Status:     statusApproved,
+				CreatedBy:  userID(r),
+				UpdatedBy:  userID(r),
+				CreatedAt:  now,
+				UpdatedAt:  now,
+			})
+		}
+	}
+
+	if len(toInsert) > 0 {
+		n, err := collection.CountDocuments(r.Context(), bson.M{"layer": body.TargetLayer}, options.Count().SetLimit(1))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+			return
+		}
+		if n > 0 {
+			writeError(w, http.StatusConflict, "conflict", "target layer already has features", FieldError{Field: "target_layer", Message: "must be a new layer"})
+			return
+		}
+		layer := LayerDoc{
+			ID:          body.TargetLayer,
+			Name:        body.TargetLayer,
+			Description: fmt.Sprintf("Voronoi cells of %d sites", len(sites)),
+			Fields:      []LayerField{{Name: "site_id", Type: "string"}, {Name: "site_name", Type: "string"}},
+			Style:       bson.M{"type": "fill", "color": "#9ecae1", "opacity": 0.4, "outline": "#3182bd"},
+			CreatedBy:   userID(r),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if !insertLayer(w, layer) {
+			return
+		}
+		forgetLayerExtent(layer.ID)
+		if _, err := collection.InsertMany(r.Context(), toInsert); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fc)
+}
+
+// polygonsOf returns the polygons of a Polygon or MultiPolygon
+func polygonsOf(g Geometry) [][][]Position {
+	switch g.Type {
+	case "Polygon":
+		return [][][]Position{g.Rings}
+	case "MultiPolygon":
+		return g.Polygons
+	}
+	return nil
+}
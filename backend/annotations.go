@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Annotation layers hold map labels rather than real-world features: each
+// feature is the point a text is anchored at, with the text, its rotation
+// and an optional leader line to what it labels. The layer style says how
+// the text and leaders are drawn.
+
+// layerKindAnnotation is LayerDoc.Kind for annotation layers
+const layerKindAnnotation = "annotation"
+
+const maxAnnotationText = 500
+
+// where the text sits relative to the point, as in MapLibre's text-anchor
+var annotationAnchors = []string{"center", "left", "right", "top", "bottom", "top-left", "top-right", "bottom-left", "bottom-right"}
+
+// Annotation is what a feature of an annotation layer draws. Rotation is
+// in degrees clockwise, 0 to 360; Leader is a LineString.
+type Annotation struct {
+	Text     string  `bson:"text" json:"text"`
+	Rotation float64 `bson:"rotation" json:"rotation"`
+	Anchor   string  `bson:"anchor" json:"anchor"`
+	Leader   bson.M  `bson:"leader,omitempty" json:"leader,omitempty"`
+}
+
+// AnnotationInput is the annotation of a FeatureInput
+type AnnotationInput struct {
+	Text     string      `json:"text"`
+	Rotation float64     `json:"rotation"`
+	Anchor   string      `json:"anchor"`
+	Leader   interface{} `json:"leader"`
+}
+
+// the style annotation layers start with
+var defaultAnnotationStyle = bson.M{
+	"type": "annotation", "font": "Open Sans Regular", "size": 12, "color": "#222222",
+	"halo_color": "#ffffff", "halo_width": 1, "leader_color": "#555555", "leader_width": 1,
+}
+
+var styleColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// validateAnnotationStyle checks the keys annotation layers draw with;
+// others are left to the client
+func validateAnnotationStyle(style bson.M) []FieldError {
+	var errs []FieldError
+	if t, ok := style["type"]; ok && t != "annotation" {
+		errs = append(errs, FieldError{Field: "style.type", Message: "must be annotation on an annotation layer"})
+	}
+	if f, ok := style["font"]; ok {
+		if s, isString := f.(string); !isString || strings.TrimSpace(s) == "" {
+			errs = append(errs, FieldError{Field: "style.font", Message: "must be a font name"})
+		}
+	}
+	for _, k := range []string{"color", "halo_color", "leader_color"} {
+		if v, ok := style[k]; ok {
+			if s, isString := v.(string); !isString || !styleColorPattern.MatchString(s) {
+				errs = append(errs, FieldError{Field: "style." + k, Message: "must be #rgb or #rrggbb"})
+			}
+		}
+	}
+	limits := map[string][2]float64{"size": {4, 128}, "halo_width": {0, 10}, "leader_width": {0, 20}}
+	for k, lim := range limits {
+		if v, ok := style[k]; ok {
+			n, err := toFloat(v)
+			if _, isString := v.(string); isString || err != nil || n < lim[0] || n > lim[1] {
+				errs = append(errs, FieldError{Field: "style." + k, Message: fmt.Sprintf("must be a number from %g to %g", lim[0], lim[1])})
+			}
+		}
+	}
+	return errs
+}
+
+// normalize validates the input into the stored annotation
+func (a *AnnotationInput) normalize() (*Annotation, []FieldError) {
+	var errs []FieldError
+	out := &Annotation{Text: strings.TrimSpace(a.Text), Anchor: a.Anchor}
+	if out.Text == "" {
+		errs = append(errs, FieldError{Field: "annotation.text", Message: "required"})
+	} else if utf8.RuneCountInString(out.Text) > maxAnnotationText {
+		errs = append(errs, FieldError{Field: "annotation.text", Message: fmt.Sprintf("at most %d characters", maxAnnotationText)})
+	}
+	if math.IsNaN(a.Rotation) || math.IsInf(a.Rotation, 0) {
+		errs = append(errs, FieldError{Field: "annotation.rotation", Message: "must be a number of degrees"})
+	} else {
+		out.Rotation = math.Mod(math.Mod(a.Rotation, 360)+360, 360)
+	}
+	if out.Anchor == "" {
+		out.Anchor = "center"
+	}
+	if !oneOf(out.Anchor, annotationAnchors) {
+		errs = append(errs, FieldError{Field: "annotation.anchor", Message: "must be one of " + strings.Join(annotationAnchors, ", ")})
+	}
+	if a.Leader != nil {
+		g, err := parseGeometry(a.Leader)
+		if err == nil {
+			err = g.Validate()
+		}
+		if err == nil && g.Type != "LineString" {
+			err = fmt.Errorf("must be a LineString, got %s", g.Type)
+		}
+		if err != nil {
+			errs = append(errs, FieldError{Field: "annotation.leader", Message: err.Error()})
+		} else {
+			out.Leader = g.BSON()
+		}
+	}
+	return out, errs
+}
+
+// featureAnnotationCheck holds a create or update to its layer's kind:
+// features of annotation layers need an annotation and a point, other
+// features can't have one. cleared is a PATCH removing the annotation. On
+// update the stored feature fills in what the request leaves out. The
+// normalized annotation is left in in.annotation.
+func featureAnnotationCheck(in *FeatureInput, existing *FeatureDoc, cleared bool) ([]FieldError, error) {
+	var errs []FieldError
+	if in.Annotation != nil {
+		a, aerrs := in.Annotation.normalize()
+		if len(aerrs) > 0 {
+			return aerrs, nil
+		}
+		in.annotation = a
+	}
+	layer := deref(in.Layer)
+	if existing != nil && in.Layer == nil {
+		layer = existing.Layer
+	}
+	kind := ""
+	if layer != "" {
+		c, err := loadLayerExtent(layer)
+		if err != nil {
+			return nil, err
+		}
+		kind = c.kind
+	}
+	has := in.annotation != nil || existing != nil && existing.Annotation != nil && !cleared
+	if kind != layerKindAnnotation {
+		if has {
+			errs = append(errs, FieldError{Field: "annotation", Message: "only features of annotation layers have one"})
+		}
+		return errs, nil
+	}
+	if !has {
+		errs = append(errs, FieldError{Field: "annotation", Message: "required on annotation layer " + layer})
+	}
+	g := in.parsed
+	if g == nil && existing != nil {
+		if stored, err := parseGeometry(existing.Geometry); err == nil {
+			g = &stored
+		}
+	}
+	if g != nil && g.Type != "Point" {
+		errs = append(errs, FieldError{Field: "geojson", Message: "annotations are anchored at a Point, got " + g.Type})
+	}
+	return errs, nil
+}
+
+// writeAnnotationCheck reports featureAnnotationCheck's outcome, true
+// when the write may go ahead
+func writeAnnotationCheck(w http.ResponseWriter, errs []FieldError, err error) bool {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "layer lookup error: "+err.Error())
+		return false
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid annotation", errs...)
+		return false
+	}
+	return true
+}
+
+// annotationProperties adds the annotation to a GeoJSON feature's properties
+// along with flat text/rotation/anchor keys data-driven map styles can use
+func annotationProperties(doc FeatureDoc, props bson.M) {
+	a := doc.Annotation
+	if a == nil {
+		return
+	}
+	props["annotation"] = a
+	props["annotation_text"] = a.Text
+	props["annotation_rotation"] = a.Rotation
+	props["annotation_anchor"] = a.Anchor
+}
+
+// GET /layers/{id}/leaders
+// The leader lines of an annotation layer as LineString features carrying
+// the annotation's id and text, for drawing as their own line layer.
+func annotationLeadersHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var l LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": id}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if l.Kind != layerKindAnnotation {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "layer "+id+" is not an annotation layer")
+		return
+	}
+	q := bson.M{"layer": id, "annotation.leader": bson.M{"$exists": true}}
+	if !applyStatusFilter(w, r, q) || !applyPublicationFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	cur, err := readsFor(r).Find(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	out := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for cur.Next(r.Context()) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil || doc.Annotation == nil {
+			continue
+		}
+		out.Features = append(out.Features, GeoJSONFeature{
+			Type:       "Feature",
+			Geometry:   doc.Annotation.Leader,
+			Properties: bson.M{"id": doc.ID.Hex(), "annotation_text": doc.Annotation.Text},
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
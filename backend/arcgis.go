@@ -0,0 +1,933 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A minimal ArcGIS REST FeatureServer facade so ArcGIS Online, Pro and Field
+// Maps/Collector can read our layers:
+//
+//	/arcgis/rest/info
+//	/arcgis/rest/services/{service}/FeatureServer              service info
+//	/arcgis/rest/services/{service}/FeatureServer/{n}          layer info
+//	/arcgis/rest/services/{service}/FeatureServer/{n}/query    query
+//
+// Layers are numbered by their position in id order. Queries support where
+// (a small SQL subset), geometry with esriSpatialRelIntersects/Contains,
+// outFields, paging, returnCountOnly and f=json|pjson|geojson. OBJECTID is
+// derived from the Mongo id and is for display only; filtering by objectIds
+// isn't supported. Everything is read-only.
+
+// maximum features per query page, ARCGIS_MAX_RECORDS
+var arcgisMaxRecords = 2000
+
+const webMercatorRadius = 6378137.0
+
+func setupArcGIS() {
+	if n, err := strconv.Atoi(getenv("ARCGIS_MAX_RECORDS", "")); err == nil && n > 0 {
+		arcgisMaxRecords = n
+	}
+}
+
+func writeArcGIS(w http.ResponseWriter, r *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if r.FormValue("f") == "pjson" {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// writeArcGISError uses the error shape ArcGIS clients expect (HTTP 200 with
+// an error object)
+func writeArcGISError(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	writeArcGIS(w, r, bson.M{"error": bson.M{"code": code, "message": msg, "details": []string{}}})
+}
+
+var wgs84SR = bson.M{"wkid": 4326, "latestWkid": 4326}
+
+func isWebMercator(wkid int) bool {
+	return wkid == 102100 || wkid == 3857 || wkid == 102113 || wkid == 900913
+}
+
+func mercToLonLat(x, y float64) Position {
+	return Position{x / webMercatorRadius * 180 / math.Pi, (2*math.Atan(math.Exp(y/webMercatorRadius)) - math.Pi/2) * 180 / math.Pi}
+}
+
+func lonLatToMerc(p Position) []float64 {
+	lat := math.Max(-maxMercatorLat, math.Min(maxMercatorLat, p[1]))
+	return []float64{p[0] * math.Pi / 180 * webMercatorRadius, math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * webMercatorRadius}
+}
+
+// arcgisLayers returns the layers in service order
+func arcgisLayers() ([]LayerDoc, error) {
+	cur, err := layers.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var out []LayerDoc
+	err = cur.All(ctx, &out)
+	return out, err
+}
+
+func arcgisLayer(w http.ResponseWriter, r *http.Request) (LayerDoc, int, bool) {
+	n, err := strconv.Atoi(mux.Vars(r)["layer"])
+	all, lerr := arcgisLayers()
+	if lerr != nil {
+		writeArcGISError(w, r, 500, "db find error: "+lerr.Error())
+		return LayerDoc{}, 0, false
+	}
+	if err != nil || n < 0 || n >= len(all) {
+		writeArcGISError(w, r, 400, "Invalid or missing input parameters: layer not found")
+		return LayerDoc{}, 0, false
+	}
+	return all[n], n, true
+}
+
+// esriGeometryType picks the layer's geometry type from its stats: the most
+// common type family wins
+func esriGeometryType(layer string) string {
+	var s LayerStats
+	if err := layerStats.FindOne(ctx, bson.M{"_id": layer}).Decode(&s); err != nil {
+		refreshLayerStats(layer)
+		layerStats.FindOne(ctx, bson.M{"_id": layer}).Decode(&s)
+	}
+	counts := map[string]int64{}
+	for t, n := range s.GeometryTypes {
+		counts[esriTypeOf(t)] += n
+	}
+	best, bestN := "esriGeometryPoint", int64(-1)
+	for _, t := range []string{"esriGeometryPoint", "esriGeometryMultipoint", "esriGeometryPolyline", "esriGeometryPolygon"} {
+		if counts[t] > bestN {
+			best, bestN = t, counts[t]
+		}
+	}
+	return best
+}
+
+func esriTypeOf(geojsonType string) string {
+	switch geojsonType {
+	case "MultiPoint":
+		return "esriGeometryMultipoint"
+	case "LineString", "MultiLineString":
+		return "esriGeometryPolyline"
+	case "Polygon", "MultiPolygon":
+		return "esriGeometryPolygon"
+	}
+	return "esriGeometryPoint"
+}
+
+var esriGeoJSONTypes = map[string]bson.A{
+	"esriGeometryPoint":      {"Point"},
+	"esriGeometryMultipoint": {"MultiPoint"},
+	"esriGeometryPolyline":   {"LineString", "MultiLineString"},
+	"esriGeometryPolygon":    {"Polygon", "MultiPolygon"},
+}
+
+var esriFieldTypes = map[string]string{
+	"string":  "esriFieldTypeString",
+	"number":  "esriFieldTypeDouble",
+	"boolean": "esriFieldTypeSmallInteger",
+	"date":    "esriFieldTypeDate",
+}
+
+func arcgisFields(l LayerDoc) []bson.M {
+	fields := []bson.M{
+		{"name": "OBJECTID", "type": "esriFieldTypeOID", "alias": "OBJECTID", "nullable": false, "editable": false},
+		{"name": "id", "type": "esriFieldTypeString", "alias": "id", "length": 24, "editable": false},
+		{"name": "name", "type": "esriFieldTypeString", "alias": "name", "length": 255},
+		{"name": "description", "type": "esriFieldTypeString", "alias": "description", "length": 4000},
+		{"name": "created_at", "type": "esriFieldTypeDate", "alias": "created_at", "length": 8},
+		{"name": "updated_at", "type": "esriFieldTypeDate", "alias": "updated_at", "length": 8},
+	}
+	for _, f := range l.Fields {
+		fields = append(fields, bson.M{"name": f.Name, "type": esriFieldTypes[f.Type], "alias": f.Name, "nullable": !f.Required})
+	}
+	return fields
+}
+
+func arcgisExtent(layer string) bson.M {
+	var s LayerStats
+	if err := layerStats.FindOne(ctx, bson.M{"_id": layer}).Decode(&s); err != nil || len(s.Extent) != 4 {
+		return bson.M{"xmin": -180, "ymin": -90, "xmax": 180, "ymax": 90, "spatialReference": wgs84SR}
+	}
+	return bson.M{"xmin": s.Extent[0], "ymin": s.Extent[1], "xmax": s.Extent[2], "ymax": s.Extent[3], "spatialReference": wgs84SR}
+}
+
+// GET /arcgis/rest/info
+func arcgisInfoHandler(w http.ResponseWriter, r *http.Request) {
+	writeArcGIS(w, r, bson.M{
+		"currentVersion": 10.81, "fullVersion": "10.8.1",
+		"authInfo": bson.M{"isTokenBasedSecurity": false},
+	})
+}
+
+// GET /arcgis/rest/services/{service}/FeatureServer
+func arcgisServiceHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := arcgisLayers()
+	if err != nil {
+		writeArcGISError(w, r, 500, "db find error: "+err.Error())
+		return
+	}
+	list := []bson.M{}
+	var credits []string
+	seen := map[string]bool{}
+	for i, l := range all {
+		list = append(list, bson.M{"id": i, "name": l.Name, "parentLayerId": -1, "defaultVisibility": true, "geometryType": esriGeometryType(l.ID)})
+		if c := l.License.text(); c != "" && !seen[c] {
+			seen[c] = true
+			credits = append(credits, c)
+		}
+	}
+	writeArcGIS(w, r, bson.M{
+		"currentVersion":              10.81,
+		"serviceDescription":          "GIS features",
+		"copyrightText":               strings.Join(credits, "; "),
+		"hasVersionedData":            false,
+		"supportsDisconnectedEditing": false,
+		"capabilities":                "Query",
+		"maxRecordCount":              arcgisMaxRecords,
+		"supportedQueryFormats":       "JSON, geoJSON",
+		"spatialReference":            wgs84SR,
+		"initialExtent":               bson.M{"xmin": -180, "ymin": -90, "xmax": 180, "ymax": 90, "spatialReference": wgs84SR},
+		"fullExtent":                  bson.M{"xmin": -180, "ymin": -90, "xmax": 180, "ymax": 90, "spatialReference": wgs84SR},
+		"units":                       "esriDecimalDegrees",
+		"layers":                      list,
+		"tables":                      []bson.M{},
+	})
+}
+
+// GET /arcgis/rest/services/{service}/FeatureServer/{layer}
+func arcgisLayerHandler(w http.ResponseWriter, r *http.Request) {
+	l, n, ok := arcgisLayer(w, r)
+	if !ok {
+		return
+	}
+	writeArcGIS(w, r, bson.M{
+		"currentVersion":        10.81,
+		"id":                    n,
+		"name":                  l.Name,
+		"type":                  "Feature Layer",
+		"description":           l.Description,
+		"copyrightText":         l.License.text(),
+		"geometryType":          esriGeometryType(l.ID),
+		"objectIdField":         "OBJECTID",
+		"displayField":          "name",
+		"fields":                arcgisFields(l),
+		"extent":                arcgisExtent(l.ID),
+		"capabilities":          "Query",
+		"maxRecordCount":        arcgisMaxRecords,
+		"supportedQueryFormats": "JSON, geoJSON",
+		"supportsPagination":    true,
+		"advancedQueryCapabilities": bson.M{
+			"supportsPagination": true, "supportsOrderBy": false, "supportsDistinct": false,
+			"supportsReturningQueryExtent": false, "supportsStatistics": false,
+		},
+		"hasAttachments": false,
+		"htmlPopupType":  "esriServerHTMLPopupTypeNone",
+	})
+}
+
+/* ---------------- where clause ---------------- */
+
+type sqlToken struct {
+	kind string // ident, num, str, op, kw, punct
+	text string
+}
+
+func tokenizeWhere(s string) ([]sqlToken, error) {
+	var toks []sqlToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if s[j] == '\'' {
+					if j+1 < len(s) && s[j+1] == '\'' {
+						b.WriteByte('\'')
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, sqlToken{"str", b.String()})
+			i = j + 1
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, sqlToken{"punct", string(c)})
+			i++
+		case strings.ContainsRune("=<>!", c):
+			j := i + 1
+			if j < len(s) && strings.ContainsRune("=>", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, sqlToken{"op", s[i:j]})
+			i = j
+		case unicode.IsDigit(c) || c == '-' || c == '.':
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' || s[j] == 'e' || s[j] == 'E') {
+				j++
+			}
+			toks = append(toks, sqlToken{"num", s[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_' || c == '"':
+			quoted := c == '"'
+			j := i + 1
+			for j < len(s) && (quoted && s[j] != '"' || !quoted && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_' || s[j] == '.')) {
+				j++
+			}
+			word := s[i:j]
+			if quoted {
+				if j >= len(s) {
+					return nil, fmt.Errorf("unterminated identifier")
+				}
+				toks = append(toks, sqlToken{"ident", word[1:]})
+				i = j + 1
+				continue
+			}
+			switch up := strings.ToUpper(word); up {
+			case "AND", "OR", "NOT", "IN", "LIKE", "IS", "NULL", "TRUE", "FALSE":
+				toks = append(toks, sqlToken{"kw", up})
+			default:
+				toks = append(toks, sqlToken{"ident", word})
+			}
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return toks, nil
+}
+
+type whereParser struct {
+	toks []sqlToken
+	pos  int
+}
+
+func (p *whereParser) peek() sqlToken {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return sqlToken{}
+}
+
+func (p *whereParser) next() sqlToken { t := p.peek(); p.pos++; return t }
+
+func (p *whereParser) accept(kind, text string) bool {
+	if t := p.peek(); t.kind == kind && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// parseWhere turns an ArcGIS where clause into a Mongo filter
+func parseWhere(s string) (bson.M, error) {
+	if strings.TrimSpace(s) == "" {
+		return bson.M{}, nil
+	}
+	toks, err := tokenizeWhere(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{toks: toks}
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	return q, nil
+}
+
+func (p *whereParser) or() (bson.M, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	parts := bson.A{left}
+	for p.accept("kw", "OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, right)
+	}
+	if len(parts) == 1 {
+		return left, nil
+	}
+	return bson.M{"$or": parts}, nil
+}
+
+func (p *whereParser) and() (bson.M, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	parts := bson.A{left}
+	for p.accept("kw", "AND") {
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, right)
+	}
+	if len(parts) == 1 {
+		return left, nil
+	}
+	return bson.M{"$and": parts}, nil
+}
+
+var matchNothing = bson.M{"_id": bson.M{"$exists": false}}
+
+func (p *whereParser) factor() (bson.M, error) {
+	if p.accept("punct", "(") {
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("punct", ")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return q, nil
+	}
+	if p.accept("kw", "NOT") {
+		q, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{q}}, nil
+	}
+	t := p.next()
+	switch t.kind {
+	case "num", "str":
+		// constant comparisons such as 1=1
+		op := p.next()
+		rhs := p.next()
+		if op.kind != "op" || (rhs.kind != "num" && rhs.kind != "str") {
+			return nil, fmt.Errorf("invalid comparison near %q", t.text)
+		}
+		if (op.text == "=" && t.text == rhs.text) || ((op.text == "<>" || op.text == "!=") && t.text != rhs.text) {
+			return bson.M{}, nil
+		}
+		return matchNothing, nil
+	case "ident":
+	default:
+		return nil, fmt.Errorf("expected a field name, got %q", t.text)
+	}
+	field, err := arcgisFieldPath(t.text)
+	if err != nil {
+		return nil, err
+	}
+
+	negate := p.accept("kw", "NOT")
+	switch {
+	case p.accept("kw", "IS"):
+		not := p.accept("kw", "NOT")
+		if !p.accept("kw", "NULL") {
+			return nil, fmt.Errorf("expected NULL after IS")
+		}
+		if not {
+			return bson.M{field: bson.M{"$ne": nil}}, nil
+		}
+		return bson.M{field: nil}, nil
+	case p.accept("kw", "IN"):
+		if !p.accept("punct", "(") {
+			return nil, fmt.Errorf("expected ( after IN")
+		}
+		var vals bson.A
+		for {
+			v, err := p.literal()
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+			if p.accept("punct", ")") {
+				break
+			}
+			if !p.accept("punct", ",") {
+				return nil, fmt.Errorf("expected , or ) in IN list")
+			}
+		}
+		if negate {
+			return bson.M{field: bson.M{"$nin": vals}}, nil
+		}
+		return bson.M{field: bson.M{"$in": vals}}, nil
+	case p.accept("kw", "LIKE"):
+		pat := p.next()
+		if pat.kind != "str" {
+			return nil, fmt.Errorf("LIKE needs a string pattern")
+		}
+		re := primitive.Regex{Pattern: likeToRegex(pat.text)}
+		if negate {
+			return bson.M{field: bson.M{"$not": re}}, nil
+		}
+		return bson.M{field: re}, nil
+	}
+	if negate {
+		return nil, fmt.Errorf("NOT must be followed by IN or LIKE here")
+	}
+	op := p.next()
+	if op.kind != "op" {
+		return nil, fmt.Errorf("expected an operator after %s", t.text)
+	}
+	v, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	mongoOps := map[string]string{"=": "$eq", "<>": "$ne", "!=": "$ne", "<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+	m, ok := mongoOps[op.text]
+	if !ok {
+		return nil, fmt.Errorf("unsupported operator %s", op.text)
+	}
+	return bson.M{field: bson.M{m: v}}, nil
+}
+
+func (p *whereParser) literal() (interface{}, error) {
+	t := p.next()
+	switch {
+	case t.kind == "str":
+		return t.text, nil
+	case t.kind == "num":
+		return strconv.ParseFloat(t.text, 64)
+	case t.kind == "kw" && t.text == "TRUE":
+		return true, nil
+	case t.kind == "kw" && t.text == "FALSE":
+		return false, nil
+	case t.kind == "kw" && t.text == "NULL":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("expected a value, got %q", t.text)
+}
+
+func likeToRegex(pat string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pat {
+		switch c {
+		case '%':
+			b.WriteString(".*")
+		case '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// arcgisFieldPath maps a field name to the document path
+func arcgisFieldPath(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "objectid":
+		return "", fmt.Errorf("filtering on OBJECTID is not supported, use id")
+	case "id":
+		return "", fmt.Errorf("filtering on id is not supported")
+	case "name", "description", "created_at", "updated_at":
+		return strings.ToLower(name), nil
+	}
+	if strings.HasPrefix(name, "$") {
+		return "", fmt.Errorf("invalid field %s", name)
+	}
+	return "properties." + name, nil
+}
+
+/* ---------------- geometry ---------------- */
+
+// arcgisGeometryFilter converts the geometry/geometryType/inSR/spatialRel
+// parameters into a Mongo condition on geometry
+func arcgisGeometryFilter(r *http.Request) (bson.M, error) {
+	raw := strings.TrimSpace(r.FormValue("geometry"))
+	if raw == "" {
+		return nil, nil
+	}
+	gtype := r.FormValue("geometryType")
+	if gtype == "" {
+		gtype = "esriGeometryEnvelope"
+	}
+	var obj struct {
+		XMin, YMin, XMax, YMax *float64
+		X, Y                   *float64
+		Rings                  [][][]float64
+		SpatialReference       struct {
+			WKID       int `json:"wkid"`
+			LatestWKID int `json:"latestWkid"`
+		} `json:"spatialReference"`
+	}
+	if strings.HasPrefix(raw, "{") {
+		if err := json.Unmarshal([]byte(raw), &obj); err != nil {
+			return nil, fmt.Errorf("invalid geometry: %v", err)
+		}
+	} else {
+		var nums []float64
+		for _, part := range strings.Split(raw, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid geometry")
+			}
+			nums = append(nums, f)
+		}
+		switch len(nums) {
+		case 4:
+			obj.XMin, obj.YMin, obj.XMax, obj.YMax = &nums[0], &nums[1], &nums[2], &nums[3]
+		case 2:
+			obj.X, obj.Y = &nums[0], &nums[1]
+		default:
+			return nil, fmt.Errorf("invalid geometry")
+		}
+	}
+
+	wkid := 4326
+	if sr := r.FormValue("inSR"); sr != "" {
+		if strings.HasPrefix(sr, "{") {
+			var s struct {
+				WKID int `json:"wkid"`
+			}
+			json.Unmarshal([]byte(sr), &s)
+			wkid = s.WKID
+		} else if n, err := strconv.Atoi(sr); err == nil {
+			wkid = n
+		}
+	} else if obj.SpatialReference.LatestWKID != 0 {
+		wkid = obj.SpatialReference.LatestWKID
+	} else if obj.SpatialReference.WKID != 0 {
+		wkid = obj.SpatialReference.WKID
+	}
+	if wkid != 4326 && !isWebMercator(wkid) {
+		return nil, fmt.Errorf("spatial reference %d not supported, use 4326 or 102100", wkid)
+	}
+	pos := func(x, y float64) Position {
+		if isWebMercator(wkid) {
+			return mercToLonLat(x, y)
+		}
+		return Position{x, y}
+	}
+
+	var g Geometry
+	switch {
+	case gtype == "esriGeometryEnvelope" && obj.XMin != nil && obj.YMin != nil && obj.XMax != nil && obj.YMax != nil:
+		a, b := pos(*obj.XMin, *obj.YMin), pos(*obj.XMax, *obj.YMax)
+		g = Geometry{Type: "Polygon", Rings: [][]Position{{
+			{a[0], a[1]}, {b[0], a[1]}, {b[0], b[1]}, {a[0], b[1]}, {a[0], a[1]},
+		}}}
+	case gtype == "esriGeometryPoint" && obj.X != nil && obj.Y != nil:
+		g = Geometry{Type: "Point", Point: pos(*obj.X, *obj.Y)}
+	case gtype == "esriGeometryPolygon" && len(obj.Rings) > 0:
+		// Esri rings are all in one list; as a query shape only the outer
+		// boundary matters, so the rings become separate polygons
+		g = Geometry{Type: "MultiPolygon"}
+		for _, ring := range obj.Rings {
+			var ps []Position
+			for _, c := range ring {
+				if len(c) < 2 {
+					return nil, fmt.Errorf("invalid ring")
+				}
+				ps = append(ps, pos(c[0], c[1]))
+			}
+			g.Polygons = append(g.Polygons, [][]Position{ps})
+		}
+	default:
+		return nil, fmt.Errorf("geometryType %s with this geometry is not supported", gtype)
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch rel := r.FormValue("spatialRel"); rel {
+	case "", "esriSpatialRelIntersects", "esriSpatialRelEnvelopeIntersects":
+		return bson.M{"$geoIntersects": bson.M{"$geometry": g.BSON()}}, nil
+	case "esriSpatialRelContains":
+		if g.Type == "Point" {
+			return nil, fmt.Errorf("esriSpatialRelContains needs an area")
+		}
+		return bson.M{"$geoWithin": bson.M{"$geometry": g.BSON()}}, nil
+	default:
+		return nil, fmt.Errorf("spatialRel %s not supported", rel)
+	}
+}
+
+// esriRing orients a ring the Esri way: outer rings clockwise, holes
+// counter-clockwise
+func esriRing(ring []Position, outer bool, conv func(Position) []float64) [][]float64 {
+	var area float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += ring[i][0]*ring[j][1] - ring[j][0]*ring[i][1]
+	}
+	out := make([][]float64, len(ring))
+	reverse := (area > 0) == outer
+	for i, p := range ring {
+		if reverse {
+			p = ring[len(ring)-1-i]
+		}
+		out[i] = conv(p)
+	}
+	return out
+}
+
+func esriGeometry(g Geometry, conv func(Position) []float64) bson.M {
+	paths := func(lines [][]Position) [][][]float64 {
+		out := make([][][]float64, len(lines))
+		for i, l := range lines {
+			for _, p := range l {
+				out[i] = append(out[i], conv(p))
+			}
+		}
+		return out
+	}
+	switch g.Type {
+	case "Point":
+		c := conv(g.Point)
+		return bson.M{"x": c[0], "y": c[1]}
+	case "MultiPoint":
+		return bson.M{"points": paths([][]Position{g.Points})[0]}
+	case "LineString":
+		return bson.M{"paths": paths([][]Position{g.Points})}
+	case "MultiLineString":
+		return bson.M{"paths": paths(g.Rings)}
+	case "Polygon", "MultiPolygon":
+		var rings [][][]float64
+		for _, poly := range polygonsOf(g) {
+			for i, ring := range poly {
+				rings = append(rings, esriRing(ring, i == 0, conv))
+			}
+		}
+		return bson.M{"rings": rings}
+	}
+	return nil
+}
+
+/* ---------------- query ---------------- */
+
+// objectIDOf derives a positive 53-bit integer from the Mongo id: the
+// timestamp and the low bits of the counter
+func objectIDOf(doc FeatureDoc) int64 {
+	b := doc.ID
+	ts := int64(b[0])<<24 | int64(b[1])<<16 | int64(b[2])<<8 | int64(b[3])
+	counter := int64(b[9])<<16 | int64(b[10])<<8 | int64(b[11])
+	return ts<<21 | counter&(1<<21-1)
+}
+
+func esriValue(v interface{}, fieldType string) interface{} {
+	switch fieldType {
+	case "date":
+		switch t := v.(type) {
+		case time.Time:
+			return t.UnixMilli()
+		case string:
+			if ts, err := time.Parse(time.RFC3339, t); err == nil {
+				return ts.UnixMilli()
+			}
+			if ts, err := time.Parse("2006-01-02", t); err == nil {
+				return ts.UnixMilli()
+			}
+		}
+	case "boolean":
+		if b, ok := v.(bool); ok {
+			if b {
+				return 1
+			}
+			return 0
+		}
+	}
+	switch t := v.(type) {
+	case bson.M, bson.A, map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+	return v
+}
+
+// GET|POST /arcgis/rest/services/{service}/FeatureServer/{layer}/query
+func arcgisQueryHandler(w http.ResponseWriter, r *http.Request) {
+	l, _, ok := arcgisLayer(w, r)
+	if !ok {
+		return
+	}
+	gtype := esriGeometryType(l.ID)
+
+	where, err := parseWhere(r.FormValue("where"))
+	if err != nil {
+		writeArcGISError(w, r, 400, "Unable to perform query. Invalid where clause: "+err.Error())
+		return
+	}
+	conds := bson.A{
+		bson.M{"layer": l.ID},
+		bson.M{"status": bson.M{"$nin": bson.A{statusPending, statusRejected}}},
+		bson.M{"geometry.type": bson.M{"$in": esriGeoJSONTypes[gtype]}},
+	}
+	if len(where) > 0 {
+		conds = append(conds, where)
+	}
+	geo, err := arcgisGeometryFilter(r)
+	if err != nil {
+		writeArcGISError(w, r, 400, "Unable to perform query. "+err.Error())
+		return
+	}
+	if geo != nil {
+		conds = append(conds, bson.M{"geometry": geo})
+	}
+	layerCond := bson.M{"layer": l.ID}
+	if !applyPublicationFilter(w, r, layerCond) {
+		return
+	}
+	conds[0] = layerCond
+	if f := visibilityFilter(r); f != nil {
+		conds = append(conds, f)
+	}
+	q := bson.M{"$and": conds}
+	coll := readsFor(r)
+
+	if ok, _ := strconv.ParseBool(r.FormValue("returnCountOnly")); ok {
+		n, err := coll.CountDocuments(r.Context(), q)
+		if err != nil {
+			writeArcGISError(w, r, 500, "db count error: "+err.Error())
+			return
+		}
+		if r.FormValue("f") == "geojson" {
+			writeArcGIS(w, r, bson.M{"type": "FeatureCollection", "features": []interface{}{}, "properties": bson.M{"count": n}})
+			return
+		}
+		writeArcGIS(w, r, bson.M{"count": n})
+		return
+	}
+
+	limit := arcgisMaxRecords
+	if n, err := strconv.Atoi(r.FormValue("resultRecordCount")); err == nil && n > 0 && n < limit {
+		limit = n
+	}
+	offset, _ := strconv.Atoi(r.FormValue("resultOffset"))
+	if offset < 0 {
+		offset = 0
+	}
+	// one extra document shows whether the page was cut
+	findOpts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(int64(offset)).SetLimit(int64(limit + 1))
+	cur, err := coll.Find(r.Context(), q, findOpts)
+	if err != nil {
+		writeArcGISError(w, r, 500, "db find error: "+err.Error())
+		return
+	}
+	var docs []FeatureDoc
+	if err := cur.All(r.Context(), &docs); err != nil {
+		writeArcGISError(w, r, 500, "db find error: "+err.Error())
+		return
+	}
+	exceeded := len(docs) > limit
+	if exceeded {
+		docs = docs[:limit]
+	}
+	for i := range docs {
+		revealDoc(r, &docs[i])
+	}
+
+	returnGeometry := r.FormValue("returnGeometry") != "false"
+	if r.FormValue("f") == "geojson" {
+		fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+		for _, d := range docs {
+			f := featureToGeoJSON(d)
+			if !returnGeometry {
+				f.Geometry = nil
+			}
+			fc.Features = append(fc.Features, f)
+		}
+		if exceeded {
+			w.Header().Set("X-Result-Truncated", "true")
+		}
+		writeArcGIS(w, r, fc)
+		return
+	}
+
+	outWKID := 4326
+	if n, err := strconv.Atoi(r.FormValue("outSR")); err == nil && isWebMercator(n) {
+		outWKID = 102100
+	}
+	conv := func(p Position) []float64 { return []float64{p[0], p[1]} }
+	sr := wgs84SR
+	if outWKID == 102100 {
+		conv = lonLatToMerc
+		sr = bson.M{"wkid": 102100, "latestWkid": 3857}
+	}
+
+	fieldTypes := map[string]string{}
+	for _, f := range l.Fields {
+		fieldTypes[f.Name] = f.Type
+	}
+	var want map[string]bool
+	if out := r.FormValue("outFields"); out != "" && out != "*" {
+		want = map[string]bool{"OBJECTID": true}
+		for _, f := range strings.Split(out, ",") {
+			want[strings.TrimSpace(f)] = true
+		}
+	}
+	fields := []bson.M{}
+	for _, f := range arcgisFields(l) {
+		if want == nil || want[f["name"].(string)] {
+			fields = append(fields, f)
+		}
+	}
+
+	features := []bson.M{}
+	for _, d := range docs {
+		attrs := bson.M{
+			"OBJECTID": objectIDOf(d), "id": d.ID.Hex(), "name": d.Name, "description": d.Description,
+			"created_at": d.CreatedAt.UnixMilli(), "updated_at": d.UpdatedAt.UnixMilli(),
+		}
+		keys := make([]string, 0, len(d.Properties))
+		for k := range d.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if _, reserved := attrs[k]; !reserved {
+				attrs[k] = esriValue(d.Properties[k], fieldTypes[k])
+			}
+		}
+		if want != nil {
+			for k := range attrs {
+				if !want[k] {
+					delete(attrs, k)
+				}
+			}
+		}
+		f := bson.M{"attributes": attrs}
+		if returnGeometry {
+			if g, err := parseGeometry(d.Geometry); err == nil {
+				f["geometry"] = esriGeometry(g, conv)
+			}
+		}
+		features = append(features, f)
+	}
+	writeArcGIS(w, r, bson.M{
+		"objectIdFieldName":     "OBJECTID",
+		"globalIdFieldName":     "",
+		"geometryType":          gtype,
+		"spatialReference":      sr,
+		"fields":                fields,
+		"features":              features,
+		"exceededTransferLimit": exceeded,
+	})
+}
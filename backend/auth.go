@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// roles in increasing order of privilege
+var roleRanks = map[string]int{
+	"viewer": 1,
+	"editor": 2,
+	"admin":  3,
+}
+
+// User is the authenticated caller attached to the request context
+type User struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+	// Provider is the auth provider that authenticated the user
+	Provider string `json:"provider"`
+	// Name is shown for the user where ID is not readable, OIDC subjects
+	Name string `json:"name,omitempty"`
+}
+
+func (u *User) hasRole(role string) bool {
+	return u != nil && roleRanks[u.Role] >= roleRanks[role]
+}
+
+type ctxKey string
+
+const userCtxKey ctxKey = "user"
+
+var (
+	// bearer token -> user, loaded from AUTH_TOKENS="token:user:role,..."
+	// and replaced when its secret file changes
+	apiTokens   = map[string]*User{}
+	apiTokensMu sync.RWMutex
+	// when false (no auth provider configured) every request is allowed, as
+	// before auth existed
+	authEnabled bool
+	// when true, editors may only modify features they created
+	enforceOwnership bool
+)
+
+// parse AUTH_TOKENS="token:user:role,token2:user2:role2"
+func parseAuthTokens(spec string) map[string]*User {
+	tokens := map[string]*User{}
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			continue
+		}
+		if _, ok := roleRanks[parts[2]]; !ok {
+			continue
+		}
+		tokens[parts[0]] = &User{ID: parts[1], Role: parts[2], Provider: "token"}
+	}
+	return tokens
+}
+
+func loadAuthTokens() {
+	apiTokens = parseAuthTokens(getsecret("AUTH_TOKENS", ""))
+	// a tokens file enables auth even while empty, so tokens can be added
+	// to it later
+	if len(apiTokens) > 0 || secretPath("AUTH_TOKENS") != "" {
+		tokenProviders = append(tokenProviders, staticTokens{})
+	}
+	watchSecret("AUTH_TOKENS", func(v string) {
+		tokens := parseAuthTokens(v)
+		apiTokensMu.Lock()
+		apiTokens = tokens
+		apiTokensMu.Unlock()
+	})
+}
+
+// Auth providers. Bearer tokens are offered to each tokenProvider in turn
+// until one claims them; passwords posted to /auth/login are checked by the
+// passwordProviders in turn, and a successful login is answered with a
+// session token this server signs itself.
+type tokenProvider interface {
+	name() string
+	// authenticate returns errNotMine for tokens of another kind
+	authenticate(token string) (*User, error)
+}
+
+type passwordProvider interface {
+	name() string
+	// login returns errInvalidCredentials for a wrong username or password
+	login(username, password string) (*User, error)
+}
+
+var (
+	tokenProviders    []tokenProvider
+	passwordProviders []passwordProvider
+
+	errNotMine = errors.New("token not handled by this provider")
+	errNoRole  = errors.New("no role for this user")
+
+	errAccountDisabled = errors.New("account disabled")
+)
+
+type staticTokens struct{}
+
+func (staticTokens) name() string { return "token" }
+
+func (staticTokens) authenticate(token string) (*User, error) {
+	apiTokensMu.RLock()
+	u, ok := apiTokens[token]
+	apiTokensMu.RUnlock()
+	if ok {
+		return u, nil
+	}
+	return nil, errNotMine
+}
+
+// Session tokens are HS256 JWTs signed with AUTH_JWT_SECRET, valid for
+// AUTH_SESSION_TTL (12h by default). Without a secret a random one is made
+// at startup, so sessions don't survive a restart or span instances. A
+// secret file that is rotated takes effect without a restart, and sessions
+// signed with the previous secret keep working.
+const sessionIssuer = "gis-mongo-backend"
+
+var (
+	sessionKeys keyRing
+	sessionTTL  = 12 * time.Hour
+)
+
+type sessionTokens struct{}
+
+func (sessionTokens) name() string { return "session" }
+
+func (sessionTokens) authenticate(token string) (*User, error) {
+	h, claims, signed, sig, err := parseJWT(token)
+	if err != nil || claims.str("iss") != sessionIssuer {
+		return nil, errNotMine
+	}
+	err = errors.New("no session key")
+	for _, key := range sessionKeys.all() {
+		if err = verifyJWTSignature(h.Alg, key, signed, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkJWTTimes(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	role := claims.str("role")
+	if _, ok := roleRanks[role]; !ok || claims.str("sub") == "" {
+		return nil, errors.New("malformed session token")
+	}
+	if claims.str("provider") == "local" {
+		issued, _ := claims.time("iat")
+		if role, err = localSession(claims.str("sub"), issued); err != nil {
+			return nil, err
+		}
+	}
+	return &User{ID: claims.str("sub"), Role: role, Provider: claims.str("provider")}, nil
+}
+
+// issueSession signs a session token for u
+func issueSession(u *User) (string, time.Time, error) {
+	now := time.Now()
+	exp := now.Add(sessionTTL)
+	token, err := signHS256(sessionKeys.current(), jwtClaims{
+		"iss": sessionIssuer, "sub": u.ID, "role": u.Role, "provider": u.Provider,
+		"iat": now.Unix(), "exp": exp.Unix(),
+	})
+	return token, exp, err
+}
+
+// setupAuthProviders configures local accounts, OIDC and LDAP next to
+// AUTH_TOKENS. Auth is enforced as soon as any provider is configured.
+func setupAuthProviders() {
+	if localAccounts = getenv("LOCAL_ACCOUNTS", "") == "true"; localAccounts {
+		passwordProviders = append(passwordProviders, localPasswords{})
+	}
+	if p := newOIDCProvider(); p != nil {
+		tokenProviders = append(tokenProviders, p)
+	}
+	if p, err := newLDAPProvider(); err != nil {
+		log.Fatalf("ldap config: %v", err)
+	} else if p != nil {
+		passwordProviders = append(passwordProviders, p)
+	}
+	if len(passwordProviders) > 0 {
+		if secret := getsecret("AUTH_JWT_SECRET", ""); secret != "" {
+			sessionKeys.set([]byte(secret))
+		} else {
+			log.Printf("AUTH_JWT_SECRET not set, sessions last until restart")
+			key := make([]byte, 32)
+			rand.Read(key)
+			sessionKeys.set(key)
+		}
+		watchSecret("AUTH_JWT_SECRET", func(v string) {
+			if v != "" {
+				sessionKeys.set([]byte(v))
+			}
+		})
+		if d, err := time.ParseDuration(getenv("AUTH_SESSION_TTL", "")); err == nil && d > 0 {
+			sessionTTL = d
+		}
+		tokenProviders = append(tokenProviders, sessionTokens{})
+	}
+	authEnabled = len(tokenProviders) > 0
+}
+
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := r.Header.Get("Authorization")
+		if strings.HasPrefix(h, "Bearer ") {
+			token := strings.TrimPrefix(h, "Bearer ")
+			var u *User
+			err := errNotMine
+			for _, p := range tokenProviders {
+				if u, err = p.authenticate(token); err != errNotMine {
+					break
+				}
+			}
+			if err != nil {
+				msg := "invalid token"
+				if err != errNotMine {
+					msg += ": " + err.Error()
+				}
+				authMetrics.Add("invalid_token", 1)
+				writeError(w, http.StatusUnauthorized, "invalid_token", msg)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), userCtxKey, u))
+		} else if u, ok := sessionFromCookie(w, r); !ok {
+			return
+		} else if u != nil {
+			r = r.WithContext(context.WithValue(r.Context(), userCtxKey, u))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// POST /auth/login { username, password, cookie }
+// Checks the password with the configured password providers and returns
+// a session token to send as a bearer token, or with cookie: true sets the
+// session cookies and returns the CSRF token instead.
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Cookie   bool   `json:"cookie"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if len(passwordProviders) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "password login is not configured")
+		return
+	}
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	wait, reason, err := loginWait(body.Username, ip, now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if wait > 0 {
+		auditAuth(AuthEvent{Event: "login_blocked", Username: strings.ToLower(body.Username), IP: ip, Reason: reason})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "too_many_attempts", "too many failed logins, try again later")
+		return
+	}
+	var u *User
+	err = errInvalidCredentials
+	for _, p := range passwordProviders {
+		if u, err = p.login(body.Username, body.Password); err != errInvalidCredentials {
+			break
+		}
+	}
+	ev := AuthEvent{Username: strings.ToLower(body.Username), IP: ip}
+	switch {
+	case err == errInvalidCredentials:
+		ev.Event = "login_failed"
+		auditAuth(ev)
+		if recordLoginFailure(body.Username, ip, now) {
+			ev.Event = "locked_out"
+			auditAuth(ev)
+		}
+		writeError(w, http.StatusUnauthorized, "invalid_credentials", err.Error())
+		return
+	case err == errNoRole:
+		ev.Event, ev.Reason = "login_failed", "no_role"
+		auditAuth(ev)
+		writeError(w, http.StatusForbidden, "forbidden", err.Error())
+		return
+	case err == errAccountDisabled:
+		ev.Event, ev.Reason = "login_failed", "disabled"
+		auditAuth(ev)
+		writeError(w, http.StatusForbidden, "account_disabled", err.Error())
+		return
+	case err != nil:
+		log.Printf("login error: %v", err)
+		writeError(w, http.StatusBadGateway, "auth_provider_error", "the authentication provider could not be reached")
+		return
+	}
+	clearLoginFailures(body.Username)
+	auditAuth(AuthEvent{Event: "login_succeeded", Username: strings.ToLower(body.Username), IP: ip, Provider: u.Provider})
+	token, exp, err := issueSession(u)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "session error: "+err.Error())
+		return
+	}
+	out := map[string]interface{}{"expires_at": exp.UTC(), "user": u}
+	if body.Cookie {
+		out["csrf_token"] = setSessionCookies(w, r, token, exp)
+	} else {
+		out["token"] = token
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /auth/me is the authenticated caller
+func meHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// currentUser returns the caller, or nil for anonymous requests
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userCtxKey).(*User)
+	return u
+}
+
+// requireRole writes 401/403 and returns false if the caller lacks role.
+// With auth disabled everyone passes.
+func requireRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	if !authEnabled {
+		return true
+	}
+	u := currentUser(r)
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return false
+	}
+	if !u.hasRole(role) {
+		writeError(w, http.StatusForbidden, "forbidden", "forbidden")
+		return false
+	}
+	return true
+}
+
+// userID is the id recorded in created_by/updated_by ("" for anonymous)
+func userID(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.ID
+	}
+	return ""
+}
+
+// canModify reports whether the caller may edit a feature created by owner
+func canModify(r *http.Request, owner string) bool {
+	if !authEnabled || !enforceOwnership {
+		return true
+	}
+	u := currentUser(r)
+	return u.hasRole("admin") || (u != nil && u.ID == owner)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Basemap tiles are fetched through /basemaps/{provider}/{z}/{x}/{y} so
+// provider API keys stay on the server. BASEMAP_PROVIDERS lists them as
+// "osm=https://tile.openstreetmap.org/{z}/{x}/{y}.png;sat=https://...?key={key}";
+// {q} is the Bing quadkey. Per provider, BASEMAP_<ID>_KEY is the key
+// (looked up per fetch, so a rotated secret file applies),
+// BASEMAP_<ID>_MAX_ZOOM caps the zoom and BASEMAP_<ID>_DAILY_LIMIT caps
+// upstream fetches per day on this instance. BASEMAP_RATE limits the tiles
+// one client may fetch per minute and BASEMAP_BOUNDS keeps requests to the
+// tiles touching a bbox. Tiles are cached in memory for BASEMAP_CACHE_TTL.
+type basemapProvider struct {
+	id         string
+	template   string
+	maxZoom    int
+	dailyLimit int64
+
+	mu      sync.Mutex
+	day     string
+	fetched int64
+}
+
+// BasemapInfo is what clients see of a provider
+type BasemapInfo struct {
+	ID      string `json:"id"`
+	MaxZoom int    `json:"max_zoom"`
+	URL     string `json:"url"`
+}
+
+const maxBasemapTileBytes = 4 << 20
+
+var (
+	basemapProviders = map[string]*basemapProvider{}
+	basemapClient    = &http.Client{Timeout: 20 * time.Second}
+	basemapUserAgent = "gis-mongo-backend basemap proxy"
+	basemapRate      = 600
+	basemapBounds    *BBox
+
+	basemapCacheTTL     = 24 * time.Hour
+	basemapCacheEntries = 5000
+	basemapCacheMu      sync.Mutex
+	basemapCacheOrder   = list.New()
+	basemapCacheItems   = map[string]*list.Element{}
+
+	basemapRateMu     sync.Mutex
+	basemapRateWindow time.Time
+	basemapRateCounts = map[string]int{}
+
+	errBasemapLimit = errors.New("daily tile limit reached")
+)
+
+type basemapTile struct {
+	key         string
+	expires     time.Time
+	contentType string
+	etag        string
+	body        []byte
+}
+
+func setupBasemaps() {
+	for _, spec := range strings.Split(getenv("BASEMAP_PROVIDERS", ""), ";") {
+		id, tmpl, ok := strings.Cut(strings.TrimSpace(spec), "=")
+		if !ok {
+			continue
+		}
+		id = strings.TrimSpace(id)
+		if !toolIDPattern.MatchString(id) {
+			log.Printf("BASEMAP_PROVIDERS: ignoring invalid provider id %q", id)
+			continue
+		}
+		if u, err := url.Parse(strings.NewReplacer("{", "", "}", "").Replace(tmpl)); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Printf("BASEMAP_PROVIDERS: ignoring %s, not an http(s) URL template", id)
+			continue
+		}
+		env := "BASEMAP_" + strings.ToUpper(strings.ReplaceAll(id, "-", "_"))
+		p := &basemapProvider{id: id, template: strings.TrimSpace(tmpl), maxZoom: 19}
+		if v, err := strconv.Atoi(getenv(env+"_MAX_ZOOM", "")); err == nil && v >= 0 && v <= maxBucketZoom {
+			p.maxZoom = v
+		}
+		if v, err := strconv.ParseInt(getenv(env+"_DAILY_LIMIT", ""), 10, 64); err == nil && v > 0 {
+			p.dailyLimit = v
+		}
+		if strings.Contains(p.template, "{key}") {
+			// read now so a missing key file fails at startup
+			getsecret(env+"_KEY", "")
+		}
+		basemapProviders[id] = p
+	}
+	if v, err := strconv.Atoi(getenv("BASEMAP_RATE", "")); err == nil && v >= 0 {
+		basemapRate = v
+	}
+	if minLon, minLat, maxLon, maxLat, ok := parseBBox(getenv("BASEMAP_BOUNDS", "")); ok {
+		basemapBounds = &BBox{MinLon: minLon, MinLat: minLat, MaxLon: maxLon, MaxLat: maxLat}
+	}
+	if d, err := time.ParseDuration(getenv("BASEMAP_CACHE_TTL", "")); err == nil {
+		basemapCacheTTL = d
+	}
+	if n, err := strconv.Atoi(getenv("BASEMAP_CACHE_ENTRIES", "")); err == nil {
+		basemapCacheEntries = n
+	}
+	basemapUserAgent = getenv("BASEMAP_USER_AGENT", basemapUserAgent)
+}
+
+func (p *basemapProvider) key() string {
+	return getsecret("BASEMAP_"+strings.ToUpper(strings.ReplaceAll(p.id, "-", "_"))+"_KEY", "")
+}
+
+func (p *basemapProvider) tileURL(z, x, y int) string {
+	return strings.NewReplacer(
+		"{z}", strconv.Itoa(z), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y),
+		"{q}", quadkey(z, x, y), "{key}", url.QueryEscape(p.key()),
+	).Replace(p.template)
+}
+
+// take counts an upstream fetch against the daily limit
+func (p *basemapProvider) take(now time.Time) bool {
+	if p.dailyLimit == 0 {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if d := now.UTC().Format("2006-01-02"); d != p.day {
+		p.day, p.fetched = d, 0
+	}
+	if p.fetched >= p.dailyLimit {
+		return false
+	}
+	p.fetched++
+	return true
+}
+
+// basemapAllowed counts a tile request of the client against BASEMAP_RATE
+// for the current minute
+func basemapAllowed(client string, now time.Time) bool {
+	if basemapRate == 0 {
+		return true
+	}
+	basemapRateMu.Lock()
+	defer basemapRateMu.Unlock()
+	if w := now.Truncate(time.Minute); !w.Equal(basemapRateWindow) {
+		basemapRateWindow = w
+		basemapRateCounts = map[string]int{}
+	}
+	if basemapRateCounts[client] >= basemapRate {
+		return false
+	}
+	basemapRateCounts[client]++
+	return true
+}
+
+// tileInBounds reports whether tile z/x/y touches BASEMAP_BOUNDS
+func tileInBounds(z, x, y int) bool {
+	b := basemapBounds
+	if b == nil {
+		return true
+	}
+	n := float64(int(1) << z)
+	west, east := tileLon(float64(x), n), tileLon(float64(x+1), n)
+	north, south := tileLat(float64(y), n), tileLat(float64(y+1), n)
+	return east >= b.MinLon && west <= b.MaxLon && north >= b.MinLat && south <= b.MaxLat
+}
+
+func cachedBasemapTile(key string, now time.Time) *basemapTile {
+	basemapCacheMu.Lock()
+	defer basemapCacheMu.Unlock()
+	el, ok := basemapCacheItems[key]
+	if !ok {
+		return nil
+	}
+	t := el.Value.(*basemapTile)
+	if now.After(t.expires) {
+		basemapCacheOrder.Remove(el)
+		delete(basemapCacheItems, key)
+		return nil
+	}
+	basemapCacheOrder.MoveToFront(el)
+	return t
+}
+
+func storeBasemapTile(t *basemapTile) {
+	if basemapCacheEntries <= 0 || basemapCacheTTL <= 0 {
+		return
+	}
+	basemapCacheMu.Lock()
+	defer basemapCacheMu.Unlock()
+	if el, ok := basemapCacheItems[t.key]; ok {
+		el.Value = t
+		basemapCacheOrder.MoveToFront(el)
+		return
+	}
+	basemapCacheItems[t.key] = basemapCacheOrder.PushFront(t)
+	for basemapCacheOrder.Len() > basemapCacheEntries {
+		last := basemapCacheOrder.Back()
+		basemapCacheOrder.Remove(last)
+		delete(basemapCacheItems, last.Value.(*basemapTile).key)
+	}
+}
+
+// fetchBasemapTile gets a tile from the provider. Errors never carry the
+// upstream URL, which may hold the key. A nil tile is a tile the provider
+// doesn't have.
+func fetchBasemapTile(r *http.Request, p *basemapProvider, key string, z, x, y int) (*basemapTile, error) {
+	if !p.take(time.Now()) {
+		return nil, errBasemapLimit
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, p.tileURL(z, x, y), nil)
+	if err != nil {
+		return nil, errors.New("invalid tile URL")
+	}
+	req.Header.Set("User-Agent", basemapUserAgent)
+	resp, err := basemapClient.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("provider returned " + resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBasemapTileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBasemapTileBytes {
+		return nil, errors.New("tile too large")
+	}
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		ct = http.DetectContentType(body)
+	}
+	return &basemapTile{key: key, expires: time.Now().Add(basemapCacheTTL), contentType: ct, etag: resp.Header.Get("ETag"), body: body}, nil
+}
+
+// GET /basemaps lists the configured providers with their proxy URLs
+func listBasemapsHandler(w http.ResponseWriter, r *http.Request) {
+	out := []BasemapInfo{}
+	for _, p := range basemapProviders {
+		out = append(out, BasemapInfo{ID: p.id, MaxZoom: p.maxZoom, URL: "/basemaps/" + p.id + "/{z}/{x}/{y}"})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /basemaps/{provider}/{z}/{x}/{y}, y may carry an extension (.png)
+func basemapTileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p, ok := basemapProviders[vars["provider"]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "unknown basemap provider "+vars["provider"])
+		return
+	}
+	ys, _, _ := strings.Cut(vars["y"], ".")
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.Atoi(vars["x"])
+	y, errY := strconv.Atoi(ys)
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > maxBucketZoom || x < 0 || y < 0 || x >= 1<<z || y >= 1<<z {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid tile coordinates")
+		return
+	}
+	if z > p.maxZoom {
+		writeError(w, http.StatusNotFound, "not_found", "zoom "+vars["z"]+" is beyond max_zoom "+strconv.Itoa(p.maxZoom))
+		return
+	}
+	if !tileInBounds(z, x, y) {
+		writeError(w, http.StatusNotFound, "not_found", "tile is outside the served area")
+		return
+	}
+	now := time.Now()
+	if !basemapAllowed(clientIP(r), now) {
+		w.Header().Set("Retry-After", strconv.Itoa(60-now.Second()))
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "too many basemap tiles, slow down")
+		return
+	}
+
+	key := p.id + "/" + strconv.Itoa(z) + "/" + strconv.Itoa(x) + "/" + strconv.Itoa(y)
+	w.Header().Set("X-Cache", "hit")
+	t := cachedBasemapTile(key, now)
+	if t == nil {
+		w.Header().Set("X-Cache", "miss")
+		var err error
+		t, err = fetchBasemapTile(r, p, key, z, x, y)
+		if err == errBasemapLimit {
+			writeError(w, http.StatusTooManyRequests, "quota_exceeded", "the "+p.id+" basemap has reached its daily tile limit")
+			return
+		} else if err != nil {
+			log.Printf("basemap %s tile %d/%d/%d: %v", p.id, z, x, y, err)
+			writeError(w, http.StatusBadGateway, "upstream_error", "basemap provider error: "+err.Error())
+			return
+		}
+		if t == nil {
+			writeError(w, http.StatusNotFound, "not_found", "no such tile")
+			return
+		}
+		storeBasemapTile(t)
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(basemapCacheTTL.Seconds())))
+	if t.etag != "" {
+		w.Header().Set("ETag", t.etag)
+		if r.Header.Get("If-None-Match") == t.etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", t.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(t.body)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(t.body)
+}
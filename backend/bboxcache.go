@@ -0,0 +1,216 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bbox listings are snapped outward to the web-mercator tile grid before
+// they run, at the deepest zoom where the bbox spans at most two tiles per
+// axis. Slightly different bboxes from a panning map then share a bucket and
+// a cached response. ?bbox_exact=true skips snapping (and the cache) for
+// callers that need the bbox as given; clip=bbox and format= exports are
+// never snapped.
+const (
+	maxBucketZoom   = 22
+	maxMercatorLat  = 85.05112878
+	maxCachedBytes  = 4 << 20
+	bboxCacheHeader = "X-BBox-Bucket"
+)
+
+var (
+	bboxCacheTTL     = 30 * time.Second
+	bboxCacheEntries = 500
+	// writeGeneration moves on every successful write; cached responses from
+	// an older generation are ignored. Other instances only see their own
+	// writes, so the TTL bounds how stale a response can get there.
+	writeGeneration atomic.Int64
+
+	bboxCacheMu    sync.Mutex
+	bboxCacheOrder = list.New()
+	bboxCacheItems = map[string]*list.Element{}
+)
+
+type bboxCacheEntry struct {
+	key        string
+	generation int64
+	expires    time.Time
+	status     int
+	header     http.Header
+	body       []byte
+	served     *accessTally
+}
+
+func setupBBoxCache() {
+	if d, err := time.ParseDuration(getenv("BBOX_CACHE_TTL", "")); err == nil {
+		bboxCacheTTL = d
+	}
+	if n, err := strconv.Atoi(getenv("BBOX_CACHE_ENTRIES", "")); err == nil {
+		bboxCacheEntries = n
+	}
+}
+
+func tileX(lon float64, n float64) float64 { return (lon + 180) / 360 * n }
+
+func tileY(lat float64, n float64) float64 {
+	r := lat * math.Pi / 180
+	return (1 - math.Log(math.Tan(r)+1/math.Cos(r))/math.Pi) / 2 * n
+}
+
+func tileLon(x, n float64) float64 { return x/n*360 - 180 }
+
+func tileLat(y, n float64) float64 {
+	return math.Atan(math.Sinh(math.Pi*(1-2*y/n))) * 180 / math.Pi
+}
+
+// quadkey is the Bing-style key of tile x,y at zoom z
+func quadkey(z, x, y int) string {
+	var b strings.Builder
+	for i := z; i > 0; i-- {
+		d := byte('0')
+		mask := 1 << (i - 1)
+		if x&mask != 0 {
+			d++
+		}
+		if y&mask != 0 {
+			d += 2
+		}
+		b.WriteByte(d)
+	}
+	return b.String()
+}
+
+// snapBBox grows the bbox to tile boundaries. key names the bucket by the
+// quadkeys of its corner tiles.
+func snapBBox(b BBox) (snapped BBox, key string, ok bool) {
+	if b.MinLon >= b.MaxLon || b.MinLat >= b.MaxLat ||
+		b.MinLat < -maxMercatorLat || b.MaxLat > maxMercatorLat || b.MinLon < -180 || b.MaxLon > 180 {
+		return b, "", false
+	}
+	z := maxBucketZoom
+	for ; z > 0; z-- {
+		n := math.Exp2(float64(z))
+		if tileX(b.MaxLon, n)-tileX(b.MinLon, n) <= 1 && tileY(b.MinLat, n)-tileY(b.MaxLat, n) <= 1 {
+			break
+		}
+	}
+	n := math.Exp2(float64(z))
+	x0, x1 := math.Floor(tileX(b.MinLon, n)), math.Ceil(tileX(b.MaxLon, n))
+	y0, y1 := math.Floor(tileY(b.MaxLat, n)), math.Ceil(tileY(b.MinLat, n))
+	snapped = BBox{MinLon: tileLon(x0, n), MinLat: tileLat(y1, n), MaxLon: tileLon(x1, n), MaxLat: tileLat(y0, n)}
+	key = quadkey(z, int(x0), int(y0)) + "-" + quadkey(z, int(x1)-1, int(y1)-1)
+	return snapped, key, true
+}
+
+// bucketProbe is a bbox inside the bucket snapped to b that snaps back to
+// the same bucket: 0.98 tiles across its centre at the bucket's zoom,
+// narrow enough for that zoom and too wide for the next.
+func bucketProbe(b BBox, key string) BBox {
+	z, _, _ := strings.Cut(key, "-")
+	n := math.Exp2(float64(len(z)))
+	cx := (tileX(b.MinLon, n) + tileX(b.MaxLon, n)) / 2
+	cy := (tileY(b.MinLat, n) + tileY(b.MaxLat, n)) / 2
+	return BBox{MinLon: tileLon(cx-0.49, n), MinLat: tileLat(cy+0.49, n), MaxLon: tileLon(cx+0.49, n), MaxLat: tileLat(cy-0.49, n)}
+}
+
+func getCachedBBox(key string) (*bboxCacheEntry, bool) {
+	bboxCacheMu.Lock()
+	defer bboxCacheMu.Unlock()
+	el, ok := bboxCacheItems[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*bboxCacheEntry)
+	if time.Now().After(e.expires) || e.generation != writeGeneration.Load() {
+		bboxCacheOrder.Remove(el)
+		delete(bboxCacheItems, key)
+		return nil, false
+	}
+	bboxCacheOrder.MoveToFront(el)
+	return e, true
+}
+
+func putCachedBBox(e *bboxCacheEntry) {
+	bboxCacheMu.Lock()
+	defer bboxCacheMu.Unlock()
+	if el, ok := bboxCacheItems[e.key]; ok {
+		bboxCacheOrder.Remove(el)
+	}
+	bboxCacheItems[e.key] = bboxCacheOrder.PushFront(e)
+	for bboxCacheOrder.Len() > bboxCacheEntries {
+		old := bboxCacheOrder.Back()
+		bboxCacheOrder.Remove(old)
+		delete(bboxCacheItems, old.Value.(*bboxCacheEntry).key)
+	}
+}
+
+// bboxCached snaps ?bbox= to its bucket and serves repeated bucket queries
+// from memory. The cache key covers the whole normalized query and the
+// caller, since visibility depends on who asks.
+func bboxCached(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		exact, _ := strconv.ParseBool(query.Get("bbox_exact"))
+		if query.Get("bbox") == "" || exact || query.Get("clip") != "" || query.Get("format") != "" {
+			next(w, r)
+			return
+		}
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(query.Get("bbox"))
+		if !ok {
+			next(w, r)
+			return
+		}
+		snapped, bucket, ok := snapBBox(BBox{minLon, minLat, maxLon, maxLat})
+		if !ok {
+			next(w, r)
+			return
+		}
+		query.Set("bbox", fmt.Sprintf("%.10g,%.10g,%.10g,%.10g", snapped.MinLon, snapped.MinLat, snapped.MaxLon, snapped.MaxLat))
+		r.URL.RawQuery = query.Encode()
+		w.Header().Set(bboxCacheHeader, bucket)
+
+		// envelope responses carry a request id and timing, so they aren't
+		// replayed
+		if bboxCacheTTL <= 0 || bboxCacheEntries <= 0 || wantsEnvelope(r) {
+			next(w, r)
+			return
+		}
+		role := ""
+		if u := currentUser(r); u != nil {
+			role = u.Role
+		}
+		key := userID(r) + "|" + role + "|" + r.URL.RawQuery + "|" + r.Header.Get("Accept-Language")
+		if e, ok := getCachedBBox(key); ok {
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			replayServed(r, e.served)
+			w.Header().Set("X-Cache", "HIT")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		generation := writeGeneration.Load()
+		w.Header().Set("X-Cache", "MISS")
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == http.StatusOK && rec.buf.Len() <= maxCachedBytes {
+			header := rec.Header().Clone()
+			header.Del("X-Cache")
+			header.Del("X-Request-ID")
+			putCachedBBox(&bboxCacheEntry{
+				key: key, generation: generation, expires: time.Now().Add(bboxCacheTTL),
+				status: rec.status, header: header, body: append([]byte(nil), rec.buf.Bytes()...),
+				served: servedBy(r),
+			})
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Benchmarks for the hot geometry paths. Run with
+//
+//	go test -run '^$' -bench . -benchmem
+//
+// and compare against a previous run with benchstat before releasing.
+
+// synthetic polygon ring of n vertices around lon, lat
+func benchRing(lon, lat float64, n int, rng *rand.Rand) []Position {
+	ring := make([]Position, 0, n+1)
+	for i := 0; i < n; i++ {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		r := 0.01 * (0.7 + 0.3*rng.Float64())
+		ring = append(ring, Position{lon + r*math.Cos(a), lat + r*math.Sin(a)})
+	}
+	return append(ring, ring[0])
+}
+
+func benchPoints(n int, rng *rand.Rand) []Position {
+	ps := make([]Position, n)
+	for i := range ps {
+		ps[i] = Position{106.7 + rng.Float64()*0.2, -6.3 + rng.Float64()*0.2}
+	}
+	return ps
+}
+
+func benchFeatures(n int) []FeatureDoc {
+	rng := rand.New(rand.NewSource(1))
+	now := time.Now().UTC()
+	docs := make([]FeatureDoc, n)
+	for i := range docs {
+		g := Geometry{Type: "Polygon", Rings: [][]Position{benchRing(106.7+rng.Float64()*0.2, -6.3+rng.Float64()*0.2, 64, rng)}}
+		docs[i] = FeatureDoc{
+			ID:         primitive.NewObjectID(),
+			Name:       "feature",
+			Layer:      "bench",
+			Geometry:   g.BSON(),
+			Properties: map[string]interface{}{"category": "park", "area": rng.Float64() * 1000},
+			Status:     statusApproved,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+	}
+	return docs
+}
+
+func BenchmarkSerializeFeatureCollection(b *testing.B) {
+	docs := benchFeatures(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		fc := GeoJSONFeatureCollection{Type: "FeatureCollection"}
+		for _, d := range docs {
+			fc.Features = append(fc.Features, featureToGeoJSON(d))
+		}
+		if err := json.NewEncoder(io.Discard).Encode(fc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseGeometry(b *testing.B) {
+	docs := benchFeatures(1000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, d := range docs {
+			if _, err := parseGeometry(d.Geometry); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkValidateGeometry(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	g := Geometry{Type: "Polygon", Rings: [][]Position{benchRing(106.8, -6.2, 10000, rng)}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := g.Validate(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClipPolygon(b *testing.B) {
+	rng := rand.New(rand.NewSource(1))
+	g := Geometry{Type: "Polygon", Rings: [][]Position{benchRing(106.8, -6.2, 10000, rng)}}
+	box := BBox{106.795, -6.205, 106.81, -6.19}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		clipGeometry(g, box)
+	}
+}
+
+func BenchmarkDensifyLine(b *testing.B) {
+	line := benchPoints(1000, rand.New(rand.NewSource(1)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		densifyLine(line, 50)
+	}
+}
+
+func BenchmarkConvexHull(b *testing.B) {
+	ps := benchPoints(10000, rand.New(rand.NewSource(1)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		convexHull(ps)
+	}
+}
+
+func BenchmarkAlphaShape(b *testing.B) {
+	ps := benchPoints(2000, rand.New(rand.NewSource(1)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		alphaShape(ps, 500)
+	}
+}
+
+func BenchmarkVoronoi(b *testing.B) {
+	ps := benchPoints(1000, rand.New(rand.NewSource(1)))
+	boundary := [][][]Position{{{{106.6, -6.4}, {107, -6.4}, {107, -6}, {106.6, -6}, {106.6, -6.4}}}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		voronoiCells(ps, boundary)
+	}
+}
+
+func BenchmarkEncodeVectorTile(b *testing.B) {
+	docs := benchFeatures(1000)
+	gs := make([]Geometry, len(docs))
+	for i, d := range docs {
+		g, err := parseGeometry(d.Geometry)
+		if err != nil {
+			b.Fatal(err)
+		}
+		gs[i] = g
+	}
+	// the z12 tile over the middle of the fixture, a quarter of the features
+	// in it and many of those cut by its edges
+	z := 12
+	n := float64(int(1) << z)
+	x, y := int(tileX(106.8, n)), int(tileY(-6.2, n))
+	box := tileBounds(z, x, y)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, g := range gs {
+			clipped, ok := clipGeometry(g, box)
+			if !ok {
+				continue
+			}
+			m := &mvtGeometry{n: n, x: float64(x), y: float64(y)}
+			m.encode(clipped)
+		}
+	}
+}
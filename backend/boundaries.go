@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// administrative levels from the top of the hierarchy down
+var adminLevels = []string{"province", "city", "district", "village"}
+
+func adminLevelRank(level string) int {
+	for i, l := range adminLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// BoundaryDoc is an administrative area polygon
+type BoundaryDoc struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Code       string             `bson:"code" json:"code"`
+	Name       string             `bson:"name" json:"name"`
+	Level      string             `bson:"level" json:"level"`
+	ParentCode string             `bson:"parent_code,omitempty" json:"parent_code,omitempty"`
+	Geometry   bson.M             `bson:"geometry" json:"geometry"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+var boundaries *mongo.Collection
+
+func setupBoundaries() {
+	boundaries = db.Collection(getenv("MONGO_BOUNDARIES_COLLECTION", "boundaries"))
+	_, err := boundaries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "code", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "parent_code", Value: 1}}},
+		{Keys: bson.D{{Key: "geometry", Value: "2dsphere"}}},
+	})
+	if err != nil {
+		log.Printf("boundaries index create warning: %v", err)
+	}
+}
+
+func boundaryFeature(b BoundaryDoc, withGeometry bool) GeoJSONFeature {
+	var geom interface{}
+	if withGeometry {
+		geom = b.Geometry
+	}
+	return GeoJSONFeature{
+		Type:     "Feature",
+		Geometry: geom,
+		Properties: bson.M{
+			"code":        b.Code,
+			"name":        b.Name,
+			"level":       b.Level,
+			"parent_code": b.ParentCode,
+		},
+	}
+}
+
+func writeBoundaries(w http.ResponseWriter, r *http.Request, filter bson.M) {
+	withGeom, _ := strconv.ParseBool(r.URL.Query().Get("geometry"))
+	opts := options.Find().SetSort(bson.D{{Key: "code", Value: 1}})
+	if !withGeom {
+		opts.SetProjection(bson.M{"geometry": 0})
+	}
+	cur, err := boundaries.Find(ctx, filter, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for cur.Next(ctx) {
+		var b BoundaryDoc
+		if err := cur.Decode(&b); err != nil {
+			log.Println("decode warn:", err)
+			continue
+		}
+		fc.Features = append(fc.Features, boundaryFeature(b, withGeom))
+	}
+	writeCollection(w, r, fc, 0, 0)
+}
+
+// GET /boundaries?level=&parent=&geometry=true
+func listBoundariesHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if level := r.URL.Query().Get("level"); level != "" {
+		filter["level"] = level
+	}
+	if parent := r.URL.Query().Get("parent"); parent != "" {
+		filter["parent_code"] = parent
+	}
+	writeBoundaries(w, r, filter)
+}
+
+// GET /boundaries/{code}/children
+func boundaryChildrenHandler(w http.ResponseWriter, r *http.Request) {
+	writeBoundaries(w, r, bson.M{"parent_code": mux.Vars(r)["code"]})
+}
+
+// GET /boundaries/{code}
+func getBoundaryHandler(w http.ResponseWriter, r *http.Request) {
+	var b BoundaryDoc
+	err := boundaries.FindOne(ctx, bson.M{"code": mux.Vars(r)["code"]}).Decode(&b)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "boundary not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(boundaryFeature(b, true))
+}
+
+// POST /boundaries { code, name, level, parent_code, geojson }
+func createBoundaryHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var body struct {
+		Code       string      `json:"code"`
+		Name       string      `json:"name"`
+		Level      string      `json:"level"`
+		ParentCode string      `json:"parent_code"`
+		GeoJSON    interface{} `json:"geojson"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if body.Code == "" || body.Name == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "code and name required")
+		return
+	}
+	rank := adminLevelRank(body.Level)
+	if rank < 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid level", FieldError{Field: "level", Message: "must be one of province, city, district, village"})
+		return
+	}
+	g, err := parseGeometry(body.GeoJSON)
+	if err != nil || (g.Type != "Polygon" && g.Type != "MultiPolygon") {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid geojson", FieldError{Field: "geojson", Message: "must be a Polygon or MultiPolygon"})
+		return
+	}
+	if rank == 0 && body.ParentCode != "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "provinces cannot have a parent", FieldError{Field: "parent_code", Message: "must be empty for a province"})
+		return
+	}
+	if rank > 0 {
+		var parent BoundaryDoc
+		if err := boundaries.FindOne(ctx, bson.M{"code": body.ParentCode}).Decode(&parent); err != nil {
+			writeError(w, http.StatusBadRequest, "validation_failed", "unknown parent boundary", FieldError{Field: "parent_code", Message: "must reference an existing boundary"})
+			return
+		}
+		if adminLevelRank(parent.Level) != rank-1 {
+			writeError(w, http.StatusBadRequest, "validation_failed", "wrong parent level", FieldError{Field: "parent_code", Message: "a " + body.Level + " must have a " + adminLevels[rank-1] + " parent"})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	doc := BoundaryDoc{
+		Code:       body.Code,
+		Name:       body.Name,
+		Level:      body.Level,
+		ParentCode: body.ParentCode,
+		Geometry:   g.BSON(),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if _, err := boundaries.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "boundary code already exists", FieldError{Field: "code", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bson.M{"code": doc.Code})
+}
+
+// GET /boundaries/resolve?lat=&lon= returns the administrative path
+// (province down to the deepest level) containing the point
+func resolveBoundaryHandler(w http.ResponseWriter, r *http.Request) {
+	lat, err1 := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	lon, err2 := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if err1 != nil || err2 != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "lat and lon required")
+		return
+	}
+	cur, err := boundaries.Find(ctx, bson.M{
+		"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{
+			"type":        "Point",
+			"coordinates": bson.A{lon, lat},
+		}}},
+	}, options.Find().SetProjection(bson.M{"geometry": 0}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	var matches []BoundaryDoc
+	if err := cur.All(ctx, &matches); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db decode error: "+err.Error())
+		return
+	}
+
+	// walk up from the deepest match so the path stays consistent with the
+	// parent links even where polygons overlap slightly
+	var deepest *BoundaryDoc
+	for i := range matches {
+		if deepest == nil || adminLevelRank(matches[i].Level) > adminLevelRank(deepest.Level) {
+			deepest = &matches[i]
+		}
+	}
+	path := []bson.M{}
+	for b := deepest; b != nil; {
+		path = append([]bson.M{{"code": b.Code, "name": b.Name, "level": b.Level}}, path...)
+		if b.ParentCode == "" {
+			break
+		}
+		var parent BoundaryDoc
+		if err := boundaries.FindOne(ctx, bson.M{"code": b.ParentCode}, options.FindOne().SetProjection(bson.M{"geometry": 0})).Decode(&parent); err != nil {
+			break
+		}
+		b = &parent
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"path": path})
+}
+
+// adminAreaFilter returns a geometry condition matching features that
+// intersect the boundary with the given code, mongo.ErrNoDocuments when
+// there is none
+func adminAreaFilter(code string) (bson.M, error) {
+	var b BoundaryDoc
+	if err := boundaries.FindOne(ctx, bson.M{"code": code}).Decode(&b); err != nil {
+		return nil, err
+	}
+	return bson.M{"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": b.Geometry}}}, nil
+}
+
+// writeAdminAreaError reports adminAreaFilter's error for ?admin=code
+func writeAdminAreaError(w http.ResponseWriter, code string, err error) {
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "unknown admin area: "+code, FieldError{Field: "admin", Message: "no boundary with this code"})
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	maxClasses = 12
+	// Jenks is quadratic in the number of values, so larger inputs are
+	// classified on an evenly spaced sample of the sorted values
+	jenksSampleSize = 2000
+)
+
+// ClassBreak is one class of a classification; it can be copied into
+// style.classes of the layer together with a color
+type ClassBreak struct {
+	Label string  `json:"label"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Classification is the response of GET /layers/{id}/classify
+type Classification struct {
+	Layer    string       `json:"layer"`
+	Property string       `json:"property"`
+	Method   string       `json:"method"`
+	Count    int          `json:"count"`
+	Breaks   []float64    `json:"breaks"`
+	Classes  []ClassBreak `json:"classes"`
+	Sampled  bool         `json:"sampled,omitempty"`
+}
+
+// equalIntervalBreaks splits [min,max] into k equal ranges; sorted must not
+// be empty
+func equalIntervalBreaks(sorted []float64, k int) []float64 {
+	lo, hi := sorted[0], sorted[len(sorted)-1]
+	breaks := []float64{lo}
+	for i := 1; i < k; i++ {
+		breaks = append(breaks, lo+(hi-lo)*float64(i)/float64(k))
+	}
+	return append(breaks, hi)
+}
+
+// quantileBreaks puts about the same number of values in each class
+func quantileBreaks(sorted []float64, k int) []float64 {
+	breaks := []float64{sorted[0]}
+	for i := 1; i < k; i++ {
+		breaks = append(breaks, sorted[i*len(sorted)/k])
+	}
+	return append(breaks, sorted[len(sorted)-1])
+}
+
+// jenksBreaks is Fisher-Jenks natural breaks: the split of sorted into k
+// classes with the least total within-class variance
+func jenksBreaks(sorted []float64, k int) []float64 {
+	n := len(sorted)
+	if k >= n {
+		// every value is its own class
+		return append([]float64{sorted[0]}, sorted...)
+	}
+	// lower[i][j]: first index (1-based) of the last class when splitting
+	// the first i values into j classes; cost[i][j]: its variance
+	lower := make([][]int, n+1)
+	cost := make([][]float64, n+1)
+	for i := range lower {
+		lower[i] = make([]int, k+1)
+		cost[i] = make([]float64, k+1)
+		for j := 1; j <= k; j++ {
+			cost[i][j] = math.Inf(1)
+		}
+	}
+	for j := 1; j <= k; j++ {
+		lower[1][j] = 1
+		cost[1][j] = 0
+	}
+	for l := 2; l <= n; l++ {
+		var sum, sumSq, w, variance float64
+		for m := 1; m <= l; m++ {
+			lowIdx := l - m + 1
+			v := sorted[lowIdx-1]
+			w++
+			sum += v
+			sumSq += v * v
+			variance = sumSq - sum*sum/w
+			if i := lowIdx - 1; i != 0 {
+				for j := 2; j <= k; j++ {
+					if c := variance + cost[i][j-1]; cost[l][j] >= c {
+						lower[l][j] = lowIdx
+						cost[l][j] = c
+					}
+				}
+			}
+		}
+		lower[l][1] = 1
+		cost[l][1] = variance
+	}
+	breaks := make([]float64, k+1)
+	breaks[k] = sorted[n-1]
+	breaks[0] = sorted[0]
+	for j, i := k, n; j >= 2; j-- {
+		idx := lower[i][j] - 1
+		breaks[j-1] = sorted[idx]
+		i = idx
+	}
+	return breaks
+}
+
+// sampleSorted keeps size evenly spaced values, including both ends
+func sampleSorted(sorted []float64, size int) []float64 {
+	out := make([]float64, size)
+	for i := range out {
+		out[i] = sorted[i*(len(sorted)-1)/(size-1)]
+	}
+	return out
+}
+
+// classCounts counts values per class; a value on a break belongs to the
+// class above it, except the maximum which closes the last class
+func classCounts(sorted []float64, breaks []float64) []ClassBreak {
+	out := make([]ClassBreak, len(breaks)-1)
+	for i := range out {
+		out[i] = ClassBreak{Min: breaks[i], Max: breaks[i+1]}
+		out[i].Label = strconv.FormatFloat(breaks[i], 'g', 6, 64) + " - " + strconv.FormatFloat(breaks[i+1], 'g', 6, 64)
+	}
+	for _, v := range sorted {
+		c := sort.Search(len(breaks)-1, func(i int) bool { return breaks[i+1] > v })
+		if c >= len(out) {
+			c = len(out) - 1
+		}
+		out[c].Count++
+	}
+	return out
+}
+
+// GET /layers/{id}/classify?property=population&method=equal|quantile|jenks&classes=5
+// Computes class breaks for a numeric property over the layer's visible
+// features; non-numeric values are ignored.
+func classifyHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	prop := query.Get("property")
+	if prop == "" || strings.ContainsAny(prop, "$") || strings.HasPrefix(prop, ".") {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid property", FieldError{Field: "property", Message: "a feature property name is required"})
+		return
+	}
+	method := query.Get("method")
+	if method == "" {
+		method = "jenks"
+	}
+	if method != "equal" && method != "quantile" && method != "jenks" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid method", FieldError{Field: "method", Message: "must be equal, quantile or jenks"})
+		return
+	}
+	k := 5
+	if s := query.Get("classes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 2 || n > maxClasses {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid classes", FieldError{Field: "classes", Message: fmt.Sprintf("must be between 2 and %d", maxClasses)})
+			return
+		}
+		k = n
+	}
+
+	path := "properties." + prop
+	ctx2, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cur, err := readsFor(r).Aggregate(ctx2, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"layer":  layer,
+			"status": bson.M{"$nin": bson.A{statusPending, statusRejected}},
+			path:     bson.M{"$type": "number"},
+		}}},
+		{{Key: "$project", Value: bson.M{"_id": 0, "v": bson.M{"$toDouble": "$" + path}}}},
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	defer cur.Close(ctx2)
+	var values []float64
+	for cur.Next(ctx2) {
+		var row struct {
+			V float64 `bson:"v"`
+		}
+		if err := cur.Decode(&row); err == nil && !math.IsNaN(row.V) && !math.IsInf(row.V, 0) {
+			values = append(values, row.V)
+		}
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db cursor error: "+err.Error())
+		return
+	}
+	if len(values) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "no numeric values for "+prop+" in layer "+layer)
+		return
+	}
+	sort.Float64s(values)
+
+	out := Classification{Layer: layer, Property: prop, Method: method, Count: len(values)}
+	var breaks []float64
+	ok := runGeometry(w, r, func() {
+		switch method {
+		case "equal":
+			breaks = equalIntervalBreaks(values, k)
+		case "quantile":
+			breaks = quantileBreaks(values, k)
+		case "jenks":
+			sample := values
+			if len(sample) > jenksSampleSize {
+				sample, out.Sampled = sampleSorted(values, jenksSampleSize), true
+			}
+			breaks = jenksBreaks(sample, k)
+		}
+	})
+	if !ok {
+		return
+	}
+	// ties can repeat a break; merge the empty classes they would make
+	uniq := breaks[:1]
+	for _, b := range breaks[1:] {
+		if b > uniq[len(uniq)-1] {
+			uniq = append(uniq, b)
+		}
+	}
+	if len(uniq) == 1 {
+		uniq = append(uniq, uniq[0])
+	}
+	out.Breaks = uniq
+	out.Classes = classCounts(values, uniq)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,207 @@
+package main
+
+// BBox is an axis-aligned lon/lat rectangle
+type BBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+func (b BBox) contains(p Position) bool {
+	return p[0] >= b.MinLon && p[0] <= b.MaxLon && p[1] >= b.MinLat && p[1] <= b.MaxLat
+}
+
+// lerp interpolates every shared dimension, so altitudes survive clipping
+func lerp(a, b Position, t float64) Position {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	p := make(Position, n)
+	for i := 0; i < n; i++ {
+		p[i] = a[i] + t*(b[i]-a[i])
+	}
+	return p
+}
+
+// clipSegment clips a-b to the box (Liang-Barsky)
+func clipSegment(a, b Position, box BBox) (Position, Position, bool) {
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	t0, t1 := 0.0, 1.0
+	edges := [4][2]float64{
+		{-dx, a[0] - box.MinLon},
+		{dx, box.MaxLon - a[0]},
+		{-dy, a[1] - box.MinLat},
+		{dy, box.MaxLat - a[1]},
+	}
+	for _, e := range edges {
+		p, q := e[0], e[1]
+		if p == 0 {
+			if q < 0 {
+				return nil, nil, false
+			}
+			continue
+		}
+		t := q / p
+		if p < 0 {
+			if t > t1 {
+				return nil, nil, false
+			}
+			if t > t0 {
+				t0 = t
+			}
+		} else {
+			if t < t0 {
+				return nil, nil, false
+			}
+			if t < t1 {
+				t1 = t
+			}
+		}
+	}
+	return lerp(a, b, t0), lerp(a, b, t1), true
+}
+
+func samePosition(a, b Position) bool {
+	return a[0] == b[0] && a[1] == b[1]
+}
+
+// clipLine returns the pieces of the line inside the box
+func clipLine(ps []Position, box BBox) [][]Position {
+	var parts [][]Position
+	var cur []Position
+	for i := 0; i+1 < len(ps); i++ {
+		a, b, ok := clipSegment(ps[i], ps[i+1], box)
+		if !ok {
+			if len(cur) > 1 {
+				parts = append(parts, cur)
+			}
+			cur = nil
+			continue
+		}
+		if len(cur) == 0 || !samePosition(cur[len(cur)-1], a) {
+			if len(cur) > 1 {
+				parts = append(parts, cur)
+			}
+			cur = []Position{a}
+		}
+		cur = append(cur, b)
+		// the segment left the box, the next one starts a new piece
+		if !samePosition(b, ps[i+1]) {
+			parts = append(parts, cur)
+			cur = nil
+		}
+	}
+	if len(cur) > 1 {
+		parts = append(parts, cur)
+	}
+	return parts
+}
+
+// clipRing clips a closed ring against the box (Sutherland-Hodgman). The
+// result is closed again, or nil when nothing is left.
+func clipRing(ring []Position, box BBox) []Position {
+	type edge struct {
+		inside    func(Position) bool
+		intersect func(a, b Position) Position
+	}
+	at := func(a, b Position, v float64, dim int) Position {
+		return lerp(a, b, (v-a[dim])/(b[dim]-a[dim]))
+	}
+	edges := []edge{
+		{func(p Position) bool { return p[0] >= box.MinLon }, func(a, b Position) Position { return at(a, b, box.MinLon, 0) }},
+		{func(p Position) bool { return p[0] <= box.MaxLon }, func(a, b Position) Position { return at(a, b, box.MaxLon, 0) }},
+		{func(p Position) bool { return p[1] >= box.MinLat }, func(a, b Position) Position { return at(a, b, box.MinLat, 1) }},
+		{func(p Position) bool { return p[1] <= box.MaxLat }, func(a, b Position) Position { return at(a, b, box.MaxLat, 1) }},
+	}
+
+	out := ring
+	if len(out) > 1 && samePosition(out[0], out[len(out)-1]) {
+		out = out[:len(out)-1]
+	}
+	for _, e := range edges {
+		in := out
+		out = nil
+		for i := range in {
+			cur, prev := in[i], in[(i+len(in)-1)%len(in)]
+			if e.inside(cur) {
+				if !e.inside(prev) {
+					out = append(out, e.intersect(prev, cur))
+				}
+				out = append(out, cur)
+			} else if e.inside(prev) {
+				out = append(out, e.intersect(prev, cur))
+			}
+		}
+		if len(out) == 0 {
+			return nil
+		}
+	}
+	if len(out) < 3 {
+		return nil
+	}
+	return append(out, out[0])
+}
+
+// clipPolygon clips the outer ring and holes; nil if the outer ring vanished
+func clipPolygon(rings [][]Position, box BBox) [][]Position {
+	var out [][]Position
+	for i, r := range rings {
+		c := clipRing(r, box)
+		if c == nil {
+			if i == 0 {
+				return nil
+			}
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// clipGeometry clips g to the box. ok is false when nothing remains.
+func clipGeometry(g Geometry, box BBox) (Geometry, bool) {
+	switch g.Type {
+	case "Point":
+		return g, box.contains(g.Point)
+	case "MultiPoint":
+		var pts []Position
+		for _, p := range g.Points {
+			if box.contains(p) {
+				pts = append(pts, p)
+			}
+		}
+		return Geometry{Type: g.Type, Points: pts}, len(pts) > 0
+	case "LineString", "MultiLineString":
+		lines := [][]Position{g.Points}
+		if g.Type == "MultiLineString" {
+			lines = g.Rings
+		}
+		var parts [][]Position
+		for _, l := range lines {
+			parts = append(parts, clipLine(l, box)...)
+		}
+		if len(parts) == 1 {
+			return Geometry{Type: "LineString", Points: parts[0]}, true
+		}
+		return Geometry{Type: "MultiLineString", Rings: parts}, len(parts) > 0
+	case "Polygon":
+		rings := clipPolygon(g.Rings, box)
+		return Geometry{Type: g.Type, Rings: rings}, rings != nil
+	case "MultiPolygon":
+		var polys [][][]Position
+		for _, p := range g.Polygons {
+			if c := clipPolygon(p, box); c != nil {
+				polys = append(polys, c)
+			}
+		}
+		return Geometry{Type: g.Type, Polygons: polys}, len(polys) > 0
+	case "GeometryCollection":
+		var children []Geometry
+		for _, c := range g.Geometries {
+			if cc, ok := clipGeometry(c, box); ok {
+				children = append(children, cc)
+			}
+		}
+		return Geometry{Type: g.Type, Geometries: children}, len(children) > 0
+	}
+	return g, false
+}
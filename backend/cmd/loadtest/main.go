@@ -0,0 +1,238 @@
+// Command loadtest seeds synthetic features into a running backend and
+// measures the latency of its key queries.
+//
+//	go run ./cmd/loadtest -url http://localhost:8080 -features 20000 -requests 500 -c 8
+//
+// Features go into a fresh layer (loadtest-<timestamp>) which is removed
+// afterwards unless -keep is given. Exit status is 1 when any query's p99
+// exceeds -max-p99.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	baseURL  = flag.String("url", "http://localhost:8080", "backend base URL")
+	token    = flag.String("token", os.Getenv("LOADTEST_TOKEN"), "bearer token (editor role) when auth is enabled")
+	features = flag.Int("features", 10000, "synthetic features to seed")
+	requests = flag.Int("requests", 300, "requests per query")
+	conc     = flag.Int("c", 8, "concurrent clients")
+	keep     = flag.Bool("keep", false, "keep the seeded layer")
+	maxP99   = flag.Duration("max-p99", 0, "fail when a query's p99 is above this (0 = report only)")
+	minLon   = flag.Float64("min-lon", 106.7, "west edge of the seed area (default around Jakarta)")
+	minLat   = flag.Float64("min-lat", -6.35, "south edge of the seed area")
+	span     = flag.Float64("span", 0.25, "width and height of the seed area in degrees")
+)
+
+var client = &http.Client{Timeout: 60 * time.Second}
+
+func do(method, path string, body interface{}) (int, []byte, error) {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, *baseURL+path, rd)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	return res.StatusCode, b, err
+}
+
+func randomPoint(rng *rand.Rand) []float64 {
+	return []float64{*minLon + rng.Float64()**span, *minLat + rng.Float64()**span}
+}
+
+func seed(layer string) {
+	rng := rand.New(rand.NewSource(1))
+	categories := []string{"school", "clinic", "park", "market", "mosque", "office"}
+	const batch = 2000
+	start := time.Now()
+	for done := 0; done < *features; done += batch {
+		n := min(batch, *features-done)
+		fs := make([]map[string]interface{}, n)
+		for i := range fs {
+			var geom map[string]interface{}
+			switch i % 10 {
+			case 0: // a small square polygon now and then
+				p := randomPoint(rng)
+				d := 0.001
+				geom = map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{{
+					{p[0], p[1]}, {p[0] + d, p[1]}, {p[0] + d, p[1] + d}, {p[0], p[1] + d}, {p[0], p[1]},
+				}}}
+			default:
+				geom = map[string]interface{}{"type": "Point", "coordinates": randomPoint(rng)}
+			}
+			fs[i] = map[string]interface{}{
+				"type":     "Feature",
+				"geometry": geom,
+				"properties": map[string]interface{}{
+					"name":     fmt.Sprintf("synthetic %d", done+i),
+					"category": categories[rng.Intn(len(categories))],
+					"value":    rng.Float64() * 100,
+				},
+			}
+		}
+		status, body, err := do("POST", "/import/geojson?layer="+url.QueryEscape(layer), map[string]interface{}{"type": "FeatureCollection", "features": fs})
+		if err != nil || status != http.StatusOK {
+			log.Fatalf("seed failed: status %d: %v %s", status, err, body)
+		}
+	}
+	log.Printf("seeded %d features into %s in %s", *features, layer, time.Since(start).Round(time.Millisecond))
+}
+
+type query struct {
+	name string
+	run  func(rng *rand.Rand) (int, error)
+}
+
+func queries(layer string) []query {
+	lq := url.QueryEscape(layer)
+	get := func(path string) (int, error) {
+		status, _, err := do("GET", path, nil)
+		return status, err
+	}
+	return []query{
+		{"bbox", func(rng *rand.Rand) (int, error) {
+			p := randomPoint(rng)
+			return get(fmt.Sprintf("/features?layer=%s&bbox=%f,%f,%f,%f&limit=500", lq, p[0], p[1], p[0]+0.02, p[1]+0.02))
+		}},
+		{"near", func(rng *rand.Rand) (int, error) {
+			p := randomPoint(rng)
+			return get(fmt.Sprintf("/features?layer=%s&near=%f,%f&radius=1km&limit=100", lq, p[1], p[0]))
+		}},
+		{"layer_sorted", func(rng *rand.Rand) (int, error) {
+			return get(fmt.Sprintf("/features?layer=%s&sort=-created_at,name&limit=100&offset=%d", lq, rng.Intn(max(1, *features-100))))
+		}},
+		{"clip", func(rng *rand.Rand) (int, error) {
+			p := randomPoint(rng)
+			return get(fmt.Sprintf("/features?layer=%s&clip=bbox&bbox=%f,%f,%f,%f&limit=500", lq, p[0], p[1], p[0]+0.01, p[1]+0.01))
+		}},
+		{"hull", func(rng *rand.Rand) (int, error) {
+			p := randomPoint(rng)
+			status, _, err := do("POST", "/analysis/hull", map[string]interface{}{
+				"filter": map[string]string{"layer": layer, "bbox": fmt.Sprintf("%f,%f,%f,%f", p[0], p[1], p[0]+0.05, p[1]+0.05)},
+			})
+			return status, err
+		}},
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func measure(q query) (lat []time.Duration, errors int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for c := 0; c < *conc; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(c) + 1))
+			for range next {
+				start := time.Now()
+				status, err := q.run(rng)
+				d := time.Since(start)
+				mu.Lock()
+				// 422 from the hull on an empty area is a valid answer
+				if err != nil || status >= 500 || (status >= 400 && status != http.StatusUnprocessableEntity) {
+					errors++
+				} else {
+					lat = append(lat, d)
+				}
+				mu.Unlock()
+			}
+		}(c)
+	}
+	for i := 0; i < *requests; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	return lat, errors
+}
+
+func cleanup(layer string) {
+	path := "/layers/" + url.PathEscape(layer) + "/features"
+	status, body, err := do("DELETE", path+"?dryRun=true", nil)
+	if err != nil || status != http.StatusOK {
+		log.Printf("cleanup dry run failed: status %d: %v %s", status, err, body)
+		return
+	}
+	var dry struct {
+		ConfirmToken string `json:"confirm_token"`
+	}
+	json.Unmarshal(body, &dry)
+	status, body, err = do("DELETE", path+"?confirm="+url.QueryEscape(dry.ConfirmToken), nil)
+	if err != nil || status != http.StatusOK {
+		log.Printf("cleanup failed: status %d: %v %s", status, err, body)
+		return
+	}
+	log.Printf("removed layer %s", layer)
+}
+
+func main() {
+	flag.Parse()
+	layer := fmt.Sprintf("loadtest-%d", time.Now().Unix())
+	seed(layer)
+	if !*keep {
+		defer cleanup(layer)
+	}
+
+	failed := false
+	fmt.Printf("%-14s %8s %10s %10s %10s %10s %7s\n", "query", "ok", "p50", "p95", "p99", "max", "errors")
+	for _, q := range queries(layer) {
+		lat, errs := measure(q)
+		p99 := percentile(lat, 0.99)
+		var maxLat time.Duration
+		if len(lat) > 0 {
+			maxLat = lat[len(lat)-1]
+		}
+		fmt.Printf("%-14s %8d %10s %10s %10s %10s %7d\n", q.name, len(lat),
+			percentile(lat, 0.5).Round(time.Microsecond*100), percentile(lat, 0.95).Round(time.Microsecond*100),
+			p99.Round(time.Microsecond*100), maxLat.Round(time.Microsecond*100), errs)
+		if errs > 0 || (*maxP99 > 0 && p99 > *maxP99) {
+			failed = true
+		}
+	}
+	if failed {
+		// run the deferred cleanup before exiting
+		if !*keep {
+			cleanup(layer)
+		}
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Identical listing requests that arrive while one is already running share
+// its result instead of each running the query: when many clients pan to the
+// same bucket at once, Mongo sees one find. Counters are published under
+// request_coalescing in /admin/metrics; REQUEST_COALESCING=false turns it off.
+var (
+	listFlights     singleflight.Group
+	coalesceEnabled = true
+
+	coalesceExecuted  atomic.Int64
+	coalesceCoalesced atomic.Int64
+)
+
+func setupCoalescing() {
+	coalesceEnabled = getenv("REQUEST_COALESCING", "true") != "false"
+	expvar.Publish("request_coalescing", expvar.Func(func() interface{} {
+		return map[string]int64{
+			"executed":  coalesceExecuted.Load(),
+			"coalesced": coalesceCoalesced.Load(),
+		}
+	}))
+}
+
+// flightResult is the response the leading request produced
+type flightResult struct {
+	status int
+	header http.Header
+	body   []byte
+	served *accessTally
+}
+
+// coalesced runs next once per distinct caller and query among concurrent
+// requests. Streaming exports and envelope responses (which carry the request
+// id) always run on their own.
+func coalesced(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !coalesceEnabled || r.Method != http.MethodGet || r.URL.Query().Get("format") != "" || wantsEnvelope(r) {
+			next(w, r)
+			return
+		}
+		role := ""
+		if u := currentUser(r); u != nil {
+			role = u.Role
+		}
+		key := r.URL.Path + "|" + userID(r) + "|" + role + "|" + r.URL.RawQuery + "|" + r.Header.Get("Accept-Language")
+
+		leader := false
+		v, _, _ := listFlights.Do(key, func() (interface{}, error) {
+			leader = true
+			coalesceExecuted.Add(1)
+			rec := &responseRecorder{ResponseWriter: w}
+			next(rec, r)
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			header := rec.Header().Clone()
+			header.Del("X-Request-ID")
+			return &flightResult{status: rec.status, header: header, body: rec.buf.Bytes(), served: servedBy(r)}, nil
+		})
+		if leader {
+			return
+		}
+		coalesceCoalesced.Add(1)
+		res := v.(*flightResult)
+		replayServed(r, res.served)
+		for k, vals := range res.header {
+			if _, set := w.Header()[k]; !set {
+				w.Header()[k] = vals
+			}
+		}
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Concerns per endpoint class, all optional (unset keeps the connection
+// string's defaults):
+//
+//	EDIT_WRITE_CONCERN    majority | <n> | <tag>   writes to features
+//	EDIT_WRITE_JOURNAL    true | false
+//	EDIT_WRITE_TIMEOUT    duration, e.g. 5s
+//	READ_CONCERN          local | available | majority | linearizable | snapshot
+//	                      listings and single-feature reads
+//	HEAVY_READ_CONCERN    same levels, exports and analytics (see readsFor)
+//
+// Typical: EDIT_WRITE_CONCERN=majority with HEAVY_READ_CONCERN=local, so
+// edits survive a failover while exports don't wait on majority commits.
+
+// ConcernSettings is the effective configuration, published under
+// mongo_concerns in /admin/metrics
+type ConcernSettings struct {
+	EditWrite string `json:"edit_write"`
+	Read      string `json:"read"`
+	HeavyRead string `json:"heavy_read"`
+}
+
+var concernSettings = ConcernSettings{EditWrite: "default", Read: "default", HeavyRead: "default"}
+
+func parseWriteConcern(w, journal, timeout string) (*writeconcern.WriteConcern, error) {
+	wc := &writeconcern.WriteConcern{}
+	switch n, err := strconv.Atoi(w); {
+	case w == "majority":
+		wc.W = "majority"
+	case err == nil:
+		if n < 0 {
+			return nil, fmt.Errorf("w must not be negative")
+		}
+		wc.W = n
+	default:
+		// a tag set defined on the replica set
+		wc.W = w
+	}
+	if journal != "" {
+		j, err := strconv.ParseBool(journal)
+		if err != nil {
+			return nil, fmt.Errorf("invalid journal %q", journal)
+		}
+		wc.Journal = &j
+	}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout %q", timeout)
+		}
+		wc.WTimeout = d
+	}
+	if !wc.IsValid() {
+		return nil, fmt.Errorf("w=0 cannot be journaled")
+	}
+	return wc, nil
+}
+
+func parseReadConcern(level string) (*readconcern.ReadConcern, error) {
+	switch level {
+	case "local", "available", "majority", "linearizable", "snapshot":
+		return &readconcern.ReadConcern{Level: level}, nil
+	}
+	return nil, fmt.Errorf("unknown read concern %q", level)
+}
+
+// setupConcerns applies EDIT_WRITE_CONCERN and READ_CONCERN to the features
+// collection. It runs before the other setups so everything that keeps the
+// collection handle shares them.
+func setupConcerns() {
+	expvar.Publish("mongo_concerns", expvar.Func(func() interface{} { return concernSettings }))
+	opts := options.Collection()
+	changed := false
+	if w := getenv("EDIT_WRITE_CONCERN", ""); w != "" {
+		journal, timeout := getenv("EDIT_WRITE_JOURNAL", ""), getenv("EDIT_WRITE_TIMEOUT", "")
+		if wc, err := parseWriteConcern(w, journal, timeout); err != nil {
+			log.Printf("EDIT_WRITE_CONCERN: %v, ignored", err)
+		} else {
+			opts.SetWriteConcern(wc)
+			concernSettings.EditWrite = "w=" + w
+			if journal != "" {
+				concernSettings.EditWrite += " j=" + journal
+			}
+			if timeout != "" {
+				concernSettings.EditWrite += " wtimeout=" + timeout
+			}
+			changed = true
+		}
+	}
+	if level := getenv("READ_CONCERN", ""); level != "" {
+		if rc, err := parseReadConcern(level); err != nil {
+			log.Printf("READ_CONCERN: %v, ignored", err)
+		} else {
+			opts.SetReadConcern(rc)
+			concernSettings.Read = level
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	c, err := collection.Clone(opts)
+	if err != nil {
+		log.Printf("collection concerns: %v, using defaults", err)
+		concernSettings.EditWrite, concernSettings.Read = "default", "default"
+		return
+	}
+	collection = c
+	log.Printf("features collection: write concern %s, read concern %s", concernSettings.EditWrite, concernSettings.Read)
+}
+
+// heavyReadConcern applies HEAVY_READ_CONCERN on top of c
+func heavyReadConcern(c *mongo.Collection) *mongo.Collection {
+	concernSettings.HeavyRead = concernSettings.Read
+	level := getenv("HEAVY_READ_CONCERN", "")
+	if level == "" {
+		return c
+	}
+	rc, err := parseReadConcern(level)
+	if err != nil {
+		log.Printf("HEAVY_READ_CONCERN: %v, ignored", err)
+		return c
+	}
+	hc, err := c.Clone(options.Collection().SetReadConcern(rc))
+	if err != nil {
+		log.Printf("heavy read concern: %v, ignored", err)
+		return c
+	}
+	concernSettings.HeavyRead = level
+	return hc
+}
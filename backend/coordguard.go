@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Coordinate sanity checks catch the usual data-entry mistakes: points at
+// (0,0), lat and lon swapped, and points far outside the area the deployment
+// covers. COORD_GUARD picks what happens when one fires: "warn" (default)
+// stores the feature and reports warnings, "reject" refuses it, "off" skips
+// the checks. ?coord_guard= overrides it per request.
+var (
+	coordGuardMode = "warn"
+	// coordExtent is the expected data area from COORD_EXTENT
+	// (minLon,minLat,maxLon,maxLat); nil disables the extent check
+	coordExtent *BBox
+)
+
+func setupCoordGuard() {
+	switch m := getenv("COORD_GUARD", coordGuardMode); m {
+	case "off", "warn", "reject":
+		coordGuardMode = m
+	default:
+		log.Printf("COORD_GUARD %q unknown, using %s", m, coordGuardMode)
+	}
+	if spec := getenv("COORD_EXTENT", ""); spec != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(spec)
+		if !ok {
+			log.Printf("COORD_EXTENT %q is not minLon,minLat,maxLon,maxLat; extent check disabled", spec)
+			return
+		}
+		coordExtent = &BBox{MinLon: minLon, MinLat: minLat, MaxLon: maxLon, MaxLat: maxLat}
+	}
+}
+
+func coordGuardFor(r *http.Request) string {
+	switch m := r.URL.Query().Get("coord_guard"); m {
+	case "off", "warn", "reject":
+		return m
+	}
+	return coordGuardMode
+}
+
+// swappedHint explains a range error when the position would be valid with
+// its axes swapped
+func swappedHint(p Position) string {
+	if math.Abs(p[1]) > 90 && math.Abs(p[0]) <= 90 && math.Abs(p[1]) <= 180 {
+		return fmt.Sprintf("; lat and lon look swapped (got lon %v, lat %v)", p[0], p[1])
+	}
+	return ""
+}
+
+// suspiciousCoordinates lists what looks wrong with an otherwise valid
+// geometry
+func suspiciousCoordinates(g Geometry) []string {
+	var out []string
+	var nullIsland, outside, swapped int
+	for _, p := range g.allPositions() {
+		if p[0] == 0 && p[1] == 0 {
+			nullIsland++
+			continue
+		}
+		if coordExtent != nil && !coordExtent.contains(p) {
+			outside++
+			if coordExtent.contains(Position{p[1], p[0]}) {
+				swapped++
+			}
+		}
+	}
+	if nullIsland > 0 {
+		out = append(out, fmt.Sprintf("%d position(s) at 0,0 (null island)", nullIsland))
+	}
+	if swapped > 0 {
+		out = append(out, fmt.Sprintf("%d position(s) fall inside the expected extent only with lat and lon swapped", swapped))
+	} else if outside > 0 {
+		out = append(out, fmt.Sprintf("%d position(s) outside the expected extent %v,%v,%v,%v", outside,
+			coordExtent.MinLon, coordExtent.MinLat, coordExtent.MaxLon, coordExtent.MaxLat))
+	}
+	return out
+}
+
+// guardCoordinates runs the sanity checks for r. In reject mode the
+// problems come back as an error, in warn mode as warnings.
+func guardCoordinates(r *http.Request, g Geometry) (warnings []string, err error) {
+	mode := coordGuardFor(r)
+	if mode == "off" {
+		return nil, nil
+	}
+	problems := suspiciousCoordinates(g)
+	if len(problems) == 0 {
+		return nil, nil
+	}
+	if mode == "reject" {
+		return nil, fmt.Errorf("suspicious coordinates: %s (send coord_guard=warn to store anyway)", problems[0])
+	}
+	return problems, nil
+}
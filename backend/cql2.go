@@ -0,0 +1,655 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CQL2 filters (OGC API - Features Part 3) on listings:
+//
+//	?filter=category = 'school' AND S_INTERSECTS(geometry, BBOX(106.8,-6.3,106.9,-6.1))
+//	?filter-lang=cql2-json&filter={"op":"=","args":[{"property":"category"},"school"]}
+//
+// Supported: comparisons, LIKE, IN, BETWEEN, IS NULL, AND/OR/NOT, TIMESTAMP
+// and DATE literals, and S_INTERSECTS, S_WITHIN and S_DISJOINT against WKT,
+// GeoJSON or BBOX geometries in CRS84. Text filters are parsed into the
+// cql2-json form, which is then compiled to a Mongo filter.
+
+// parseCQL2 compiles a filter in the given language
+func parseCQL2(filter, lang string) (bson.M, error) {
+	var ast interface{}
+	switch lang {
+	case "", "cql2-text":
+		toks, err := tokenizeWhere(filter)
+		if err != nil {
+			return nil, err
+		}
+		p := &cqlParser{whereParser{toks: toks}}
+		if ast, err = p.or(); err != nil {
+			return nil, err
+		}
+		if p.pos < len(p.toks) {
+			return nil, fmt.Errorf("unexpected %q", p.peek().text)
+		}
+	case "cql2-json":
+		dec := json.NewDecoder(strings.NewReader(filter))
+		dec.UseNumber()
+		if err := dec.Decode(&ast); err != nil {
+			return nil, fmt.Errorf("invalid cql2-json: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("filter-lang must be cql2-text or cql2-json")
+	}
+	return compileCQL2(ast)
+}
+
+/* ---------------- cql2-text → cql2-json ---------------- */
+
+type cqlParser struct{ whereParser }
+
+func cqlOp(op string, args ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"op": op, "args": args}
+}
+
+func (p *cqlParser) isWord(word string) bool {
+	t := p.peek()
+	return (t.kind == "ident" || t.kind == "kw") && strings.EqualFold(t.text, word)
+}
+
+func (p *cqlParser) acceptWord(word string) bool {
+	if p.isWord(word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *cqlParser) or() (interface{}, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptWord("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = cqlOp("or", left, right)
+	}
+	return left, nil
+}
+
+func (p *cqlParser) and() (interface{}, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptWord("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = cqlOp("and", left, right)
+	}
+	return left, nil
+}
+
+func (p *cqlParser) not() (interface{}, error) {
+	if p.acceptWord("NOT") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return cqlOp("not", e), nil
+	}
+	if p.accept("punct", "(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept("punct", ")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	}
+	return p.predicate()
+}
+
+func (p *cqlParser) predicate() (interface{}, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := left.(map[string]interface{}); ok {
+		if op, _ := m["op"].(string); strings.HasPrefix(op, "s_") {
+			return left, nil
+		}
+	}
+	if b, ok := left.(bool); ok {
+		return b, nil
+	}
+	negate := p.acceptWord("NOT")
+	wrap := func(e interface{}) interface{} {
+		if negate {
+			return cqlOp("not", e)
+		}
+		return e
+	}
+	switch {
+	case p.acceptWord("LIKE"):
+		pat, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return wrap(cqlOp("like", left, pat)), nil
+	case p.acceptWord("IN"):
+		if !p.accept("punct", "(") {
+			return nil, fmt.Errorf("expected ( after IN")
+		}
+		var list []interface{}
+		for {
+			v, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			if p.accept("punct", ")") {
+				break
+			}
+			if !p.accept("punct", ",") {
+				return nil, fmt.Errorf("expected , or ) in IN list")
+			}
+		}
+		return wrap(cqlOp("in", left, list)), nil
+	case p.acceptWord("BETWEEN"):
+		lo, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		if !p.acceptWord("AND") {
+			return nil, fmt.Errorf("expected AND in BETWEEN")
+		}
+		hi, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		return wrap(cqlOp("between", left, lo, hi)), nil
+	case p.acceptWord("IS"):
+		if negate {
+			return nil, fmt.Errorf("unexpected NOT before IS")
+		}
+		not := p.acceptWord("NOT")
+		if !p.acceptWord("NULL") {
+			return nil, fmt.Errorf("expected NULL after IS")
+		}
+		e := cqlOp("isNull", left)
+		if not {
+			return cqlOp("not", e), nil
+		}
+		return e, nil
+	}
+	if negate {
+		return nil, fmt.Errorf("NOT must be followed by LIKE, IN or BETWEEN here")
+	}
+	op := p.next()
+	if op.kind != "op" {
+		return nil, fmt.Errorf("expected an operator, got %q", op.text)
+	}
+	if op.text == "!=" {
+		op.text = "<>"
+	}
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	return cqlOp(op.text, left, right), nil
+}
+
+func (p *cqlParser) operand() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case "str":
+		return t.text, nil
+	case "num":
+		return json.Number(t.text), nil
+	case "kw":
+		switch t.text {
+		case "TRUE":
+			return true, nil
+		case "FALSE":
+			return false, nil
+		}
+		return nil, fmt.Errorf("unexpected %s", t.text)
+	case "ident":
+	case "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	default:
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	if p.peek().kind != "punct" || p.peek().text != "(" {
+		return map[string]interface{}{"property": t.text}, nil
+	}
+	name := strings.ToUpper(t.text)
+	switch name {
+	case "POINT", "LINESTRING", "POLYGON", "MULTIPOINT", "MULTILINESTRING", "MULTIPOLYGON":
+		return p.wkt(name)
+	}
+	p.pos++ // (
+	var args []interface{}
+	if !p.accept("punct", ")") {
+		for {
+			a, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, a)
+			if p.accept("punct", ")") {
+				break
+			}
+			if !p.accept("punct", ",") {
+				return nil, fmt.Errorf("expected , or ) in %s()", name)
+			}
+		}
+	}
+	switch name {
+	case "TIMESTAMP", "DATE":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one string", name)
+		}
+		return map[string]interface{}{strings.ToLower(name): args[0]}, nil
+	case "BBOX":
+		return map[string]interface{}{"bbox": args}, nil
+	case "S_INTERSECTS", "S_WITHIN", "S_DISJOINT", "S_CONTAINS", "S_EQUALS", "S_TOUCHES", "S_OVERLAPS", "S_CROSSES":
+		return cqlOp(strings.ToLower(name), args...), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", name)
+}
+
+func (p *cqlParser) coord() ([]interface{}, error) {
+	var c []interface{}
+	for p.peek().kind == "num" {
+		f, err := strconv.ParseFloat(p.next().text, 64)
+		if err != nil {
+			return nil, err
+		}
+		c = append(c, f)
+	}
+	if len(c) < 2 {
+		return nil, fmt.Errorf("WKT coordinate needs x and y")
+	}
+	return c, nil
+}
+
+// coordList parses "(x y, x y, ...)"; points of a MULTIPOINT may also be
+// wrapped in their own parentheses
+func (p *cqlParser) coordList() ([]interface{}, error) {
+	if !p.accept("punct", "(") {
+		return nil, fmt.Errorf("expected ( in WKT")
+	}
+	var out []interface{}
+	for {
+		wrapped := p.accept("punct", "(")
+		c, err := p.coord()
+		if err != nil {
+			return nil, err
+		}
+		if wrapped && !p.accept("punct", ")") {
+			return nil, fmt.Errorf("expected ) in WKT")
+		}
+		out = append(out, c)
+		if p.accept("punct", ")") {
+			return out, nil
+		}
+		if !p.accept("punct", ",") {
+			return nil, fmt.Errorf("expected , or ) in WKT")
+		}
+	}
+}
+
+// nested parses depth levels of parenthesised coordinate lists
+func (p *cqlParser) nested(depth int) ([]interface{}, error) {
+	if depth == 1 {
+		return p.coordList()
+	}
+	if !p.accept("punct", "(") {
+		return nil, fmt.Errorf("expected ( in WKT")
+	}
+	var out []interface{}
+	for {
+		part, err := p.nested(depth - 1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, part)
+		if p.accept("punct", ")") {
+			return out, nil
+		}
+		if !p.accept("punct", ",") {
+			return nil, fmt.Errorf("expected , or ) in WKT")
+		}
+	}
+}
+
+func (p *cqlParser) wkt(kind string) (interface{}, error) {
+	types := map[string]string{
+		"POINT": "Point", "LINESTRING": "LineString", "POLYGON": "Polygon",
+		"MULTIPOINT": "MultiPoint", "MULTILINESTRING": "MultiLineString", "MULTIPOLYGON": "MultiPolygon",
+	}
+	// the Z tag is optional, the coordinates say whether there are altitudes
+	if t := p.peek(); t.kind != "str" && strings.EqualFold(t.text, "Z") {
+		p.next()
+	}
+	var coords interface{}
+	var err error
+	switch kind {
+	case "POINT":
+		var list []interface{}
+		if list, err = p.coordList(); err == nil {
+			if len(list) != 1 {
+				return nil, fmt.Errorf("POINT takes one coordinate")
+			}
+			coords = list[0]
+		}
+	case "LINESTRING", "MULTIPOINT":
+		coords, err = p.coordList()
+	case "POLYGON", "MULTILINESTRING":
+		coords, err = p.nested(2)
+	case "MULTIPOLYGON":
+		coords, err = p.nested(3)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"type": types[kind], "coordinates": coords}, nil
+}
+
+// parseWKT reads a WKT geometry on its own, such as a CSV cell, into
+// GeoJSON
+func parseWKT(s string) (map[string]interface{}, error) {
+	toks, err := tokenizeWhere(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &cqlParser{whereParser{toks: toks}}
+	kind := strings.ToUpper(p.next().text)
+	switch kind {
+	case "POINT", "LINESTRING", "POLYGON", "MULTIPOINT", "MULTILINESTRING", "MULTIPOLYGON":
+	default:
+		return nil, fmt.Errorf("not a WKT geometry")
+	}
+	g, err := p.wkt(kind)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q after WKT", p.peek().text)
+	}
+	return g.(map[string]interface{}), nil
+}
+
+/* ---------------- cql2-json → Mongo ---------------- */
+
+func cqlArgs(node map[string]interface{}, n int) ([]interface{}, error) {
+	args, _ := node["args"].([]interface{})
+	if n >= 0 && len(args) != n {
+		return nil, fmt.Errorf("%v takes %d arguments", node["op"], n)
+	}
+	return args, nil
+}
+
+// cqlProperty maps a property reference to a document path
+func cqlProperty(v interface{}) (string, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["property"].(string)
+	if !ok {
+		return "", false
+	}
+	switch name {
+	case "id":
+		return "_id", true
+	case "name", "description", "layer", "status", "created_at", "updated_at", "created_by", "updated_by", "geometry", "external_id":
+		return name, true
+	}
+	if strings.HasPrefix(name, "properties.") {
+		return name, true
+	}
+	return "properties." + name, true
+}
+
+// cqlValue converts a literal; path decides how ids and timestamps are
+// represented
+func cqlValue(v interface{}, path string) (interface{}, error) {
+	switch t := v.(type) {
+	case json.Number:
+		return t.Float64()
+	case string:
+		if path == "_id" {
+			return primitive.ObjectIDFromHex(t)
+		}
+		return t, nil
+	case bool, nil:
+		return t, nil
+	case map[string]interface{}:
+		for _, k := range []string{"timestamp", "date"} {
+			s, ok := t[k].(string)
+			if !ok {
+				continue
+			}
+			// stored timestamps are dates, properties keep their text
+			if path != "created_at" && path != "updated_at" {
+				return s, nil
+			}
+			layout := time.RFC3339
+			if k == "date" {
+				layout = "2006-01-02"
+			}
+			ts, err := time.Parse(layout, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s %q", k, s)
+			}
+			return ts, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported literal %v", v)
+}
+
+func cqlGeometry(v interface{}) (bson.M, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("spatial predicates need a geometry literal")
+	}
+	if bb, ok := m["bbox"].([]interface{}); ok {
+		var f []float64
+		for _, x := range bb {
+			n, err := cqlValue(x, "")
+			fv, isNum := n.(float64)
+			if err != nil || !isNum {
+				return nil, fmt.Errorf("invalid bbox")
+			}
+			f = append(f, fv)
+		}
+		if len(f) == 6 {
+			f = []float64{f[0], f[1], f[3], f[4]}
+		}
+		if len(f) != 4 {
+			return nil, fmt.Errorf("bbox needs 4 numbers")
+		}
+		g := Geometry{Type: "Polygon", Rings: [][]Position{{
+			{f[0], f[1]}, {f[2], f[1]}, {f[2], f[3]}, {f[0], f[3]}, {f[0], f[1]},
+		}}}
+		return g.BSON(), nil
+	}
+	// cql2-json numbers arrive as json.Number
+	var fix func(x interface{}) interface{}
+	fix = func(x interface{}) interface{} {
+		switch t := x.(type) {
+		case json.Number:
+			f, _ := t.Float64()
+			return f
+		case []interface{}:
+			out := make([]interface{}, len(t))
+			for i := range t {
+				out[i] = fix(t[i])
+			}
+			return out
+		}
+		return x
+	}
+	g, err := parseGeometry(map[string]interface{}{"type": m["type"], "coordinates": fix(m["coordinates"])})
+	if err != nil {
+		return nil, err
+	}
+	if err := g.Validate(); err != nil {
+		return nil, err
+	}
+	return g.BSON(), nil
+}
+
+func compileCQL2(ast interface{}) (bson.M, error) {
+	if b, ok := ast.(bool); ok {
+		if b {
+			return bson.M{}, nil
+		}
+		return matchNothing, nil
+	}
+	node, ok := ast.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a predicate")
+	}
+	op, _ := node["op"].(string)
+	switch op {
+	case "and", "or":
+		args, _ := cqlArgs(node, -1)
+		if len(args) < 2 {
+			return nil, fmt.Errorf("%s needs at least 2 arguments", op)
+		}
+		parts := bson.A{}
+		for _, a := range args {
+			q, err := compileCQL2(a)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, q)
+		}
+		return bson.M{"$" + op: parts}, nil
+	case "not":
+		args, err := cqlArgs(node, 1)
+		if err != nil {
+			return nil, err
+		}
+		q, err := compileCQL2(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"$nor": bson.A{q}}, nil
+	case "=", "<>", "<", "<=", ">", ">=":
+		args, err := cqlArgs(node, 2)
+		if err != nil {
+			return nil, err
+		}
+		flip := map[string]string{"=": "=", "<>": "<>", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+		path, ok := cqlProperty(args[0])
+		lit := args[1]
+		if !ok {
+			if path, ok = cqlProperty(args[1]); !ok {
+				return nil, fmt.Errorf("comparison needs a property")
+			}
+			lit, op = args[0], flip[op]
+		}
+		v, err := cqlValue(lit, path)
+		if err != nil {
+			return nil, err
+		}
+		mongoOps := map[string]string{"=": "$eq", "<>": "$ne", "<": "$lt", "<=": "$lte", ">": "$gt", ">=": "$gte"}
+		return bson.M{path: bson.M{mongoOps[op]: v}}, nil
+	case "like":
+		args, err := cqlArgs(node, 2)
+		if err != nil {
+			return nil, err
+		}
+		path, ok := cqlProperty(args[0])
+		pat, isStr := args[1].(string)
+		if !ok || !isStr {
+			return nil, fmt.Errorf("like needs a property and a string pattern")
+		}
+		return bson.M{path: primitive.Regex{Pattern: likeToRegex(pat)}}, nil
+	case "in":
+		args, err := cqlArgs(node, 2)
+		if err != nil {
+			return nil, err
+		}
+		path, ok := cqlProperty(args[0])
+		list, isList := args[1].([]interface{})
+		if !ok || !isList {
+			return nil, fmt.Errorf("in needs a property and a list")
+		}
+		vals := bson.A{}
+		for _, x := range list {
+			v, err := cqlValue(x, path)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, v)
+		}
+		return bson.M{path: bson.M{"$in": vals}}, nil
+	case "between":
+		args, err := cqlArgs(node, 3)
+		if err != nil {
+			return nil, err
+		}
+		path, ok := cqlProperty(args[0])
+		if !ok {
+			return nil, fmt.Errorf("between needs a property")
+		}
+		lo, err := cqlValue(args[1], path)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := cqlValue(args[2], path)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{path: bson.M{"$gte": lo, "$lte": hi}}, nil
+	case "isNull":
+		args, err := cqlArgs(node, 1)
+		if err != nil {
+			return nil, err
+		}
+		path, ok := cqlProperty(args[0])
+		if !ok {
+			return nil, fmt.Errorf("isNull needs a property")
+		}
+		return bson.M{path: nil}, nil
+	case "s_intersects", "s_within", "s_disjoint":
+		args, err := cqlArgs(node, 2)
+		if err != nil {
+			return nil, err
+		}
+		if path, ok := cqlProperty(args[0]); !ok || path != "geometry" {
+			return nil, fmt.Errorf("%s applies to the geometry property", op)
+		}
+		g, err := cqlGeometry(args[1])
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "s_within":
+			return bson.M{"geometry": bson.M{"$geoWithin": bson.M{"$geometry": g}}}, nil
+		case "s_disjoint":
+			return bson.M{"$nor": bson.A{bson.M{"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": g}}}}}, nil
+		}
+		return bson.M{"geometry": bson.M{"$geoIntersects": bson.M{"$geometry": g}}}, nil
+	case "":
+		return nil, fmt.Errorf("expected a predicate")
+	}
+	return nil, fmt.Errorf("operator %s is not supported", op)
+}
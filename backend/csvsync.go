@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// CSV sources for the sync job: a CSV file at a URL or a Google Sheet,
+// given by its share link (.../spreadsheets/d/<id>/edit#gid=<tab>, for a
+// sheet anyone with the link can view) or its "Publish to the web" link.
+// The first row is the header, and params.columns maps it:
+//
+//	{"lon": "Longitude", "lat": "Latitude"}  a point from two columns, or
+//	{"wkt": "Shape"}                         a WKT geometry column
+//	{"id": "Code", "name": "Name", "description": "Notes"}
+//	{"properties": {"seats": "Seats:number", "open": "Open:bool"}}
+//
+// Columns left out are looked for under the usual headers (lon, lng,
+// longitude, x / lat, latitude, y / wkt, geometry, geom; id_property, name
+// and description), ignoring case. Without a properties mapping every
+// other column becomes a string property under its header. Empty cells
+// are skipped, and numbers may use a decimal comma.
+var csvColumnDefaults = map[string][]string{
+	"lon":         {"lon", "lng", "long", "longitude", "x"},
+	"lat":         {"lat", "latitude", "y"},
+	"wkt":         {"wkt", "geometry", "geom"},
+	"name":        {"name"},
+	"description": {"description"},
+}
+
+// csvPropertyTypes are the :type suffixes of a properties mapping
+var csvPropertyTypes = map[string]bool{"string": true, "number": true, "bool": true}
+
+// googleSheetCSVURL turns a Google Sheets link into its CSV download,
+// reporting whether it was one
+func googleSheetCSVURL(s string) (string, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host != "docs.google.com" || !strings.HasPrefix(u.Path, "/spreadsheets/d/") {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/spreadsheets/d/"), "/")
+	gid := u.Query().Get("gid")
+	if frag, err := url.ParseQuery(u.Fragment); err == nil && gid == "" {
+		gid = frag.Get("gid")
+	}
+	q := url.Values{}
+	var path string
+	if parts[0] == "e" && len(parts) > 1 {
+		// published to the web
+		path = "/spreadsheets/d/e/" + parts[1] + "/pub"
+		q.Set("output", "csv")
+		if gid != "" {
+			q.Set("gid", gid)
+			q.Set("single", "true")
+		}
+	} else {
+		path = "/spreadsheets/d/" + parts[0] + "/export"
+		q.Set("format", "csv")
+		if gid != "" {
+			q.Set("gid", gid)
+		}
+	}
+	return "https://docs.google.com" + path + "?" + q.Encode(), true
+}
+
+func validateCSVColumns(params bson.M) []FieldError {
+	if params["columns"] == nil {
+		return nil
+	}
+	cols := paramMap(params, "columns")
+	if cols == nil {
+		return []FieldError{{Field: "params.columns", Message: "must be an object"}}
+	}
+	var errs []FieldError
+	for k, v := range cols {
+		switch k {
+		case "lon", "lat", "wkt", "id", "name", "description":
+			if s, ok := v.(string); !ok || s == "" {
+				errs = append(errs, FieldError{Field: "params.columns." + k, Message: "must be a column name"})
+			}
+		case "properties":
+			props := paramMap(cols, "properties")
+			if props == nil {
+				errs = append(errs, FieldError{Field: "params.columns.properties", Message: "must map property names to columns"})
+			}
+			for p, c := range props {
+				if s, ok := c.(string); !ok || s == "" {
+					errs = append(errs, FieldError{Field: "params.columns.properties." + p, Message: "must be a column name, optionally with :string, :number or :bool"})
+				}
+			}
+		default:
+			errs = append(errs, FieldError{Field: "params.columns." + k, Message: "unknown mapping"})
+		}
+	}
+	if (cols["lon"] == nil) != (cols["lat"] == nil) {
+		errs = append(errs, FieldError{Field: "params.columns", Message: "lon and lat go together"})
+	}
+	return errs
+}
+
+// splitColumnType splits "Seats:number" into the column and its type,
+// string unless a known type follows the last colon
+func splitColumnType(s string) (string, string) {
+	if i := strings.LastIndexByte(s, ':'); i >= 0 && csvPropertyTypes[s[i+1:]] {
+		return s[:i], s[i+1:]
+	}
+	return s, "string"
+}
+
+// parseCSVNumber reads a cell as a number, taking a lone comma as the
+// decimal separator
+func parseCSVNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.Count(s, ",") == 1 && !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func csvSyncRecords(body []byte, params bson.M, idProp string) ([]syncRecord, error) {
+	rd := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))))
+	rd.FieldsPerRecord = -1
+	rows, err := rd.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("CSV has no header row")
+	}
+	header := map[string]int{}
+	for i, h := range rows[0] {
+		if _, dup := header[strings.ToLower(strings.TrimSpace(h))]; !dup {
+			header[strings.ToLower(strings.TrimSpace(h))] = i
+		}
+	}
+	cols := paramMap(params, "columns")
+	// find is the index of a mapped column, or of the first default header
+	// present; mapped columns that are missing are an error
+	find := func(key string, defaults ...string) (int, error) {
+		if name, ok := cols[key].(string); ok {
+			i, ok := header[strings.ToLower(strings.TrimSpace(name))]
+			if !ok {
+				return -1, fmt.Errorf("CSV has no column %q for %s", name, key)
+			}
+			return i, nil
+		}
+		for _, d := range defaults {
+			if i, ok := header[d]; ok {
+				return i, nil
+			}
+		}
+		return -1, nil
+	}
+	idx := map[string]int{}
+	for key, defaults := range csvColumnDefaults {
+		if idx[key], err = find(key, defaults...); err != nil {
+			return nil, err
+		}
+	}
+	if idx["id"], err = find("id", strings.ToLower(idProp)); err != nil {
+		return nil, err
+	}
+	if idx["wkt"] < 0 && (idx["lon"] < 0 || idx["lat"] < 0) {
+		return nil, fmt.Errorf("CSV has no lon/lat or wkt columns, map them in params.columns")
+	}
+
+	type propColumn struct {
+		name, typ string
+		index     int
+	}
+	var props []propColumn
+	if mapped := paramMap(cols, "properties"); mapped != nil {
+		for p, c := range mapped {
+			s, _ := c.(string)
+			col, typ := splitColumnType(s)
+			i, ok := header[strings.ToLower(strings.TrimSpace(col))]
+			if !ok {
+				return nil, fmt.Errorf("CSV has no column %q for property %s", col, p)
+			}
+			props = append(props, propColumn{p, typ, i})
+		}
+	} else {
+		used := map[int]bool{}
+		for _, i := range idx {
+			used[i] = true
+		}
+		for i, h := range rows[0] {
+			if name := strings.TrimSpace(h); !used[i] && name != "" {
+				props = append(props, propColumn{name, "string", i})
+			}
+		}
+	}
+
+	cell := func(row []string, i int) string {
+		if i < 0 || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+	records := make([]syncRecord, 0, len(rows)-1)
+	for n, row := range rows[1:] {
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		rec := syncRecord{key: cell(row, idx["id"]), in: map[string]interface{}{}}
+		// header is line 1
+		line := n + 2
+		if rec.key == "" {
+			rec.err = fmt.Errorf("line %d: no id", line)
+		}
+		if wkt := cell(row, idx["wkt"]); wkt != "" {
+			g, err := parseWKT(wkt)
+			if err != nil {
+				rec.err = fmt.Errorf("line %d: %v", line, err)
+			}
+			rec.in["geojson"] = g
+		} else {
+			lon, errLon := parseCSVNumber(cell(row, idx["lon"]))
+			lat, errLat := parseCSVNumber(cell(row, idx["lat"]))
+			if errLon != nil || errLat != nil {
+				rec.err = fmt.Errorf("line %d: no valid coordinates", line)
+			}
+			rec.in["lon"], rec.in["lat"] = lon, lat
+		}
+		if idx["name"] >= 0 {
+			rec.in["name"] = cell(row, idx["name"])
+		}
+		if v := cell(row, idx["description"]); v != "" {
+			rec.in["description"] = v
+		}
+		properties := map[string]interface{}{}
+		for _, p := range props {
+			v := cell(row, p.index)
+			if v == "" {
+				continue
+			}
+			switch p.typ {
+			case "number":
+				f, err := parseCSVNumber(v)
+				if err != nil && rec.err == nil {
+					rec.err = fmt.Errorf("line %d: %s %q is not a number", line, p.name, v)
+				}
+				properties[p.name] = f
+			case "bool":
+				switch strings.ToLower(v) {
+				case "true", "yes", "y", "1":
+					properties[p.name] = true
+				case "false", "no", "n", "0":
+					properties[p.name] = false
+				default:
+					if rec.err == nil {
+						rec.err = fmt.Errorf("line %d: %s %q is not true or false", line, p.name, v)
+					}
+				}
+			default:
+				properties[p.name] = v
+			}
+		}
+		rec.in["properties"] = properties
+		records = append(records, rec)
+	}
+	return records, nil
+}
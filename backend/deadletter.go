@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Failed job runs and notifications are kept as dead letters until an
+// admin retries or cancels them under /admin/dead-letters. A job that
+// keeps failing stays one dead letter whose failure count goes up; each
+// undelivered notification is its own. Closed (resolved or cancelled)
+// letters expire after DEAD_LETTER_RETENTION (30d), open ones never do.
+// When DEAD_LETTER_ALERT_THRESHOLD (5) failures happen within
+// DEAD_LETTER_ALERT_WINDOW (1h), a deadletter.threshold event goes to the
+// notifiers routed for it, at most once per window.
+type DeadLetter struct {
+	ID            primitive.ObjectID `bson:"_id" json:"id"`
+	Source        string             `bson:"source" json:"source"`
+	Name          string             `bson:"name" json:"name"`
+	Kind          string             `bson:"kind,omitempty" json:"kind,omitempty"`
+	Payload       bson.M             `bson:"payload,omitempty" json:"payload,omitempty"`
+	Error         string             `bson:"error" json:"error"`
+	RunID         string             `bson:"run_id,omitempty" json:"run_id,omitempty"`
+	Status        string             `bson:"status" json:"status"`
+	Failures      int                `bson:"failures" json:"failures"`
+	Retries       int                `bson:"retries" json:"retries"`
+	FirstFailedAt time.Time          `bson:"first_failed_at" json:"first_failed_at"`
+	LastFailedAt  time.Time          `bson:"last_failed_at" json:"last_failed_at"`
+	ClosedAt      *time.Time         `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+	ClosedBy      string             `bson:"closed_by,omitempty" json:"closed_by,omitempty"`
+}
+
+const (
+	deadLetterJob    = "job"
+	deadLetterNotify = "notify"
+
+	letterFailed    = "failed"
+	letterRetrying  = "retrying"
+	letterResolved  = "resolved"
+	letterCancelled = "cancelled"
+)
+
+var (
+	deadLetters        *mongo.Collection
+	deadLetterMetrics  = new(expvar.Map)
+	deadLetterAlertMin = 5
+	deadLetterWindow   = time.Hour
+
+	deadLetterMu  sync.Mutex
+	recentFails   []time.Time
+	lastFailAlert time.Time
+)
+
+func setupDeadLetters() {
+	deadLetters = db.Collection(getenv("MONGO_DEAD_LETTERS_COLLECTION", "dead_letters"))
+	if v, err := strconv.Atoi(getenv("DEAD_LETTER_ALERT_THRESHOLD", "")); err == nil && v >= 0 {
+		deadLetterAlertMin = v
+	}
+	if d, err := time.ParseDuration(getenv("DEAD_LETTER_ALERT_WINDOW", "")); err == nil && d > 0 {
+		deadLetterWindow = d
+	}
+	retention := 30 * 24 * time.Hour
+	if d, err := time.ParseDuration(getenv("DEAD_LETTER_RETENTION", "")); err == nil && d > 0 {
+		retention = d
+	}
+	if _, err := deadLetters.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "closed_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(retention.Seconds()))},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "last_failed_at", Value: -1}}},
+		{Keys: bson.D{{Key: "source", Value: 1}, {Key: "name", Value: 1}, {Key: "status", Value: 1}}},
+	}); err != nil {
+		log.Printf("dead letter index create warning: %v", err)
+	}
+	expvar.Publish("dead_letters", deadLetterMetrics)
+}
+
+// toBSONMap stores v as a document, for payloads
+func toBSONMap(v interface{}) bson.M {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var m bson.M
+	bson.Unmarshal(b, &m)
+	return m
+}
+
+func fromBSONMap(m bson.M, v interface{}) error {
+	b, err := bson.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, v)
+}
+
+// deadLetterJobRun records a failed run of j. An open letter for the same
+// job takes the new failure.
+func deadLetterJobRun(j JobDoc, run JobRun) {
+	now := time.Now().UTC()
+	_, err := deadLetters.UpdateOne(ctx,
+		bson.M{"source": deadLetterJob, "name": j.Name, "status": letterFailed},
+		bson.M{
+			"$set":         bson.M{"kind": j.Kind, "payload": toBSONMap(j), "error": run.Error, "run_id": run.ID.Hex(), "last_failed_at": now},
+			"$inc":         bson.M{"failures": 1},
+			"$setOnInsert": bson.M{"retries": 0, "first_failed_at": now},
+		},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		log.Printf("dead letter record warning: %v", err)
+	}
+	countFailure(now)
+}
+
+// deadLetterEvent records an event notifier n couldn't deliver
+func deadLetterEvent(n Notifier, ev Event, cause error) {
+	now := time.Now().UTC()
+	d := DeadLetter{
+		ID: primitive.NewObjectID(), Source: deadLetterNotify, Name: n.Name(), Kind: ev.Type,
+		Payload: toBSONMap(ev), Error: cause.Error(), Status: letterFailed, Failures: 1,
+		FirstFailedAt: now, LastFailedAt: now,
+	}
+	if _, err := deadLetters.InsertOne(ctx, d); err != nil {
+		log.Printf("dead letter record warning: %v", err)
+	}
+	// an undeliverable alert doesn't raise another one
+	if ev.Type != eventFailureThreshold {
+		countFailure(now)
+	}
+}
+
+func countFailure(now time.Time) {
+	deadLetterMetrics.Add("recorded", 1)
+	deadLetterMu.Lock()
+	cutoff := now.Add(-deadLetterWindow)
+	kept := recentFails[:0]
+	for _, t := range recentFails {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	recentFails = append(kept, now)
+	alert := deadLetterAlertMin > 0 && len(recentFails) >= deadLetterAlertMin && now.Sub(lastFailAlert) >= deadLetterWindow
+	if alert {
+		lastFailAlert = now
+	}
+	n := len(recentFails)
+	deadLetterMu.Unlock()
+	if !alert {
+		return
+	}
+	deadLetterMetrics.Add("alerts", 1)
+	notify(Event{
+		Type:    eventFailureThreshold,
+		Subject: fmt.Sprintf("%d failures in the last %s", n, deadLetterWindow),
+		Message: fmt.Sprintf("%d job runs or notifications failed within %s. Review them under /admin/dead-letters.", n, deadLetterWindow),
+		Data:    map[string]interface{}{"failures": n, "window": deadLetterWindow.String()},
+	})
+}
+
+// retryDeadLetter runs d again; nil means it went through
+func retryDeadLetter(d DeadLetter, by string) error {
+	switch d.Source {
+	case deadLetterJob:
+		var j JobDoc
+		// the job as it is now, or as it was when it failed if since deleted
+		if err := jobs.FindOne(ctx, bson.M{"_id": d.Name}).Decode(&j); err == mongo.ErrNoDocuments {
+			if err := fromBSONMap(d.Payload, &j); err != nil {
+				return fmt.Errorf("job payload: %v", err)
+			}
+		} else if err != nil {
+			return err
+		}
+		run := runJob(j, "retry:"+by)
+		if run.Status != jobOK {
+			if run.Error == "" {
+				return fmt.Errorf("%s: %s", run.Status, run.Message)
+			}
+			return fmt.Errorf("%s", run.Error)
+		}
+		return nil
+	case deadLetterNotify:
+		n, ok := notifiers[d.Name]
+		if !ok {
+			return fmt.Errorf("notifier %s is no longer configured", d.Name)
+		}
+		var ev Event
+		if err := fromBSONMap(d.Payload, &ev); err != nil {
+			return fmt.Errorf("event payload: %v", err)
+		}
+		return n.Notify(ev)
+	}
+	return fmt.Errorf("unknown source %q", d.Source)
+}
+
+// GET /admin/dead-letters?status=failed&source=job|notify&name=&limit=50
+// status defaults to the open ones (failed and retrying); all lists every
+// status
+func listDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	query := r.URL.Query()
+	q := bson.M{}
+	switch status := query.Get("status"); status {
+	case "":
+		q["status"] = bson.M{"$in": bson.A{letterFailed, letterRetrying}}
+	case "all":
+	case letterFailed, letterRetrying, letterResolved, letterCancelled:
+		q["status"] = status
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid status", FieldError{Field: "status", Message: "must be one of failed, retrying, resolved, cancelled, all"})
+		return
+	}
+	if v := query.Get("source"); v != "" {
+		q["source"] = v
+	}
+	if v := query.Get("name"); v != "" {
+		q["name"] = v
+	}
+	limit := int64(50)
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+	cur, err := deadLetters.Find(ctx, q, options.Find().SetSort(bson.D{{Key: "last_failed_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []DeadLetter{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func loadDeadLetter(w http.ResponseWriter, r *http.Request) (DeadLetter, bool) {
+	var d DeadLetter
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return d, false
+	}
+	if err := deadLetters.FindOne(ctx, bson.M{"_id": oid}).Decode(&d); err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "dead letter not found")
+		return d, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return d, false
+	}
+	return d, true
+}
+
+// GET /admin/dead-letters/{id}
+func getDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	d, ok := loadDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// POST /admin/dead-letters/{id}/retry
+// Runs the job or sends the notification again. A success resolves the
+// letter; a failure puts it back as failed with the new error. Answers 200
+// with the outcome, or 202 while a long job is still going.
+func retryDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	d, ok := loadDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	// claim it, so two admins don't retry the same failure
+	res, err := deadLetters.UpdateOne(ctx, bson.M{"_id": d.ID, "status": letterFailed},
+		bson.M{"$set": bson.M{"status": letterRetrying}, "$inc": bson.M{"retries": 1}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.ModifiedCount == 0 {
+		writeError(w, http.StatusConflict, "conflict", "dead letter is "+d.Status+", only failed ones can be retried")
+		return
+	}
+	deadLetterMetrics.Add("retried", 1)
+
+	by := userID(r)
+	done := make(chan DeadLetter, 1)
+	go func() {
+		now := time.Now().UTC()
+		set := bson.M{"status": letterResolved, "closed_at": now, "closed_by": by}
+		update := bson.M{"$set": set}
+		if err := retryDeadLetter(d, by); err != nil {
+			set = bson.M{"status": letterFailed, "error": err.Error(), "last_failed_at": now}
+			update = bson.M{"$set": set, "$inc": bson.M{"failures": 1}}
+		} else {
+			deadLetterMetrics.Add("resolved", 1)
+		}
+		var stored DeadLetter
+		if err := deadLetters.FindOneAndUpdate(ctx, bson.M{"_id": d.ID}, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored); err != nil {
+			log.Printf("dead letter update warning: %v", err)
+		}
+		done <- stored
+	}()
+	select {
+	case stored := <-done:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored)
+	case <-time.After(5 * time.Second):
+		d.Status = letterRetrying
+		d.Retries++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(d)
+	}
+}
+
+// POST /admin/dead-letters/{id}/cancel
+// Gives up on a failure; the letter is kept until DEAD_LETTER_RETENTION
+func cancelDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	d, ok := loadDeadLetter(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	var stored DeadLetter
+	// a retry that died with its instance stays retrying, so those can be
+	// cancelled too
+	err := deadLetters.FindOneAndUpdate(ctx, bson.M{"_id": d.ID, "status": bson.M{"$in": bson.A{letterFailed, letterRetrying}}},
+		bson.M{"$set": bson.M{"status": letterCancelled, "closed_at": now, "closed_by": userID(r)}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusConflict, "conflict", "dead letter is "+d.Status+", only open ones can be cancelled")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
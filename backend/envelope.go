@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const startCtxKey ctxKey = "start"
+
+// ResponseMeta describes a page of results in envelope mode
+type ResponseMeta struct {
+	Count      int    `json:"count"`
+	Limit      int64  `json:"limit,omitempty"`
+	Offset     int64  `json:"offset"`
+	NextOffset *int64 `json:"next_offset,omitempty"`
+	Truncated  bool   `json:"truncated"`
+	TookMS     int64  `json:"took_ms"`
+	RequestID  string `json:"request_id,omitempty"`
+}
+
+// Envelope wraps a listing with its metadata and any warnings. Clients opt
+// in with ?envelope=true or the X-Response-Envelope: true header; without
+// either the bare FeatureCollection is returned as before.
+type Envelope struct {
+	Data     interface{}  `json:"data"`
+	Meta     ResponseMeta `json:"meta"`
+	Warnings []string     `json:"warnings"`
+}
+
+func wantsEnvelope(r *http.Request) bool {
+	if v, err := strconv.ParseBool(r.URL.Query().Get("envelope")); err == nil {
+		return v
+	}
+	v, _ := strconv.ParseBool(r.Header.Get("X-Response-Envelope"))
+	return v
+}
+
+// writeCollection writes fc either bare or inside an Envelope. limit and
+// offset are what the query ran with (limit 0 = none); truncation is read
+// from the X-Result-Truncated header set by applyGuardrails.
+func writeCollection(w http.ResponseWriter, r *http.Request, fc GeoJSONFeatureCollection, limit, offset int64, warnings ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	if !wantsEnvelope(r) {
+		json.NewEncoder(w).Encode(fc)
+		return
+	}
+	if fc.Features == nil {
+		fc.Features = []GeoJSONFeature{}
+	}
+
+	meta := ResponseMeta{
+		Count:     len(fc.Features),
+		Limit:     limit,
+		Offset:    offset,
+		Truncated: w.Header().Get("X-Result-Truncated") == "true",
+		RequestID: w.Header().Get("X-Request-ID"),
+	}
+	if meta.Truncated {
+		warnings = append(warnings, "result truncated to "+strconv.FormatInt(maxFeatures, 10)+" features; use limit and offset to page through the rest")
+	}
+	// a full page suggests there may be more
+	if limit > 0 && int64(len(fc.Features)) == limit {
+		next := offset + limit
+		meta.NextOffset = &next
+	}
+	if start, ok := r.Context().Value(startCtxKey).(time.Time); ok {
+		meta.TookMS = time.Since(start).Milliseconds()
+	}
+	if warnings == nil {
+		warnings = []string{}
+	}
+	json.NewEncoder(w).Encode(Envelope{Data: fc, Meta: meta, Warnings: warnings})
+}
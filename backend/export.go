@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// earth radius in meters, used to turn $maxDistance into radians
+const earthRadiusMeters = 6378100.0
+
+// geoWithinFilter returns a copy of q where a $near condition is replaced by
+// the equivalent $geoWithin/$centerSphere. $near is only allowed in find, not
+// in aggregations or countDocuments.
+func geoWithinFilter(q bson.M) bson.M {
+	out := bson.M{}
+	for k, v := range q {
+		out[k] = v
+	}
+	g, ok := q["geometry"].(bson.M)
+	if !ok {
+		return out
+	}
+	near, ok := g["$near"].(bson.M)
+	if !ok {
+		return out
+	}
+	center, _ := near["$geometry"].(bson.M)
+	dist, _ := toFloat(near["$maxDistance"])
+	out["geometry"] = bson.M{
+		"$geoWithin": bson.M{
+			"$centerSphere": bson.A{center["coordinates"], dist / earthRadiusMeters},
+		},
+	}
+	return out
+}
+
+// propertyKeys collects the distinct property names of all features matching q
+func propertyKeys(ctx context.Context, coll *mongo.Collection, q bson.M) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: geoWithinFilter(q)}},
+		{{Key: "$project", Value: bson.M{"k": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$properties", bson.M{}}}}}}},
+		{{Key: "$unwind", Value: "$k"}},
+		{{Key: "$group", Value: bson.M{"_id": "$k.k"}}},
+	}
+	cur, err := coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var keys []string
+	for cur.Next(ctx) {
+		var row struct {
+			ID string `bson:"_id"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			continue
+		}
+		switch row.ID {
+		case "id", "name", "description":
+			// already written as fixed columns
+		default:
+			keys = append(keys, row.ID)
+		}
+	}
+	sort.Strings(keys)
+	return keys, cur.Err()
+}
+
+// csvValue flattens a property value into a single cell
+func csvValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case int32, int64, int:
+		return fmt.Sprint(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339)
+	default:
+		b, err := json.Marshal(t)
+		if err != nil {
+			return fmt.Sprint(t)
+		}
+		return string(b)
+	}
+}
+
+// writeFeaturesCSV streams the cursor as CSV. geomMode is "wkt" (default) or
+// "lonlat", which writes lon/lat columns for points and leaves them empty for
+// other geometry types.
+func writeFeaturesCSV(w http.ResponseWriter, r *http.Request, ctx context.Context, coll *mongo.Collection, q bson.M, cur *mongo.Cursor, geomMode string) {
+	keys, err := propertyKeys(ctx, coll, q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="features.csv"`)
+	n := encodeFeaturesCSV(w, r, ctx, keys, cur, geomMode)
+	if err := cur.Err(); err != nil {
+		// the 200 is sent: break the response off instead of ending it,
+		// so the client sees a failed download rather than a short file
+		log.Printf("csv export failed after %d rows: %v", n, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// featureCursor is what the export encoders read from: a *mongo.Cursor, or
+// a filteredCursor over one
+type featureCursor interface {
+	Next(ctx context.Context) bool
+	Decode(v interface{}) error
+	Err() error
+}
+
+// filteredCursor yields the features of cur that keep accepts. Decode only
+// takes a *FeatureDoc.
+type filteredCursor struct {
+	cur  *mongo.Cursor
+	keep func(*FeatureDoc) bool
+	doc  FeatureDoc
+}
+
+func (f *filteredCursor) Next(ctx context.Context) bool {
+	for f.cur.Next(ctx) {
+		f.doc = FeatureDoc{}
+		if err := f.cur.Decode(&f.doc); err != nil {
+			continue
+		}
+		if f.keep(&f.doc) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *filteredCursor) Decode(v interface{}) error {
+	doc, ok := v.(*FeatureDoc)
+	if !ok {
+		return fmt.Errorf("filteredCursor decodes into *FeatureDoc, not %T", v)
+	}
+	*doc = f.doc
+	return nil
+}
+
+func (f *filteredCursor) Err() error { return f.cur.Err() }
+
+// encodeFeaturesCSV writes the CSV body: header row with the given property
+// keys, then one row per feature. It returns the number of rows.
+func encodeFeaturesCSV(out io.Writer, r *http.Request, ctx context.Context, keys []string, cur featureCursor, geomMode string) int {
+	header := []string{"id", "name", "description"}
+	if geomMode == "lonlat" {
+		header = append(header, "lon", "lat")
+	} else {
+		header = append(header, "wkt")
+	}
+	header = append(header, "created_at", "updated_at")
+	header = append(header, keys...)
+
+	// UTF-8 BOM so Excel doesn't mangle non-ASCII names
+	out.Write([]byte("\xEF\xBB\xBF"))
+
+	n := 0
+	cw := csv.NewWriter(out)
+	cw.Write(header)
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		revealDoc(r, &doc)
+		countServed(r, doc.Layer, 1)
+		row := []string{doc.ID.Hex(), doc.Name, doc.Description}
+		g, gerr := parseGeometry(doc.Geometry)
+		if geomMode == "lonlat" {
+			if gerr == nil && g.Type == "Point" {
+				row = append(row, wktFloat(g.Point[0]), wktFloat(g.Point[1]))
+			} else {
+				row = append(row, "", "")
+			}
+		} else {
+			wkt := ""
+			if gerr == nil {
+				wkt = g.WKT()
+			}
+			row = append(row, wkt)
+		}
+		row = append(row, csvValue(doc.CreatedAt), csvValue(doc.UpdatedAt))
+		for _, k := range keys {
+			row = append(row, csvValue(doc.Properties[k]))
+		}
+		cw.Write(row)
+		n++
+	}
+	cw.Flush()
+	return n
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Multi-part export splits one layer into files that can be downloaded,
+// and retried, one at a time. GET /export/parts returns the manifest and
+// GET /export/parts/{part} one file. Each feature goes to exactly one part,
+// the one holding its anchor: the first position of its geometry. Parts
+// are either web-mercator tiles (split=tile, the default), at ?zoom= or at
+// the lowest zoom where no tile has more than ?max_features= (100000), or
+// the administrative areas of one ?level= (split=admin, optionally inside
+// ?parent=), plus _outside for anchors in no area. Parts are computed from
+// the data when requested, so a manifest goes stale when the layer
+// changes; its version is the layer's last update.
+const (
+	maxPartZoom         = 16
+	defaultPartFeatures = 100000
+	outsidePart         = "_outside"
+)
+
+// ExportPart is one file of a multi-part export
+type ExportPart struct {
+	ID       string    `json:"id"`
+	Tile     []int     `json:"tile,omitempty"`
+	Admin    string    `json:"admin,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	BBox     []float64 `json:"bbox,omitempty"`
+	Features int64     `json:"features"`
+	URL      string    `json:"url"`
+}
+
+// PartManifest lists the parts of a multi-part export
+type PartManifest struct {
+	GeneratedAt time.Time     `json:"generated_at"`
+	Layer       string        `json:"layer"`
+	Split       string        `json:"split"`
+	Zoom        *int          `json:"zoom,omitempty"`
+	Level       string        `json:"level,omitempty"`
+	Parent      string        `json:"parent,omitempty"`
+	Format      string        `json:"format"`
+	Version     *time.Time    `json:"version,omitempty"`
+	Features    int64         `json:"features"`
+	Skipped     int64         `json:"skipped,omitempty"`
+	License     *LayerLicense `json:"license,omitempty"`
+	Parts       []ExportPart  `json:"parts"`
+}
+
+type partSpec struct {
+	layer, split, format, level, parent string
+	zoom                                int // -1 picks one
+	maxFeatures                         int64
+}
+
+func parsePartSpec(w http.ResponseWriter, r *http.Request) (partSpec, bool) {
+	query := r.URL.Query()
+	s := partSpec{layer: query.Get("layer"), split: query.Get("split"), format: query.Get("format"),
+		level: query.Get("level"), parent: query.Get("parent"), zoom: -1, maxFeatures: defaultPartFeatures}
+	var errs []FieldError
+	if s.layer == "" {
+		errs = append(errs, FieldError{Field: "layer", Message: "required"})
+	}
+	if s.split == "" {
+		s.split = "tile"
+	}
+	if s.split != "tile" && s.split != "admin" {
+		errs = append(errs, FieldError{Field: "split", Message: "must be tile or admin"})
+	}
+	if s.format == "" {
+		s.format = "geojson"
+	}
+	if s.format != "geojson" && s.format != "csv" {
+		errs = append(errs, FieldError{Field: "format", Message: "must be geojson or csv"})
+	}
+	if v := query.Get("zoom"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil || z < 0 || z > maxPartZoom {
+			errs = append(errs, FieldError{Field: "zoom", Message: fmt.Sprintf("must be between 0 and %d", maxPartZoom)})
+		}
+		s.zoom = z
+	}
+	if v := query.Get("max_features"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			errs = append(errs, FieldError{Field: "max_features", Message: "must be a positive integer"})
+		}
+		s.maxFeatures = n
+	}
+	if s.split == "admin" {
+		if s.level == "" {
+			s.level = "district"
+		}
+		if adminLevelRank(s.level) < 0 {
+			errs = append(errs, FieldError{Field: "level", Message: "one of " + strings.Join(adminLevels, ", ")})
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid export parameters", errs...)
+		return s, false
+	}
+	return s, true
+}
+
+// partURL links part id with the parameters that produced the manifest
+func (s partSpec) partURL(id string) string {
+	q := url.Values{"layer": {s.layer}, "split": {s.split}, "format": {s.format}}
+	if s.split == "admin" {
+		q.Set("level", s.level)
+		if s.parent != "" {
+			q.Set("parent", s.parent)
+		}
+	}
+	return "/export/parts/" + url.PathEscape(id) + "?" + q.Encode()
+}
+
+// anchorTileExpr is the tile {x, y} at zoom z of a document's anchor, the
+// same arithmetic as tileX and tileY. Tiles at one zoom are the tiles of
+// a deeper one shifted right, so counts at maxPartZoom roll up exactly.
+func anchorTileExpr(z int) bson.M {
+	n := math.Exp2(float64(z))
+	lon := bson.M{"$arrayElemAt": bson.A{"$$p", 0}}
+	lat := bson.M{"$min": bson.A{bson.M{"$max": bson.A{bson.M{"$arrayElemAt": bson.A{"$$p", 1}}, -maxMercatorLat}}, maxMercatorLat}}
+	rad := bson.M{"$degreesToRadians": lat}
+	clamp := func(v bson.M) bson.M {
+		return bson.M{"$min": bson.A{bson.M{"$max": bson.A{v, 0}}, n - 1}}
+	}
+	x := bson.M{"$floor": bson.M{"$multiply": bson.A{bson.M{"$divide": bson.A{bson.M{"$add": bson.A{lon, 180}}, 360}}, n}}}
+	y := bson.M{"$floor": bson.M{"$multiply": bson.A{bson.M{"$divide": bson.A{
+		bson.M{"$subtract": bson.A{1, bson.M{"$divide": bson.A{
+			bson.M{"$ln": bson.M{"$add": bson.A{bson.M{"$tan": rad}, bson.M{"$divide": bson.A{1, bson.M{"$cos": rad}}}}}},
+			math.Pi,
+		}}}},
+		2,
+	}}, n}}}
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"p": bson.M{"$arrayElemAt": bson.A{flattenCoords, 0}}},
+		"in":   bson.D{{Key: "x", Value: clamp(x)}, {Key: "y", Value: clamp(y)}},
+	}}
+}
+
+// tileBounds is tile x,y at zoom z in lon/lat; the outer rows reach the
+// poles, since anchors beyond the mercator limit are counted in them
+func tileBounds(z, x, y int) BBox {
+	n := math.Exp2(float64(z))
+	b := BBox{MinLon: tileLon(float64(x), n), MaxLon: tileLon(float64(x+1), n), MinLat: tileLat(float64(y+1), n), MaxLat: tileLat(float64(y), n)}
+	if y == 0 {
+		b.MaxLat = 90
+	}
+	if y == int(n)-1 {
+		b.MinLat = -90
+	}
+	return b
+}
+
+// tilePrefilter narrows a tile part to features near the tile, using the
+// geometry index. Polygon edges are geodesics, so the top and bottom edges
+// get a vertex every degree to stay close to the parallels, and the box is
+// grown a little; the anchor test decides membership. Zooms below 2 have
+// tiles too large for a geo polygon and scan the layer.
+func tilePrefilter(z, x, y int) bson.M {
+	if z < 2 {
+		return nil
+	}
+	b := tileBounds(z, x, y)
+	eps := (b.MaxLon-b.MinLon)*0.001 + 1e-7
+	minLon, maxLon := math.Max(b.MinLon-eps, -180), math.Min(b.MaxLon+eps, 180)
+	minLat, maxLat := math.Max(b.MinLat-eps, -89.9999), math.Min(b.MaxLat+eps, 89.9999)
+	steps := int(math.Ceil(maxLon - minLon))
+	ring := bson.A{}
+	for i := 0; i <= steps; i++ {
+		ring = append(ring, bson.A{minLon + (maxLon-minLon)*float64(i)/float64(steps), minLat})
+	}
+	for i := steps; i >= 0; i-- {
+		ring = append(ring, bson.A{minLon + (maxLon-minLon)*float64(i)/float64(steps), maxLat})
+	}
+	ring = append(ring, bson.A{minLon, minLat})
+	return bson.M{"$geoIntersects": bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}}}}
+}
+
+func parseTilePart(id string) (z, x, y int, ok bool) {
+	parts := strings.Split(id, "-")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	var err [3]error
+	z, err[0] = strconv.Atoi(parts[0])
+	x, err[1] = strconv.Atoi(parts[1])
+	y, err[2] = strconv.Atoi(parts[2])
+	n := 1 << uint(z)
+	if err[0] != nil || err[1] != nil || err[2] != nil || z < 0 || z > maxPartZoom || x < 0 || y < 0 || x >= n || y >= n {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// adminPartAreas are the areas of an admin split, by code, and the test
+// placing an anchor in one of them (-1 for none). Areas of one level
+// shouldn't overlap; where they do the first code wins.
+type adminPartAreas struct {
+	areas []BoundaryDoc
+	polys [][][][]Position
+	boxes []BBox
+}
+
+func loadPartAreas(s partSpec) (*adminPartAreas, error) {
+	q := bson.M{"level": s.level}
+	if s.parent != "" {
+		q["parent_code"] = s.parent
+	}
+	cur, err := boundaries.Find(ctx, q, options.Find().SetSort(bson.D{{Key: "code", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	a := &adminPartAreas{}
+	if err := cur.All(ctx, &a.areas); err != nil {
+		return nil, err
+	}
+	for _, b := range a.areas {
+		g, _ := parseGeometry(b.Geometry)
+		polys := polygonsOf(g)
+		box := BBox{MinLon: 180, MinLat: 90, MaxLon: -180, MaxLat: -90}
+		for _, poly := range polys {
+			for _, p := range poly[0] {
+				box.MinLon, box.MaxLon = math.Min(box.MinLon, p[0]), math.Max(box.MaxLon, p[0])
+				box.MinLat, box.MaxLat = math.Min(box.MinLat, p[1]), math.Max(box.MaxLat, p[1])
+			}
+		}
+		a.polys = append(a.polys, polys)
+		a.boxes = append(a.boxes, box)
+	}
+	return a, nil
+}
+
+func (a *adminPartAreas) assign(p Position) int {
+	for i, polys := range a.polys {
+		if !a.boxes[i].contains(p) {
+			continue
+		}
+		for _, rings := range polys {
+			if positionInPolygon(p, rings) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// anchorRow is a feature's id and anchor, for placing it in an area
+type anchorRow struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	P       []float64          `bson:"p"`
+	Updated time.Time          `bson:"updated_at"`
+}
+
+// scanAnchors calls fn with the anchor of every feature matching q
+func scanAnchors(r *http.Request, q bson.M, fn func(row anchorRow)) error {
+	pipeline := bson.A{
+		bson.M{"$match": q},
+		bson.M{"$project": bson.M{"updated_at": 1, "p": bson.M{"$arrayElemAt": bson.A{flattenCoords, 0}}}},
+	}
+	cur, err := readsFor(r).Aggregate(r.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(r.Context())
+	for cur.Next(r.Context()) {
+		var row anchorRow
+		if err := cur.Decode(&row); err != nil {
+			continue
+		}
+		fn(row)
+	}
+	return cur.Err()
+}
+
+// GET /export/parts?layer=&split=tile|admin&zoom=&max_features=&level=&parent=&format=geojson|csv
+func exportPartsHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := parsePartSpec(w, r)
+	if !ok {
+		return
+	}
+	base := bson.M{"layer": s.layer}
+	if !applyProjectFilter(w, r, base) {
+		return
+	}
+	applyVisibilityFilter(r, base)
+	if !applyPublicationFilter(w, r, base) {
+		return
+	}
+	license, err := layerLicense(s.layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	m := PartManifest{GeneratedAt: time.Now().UTC(), Layer: s.layer, Split: s.split, Format: s.format, License: license, Parts: []ExportPart{}}
+	touch := func(t time.Time) {
+		if m.Version == nil || t.After(*m.Version) {
+			t := t
+			m.Version = &t
+		}
+	}
+
+	if s.split == "tile" {
+		pipeline := bson.A{
+			bson.M{"$match": base},
+			bson.M{"$group": bson.M{"_id": anchorTileExpr(maxPartZoom), "n": bson.M{"$sum": 1}, "last": bson.M{"$max": "$updated_at"}}},
+		}
+		cur, err := readsFor(r).Aggregate(r.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		var rows []struct {
+			ID struct {
+				X *float64 `bson:"x"`
+				Y *float64 `bson:"y"`
+			} `bson:"_id"`
+			N    int64     `bson:"n"`
+			Last time.Time `bson:"last"`
+		}
+		if err := cur.All(r.Context(), &rows); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		type tileKey struct{ x, y int }
+		deep := map[tileKey]int64{}
+		for _, row := range rows {
+			touch(row.Last)
+			if row.ID.X == nil || row.ID.Y == nil {
+				// no coordinates to anchor on
+				m.Skipped += row.N
+				continue
+			}
+			deep[tileKey{int(*row.ID.X), int(*row.ID.Y)}] += row.N
+		}
+		rollup := func(z int) (map[tileKey]int64, int64) {
+			out := map[tileKey]int64{}
+			var most int64
+			shift := uint(maxPartZoom - z)
+			for k, n := range deep {
+				t := tileKey{k.x >> shift, k.y >> shift}
+				out[t] += n
+				most = max(most, out[t])
+			}
+			return out, most
+		}
+		zoom := s.zoom
+		if zoom < 0 {
+			for zoom = 0; zoom < maxPartZoom; zoom++ {
+				if _, most := rollup(zoom); most <= s.maxFeatures {
+					break
+				}
+			}
+		}
+		tiles, _ := rollup(zoom)
+		m.Zoom = &zoom
+		keys := make([]tileKey, 0, len(tiles))
+		for k := range tiles {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].y != keys[j].y {
+				return keys[i].y < keys[j].y
+			}
+			return keys[i].x < keys[j].x
+		})
+		for _, k := range keys {
+			b := tileBounds(zoom, k.x, k.y)
+			id := fmt.Sprintf("%d-%d-%d", zoom, k.x, k.y)
+			m.Parts = append(m.Parts, ExportPart{
+				ID: id, Tile: []int{zoom, k.x, k.y}, BBox: []float64{b.MinLon, b.MinLat, b.MaxLon, b.MaxLat},
+				Features: tiles[k], URL: s.partURL(id),
+			})
+			m.Features += tiles[k]
+		}
+	} else {
+		m.Level, m.Parent = s.level, s.parent
+		areas, err := loadPartAreas(s)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		counts := make([]int64, len(areas.areas))
+		var outside int64
+		err = scanAnchors(r, base, func(row anchorRow) {
+			touch(row.Updated)
+			if len(row.P) < 2 {
+				m.Skipped++
+				return
+			}
+			if i := areas.assign(Position{row.P[0], row.P[1]}); i >= 0 {
+				counts[i]++
+			} else {
+				outside++
+			}
+		})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		for i, a := range areas.areas {
+			if counts[i] == 0 {
+				continue
+			}
+			b := areas.boxes[i]
+			m.Parts = append(m.Parts, ExportPart{
+				ID: a.Code, Admin: a.Code, Name: a.Name, BBox: []float64{b.MinLon, b.MinLat, b.MaxLon, b.MaxLat},
+				Features: counts[i], URL: s.partURL(a.Code),
+			})
+			m.Features += counts[i]
+		}
+		if outside > 0 {
+			m.Parts = append(m.Parts, ExportPart{ID: outsidePart, Features: outside, URL: s.partURL(outsidePart)})
+			m.Features += outside
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// GET /export/parts/{part}?layer=&split=&level=&parent=&format=
+// One part of the manifest with the same parameters: a FeatureCollection
+// or CSV of the features anchored in it, in id order.
+func exportPartHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := parsePartSpec(w, r)
+	if !ok {
+		return
+	}
+	part := mux.Vars(r)["part"]
+	q := bson.M{"layer": s.layer}
+	if !applyProjectFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+	// admin parts fetch every feature touching the area and keep the ones
+	// anchored in it
+	var keep func(*FeatureDoc) bool
+
+	if s.split == "tile" {
+		z, x, y, ok := parseTilePart(part)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_id", "invalid part", FieldError{Field: "part", Message: "must be zoom-x-y"})
+			return
+		}
+		if pre := tilePrefilter(z, x, y); pre != nil {
+			q["geometry"] = pre
+		}
+		q["$expr"] = bson.M{"$eq": bson.A{anchorTileExpr(z), bson.D{{Key: "x", Value: x}, {Key: "y", Value: y}}}}
+	} else {
+		areas, err := loadPartAreas(s)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		want := -1
+		if part != outsidePart {
+			for i, a := range areas.areas {
+				if a.Code == part {
+					want = i
+				}
+			}
+			if want < 0 {
+				writeError(w, http.StatusNotFound, "not_found", "no area "+part+" at level "+s.level)
+				return
+			}
+		}
+		scan := bson.M{}
+		for k, v := range q {
+			scan[k] = v
+		}
+		if want >= 0 {
+			scan["geometry"] = bson.M{"$geoIntersects": bson.M{"$geometry": areas.areas[want].Geometry}}
+		}
+		keep = func(doc *FeatureDoc) bool {
+			p, ok := featureAnchor(doc)
+			return ok && areas.assign(p) == want
+		}
+		q = scan
+	}
+
+	name := s.layer + "-" + part + "." + s.format
+	license, err := layerLicense(s.layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	// CSV has nowhere to put it, so the terms go in a header too
+	if license != nil && license.URL != "" {
+		w.Header().Set("Link", "<"+license.URL+`>; rel="license"`)
+	}
+	var csvKeys []string
+	if s.format == "csv" {
+		var err error
+		if csvKeys, err = propertyKeys(r.Context(), readsFor(r), q); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+	}
+	cur, err := readsFor(r).Find(r.Context(), q, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	var docs featureCursor = cur
+	if keep != nil {
+		docs = &filteredCursor{cur: cur, keep: keep}
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if s.format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		encodeFeaturesCSV(w, r, r.Context(), csvKeys, docs, r.URL.Query().Get("geom"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeGeoJSONCursor(w, r, docs, license)
+}
+
+// featureAnchor is the first position of the feature's geometry, the
+// anchor the manifest's aggregation places it by
+func featureAnchor(doc *FeatureDoc) (Position, bool) {
+	g, err := parseGeometry(doc.Geometry)
+	if err != nil {
+		return Position{}, false
+	}
+	switch {
+	case g.Type == "Point":
+		return g.Point, true
+	case len(g.Points) > 0:
+		return g.Points[0], true
+	case len(g.Rings) > 0 && len(g.Rings[0]) > 0:
+		return g.Rings[0][0], true
+	case len(g.Polygons) > 0 && len(g.Polygons[0]) > 0 && len(g.Polygons[0][0]) > 0:
+		return g.Polygons[0][0][0], true
+	}
+	return Position{}, false
+}
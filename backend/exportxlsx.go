@@ -0,0 +1,272 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// the sheet listing every vertex of the exported features
+const xlsxCoordinatesSheet = "Coordinates"
+
+// xlsxValue types a property for its cell: by the layer field's type when
+// the schema has one, by the stored value otherwise. Values that don't fit
+// their field type are kept as text rather than dropped.
+func xlsxValue(v interface{}, fieldType string) interface{} {
+	if dt, ok := v.(primitive.DateTime); ok {
+		v = dt.Time()
+	}
+	switch fieldType {
+	case "number":
+		if f, err := toFloat(v); err == nil {
+			return f
+		}
+	case "boolean":
+		switch t := v.(type) {
+		case bool:
+			return t
+		case string:
+			if b, err := strconv.ParseBool(t); err == nil {
+				return b
+			}
+		}
+	case "date":
+		switch t := v.(type) {
+		case time.Time:
+			return t
+		case string:
+			if ts, err := time.Parse(time.RFC3339, t); err == nil {
+				return ts
+			}
+			if ts, err := time.Parse("2006-01-02", t); err == nil {
+				return xlsxDate(ts)
+			}
+		}
+	case "string":
+		return csvValue(v)
+	}
+	switch t := v.(type) {
+	case nil, bool, float64, int32, int64, int, time.Time:
+		return t
+	}
+	return csvValue(v)
+}
+
+// xlsxVertex is one row of the coordinates sheet
+type xlsxVertex struct {
+	part, ring, vertex int
+	p                  Position
+}
+
+// xlsxVertices numbers the positions of g: part is the point, line or
+// polygon of a multi geometry, ring the ring of a polygon, 0 the outer one
+func xlsxVertices(g Geometry, part int, out []xlsxVertex) ([]xlsxVertex, int) {
+	switch g.Type {
+	case "Point":
+		out = append(out, xlsxVertex{part, 0, 0, g.Point})
+		part++
+	case "MultiPoint":
+		for _, p := range g.Points {
+			out = append(out, xlsxVertex{part, 0, 0, p})
+			part++
+		}
+	case "LineString":
+		for i, p := range g.Points {
+			out = append(out, xlsxVertex{part, 0, i, p})
+		}
+		part++
+	case "Polygon":
+		for r, ring := range g.Rings {
+			for i, p := range ring {
+				out = append(out, xlsxVertex{part, r, i, p})
+			}
+		}
+		part++
+	case "MultiLineString":
+		for _, line := range g.Rings {
+			for i, p := range line {
+				out = append(out, xlsxVertex{part, 0, i, p})
+			}
+			part++
+		}
+	case "MultiPolygon":
+		for _, poly := range g.Polygons {
+			for r, ring := range poly {
+				for i, p := range ring {
+					out = append(out, xlsxVertex{part, r, i, p})
+				}
+			}
+			part++
+		}
+	case "GeometryCollection":
+		for _, m := range g.Geometries {
+			out, part = xlsxVertices(m, part, out)
+		}
+	}
+	return out, part
+}
+
+// GET /export/xlsx?layer=a&layer=b&bbox=&admin=&project=&tz=&coordinates=true
+// Streams a workbook with one sheet per layer that has matching features:
+// the fixed columns, the layer's schema fields typed as numbers, dates and
+// booleans, then any other properties. A last sheet lists every vertex,
+// one row each, unless coordinates=false. Dates are written as wall clock
+// time in tz, UTC by default, since Excel cells carry no time zone.
+func exportXLSXHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid tz", FieldError{Field: "tz", Message: "unknown time zone"})
+			return
+		}
+		loc = l
+	}
+	coordinates := true
+	if v := query.Get("coordinates"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid coordinates", FieldError{Field: "coordinates", Message: "must be true or false"})
+			return
+		}
+		coordinates = b
+	}
+
+	q, layerIDs, defs, ok := exportLayers(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	generated := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", `attachment; filename="export-`+generated.Format("20060102-150405")+`.xlsx"`)
+	x := newXLSX(w, loc)
+
+	for _, id := range layerIDs {
+		lq := exportLayerQuery(q, id)
+		def := defs[id]
+		keys, err := propertyKeys(ctx, readsFor(r), lq)
+		if err != nil {
+			break
+		}
+		types := map[string]string{}
+		var fields []string
+		for _, f := range def.Fields {
+			if f.Name == "id" || f.Name == "name" || f.Name == "description" {
+				continue
+			}
+			types[f.Name] = f.Type
+			fields = append(fields, f.Name)
+		}
+		for _, k := range keys {
+			if _, ok := types[k]; !ok {
+				fields = append(fields, k)
+			}
+		}
+
+		header := []string{"id", "name", "description", "geometry_type", "lon", "lat", "created_at", "updated_at"}
+		widths := []float64{26, 30, 40, 16, 12, 12, 20, 20}
+		for _, f := range fields {
+			header = append(header, f)
+			wd := float64(len(f)) + 4
+			switch {
+			case types[f] == "date":
+				wd = 20
+			case wd < 12:
+				wd = 12
+			case wd > 40:
+				wd = 40
+			}
+			widths = append(widths, wd)
+		}
+		name := def.Name
+		if name == "" {
+			name = id
+		}
+		if id == "" {
+			name = unlayeredExportName
+		}
+		sheet, err := x.sheet(name, header, widths)
+		if err != nil {
+			break
+		}
+
+		cur, err := readsFor(r).Find(ctx, lq)
+		if err != nil {
+			break
+		}
+		for cur.Next(ctx) {
+			var doc FeatureDoc
+			if err := cur.Decode(&doc); err != nil {
+				continue
+			}
+			revealDoc(r, &doc)
+			row := []interface{}{doc.ID.Hex(), doc.Name, doc.Description, nil, nil, nil, doc.CreatedAt, doc.UpdatedAt}
+			if g, err := parseGeometry(doc.Geometry); err == nil {
+				row[3] = g.Type
+				if g.Type == "Point" {
+					row[4], row[5] = g.Point[0], g.Point[1]
+				}
+			}
+			for _, f := range fields {
+				row = append(row, xlsxValue(doc.Properties[f], types[f]))
+			}
+			if sheet.rows == xlsxMaxRows-1 {
+				sheet.row("more features than a sheet holds, export fewer to list them all")
+				break
+			}
+			sheet.row(row...)
+			countServed(r, doc.Layer, 1)
+		}
+		cur.Close(ctx)
+	}
+
+	if coordinates {
+		if sheet, err := x.sheet(xlsxCoordinatesSheet, []string{"feature_id", "layer", "part", "ring", "vertex", "lon", "lat", "alt"}, []float64{26, 20, 8, 8, 8, 14, 14, 10}); err == nil {
+			xlsxWriteVertices(r, sheet, q, layerIDs)
+		}
+	}
+	x.close()
+}
+
+// xlsxWriteVertices fills the coordinates sheet in the order of the layer
+// sheets, ending with a note when the vertices outgrow it
+func xlsxWriteVertices(r *http.Request, sheet *xlsxSheet, q bson.M, layerIDs []string) {
+	ctx := r.Context()
+	var vertices []xlsxVertex
+	for _, id := range layerIDs {
+		cur, err := readsFor(r).Find(ctx, exportLayerQuery(q, id))
+		if err != nil {
+			return
+		}
+		for cur.Next(ctx) {
+			var doc FeatureDoc
+			if err := cur.Decode(&doc); err != nil {
+				continue
+			}
+			g, err := parseGeometry(doc.Geometry)
+			if err != nil {
+				continue
+			}
+			vertices, _ = xlsxVertices(g, 0, vertices[:0])
+			for _, v := range vertices {
+				var alt interface{}
+				if len(v.p) > 2 {
+					alt = v.p[2]
+				}
+				if sheet.rows == xlsxMaxRows-1 {
+					sheet.row("more vertices than a sheet holds, export fewer features to list them all")
+					cur.Close(ctx)
+					return
+				}
+				sheet.row(doc.ID.Hex(), doc.Layer, v.part, v.ring, v.vertex, v.p[0], v.p[1], alt)
+			}
+		}
+		cur.Close(ctx)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ZipManifestFile describes one file of a zip export
+type ZipManifestFile struct {
+	Name      string        `json:"name"`
+	Layer     string        `json:"layer"`
+	LayerName string        `json:"layer_name,omitempty"`
+	Fields    []LayerField  `json:"fields,omitempty"`
+	License   *LayerLicense `json:"license,omitempty"`
+	Features  int           `json:"features"`
+}
+
+// ZipManifest is manifest.json in a zip export
+type ZipManifest struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Format      string            `json:"format"`
+	Filter      map[string]string `json:"filter"`
+	Files       []ZipManifestFile `json:"files"`
+}
+
+// features without a layer land in this file
+const unlayeredExportName = "_unlayered"
+
+// writeGeoJSONEntry streams the features matching q as one
+// FeatureCollection, with the layer's license as a "license" member when
+// it has one
+func writeGeoJSONEntry(out io.Writer, r *http.Request, q bson.M, license *LayerLicense, opts ...*options.FindOptions) (int, error) {
+	cur, err := readsFor(r).Find(r.Context(), q, opts...)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(r.Context())
+	return writeGeoJSONCursor(out, r, cur, license)
+}
+
+func writeGeoJSONCursor(out io.Writer, r *http.Request, cur featureCursor, license *LayerLicense) (int, error) {
+	io.WriteString(out, `{"type":"FeatureCollection",`)
+	enc := json.NewEncoder(out)
+	if license != nil {
+		io.WriteString(out, `"license":`)
+		b, _ := json.Marshal(license)
+		out.Write(b)
+		io.WriteString(out, ",")
+	}
+	io.WriteString(out, `"features":[`)
+	n := 0
+	for cur.Next(r.Context()) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		if n > 0 {
+			io.WriteString(out, ",")
+		}
+		revealDoc(r, &doc)
+		countServed(r, doc.Layer, 1)
+		enc.Encode(featureToGeoJSON(doc))
+		n++
+	}
+	io.WriteString(out, "]}\n")
+	return n, cur.Err()
+}
+
+// exportLayers resolves the ?layer=&bbox=&admin=&project= selection of a
+// multi-layer export: the query, the layers with matching features in
+// order, "" last for features without a layer, and their definitions
+func exportLayers(w http.ResponseWriter, r *http.Request) (bson.M, []string, map[string]LayerDoc, bool) {
+	query := r.URL.Query()
+	sel := Selection{Filter: &SelectionFilter{BBox: query.Get("bbox"), Admin: query.Get("admin")}}
+	q, err := sel.query()
+	if _, invalid := err.(selectionError); invalid {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return nil, nil, nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, nil, nil, false
+	}
+	if want := query["layer"]; len(want) == 1 {
+		q["layer"] = want[0]
+	} else if len(want) > 1 {
+		q["layer"] = bson.M{"$in": want}
+	}
+	if !applyProjectFilter(w, r, q) {
+		return nil, nil, nil, false
+	}
+	applyVisibilityFilter(r, q)
+
+	ctx := r.Context()
+	distinct, err := readsFor(r).Distinct(ctx, "layer", geoWithinFilter(q))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db distinct error: "+err.Error())
+		return nil, nil, nil, false
+	}
+	hidden, err := hiddenLayers(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db distinct error: "+err.Error())
+		return nil, nil, nil, false
+	}
+	var layerIDs []string
+	hasUnlayered := false
+	for _, v := range distinct {
+		if s, ok := v.(string); ok && s != "" {
+			keep := true
+			for _, h := range hidden {
+				keep = keep && h != s
+			}
+			if keep {
+				layerIDs = append(layerIDs, s)
+			}
+		} else {
+			hasUnlayered = true
+		}
+	}
+	sort.Strings(layerIDs)
+	if _, filtered := q["layer"]; !filtered {
+		// Distinct skips documents without the field
+		missing := bson.M{"$or": bson.A{bson.M{"layer": bson.M{"$exists": false}}, bson.M{"layer": ""}}}
+		n, err := readsFor(r).CountDocuments(ctx, bson.M{"$and": bson.A{geoWithinFilter(q), missing}}, options.Count().SetLimit(1))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+			return nil, nil, nil, false
+		}
+		hasUnlayered = hasUnlayered || n > 0
+	}
+
+	defs := map[string]LayerDoc{}
+	if len(layerIDs) > 0 {
+		cur, err := layers.Find(ctx, bson.M{"_id": bson.M{"$in": layerIDs}})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return nil, nil, nil, false
+		}
+		var docs []LayerDoc
+		if err := cur.All(ctx, &docs); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return nil, nil, nil, false
+		}
+		for _, d := range docs {
+			defs[d.ID] = d
+		}
+	}
+	if hasUnlayered {
+		layerIDs = append(layerIDs, "")
+	}
+	return q, layerIDs, defs, true
+}
+
+// exportLayerQuery narrows q to one layer of exportLayers, "" meaning the
+// features without one
+func exportLayerQuery(q bson.M, id string) bson.M {
+	lq := bson.M{}
+	for k, v := range q {
+		lq[k] = v
+	}
+	if id == "" {
+		and, _ := asArray(q["$and"])
+		lq["$and"] = append(append(bson.A{}, and...), bson.M{"$or": bson.A{bson.M{"layer": bson.M{"$exists": false}}, bson.M{"layer": ""}}})
+		delete(lq, "layer")
+	} else {
+		lq["layer"] = id
+	}
+	return lq
+}
+
+// GET /export/zip?layer=a&layer=b&bbox=&admin=&project=&format=geojson|csv
+// Streams a zip with one file per layer that has matching features, plus
+// manifest.json listing the files with their layer schema and counts.
+func exportZipHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "geojson"
+	}
+	if format != "geojson" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid format", FieldError{Field: "format", Message: "must be geojson or csv"})
+		return
+	}
+
+	q, layerIDs, defs, ok := exportLayers(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+
+	manifest := ZipManifest{
+		GeneratedAt: time.Now().UTC(),
+		Format:      format,
+		Filter:      map[string]string{},
+		Files:       []ZipManifestFile{},
+	}
+	for _, k := range []string{"bbox", "admin", "project"} {
+		if v := query.Get(k); v != "" {
+			manifest.Filter[k] = v
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="export-`+manifest.GeneratedAt.Format("20060102-150405")+`.zip"`)
+	zw := zip.NewWriter(w)
+
+	for _, id := range layerIDs {
+		lq := exportLayerQuery(q, id)
+		name := id
+		if id == "" {
+			name = unlayeredExportName
+		}
+		name += "." + format
+		f, err := zw.Create(name)
+		if err != nil {
+			break
+		}
+		var n int
+		if format == "csv" {
+			keys, err := propertyKeys(ctx, readsFor(r), lq)
+			if err != nil {
+				break
+			}
+			cur, err := readsFor(r).Find(ctx, lq)
+			if err != nil {
+				break
+			}
+			n = encodeFeaturesCSV(f, r, ctx, keys, cur, query.Get("geom"))
+			cur.Close(ctx)
+		} else if n, err = writeGeoJSONEntry(f, r, lq, defs[id].License); err != nil {
+			break
+		}
+		def := defs[id]
+		manifest.Files = append(manifest.Files, ZipManifestFile{Name: name, Layer: id, LayerName: def.Name, Fields: def.Fields, License: def.License, Features: n})
+	}
+
+	licensed := map[string]*LayerLicense{}
+	var names []string
+	for _, f := range manifest.Files {
+		if f.License != nil {
+			licensed[f.Name] = f.License
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) > 0 {
+		if f, err := zw.Create("ATTRIBUTION.txt"); err == nil {
+			writeAttribution(f, names, licensed)
+		}
+	}
+
+	// the manifest goes last so it has the counts; a file missing from it
+	// means the export was cut short
+	if f, err := zw.Create("manifest.json"); err == nil {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		enc.Encode(manifest)
+	}
+	zw.Close()
+}
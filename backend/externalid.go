@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const maxExternalIDLength = 200
+
+func setupExternalIDs() {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "external_id", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"external_id": bson.M{"$type": "string"}}),
+	})
+	if err != nil {
+		log.Printf("external_id index create warning: %v", err)
+	}
+}
+
+// PUT /features/by-external-id/{key}
+// Creates the feature carrying external id {key} or updates it with PUT
+// semantics. Returns 201 when it was created, 200 when updated.
+func upsertByExternalIDHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	if key == "" || len(key) > maxExternalIDLength {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid external id", FieldError{Field: "key", Message: "must be 1-200 characters"})
+		return
+	}
+
+	var in FeatureInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	geometry, hasGeometry, errs := in.geometry(r)
+	errs = append(errs, validateProperties(in.Properties)...)
+	errs = append(errs, validateVisibility(in.Visibility)...)
+	errs = append(errs, in.validateLevel()...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", errs...)
+		return
+	}
+
+	var existing FeatureDoc
+	err := collection.FindOne(ctx, bson.M{"external_id": key}, options.FindOne().SetProjection(bson.M{"layer": 1, "geometry": 1, "annotation": 1})).Decode(&existing)
+	created := err == mongo.ErrNoDocuments
+	if err != nil && !created {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if created && !hasGeometry {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", FieldError{Field: "geojson", Message: "required unless lat and lon are given"})
+		return
+	}
+	if !created && !checkOwnership(w, r, existing.ID) {
+		return
+	}
+	check := &existing
+	if created {
+		check = nil
+	}
+	if err := featureExtentCheck(&in, check); err != nil {
+		writeExtentError(w, err)
+		return
+	}
+	if in.parsed != nil {
+		geometry, hasGeometry = in.parsed.BSON(), true
+	}
+	if aerrs, err := featureAnnotationCheck(&in, check, false); !writeAnnotationCheck(w, aerrs, err) {
+		return
+	}
+
+	now := time.Now().UTC()
+	set := in.setFields(geometry, hasGeometry)
+	if in.Properties != nil {
+		layer := existing.Layer
+		if in.Layer != nil {
+			layer = *in.Layer
+		}
+		if herrs, err := checkLayerHeights(layer, in.Properties); !writeHeightCheck(w, herrs, err) {
+			return
+		}
+		if err := sealProperties(layer, in.Properties); err != nil {
+			writeSealError(w, err)
+			return
+		}
+		set["properties"] = in.Properties
+	}
+	set["updated_at"] = now
+	onInsert := bson.M{"created_at": now, "status": statusApproved}
+	if _, ok := set["name"]; !ok {
+		onInsert["name"] = ""
+	}
+	if uid := userID(r); uid != "" {
+		set["updated_by"] = uid
+		onInsert["created_by"] = uid
+	}
+
+	var stored FeatureDoc
+	err = collection.FindOneAndUpdate(ctx, bson.M{"external_id": key},
+		bson.M{"$set": set, "$setOnInsert": onInsert},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&stored)
+	if mongo.IsDuplicateKeyError(err) {
+		writeError(w, http.StatusConflict, "conflict", "feature with this external id was created concurrently, retry")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db upsert error: "+err.Error())
+		return
+	}
+
+	if created {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeStoredFeature(w, r, stored, in.warnings...)
+}
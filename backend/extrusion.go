@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Layers of 3D buildings opt into extrusion: their height and min_height
+// properties are then held to what MapLibre's fill-extrusion can draw.
+// Elsewhere those keys are ordinary properties, a tree's height in a
+// survey say, and stored as they come.
+
+// extrusion properties in meters above the ground, the top and the bottom
+// of a 3D building as MapLibre's fill-extrusion draws it
+const (
+	heightProperty    = "height"
+	minHeightProperty = "min_height"
+	maxHeight         = 2000
+)
+
+// validateHeights checks that extrusion heights are sensible numbers
+func validateHeights(props map[string]interface{}) []FieldError {
+	var errs []FieldError
+	heights := map[string]float64{}
+	for _, k := range []string{heightProperty, minHeightProperty} {
+		v, ok := props[k]
+		if !ok || v == nil {
+			continue
+		}
+		n, isNumber := v.(float64)
+		if !isNumber || n < 0 || n > maxHeight {
+			errs = append(errs, FieldError{Field: "properties." + k, Message: fmt.Sprintf("must be a number of meters from 0 to %d", maxHeight)})
+			continue
+		}
+		heights[k] = n
+	}
+	h, hasTop := heights[heightProperty]
+	if base, ok := heights[minHeightProperty]; ok && hasTop && base > h {
+		errs = append(errs, FieldError{Field: "properties." + minHeightProperty, Message: "must not be above height"})
+	}
+	return errs
+}
+
+// checkLayerHeights runs validateHeights when the layer is extruded
+func checkLayerHeights(layer string, props map[string]interface{}) ([]FieldError, error) {
+	if layer == "" || len(props) == 0 {
+		return nil, nil
+	}
+	c, err := loadLayerExtent(layer)
+	if err != nil || !c.extrusion {
+		return nil, err
+	}
+	return validateHeights(props), nil
+}
+
+// writeHeightCheck reports checkLayerHeights' outcome, true when the write
+// may go ahead
+func writeHeightCheck(w http.ResponseWriter, errs []FieldError, err error) bool {
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "layer lookup error: "+err.Error())
+		return false
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", errs...)
+		return false
+	}
+	return true
+}
+
+// PUT /layers/{id}/extrusion holds the layer's heights to fill-extrusion
+func putLayerExtrusionHandler(w http.ResponseWriter, r *http.Request) {
+	setLayerExtrusion(w, r, true)
+}
+
+// DELETE /layers/{id}/extrusion makes heights ordinary properties again
+func deleteLayerExtrusionHandler(w http.ResponseWriter, r *http.Request) {
+	setLayerExtrusion(w, r, false)
+}
+
+func setLayerExtrusion(w http.ResponseWriter, r *http.Request, on bool) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	change := bson.M{"$set": bson.M{"extrusion": true, "updated_at": time.Now().UTC()}}
+	if !on {
+		change = bson.M{"$unset": bson.M{"extrusion": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}}
+	}
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, change)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetLayerExtent(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"extrusion": on})
+}
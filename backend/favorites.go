@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Favorites and recently viewed features, per signed-in user, for quick
+// access in the field app. Starring is explicit; views are recorded by the
+// client with POST /features/{id}/views when it opens a feature. Only the
+// latest RECENT_VIEWS_LIMIT views are kept per user, each with how often
+// the feature was opened. Listings leave out features the user can no
+// longer see or that were deleted.
+type UserFeature struct {
+	ID      string             `bson:"_id" json:"-"`
+	User    string             `bson:"user" json:"-"`
+	Feature primitive.ObjectID `bson:"feature" json:"-"`
+	At      time.Time          `bson:"at" json:"at"`
+	Count   int                `bson:"count,omitempty" json:"count,omitempty"`
+}
+
+const (
+	defaultUserFeatureLimit = 50
+	maxUserFeatureLimit     = 500
+)
+
+var (
+	favorites        *mongo.Collection
+	recentViews      *mongo.Collection
+	recentViewsLimit = 100
+)
+
+func setupFavorites() {
+	favorites = db.Collection(getenv("MONGO_FAVORITES_COLLECTION", "favorites"))
+	recentViews = db.Collection(getenv("MONGO_RECENT_VIEWS_COLLECTION", "recent_views"))
+	if n, err := strconv.Atoi(getenv("RECENT_VIEWS_LIMIT", "")); err == nil && n > 0 {
+		recentViewsLimit = n
+	}
+	for _, c := range []*mongo.Collection{favorites, recentViews} {
+		if _, err := c.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "user", Value: 1}, {Key: "at", Value: -1}}}); err != nil {
+			log.Printf("%s index create warning: %v", c.Name(), err)
+		}
+	}
+}
+
+// requireSignedIn is the caller's user id, writing 401 when there is none;
+// favorites need someone to belong to even with auth disabled
+func requireSignedIn(w http.ResponseWriter, r *http.Request) (string, bool) {
+	uid := userID(r)
+	if uid == "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return "", false
+	}
+	return uid, true
+}
+
+// visibleFeature checks the caller may see feature id, writing 404 if not
+func visibleFeature(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return oid, false
+	}
+	q := bson.M{"_id": oid, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	if !applyPublicationFilter(w, r, q) {
+		return oid, false
+	}
+	applyVisibilityFilter(r, q)
+	n, err := collection.CountDocuments(r.Context(), q, options.Count().SetLimit(1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return oid, false
+	}
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return oid, false
+	}
+	return oid, true
+}
+
+// PUT /features/{id}/favorite stars the feature for the caller
+func putFavoriteHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireSignedIn(w, r)
+	if !ok {
+		return
+	}
+	oid, ok := visibleFeature(w, r)
+	if !ok {
+		return
+	}
+	f := UserFeature{ID: uid + "|" + oid.Hex(), User: uid, Feature: oid, At: time.Now().UTC()}
+	_, err := favorites.UpdateOne(r.Context(), bson.M{"_id": f.ID}, bson.M{"$setOnInsert": f}, options.Update().SetUpsert(true))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DELETE /features/{id}/favorite
+func deleteFavoriteHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireSignedIn(w, r)
+	if !ok {
+		return
+	}
+	id := uid + "|" + mux.Vars(r)["id"]
+	res, err := favorites.DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "feature is not a favorite")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /features/{id}/views records that the caller opened the feature
+func recordViewHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireSignedIn(w, r)
+	if !ok {
+		return
+	}
+	oid, ok := visibleFeature(w, r)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	_, err := recentViews.UpdateOne(r.Context(), bson.M{"_id": uid + "|" + oid.Hex()},
+		bson.M{"$set": bson.M{"user": uid, "feature": oid, "at": now}, "$inc": bson.M{"count": 1}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	trimRecentViews(r, uid)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trimRecentViews drops the caller's views beyond the newest
+// recentViewsLimit
+func trimRecentViews(r *http.Request, uid string) {
+	var cutoff UserFeature
+	err := recentViews.FindOne(r.Context(), bson.M{"user": uid},
+		options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}}).SetSkip(int64(recentViewsLimit)).SetProjection(bson.M{"at": 1})).Decode(&cutoff)
+	if err == mongo.ErrNoDocuments {
+		return
+	} else if err != nil {
+		log.Printf("recent views trim warning for %s: %v", uid, err)
+		return
+	}
+	if _, err := recentViews.DeleteMany(r.Context(), bson.M{"user": uid, "at": bson.M{"$lte": cutoff.At}}); err != nil {
+		log.Printf("recent views trim warning for %s: %v", uid, err)
+	}
+}
+
+// DELETE /users/me/recent clears the caller's recently viewed features
+func clearRecentViewsHandler(w http.ResponseWriter, r *http.Request) {
+	uid, ok := requireSignedIn(w, r)
+	if !ok {
+		return
+	}
+	if _, err := recentViews.DeleteMany(r.Context(), bson.M{"user": uid}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /users/me/favorites?limit=&offset=
+func listFavoritesHandler(w http.ResponseWriter, r *http.Request) {
+	listUserFeatures(w, r, favorites, "starred_at", bson.D{{Key: "at", Value: -1}})
+}
+
+// GET /users/me/recent?sort=recent|frequent&limit=&offset=
+func listRecentViewsHandler(w http.ResponseWriter, r *http.Request) {
+	order := bson.D{{Key: "at", Value: -1}}
+	switch r.URL.Query().Get("sort") {
+	case "", "recent":
+	case "frequent":
+		order = bson.D{{Key: "count", Value: -1}, {Key: "at", Value: -1}}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid sort", FieldError{Field: "sort", Message: "must be recent or frequent"})
+		return
+	}
+	listUserFeatures(w, r, recentViews, "viewed_at", order)
+}
+
+// listUserFeatures writes the caller's entries in c as a FeatureCollection
+// in order, each feature with the entry's time as the at property and, for
+// views, a view_count
+func listUserFeatures(w http.ResponseWriter, r *http.Request, c *mongo.Collection, at string, order bson.D) {
+	uid, ok := requireSignedIn(w, r)
+	if !ok {
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultUserFeatureLimit
+	}
+	if limit > maxUserFeatureLimit {
+		limit = maxUserFeatureLimit
+	}
+	cur, err := c.Find(r.Context(), bson.M{"user": uid}, options.Find().SetSort(order).SetSkip(offset).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	var entries []UserFeature
+	if err := cur.All(r.Context(), &entries); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	ids := bson.A{}
+	for _, e := range entries {
+		ids = append(ids, e.Feature)
+	}
+	q := bson.M{"_id": bson.M{"$in": ids}, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	docs := map[primitive.ObjectID]FeatureDoc{}
+	if len(ids) > 0 {
+		fcur, err := readsFor(r).Find(r.Context(), q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		defer fcur.Close(r.Context())
+		for fcur.Next(r.Context()) {
+			var doc FeatureDoc
+			if err := fcur.Decode(&doc); err != nil {
+				continue
+			}
+			docs[doc.ID] = doc
+		}
+		if err := fcur.Err(); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+	}
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, e := range entries {
+		doc, ok := docs[e.Feature]
+		if !ok {
+			continue
+		}
+		revealDoc(r, &doc)
+		f := featureToGeoJSON(doc)
+		props := f.Properties.(bson.M)
+		props[at] = e.At
+		if e.Count > 0 {
+			props["view_count"] = e.Count
+		}
+		fc.Features = append(fc.Features, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fc)
+}
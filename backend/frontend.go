@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// web/ holds the built frontend when the binary serves it itself; it is
+// filled by `go generate` (or Dockerfile.single) before building
+//
+//go:generate sh -c "rm -rf web && mkdir -p web && cp -r ../frontend/. web/ && touch web/.keep"
+//go:embed all:web
+var webFiles embed.FS
+
+const apiCtxKey ctxKey = "api"
+
+// asset names with a content hash (app.3f2a9c1b.js) never change, so they
+// can be cached for good
+var hashedAsset = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+type webAsset struct {
+	body        []byte
+	etag        string
+	contentType string
+}
+
+// frontend serves the embedded files with ETags, falling back to index.html
+// for client-side routes
+type frontend struct {
+	assets map[string]webAsset
+}
+
+// loadFrontend reads web/ into memory. apiBase is injected into index.html as
+// window.EMBEDDED_API_BASE so the app talks to this server.
+func loadFrontend(apiBase string) (*frontend, error) {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return nil, err
+	}
+	f := &frontend{assets: map[string]webAsset{}}
+	err = fs.WalkDir(sub, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		body, err := fs.ReadFile(sub, p)
+		if err != nil {
+			return err
+		}
+		if p == "index.html" {
+			inject := []byte(`<script>window.EMBEDDED_API_BASE = "` + apiBase + `";</script>`)
+			if i := bytes.Index(body, []byte("<script")); i >= 0 {
+				body = append(body[:i:i], append(inject, body[i:]...)...)
+			} else {
+				body = append(inject, body...)
+			}
+		}
+		sum := sha256.Sum256(body)
+		ct := mime.TypeByExtension(path.Ext(p))
+		if ct == "" {
+			ct = http.DetectContentType(body)
+		}
+		f.assets["/"+p] = webAsset{body: body, etag: `"` + hex.EncodeToString(sum[:8]) + `"`, contentType: ct}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.assets["/index.html"]; !ok {
+		return nil, fs.ErrNotExist
+	}
+	return f, nil
+}
+
+func (f *frontend) serve(w http.ResponseWriter, r *http.Request, p string) {
+	a := f.assets[p]
+	switch {
+	case p == "/index.html":
+		// always revalidate so deploys show up immediately
+		w.Header().Set("Cache-Control", "no-cache")
+	case hashedAsset.MatchString(p):
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	default:
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("ETag", a.etag)
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, a.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(a.body)
+}
+
+// handler is used as the router's NotFoundHandler: known files are served,
+// other GETs for paths without an extension get index.html (SPA routes), and
+// everything under /api stays a JSON 404
+func (f *frontend) handler(w http.ResponseWriter, r *http.Request) {
+	isAPI, _ := r.Context().Value(apiCtxKey).(bool)
+	if isAPI || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		notFoundHandler(w, r)
+		return
+	}
+	p := r.URL.Path
+	if p == "/" {
+		p = "/index.html"
+	}
+	if _, ok := f.assets[p]; ok {
+		f.serve(w, r, p)
+		return
+	}
+	if path.Ext(p) != "" {
+		notFoundHandler(w, r)
+		return
+	}
+	f.serve(w, r, "/index.html")
+}
+
+// stripAPIPrefix lets every API route also be reached under /api, which is
+// how the embedded frontend calls it
+func stripAPIPrefix(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" || strings.HasPrefix(r.URL.Path, "/api/") {
+			r2 := r.Clone(context.WithValue(r.Context(), apiCtxKey, true))
+			r2.URL.Path = strings.TrimPrefix(r.URL.Path, "/api")
+			if r2.URL.Path == "" {
+				r2.URL.Path = "/"
+			}
+			r2.URL.RawPath = ""
+			next.ServeHTTP(w, r2)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setupFrontend enables SERVE_FRONTEND=true: the embedded app at / and the
+// API under /api as well as at its usual paths
+func setupFrontend(r http.Handler, notFound *http.Handler) http.Handler {
+	if getenv("SERVE_FRONTEND", "") != "true" {
+		return r
+	}
+	f, err := loadFrontend(getenv("FRONTEND_API_BASE", "/api"))
+	if err != nil {
+		log.Printf("SERVE_FRONTEND set but no embedded frontend (run go generate before building): %v", err)
+		return r
+	}
+	*notFound = http.HandlerFunc(f.handler)
+	log.Printf("serving embedded frontend (%d files)", len(f.assets))
+	return stripAPIPrefix(r)
+}
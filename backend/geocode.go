@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The internal geocoder resolves addresses against an address layer built
+// from the addresses template: point features with house_number and street,
+// linked to their street line through street_feature. An address that isn't
+// in the layer is interpolated between the nearest numbers below and above
+// it on the same street, along the linked street line when there is one.
+const (
+	geocodeDefaultLimit = 5
+	geocodeMaxLimit     = 50
+	// most address points read for one street query
+	geocodeMaxAddresses = 5000
+)
+
+// confidence of each kind of match
+var geocodeConfidence = map[string]float64{"exact": 1, "interpolated": 0.8, "nearest": 0.5, "street": 0.3}
+
+func setupGeocoding() {
+	model := mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "properties.street", Value: 1}}}
+	if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+		log.Printf("address index create warning: %v", err)
+	}
+}
+
+var (
+	houseNumberPattern = regexp.MustCompile(`^(\d+)\s*([a-zA-Z]?)$`)
+	// words that only announce the house number, as in "Jl. Merdeka No. 12"
+	houseNumberWords = map[string]bool{"no": true, "no.": true, "nomor": true, "number": true, "#": true}
+)
+
+// parseAddress splits free text into a house number and a street; text after
+// the first comma (city, postcode) is dropped
+func parseAddress(text string) (number, street string) {
+	if i := strings.Index(text, ","); i >= 0 {
+		text = text[:i]
+	}
+	var words []string
+	for _, t := range strings.Fields(text) {
+		switch {
+		case houseNumberWords[strings.ToLower(t)]:
+		case number == "" && houseNumberPattern.MatchString(t):
+			number = t
+		default:
+			words = append(words, t)
+		}
+	}
+	return number, strings.Join(words, " ")
+}
+
+// houseNumber is the numeric part of a house number, false for numbers like
+// "12-14" or "blok C"
+func houseNumber(s string) (int, bool) {
+	m := houseNumberPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(m[1])
+	return n, err == nil
+}
+
+func normalizeAddressPart(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// addressPoint is an address feature of a street, with its numeric house
+// number and its distance along the street line
+type addressPoint struct {
+	doc    FeatureDoc
+	pos    Position
+	number int
+	along  float64
+}
+
+// geocodeResult is one candidate location for an address
+type geocodeResult struct {
+	Match, Street, HouseNumber, City string
+	Confidence                       float64
+	Position                         Position
+	Sources                          []string
+}
+
+// geocodeStreet resolves number on one street from its address points and
+// the street line (nil when the street isn't linked)
+func geocodeStreet(number string, points []addressPoint, line []Position) geocodeResult {
+	res := geocodeResult{Street: stringProp(points[0].doc.Properties, "street"), City: stringProp(points[0].doc.Properties, "city"), HouseNumber: number}
+	if number != "" {
+		for _, p := range points {
+			if normalizeAddressPart(stringProp(p.doc.Properties, "house_number")) == normalizeAddressPart(number) {
+				res.Match, res.Position, res.Sources = "exact", p.pos, []string{p.doc.ID.Hex()}
+				return res
+			}
+		}
+	}
+	n, numeric := houseNumber(number)
+	var numbered []addressPoint
+	for _, p := range points {
+		if p.number > 0 {
+			numbered = append(numbered, p)
+		}
+	}
+	if numeric && len(numbered) > 0 {
+		// both sides of a street usually carry one parity each, so bracket
+		// with same-parity numbers when the street has them
+		var same []addressPoint
+		for _, p := range numbered {
+			if p.number%2 == n%2 {
+				same = append(same, p)
+			}
+		}
+		if len(same) >= 2 {
+			numbered = same
+		}
+		var lo, hi *addressPoint
+		for i := range numbered {
+			p := &numbered[i]
+			if p.number <= n && (lo == nil || p.number > lo.number) {
+				lo = p
+			}
+			if p.number > n && (hi == nil || p.number < hi.number) {
+				hi = p
+			}
+		}
+		if lo != nil && hi != nil {
+			f := float64(n-lo.number) / float64(hi.number-lo.number)
+			res.Match, res.Sources = "interpolated", []string{lo.doc.ID.Hex(), hi.doc.ID.Hex()}
+			if line != nil {
+				head := lineUpTo(line, lo.along+f*(hi.along-lo.along))
+				res.Position = head[len(head)-1]
+			} else {
+				res.Position = lerp(lo.pos, hi.pos, f)
+			}
+			return res
+		}
+		near := lo
+		if near == nil {
+			near = hi
+		}
+		res.Match, res.Position, res.Sources = "nearest", near.pos, []string{near.doc.ID.Hex()}
+		return res
+	}
+	res.Match = "street"
+	if line != nil {
+		head := lineUpTo(line, lineLength(line)/2)
+		res.Position = head[len(head)-1]
+	} else {
+		var sx, sy float64
+		for _, p := range points {
+			sx, sy = sx+p.pos[0], sy+p.pos[1]
+		}
+		res.Position = Position{sx / float64(len(points)), sy / float64(len(points))}
+	}
+	for _, p := range points {
+		res.Sources = append(res.Sources, p.doc.ID.Hex())
+	}
+	if len(res.Sources) > 10 {
+		res.Sources = res.Sources[:10]
+	}
+	return res
+}
+
+func stringProp(props bson.M, key string) string {
+	if s, ok := props[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// streetLine loads the line geometry of a street feature; a MultiLineString
+// is reduced to its longest part
+func streetLine(ctx2 context.Context, id string) []Position {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil
+	}
+	var doc FeatureDoc
+	if err := collection.FindOne(ctx2, bson.M{"_id": oid}).Decode(&doc); err != nil {
+		return nil
+	}
+	g, err := parseGeometry(doc.Geometry)
+	if err != nil {
+		return nil
+	}
+	switch g.Type {
+	case "LineString":
+		return g.Points
+	case "MultiLineString":
+		var best []Position
+		for _, part := range g.Rings {
+			if lineLength(part) > lineLength(best) {
+				best = part
+			}
+		}
+		return best
+	}
+	return nil
+}
+
+// GET /geocode?q=Jl. Merdeka No. 12&city=&layer=addresses&limit=5
+// Structured queries can pass street= and number= instead of q. Results are
+// point features ordered by confidence; match tells how each was found:
+// exact, interpolated (between two known numbers), nearest (the closest
+// known number when the street has none on one side) or street (no usable
+// number).
+func geocodeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	number, street := query.Get("number"), query.Get("street")
+	if text := strings.TrimSpace(query.Get("q")); text != "" {
+		number, street = parseAddress(text)
+	}
+	street = strings.TrimSpace(street)
+	if street == "" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "q or street is required", FieldError{Field: "q", Message: "an address with a street name"})
+		return
+	}
+	limit := geocodeDefaultLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > geocodeMaxLimit {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(geocodeMaxLimit)})
+			return
+		}
+		limit = n
+	}
+	layer := query.Get("layer")
+	if layer == "" {
+		layer = "addresses"
+	}
+
+	q := bson.M{
+		"layer":             layer,
+		"status":            bson.M{"$nin": bson.A{statusPending, statusRejected}},
+		"geometry.type":     "Point",
+		"properties.street": primitive.Regex{Pattern: regexp.QuoteMeta(street), Options: "i"},
+	}
+	if city := strings.TrimSpace(query.Get("city")); city != "" {
+		q["properties.city"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(city) + "$", Options: "i"}
+	}
+	if !applyProjectFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	cur, err := readsFor(r).Find(ctx2, q, options.Find().SetLimit(geocodeMaxAddresses))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(ctx2)
+	type streetKey struct{ street, city string }
+	groups := map[streetKey][]addressPoint{}
+	var order []streetKey
+	for cur.Next(ctx2) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		g, err := parseGeometry(doc.Geometry)
+		if err != nil {
+			continue
+		}
+		k := streetKey{normalizeAddressPart(stringProp(doc.Properties, "street")), normalizeAddressPart(stringProp(doc.Properties, "city"))}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		n, _ := houseNumber(stringProp(doc.Properties, "house_number"))
+		groups[k] = append(groups[k], addressPoint{doc: doc, pos: g.Point, number: n})
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db cursor error: "+err.Error())
+		return
+	}
+
+	want := normalizeAddressPart(street)
+	var results []geocodeResult
+	for _, k := range order {
+		points := groups[k]
+		// the street line most of the street's addresses are linked to
+		links := map[string]int{}
+		link := ""
+		for _, p := range points {
+			if id := stringProp(p.doc.Properties, "street_feature"); id != "" {
+				if links[id]++; links[id] > links[link] {
+					link = id
+				}
+			}
+		}
+		var line []Position
+		if link != "" {
+			if line = streetLine(ctx2, link); len(line) >= 2 {
+				for i := range points {
+					_, points[i].along, _ = locateOnLine(line, points[i].pos)
+				}
+			} else {
+				line = nil
+			}
+		}
+		res := geocodeStreet(number, points, line)
+		res.Confidence = geocodeConfidence[res.Match]
+		if k.street != want {
+			// a partial street name match
+			res.Confidence *= 0.9
+		}
+		results = append(results, res)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Confidence > results[j].Confidence })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, res := range results {
+		props := bson.M{
+			"match":      res.Match,
+			"confidence": math.Round(res.Confidence*100) / 100,
+			"street":     res.Street,
+			"sources":    res.Sources,
+		}
+		if res.HouseNumber != "" {
+			props["house_number"] = res.HouseNumber
+		}
+		if res.City != "" {
+			props["city"] = res.City
+		}
+		fc.Features = append(fc.Features, GeoJSONFeature{Type: "Feature", Geometry: Geometry{Type: "Point", Point: res.Position}.BSON(), Properties: props})
+	}
+	writeCollection(w, r, fc, int64(limit), 0)
+}
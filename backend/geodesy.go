@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// WGS84 ellipsoid
+const (
+	wgs84A = 6378137.0
+	wgs84F = 1 / 298.257223563
+	wgs84B = wgs84A * (1 - wgs84F)
+)
+
+func toRad(d float64) float64 { return d * math.Pi / 180 }
+func toDeg(r float64) float64 { return r * 180 / math.Pi }
+
+// normalize a bearing into [0, 360)
+func normBearing(d float64) float64 {
+	d = math.Mod(d, 360)
+	if d < 0 {
+		d += 360
+	}
+	return d
+}
+
+// vincentyInverse returns the ellipsoidal distance in meters and the initial
+// and final bearings in degrees from a to b. It fails to converge only for
+// nearly antipodal points.
+func vincentyInverse(a, b Position) (dist, initial, final float64, err error) {
+	L := toRad(b[0] - a[0])
+	U1 := math.Atan((1 - wgs84F) * math.Tan(toRad(a[1])))
+	U2 := math.Atan((1 - wgs84F) * math.Tan(toRad(b[1])))
+	sinU1, cosU1 := math.Sincos(U1)
+	sinU2, cosU2 := math.Sincos(U2)
+
+	lambda := L
+	var sinSigma, cosSigma, sigma, cosSqAlpha, cos2SigmaM, sinLambda, cosLambda float64
+	for i := 0; ; i++ {
+		if i == 200 {
+			return 0, 0, 0, fmt.Errorf("distance did not converge (points are nearly antipodal)")
+		}
+		sinLambda, cosLambda = math.Sincos(lambda)
+		sinSigma = math.Hypot(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)
+		if sinSigma == 0 {
+			return 0, 0, 0, nil // same point
+		}
+		cosSigma = sinU1*sinU2 + cosU1*cosU2*cosLambda
+		sigma = math.Atan2(sinSigma, cosSigma)
+		sinAlpha := cosU1 * cosU2 * sinLambda / sinSigma
+		cosSqAlpha = 1 - sinAlpha*sinAlpha
+		cos2SigmaM = 0
+		if cosSqAlpha != 0 { // not on the equator
+			cos2SigmaM = cosSigma - 2*sinU1*sinU2/cosSqAlpha
+		}
+		C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+		prev := lambda
+		lambda = L + (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+		if math.Abs(lambda-prev) < 1e-12 {
+			break
+		}
+	}
+
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+	deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+		B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+	dist = wgs84B * A * (sigma - deltaSigma)
+	initial = normBearing(toDeg(math.Atan2(cosU2*sinLambda, cosU1*sinU2-sinU1*cosU2*cosLambda)))
+	final = normBearing(toDeg(math.Atan2(cosU1*sinLambda, -sinU1*cosU2+cosU1*sinU2*cosLambda)))
+	return dist, initial, final, nil
+}
+
+// vincentyDirect returns the point dist meters from p along the initial
+// bearing (degrees), and the final bearing there
+func vincentyDirect(p Position, bearing, dist float64) (Position, float64) {
+	sinAlpha1, cosAlpha1 := math.Sincos(toRad(bearing))
+	tanU1 := (1 - wgs84F) * math.Tan(toRad(p[1]))
+	cosU1 := 1 / math.Sqrt(1+tanU1*tanU1)
+	sinU1 := tanU1 * cosU1
+	sigma1 := math.Atan2(tanU1, cosAlpha1)
+	sinAlpha := cosU1 * sinAlpha1
+	cosSqAlpha := 1 - sinAlpha*sinAlpha
+	uSq := cosSqAlpha * (wgs84A*wgs84A - wgs84B*wgs84B) / (wgs84B * wgs84B)
+	A := 1 + uSq/16384*(4096+uSq*(-768+uSq*(320-175*uSq)))
+	B := uSq / 1024 * (256 + uSq*(-128+uSq*(74-47*uSq)))
+
+	sigma := dist / (wgs84B * A)
+	var sinSigma, cosSigma, cos2SigmaM float64
+	for i := 0; i < 200; i++ {
+		cos2SigmaM = math.Cos(2*sigma1 + sigma)
+		sinSigma, cosSigma = math.Sincos(sigma)
+		deltaSigma := B * sinSigma * (cos2SigmaM + B/4*(cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)-
+			B/6*cos2SigmaM*(-3+4*sinSigma*sinSigma)*(-3+4*cos2SigmaM*cos2SigmaM)))
+		prev := sigma
+		sigma = dist/(wgs84B*A) + deltaSigma
+		if math.Abs(sigma-prev) < 1e-12 {
+			break
+		}
+	}
+	sinSigma, cosSigma = math.Sincos(sigma)
+	cos2SigmaM = math.Cos(2*sigma1 + sigma)
+
+	x := sinU1*sinSigma - cosU1*cosSigma*cosAlpha1
+	lat := math.Atan2(sinU1*cosSigma+cosU1*sinSigma*cosAlpha1, (1-wgs84F)*math.Hypot(sinAlpha, x))
+	lambda := math.Atan2(sinSigma*sinAlpha1, cosU1*cosSigma-sinU1*sinSigma*cosAlpha1)
+	C := wgs84F / 16 * cosSqAlpha * (4 + wgs84F*(4-3*cosSqAlpha))
+	L := lambda - (1-C)*wgs84F*sinAlpha*(sigma+C*sinSigma*(cos2SigmaM+C*cosSigma*(-1+2*cos2SigmaM*cos2SigmaM)))
+	lon := math.Mod(p[0]+toDeg(L)+540, 360) - 180
+	final := normBearing(toDeg(math.Atan2(sinAlpha, -x)))
+	return Position{lon, toDeg(lat)}, final
+}
+
+// parseLatLon reads "lat,lon", the same order as ?near=
+func parseLatLon(s string) (Position, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected lat,lon")
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("expected lat,lon")
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return nil, fmt.Errorf("lat must be within [-90,90] and lon within [-180,180]")
+	}
+	return Position{lon, lat}, nil
+}
+
+// read the from= and to= points, writing the error response on failure
+func parseFromTo(w http.ResponseWriter, r *http.Request) (Position, Position, bool) {
+	var pts [2]Position
+	for i, name := range []string{"from", "to"} {
+		p, err := parseLatLon(r.URL.Query().Get(name))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid "+name, FieldError{Field: name, Message: err.Error()})
+			return nil, nil, false
+		}
+		pts[i] = p
+	}
+	return pts[0], pts[1], true
+}
+
+func pointJSON(p Position) bson.M {
+	return bson.M{"lat": p[1], "lon": p[0], "geometry": Geometry{Type: "Point", Point: p}.BSON()}
+}
+
+// GET /geodesy/bearing?from=lat,lon&to=lat,lon
+// Initial and final bearing (degrees from north) and distance on WGS84
+func bearingHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseFromTo(w, r)
+	if !ok {
+		return
+	}
+	dist, initial, final, err := vincentyInverse(from, to)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"initial_bearing": initial, "final_bearing": final, "distance_meters": dist})
+}
+
+// GET /geodesy/destination?from=lat,lon&bearing=deg&distance=2km
+func destinationHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := parseLatLon(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid from", FieldError{Field: "from", Message: err.Error()})
+		return
+	}
+	bearing, err := strconv.ParseFloat(query.Get("bearing"), 64)
+	if err != nil || math.IsNaN(bearing) || math.IsInf(bearing, 0) {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid bearing", FieldError{Field: "bearing", Message: "degrees clockwise from north"})
+		return
+	}
+	dist, err := parseDistance(query.Get("distance"))
+	if err == nil && (dist < 0 || dist > math.Pi*wgs84A) {
+		err = fmt.Errorf("must be between 0 and half the earth's circumference")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid distance", FieldError{Field: "distance", Message: err.Error()})
+		return
+	}
+	dest, final := vincentyDirect(from, normBearing(bearing), dist)
+	out := pointJSON(dest)
+	out["final_bearing"] = final
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /geodesy/midpoint?from=lat,lon&to=lat,lon
+// The point halfway along the geodesic between the two points
+func midpointHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseFromTo(w, r)
+	if !ok {
+		return
+	}
+	dist, initial, _, err := vincentyInverse(from, to)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", err.Error())
+		return
+	}
+	mid, _ := vincentyDirect(from, initial, dist/2)
+	out := pointJSON(mid)
+	out["distance_meters"] = dist
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// maximum vertices in a generated great-circle line
+const maxGreatCirclePoints = 10000
+
+// greatCirclePoints follows the geodesic from a to b with vertices at most
+// maxSeg meters apart
+func greatCirclePoints(a, b Position, maxSeg float64) ([]Position, error) {
+	dist, initial, _, err := vincentyInverse(a, b)
+	if err != nil {
+		return nil, err
+	}
+	n := int(math.Ceil(dist / maxSeg))
+	if n < 1 {
+		n = 1
+	}
+	if n >= maxGreatCirclePoints {
+		return nil, fmt.Errorf("line would exceed %d vertices; increase max_segment", maxGreatCirclePoints)
+	}
+	ps := make([]Position, 0, n+1)
+	ps = append(ps, a)
+	for k := 1; k < n; k++ {
+		p, _ := vincentyDirect(a, initial, dist*float64(k)/float64(n))
+		ps = append(ps, p)
+	}
+	return append(ps, b), nil
+}
+
+// splitAntimeridian cuts a line wherever it crosses ±180° so every part
+// stays within [-180,180] and renders without a chord across the map
+func splitAntimeridian(ps []Position) [][]Position {
+	var parts [][]Position
+	cur := []Position{ps[0]}
+	for i := 1; i < len(ps); i++ {
+		a, b := ps[i-1], ps[i]
+		if math.Abs(b[0]-a[0]) <= 180 {
+			cur = append(cur, b)
+			continue
+		}
+		// shift b next to a, find where the segment meets the meridian
+		edge := 180.0
+		bLon := b[0] + 360
+		if a[0] < 0 {
+			edge, bLon = -180, b[0]-360
+		}
+		t := (edge - a[0]) / (bLon - a[0])
+		lat := a[1] + t*(b[1]-a[1])
+		cur = append(cur, Position{edge, lat})
+		parts = append(parts, cur)
+		cur = []Position{{-edge, lat}, b}
+	}
+	return append(parts, cur)
+}
+
+// GET /geodesy/great-circle?from=lat,lon&to=lat,lon&max_segment=100km
+// &antimeridian=split|continuous
+// A geodesic LineString between two points so long connections draw as
+// curves on web mercator. split (default) returns a MultiLineString when the
+// line crosses the antimeridian; continuous lets longitudes run past ±180.
+func greatCircleHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseFromTo(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	maxSeg := 100000.0
+	if s := query.Get("max_segment"); s != "" {
+		d, err := parseDistance(s)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be greater than 0")
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid max_segment", FieldError{Field: "max_segment", Message: err.Error()})
+			return
+		}
+		maxSeg = d
+	}
+	mode := query.Get("antimeridian")
+	if mode != "" && mode != "split" && mode != "continuous" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid antimeridian", FieldError{Field: "antimeridian", Message: "must be split or continuous"})
+		return
+	}
+
+	ps, err := greatCirclePoints(from, to, maxSeg)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", err.Error())
+		return
+	}
+	dist, _, _, _ := vincentyInverse(from, to)
+
+	g := Geometry{Type: "LineString", Points: ps}
+	if mode == "continuous" {
+		for i := 1; i < len(ps); i++ {
+			for ps[i][0]-ps[i-1][0] > 180 {
+				ps[i][0] -= 360
+			}
+			for ps[i][0]-ps[i-1][0] < -180 {
+				ps[i][0] += 360
+			}
+		}
+	} else if parts := splitAntimeridian(ps); len(parts) > 1 {
+		g = Geometry{Type: "MultiLineString", Rings: parts}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   g.BSON(),
+		Properties: bson.M{"distance_meters": dist, "vertices": len(ps)},
+	})
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Position is a GeoJSON position: lon, lat and an optional altitude
+type Position []float64
+
+// Geometry is a parsed GeoJSON geometry. Only the field matching Type is set.
+type Geometry struct {
+	Type       string
+	Point      Position       // Point
+	Points     []Position     // MultiPoint, LineString
+	Rings      [][]Position   // Polygon, MultiLineString
+	Polygons   [][][]Position // MultiPolygon
+	Geometries []Geometry     // GeometryCollection
+}
+
+// asMap accepts the different map shapes geometry can arrive in
+// (decoded JSON, bson.M from Mongo, bson.D)
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case bson.M:
+		return t, true
+	case bson.D:
+		m := make(map[string]interface{}, len(t))
+		for _, e := range t {
+			m[e.Key] = e.Value
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func asArray(v interface{}) ([]interface{}, bool) {
+	switch t := v.(type) {
+	case []interface{}:
+		return t, true
+	case bson.A:
+		return t, true
+	}
+	return nil, false
+}
+
+func parsePosition(v interface{}) (Position, error) {
+	arr, ok := asArray(v)
+	if !ok || len(arr) < 2 {
+		return nil, fmt.Errorf("position must be an array of at least 2 numbers")
+	}
+	p := make(Position, 0, len(arr))
+	for _, c := range arr {
+		f, err := toFloat(c)
+		if err != nil {
+			return nil, fmt.Errorf("position contains a non-numeric value")
+		}
+		p = append(p, f)
+	}
+	return p, nil
+}
+
+func parsePositions(v interface{}) ([]Position, error) {
+	arr, ok := asArray(v)
+	if !ok {
+		return nil, fmt.Errorf("expected an array of positions")
+	}
+	out := make([]Position, 0, len(arr))
+	for _, a := range arr {
+		p, err := parsePosition(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func parseRings(v interface{}) ([][]Position, error) {
+	arr, ok := asArray(v)
+	if !ok {
+		return nil, fmt.Errorf("expected an array of position arrays")
+	}
+	out := make([][]Position, 0, len(arr))
+	for _, a := range arr {
+		ps, err := parsePositions(a)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ps)
+	}
+	return out, nil
+}
+
+// parseGeometry converts a GeoJSON geometry object into a Geometry
+func parseGeometry(v interface{}) (Geometry, error) {
+	var g Geometry
+	m, ok := asMap(v)
+	if !ok {
+		return g, fmt.Errorf("geometry must be an object")
+	}
+	g.Type, _ = m["type"].(string)
+	var err error
+	switch g.Type {
+	case "Point":
+		g.Point, err = parsePosition(m["coordinates"])
+	case "MultiPoint", "LineString":
+		g.Points, err = parsePositions(m["coordinates"])
+	case "Polygon", "MultiLineString":
+		g.Rings, err = parseRings(m["coordinates"])
+	case "MultiPolygon":
+		arr, ok := asArray(m["coordinates"])
+		if !ok {
+			return g, fmt.Errorf("MultiPolygon coordinates must be an array")
+		}
+		for _, a := range arr {
+			rings, err := parseRings(a)
+			if err != nil {
+				return g, err
+			}
+			g.Polygons = append(g.Polygons, rings)
+		}
+	case "GeometryCollection":
+		arr, ok := asArray(m["geometries"])
+		if !ok {
+			return g, fmt.Errorf("GeometryCollection geometries must be an array")
+		}
+		for _, a := range arr {
+			child, err := parseGeometry(a)
+			if err != nil {
+				return g, err
+			}
+			g.Geometries = append(g.Geometries, child)
+		}
+	case "":
+		return g, fmt.Errorf("geometry type missing")
+	default:
+		return g, fmt.Errorf("unsupported geometry type %q", g.Type)
+	}
+	return g, err
+}
+
+func positionsBSON(ps []Position) bson.A {
+	a := make(bson.A, 0, len(ps))
+	for _, p := range ps {
+		a = append(a, bson.A(toInterfaces(p)))
+	}
+	return a
+}
+
+func ringsBSON(rings [][]Position) bson.A {
+	a := make(bson.A, 0, len(rings))
+	for _, r := range rings {
+		a = append(a, positionsBSON(r))
+	}
+	return a
+}
+
+func toInterfaces(p Position) []interface{} {
+	out := make([]interface{}, len(p))
+	for i, c := range p {
+		out[i] = c
+	}
+	return out
+}
+
+// BSON returns the geometry as a GeoJSON document suitable for storing
+func (g Geometry) BSON() bson.M {
+	switch g.Type {
+	case "Point":
+		return bson.M{"type": g.Type, "coordinates": bson.A(toInterfaces(g.Point))}
+	case "MultiPoint", "LineString":
+		return bson.M{"type": g.Type, "coordinates": positionsBSON(g.Points)}
+	case "Polygon", "MultiLineString":
+		return bson.M{"type": g.Type, "coordinates": ringsBSON(g.Rings)}
+	case "MultiPolygon":
+		a := make(bson.A, 0, len(g.Polygons))
+		for _, p := range g.Polygons {
+			a = append(a, ringsBSON(p))
+		}
+		return bson.M{"type": g.Type, "coordinates": a}
+	case "GeometryCollection":
+		a := make(bson.A, 0, len(g.Geometries))
+		for _, c := range g.Geometries {
+			a = append(a, c.BSON())
+		}
+		return bson.M{"type": g.Type, "geometries": a}
+	}
+	return nil
+}
+
+/* ---------------- WKT ---------------- */
+
+func wktFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func wktPosition(p Position) string {
+	parts := make([]string, len(p))
+	for i, c := range p {
+		parts[i] = wktFloat(c)
+	}
+	return strings.Join(parts, " ")
+}
+
+func wktPositions(ps []Position) string {
+	parts := make([]string, len(ps))
+	for i, p := range ps {
+		parts[i] = wktPosition(p)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+func wktRings(rings [][]Position) string {
+	parts := make([]string, len(rings))
+	for i, r := range rings {
+		parts[i] = wktPositions(r)
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
+
+// hasZ reports that the positions carry altitudes; Validate keeps a
+// geometry to one dimension throughout
+func (g Geometry) hasZ() bool {
+	ps := g.allPositions()
+	return len(ps) > 0 && len(ps[0]) > 2
+}
+
+// WKT renders the geometry as Well-Known Text, tagged Z when 3D
+func (g Geometry) WKT() string {
+	z := ""
+	if g.hasZ() && g.Type != "GeometryCollection" {
+		z = " Z"
+	}
+	switch g.Type {
+	case "Point":
+		return "POINT" + z + " (" + wktPosition(g.Point) + ")"
+	case "MultiPoint":
+		parts := make([]string, len(g.Points))
+		for i, p := range g.Points {
+			parts[i] = "(" + wktPosition(p) + ")"
+		}
+		return "MULTIPOINT" + z + " (" + strings.Join(parts, ", ") + ")"
+	case "LineString":
+		return "LINESTRING" + z + " " + wktPositions(g.Points)
+	case "Polygon":
+		return "POLYGON" + z + " " + wktRings(g.Rings)
+	case "MultiLineString":
+		return "MULTILINESTRING" + z + " " + wktRings(g.Rings)
+	case "MultiPolygon":
+		parts := make([]string, len(g.Polygons))
+		for i, p := range g.Polygons {
+			parts[i] = wktRings(p)
+		}
+		return "MULTIPOLYGON" + z + " (" + strings.Join(parts, ", ") + ")"
+	case "GeometryCollection":
+		parts := make([]string, len(g.Geometries))
+		for i, c := range g.Geometries {
+			parts[i] = c.WKT()
+		}
+		return "GEOMETRYCOLLECTION (" + strings.Join(parts, ", ") + ")"
+	}
+	return ""
+}
+
+/* ---------------- validation ---------------- */
+
+// altitudes in meters outside this range are taken for a unit mix-up,
+// such as feet or centimetres
+const (
+	minAltitude = -12000
+	maxAltitude = 50000
+)
+
+func validatePosition(p Position) error {
+	for _, c := range p {
+		if math.IsNaN(c) || math.IsInf(c, 0) {
+			return fmt.Errorf("position contains a non-finite number")
+		}
+	}
+	if len(p) > 3 {
+		return fmt.Errorf("position has %d values, at most lon, lat and altitude", len(p))
+	}
+	if p[0] < -180 || p[0] > 180 {
+		return fmt.Errorf("longitude %v out of range [-180, 180]", p[0])
+	}
+	if p[1] < -90 || p[1] > 90 {
+		return fmt.Errorf("latitude %v out of range [-90, 90]", p[1])
+	}
+	if len(p) == 3 && (p[2] < minAltitude || p[2] > maxAltitude) {
+		return fmt.Errorf("altitude %v out of range [%d, %d] meters", p[2], minAltitude, maxAltitude)
+	}
+	return nil
+}
+
+func validatePositions(ps []Position) error {
+	for _, p := range ps {
+		if err := validatePosition(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateLine(ps []Position) error {
+	if len(ps) < 2 {
+		return fmt.Errorf("LineString needs at least 2 positions")
+	}
+	return validatePositions(ps)
+}
+
+func validatePolygon(rings [][]Position) error {
+	if len(rings) == 0 {
+		return fmt.Errorf("Polygon needs at least one ring")
+	}
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return fmt.Errorf("Polygon rings need at least 4 positions")
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("Polygon rings must be closed")
+		}
+		if err := validatePositions(ring); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks coordinate ranges and the structural rules of each type
+func (g Geometry) Validate() error {
+	ps := g.allPositions()
+	for _, p := range ps {
+		if (len(p) > 2) != (len(ps[0]) > 2) {
+			return fmt.Errorf("positions mix 2D and 3D; give every position an altitude or none")
+		}
+	}
+	switch g.Type {
+	case "Point":
+		return validatePosition(g.Point)
+	case "MultiPoint":
+		return validatePositions(g.Points)
+	case "LineString":
+		return validateLine(g.Points)
+	case "MultiLineString":
+		for _, l := range g.Rings {
+			if err := validateLine(l); err != nil {
+				return err
+			}
+		}
+	case "Polygon":
+		return validatePolygon(g.Rings)
+	case "MultiPolygon":
+		for _, p := range g.Polygons {
+			if err := validatePolygon(p); err != nil {
+				return err
+			}
+		}
+	case "GeometryCollection":
+		for _, c := range g.Geometries {
+			if err := c.Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+/* ---------------- local planar projection ---------------- */
+
+// planar is an equirectangular projection in meters centred on a reference
+// latitude. Good enough for analysis over city/regional extents.
+type planar struct {
+	lat0, lon0 float64
+	kx         float64
+}
+
+func newPlanar(ps []Position) planar {
+	var lat, lon float64
+	for _, p := range ps {
+		lon += p[0]
+		lat += p[1]
+	}
+	if n := float64(len(ps)); n > 0 {
+		lat /= n
+		lon /= n
+	}
+	return planar{lat0: lat, lon0: lon, kx: math.Cos(lat * math.Pi / 180)}
+}
+
+const degToMeters = earthRadiusMeters * math.Pi / 180
+
+func (pl planar) xy(p Position) (float64, float64) {
+	return (p[0] - pl.lon0) * pl.kx * degToMeters, (p[1] - pl.lat0) * degToMeters
+}
+
+func (pl planar) lonlat(x, y float64) Position {
+	return Position{x/(pl.kx*degToMeters) + pl.lon0, y/degToMeters + pl.lat0}
+}
+
+// allPositions flattens every vertex of the geometry
+func (g Geometry) allPositions() []Position {
+	switch g.Type {
+	case "Point":
+		return []Position{g.Point}
+	case "MultiPoint", "LineString":
+		return g.Points
+	case "Polygon", "MultiLineString":
+		var out []Position
+		for _, r := range g.Rings {
+			out = append(out, r...)
+		}
+		return out
+	case "MultiPolygon":
+		var out []Position
+		for _, p := range g.Polygons {
+			for _, r := range p {
+				out = append(out, r...)
+			}
+		}
+		return out
+	case "GeometryCollection":
+		var out []Position
+		for _, c := range g.Geometries {
+			out = append(out, c.allPositions()...)
+		}
+		return out
+	}
+	return nil
+}
+
+// uniquePositions drops repeated lon/lat pairs
+func uniquePositions(ps []Position) []Position {
+	seen := map[[2]float64]bool{}
+	out := make([]Position, 0, len(ps))
+	for _, p := range ps {
+		k := [2]float64{p[0], p[1]}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, Position{p[0], p[1]})
+	}
+	return out
+}
+
+/* ---------------- convex hull ---------------- */
+
+func cross(o, a, b Position) float64 {
+	return (a[0]-o[0])*(b[1]-o[1]) - (a[1]-o[1])*(b[0]-o[0])
+}
+
+// convexHull returns the closed counter-clockwise hull ring (monotone chain),
+// or nil for fewer than 3 non-collinear points
+func convexHull(ps []Position) []Position {
+	pts := uniquePositions(ps)
+	if len(pts) < 3 {
+		return nil
+	}
+	sort.Slice(pts, func(i, j int) bool {
+		if pts[i][0] != pts[j][0] {
+			return pts[i][0] < pts[j][0]
+		}
+		return pts[i][1] < pts[j][1]
+	})
+	hull := make([]Position, 0, 2*len(pts))
+	for _, p := range pts {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(pts) - 2; i >= 0; i-- {
+		p := pts[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	if len(hull) < 4 {
+		return nil
+	}
+	return hull
+}
+
+/* ---------------- Delaunay triangulation ---------------- */
+
+type xy struct{ x, y float64 }
+
+// triangle indexes into the point slice, counter-clockwise
+type triangle struct {
+	a, b, c int
+	cx, cy  float64 // circumcentre
+	r2      float64 // squared circumradius
+}
+
+func newTriangle(pts []xy, a, b, c int) triangle {
+	pa, pb, pc := pts[a], pts[b], pts[c]
+	if (pb.x-pa.x)*(pc.y-pa.y)-(pb.y-pa.y)*(pc.x-pa.x) < 0 {
+		b, c = c, b
+		pb, pc = pc, pb
+	}
+	d := 2 * (pa.x*(pb.y-pc.y) + pb.x*(pc.y-pa.y) + pc.x*(pa.y-pb.y))
+	t := triangle{a: a, b: b, c: c}
+	if d == 0 {
+		t.r2 = math.Inf(1)
+		return t
+	}
+	a2 := pa.x*pa.x + pa.y*pa.y
+	b2 := pb.x*pb.x + pb.y*pb.y
+	c2 := pc.x*pc.x + pc.y*pc.y
+	t.cx = (a2*(pb.y-pc.y) + b2*(pc.y-pa.y) + c2*(pa.y-pb.y)) / d
+	t.cy = (a2*(pc.x-pb.x) + b2*(pa.x-pc.x) + c2*(pb.x-pa.x)) / d
+	t.r2 = (pa.x-t.cx)*(pa.x-t.cx) + (pa.y-t.cy)*(pa.y-t.cy)
+	return t
+}
+
+type edge struct{ a, b int }
+
+// delaunay triangulates pts (Bowyer-Watson). Points must be unique. The
+// returned triangles only reference indexes < len(pts).
+//
+// Points are inserted in order along the longer side of their extent, so a
+// triangle whose circumcircle lies wholly behind the point being inserted
+// can't be touched again; it is set aside instead of being tested by every
+// later point, which keeps selections of maxAnalysisPoints to well under a
+// second.
+func delaunay(pts []xy) []triangle {
+	n := len(pts)
+	if n < 3 {
+		return nil
+	}
+	minX, minY, maxX, maxY := pts[0].x, pts[0].y, pts[0].x, pts[0].y
+	for _, p := range pts {
+		minX, maxX = math.Min(minX, p.x), math.Max(maxX, p.x)
+		minY, maxY = math.Min(minY, p.y), math.Max(maxY, p.y)
+	}
+	d := math.Max(maxX-minX, maxY-minY) * 20
+	if d == 0 {
+		return nil
+	}
+	mx, my := (minX+maxX)/2, (minY+maxY)/2
+	all := append(append([]xy{}, pts...), xy{mx - d, my - d}, xy{mx + d, my - d}, xy{mx, my + d})
+	tris := []triangle{newTriangle(all, n, n+1, n+2)}
+	var done []triangle
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	along := func(x, y float64) float64 { return x }
+	if maxY-minY > maxX-minX {
+		along = func(x, y float64) float64 { return y }
+	}
+	sort.Slice(order, func(a, b int) bool {
+		pa, pb := pts[order[a]], pts[order[b]]
+		return along(pa.x, pa.y) < along(pb.x, pb.y)
+	})
+
+	for _, i := range order {
+		p := all[i]
+		var keep []triangle
+		edges := map[edge]int{}
+		for _, t := range tris {
+			dx, dy := p.x-t.cx, p.y-t.cy
+			if behind := along(dx, dy); behind > 0 && behind*behind > t.r2 {
+				done = append(done, t)
+			} else if dx*dx+dy*dy <= t.r2 {
+				for _, e := range []edge{{t.a, t.b}, {t.b, t.c}, {t.c, t.a}} {
+					if e.a > e.b {
+						e.a, e.b = e.b, e.a
+					}
+					edges[e]++
+				}
+			} else {
+				keep = append(keep, t)
+			}
+		}
+		for e, count := range edges {
+			if count == 1 {
+				keep = append(keep, newTriangle(all, e.a, e.b, i))
+			}
+		}
+		tris = keep
+	}
+
+	done = append(done, tris...)
+	out := done[:0]
+	for _, t := range done {
+		if t.a < n && t.b < n && t.c < n {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+/* ---------------- alpha shape (concave hull) ---------------- */
+
+func ringArea(ring []xy) float64 {
+	var a float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		a += ring[i].x*ring[j].y - ring[j].x*ring[i].y
+	}
+	return a / 2
+}
+
+func pointInRing(p xy, ring []xy) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			in = !in
+		}
+	}
+	return in
+}
+
+// alphaShape keeps the Delaunay triangles whose circumradius is at most
+// alpha meters and returns the outline as polygons (outer ring first, then
+// holes), in lon/lat
+func alphaShape(ps []Position, alpha float64) [][][]Position {
+	ps = uniquePositions(ps)
+	pl := newPlanar(ps)
+	pts := make([]xy, len(ps))
+	for i, p := range ps {
+		pts[i].x, pts[i].y = pl.xy(p)
+	}
+
+	// boundary edges are the directed edges used by exactly one kept triangle
+	used := map[edge]bool{}
+	var directed []edge
+	for _, t := range delaunay(pts) {
+		if t.r2 > alpha*alpha {
+			continue
+		}
+		for _, e := range []edge{{t.a, t.b}, {t.b, t.c}, {t.c, t.a}} {
+			directed = append(directed, e)
+			used[e] = true
+		}
+	}
+	next := map[int][]int{}
+	for _, e := range directed {
+		if !used[edge{e.b, e.a}] {
+			next[e.a] = append(next[e.a], e.b)
+		}
+	}
+
+	// chain boundary edges into rings
+	var rings [][]int
+	starts := make([]int, 0, len(next))
+	for v := range next {
+		starts = append(starts, v)
+	}
+	sort.Ints(starts)
+	for _, start := range starts {
+		for len(next[start]) > 0 {
+			ring := []int{start}
+			v := start
+			for {
+				outs := next[v]
+				if len(outs) == 0 {
+					break
+				}
+				w := outs[len(outs)-1]
+				next[v] = outs[:len(outs)-1]
+				if w == start {
+					break
+				}
+				ring = append(ring, w)
+				v = w
+			}
+			if len(ring) >= 3 {
+				rings = append(rings, ring)
+			}
+		}
+	}
+
+	// counter-clockwise rings are outlines, clockwise ones are holes
+	type poly struct {
+		outer []xy
+		rings [][]int
+	}
+	var polys []*poly
+	var holes [][]int
+	toXY := func(ring []int) []xy {
+		out := make([]xy, len(ring))
+		for i, idx := range ring {
+			out[i] = pts[idx]
+		}
+		return out
+	}
+	for _, ring := range rings {
+		if ringArea(toXY(ring)) > 0 {
+			polys = append(polys, &poly{outer: toXY(ring), rings: [][]int{ring}})
+		} else {
+			holes = append(holes, ring)
+		}
+	}
+	for _, h := range holes {
+		for _, p := range polys {
+			if pointInRing(pts[h[0]], p.outer) {
+				p.rings = append(p.rings, h)
+				break
+			}
+		}
+	}
+
+	var out [][][]Position
+	for _, p := range polys {
+		var rs [][]Position
+		for _, ring := range p.rings {
+			r := make([]Position, 0, len(ring)+1)
+			for _, idx := range ring {
+				r = append(r, ps[idx])
+			}
+			rs = append(rs, append(r, ps[ring[0]]))
+		}
+		out = append(out, rs)
+	}
+	return out
+}
+
+/* ---------------- Voronoi ---------------- */
+
+// clipHalfPlane keeps the part of the ring on the side of the line a*x+b*y <= c
+func clipHalfPlane(ring []xy, a, b, c float64) []xy {
+	var out []xy
+	for i := range ring {
+		cur, prev := ring[i], ring[(i+len(ring)-1)%len(ring)]
+		dc, dp := a*cur.x+b*cur.y-c, a*prev.x+b*prev.y-c
+		if dc <= 0 {
+			if dp > 0 {
+				t := dp / (dp - dc)
+				out = append(out, xy{prev.x + t*(cur.x-prev.x), prev.y + t*(cur.y-prev.y)})
+			}
+			out = append(out, cur)
+		} else if dp <= 0 {
+			t := dp / (dp - dc)
+			out = append(out, xy{prev.x + t*(cur.x-prev.x), prev.y + t*(cur.y-prev.y)})
+		}
+	}
+	return out
+}
+
+// delaunayNeighbors lists, for each site, the sites sharing a Delaunay edge.
+// With too few or collinear sites every pair is a neighbour.
+func delaunayNeighbors(pts []xy) [][]int {
+	nb := make([]map[int]bool, len(pts))
+	for i := range nb {
+		nb[i] = map[int]bool{}
+	}
+	tris := delaunay(pts)
+	if len(tris) == 0 {
+		for i := range pts {
+			for j := range pts {
+				if i != j {
+					nb[i][j] = true
+				}
+			}
+		}
+	}
+	for _, t := range tris {
+		for _, e := range []edge{{t.a, t.b}, {t.b, t.c}, {t.c, t.a}} {
+			nb[e.a][e.b] = true
+			nb[e.b][e.a] = true
+		}
+	}
+	out := make([][]int, len(pts))
+	for i, m := range nb {
+		for j := range m {
+			out[i] = append(out[i], j)
+		}
+		sort.Ints(out[i])
+	}
+	return out
+}
+
+// voronoiCells returns the Thiessen cell of every site clipped to the outer
+// rings of the boundary polygons (holes are ignored). A cell is nil when the
+// site's region doesn't overlap the boundary.
+func voronoiCells(sites []Position, boundary [][][]Position) [][][]Position {
+	pl := newPlanar(sites)
+	pts := make([]xy, len(sites))
+	for i, s := range sites {
+		pts[i].x, pts[i].y = pl.xy(s)
+	}
+	var outers [][]xy
+	for _, poly := range boundary {
+		if len(poly) == 0 {
+			continue
+		}
+		ring := poly[0]
+		if len(ring) > 1 && samePosition(ring[0], ring[len(ring)-1]) {
+			ring = ring[:len(ring)-1]
+		}
+		r := make([]xy, len(ring))
+		for i, p := range ring {
+			r[i].x, r[i].y = pl.xy(p)
+		}
+		outers = append(outers, r)
+	}
+
+	neighbors := delaunayNeighbors(pts)
+	cells := make([][][]Position, len(sites))
+	for i, p := range pts {
+		for _, outer := range outers {
+			cell := outer
+			for _, j := range neighbors[i] {
+				q := pts[j]
+				// points closer to p than to q: 2(q-p).x <= |q|^2-|p|^2
+				a, b := 2*(q.x-p.x), 2*(q.y-p.y)
+				c := q.x*q.x + q.y*q.y - p.x*p.x - p.y*p.y
+				cell = clipHalfPlane(cell, a, b, c)
+				if len(cell) < 3 {
+					break
+				}
+			}
+			if len(cell) < 3 {
+				continue
+			}
+			if ringArea(cell) < 0 {
+				for l, r := 0, len(cell)-1; l < r; l, r = l+1, r-1 {
+					cell[l], cell[r] = cell[r], cell[l]
+				}
+			}
+			ring := make([]Position, 0, len(cell)+1)
+			for _, v := range cell {
+				ring = append(ring, pl.lonlat(v.x, v.y))
+			}
+			cells[i] = append(cells[i], append(ring, ring[0]))
+		}
+	}
+	return cells
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// gisctl runs ops tasks against the database the server uses, with the
+// server's own code, so they validate and record the same way as the admin
+// endpoints without a token or curl. It is the server binary run as
+// `server ctl <command>`, or through a link named gisctl:
+//
+//	gisctl import -layer roads roads.geojson
+//	gisctl export -layer roads -format csv -o roads.csv
+//	gisctl reindex
+//	gisctl create-user -id budi -role editor -password-stdin
+//	gisctl create-api-key -user etl -role editor
+//	gisctl seed pois roads
+//	gisctl migrate
+//
+// Commands act as an admin named GISCTL_USER (gisctl); that is the name
+// recorded as creator and in audit trails.
+var ctlCommands = map[string]func(args []string) error{
+	"import":         ctlImport,
+	"export":         ctlExport,
+	"reindex":        ctlReindex,
+	"create-user":    ctlCreateUser,
+	"create-api-key": ctlCreateAPIKey,
+	"seed":           ctlSeed,
+	"migrate":        ctlMigrate,
+}
+
+// ctlArgs returns the gisctl arguments and whether this run is one.
+// `server seed ...` predates gisctl and still works.
+func ctlArgs() ([]string, bool) {
+	if filepath.Base(os.Args[0]) == "gisctl" {
+		return os.Args[1:], true
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		return os.Args[2:], true
+	}
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		return os.Args[1:], true
+	}
+	return nil, false
+}
+
+func runCtlCommand(args []string) {
+	if len(args) == 0 || ctlCommands[args[0]] == nil {
+		names := make([]string, 0, len(ctlCommands))
+		for name := range ctlCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: gisctl <command> [flags]\ncommands: %s\n", strings.Join(names, ", "))
+		os.Exit(2)
+	}
+	if err := ctlCommands[args[0]](args[1:]); err != nil {
+		log.Printf("%s failed: %v", args[0], err)
+		os.Exit(1)
+	}
+}
+
+// ctlRequest is a request from the gisctl admin, for calling handlers
+func ctlRequest(method, target string, body io.Reader) *http.Request {
+	r, _ := http.NewRequest(method, target, body)
+	u := &User{ID: getenv("GISCTL_USER", "gisctl"), Role: "admin", Provider: "cli"}
+	return r.WithContext(context.WithValue(r.Context(), userCtxKey, u))
+}
+
+// ctlWriter sends a handler's response body to out, or keeps it as the
+// error when the status says it failed
+type ctlWriter struct {
+	header http.Header
+	status int
+	out    io.Writer
+	errBuf bytes.Buffer
+}
+
+func (c *ctlWriter) Header() http.Header { return c.header }
+
+func (c *ctlWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *ctlWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.status >= 400 {
+		return c.errBuf.Write(b)
+	}
+	return c.out.Write(b)
+}
+
+// callHandler runs h for r, writing a successful body to out
+func callHandler(h http.HandlerFunc, r *http.Request, out io.Writer) error {
+	w := &ctlWriter{header: http.Header{}, out: out}
+	h(w, r)
+	if w.status >= 400 {
+		var e struct {
+			Error APIError `json:"error"`
+		}
+		if json.Unmarshal(w.errBuf.Bytes(), &e) == nil && e.Error.Message != "" {
+			for _, f := range e.Error.Fields {
+				log.Printf("  %s: %s", f.Field, f.Message)
+			}
+			return fmt.Errorf("%s", e.Error.Message)
+		}
+		return fmt.Errorf("status %d: %s", w.status, strings.TrimSpace(w.errBuf.String()))
+	}
+	return nil
+}
+
+// jsonOut prints handler results indented, for reading at a terminal
+type jsonOut struct{ buf bytes.Buffer }
+
+func (j *jsonOut) Write(b []byte) (int, error) { return j.buf.Write(b) }
+
+func (j *jsonOut) print() {
+	var v interface{}
+	if json.Unmarshal(j.buf.Bytes(), &v) != nil {
+		os.Stdout.Write(j.buf.Bytes())
+		return
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// gisctl import [-layer id] [-dry-run] file.geojson|-
+func ctlImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	layer := fs.String("layer", "", "layer to put the features in")
+	dryRun := fs.Bool("dry-run", false, "validate only")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gisctl import [-layer id] [-dry-run] file.geojson|-")
+	}
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	q := url.Values{}
+	if *layer != "" {
+		q.Set("layer", *layer)
+	}
+	if *dryRun {
+		q.Set("dryRun", "true")
+	}
+	out := &jsonOut{}
+	if err := callHandler(importGeoJSONHandler, ctlRequest("POST", "/import/geojson?"+q.Encode(), in), out); err != nil {
+		return err
+	}
+	out.print()
+	return nil
+}
+
+// gisctl export [-layer id ...] [-bbox ...] [-format geojson|csv|zip] [-o file]
+func ctlExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var layerIDs stringList
+	fs.Var(&layerIDs, "layer", "layer to export (repeatable; default all)")
+	bbox := fs.String("bbox", "", "minLon,minLat,maxLon,maxLat")
+	format := fs.String("format", "geojson", "geojson, csv or zip")
+	output := fs.String("o", "-", "output file")
+	fs.Parse(args)
+
+	var out io.Writer = os.Stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	q := url.Values{}
+	for _, l := range layerIDs {
+		q.Add("layer", l)
+	}
+	if *bbox != "" {
+		q.Set("bbox", *bbox)
+	}
+	switch *format {
+	case "zip":
+		return callHandler(exportZipHandler, ctlRequest("GET", "/export/zip?"+q.Encode(), nil), out)
+	case "geojson", "csv":
+	default:
+		return fmt.Errorf("unknown format %q, want geojson, csv or zip", *format)
+	}
+
+	r := ctlRequest("GET", "/features?"+q.Encode(), nil)
+	sel := Selection{Filter: &SelectionFilter{BBox: *bbox}}
+	filter, err := sel.query()
+	if err != nil {
+		return err
+	}
+	if len(layerIDs) == 1 {
+		filter["layer"] = layerIDs[0]
+	} else if len(layerIDs) > 1 {
+		filter["layer"] = bson.M{"$in": []string(layerIDs)}
+	}
+	var n int
+	if *format == "csv" {
+		keys, err := propertyKeys(r.Context(), readsFor(r), filter)
+		if err != nil {
+			return err
+		}
+		cur, err := readsFor(r).Find(r.Context(), filter)
+		if err != nil {
+			return err
+		}
+		defer cur.Close(r.Context())
+		n = encodeFeaturesCSV(out, r, r.Context(), keys, cur, "")
+		err = cur.Err()
+	} else {
+		n, err = writeGeoJSONEntry(out, r, filter, nil)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d features", n)
+	return nil
+}
+
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// gisctl reindex rebuilds the text index, so a changed SEARCH_PROPERTIES
+// takes effect, and recomputes every layer's statistics. The other indexes
+// are ensured on every start, this one included.
+func ctlReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	fs.Parse(args)
+	if _, err := collection.Indexes().DropOne(ctx, "feature_text"); err != nil {
+		log.Printf("text index drop warning: %v", err)
+	}
+	setupSearch()
+
+	distinct, err := collection.Distinct(ctx, "layer", bson.M{})
+	if err != nil {
+		return fmt.Errorf("db distinct error: %w", err)
+	}
+	for _, v := range distinct {
+		layer, _ := v.(string)
+		if layer == "" {
+			continue
+		}
+		if err := refreshLayerStats(layer); err != nil {
+			return fmt.Errorf("layer %s stats: %w", layer, err)
+		}
+	}
+	log.Printf("rebuilt text index, refreshed stats of %d layer(s)", len(distinct))
+
+	specs, err := collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return fmt.Errorf("db list indexes error: %w", err)
+	}
+	for _, s := range specs {
+		fmt.Printf("%s\t%s\n", s.Name, s.KeysDocument)
+	}
+	return nil
+}
+
+// gisctl create-user -id name -role viewer|editor|admin [-name ..] [-email ..] [-password-stdin]
+// The password may also come from GISCTL_PASSWORD or GISCTL_PASSWORD_FILE;
+// without one the account can only log in after an admin issues a reset
+// token.
+func ctlCreateUser(args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	id := fs.String("id", "", "username")
+	role := fs.String("role", "", "viewer, editor or admin")
+	name := fs.String("name", "", "display name")
+	email := fs.String("email", "", "email address")
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin")
+	fs.Parse(args)
+
+	in := map[string]interface{}{"id": *id, "role": *role}
+	if *name != "" {
+		in["name"] = *name
+	}
+	if *email != "" {
+		in["email"] = *email
+	}
+	password := getsecret("GISCTL_PASSWORD", "")
+	if *passwordStdin {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if password != "" {
+		in["password"] = password
+	}
+	body, _ := json.Marshal(in)
+	out := &jsonOut{}
+	if err := callHandler(createUserHandler, ctlRequest("POST", "/users", bytes.NewReader(body)), out); err != nil {
+		return err
+	}
+	out.print()
+	return nil
+}
+
+// gisctl create-api-key -user name -role viewer|editor|admin
+// API keys are AUTH_TOKENS entries. When AUTH_TOKENS comes from a file the
+// key is added to it, and running servers pick it up on their next secret
+// reload; otherwise the entry is printed to add by hand.
+func ctlCreateAPIKey(args []string) error {
+	fs := flag.NewFlagSet("create-api-key", flag.ExitOnError)
+	user := fs.String("user", "", "user the key authenticates as")
+	role := fs.String("role", "viewer", "viewer, editor or admin")
+	fs.Parse(args)
+	if *user == "" || strings.ContainsAny(*user, ":,") {
+		return fmt.Errorf("-user is required and can't contain : or ,")
+	}
+	if _, ok := roleRanks[*role]; !ok {
+		return fmt.Errorf("unknown role %q", *role)
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+	entry := token + ":" + *user + ":" + *role
+
+	path := secretPath("AUTH_TOKENS")
+	if path == "" {
+		fmt.Println(entry)
+		log.Printf("add the entry above to AUTH_TOKENS (comma separated) and restart")
+		return nil
+	}
+	existing, err := readSecretFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if existing = strings.TrimSpace(existing); existing != "" {
+		entry = existing + "," + entry
+	}
+	if err := os.WriteFile(path, []byte(entry+"\n"), 0o600); err != nil {
+		return err
+	}
+	fmt.Println(token)
+	log.Printf("added key for %s (%s) to %s", *user, *role, path)
+	return nil
+}
+
+// gisctl seed [districts|pois|roads ...]
+func ctlSeed(args []string) error {
+	loaded, err := seedData(ctlRequest("POST", "/admin/seed", nil), args)
+	for name, n := range loaded {
+		log.Printf("seeded %s: %d records", name, n)
+	}
+	return err
+}
+
+// gisctl migrate applies pending migrations. Servers do this on start
+// unless MIGRATE_ON_STARTUP=false, which is when this is useful.
+func ctlMigrate(args []string) error {
+	applied, err := runMigrations(ctx)
+	for _, a := range applied {
+		fmt.Printf("%d\t%s\t%dms\n", a.Version, a.Name, a.DurationMs)
+	}
+	if err == nil && len(applied) == 0 {
+		log.Printf("no pending migrations")
+	}
+	return err
+}
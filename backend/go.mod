@@ -5,6 +5,9 @@ go 1.24.4
 require (
 	github.com/gorilla/mux v1.8.1
 	go.mongodb.org/mongo-driver v1.17.6
+	golang.org/x/crypto v0.26.0
+	golang.org/x/sync v0.8.0
+	golang.org/x/text v0.17.0
 )
 
 require (
@@ -15,7 +18,5 @@ require (
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
-	golang.org/x/crypto v0.26.0 // indirect
-	golang.org/x/sync v0.8.0 // indirect
-	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/net v0.21.0 // indirect
 )
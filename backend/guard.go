@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// guardrails for listing queries, configured from env in main()
+var (
+	// maximum number of features a single listing may return
+	maxFeatures int64 = 5000
+	// "reject" refuses oversized queries, "paginate" truncates them to
+	// maxFeatures and reports it in the X-Result-Truncated header
+	guardMode = "reject"
+)
+
+// parse ?limit= and ?offset=. limit 0 means no limit was requested.
+func parsePagination(r *http.Request) (limit, offset int64, err error) {
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// applyPagination sets the requested skip/limit on opts without capping
+// them, for streamed exports the guardrails don't apply to
+func applyPagination(w http.ResponseWriter, r *http.Request, opts *options.FindOptions) bool {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return false
+	}
+	if offset > 0 {
+		opts.SetSkip(offset)
+	}
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	return true
+}
+
+// applyGuardrails sets skip/limit on opts. When the client didn't paginate,
+// or asked for more than maxFeatures, it counts the matches (capped just
+// above maxFeatures). A ?limit= over the cap is cut to it; without one the
+// query is rejected or cut, depending on guardMode. Every cut sets
+// X-Result-Truncated.
+func applyGuardrails(ctx context.Context, w http.ResponseWriter, r *http.Request, q bson.M, opts *options.FindOptions) (ok bool) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return false
+	}
+	if offset > 0 {
+		opts.SetSkip(offset)
+	}
+	if limit > 0 && limit <= maxFeatures {
+		opts.SetLimit(limit)
+		return true
+	}
+
+	n, err := collection.CountDocuments(ctx, geoWithinFilter(q), options.Count().SetLimit(maxFeatures+1).SetSkip(offset))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return false
+	}
+	if n <= maxFeatures {
+		return true
+	}
+	// a ?limit= above the cap is cut to it, as paginate mode cuts the rest
+	if limit > 0 || guardMode == "paginate" {
+		opts.SetLimit(maxFeatures)
+		w.Header().Set("X-Result-Truncated", "true")
+		return true
+	}
+	writeError(w, http.StatusRequestEntityTooLarge, "result_too_large", fmt.Sprintf("query matches more than %d features; narrow the bbox or use ?limit= and ?offset=", maxFeatures))
+	return false
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Localized names and descriptions. A feature's name and description are
+// in DEFAULT_LANGUAGE; translations holds them in other languages. Reads
+// pick the best one for ?lang= or else Accept-Language, and every variant
+// is also served as name:<lang> and description:<lang> properties, the way
+// OSM tags them.
+type FeatureTranslation struct {
+	Name        string `bson:"name,omitempty" json:"name,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+}
+
+var (
+	defaultLanguage = "id"
+	languagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+)
+
+func setupI18n() {
+	if l := strings.ToLower(getenv("DEFAULT_LANGUAGE", "")); languagePattern.MatchString(l) {
+		defaultLanguage = l
+	}
+}
+
+// requestLanguages lists the caller's languages, most preferred first
+func requestLanguages(r *http.Request) []string {
+	if l := strings.ToLower(r.URL.Query().Get("lang")); l != "" {
+		return []string{l}
+	}
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var prefs []weighted
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	out := make([]string, len(prefs))
+	for i, p := range prefs {
+		out[i] = p.lang
+	}
+	return out
+}
+
+// bestLanguage picks from available (which includes the default language)
+// the first of wanted that matches exactly or by its base language, the
+// default language when none does
+func bestLanguage(wanted []string, available map[string]bool) string {
+	for _, w := range wanted {
+		if available[w] {
+			return w
+		}
+		base, _, _ := strings.Cut(w, "-")
+		if available[base] {
+			return base
+		}
+		for a := range available {
+			if ab, _, _ := strings.Cut(a, "-"); ab == base {
+				return a
+			}
+		}
+	}
+	return defaultLanguage
+}
+
+// localizeDoc swaps in the translated name and description the caller
+// prefers; without a translated description the original stays. The
+// originals are kept as the default language's translation.
+func localizeDoc(r *http.Request, doc *FeatureDoc) {
+	if len(doc.Translations) == 0 {
+		return
+	}
+	available := map[string]bool{defaultLanguage: true}
+	for l := range doc.Translations {
+		available[l] = true
+	}
+	lang := bestLanguage(requestLanguages(r), available)
+	doc.Language = lang
+	doc.Translations[defaultLanguage] = FeatureTranslation{Name: doc.Name, Description: doc.Description}
+	t := doc.Translations[lang]
+	if t.Name != "" {
+		doc.Name = t.Name
+	}
+	if t.Description != "" {
+		doc.Description = t.Description
+	}
+}
+
+// translationProperties adds the name:<lang> and description:<lang>
+// variants of doc to props
+func translationProperties(doc FeatureDoc, props bson.M) {
+	if doc.Language != "" {
+		props["lang"] = doc.Language
+	}
+	for l, t := range doc.Translations {
+		if t.Name != "" {
+			props["name:"+l] = t.Name
+		}
+		if t.Description != "" {
+			props["description:"+l] = t.Description
+		}
+	}
+}
+
+func translationFeature(w http.ResponseWriter, r *http.Request, write bool) (primitive.ObjectID, bool) {
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return oid, false
+	}
+	if write && (!requireFeatureRole(w, r, oid, "editor") || !checkOwnership(w, r, oid)) {
+		return oid, false
+	}
+	return oid, true
+}
+
+// GET /features/{id}/translations lists the translations by language
+func getTranslationsHandler(w http.ResponseWriter, r *http.Request) {
+	oid, ok := translationFeature(w, r, false)
+	if !ok {
+		return
+	}
+	q := bson.M{"_id": oid}
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	var doc FeatureDoc
+	err := collection.FindOne(r.Context(), q, options.FindOne().SetProjection(bson.M{"name": 1, "description": 1, "translations": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := map[string]FeatureTranslation{defaultLanguage: {Name: doc.Name, Description: doc.Description}}
+	for l, t := range doc.Translations {
+		out[l] = t
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"default": defaultLanguage, "translations": out})
+}
+
+// PUT /features/{id}/translations/{lang} { name, description }
+// The default language is the feature's own name and description, edited
+// with PUT /features/{id}.
+func putTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	oid, ok := translationFeature(w, r, true)
+	if !ok {
+		return
+	}
+	lang := strings.ToLower(mux.Vars(r)["lang"])
+	if !languagePattern.MatchString(lang) || lang == defaultLanguage {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid language", FieldError{Field: "lang", Message: "a language tag such as en or en-gb, other than the default " + defaultLanguage})
+		return
+	}
+	var body FeatureTranslation
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	body.Name, body.Description = strings.TrimSpace(body.Name), strings.TrimSpace(body.Description)
+	if body.Name == "" && body.Description == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "empty translation", FieldError{Field: "name", Message: "name or description required"})
+		return
+	}
+	set := bson.M{"translations." + lang: body, "updated_at": time.Now().UTC()}
+	if uid := userID(r); uid != "" {
+		set["updated_by"] = uid
+	}
+	res, err := collection.UpdateOne(r.Context(), bson.M{"_id": oid}, bson.M{"$set": set})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// DELETE /features/{id}/translations/{lang}
+func deleteTranslationHandler(w http.ResponseWriter, r *http.Request) {
+	oid, ok := translationFeature(w, r, true)
+	if !ok {
+		return
+	}
+	lang := strings.ToLower(mux.Vars(r)["lang"])
+	if !languagePattern.MatchString(lang) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid language", FieldError{Field: "lang", Message: "a language tag such as en or en-gb"})
+		return
+	}
+	res, err := collection.UpdateOne(r.Context(), bson.M{"_id": oid, "translations." + lang: bson.M{"$exists": true}},
+		bson.M{"$unset": bson.M{"translations." + lang: ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no "+lang+" translation")
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IdempotencyRecord stores the outcome of a request made with an
+// Idempotency-Key so retries get the same response
+type IdempotencyRecord struct {
+	Key         string    `bson:"_id"`
+	Done        bool      `bson:"done"`
+	Fingerprint string    `bson:"fingerprint,omitempty"`
+	Status      int       `bson:"status,omitempty"`
+	ContentType string    `bson:"content_type,omitempty"`
+	Body        []byte    `bson:"body,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+}
+
+var idempotencyKeys *mongo.Collection
+
+func setupIdempotency() {
+	idempotencyKeys = db.Collection(getenv("MONGO_IDEMPOTENCY_COLLECTION", "idempotency_keys"))
+	ttl, err := time.ParseDuration(getenv("IDEMPOTENCY_TTL", "24h"))
+	if err != nil {
+		ttl = 24 * time.Hour
+	}
+	_, err = idempotencyKeys.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds())),
+	})
+	if err != nil {
+		log.Printf("idempotency index create warning: %v", err)
+	}
+}
+
+// responseRecorder passes the response through while keeping a copy
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.buf.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// hashingBody fingerprints the request body as the handler reads it, so large
+// imports aren't buffered in memory
+type hashingBody struct {
+	io.ReadCloser
+	h hash.Hash
+}
+
+func (b *hashingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.h.Write(p[:n])
+	return n, err
+}
+
+func bodyFingerprint(r io.Reader) string {
+	h := sha256.New()
+	io.Copy(h, r)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotent wraps a create handler. Requests carrying an Idempotency-Key
+// header run once per key (scoped to caller and route); repeats replay the
+// stored response. Server errors aren't stored so the client can retry.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "Idempotency-Key too long", FieldError{Field: "Idempotency-Key", Message: "at most 255 characters"})
+			return
+		}
+		scoped := userID(r) + "|" + r.Method + " " + r.URL.Path + "|" + key
+
+		_, err := idempotencyKeys.InsertOne(ctx, IdempotencyRecord{Key: scoped, CreatedAt: time.Now().UTC()})
+		if mongo.IsDuplicateKeyError(err) {
+			var rec IdempotencyRecord
+			if err := idempotencyKeys.FindOne(ctx, bson.M{"_id": scoped}).Decode(&rec); err != nil {
+				writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+				return
+			}
+			if !rec.Done {
+				writeError(w, http.StatusConflict, "idempotency_in_progress", "a request with this Idempotency-Key is still being processed")
+				return
+			}
+			if bodyFingerprint(r.Body) != rec.Fingerprint {
+				writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", "Idempotency-Key was already used with a different request body")
+				return
+			}
+			if rec.ContentType != "" {
+				w.Header().Set("Content-Type", rec.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.Status)
+			w.Write(rec.Body)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return
+		}
+
+		hb := &hashingBody{ReadCloser: r.Body, h: sha256.New()}
+		r.Body = hb
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+		// drain whatever the handler didn't read so the fingerprint covers
+		// the whole body
+		io.Copy(io.Discard, hb)
+
+		if rec.status == 0 || rec.status >= 500 {
+			idempotencyKeys.DeleteOne(ctx, bson.M{"_id": scoped})
+			return
+		}
+		_, err = idempotencyKeys.UpdateOne(ctx, bson.M{"_id": scoped}, bson.M{"$set": bson.M{
+			"done":         true,
+			"fingerprint":  hex.EncodeToString(hb.h.Sum(nil)),
+			"status":       rec.status,
+			"content_type": rec.Header().Get("Content-Type"),
+			"body":         rec.buf.Bytes(),
+		}})
+		if err != nil {
+			log.Printf("idempotency store warning: %v", err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// grid size limits for IDW output
+	maxIDWCellsGeoJSON = 20000
+	maxIDWCellsPNG     = 1 << 20
+	// upper bound on cells x samples work per request
+	maxIDWWork = 50000000
+)
+
+type idwSample struct {
+	x, y, v float64
+}
+
+// idwGrid interpolates a rows x cols grid over box; cells with no sample
+// within maxDist (meters, 0 = unlimited) are NaN. Row 0 is the northern edge.
+func idwGrid(samples []idwSample, pl planar, box BBox, cols, rows int, power, maxDist float64) [][]float64 {
+	grid := make([][]float64, rows)
+	dLon := (box.MaxLon - box.MinLon) / float64(cols)
+	dLat := (box.MaxLat - box.MinLat) / float64(rows)
+	for r := 0; r < rows; r++ {
+		grid[r] = make([]float64, cols)
+		lat := box.MaxLat - (float64(r)+0.5)*dLat
+		for c := 0; c < cols; c++ {
+			lon := box.MinLon + (float64(c)+0.5)*dLon
+			x, y := pl.xy(Position{lon, lat})
+			var num, den float64
+			exact := false
+			for _, s := range samples {
+				d := math.Hypot(s.x-x, s.y-y)
+				if d < 1e-9 {
+					grid[r][c] = s.v
+					exact = true
+					break
+				}
+				if maxDist > 0 && d > maxDist {
+					continue
+				}
+				wt := 1 / math.Pow(d, power)
+				num += wt * s.v
+				den += wt
+			}
+			if exact {
+				continue
+			}
+			if den == 0 {
+				grid[r][c] = math.NaN()
+			} else {
+				grid[r][c] = num / den
+			}
+		}
+	}
+	return grid
+}
+
+// rampColor maps t in [0,1] onto a blue-cyan-yellow-red ramp
+func rampColor(t float64) color.NRGBA {
+	stops := []color.NRGBA{{43, 131, 186, 200}, {171, 221, 164, 200}, {255, 255, 191, 200}, {253, 174, 97, 200}, {215, 25, 28, 200}}
+	if t <= 0 {
+		return stops[0]
+	}
+	if t >= 1 {
+		return stops[len(stops)-1]
+	}
+	f := t * float64(len(stops)-1)
+	i := int(f)
+	frac := f - float64(i)
+	a, b := stops[i], stops[i+1]
+	mix := func(x, y uint8) uint8 { return uint8(float64(x) + frac*(float64(y)-float64(x))) }
+	return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// POST /analysis/idw { ids | filter, property, cell_size, bbox, power,
+// max_distance, format }
+// Inverse-distance-weighted surface of a numeric property over point
+// features. format=geojson (default) returns one polygon per cell,
+// format=png a color-ramped image covering bbox.
+func idwHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Selection
+		Property    string  `json:"property"`
+		CellSize    float64 `json:"cell_size"` // meters
+		BBox        string  `json:"bbox"`
+		Power       float64 `json:"power"`
+		MaxDistance float64 `json:"max_distance"` // meters
+		Format      string  `json:"format"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Property == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "property required", FieldError{Field: "property", Message: "name of a numeric property"})
+		return
+	}
+	if !(body.CellSize > 0) || math.IsInf(body.CellSize, 0) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid cell_size", FieldError{Field: "cell_size", Message: "must be a positive size in meters"})
+		return
+	}
+	if body.Power == 0 {
+		body.Power = 2
+	}
+	if body.Format == "" {
+		body.Format = "geojson"
+	}
+	if body.Format != "geojson" && body.Format != "png" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid format", FieldError{Field: "format", Message: "must be geojson or png"})
+		return
+	}
+
+	docs, err := loadSelection(r, body.Selection)
+	if err != nil {
+		writeSelectionError(w, err)
+		return
+	}
+	var pts []Position
+	var vals []float64
+	for _, d := range docs {
+		g, err := parseGeometry(d.Geometry)
+		if err != nil || g.Type != "Point" {
+			continue
+		}
+		v, err := toFloat(d.Properties[body.Property])
+		if err != nil || math.IsNaN(v) {
+			continue
+		}
+		pts = append(pts, g.Point)
+		vals = append(vals, v)
+	}
+	if len(pts) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "no point features with a numeric "+body.Property)
+		return
+	}
+
+	var box BBox
+	if body.BBox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(body.BBox)
+		if !ok || minLon >= maxLon || minLat >= maxLat {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid bbox", FieldError{Field: "bbox", Message: "expected minLon,minLat,maxLon,maxLat"})
+			return
+		}
+		box = BBox{minLon, minLat, maxLon, maxLat}
+	} else {
+		box = BBox{pts[0][0], pts[0][1], pts[0][0], pts[0][1]}
+		for _, p := range pts {
+			box.MinLon, box.MaxLon = math.Min(box.MinLon, p[0]), math.Max(box.MaxLon, p[0])
+			box.MinLat, box.MaxLat = math.Min(box.MinLat, p[1]), math.Max(box.MaxLat, p[1])
+		}
+	}
+
+	pl := newPlanar(pts)
+	x0, y0 := pl.xy(Position{box.MinLon, box.MinLat})
+	x1, y1 := pl.xy(Position{box.MaxLon, box.MaxLat})
+	// the grid is sized in floats and checked against the limits before
+	// it is converted, a tiny cell_size would overflow an int
+	fCols := math.Max(1, math.Ceil((x1-x0)/body.CellSize))
+	fRows := math.Max(1, math.Ceil((y1-y0)/body.CellSize))
+	if math.IsNaN(fCols) || math.IsNaN(fRows) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid cell_size", FieldError{Field: "cell_size", Message: "doesn't give a grid over bbox"})
+		return
+	}
+	limit := float64(maxIDWCellsGeoJSON)
+	if body.Format == "png" {
+		limit = maxIDWCellsPNG
+	}
+	if fCols*fRows > limit || fCols*fRows*float64(len(pts)) > maxIDWWork {
+		writeError(w, http.StatusRequestEntityTooLarge, "result_too_large", fmt.Sprintf("grid of %gx%g cells over %d samples is too large; increase cell_size", fCols, fRows, len(pts)))
+		return
+	}
+	cols, rows := int(fCols), int(fRows)
+
+	samples := make([]idwSample, len(pts))
+	for i, p := range pts {
+		samples[i].x, samples[i].y = pl.xy(p)
+		samples[i].v = vals[i]
+	}
+	var grid [][]float64
+	if !runGeometry(w, r, func() { grid = idwGrid(samples, pl, box, cols, rows, body.Power, body.MaxDistance) }) {
+		return
+	}
+
+	minV, maxV := math.Inf(1), math.Inf(-1)
+	for _, row := range grid {
+		for _, v := range row {
+			if !math.IsNaN(v) {
+				minV, maxV = math.Min(minV, v), math.Max(maxV, v)
+			}
+		}
+	}
+
+	dLon := (box.MaxLon - box.MinLon) / float64(cols)
+	dLat := (box.MaxLat - box.MinLat) / float64(rows)
+	if body.Format == "png" {
+		img := image.NewNRGBA(image.Rect(0, 0, cols, rows))
+		for rr, row := range grid {
+			for c, v := range row {
+				if math.IsNaN(v) {
+					continue
+				}
+				t := 0.0
+				if maxV > minV {
+					t = (v - minV) / (maxV - minV)
+				}
+				img.SetNRGBA(c, rr, rampColor(t))
+			}
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-BBox", fmt.Sprintf("%g,%g,%g,%g", box.MinLon, box.MinLat, box.MaxLon, box.MaxLat))
+		w.Header().Set("X-Value-Min", strconv.FormatFloat(minV, 'g', -1, 64))
+		w.Header().Set("X-Value-Max", strconv.FormatFloat(maxV, 'g', -1, 64))
+		png.Encode(w, img)
+		return
+	}
+
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for rr, row := range grid {
+		top := box.MaxLat - float64(rr)*dLat
+		for c, v := range row {
+			if math.IsNaN(v) {
+				continue
+			}
+			left := box.MinLon + float64(c)*dLon
+			ring := []Position{{left, top - dLat}, {left + dLon, top - dLat}, {left + dLon, top}, {left, top}, {left, top - dLat}}
+			g := Geometry{Type: "Polygon", Rings: [][]Position{ring}}
+			fc.Features = append(fc.Features, GeoJSONFeature{
+				Type:       "Feature",
+				Geometry:   g.BSON(),
+				Properties: bson.M{"value": v, "row": rr, "col": c},
+			})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fc)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// features per InsertMany call
+	importBatchSize = 500
+	// per-row errors kept in the report
+	maxImportErrors = 1000
+)
+
+// ImportRowError describes why one input feature was rejected
+type ImportRowError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// ImportReport summarizes an import or a dry run
+type ImportReport struct {
+	DryRun          bool             `json:"dry_run"`
+	Total           int              `json:"total"`
+	Valid           int              `json:"valid"`
+	Invalid         int              `json:"invalid"`
+	Inserted        int64            `json:"inserted"`
+	Errors          []ImportRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated,omitempty"`
+	// Warnings are coordinate guard findings and splits by the layer's
+	// multi policy on features that were kept
+	Warnings []ImportRowError `json:"warnings,omitempty"`
+}
+
+func (rep *ImportReport) addError(index int, err error) {
+	rep.Invalid++
+	if len(rep.Errors) >= maxImportErrors {
+		rep.ErrorsTruncated = true
+		return
+	}
+	rep.Errors = append(rep.Errors, ImportRowError{Index: index, Error: err.Error()})
+}
+
+// importFeatureDoc validates one GeoJSON Feature and converts it to
+// FeatureDocs, one unless the layer splits its geometry; name and
+// description are taken from its properties. Coordinate guard warnings
+// are appended to warnings when it isn't nil.
+func importFeatureDoc(raw interface{}, r *http.Request, layer string, now time.Time, warnings *[]string) ([]FeatureDoc, error) {
+	f, ok := asMap(raw)
+	if !ok || f["type"] != "Feature" {
+		return nil, fmt.Errorf("not a GeoJSON Feature")
+	}
+	g, err := parseGeometry(f["geometry"])
+	if err != nil {
+		return nil, err
+	}
+	if err := checkGeometry(r, g, warnings); err != nil {
+		return nil, err
+	}
+	gs, err := layerGeometries(layer, g)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLayerExtent(layer, g, warnings); err != nil {
+		return nil, err
+	}
+	if len(gs) > 1 && warnings != nil {
+		*warnings = append(*warnings, fmt.Sprintf("split into %d %s features by layer %s", len(gs), gs[0].Type, layer))
+	}
+	props := bson.M{}
+	if p, present := f["properties"]; present && p != nil {
+		m, ok := asMap(p)
+		if !ok {
+			return nil, fmt.Errorf("properties must be an object")
+		}
+		for k, v := range m {
+			props[k] = v
+		}
+	}
+	herrs, err := checkLayerHeights(layer, props)
+	if err != nil {
+		return nil, err
+	}
+	if len(herrs) > 0 {
+		return nil, fmt.Errorf("%s %s", herrs[0].Field, herrs[0].Message)
+	}
+	name, _ := props["name"].(string)
+	desc, _ := props["description"].(string)
+	delete(props, "name")
+	delete(props, "description")
+	delete(props, "id")
+
+	docs := make([]FeatureDoc, len(gs))
+	for i, part := range gs {
+		docs[i] = FeatureDoc{
+			Name:        name,
+			Description: desc,
+			Layer:       layer,
+			Geometry:    part.BSON(),
+			Status:      statusApproved,
+			CreatedBy:   userID(r),
+			UpdatedBy:   userID(r),
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if len(props) > 0 {
+			docs[i].Properties = props
+		}
+	}
+	return docs, nil
+}
+
+// geoJSONStream walks a FeatureCollection body token by token so only one
+// feature at a time is held in memory, however large the upload
+type geoJSONStream struct {
+	dec *json.Decoder
+	// inFeatures is set while positioned inside the features array
+	inFeatures bool
+	sawType    bool
+	done       bool
+}
+
+func newGeoJSONStream(r io.Reader) (*geoJSONStream, error) {
+	s := &geoJSONStream{dec: json.NewDecoder(r)}
+	if t, err := s.dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, fmt.Errorf("body must be a JSON object")
+	}
+	return s, nil
+}
+
+// next returns the next raw feature; ok is false once the body is exhausted. The
+// top-level "type" is checked as soon as it is seen; GeoJSON writers put it
+// before "features".
+func (s *geoJSONStream) next() (raw interface{}, ok bool, err error) {
+	for !s.done {
+		if s.inFeatures {
+			if s.dec.More() {
+				if err := s.dec.Decode(&raw); err != nil {
+					return nil, false, err
+				}
+				return raw, true, nil
+			}
+			if _, err := s.dec.Token(); err != nil { // ]
+				return nil, false, err
+			}
+			s.inFeatures = false
+			continue
+		}
+		if !s.dec.More() {
+			if _, err := s.dec.Token(); err != nil { // }
+				return nil, false, err
+			}
+			if !s.sawType {
+				return nil, false, errNotFeatureCollection
+			}
+			s.done = true
+			break
+		}
+		t, err := s.dec.Token()
+		if err != nil {
+			return nil, false, err
+		}
+		switch t {
+		case "type":
+			var typ string
+			if err := s.dec.Decode(&typ); err != nil || typ != "FeatureCollection" {
+				return nil, false, errNotFeatureCollection
+			}
+			s.sawType = true
+		case "features":
+			if t, err := s.dec.Token(); err != nil {
+				return nil, false, err
+			} else if t != json.Delim('[') {
+				return nil, false, fmt.Errorf("features must be an array")
+			}
+			s.inFeatures = true
+		default:
+			// skip other members (bbox, crs, name, ...)
+			var skip json.RawMessage
+			if err := s.dec.Decode(&skip); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	return nil, false, nil
+}
+
+var errNotFeatureCollection = errors.New("body must be a GeoJSON FeatureCollection")
+
+// POST /import/geojson?layer=&dryRun=true imports a FeatureCollection.
+// Invalid features are reported and skipped; with dryRun nothing is written.
+// The body is streamed: features are validated and inserted a batch at a
+// time, so memory stays bounded for very large uploads.
+func importGeoJSONHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	stream, err := newGeoJSONStream(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	layer := r.URL.Query().Get("layer")
+	rep := ImportReport{DryRun: dryRun, Errors: []ImportRowError{}}
+	now := time.Now().UTC()
+
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := collection.InsertMany(r.Context(), batch, options.InsertMany().SetOrdered(false))
+		if res != nil {
+			rep.Inserted += int64(len(res.InsertedIDs))
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	// validate a chunk at a time on the geometry pool, then insert it
+	process := func(start int, chunk []interface{}) bool {
+		docs := make([][]FeatureDoc, len(chunk))
+		errs := make([]error, len(chunk))
+		warnings := make([][]string, len(chunk))
+		ok := runGeometry(w, r, func() {
+			for j, raw := range chunk {
+				docs[j], errs[j] = importFeatureDoc(raw, r, layer, now, &warnings[j])
+			}
+		})
+		if !ok {
+			return false
+		}
+		for j := range chunk {
+			rep.Total++
+			if errs[j] != nil {
+				rep.addError(start+j, errs[j])
+				continue
+			}
+			rep.Valid++
+			for _, msg := range warnings[j] {
+				if len(rep.Warnings) < maxImportErrors {
+					rep.Warnings = append(rep.Warnings, ImportRowError{Index: start + j, Error: msg})
+				}
+			}
+			if !dryRun {
+				// the parts of a split feature share their properties, so
+				// they are sealed once
+				if err := sealProperties(docs[j][0].Layer, docs[j][0].Properties); err != nil {
+					writeSealError(w, err)
+					return false
+				}
+				for _, doc := range docs[j] {
+					batch = append(batch, doc)
+				}
+			}
+		}
+		if err := flush(); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return false
+		}
+		return true
+	}
+
+	chunk := make([]interface{}, 0, importBatchSize)
+	for index := 0; ; {
+		raw, more, err := stream.next()
+		if err != nil {
+			code, msg := "invalid_json", "invalid json: "+err.Error()
+			if err == errNotFeatureCollection {
+				code, msg = "validation_failed", err.Error()
+			}
+			if rep.Inserted > 0 {
+				msg += fmt.Sprintf(" (%d features before this point were imported)", rep.Inserted)
+			}
+			writeError(w, http.StatusBadRequest, code, msg)
+			return
+		}
+		if more {
+			chunk = append(chunk, raw)
+		}
+		if len(chunk) == importBatchSize || (!more && len(chunk) > 0) {
+			if !process(index, chunk) {
+				return
+			}
+			index += len(chunk)
+			chunk = chunk[:0]
+		}
+		if !more {
+			break
+		}
+	}
+
+	if !dryRun {
+		notify(Event{
+			Type:    eventImportCompleted,
+			Subject: "GeoJSON import completed",
+			Message: fmt.Sprintf("%d of %d features imported into layer %q (%d invalid).", rep.Inserted, rep.Total, layer, rep.Invalid),
+			Data:    map[string]interface{}{"layer": layer, "total": rep.Total, "inserted": rep.Inserted, "invalid": rep.Invalid},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
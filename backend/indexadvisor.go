@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// how many distinct query shapes are tracked; new shapes beyond this are
+// ignored until a restart
+const maxQueryShapes = 200
+
+// queryShape is a listing filter with its values stripped, counted as
+// requests come in. Sample keeps the latest concrete filter so explain()
+// has real values to plan with.
+type queryShape struct {
+	Shape    string
+	Sort     bson.D
+	Sample   bson.M
+	Count    int64
+	LastSeen time.Time
+}
+
+var (
+	queryShapesMu sync.Mutex
+	queryShapes   = map[string]*queryShape{}
+)
+
+// shapeOf replaces every value in a filter with "?" but keeps field names
+// and operators, e.g. {"layer":"?","geometry":{"$geoWithin":"?"}}
+func shapeOf(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.M:
+		out := bson.M{}
+		for k, x := range t {
+			if strings.HasPrefix(k, "$") && k != "$and" && k != "$or" {
+				out[k] = "?"
+			} else {
+				out[k] = shapeOf(x)
+			}
+		}
+		return out
+	case bson.A:
+		out := bson.A{}
+		for _, x := range t {
+			out = append(out, shapeOf(x))
+		}
+		return out
+	}
+	return "?"
+}
+
+// recordQueryShape counts a listing query for the index analyzer
+func recordQueryShape(q bson.M, sortDoc bson.D) {
+	b, _ := json.Marshal(shapeOf(q))
+	var keys []string
+	for _, e := range sortDoc {
+		keys = append(keys, fmt.Sprint(e.Key, ":", e.Value))
+	}
+	key := string(b) + " sort=" + strings.Join(keys, ",")
+
+	queryShapesMu.Lock()
+	defer queryShapesMu.Unlock()
+	s, ok := queryShapes[key]
+	if !ok {
+		if len(queryShapes) >= maxQueryShapes {
+			return
+		}
+		s = &queryShape{Shape: string(b), Sort: sortDoc}
+		queryShapes[key] = s
+	}
+	s.Count++
+	s.Sample = q
+	s.LastSeen = time.Now().UTC()
+}
+
+// planStages walks an explain plan collecting stage names and index names
+func planStages(plan interface{}, stages, indexes *[]string) {
+	m, ok := asMap(plan)
+	if !ok {
+		return
+	}
+	if s, ok := m["stage"].(string); ok {
+		*stages = append(*stages, s)
+	}
+	if name, ok := m["indexName"].(string); ok {
+		*indexes = append(*indexes, name)
+	}
+	for _, k := range []string{"inputStage", "queryPlan"} {
+		if child, ok := m[k]; ok {
+			planStages(child, stages, indexes)
+		}
+	}
+	if children, ok := asArray(m["inputStages"]); ok {
+		for _, c := range children {
+			planStages(c, stages, indexes)
+		}
+	}
+}
+
+// filterFields lists the document fields a filter touches
+func filterFields(q bson.M, out map[string]bool) {
+	for k, v := range q {
+		if k == "$and" || k == "$or" {
+			if arr, ok := v.(bson.A); ok {
+				for _, x := range arr {
+					if sub, ok := x.(bson.M); ok {
+						filterFields(sub, out)
+					}
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(k, "$") {
+			out[k] = true
+		}
+	}
+}
+
+// ShapeReport is the analyzer's verdict on one query shape
+type ShapeReport struct {
+	Shape       string   `json:"shape"`
+	Sort        string   `json:"sort,omitempty"`
+	Count       int64    `json:"count"`
+	LastSeen    string   `json:"last_seen"`
+	Stages      []string `json:"stages"`
+	Indexes     []string `json:"indexes"`
+	CollScan    bool     `json:"collscan"`
+	Suggestions []string `json:"suggestions"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// GET /admin/indexes/analyze?top=20
+// Runs explain() on the most frequent feature listing shapes seen since
+// startup and reports whether they use an index, with suggestions.
+func analyzeIndexesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	top := 20
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxQueryShapes {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid top", FieldError{Field: "top", Message: "must be between 1 and " + strconv.Itoa(maxQueryShapes)})
+			return
+		}
+		top = n
+	}
+
+	queryShapesMu.Lock()
+	shapes := make([]queryShape, 0, len(queryShapes))
+	for _, s := range queryShapes {
+		shapes = append(shapes, *s)
+	}
+	queryShapesMu.Unlock()
+	sort.Slice(shapes, func(i, j int) bool { return shapes[i].Count > shapes[j].Count })
+	if len(shapes) > top {
+		shapes = shapes[:top]
+	}
+
+	// existing indexes, by the fields they cover
+	indexed := map[string]bool{}
+	var indexNames []string
+	cur, err := collection.Indexes().List(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db index list error: "+err.Error())
+		return
+	}
+	for cur.Next(ctx) {
+		var idx struct {
+			Name string `bson:"name"`
+			Key  bson.D `bson:"key"`
+		}
+		if cur.Decode(&idx) != nil {
+			continue
+		}
+		indexNames = append(indexNames, idx.Name)
+		for _, k := range idx.Key {
+			indexed[k.Key] = true
+		}
+	}
+	cur.Close(ctx)
+
+	reports := []ShapeReport{}
+	for _, s := range shapes {
+		rep := ShapeReport{Shape: s.Shape, Count: s.Count, LastSeen: s.LastSeen.Format(time.RFC3339), Stages: []string{}, Indexes: []string{}, Suggestions: []string{}}
+		var sortKeys []string
+		for _, e := range s.Sort {
+			sortKeys = append(sortKeys, e.Key)
+		}
+		rep.Sort = strings.Join(sortKeys, ",")
+
+		find := bson.D{{Key: "find", Value: collection.Name()}, {Key: "filter", Value: s.Sample}}
+		if len(s.Sort) > 0 {
+			find = append(find, bson.E{Key: "sort", Value: s.Sort})
+		}
+		var res bson.M
+		err := db.RunCommand(ctx, bson.D{{Key: "explain", Value: find}, {Key: "verbosity", Value: "queryPlanner"}}).Decode(&res)
+		if err != nil {
+			rep.Error = err.Error()
+			reports = append(reports, rep)
+			continue
+		}
+		if qp, ok := asMap(res["queryPlanner"]); ok {
+			planStages(qp["winningPlan"], &rep.Stages, &rep.Indexes)
+		}
+		for _, st := range rep.Stages {
+			if st == "COLLSCAN" {
+				rep.CollScan = true
+			}
+		}
+
+		fields := map[string]bool{}
+		filterFields(s.Sample, fields)
+		var missing []string
+		for f := range fields {
+			if !indexed[f] && f != "_id" {
+				missing = append(missing, f)
+			}
+		}
+		sort.Strings(missing)
+		if rep.CollScan {
+			rep.Suggestions = append(rep.Suggestions, "COLLSCAN: this query reads the whole collection")
+		}
+		for _, f := range missing {
+			if strings.HasPrefix(f, "properties.") {
+				rep.Suggestions = append(rep.Suggestions, "no index on "+f+"; add "+strings.TrimPrefix(f, "properties.")+" to SORTABLE_PROPERTIES or create an index on it")
+			} else {
+				rep.Suggestions = append(rep.Suggestions, "no index on "+f)
+			}
+		}
+		for _, k := range sortKeys {
+			if !indexed[k] && k != "_id" {
+				rep.Suggestions = append(rep.Suggestions, "sort on "+k+" has no index and sorts in memory")
+			}
+		}
+		if rep.CollScan && len(fields) > 1 && len(missing) == 0 {
+			rep.Suggestions = append(rep.Suggestions, "fields are indexed separately; a compound index on "+strings.Join(sortedKeys(fields), ", ")+" may help")
+		}
+		reports = append(reports, rep)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"indexes": indexNames, "shapes": reports})
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
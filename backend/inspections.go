@@ -0,0 +1,803 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Inspection forms are the questionnaires surveyors fill in on site. Admins
+// define one or more per layer; a submission answers a form for a feature
+// of that layer and records who inspected it and when. Changing a form's
+// fields bumps its version, and each submission keeps the version it was
+// made against, so older answers stay readable in the export.
+
+// form field types; choice and multi_choice take their values from options
+var formFieldTypes = map[string]bool{"text": true, "number": true, "integer": true, "boolean": true, "date": true, "choice": true, "multi_choice": true}
+
+const (
+	maxFormFields           = 200
+	defaultSubmissionsLimit = 100
+	maxSubmissionsLimit     = 1000
+)
+
+// FormField is one question of an inspection form
+type FormField struct {
+	Name     string `bson:"name" json:"name"`
+	Label    string `bson:"label,omitempty" json:"label,omitempty"`
+	Help     string `bson:"help,omitempty" json:"help,omitempty"`
+	Type     string `bson:"type" json:"type"`
+	Required bool   `bson:"required,omitempty" json:"required,omitempty"`
+	// Min and Max bound numbers, MinLength and MaxLength text
+	Min       *float64 `bson:"min,omitempty" json:"min,omitempty"`
+	Max       *float64 `bson:"max,omitempty" json:"max,omitempty"`
+	MinLength int      `bson:"min_length,omitempty" json:"min_length,omitempty"`
+	MaxLength int      `bson:"max_length,omitempty" json:"max_length,omitempty"`
+	// Pattern is a regular expression text answers must match
+	Pattern string   `bson:"pattern,omitempty" json:"pattern,omitempty"`
+	Options []string `bson:"options,omitempty" json:"options,omitempty"`
+}
+
+// InspectionForm is a layer's questionnaire
+type InspectionForm struct {
+	ID          string      `bson:"_id" json:"id"`
+	Layer       string      `bson:"layer" json:"layer"`
+	Name        string      `bson:"name" json:"name"`
+	Description string      `bson:"description,omitempty" json:"description,omitempty"`
+	Fields      []FormField `bson:"fields" json:"fields"`
+	Version     int         `bson:"version" json:"version"`
+	// Archived forms keep their submissions but take no new ones
+	Archived  bool      `bson:"archived,omitempty" json:"archived,omitempty"`
+	CreatedBy string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// InspectionSubmission is one filled-in form
+type InspectionSubmission struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Form        string             `bson:"form" json:"form"`
+	FormVersion int                `bson:"form_version" json:"form_version"`
+	Layer       string             `bson:"layer" json:"layer"`
+	Feature     primitive.ObjectID `bson:"feature" json:"feature"`
+	Inspector   string             `bson:"inspector,omitempty" json:"inspector,omitempty"`
+	Answers     bson.M             `bson:"answers" json:"answers"`
+	InspectedAt time.Time          `bson:"inspected_at" json:"inspected_at"`
+	SubmittedAt time.Time          `bson:"submitted_at" json:"submitted_at"`
+}
+
+var (
+	inspectionForms       *mongo.Collection
+	inspectionSubmissions *mongo.Collection
+)
+
+func setupInspections() {
+	inspectionForms = db.Collection(getenv("MONGO_INSPECTION_FORMS_COLLECTION", "inspection_forms"))
+	inspectionSubmissions = db.Collection(getenv("MONGO_INSPECTION_SUBMISSIONS_COLLECTION", "inspection_submissions"))
+	if _, err := inspectionForms.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}}}); err != nil {
+		log.Printf("inspection forms index create warning: %v", err)
+	}
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "form", Value: 1}, {Key: "inspected_at", Value: -1}}},
+		{Keys: bson.D{{Key: "feature", Value: 1}, {Key: "inspected_at", Value: -1}}},
+	}
+	if _, err := inspectionSubmissions.Indexes().CreateMany(ctx, indexes); err != nil {
+		log.Printf("inspection submissions index create warning: %v", err)
+	}
+}
+
+func validateFormFields(fields []FormField) []FieldError {
+	var errs []FieldError
+	if len(fields) == 0 || len(fields) > maxFormFields {
+		return []FieldError{{Field: "fields", Message: fmt.Sprintf("between 1 and %d fields", maxFormFields)}}
+	}
+	seen := map[string]bool{}
+	for i := range fields {
+		f := &fields[i]
+		name := fmt.Sprintf("fields[%d]", i)
+		f.Name = strings.TrimSpace(f.Name)
+		if !toolIDPattern.MatchString(f.Name) {
+			errs = append(errs, FieldError{Field: name + ".name", Message: "lowercase letters, digits, _ and -, starting with a letter"})
+		} else if seen[f.Name] {
+			errs = append(errs, FieldError{Field: name + ".name", Message: "duplicate field " + f.Name})
+		}
+		seen[f.Name] = true
+		if !formFieldTypes[f.Type] {
+			errs = append(errs, FieldError{Field: name + ".type", Message: "must be one of text, number, integer, boolean, date, choice, multi_choice"})
+		}
+		if (f.Type == "choice" || f.Type == "multi_choice") != (len(f.Options) > 0) {
+			errs = append(errs, FieldError{Field: name + ".options", Message: "required for choice and multi_choice fields only"})
+		}
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			errs = append(errs, FieldError{Field: name + ".min", Message: "greater than max"})
+		}
+		if f.MinLength < 0 || f.MaxLength < 0 || f.MaxLength > 0 && f.MinLength > f.MaxLength {
+			errs = append(errs, FieldError{Field: name + ".min_length", Message: "invalid length bounds"})
+		}
+		if f.Pattern != "" {
+			if _, err := regexp.Compile(f.Pattern); err != nil {
+				errs = append(errs, FieldError{Field: name + ".pattern", Message: "invalid regular expression: " + err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+// checkAnswer validates and normalizes the answer to f; dates become
+// time.Time and integers int64
+func checkAnswer(f FormField, v interface{}) (interface{}, string) {
+	switch f.Type {
+	case "text":
+		s, ok := v.(string)
+		if !ok {
+			return nil, "must be text"
+		}
+		n := len([]rune(s))
+		if n < f.MinLength || f.MaxLength > 0 && n > f.MaxLength {
+			return nil, "length out of bounds"
+		}
+		if f.Pattern != "" && !regexp.MustCompile(f.Pattern).MatchString(s) {
+			return nil, "does not match the expected format"
+		}
+		return s, ""
+	case "number", "integer":
+		n, ok := v.(float64)
+		if !ok || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, "must be a number"
+		}
+		if f.Type == "integer" && n != math.Trunc(n) {
+			return nil, "must be a whole number"
+		}
+		if f.Min != nil && n < *f.Min || f.Max != nil && n > *f.Max {
+			return nil, "out of range"
+		}
+		if f.Type == "integer" {
+			return int64(n), ""
+		}
+		return n, ""
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return nil, "must be true or false"
+		}
+		return b, ""
+	case "date":
+		s, _ := v.(string)
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t, err = time.Parse("2006-01-02", s)
+		}
+		if err != nil {
+			return nil, "expected RFC 3339 or YYYY-MM-DD"
+		}
+		return t.UTC(), ""
+	case "choice":
+		s, _ := v.(string)
+		if !oneOf(s, f.Options) {
+			return nil, "must be one of " + strings.Join(f.Options, ", ")
+		}
+		return s, ""
+	case "multi_choice":
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil, "must be a list"
+		}
+		out := bson.A{}
+		for _, item := range list {
+			s, _ := item.(string)
+			if !oneOf(s, f.Options) {
+				return nil, "values must be among " + strings.Join(f.Options, ", ")
+			}
+			out = append(out, s)
+		}
+		return out, ""
+	}
+	return nil, "unknown field type"
+}
+
+// checkAnswers validates a submission against the form
+func checkAnswers(form InspectionForm, answers map[string]interface{}) (bson.M, []FieldError) {
+	var errs []FieldError
+	out := bson.M{}
+	known := map[string]bool{}
+	for _, f := range form.Fields {
+		known[f.Name] = true
+		v, ok := answers[f.Name]
+		// forms send blank inputs and empty selections as "" and []
+		if s, isString := v.(string); isString && strings.TrimSpace(s) == "" {
+			ok = false
+		}
+		if list, isList := v.([]interface{}); isList && len(list) == 0 {
+			ok = false
+		}
+		if !ok || v == nil {
+			if f.Required {
+				errs = append(errs, FieldError{Field: "answers." + f.Name, Message: "required"})
+			}
+			continue
+		}
+		norm, msg := checkAnswer(f, v)
+		if msg != "" {
+			errs = append(errs, FieldError{Field: "answers." + f.Name, Message: msg})
+			continue
+		}
+		out[f.Name] = norm
+	}
+	for k := range answers {
+		if !known[k] {
+			errs = append(errs, FieldError{Field: "answers." + k, Message: "not a field of this form"})
+		}
+	}
+	return out, errs
+}
+
+func loadInspectionForm(w http.ResponseWriter, r *http.Request) (InspectionForm, bool) {
+	var f InspectionForm
+	err := inspectionForms.FindOne(r.Context(), bson.M{"_id": mux.Vars(r)["id"]}).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "inspection form not found")
+		return f, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return f, false
+	}
+	return f, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// GET /inspection-forms?layer=&archived=true
+func listInspectionFormsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	q := bson.M{}
+	if l := r.URL.Query().Get("layer"); l != "" {
+		q["layer"] = l
+	}
+	if r.URL.Query().Get("archived") != "true" {
+		q["archived"] = bson.M{"$ne": true}
+	}
+	cur, err := inspectionForms.Find(r.Context(), q, options.Find().SetSort(bson.D{{Key: "layer", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []InspectionForm{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// GET /inspection-forms/{id}
+func getInspectionFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	f, ok := loadInspectionForm(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// POST /inspection-forms { id, layer, name, description, fields }
+func createInspectionFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var f InspectionForm
+	if !decodeJSON(w, r, &f) {
+		return
+	}
+	var errs []FieldError
+	if !layerIDPattern.MatchString(f.ID) {
+		errs = append(errs, FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, up to 64 characters"})
+	}
+	if f.Layer == "" {
+		errs = append(errs, FieldError{Field: "layer", Message: "required"})
+	} else if n, err := layers.CountDocuments(r.Context(), bson.M{"_id": f.Layer}); err == nil && n == 0 {
+		errs = append(errs, FieldError{Field: "layer", Message: "no such layer"})
+	}
+	if f.Name = strings.TrimSpace(f.Name); f.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "required"})
+	}
+	errs = append(errs, validateFormFields(f.Fields)...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid inspection form", errs...)
+		return
+	}
+	now := time.Now().UTC()
+	f.Version = 1
+	f.Archived = false
+	f.CreatedBy = userID(r)
+	f.CreatedAt, f.UpdatedAt = now, now
+	if _, err := inspectionForms.InsertOne(r.Context(), f); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "inspection form "+f.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Location", "/inspection-forms/"+f.ID)
+	writeJSON(w, http.StatusCreated, f)
+}
+
+// PUT /inspection-forms/{id} { name, description, fields, archived }
+// The layer stays; new fields bump the version.
+func updateInspectionFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	f, ok := loadInspectionForm(w, r)
+	if !ok {
+		return
+	}
+	var body InspectionForm
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var errs []FieldError
+	if body.Name = strings.TrimSpace(body.Name); body.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "required"})
+	}
+	errs = append(errs, validateFormFields(body.Fields)...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid inspection form", errs...)
+		return
+	}
+	prev, _ := json.Marshal(f.Fields)
+	next, _ := json.Marshal(body.Fields)
+	version := f.Version
+	if string(prev) != string(next) {
+		f.Version++
+	}
+	f.Name, f.Description, f.Fields, f.Archived = body.Name, body.Description, body.Fields, body.Archived
+	f.UpdatedAt = time.Now().UTC()
+	// the version check keeps two concurrent edits from sharing a version
+	res, err := inspectionForms.ReplaceOne(r.Context(), bson.M{"_id": f.ID, "version": version}, f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusConflict, "conflict", "inspection form was changed concurrently, retry")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// DELETE /inspection-forms/{id} only removes forms without submissions;
+// archive the others
+func deleteInspectionFormHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	n, err := inspectionSubmissions.CountDocuments(r.Context(), bson.M{"form": id}, options.Count().SetLimit(1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	if n > 0 {
+		writeError(w, http.StatusConflict, "conflict", "the form has submissions; archive it instead")
+		return
+	}
+	res, err := inspectionForms.DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "inspection form not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /inspection-forms/{id}/submissions { feature, answers, inspected_at }
+func createSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	form, ok := loadInspectionForm(w, r)
+	if !ok {
+		return
+	}
+	if form.Archived {
+		writeError(w, http.StatusConflict, "conflict", "the form is archived")
+		return
+	}
+	var body struct {
+		Feature     string                 `json:"feature"`
+		Answers     map[string]interface{} `json:"answers"`
+		InspectedAt *time.Time             `json:"inspected_at"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	fid, err := primitive.ObjectIDFromHex(body.Feature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", FieldError{Field: "feature", Message: "must be a feature id"})
+		return
+	}
+	q := bson.M{"_id": fid, "layer": form.Layer}
+	applyVisibilityFilter(r, q)
+	n, err := collection.CountDocuments(r.Context(), q, options.Count().SetLimit(1))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	if n == 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", FieldError{Field: "feature", Message: "no such feature in layer " + form.Layer})
+		return
+	}
+	answers, errs := checkAnswers(form, body.Answers)
+	now := time.Now().UTC()
+	inspected := now
+	if body.InspectedAt != nil {
+		inspected = body.InspectedAt.UTC()
+		// surveyors may sync a day's work later, but not from the future
+		if inspected.After(now.Add(5 * time.Minute)) {
+			errs = append(errs, FieldError{Field: "inspected_at", Message: "in the future"})
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid submission", errs...)
+		return
+	}
+	s := InspectionSubmission{
+		ID:          primitive.NewObjectID(),
+		Form:        form.ID,
+		FormVersion: form.Version,
+		Layer:       form.Layer,
+		Feature:     fid,
+		Inspector:   userID(r),
+		Answers:     answers,
+		InspectedAt: inspected,
+		SubmittedAt: now,
+	}
+	if _, err := inspectionSubmissions.InsertOne(r.Context(), s); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Location", "/inspection-forms/"+form.ID+"/submissions/"+s.ID.Hex())
+	writeJSON(w, http.StatusCreated, s)
+}
+
+// submissionFilter reads ?feature=&inspector=&from=&to= into q
+func submissionFilter(w http.ResponseWriter, r *http.Request, q bson.M) bool {
+	query := r.URL.Query()
+	if f := query.Get("feature"); f != "" {
+		oid, err := primitive.ObjectIDFromHex(f)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid feature", FieldError{Field: "feature", Message: "must be a feature id"})
+			return false
+		}
+		q["feature"] = oid
+	}
+	if i := query.Get("inspector"); i == "me" {
+		q["inspector"] = userID(r)
+	} else if i != "" {
+		q["inspector"] = i
+	}
+	span := bson.M{}
+	for param, op := range map[string]string{"from": "$gte", "to": "$lt"} {
+		if s := query.Get(param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				t, err = time.Parse("2006-01-02", s)
+			}
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid "+param, FieldError{Field: param, Message: "expected RFC 3339 or YYYY-MM-DD"})
+				return false
+			}
+			span[op] = t.UTC()
+		}
+	}
+	if len(span) > 0 {
+		q["inspected_at"] = span
+	}
+	return true
+}
+
+// submissionAccess narrows q to the submissions of layer the caller may
+// read: editors of the layer read every inspector's answers, others their
+// own. It writes 404 when the layer is not published to the caller.
+func submissionAccess(w http.ResponseWriter, r *http.Request, layer string, q bson.M) bool {
+	hidden, err := hiddenLayers(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db distinct error: "+err.Error())
+		return false
+	}
+	if oneOf(layer, hidden) {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return false
+	}
+	if roleRanks[layerRole(r, layer)] < roleRanks["editor"] {
+		q["inspector"] = userID(r)
+	}
+	return true
+}
+
+// findSubmissions reads the submissions matching q on features the caller
+// may see, latest first; limit 0 is all of them
+func findSubmissions(r *http.Request, q bson.M, offset, limit int64) (*mongo.Cursor, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: q}},
+		{{Key: "$sort", Value: bson.D{{Key: "inspected_at", Value: -1}}}},
+	}
+	pipeline = append(pipeline, visibleFeatureStages(r, "feature")...)
+	if offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: offset}})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	return inspectionSubmissions.Aggregate(r.Context(), pipeline)
+}
+
+// GET /inspection-forms/{id}/submissions?feature=&inspector=|me&from=&to=
+// &format=json|csv&limit=&offset=; the CSV has a column per form field,
+// then any answers to fields since removed. Callers below editor on the
+// layer get their own submissions, see submissionAccess.
+func listSubmissionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	form, ok := loadInspectionForm(w, r)
+	if !ok {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid format", FieldError{Field: "format", Message: "must be json or csv"})
+		return
+	}
+	q := bson.M{"form": form.ID}
+	if !submissionFilter(w, r, q) || !submissionAccess(w, r, form.Layer, q) {
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if format == "csv" {
+		// exports are the whole history unless asked otherwise
+		writeSubmissionsCSV(w, r, form, q, offset, limit)
+		return
+	}
+	if limit == 0 {
+		limit = defaultSubmissionsLimit
+	}
+	cur, err := findSubmissions(r, q, offset, min(limit, maxSubmissionsLimit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []InspectionSubmission{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeSubmissionsCSV(w http.ResponseWriter, r *http.Request, form InspectionForm, q bson.M, offset, limit int64) {
+	var removed []string
+	known := map[string]bool{}
+	for _, f := range form.Fields {
+		known[f.Name] = true
+	}
+	if form.Version > 1 {
+		var err error
+		if removed, err = submissionAnswerKeys(r, q, known); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+	}
+	cur, err := findSubmissions(r, q, offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="inspections-`+form.ID+`.csv"`)
+	// UTF-8 BOM so Excel doesn't mangle non-ASCII answers
+	w.Write([]byte("\xEF\xBB\xBF"))
+	cw := csv.NewWriter(w)
+	header := []string{"id", "feature", "inspector", "inspected_at", "submitted_at", "form_version"}
+	for _, f := range form.Fields {
+		header = append(header, f.Name)
+	}
+	cw.Write(append(header, removed...))
+	for cur.Next(r.Context()) {
+		var s InspectionSubmission
+		if err := cur.Decode(&s); err != nil {
+			continue
+		}
+		row := []string{s.ID.Hex(), s.Feature.Hex(), s.Inspector, csvValue(s.InspectedAt), csvValue(s.SubmittedAt), fmt.Sprint(s.FormVersion)}
+		for _, f := range form.Fields {
+			row = append(row, answerCSV(s.Answers[f.Name]))
+		}
+		for _, k := range removed {
+			row = append(row, answerCSV(s.Answers[k]))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+}
+
+// submissionAnswerKeys lists the answered fields that are not in known
+func submissionAnswerKeys(r *http.Request, q bson.M, known map[string]bool) ([]string, error) {
+	pipeline := append(mongo.Pipeline{{{Key: "$match", Value: q}}}, visibleFeatureStages(r, "feature")...)
+	cur, err := inspectionSubmissions.Aggregate(r.Context(), append(pipeline,
+		bson.D{{Key: "$project", Value: bson.M{"keys": bson.M{"$objectToArray": "$answers"}}}},
+		bson.D{{Key: "$unwind", Value: "$keys"}},
+		bson.D{{Key: "$group", Value: bson.M{"_id": "$keys.k"}}},
+	))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID string `bson:"_id"`
+	}
+	if err := cur.All(r.Context(), &rows); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, row := range rows {
+		if !known[row.ID] {
+			out = append(out, row.ID)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// answerCSV writes multiple choices separated by semicolons
+func answerCSV(v interface{}) string {
+	switch t := v.(type) {
+	case primitive.DateTime:
+		return csvValue(t.Time())
+	case bson.A:
+		parts := make([]string, len(t))
+		for i, p := range t {
+			parts[i] = csvValue(p)
+		}
+		return strings.Join(parts, ";")
+	}
+	return csvValue(v)
+}
+
+// GET /inspection-forms/{id}/submissions/{sid}
+func getSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	sid, err := primitive.ObjectIDFromHex(mux.Vars(r)["sid"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	form, ok := loadInspectionForm(w, r)
+	if !ok {
+		return
+	}
+	q := bson.M{"_id": sid, "form": form.ID}
+	if !submissionAccess(w, r, form.Layer, q) {
+		return
+	}
+	cur, err := findSubmissions(r, q, 0, 1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	var found []InspectionSubmission
+	if err := cur.All(r.Context(), &found); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if len(found) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "submission not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, found[0])
+}
+
+// DELETE /inspection-forms/{id}/submissions/{sid} is for editors of the
+// layer, to drop a mistaken submission
+func deleteSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	form, ok := loadInspectionForm(w, r)
+	if !ok || !requireLayerRole(w, r, form.Layer, "editor") {
+		return
+	}
+	sid, err := primitive.ObjectIDFromHex(mux.Vars(r)["sid"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	res, err := inspectionSubmissions.DeleteOne(r.Context(), bson.M{"_id": sid, "form": form.ID})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "submission not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /features/{id}/inspections lists a feature's submissions across
+// forms, latest first
+func featureInspectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	fid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	fq := bson.M{"_id": fid}
+	applyVisibilityFilter(r, fq)
+	var doc FeatureDoc
+	err = collection.FindOne(r.Context(), fq, options.FindOne().SetProjection(bson.M{"layer": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	q := bson.M{"feature": fid}
+	if f := r.URL.Query().Get("form"); f != "" {
+		q["form"] = f
+	}
+	if !submissionAccess(w, r, doc.Layer, q) {
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultSubmissionsLimit
+	}
+	cur, err := findSubmissions(r, q, offset, min(limit, maxSubmissionsLimit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []InspectionSubmission{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Invitations let admins onboard colleagues without setting passwords for
+// them: an invitation names an email and the role (and optionally the org
+// and teams) the account will get, and carries a one-time token. Whoever
+// holds the token picks a username and password to accept it, which
+// creates the local account. Like reset tokens only the token's hash is
+// stored. With SMTP configured the token is emailed as a link built from
+// INVITE_ACCEPT_URL; it is also returned to the admin to pass on.
+type Invitation struct {
+	ID        string    `bson:"_id" json:"id"`
+	Email     string    `bson:"email" json:"email"`
+	Name      string    `bson:"name,omitempty" json:"name,omitempty"`
+	Role      string    `bson:"role" json:"role"`
+	Org       string    `bson:"org,omitempty" json:"org,omitempty"`
+	OrgRole   string    `bson:"org_role,omitempty" json:"org_role,omitempty"`
+	Teams     []string  `bson:"teams,omitempty" json:"teams,omitempty"`
+	State     string    `bson:"state" json:"state"`
+	TokenHash string    `bson:"token_hash" json:"-"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+	InvitedBy string    `bson:"invited_by,omitempty" json:"invited_by,omitempty"`
+	Emailed   bool      `bson:"emailed,omitempty" json:"emailed,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	// AcceptedBy is the account the invitation created
+	AcceptedBy string     `bson:"accepted_by,omitempty" json:"accepted_by,omitempty"`
+	AcceptedAt *time.Time `bson:"accepted_at,omitempty" json:"accepted_at,omitempty"`
+}
+
+// invitation states; pending ones past expires_at are reported as expired
+const (
+	invitePending  = "pending"
+	inviteAccepted = "accepted"
+	inviteRevoked  = "revoked"
+	inviteExpired  = "expired"
+)
+
+const maxInviteTTL = 30 * 24 * time.Hour
+
+var (
+	invitations     *mongo.Collection
+	inviteTTL       = 7 * 24 * time.Hour
+	inviteAcceptURL string
+)
+
+func setupInvitations() {
+	invitations = db.Collection(getenv("MONGO_INVITATIONS_COLLECTION", "invitations"))
+	if d, err := time.ParseDuration(getenv("INVITE_TTL", "")); err == nil && d > 0 && d <= maxInviteTTL {
+		inviteTTL = d
+	}
+	inviteAcceptURL = getenv("INVITE_ACCEPT_URL", "")
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "token_hash", Value: 1}}},
+		// one open invitation per email
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"state": invitePending})},
+	}
+	if _, err := invitations.Indexes().CreateMany(ctx, indexes); err != nil {
+		log.Printf("invitations index create warning: %v", err)
+	}
+}
+
+func newInviteToken() (token, hash string) {
+	b := make([]byte, 24)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+	return token, inviteTokenHash(token)
+}
+
+func inviteTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// current reports pending invitations past their expiry as expired
+func (inv *Invitation) current(now time.Time) *Invitation {
+	if inv.State == invitePending && !now.Before(inv.ExpiresAt) {
+		inv.State = inviteExpired
+	}
+	return inv
+}
+
+// expireInvitations moves pending invitations past their expiry to
+// expired, so they no longer hold their email's slot
+func expireInvitations(filter bson.M) error {
+	now := time.Now().UTC()
+	filter["state"] = invitePending
+	filter["expires_at"] = bson.M{"$lte": now}
+	_, err := invitations.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"state": inviteExpired, "updated_at": now}})
+	return err
+}
+
+// sendInvitation emails the token through the smtp notifier, reporting
+// whether it went out
+func sendInvitation(inv *Invitation, token string) bool {
+	n, ok := notifiers["smtp"].(smtpNotifier)
+	if !ok {
+		return false
+	}
+	n.to = []string{inv.Email}
+	link := token
+	if inviteAcceptURL != "" {
+		sep := "?"
+		if strings.Contains(inviteAcceptURL, "?") {
+			sep = "&"
+		}
+		link = inviteAcceptURL + sep + "token=" + url.QueryEscape(token)
+	}
+	msg := "You have been invited to the GIS as " + inv.Role + ".\n\n" +
+		"Accept the invitation and choose your username and password:\n" + link + "\n\n" +
+		"The invitation expires " + inv.ExpiresAt.Format(time.RFC1123) + "."
+	if err := n.Notify(Event{Type: "invitation", Subject: "Invitation to the GIS", Message: msg, Time: time.Now().UTC()}); err != nil {
+		log.Printf("invitation email to %s failed: %v", inv.Email, err)
+		return false
+	}
+	return true
+}
+
+func writeInvitation(w http.ResponseWriter, status int, inv *Invitation, token string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		*Invitation
+		Token string `json:"token"`
+	}{inv, token})
+}
+
+// POST /invitations { email, name, role, org, org_role, teams, expires_in }
+// expires_in is a duration such as 72h, at most 30 days
+func createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	if !localAccounts {
+		writeError(w, http.StatusNotFound, "not_found", "local accounts are not enabled")
+		return
+	}
+	var body struct {
+		Email     string   `json:"email"`
+		Name      string   `json:"name"`
+		Role      string   `json:"role"`
+		Org       string   `json:"org"`
+		OrgRole   string   `json:"org_role"`
+		Teams     []string `json:"teams"`
+		ExpiresIn string   `json:"expires_in"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(body.Email))
+	var errs []FieldError
+	if !strings.Contains(email, "@") {
+		errs = append(errs, FieldError{Field: "email", Message: "not an email address"})
+	}
+	if _, ok := roleRanks[body.Role]; !ok {
+		errs = append(errs, FieldError{Field: "role", Message: "must be viewer, editor or admin"})
+	}
+	ttl := inviteTTL
+	if body.ExpiresIn != "" {
+		d, err := time.ParseDuration(body.ExpiresIn)
+		if err != nil || d <= 0 || d > maxInviteTTL {
+			errs = append(errs, FieldError{Field: "expires_in", Message: "must be a duration up to 720h"})
+		}
+		ttl = d
+	}
+	if body.Org == "" && (body.OrgRole != "" || len(body.Teams) > 0) {
+		errs = append(errs, FieldError{Field: "org", Message: "required with org_role or teams"})
+	}
+	if body.Org != "" {
+		if body.OrgRole == "" {
+			body.OrgRole = orgMember
+		}
+		if body.OrgRole != orgMember && body.OrgRole != orgAdmin {
+			errs = append(errs, FieldError{Field: "org_role", Message: "must be member or admin"})
+		}
+		var o OrgDoc
+		err := orgs.FindOne(ctx, bson.M{"_id": body.Org}).Decode(&o)
+		if err == mongo.ErrNoDocuments {
+			errs = append(errs, FieldError{Field: "org", Message: "no such organization"})
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		for _, t := range body.Teams {
+			if err == nil && o.team(t) == nil {
+				errs = append(errs, FieldError{Field: "teams", Message: "no team " + t + " in " + body.Org})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid invitation", errs...)
+		return
+	}
+	n, err := users.CountDocuments(ctx, bson.M{"email": email})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	if n > 0 {
+		writeError(w, http.StatusConflict, "conflict", "an account with this email already exists", FieldError{Field: "email", Message: "already in use"})
+		return
+	}
+	if err := expireInvitations(bson.M{"email": email}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+
+	token, hash := newInviteToken()
+	now := time.Now().UTC()
+	inv := Invitation{
+		ID: primitive.NewObjectID().Hex(), Email: email, Name: strings.TrimSpace(body.Name), Role: body.Role,
+		Org: body.Org, OrgRole: body.OrgRole, Teams: body.Teams,
+		State: invitePending, TokenHash: hash, ExpiresAt: now.Add(ttl),
+		InvitedBy: userID(r), CreatedAt: now, UpdatedAt: now,
+	}
+	if _, err := invitations.InsertOne(ctx, inv); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "this email already has an open invitation", FieldError{Field: "email", Message: "already invited"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	if inv.Emailed = sendInvitation(&inv, token); inv.Emailed {
+		invitations.UpdateByID(ctx, inv.ID, bson.M{"$set": bson.M{"emailed": true}})
+	}
+	writeInvitation(w, http.StatusCreated, &inv, token)
+}
+
+// GET /invitations?state=&email=
+func listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	now := time.Now().UTC()
+	filter := bson.M{}
+	switch state := r.URL.Query().Get("state"); state {
+	case "":
+	case invitePending:
+		filter["state"] = invitePending
+		filter["expires_at"] = bson.M{"$gt": now}
+	case inviteExpired:
+		filter["$or"] = bson.A{bson.M{"state": inviteExpired}, bson.M{"state": invitePending, "expires_at": bson.M{"$lte": now}}}
+	case inviteAccepted, inviteRevoked:
+		filter["state"] = state
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid state", FieldError{Field: "state", Message: "must be pending, accepted, revoked or expired"})
+		return
+	}
+	if e := r.URL.Query().Get("email"); e != "" {
+		filter["email"] = strings.ToLower(strings.TrimSpace(e))
+	}
+	cur, err := invitations.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []Invitation{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	for i := range out {
+		out[i].current(now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// DELETE /invitations/{id} revokes a pending invitation
+func revokeInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	now := time.Now().UTC()
+	var inv Invitation
+	err := invitations.FindOneAndUpdate(ctx, bson.M{"_id": mux.Vars(r)["id"], "state": invitePending},
+		bson.M{"$set": bson.M{"state": inviteRevoked, "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&inv)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "no pending invitation "+mux.Vars(r)["id"])
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+// POST /invitations/{id}/resend issues a new token and expiry for a pending
+// or expired invitation, voiding the previous token
+func resendInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	token, hash := newInviteToken()
+	now := time.Now().UTC()
+	var inv Invitation
+	err := invitations.FindOneAndUpdate(ctx, bson.M{"_id": id, "state": bson.M{"$in": bson.A{invitePending, inviteExpired}}},
+		bson.M{"$set": bson.M{"state": invitePending, "token_hash": hash, "expires_at": now.Add(inviteTTL), "updated_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&inv)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "no pending or expired invitation "+id)
+		return
+	} else if mongo.IsDuplicateKeyError(err) {
+		writeError(w, http.StatusConflict, "conflict", "this email already has an open invitation")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	inv.Emailed = sendInvitation(&inv, token)
+	invitations.UpdateByID(ctx, id, bson.M{"$set": bson.M{"emailed": inv.Emailed}})
+	writeInvitation(w, http.StatusOK, &inv, token)
+}
+
+// openInvitation finds the pending, unexpired invitation for token
+func openInvitation(w http.ResponseWriter, token string) (*Invitation, bool) {
+	var inv Invitation
+	err := invitations.FindOne(ctx, bson.M{"token_hash": inviteTokenHash(token), "state": invitePending, "expires_at": bson.M{"$gt": time.Now().UTC()}}).Decode(&inv)
+	if token == "" || err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusBadRequest, "invalid_token", "invalid or expired invitation")
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	return &inv, true
+}
+
+// GET /auth/invitations/{token} shows what accepting the invitation gives,
+// for the onboarding page
+func getInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	inv, ok := openInvitation(w, mux.Vars(r)["token"])
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"email": inv.Email, "name": inv.Name, "role": inv.Role, "org": inv.Org, "expires_at": inv.ExpiresAt,
+	})
+}
+
+// POST /auth/invitations/accept { token, username, name, password, cookie }
+// Creates the account with the invited email and role, adds it to the
+// invited org and teams and logs it in. The response is the login one.
+func acceptInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string  `json:"token"`
+		Username string  `json:"username"`
+		Name     *string `json:"name"`
+		Password string  `json:"password"`
+		Cookie   bool    `json:"cookie"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if !localAccounts {
+		writeError(w, http.StatusNotFound, "not_found", "local accounts are not enabled")
+		return
+	}
+	inv, ok := openInvitation(w, body.Token)
+	if !ok {
+		return
+	}
+	id := strings.ToLower(body.Username)
+	var errs []FieldError
+	if !usernamePattern.MatchString(id) || id == "me" {
+		errs = append(errs, FieldError{Field: "username", Message: "lowercase letters, digits, ., _ and -, at most 64 characters"})
+	}
+	if foreignUserID(id) {
+		writeError(w, http.StatusConflict, "conflict", "username already in use", FieldError{Field: "username", Message: "already used by another auth provider"})
+		return
+	}
+	if fe := validatePassword(body.Password); fe != nil {
+		errs = append(errs, *fe)
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid account", errs...)
+		return
+	}
+	hash, ok := hashPassword(w, body.Password)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	u := LocalUser{ID: id, Name: inv.Name, Email: inv.Email, Role: inv.Role, PasswordHash: hash, PasswordChangedAt: now, CreatedAt: now, UpdatedAt: now}
+	if body.Name != nil {
+		u.Name = strings.TrimSpace(*body.Name)
+	}
+	if _, err := users.InsertOne(ctx, u); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	// the account exists now; claim the invitation, and undo the account
+	// if it was revoked or accepted meanwhile
+	res, err := invitations.UpdateOne(ctx, bson.M{"_id": inv.ID, "state": invitePending, "token_hash": inv.TokenHash},
+		bson.M{"$set": bson.M{"state": inviteAccepted, "accepted_by": id, "accepted_at": now, "updated_at": now}})
+	if err != nil || res.MatchedCount == 0 {
+		users.DeleteOne(ctx, bson.M{"_id": id})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+			return
+		}
+		writeError(w, http.StatusBadRequest, "invalid_token", "invalid or expired invitation")
+		return
+	}
+	if inv.Org != "" {
+		joinInvitedOrg(inv, id)
+	}
+	ip := clientIP(r)
+	auditAuth(AuthEvent{Event: "invitation_accepted", Username: id, IP: ip, Provider: "local"})
+
+	user := &User{ID: id, Role: u.Role, Provider: "local"}
+	token, exp, err := issueSession(user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "session error: "+err.Error())
+		return
+	}
+	out := map[string]interface{}{"expires_at": exp.UTC(), "user": user}
+	if body.Cookie {
+		out["csrf_token"] = setSessionCookies(w, r, token, exp)
+	} else {
+		out["token"] = token
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(out)
+}
+
+// joinInvitedOrg adds a new account to the org and teams of its
+// invitation. The account is already usable, so failures are only logged.
+func joinInvitedOrg(inv *Invitation, uid string) {
+	_, err := orgs.UpdateOne(ctx, bson.M{"_id": inv.Org, "members.user_id": bson.M{"$ne": uid}},
+		bson.M{"$push": bson.M{"members": OrgMember{UserID: uid, Role: inv.OrgRole}}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		log.Printf("invitation %s: joining org %s failed: %v", inv.ID, inv.Org, err)
+		return
+	}
+	if len(inv.Teams) == 0 {
+		return
+	}
+	_, err = orgs.UpdateOne(ctx, bson.M{"_id": inv.Org}, bson.M{"$addToSet": bson.M{"teams.$[t].members": uid}},
+		options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"t.id": bson.M{"$in": inv.Teams}}}}))
+	if err != nil {
+		log.Printf("invitation %s: joining teams of %s failed: %v", inv.ID, inv.Org, err)
+	}
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scheduled jobs. Admins register jobs (a kind from jobKinds, a cron
+// schedule and params) under /admin/jobs; they are stored in the jobs
+// collection so every replica sees the same list. One replica at a time
+// holds the scheduler lease in jobs_lock and starts due jobs, checking
+// every JOBS_POLL_INTERVAL (15s); if it stops renewing, another takes over
+// after three intervals. Each run is recorded in job_runs, kept for
+// JOBS_HISTORY_TTL (30d). Schedules are read in JOBS_TIMEZONE (UTC).
+// JOBS=false stops this replica from scheduling; manual runs still work.
+type JobDoc struct {
+	Name       string     `bson:"_id" json:"name"`
+	Kind       string     `bson:"kind" json:"kind"`
+	Schedule   string     `bson:"schedule" json:"schedule"`
+	Params     bson.M     `bson:"params,omitempty" json:"params,omitempty"`
+	Enabled    bool       `bson:"enabled" json:"enabled"`
+	NextRun    *time.Time `bson:"next_run,omitempty" json:"next_run,omitempty"`
+	LastRun    *time.Time `bson:"last_run,omitempty" json:"last_run,omitempty"`
+	LastStatus string     `bson:"last_status,omitempty" json:"last_status,omitempty"`
+	UpdatedBy  string     `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt  time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// JobRun is one run of a job
+type JobRun struct {
+	ID         primitive.ObjectID `bson:"_id" json:"id"`
+	Job        string             `bson:"job" json:"job"`
+	Kind       string             `bson:"kind" json:"kind"`
+	Trigger    string             `bson:"trigger" json:"trigger"`
+	Instance   string             `bson:"instance" json:"instance"`
+	StartedAt  time.Time          `bson:"started_at" json:"started_at"`
+	FinishedAt *time.Time         `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+	DurationMs int64              `bson:"duration_ms" json:"duration_ms"`
+	Status     string             `bson:"status" json:"status"`
+	Message    string             `bson:"message,omitempty" json:"message,omitempty"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+const (
+	jobRunning = "running"
+	jobOK      = "ok"
+	jobFailed  = "error"
+	jobSkipped = "skipped"
+)
+
+// jobKind is something a job can do. validate checks params when the job
+// is saved; run does the work and returns a one line summary.
+type jobKind struct {
+	validate func(params bson.M) []FieldError
+	run      func(c context.Context, j JobDoc) (string, error)
+}
+
+var jobKinds = map[string]jobKind{
+	"snapshot_stats": {run: func(c context.Context, j JobDoc) (string, error) {
+		n, err := takeSnapshots(time.Now().UTC())
+		return fmt.Sprintf("%d layer snapshots", n), err
+	}},
+	"layer_stats": {run: func(c context.Context, j JobDoc) (string, error) {
+		return "layer stats refreshed", refreshLayerStats("")
+	}},
+	"cache_seed":       {validate: validateCacheSeed, run: runCacheSeed},
+	"purge":            {validate: validatePurge, run: runPurge},
+	"sync":             {validate: validateSync, run: runSync},
+	"overpass":         {validate: validateOverpassJob, run: runOverpassJob},
+	"outliers":         {validate: validateOutliers, run: runOutliers},
+	"situation_report": {validate: validateSituationJob, run: runSituationJob},
+	"reseal_fields":    {run: runResealJob},
+}
+
+var (
+	jobs        *mongo.Collection
+	jobRuns     *mongo.Collection
+	jobsLock    *mongo.Collection
+	jobLocation = time.UTC
+	jobPoll     = 15 * time.Second
+	jobInstance string
+	jobsClient  = &http.Client{Timeout: 5 * time.Minute}
+
+	jobsMu      sync.Mutex
+	jobsRunning = map[string]bool{}
+	jobLeader   bool
+)
+
+func setupJobs() {
+	jobs = db.Collection(getenv("MONGO_JOBS_COLLECTION", "jobs"))
+	jobRuns = db.Collection(getenv("MONGO_JOB_RUNS_COLLECTION", "job_runs"))
+	jobsLock = db.Collection(getenv("MONGO_JOBS_LOCK_COLLECTION", "jobs_lock"))
+	if tz := getenv("JOBS_TIMEZONE", ""); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("JOBS_TIMEZONE: %v", err)
+		}
+		jobLocation = loc
+	}
+	if d, err := time.ParseDuration(getenv("JOBS_POLL_INTERVAL", "")); err == nil && d > 0 {
+		jobPoll = d
+	}
+	ttl := 30 * 24 * time.Hour
+	if d, err := time.ParseDuration(getenv("JOBS_HISTORY_TTL", "")); err == nil && d > 0 {
+		ttl = d
+	}
+	if _, err := jobRuns.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "started_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds()))},
+		{Keys: bson.D{{Key: "job", Value: 1}, {Key: "started_at", Value: -1}}},
+	}); err != nil {
+		log.Printf("job runs index create warning: %v", err)
+	}
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	jobInstance = host + "-" + hex.EncodeToString(b)
+	// gisctl runs exit too soon to be trusted with the lease
+	if _, ctl := ctlArgs(); ctl || getenv("JOBS", "true") == "false" {
+		return
+	}
+	go func() {
+		for {
+			scheduleJobs()
+			time.Sleep(jobPoll)
+		}
+	}()
+}
+
+// holdJobLease takes or renews the scheduler lease, reporting whether this
+// instance has it
+func holdJobLease(now time.Time) bool {
+	_, err := jobsLock.UpdateOne(ctx,
+		bson.M{"_id": "scheduler", "$or": bson.A{bson.M{"holder": jobInstance}, bson.M{"expires": bson.M{"$lt": now}}}},
+		bson.M{"$set": bson.M{"holder": jobInstance, "expires": now.Add(3 * jobPoll)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// someone else holds it
+		return false
+	} else if err != nil {
+		log.Printf("job lease warning: %v", err)
+		return false
+	}
+	return true
+}
+
+func scheduleJobs() {
+	now := time.Now().UTC()
+	leader := holdJobLease(now)
+	jobsMu.Lock()
+	if leader != jobLeader {
+		log.Printf("job scheduler lease: leader=%v (%s)", leader, jobInstance)
+	}
+	jobLeader = leader
+	jobsMu.Unlock()
+	if !leader {
+		return
+	}
+
+	cur, err := jobs.Find(ctx, bson.M{"enabled": true, "next_run": bson.M{"$lte": now}})
+	if err != nil {
+		log.Printf("job schedule warning: %v", err)
+		return
+	}
+	var due []JobDoc
+	if err := cur.All(ctx, &due); err != nil {
+		log.Printf("job schedule warning: %v", err)
+		return
+	}
+	for _, j := range due {
+		sched, err := parseCron(j.Schedule)
+		if err != nil {
+			continue
+		}
+		next := sched.next(now.In(jobLocation)).UTC()
+		// claiming by the old next_run keeps a lease handover from starting
+		// the run twice
+		res, err := jobs.UpdateOne(ctx, bson.M{"_id": j.Name, "next_run": j.NextRun}, bson.M{"$set": bson.M{"next_run": next}})
+		if err != nil || res.ModifiedCount == 0 {
+			continue
+		}
+		j.NextRun = &next
+		go runJob(j, "schedule")
+	}
+}
+
+// runJob runs j and records the run. A job still running from before on
+// this instance is recorded as skipped; after a lease handover the new
+// leader can't tell, so jobs should be safe to overlap.
+func runJob(j JobDoc, trigger string) JobRun {
+	run := JobRun{ID: primitive.NewObjectID(), Job: j.Name, Kind: j.Kind, Trigger: trigger, Instance: jobInstance, StartedAt: time.Now().UTC()}
+	jobsMu.Lock()
+	busy := jobsRunning[j.Name]
+	if !busy {
+		jobsRunning[j.Name] = true
+	}
+	jobsMu.Unlock()
+	if busy {
+		run.Status, run.Message = jobSkipped, "previous run still in progress"
+		finished := run.StartedAt
+		run.FinishedAt = &finished
+		if _, err := jobRuns.InsertOne(ctx, run); err != nil {
+			log.Printf("job run record warning: %v", err)
+		}
+		return run
+	}
+	defer func() {
+		jobsMu.Lock()
+		delete(jobsRunning, j.Name)
+		jobsMu.Unlock()
+	}()
+
+	run.Status = jobRunning
+	if _, err := jobRuns.InsertOne(ctx, run); err != nil {
+		log.Printf("job run record warning: %v", err)
+	}
+	kind, ok := jobKinds[j.Kind]
+	var msg string
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown job kind %q", j.Kind)
+	} else {
+		msg, err = runJobKind(kind, j)
+	}
+	finished := time.Now().UTC()
+	run.FinishedAt, run.DurationMs, run.Message = &finished, finished.Sub(run.StartedAt).Milliseconds(), msg
+	run.Status = jobOK
+	if err != nil {
+		run.Status, run.Error = jobFailed, err.Error()
+		log.Printf("job %s failed: %v", j.Name, err)
+		// a failed retry goes back on the letter being retried
+		if !strings.HasPrefix(trigger, "retry:") {
+			defer deadLetterJobRun(j, run)
+		}
+	}
+	if _, err := jobRuns.ReplaceOne(ctx, bson.M{"_id": run.ID}, run); err != nil {
+		log.Printf("job run record warning: %v", err)
+	}
+	if _, err := jobs.UpdateOne(ctx, bson.M{"_id": j.Name}, bson.M{"$set": bson.M{"last_run": run.StartedAt, "last_status": run.Status}}); err != nil {
+		log.Printf("job update warning: %v", err)
+	}
+	return run
+}
+
+// runJobKind keeps a panicking job from taking the scheduler down
+func runJobKind(kind jobKind, j JobDoc) (msg string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return kind.run(ctx, j)
+}
+
+// jobRequest is a request made by job j, for calling handlers
+func jobRequest(j JobDoc, method, target string, body io.Reader, vars map[string]string) *http.Request {
+	r, _ := http.NewRequest(method, target, body)
+	u := &User{ID: "job:" + j.Name, Role: "admin", Provider: "jobs"}
+	r = r.WithContext(context.WithValue(r.Context(), userCtxKey, u))
+	if vars != nil {
+		r = mux.SetURLVars(r, vars)
+	}
+	return r
+}
+
+func paramInt(params bson.M, key string, def int) int {
+	switch v := params[key].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return def
+}
+
+// paramMap is a nested object param, whether it came from JSON or Mongo
+func paramMap(params bson.M, key string) map[string]interface{} {
+	switch v := params[key].(type) {
+	case map[string]interface{}:
+		return v
+	case bson.M:
+		return v
+	case bson.D:
+		m := map[string]interface{}{}
+		for _, e := range v {
+			m[e.Key] = e.Value
+		}
+		return m
+	}
+	return nil
+}
+
+func paramString(params bson.M, key string) string {
+	s, _ := params[key].(string)
+	return s
+}
+
+// cache_seed {days: 7, limit: 20}: requests the busiest bbox buckets of
+// GET /stats/usage so the bbox cache holds them. Only this instance's
+// cache is filled, for anonymous callers (the cache is per caller), and it
+// only helps when the schedule is shorter than BBOX_CACHE_TTL.
+func validateCacheSeed(params bson.M) []FieldError {
+	var errs []FieldError
+	if d := paramInt(params, "days", 7); d < 1 || d > 366 {
+		errs = append(errs, FieldError{Field: "params.days", Message: "must be between 1 and 366"})
+	}
+	if n := paramInt(params, "limit", 20); n < 1 || n > 500 {
+		errs = append(errs, FieldError{Field: "params.limit", Message: "must be between 1 and 500"})
+	}
+	return errs
+}
+
+func runCacheSeed(c context.Context, j JobDoc) (string, error) {
+	days, limit := paramInt(j.Params, "days", 7), paramInt(j.Params, "limit", 20)
+	since := time.Now().UTC().AddDate(0, 0, 1-days).Format("2006-01-02")
+	rows, err := topAccess(c, accessBBox, since, accessMinCount, limit)
+	if err != nil {
+		return "", err
+	}
+	list := bboxCached(coalesced(listFeaturesHandler))
+	warmed := 0
+	for _, row := range rows {
+		if len(row.BBox) != 4 {
+			continue
+		}
+		b := bucketProbe(BBox{row.BBox[0], row.BBox[1], row.BBox[2], row.BBox[3]}, row.Key)
+		q := url.Values{"bbox": {fmt.Sprintf("%.10g,%.10g,%.10g,%.10g", b.MinLon, b.MinLat, b.MaxLon, b.MaxLat)}}
+		r, _ := http.NewRequest("GET", "/features?"+q.Encode(), nil)
+		if err := callHandler(list, r.WithContext(c), io.Discard); err != nil {
+			return fmt.Sprintf("%d of %d buckets", warmed, len(rows)), err
+		}
+		warmed++
+	}
+	return fmt.Sprintf("%d buckets", warmed), nil
+}
+
+// purge {target, older_than_days: 30} deletes what has expired
+var purgeTargets = map[string]func(cutoff time.Time) (int64, error){
+	// rejected submissions nobody will approve any more, with their relations
+	// and open work orders
+	"rejected_features": func(cutoff time.Time) (int64, error) {
+		q := bson.M{"status": statusRejected, "updated_at": bson.M{"$lt": cutoff}}
+		oids, err := featureIDs(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		if len(oids) == 0 {
+			return 0, nil
+		}
+		if err := deleteFeatureDependents(oids); err != nil {
+			return 0, err
+		}
+		res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": oids}})
+		if err != nil {
+			return 0, err
+		}
+		writeGeneration.Add(1)
+		return res.DeletedCount, nil
+	},
+	"layer_snapshots": func(cutoff time.Time) (int64, error) {
+		res, err := layerSnapshots.DeleteMany(ctx, bson.M{"taken_at": bson.M{"$lt": cutoff}})
+		if err != nil {
+			return 0, err
+		}
+		return res.DeletedCount, nil
+	},
+}
+
+func validatePurge(params bson.M) []FieldError {
+	var errs []FieldError
+	if _, ok := purgeTargets[paramString(params, "target")]; !ok {
+		errs = append(errs, FieldError{Field: "params.target", Message: "must be rejected_features or layer_snapshots"})
+	}
+	if d := paramInt(params, "older_than_days", 30); d < 1 {
+		errs = append(errs, FieldError{Field: "params.older_than_days", Message: "must be at least 1"})
+	}
+	return errs
+}
+
+func runPurge(c context.Context, j JobDoc) (string, error) {
+	target := paramString(j.Params, "target")
+	purge, ok := purgeTargets[target]
+	if !ok {
+		return "", fmt.Errorf("unknown purge target %q", target)
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -paramInt(j.Params, "older_than_days", 30))
+	n, err := purge(cutoff)
+	return fmt.Sprintf("%d %s deleted", n, target), err
+}
+
+// sync {url, layer, id_property: "id", format: "geojson"}: fetches a
+// GeoJSON FeatureCollection, or with format csv a CSV table (see
+// csvsync.go), and upserts each feature into layer by external id, taken
+// from the id_property property or else the feature id. Features missing
+// from the source are left alone.
+const maxSyncBytes = 64 << 20
+
+func validateSync(params bson.M) []FieldError {
+	var errs []FieldError
+	if u, err := url.Parse(paramString(params, "url")); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, FieldError{Field: "params.url", Message: "must be an http(s) URL"})
+	}
+	if paramString(params, "layer") == "" {
+		errs = append(errs, FieldError{Field: "params.layer", Message: "required"})
+	}
+	switch syncFormat(params) {
+	case "geojson":
+	case "csv":
+		errs = append(errs, validateCSVColumns(params)...)
+	default:
+		errs = append(errs, FieldError{Field: "params.format", Message: "must be geojson or csv"})
+	}
+	return errs
+}
+
+// syncFormat is params.format, csv for Google Sheets links
+func syncFormat(params bson.M) string {
+	if f := paramString(params, "format"); f != "" {
+		return f
+	}
+	if _, ok := googleSheetCSVURL(paramString(params, "url")); ok {
+		return "csv"
+	}
+	return "geojson"
+}
+
+// syncRecord is one source feature as the body of an upsert by external
+// id, or why it couldn't be read
+type syncRecord struct {
+	key string
+	in  map[string]interface{}
+	err error
+}
+
+func runSync(c context.Context, j JobDoc) (string, error) {
+	format := syncFormat(j.Params)
+	src := paramString(j.Params, "url")
+	accept := "application/geo+json, application/json"
+	if format == "csv" {
+		if u, ok := googleSheetCSVURL(src); ok {
+			src = u
+		}
+		accept = "text/csv"
+	}
+	req, err := http.NewRequestWithContext(c, "GET", src, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", accept)
+	res, err := jobsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("source returned %s", res.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxSyncBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(body) > maxSyncBytes {
+		return "", fmt.Errorf("source is larger than %d MB", maxSyncBytes>>20)
+	}
+
+	layer := paramString(j.Params, "layer")
+	idProp := paramString(j.Params, "id_property")
+	if idProp == "" {
+		idProp = "id"
+	}
+	var records []syncRecord
+	if format == "csv" {
+		records, err = csvSyncRecords(body, j.Params, idProp)
+	} else {
+		records, err = geoJSONSyncRecords(body, idProp)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	created, updated, failed, firstErr := upsertSyncRecords(records, layer, func(key string, body io.Reader) *http.Request {
+		return jobRequest(j, "PUT", "/features/by-external-id/"+url.PathEscape(key), body, map[string]string{"key": key})
+	})
+	msg := fmt.Sprintf("%d created, %d updated, %d failed", created, updated, failed)
+	if failed > 0 {
+		return msg, firstErr
+	}
+	return msg, nil
+}
+
+// upsertSyncRecords upserts each record into layer by its key, with
+// request making the upsert request for a key and body
+func upsertSyncRecords(records []syncRecord, layer string, request func(key string, body io.Reader) *http.Request) (created, updated, failed int, firstErr error) {
+	upsert := http.HandlerFunc(upsertByExternalIDHandler)
+	for i, rec := range records {
+		if rec.err == nil && rec.key == "" {
+			rec.err = fmt.Errorf("no id")
+		}
+		if rec.err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("feature %d: %v", i, rec.err)
+			}
+			continue
+		}
+		rec.in["layer"] = layer
+		b, _ := json.Marshal(rec.in)
+		w := &ctlWriter{header: http.Header{}, out: io.Discard}
+		upsert(w, request(rec.key, bytes.NewReader(b)))
+		switch w.status {
+		case http.StatusCreated:
+			created++
+		case http.StatusOK:
+			updated++
+		default:
+			failed++
+			if firstErr == nil {
+				firstErr = fmt.Errorf("feature %s: %s", rec.key, bytes.TrimSpace(w.errBuf.Bytes()))
+			}
+		}
+	}
+	return
+}
+
+func geoJSONSyncRecords(body []byte, idProp string) ([]syncRecord, error) {
+	var fc struct {
+		Features []struct {
+			ID         interface{}            `json:"id"`
+			Geometry   json.RawMessage        `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.Unmarshal(body, &fc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %v", err)
+	}
+	records := make([]syncRecord, 0, len(fc.Features))
+	for _, f := range fc.Features {
+		rec := syncRecord{in: map[string]interface{}{"geojson": f.Geometry, "properties": f.Properties}}
+		if v, ok := f.Properties[idProp]; ok && v != nil {
+			rec.key = fmt.Sprint(v)
+		} else if f.ID != nil {
+			rec.key = fmt.Sprint(f.ID)
+		} else {
+			rec.err = fmt.Errorf("no %s property or id", idProp)
+		}
+		if name, ok := f.Properties["name"].(string); ok {
+			rec.in["name"] = name
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// JobInput is the body of PUT /admin/jobs/{name}
+type JobInput struct {
+	Kind     string `json:"kind"`
+	Schedule string `json:"schedule"`
+	Params   bson.M `json:"params"`
+	Enabled  *bool  `json:"enabled"`
+}
+
+// GET /admin/jobs
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	cur, err := jobs.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []JobDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	kinds := make([]string, 0, len(jobKinds))
+	for k := range jobKinds {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	var lease struct {
+		Holder  string    `bson:"holder" json:"holder"`
+		Expires time.Time `bson:"expires" json:"expires"`
+	}
+	if err := jobsLock.FindOne(ctx, bson.M{"_id": "scheduler"}).Decode(&lease); err != nil && err != mongo.ErrNoDocuments {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{
+		"jobs":     out,
+		"kinds":    kinds,
+		"leader":   lease,
+		"instance": jobInstance,
+		"timezone": jobLocation.String(),
+	})
+}
+
+var jobNamePattern = usernamePattern
+
+// PUT /admin/jobs/{name} {kind, schedule, params, enabled}
+func putJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if !jobNamePattern.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid job name", FieldError{Field: "name", Message: "lowercase letters, digits, ., _ and -, at most 64 characters"})
+		return
+	}
+	var in JobInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	var errs []FieldError
+	kind, ok := jobKinds[in.Kind]
+	if !ok {
+		errs = append(errs, FieldError{Field: "kind", Message: "unknown job kind"})
+	} else if kind.validate != nil {
+		errs = append(errs, kind.validate(in.Params)...)
+	}
+	sched, err := parseCron(in.Schedule)
+	if err != nil {
+		errs = append(errs, FieldError{Field: "schedule", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid job", errs...)
+		return
+	}
+
+	now := time.Now().UTC()
+	enabled := in.Enabled == nil || *in.Enabled
+	set := bson.M{"kind": in.Kind, "schedule": in.Schedule, "params": in.Params, "enabled": enabled, "updated_by": userID(r), "updated_at": now}
+	update := bson.M{"$set": set, "$setOnInsert": bson.M{"created_at": now}}
+	if enabled {
+		set["next_run"] = sched.next(now.In(jobLocation)).UTC()
+	} else {
+		update["$unset"] = bson.M{"next_run": ""}
+	}
+	var stored JobDoc
+	if err := jobs.FindOneAndUpdate(ctx, bson.M{"_id": name}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&stored); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db upsert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
+
+// DELETE /admin/jobs/{name}
+// The run history stays until it expires.
+func deleteJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	res, err := jobs.DeleteOne(ctx, bson.M{"_id": mux.Vars(r)["name"]})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "job not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /admin/jobs/{name}/run
+// Starts the job on this instance now, whatever its schedule, and returns
+// 202 with the run; poll /admin/jobs/{name}/runs for the outcome.
+func runJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var j JobDoc
+	if err := jobs.FindOne(ctx, bson.M{"_id": mux.Vars(r)["name"]}).Decode(&j); err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "job not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	jobsMu.Lock()
+	busy := jobsRunning[j.Name]
+	jobsMu.Unlock()
+	if busy {
+		writeError(w, http.StatusConflict, "conflict", "job is already running on this instance")
+		return
+	}
+	done := make(chan JobRun, 1)
+	trigger := "manual:" + userID(r)
+	go func() { done <- runJob(j, trigger) }()
+	// short jobs finish before we answer
+	var body interface{} = bson.M{"job": j.Name, "status": jobRunning}
+	select {
+	case run := <-done:
+		body = run
+	case <-time.After(2 * time.Second):
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(body)
+}
+
+// GET /admin/jobs/{name}/runs?limit=20
+func jobRunsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	limit := int64(20)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > 500 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and 500"})
+			return
+		}
+		limit = n
+	}
+	cur, err := jobRuns.Find(ctx, bson.M{"job": mux.Vars(r)["name"]},
+		options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []JobRun{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Just enough JWT for the auth providers: HS256 for the tokens this server
+// issues itself, RS256 and ES256 for identity providers.
+
+// clock skew tolerated on exp and nbf
+const jwtLeeway = 60 * time.Second
+
+var errJWTFormat = errors.New("not a JWT")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwtClaims are the decoded payload; fields are read through the helpers
+type jwtClaims map[string]interface{}
+
+func (c jwtClaims) str(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+func (c jwtClaims) time(key string) (time.Time, bool) {
+	switch v := c[key].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		f, err := v.Float64()
+		return time.Unix(int64(f), 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+// audience reports whether aud is or contains want
+func (c jwtClaims) audience(want string) bool {
+	switch v := c["aud"].(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// path reads a dotted claim path such as realm_access.roles
+func (c jwtClaims) path(p string) interface{} {
+	var v interface{} = map[string]interface{}(c)
+	for _, k := range strings.Split(p, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// parseJWT splits a compact JWT without verifying it
+func parseJWT(token string) (jwtHeader, jwtClaims, []byte, []byte, error) {
+	var h jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, nil, nil, nil, errJWTFormat
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &h) != nil {
+		return h, nil, nil, nil, errJWTFormat
+	}
+	pb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return h, nil, nil, nil, errJWTFormat
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(pb, &claims); err != nil {
+		return h, nil, nil, nil, errJWTFormat
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, nil, nil, nil, errJWTFormat
+	}
+	return h, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// verifyJWTSignature checks sig over signed with key, which must match alg:
+// []byte for HS256, *rsa.PublicKey for RS256, *ecdsa.PublicKey for ES256
+func verifyJWTSignature(alg string, key interface{}, signed, sig []byte) error {
+	sum := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case []byte:
+		if alg != "HS256" {
+			break
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			break
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported algorithm " + alg)
+}
+
+// checkJWTTimes validates exp (required) and nbf
+func checkJWTTimes(c jwtClaims, now time.Time) error {
+	exp, ok := c.time("exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := c.time("nbf"); ok && now.Add(jwtLeeway).Before(nbf) {
+		return errors.New("token not valid yet")
+	}
+	return nil
+}
+
+// signHS256 issues a compact JWT with claims
+func signHS256(secret []byte, claims jwtClaims) (string, error) {
+	hb, _ := json.Marshal(jwtHeader{Alg: "HS256", Typ: "JWT"})
+	pb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(pb)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// jwkKey is the public key of a JSON Web Key, nil for unsupported kinds
+func jwkKey(k map[string]interface{}) interface{} {
+	b64 := func(name string) *big.Int {
+		s, _ := k[name].(string)
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(b)
+	}
+	switch k["kty"] {
+	case "RSA":
+		n, e := b64("n"), b64("e")
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		x, y := b64("x"), b64("y")
+		if k["crv"] != "P-256" || x == nil || y == nil {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+	return nil
+}
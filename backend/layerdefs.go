@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// property types a layer schema may declare
+var layerFieldTypes = map[string]bool{"string": true, "number": true, "boolean": true, "date": true}
+
+var layerIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// LayerField declares one feature property of a layer
+type LayerField struct {
+	Name     string `bson:"name" json:"name"`
+	Type     string `bson:"type" json:"type"`
+	Required bool   `bson:"required,omitempty" json:"required,omitempty"`
+}
+
+// LayerDoc is the metadata for a layer; features point at it through their
+// layer field. Layers used by features without a LayerDoc still work, they
+// just have no schema or style.
+type LayerDoc struct {
+	ID          string       `bson:"_id" json:"id"`
+	Name        string       `bson:"name" json:"name"`
+	Description string       `bson:"description,omitempty" json:"description,omitempty"`
+	Fields      []LayerField `bson:"fields" json:"fields"`
+	Style       bson.M       `bson:"style,omitempty" json:"style,omitempty"`
+	Template    string       `bson:"template,omitempty" json:"template,omitempty"`
+	ClonedFrom  string       `bson:"cloned_from,omitempty" json:"cloned_from,omitempty"`
+	Extent      *LayerExtent `bson:"extent,omitempty" json:"extent,omitempty"`
+	// Kind is empty for ordinary layers or annotation, see annotations.go
+	Kind string `bson:"kind,omitempty" json:"kind,omitempty"`
+	// GeometryType holds the layer to one geometry type, see
+	// layergeomtype.go
+	GeometryType string `bson:"geometry_type,omitempty" json:"geometry_type,omitempty"`
+	// Multi is promote or split, see layermulti.go
+	Multi string `bson:"multi,omitempty" json:"multi,omitempty"`
+	// Extrusion holds height and min_height to fill-extrusion, see
+	// extrusion.go
+	Extrusion bool `bson:"extrusion,omitempty" json:"extrusion,omitempty"`
+	// Sensitive properties are encrypted, see sensitive.go
+	Sensitive *LayerSensitivity `bson:"sensitive,omitempty" json:"sensitive,omitempty"`
+	// License is the data's source and terms, see licenses.go
+	License *LayerLicense `bson:"license,omitempty" json:"license,omitempty"`
+	// Publication is set on layers under the publishing workflow, see
+	// publishing.go
+	Publication *LayerPublication `bson:"publication,omitempty" json:"publication,omitempty"`
+	// Shares grants teams roles on the layer's features, see orgs.go
+	Shares    []TeamGrant `bson:"shares,omitempty" json:"shares,omitempty"`
+	CreatedBy string      `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time   `bson:"updated_at" json:"updated_at"`
+}
+
+// LayerTemplate is a schema + style preset new layers can start from
+type LayerTemplate struct {
+	ID          string       `bson:"_id" json:"id"`
+	Name        string       `bson:"name" json:"name"`
+	Description string       `bson:"description,omitempty" json:"description,omitempty"`
+	Fields      []LayerField `bson:"fields" json:"fields"`
+	Style       bson.M       `bson:"style,omitempty" json:"style,omitempty"`
+	Builtin     bool         `bson:"builtin,omitempty" json:"builtin,omitempty"`
+}
+
+// templates shipped with the server, (re)installed at startup
+var builtinLayerTemplates = []LayerTemplate{
+	{
+		ID: "poi", Name: "Points of interest", Builtin: true,
+		Fields: []LayerField{{Name: "category", Type: "string", Required: true}, {Name: "address", Type: "string"}, {Name: "phone", Type: "string"}},
+		Style:  bson.M{"type": "circle", "color": "#e6550d", "radius": 6},
+	},
+	{
+		ID: "roads", Name: "Roads", Builtin: true,
+		Fields: []LayerField{{Name: "class", Type: "string", Required: true}, {Name: "surface", Type: "string"}, {Name: "lanes", Type: "number"}, {Name: "oneway", Type: "boolean"}},
+		Style:  bson.M{"type": "line", "color": "#636363", "width": 2},
+	},
+	{
+		ID: "land_parcels", Name: "Land parcels", Builtin: true,
+		Fields: []LayerField{{Name: "parcel_id", Type: "string", Required: true}, {Name: "owner", Type: "string"}, {Name: "area_m2", Type: "number"}, {Name: "registered_at", Type: "date"}},
+		Style:  bson.M{"type": "fill", "color": "#31a354", "opacity": 0.4, "outline": "#006d2c"},
+	},
+	{
+		ID: "addresses", Name: "Addresses", Builtin: true,
+		Description: "Address points for the internal geocoder; street_feature is the id of the street line",
+		Fields:      []LayerField{{Name: "house_number", Type: "string", Required: true}, {Name: "street", Type: "string", Required: true}, {Name: "street_feature", Type: "string"}, {Name: "city", Type: "string"}, {Name: "postcode", Type: "string"}},
+		Style:       bson.M{"type": "circle", "color": "#3182bd", "radius": 4},
+	},
+}
+
+var (
+	layers         *mongo.Collection
+	layerTemplates *mongo.Collection
+)
+
+func setupLayers() {
+	layers = db.Collection(getenv("MONGO_LAYERS_COLLECTION", "layers"))
+	layerTemplates = db.Collection(getenv("MONGO_LAYER_TEMPLATES_COLLECTION", "layer_templates"))
+	for _, t := range builtinLayerTemplates {
+		_, err := layerTemplates.ReplaceOne(ctx, bson.M{"_id": t.ID}, t, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Printf("layer template %s install warning: %v", t.ID, err)
+		}
+	}
+}
+
+func validateLayerFields(fields []LayerField) []FieldError {
+	var errs []FieldError
+	seen := map[string]bool{}
+	for i, f := range fields {
+		name := fmt.Sprintf("fields[%d]", i)
+		if f.Name == "" {
+			errs = append(errs, FieldError{Field: name + ".name", Message: "required"})
+		} else if seen[f.Name] {
+			errs = append(errs, FieldError{Field: name + ".name", Message: "duplicate field " + f.Name})
+		}
+		seen[f.Name] = true
+		if !layerFieldTypes[f.Type] {
+			errs = append(errs, FieldError{Field: name + ".type", Message: "must be one of string, number, boolean, date"})
+		}
+	}
+	return errs
+}
+
+// insertLayer writes a new LayerDoc, reporting a taken id as a conflict
+func insertLayer(w http.ResponseWriter, doc LayerDoc) bool {
+	if _, err := layers.InsertOne(ctx, doc); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "layer "+doc.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return false
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func listLayersHandler(w http.ResponseWriter, r *http.Request) {
+	cur, err := layers.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LayerDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func getLayerHandler(w http.ResponseWriter, r *http.Request) {
+	var doc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// POST /layers { id, name, description, kind, geometry_type, multi, extrusion, fields, style, template, license }
+// With template the fields and style default to the template's. kind
+// annotation makes a layer of map labels, see annotations.go; geometry_type
+// holds the layer to one geometry type, see layergeomtype.go, and multi
+// normalizes geometries to or from Multi types, see layermulti.go.
+func createLayerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var body LayerDoc
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if !layerIDPattern.MatchString(body.ID) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid layer id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+	if body.Template != "" {
+		var t LayerTemplate
+		err := layerTemplates.FindOne(ctx, bson.M{"_id": body.Template}).Decode(&t)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusBadRequest, "validation_failed", "unknown template", FieldError{Field: "template", Message: "no template " + body.Template})
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		if body.Fields == nil {
+			body.Fields = t.Fields
+		}
+		if body.Style == nil {
+			body.Style = t.Style
+		}
+		if body.Name == "" {
+			body.Name = t.Name
+		}
+	}
+	if body.Name == "" {
+		body.Name = body.ID
+	}
+	if body.Fields == nil {
+		body.Fields = []LayerField{}
+	}
+	if errs := validateLayerFields(body.Fields); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid layer fields", errs...)
+		return
+	}
+	switch body.Kind {
+	case "":
+	case layerKindAnnotation:
+		if body.Style == nil {
+			body.Style = bson.M{}
+			for k, v := range defaultAnnotationStyle {
+				body.Style[k] = v
+			}
+		}
+		if errs := validateAnnotationStyle(body.Style); len(errs) > 0 {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid annotation style", errs...)
+			return
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid layer kind", FieldError{Field: "kind", Message: "must be empty or annotation"})
+		return
+	}
+	if errs := validateLayerGeometryType(body.GeometryType, body.Kind); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid geometry type", errs...)
+		return
+	}
+	if errs := validateLayerMulti(body.Multi, body.GeometryType, body.Kind); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid multi policy", errs...)
+		return
+	}
+	if body.License != nil {
+		if errs := validateLicense(body.License); len(errs) > 0 {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid license", errs...)
+			return
+		}
+	}
+	if body.Sensitive != nil {
+		if errs := validateSensitivity(body.Sensitive); len(errs) > 0 {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid sensitivity", errs...)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	body.ClonedFrom = ""
+	// extents are set through PUT /layers/{id}/extent
+	body.Extent = nil
+	body.CreatedBy = userID(r)
+	body.CreatedAt, body.UpdatedAt = now, now
+	if !insertLayer(w, body) {
+		return
+	}
+	// a write may have cached the layer as missing
+	forgetLayerExtent(body.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(body)
+}
+
+// POST /layers/{id}/clone { id, name, features }
+// Copies the layer's schema and style to a new layer, and its features too
+// when features is true. Copied features get new ids, the caller as creator
+// and keep their moderation status.
+func cloneLayerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	src := mux.Vars(r)["id"]
+	var body struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Features bool   `json:"features"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if !layerIDPattern.MatchString(body.ID) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid layer id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+
+	var srcDoc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": src}).Decode(&srcDoc)
+	if err == mongo.ErrNoDocuments {
+		// a layer that only exists through its features clones with an
+		// empty schema
+		n, err := collection.CountDocuments(ctx, bson.M{"layer": src}, options.Count().SetLimit(1))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+			return
+		}
+		if n == 0 {
+			writeError(w, http.StatusNotFound, "not_found", "layer not found")
+			return
+		}
+		srcDoc = LayerDoc{Name: src, Fields: []LayerField{}}
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	clone := srcDoc
+	clone.ID = body.ID
+	clone.Name = body.Name
+	if clone.Name == "" {
+		clone.Name = srcDoc.Name + " (copy)"
+	}
+	clone.ClonedFrom = src
+	clone.CreatedBy = userID(r)
+	clone.CreatedAt, clone.UpdatedAt = now, now
+	if !insertLayer(w, clone) {
+		return
+	}
+	forgetLayerExtent(clone.ID)
+
+	var copied int
+	if body.Features {
+		copied, err = cloneLayerFeatures(r, src, body.ID, now)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(bson.M{"layer": clone, "features_copied": copied})
+}
+
+func cloneLayerFeatures(r *http.Request, src, dst string, now time.Time) (int, error) {
+	cur, err := collection.Find(ctx, bson.M{"layer": src})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	uid := userID(r)
+	copied := 0
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := collection.InsertMany(ctx, batch)
+		if res != nil {
+			copied += len(res.InsertedIDs)
+		}
+		batch = batch[:0]
+		return err
+	}
+	for cur.Next(ctx) {
+		var doc bson.M
+		if err := cur.Decode(&doc); err != nil {
+			log.Println("decode warn:", err)
+			continue
+		}
+		doc["_id"] = primitive.NewObjectID()
+		doc["layer"] = dst
+		doc["created_at"], doc["updated_at"] = now, now
+		delete(doc, "moderation")
+		if uid != "" {
+			doc["created_by"], doc["updated_by"] = uid, uid
+		}
+		batch = append(batch, doc)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, flush()
+}
+
+func listLayerTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	cur, err := layerTemplates.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LayerTemplate{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /layer-templates { id, name, description, fields, style }
+// Admins add templates; ?from_layer=<id> snapshots an existing layer instead
+func createLayerTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var t LayerTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if !layerIDPattern.MatchString(t.ID) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid template id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+	if from := r.URL.Query().Get("from_layer"); from != "" {
+		var l LayerDoc
+		if err := layers.FindOne(ctx, bson.M{"_id": from}).Decode(&l); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "unknown layer "+from, FieldError{Field: "from_layer", Message: "must be an existing layer"})
+			return
+		}
+		t.Fields, t.Style = l.Fields, l.Style
+		if t.Name == "" {
+			t.Name = l.Name
+		}
+	}
+	if t.Name == "" {
+		t.Name = t.ID
+	}
+	if t.Fields == nil {
+		t.Fields = []LayerField{}
+	}
+	if errs := validateLayerFields(t.Fields); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid template fields", errs...)
+		return
+	}
+	t.Builtin = false
+	if _, err := layerTemplates.InsertOne(ctx, t); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "template "+t.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
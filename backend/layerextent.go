@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LayerExtent restricts where a layer's features may be. Features outside
+// the polygon are refused (mode reject) or stored with a warning (mode warn).
+type LayerExtent struct {
+	Geometry bson.M `bson:"geometry" json:"geometry"`
+	Mode     string `bson:"mode" json:"mode"`
+	// Boundary is the code of the boundary the geometry was copied from
+	Boundary string `bson:"boundary,omitempty" json:"boundary,omitempty"`
+}
+
+// cached extents so writes don't look up the layer every time
+const layerExtentTTL = 30 * time.Second
+
+type cachedExtent struct {
+	extent  *LayerExtent
+	polys   [][][]Position
+	expires time.Time
+	// kind, geometryType, multi and extrusion ride along so annotation,
+	// geometry type and height checks share the lookup
+	kind         string
+	geometryType string
+	multi        string
+	extrusion    bool
+}
+
+var (
+	layerExtentMu    sync.Mutex
+	layerExtentCache = map[string]cachedExtent{}
+)
+
+func forgetLayerExtent(layer string) {
+	layerExtentMu.Lock()
+	delete(layerExtentCache, layer)
+	layerExtentMu.Unlock()
+}
+
+func loadLayerExtent(layer string) (cachedExtent, error) {
+	layerExtentMu.Lock()
+	c, ok := layerExtentCache[layer]
+	layerExtentMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c, nil
+	}
+	var doc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": layer}, options.FindOne().SetProjection(bson.M{"extent": 1, "kind": 1, "geometry_type": 1, "multi": 1, "extrusion": 1})).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return c, err
+	}
+	c = cachedExtent{extent: doc.Extent, kind: doc.Kind, geometryType: doc.GeometryType, multi: doc.Multi, extrusion: doc.Extrusion, expires: time.Now().Add(layerExtentTTL)}
+	if doc.Extent != nil {
+		g, err := parseGeometry(doc.Extent.Geometry)
+		if err != nil {
+			return c, fmt.Errorf("layer %s extent: %v", layer, err)
+		}
+		c.polys = polygonsOf(g)
+	}
+	layerExtentMu.Lock()
+	layerExtentCache[layer] = c
+	layerExtentMu.Unlock()
+	return c, nil
+}
+
+// positionInPolygon tests p against an outer ring and its holes in lon/lat
+func positionInPolygon(p Position, rings [][]Position) bool {
+	in := func(ring []Position) bool {
+		inside := false
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+				inside = !inside
+			}
+		}
+		return inside
+	}
+	if len(rings) == 0 || !in(rings[0]) {
+		return false
+	}
+	for _, hole := range rings[1:] {
+		if in(hole) {
+			return false
+		}
+	}
+	return true
+}
+
+// extentError is a feature refused by its layer's extent, as opposed to a
+// failure loading the extent
+type extentError string
+
+func (e extentError) Error() string { return string(e) }
+
+// writeExtentError reports err from featureExtentCheck
+func writeExtentError(w http.ResponseWriter, err error) {
+	if e, ok := err.(extentError); ok {
+		writeError(w, http.StatusBadRequest, "validation_failed", "feature outside layer extent", FieldError{Field: "geojson", Message: e.Error()})
+		return
+	}
+	if e, ok := err.(geometryTypeError); ok {
+		writeError(w, http.StatusBadRequest, "validation_failed", "geometry type not allowed in layer", FieldError{Field: "geojson", Message: e.Error()})
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "db_error", "layer extent error: "+err.Error())
+}
+
+// checkLayerExtent applies the layer's extent to g: an error in reject mode,
+// a warning appended to warnings in warn mode
+func checkLayerExtent(layer string, g Geometry, warnings *[]string) error {
+	if layer == "" {
+		return nil
+	}
+	c, err := loadLayerExtent(layer)
+	if err != nil {
+		return err
+	}
+	if c.extent == nil {
+		return nil
+	}
+	outside := 0
+	for _, p := range g.allPositions() {
+		inside := false
+		for _, poly := range c.polys {
+			if positionInPolygon(p, poly) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			outside++
+		}
+	}
+	if outside == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%d position(s) outside the extent of layer %s", outside, layer)
+	if c.extent.Mode == "reject" {
+		return extentError(msg)
+	}
+	if warnings != nil {
+		*warnings = append(*warnings, msg)
+	}
+	return nil
+}
+
+// featureExtentCheck runs layerGeometries and checkLayerExtent for a create
+// or update. On update the stored layer or geometry fills in whichever the
+// request leaves out. A geometry the layer normalizes is left in in.parsed,
+// the parts of a split one in in.parts when in.splits allows it.
+func featureExtentCheck(in *FeatureInput, existing *FeatureDoc) error {
+	layer := deref(in.Layer)
+	g := in.parsed
+	if existing != nil {
+		if in.Layer == nil {
+			layer = existing.Layer
+		}
+		if g == nil {
+			if in.Layer == nil {
+				// neither changed
+				return nil
+			}
+			stored, err := parseGeometry(existing.Geometry)
+			if err != nil {
+				return nil
+			}
+			g = &stored
+		}
+	}
+	if g == nil {
+		return nil
+	}
+	gs, err := layerGeometries(layer, *g)
+	if err != nil {
+		return err
+	}
+	if len(gs) > 1 {
+		if !in.splits {
+			return splitRefused(layer, *g, len(gs))
+		}
+		in.parts = gs
+	}
+	if gs[0].Type != g.Type {
+		in.parsed = &gs[0]
+	}
+	return checkLayerExtent(layer, *g, &in.warnings)
+}
+
+// PUT /layers/{id}/extent { geometry | boundary, mode }
+// Sets the allowed extent from a Polygon/MultiPolygon or a boundary code.
+func putLayerExtentHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	var body struct {
+		Geometry interface{} `json:"geometry"`
+		Boundary string      `json:"boundary"`
+		Mode     string      `json:"mode"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Mode == "" {
+		body.Mode = "reject"
+	}
+	if body.Mode != "reject" && body.Mode != "warn" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid mode", FieldError{Field: "mode", Message: "must be reject or warn"})
+		return
+	}
+	raw := body.Geometry
+	if body.Boundary != "" {
+		var b BoundaryDoc
+		err := boundaries.FindOne(ctx, bson.M{"code": body.Boundary}).Decode(&b)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusBadRequest, "validation_failed", "unknown boundary", FieldError{Field: "boundary", Message: "no boundary " + body.Boundary})
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		raw = b.Geometry
+	}
+	if raw == nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "geometry or boundary required", FieldError{Field: "geometry", Message: "required unless boundary is given"})
+		return
+	}
+	g, err := parseGeometry(raw)
+	if err == nil {
+		err = g.Validate()
+	}
+	if err == nil && polygonsOf(g) == nil {
+		err = fmt.Errorf("extent must be a Polygon or MultiPolygon")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid extent", FieldError{Field: "geometry", Message: err.Error()})
+		return
+	}
+
+	extent := LayerExtent{Geometry: g.BSON(), Mode: body.Mode, Boundary: body.Boundary}
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"extent": extent, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetLayerExtent(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(extent)
+}
+
+// DELETE /layers/{id}/extent lifts the constraint
+func deleteLayerExtentHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"extent": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetLayerExtent(id)
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A layer may be held to one geometry type, so map styles written for its
+// points, lines or polygons don't meet anything else. Every write into the
+// layer is checked, through featureExtentCheck and the imports, after the
+// layer's multi policy has normalized it, see layermulti.go.
+
+// layerGeometryTypes are the types a layer can be held to
+var layerGeometryTypes = []string{"Point", "LineString", "Polygon", "MultiPoint", "MultiLineString", "MultiPolygon"}
+
+// geometryTypeError is a feature refused by its layer's geometry type, as
+// opposed to a failure loading the layer
+type geometryTypeError string
+
+func (e geometryTypeError) Error() string { return string(e) }
+
+func validateLayerGeometryType(t, kind string) []FieldError {
+	switch {
+	case t == "":
+	case !oneOf(t, layerGeometryTypes):
+		return []FieldError{{Field: "geometry_type", Message: "must be one of " + strings.Join(layerGeometryTypes, ", ")}}
+	case kind == layerKindAnnotation && t != "Point":
+		return []FieldError{{Field: "geometry_type", Message: "annotation layers hold Points"}}
+	}
+	return nil
+}
+
+// checkLayerGeometryType refuses g when the layer is held to another type
+func checkLayerGeometryType(layer string, g Geometry) error {
+	if layer == "" {
+		return nil
+	}
+	c, err := loadLayerExtent(layer)
+	if err != nil {
+		return err
+	}
+	if c.geometryType == "" || g.Type == c.geometryType {
+		return nil
+	}
+	return geometryTypeError(fmt.Sprintf("layer %s takes %s geometries, got %s", layer, c.geometryType, g.Type))
+}
+
+// PUT /layers/{id}/geometry-type { geometry_type }
+// Holds the layer to one geometry type. Refused with 409 while the layer
+// has features of other types, counted by type so they can be fixed first.
+func putLayerGeometryTypeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	var body struct {
+		GeometryType string `json:"geometry_type"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var l LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"kind": 1, "multi": 1})).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if body.GeometryType == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "geometry_type required", FieldError{Field: "geometry_type", Message: "required"})
+		return
+	}
+	if errs := validateLayerGeometryType(body.GeometryType, l.Kind); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid geometry type", errs...)
+		return
+	}
+	if errs := validateLayerMulti(l.Multi, body.GeometryType, l.Kind); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "geometry type doesn't fit the layer's multi policy", errs...)
+		return
+	}
+
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"layer": id, "geometry.type": bson.M{"$ne": body.GeometryType}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$geometry.type", "n": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	var others []struct {
+		Type string `bson:"_id"`
+		N    int    `bson:"n"`
+	}
+	if err := cur.All(ctx, &others); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	if len(others) > 0 {
+		var errs []FieldError
+		for _, o := range others {
+			errs = append(errs, FieldError{Field: "geometry_type", Message: fmt.Sprintf("%d %s feature(s) in the layer", o.N, o.Type)})
+		}
+		writeError(w, http.StatusConflict, "conflict", "layer has features of other geometry types", errs...)
+		return
+	}
+
+	if _, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"geometry_type": body.GeometryType, "updated_at": time.Now().UTC()}}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	forgetLayerExtent(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"geometry_type": body.GeometryType})
+}
+
+// DELETE /layers/{id}/geometry-type lets the layer take any geometry again
+func deleteLayerGeometryTypeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"geometry_type": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetLayerExtent(id)
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A layer's multi policy normalizes geometries as they are written, for
+// downstream tools that can't take simple and Multi types mixed: promote
+// stores a Point as a MultiPoint, a LineString as a MultiLineString and a
+// Polygon as a MultiPolygon; split stores each part of a Multi geometry as
+// a feature of its own, with the same fields. Geometry collections are
+// kept as they are. Features already stored keep their geometry until
+// they are written again.
+
+const (
+	multiPromote = "promote"
+	multiSplit   = "split"
+)
+
+var layerMultiPolicies = []string{multiPromote, multiSplit}
+
+// validateLayerMulti checks a multi policy against the layer's geometry
+// type, which it must be able to produce, and its kind
+func validateLayerMulti(policy, geometryType, kind string) []FieldError {
+	if policy == "" {
+		return nil
+	}
+	if !oneOf(policy, layerMultiPolicies) {
+		return []FieldError{{Field: "multi", Message: "must be one of " + strings.Join(layerMultiPolicies, ", ")}}
+	}
+	multi := strings.HasPrefix(geometryType, "Multi")
+	if geometryType != "" && policy == multiPromote && !multi {
+		return []FieldError{{Field: "multi", Message: "promote stores Multi geometries, the layer takes " + geometryType}}
+	}
+	if policy == multiPromote && kind == layerKindAnnotation {
+		return []FieldError{{Field: "multi", Message: "annotation layers hold Points"}}
+	}
+	if policy == multiSplit && multi {
+		return []FieldError{{Field: "multi", Message: "split stores single geometries, the layer takes " + geometryType}}
+	}
+	return nil
+}
+
+// promoteGeometry wraps a Point, LineString or Polygon in its Multi type
+func promoteGeometry(g Geometry) Geometry {
+	switch g.Type {
+	case "Point":
+		return Geometry{Type: "MultiPoint", Points: []Position{g.Point}}
+	case "LineString":
+		return Geometry{Type: "MultiLineString", Rings: [][]Position{g.Points}}
+	case "Polygon":
+		return Geometry{Type: "MultiPolygon", Polygons: [][][]Position{g.Rings}}
+	}
+	return g
+}
+
+// splitGeometry returns the parts of a Multi geometry, or g itself
+func splitGeometry(g Geometry) []Geometry {
+	var parts []Geometry
+	switch g.Type {
+	case "MultiPoint":
+		for _, p := range g.Points {
+			parts = append(parts, Geometry{Type: "Point", Point: p})
+		}
+	case "MultiLineString":
+		for _, l := range g.Rings {
+			parts = append(parts, Geometry{Type: "LineString", Points: l})
+		}
+	case "MultiPolygon":
+		for _, p := range g.Polygons {
+			parts = append(parts, Geometry{Type: "Polygon", Rings: p})
+		}
+	}
+	if len(parts) == 0 {
+		return []Geometry{g}
+	}
+	return parts
+}
+
+// layerGeometries is what g is stored as in the layer: normalized by its
+// multi policy, one geometry per feature to store, then held to its
+// geometry type
+func layerGeometries(layer string, g Geometry) ([]Geometry, error) {
+	gs := []Geometry{g}
+	if layer != "" {
+		c, err := loadLayerExtent(layer)
+		if err != nil {
+			return nil, err
+		}
+		switch c.multi {
+		case multiPromote:
+			gs[0] = promoteGeometry(g)
+		case multiSplit:
+			gs = splitGeometry(g)
+		}
+	}
+	if err := checkLayerGeometryType(layer, gs[0]); err != nil {
+		return nil, err
+	}
+	return gs, nil
+}
+
+// splitRefused is the error for a write that would be split but can only
+// store one feature
+func splitRefused(layer string, g Geometry, parts int) error {
+	return geometryTypeError(fmt.Sprintf("layer %s stores each part as a feature of its own, send the %d parts of this %s separately", layer, parts, g.Type))
+}
+
+// insertFeatureParts stores doc once per part of the split geometry and
+// writes the first part as the created feature, listing them all. It
+// returns the first id, or "" after writing an error response.
+func insertFeatureParts(w http.ResponseWriter, r *http.Request, doc bson.M, in FeatureInput) string {
+	docs := make([]interface{}, len(in.parts))
+	for i, g := range in.parts {
+		part := bson.M{}
+		for k, v := range doc {
+			part[k] = v
+		}
+		part["geometry"] = g.BSON()
+		docs[i] = part
+	}
+	res, err := collection.InsertMany(ctx, docs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return ""
+	}
+	ids := make([]string, len(res.InsertedIDs))
+	for i, id := range res.InsertedIDs {
+		ids[i] = id.(primitive.ObjectID).Hex()
+	}
+	first := docs[0].(bson.M)
+	first["_id"] = res.InsertedIDs[0]
+	var stored FeatureDoc
+	if raw, err := bson.Marshal(first); err == nil {
+		bson.Unmarshal(raw, &stored)
+	}
+	warnings := append(in.warnings, fmt.Sprintf("split into %d %s features by layer %s", len(ids), in.parts[0].Type, deref(in.Layer)))
+	out := storedFeature(r, stored, warnings...)
+	out.Parts = ids
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+	return ids[0]
+}
+
+// PUT /layers/{id}/multi { multi: promote|split }
+// Sets how the layer normalizes geometries on write, see above.
+func putLayerMultiHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	var body struct {
+		Multi string `json:"multi"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Multi == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "multi required", FieldError{Field: "multi", Message: "required"})
+		return
+	}
+	var l LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"geometry_type": 1, "kind": 1})).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if errs := validateLayerMulti(body.Multi, l.GeometryType, l.Kind); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid multi policy", errs...)
+		return
+	}
+	if _, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"multi": body.Multi, "updated_at": time.Now().UTC()}}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	forgetLayerExtent(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"multi": body.Multi})
+}
+
+// DELETE /layers/{id}/multi stores geometries as they are sent again
+func deleteLayerMultiHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$unset": bson.M{"multi": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetLayerExtent(id)
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
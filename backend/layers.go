@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// how long a bulk delete confirmation token stays valid
+const confirmTokenTTL = 10 * time.Minute
+
+// key used to sign confirmation tokens; CONFIRM_SECRET keeps tokens valid
+// across restarts and replicas, otherwise a random key is generated
+var confirmKeys keyRing
+
+func setupConfirmSecret() {
+	watchSecret("CONFIRM_SECRET", func(v string) {
+		if v != "" {
+			confirmKeys.set([]byte(v))
+		}
+	})
+	if s := getsecret("CONFIRM_SECRET", ""); s != "" {
+		confirmKeys.set([]byte(s))
+		return
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	confirmKeys.set(key)
+}
+
+// layerFeatureFilter builds the filter for DELETE /layers/{id}/features from
+// ?bbox= and ?prop.<key>=<value> equality conditions. Values are compared as
+// the layer schema types the property; undeclared properties match the text
+// or the number or boolean it spells. It also returns a canonical string of
+// the filter that confirmation tokens are bound to.
+func layerFeatureFilter(r *http.Request, layer string) (bson.M, string, []FieldError, error) {
+	q := bson.M{"layer": layer}
+	query := r.URL.Query()
+	var canon []string
+	var errs []FieldError
+	if bbox := query.Get("bbox"); bbox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(bbox)
+		if !ok {
+			return nil, "", []FieldError{{Field: "bbox", Message: "expected minLon,minLat,maxLon,maxLat"}}, nil
+		}
+		q["geometry"] = bson.M{
+			"$geoWithin": bson.M{
+				"$box": bson.A{
+					bson.A{minLon, minLat},
+					bson.A{maxLon, maxLat},
+				},
+			},
+		}
+		canon = append(canon, "bbox="+bbox)
+	}
+	var types map[string]string
+	for k, vs := range query {
+		if !strings.HasPrefix(k, "prop.") || len(vs) == 0 {
+			continue
+		}
+		if types == nil {
+			var err error
+			if types, err = layerPropertyTypes(r.Context(), layer); err != nil {
+				return nil, "", nil, err
+			}
+		}
+		key := strings.TrimPrefix(k, "prop.")
+		v, err := propertyFilterValue(vs[0], types[key])
+		if err != nil {
+			errs = append(errs, FieldError{Field: k, Message: err.Error()})
+			continue
+		}
+		q["properties."+key] = v
+		canon = append(canon, k+"="+vs[0])
+	}
+	// editors with ownership enforcement can only clear their own features
+	if authEnabled && enforceOwnership {
+		if u := currentUser(r); !u.hasRole("admin") {
+			q["created_by"] = userID(r)
+			canon = append(canon, "created_by="+userID(r))
+		}
+	}
+	sort.Strings(canon)
+	return q, layer + "|" + strings.Join(canon, "&"), errs, nil
+}
+
+// layerPropertyTypes maps the properties a layer schema declares to their type;
+// layers without a LayerDoc have none
+func layerPropertyTypes(ctx context.Context, layer string) (map[string]string, error) {
+	var doc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": layer}, options.FindOne().SetProjection(bson.M{"fields": 1})).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	types := map[string]string{}
+	for _, f := range doc.Fields {
+		types[f.Name] = f.Type
+	}
+	return types, nil
+}
+
+// propertyFilterValue converts a query string value to what a property of
+// fieldType is stored as
+func propertyFilterValue(s, fieldType string) (interface{}, error) {
+	switch fieldType {
+	case "number":
+		f, err := parseCSVNumber(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return f, nil
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", s)
+		}
+		return b, nil
+	case "":
+		in := bson.A{s}
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			in = append(in, f)
+		}
+		if b, err := strconv.ParseBool(s); err == nil {
+			in = append(in, b)
+		}
+		if len(in) == 1 {
+			return s, nil
+		}
+		return bson.M{"$in": in}, nil
+	}
+	return s, nil
+}
+
+func signConfirm(key []byte, canon string, count int64, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canon + "|" + strconv.FormatInt(count, 10) + "|" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// confirmation tokens are "<expiry unix>.<hmac>" and bind the filter and the
+// count reported by the dry run
+func makeConfirmToken(canon string, count int64) (string, time.Time) {
+	exp := time.Now().Add(confirmTokenTTL)
+	return strconv.FormatInt(exp.Unix(), 10) + "." + signConfirm(confirmKeys.current(), canon, count, exp.Unix()), exp
+}
+
+func checkConfirmToken(token, canon string, count int64) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	for _, key := range confirmKeys.all() {
+		if hmac.Equal([]byte(parts[1]), []byte(signConfirm(key, canon, count, exp))) {
+			return true
+		}
+	}
+	return false
+}
+
+// DELETE /layers/{id}/features?dryRun=true reports how many features match
+// and returns a confirmation token; repeating the call with the same filter
+// and ?confirm=<token> deletes them.
+func deleteLayerFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["id"]
+	if !requireLayerRole(w, r, layer, "editor") {
+		return
+	}
+	ctx := r.Context()
+	q, canon, errs, err := layerFeatureFilter(r, layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid filter", errs...)
+		return
+	}
+	recordQueryShape(q, nil)
+
+	count, err := collection.CountDocuments(ctx, q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if dry, _ := strconv.ParseBool(r.URL.Query().Get("dryRun")); dry {
+		token, exp := makeConfirmToken(canon, count)
+		json.NewEncoder(w).Encode(bson.M{
+			"layer":         layer,
+			"count":         count,
+			"confirm_token": token,
+			"expires_at":    exp.UTC(),
+		})
+		return
+	}
+
+	token := r.URL.Query().Get("confirm")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "confirmation_required", "confirmation required: call with ?dryRun=true first and pass its confirm_token as ?confirm=")
+		return
+	}
+	if !checkConfirmToken(token, canon, count) {
+		writeError(w, http.StatusConflict, "confirmation_invalid", "confirmation token invalid, expired, or the matching features changed; repeat the dry run")
+		return
+	}
+
+	oids, err := featureIDs(ctx, q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	res, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": oids}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if err := deleteFeatureDependents(oids); err != nil {
+		log.Printf("relation cleanup warning for layer %s: %v", layer, err)
+	}
+	json.NewEncoder(w).Encode(bson.M{"ok": true, "deleted": res.DeletedCount})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LayerStats is the stored rollup for one layer, refreshed every
+// LAYER_STATS_INTERVAL by one aggregation over the features collection so
+// stats reads never scan features
+type LayerStats struct {
+	Layer         string           `bson:"_id" json:"layer"`
+	Count         int64            `bson:"count" json:"count"`
+	Extent        []float64        `bson:"extent,omitempty" json:"extent,omitempty"`
+	LastUpdated   time.Time        `bson:"last_updated" json:"last_updated"`
+	GeometryTypes map[string]int64 `bson:"geometry_types" json:"geometry_types"`
+	// Elevation is the lowest and highest altitude of 3D positions, Height
+	// and MinHeight the ranges of the extrusion properties, in meters
+	Elevation  []float64 `bson:"elevation,omitempty" json:"elevation,omitempty"`
+	Height     []float64 `bson:"height,omitempty" json:"height,omitempty"`
+	MinHeight  []float64 `bson:"min_height,omitempty" json:"min_height,omitempty"`
+	ComputedAt time.Time `bson:"computed_at" json:"computed_at"`
+}
+
+var (
+	layerStats         *mongo.Collection
+	layerStatsInterval = 5 * time.Minute
+)
+
+func setupLayerStats() {
+	layerStats = db.Collection(getenv("MONGO_LAYER_STATS_COLLECTION", "layer_stats"))
+	if d, err := time.ParseDuration(getenv("LAYER_STATS_INTERVAL", "")); err == nil {
+		layerStatsInterval = d
+	}
+	if layerStatsInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if err := refreshLayerStats(""); err != nil {
+				log.Printf("layer stats refresh warning: %v", err)
+			}
+			time.Sleep(layerStatsInterval)
+		}
+	}()
+}
+
+// flattenCoords is an aggregation expression for every position of
+// $geometry as one array
+var flattenCoords = bson.M{"$switch": bson.M{
+	"branches": bson.A{
+		bson.M{"case": bson.M{"$eq": bson.A{"$geometry.type", "Point"}}, "then": bson.A{"$geometry.coordinates"}},
+		bson.M{"case": bson.M{"$in": bson.A{"$geometry.type", bson.A{"LineString", "MultiPoint"}}}, "then": "$geometry.coordinates"},
+		bson.M{"case": bson.M{"$in": bson.A{"$geometry.type", bson.A{"Polygon", "MultiLineString"}}}, "then": bson.M{
+			"$reduce": bson.M{"input": "$geometry.coordinates", "initialValue": bson.A{}, "in": bson.M{"$concatArrays": bson.A{"$$value", "$$this"}}},
+		}},
+		bson.M{"case": bson.M{"$eq": bson.A{"$geometry.type", "MultiPolygon"}}, "then": bson.M{
+			"$reduce": bson.M{"input": "$geometry.coordinates", "initialValue": bson.A{}, "in": bson.M{"$concatArrays": bson.A{"$$value",
+				bson.M{"$reduce": bson.M{"input": "$$this", "initialValue": bson.A{}, "in": bson.M{"$concatArrays": bson.A{"$$value", "$$this"}}}},
+			}}},
+		}},
+	},
+	"default": bson.A{},
+}}
+
+func axis(i int) bson.M {
+	return bson.M{"$map": bson.M{"input": "$pts", "in": bson.M{"$arrayElemAt": bson.A{"$$this", i}}}}
+}
+
+// numericProperty is properties.<name> when it is a number, null otherwise
+func numericProperty(name string) bson.M {
+	return bson.M{"$cond": bson.A{bson.M{"$isNumber": "$properties." + name}, "$properties." + name, nil}}
+}
+
+// widenRange grows a [min, max] pair by a group's bounds
+func widenRange(r []float64, lo, hi *float64) []float64 {
+	if lo == nil || hi == nil {
+		return r
+	}
+	if r == nil {
+		return []float64{*lo, *hi}
+	}
+	return []float64{min(r[0], *lo), max(r[1], *hi)}
+}
+
+// refreshLayerStats recomputes the rollup of one layer, or of all layers
+// when layer is "" (dropping rollups of layers that no longer have features)
+func refreshLayerStats(layer string) error {
+	match := bson.M{"layer": bson.M{"$exists": true, "$ne": ""}}
+	if layer != "" {
+		match = bson.M{"layer": layer}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.M{
+			"layer": 1, "updated_at": 1, "type": "$geometry.type", "pts": flattenCoords,
+			"h": numericProperty(heightProperty), "b": numericProperty(minHeightProperty),
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"layer": 1, "updated_at": 1, "type": 1, "h": 1, "b": 1,
+			"minx": bson.M{"$min": axis(0)}, "maxx": bson.M{"$max": axis(0)},
+			"miny": bson.M{"$min": axis(1)}, "maxy": bson.M{"$max": axis(1)},
+			// 2D positions have no third element, which $min and $max skip
+			"minz": bson.M{"$min": axis(2)}, "maxz": bson.M{"$max": axis(2)},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"layer": "$layer", "type": "$type"},
+			"n":   bson.M{"$sum": 1}, "last": bson.M{"$max": "$updated_at"},
+			"minx": bson.M{"$min": "$minx"}, "maxx": bson.M{"$max": "$maxx"},
+			"miny": bson.M{"$min": "$miny"}, "maxy": bson.M{"$max": "$maxy"},
+			"minz": bson.M{"$min": "$minz"}, "maxz": bson.M{"$max": "$maxz"},
+			"minh": bson.M{"$min": "$h"}, "maxh": bson.M{"$max": "$h"},
+			"minb": bson.M{"$min": "$b"}, "maxb": bson.M{"$max": "$b"},
+		}}},
+	}
+	cur, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		ID struct {
+			Layer string `bson:"layer"`
+			Type  string `bson:"type"`
+		} `bson:"_id"`
+		N    int64     `bson:"n"`
+		Last time.Time `bson:"last"`
+		MinX *float64  `bson:"minx"`
+		MaxX *float64  `bson:"maxx"`
+		MinY *float64  `bson:"miny"`
+		MaxY *float64  `bson:"maxy"`
+		MinZ *float64  `bson:"minz"`
+		MaxZ *float64  `bson:"maxz"`
+		MinH *float64  `bson:"minh"`
+		MaxH *float64  `bson:"maxh"`
+		MinB *float64  `bson:"minb"`
+		MaxB *float64  `bson:"maxb"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	stats := map[string]*LayerStats{}
+	for _, row := range rows {
+		s := stats[row.ID.Layer]
+		if s == nil {
+			s = &LayerStats{Layer: row.ID.Layer, GeometryTypes: map[string]int64{}, ComputedAt: now}
+			stats[row.ID.Layer] = s
+		}
+		s.Count += row.N
+		s.GeometryTypes[row.ID.Type] += row.N
+		if row.Last.After(s.LastUpdated) {
+			s.LastUpdated = row.Last
+		}
+		s.Elevation = widenRange(s.Elevation, row.MinZ, row.MaxZ)
+		s.Height = widenRange(s.Height, row.MinH, row.MaxH)
+		s.MinHeight = widenRange(s.MinHeight, row.MinB, row.MaxB)
+		if row.MinX == nil || row.MaxX == nil || row.MinY == nil || row.MaxY == nil {
+			continue
+		}
+		if s.Extent == nil {
+			s.Extent = []float64{*row.MinX, *row.MinY, *row.MaxX, *row.MaxY}
+		} else {
+			s.Extent = []float64{min(s.Extent[0], *row.MinX), min(s.Extent[1], *row.MinY), max(s.Extent[2], *row.MaxX), max(s.Extent[3], *row.MaxY)}
+		}
+	}
+
+	keep := []string{}
+	for id, s := range stats {
+		keep = append(keep, id)
+		if _, err := layerStats.ReplaceOne(ctx, bson.M{"_id": id}, s, options.Replace().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	stale := bson.M{"_id": bson.M{"$nin": keep}}
+	if layer != "" {
+		stale = bson.M{"_id": layer}
+		if len(keep) > 0 {
+			return nil
+		}
+	}
+	_, err = layerStats.DeleteMany(ctx, stale)
+	return err
+}
+
+// GET /stats/layers lists the rollups of every layer
+func listLayerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	cur, err := layerStats.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LayerStats{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /layers/{id}/stats?refresh=true
+// Returns the stored rollup; it is computed on the spot when missing, or
+// when an editor asks for refresh
+func layerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	refresh, _ := strconv.ParseBool(r.URL.Query().Get("refresh"))
+	if refresh && !requireRole(w, r, "editor") {
+		return
+	}
+	var s LayerStats
+	err := layerStats.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	if err == mongo.ErrNoDocuments || (err == nil && refresh) {
+		if err := refreshLayerStats(id); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		err = layerStats.FindOne(ctx, bson.M{"_id": id}).Decode(&s)
+	}
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer has no features")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
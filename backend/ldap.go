@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ldapProvider checks passwords with an LDAP simple bind. LDAP_URL is
+// ldap://host:389 or ldaps://host:636 and LDAP_USER_DN the bind DN with %s
+// for the username, e.g. uid=%s,ou=people,dc=example,dc=org. After a
+// successful bind the user's LDAP_GROUP_ATTR values (memberOf by default)
+// are read and mapped with LDAP_ROLE_MAP="admin=cn=gis-admins,ou=groups,...";
+// users in no mapped group get LDAP_DEFAULT_ROLE (empty refuses them).
+// Users are keyed ldap#<host>#<username> so a directory account never takes
+// over a local or OIDC user of the same name; LDAP_NAME_ATTR (cn by default)
+// is their display name.
+//
+// Only the bind and a base-object search are needed, so the few LDAP
+// messages involved are BER-encoded here instead of pulling in a client.
+type ldapProvider struct {
+	url         *url.URL
+	userDN      string
+	groupAttr   string
+	nameAttr    string
+	roleMap     map[string]string
+	defaultRole string
+}
+
+var errInvalidCredentials = errors.New("invalid username or password")
+
+func newLDAPProvider() (*ldapProvider, error) {
+	raw := getenv("LDAP_URL", "")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("LDAP_URL %q must be ldap://host[:port] or ldaps://host[:port]", raw)
+	}
+	p := &ldapProvider{
+		url:         u,
+		userDN:      getenv("LDAP_USER_DN", ""),
+		groupAttr:   getenv("LDAP_GROUP_ATTR", "memberOf"),
+		nameAttr:    getenv("LDAP_NAME_ATTR", "cn"),
+		roleMap:     parseRoleMap(getenv("LDAP_ROLE_MAP", "")),
+		defaultRole: getenv("LDAP_DEFAULT_ROLE", "viewer"),
+	}
+	if strings.Count(p.userDN, "%s") != 1 {
+		return nil, errors.New("LDAP_USER_DN must contain %s once")
+	}
+	if _, ok := roleRanks[p.defaultRole]; !ok {
+		p.defaultRole = ""
+	}
+	return p, nil
+}
+
+func (p *ldapProvider) name() string { return "ldap" }
+
+// ldapEscapeDN escapes a value for use in a DN (RFC 4514)
+func ldapEscapeDN(s string) string {
+	var b strings.Builder
+	for i, c := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, c),
+			i == 0 && (c == '#' || c == ' '),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c < 0x20:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// BER encoding of the handful of types LDAP messages use
+func berTLV(tag byte, content []byte) []byte {
+	n := len(content)
+	var length []byte
+	switch {
+	case n < 0x80:
+		length = []byte{byte(n)}
+	case n < 0x100:
+		length = []byte{0x81, byte(n)}
+	case n < 0x10000:
+		length = []byte{0x82, byte(n >> 8), byte(n)}
+	default:
+		length = []byte{0x83, byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	return append(append([]byte{tag}, length...), content...)
+}
+
+func berInt(tag byte, v int) []byte {
+	// message ids, versions and enums here all fit in one positive byte
+	return berTLV(tag, []byte{byte(v)})
+}
+
+func berString(tag byte, s string) []byte { return berTLV(tag, []byte(s)) }
+
+func berSeq(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return berTLV(tag, content)
+}
+
+// berElement is one decoded TLV
+type berElement struct {
+	tag     byte
+	content []byte
+}
+
+// readBER reads one TLV from r
+func readBER(r io.Reader) (berElement, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return berElement{}, err
+	}
+	n := int(head[1])
+	if n&0x80 != 0 {
+		k := n & 0x7f
+		if k == 0 || k > 3 {
+			return berElement{}, errors.New("ldap: unsupported length")
+		}
+		b := make([]byte, k)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return berElement{}, err
+		}
+		n = 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+	}
+	content := make([]byte, n)
+	_, err := io.ReadFull(r, content)
+	return berElement{tag: head[0], content: content}, err
+}
+
+// berChildren splits a constructed element's content into its elements
+func berChildren(b []byte) ([]berElement, error) {
+	var out []berElement
+	r := strings.NewReader(string(b))
+	for r.Len() > 0 {
+		e, err := readBER(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (p *ldapProvider) dial() (net.Conn, error) {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		if p.url.Scheme == "ldaps" {
+			host = net.JoinHostPort(host, "636")
+		} else {
+			host = net.JoinHostPort(host, "389")
+		}
+	}
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if p.url.Scheme == "ldaps" {
+		return tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: p.url.Hostname()})
+	}
+	return d.Dial("tcp", host)
+}
+
+// ldapResult reads the result code out of an LDAPResult body
+func ldapResult(op berElement) (int, string, error) {
+	parts, err := berChildren(op.content)
+	if err != nil || len(parts) < 3 || len(parts[0].content) != 1 {
+		return 0, "", errors.New("ldap: malformed result")
+	}
+	return int(parts[0].content[0]), string(parts[2].content), nil
+}
+
+// readLDAPMessage reads a message and returns its protocol operation
+func readLDAPMessage(conn net.Conn) (berElement, error) {
+	msg, err := readBER(conn)
+	if err != nil {
+		return berElement{}, err
+	}
+	parts, err := berChildren(msg.content)
+	if err != nil || msg.tag != 0x30 || len(parts) < 2 {
+		return berElement{}, errors.New("ldap: malformed message")
+	}
+	return parts[1], nil
+}
+
+// attributes reads the named attributes of dn from a bound connection
+func (p *ldapProvider) attributes(conn net.Conn, dn string, names ...string) (map[string][]string, error) {
+	var list [][]byte
+	for _, n := range names {
+		list = append(list, berString(0x04, n))
+	}
+	search := berSeq(0x30,
+		berInt(0x02, 2),
+		berSeq(0x63, // SearchRequest
+			berString(0x04, dn),
+			berInt(0x0a, 0),         // scope baseObject
+			berInt(0x0a, 0),         // neverDerefAliases
+			berInt(0x02, 1),         // sizeLimit
+			berInt(0x02, 10),        // timeLimit seconds
+			berTLV(0x01, []byte{0}), // typesOnly false
+			berString(0x87, "objectClass"),
+			berSeq(0x30, list...),
+		),
+	)
+	if _, err := conn.Write(search); err != nil {
+		return nil, err
+	}
+	out := map[string][]string{}
+	for {
+		op, err := readLDAPMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case 0x64: // SearchResultEntry
+			parts, err := berChildren(op.content)
+			if err != nil || len(parts) < 2 {
+				return nil, errors.New("ldap: malformed entry")
+			}
+			attrs, _ := berChildren(parts[1].content)
+			for _, a := range attrs {
+				kv, err := berChildren(a.content)
+				if err != nil || len(kv) < 2 {
+					continue
+				}
+				for _, n := range names {
+					if !strings.EqualFold(string(kv[0].content), n) {
+						continue
+					}
+					vals, _ := berChildren(kv[1].content)
+					for _, v := range vals {
+						out[n] = append(out[n], string(v.content))
+					}
+				}
+			}
+		case 0x65: // SearchResultDone
+			code, diag, err := ldapResult(op)
+			if err != nil {
+				return nil, err
+			}
+			if code != 0 {
+				return nil, fmt.Errorf("ldap search failed (%d): %s", code, diag)
+			}
+			return out, nil
+		}
+	}
+}
+
+func (p *ldapProvider) login(username, password string) (*User, error) {
+	// an empty password is an unauthenticated bind, which servers accept
+	if username == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	dn := fmt.Sprintf(p.userDN, ldapEscapeDN(username))
+	bind := berSeq(0x30,
+		berInt(0x02, 1),
+		berSeq(0x60, // BindRequest
+			berInt(0x02, 3),
+			berString(0x04, dn),
+			berString(0x80, password), // simple authentication
+		),
+	)
+	if _, err := conn.Write(bind); err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	op, err := readLDAPMessage(conn)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %v", err)
+	}
+	code, diag, err := ldapResult(op)
+	if err != nil || op.tag != 0x61 {
+		return nil, errors.New("ldap: unexpected bind response")
+	}
+	if code == 49 { // invalidCredentials
+		return nil, errInvalidCredentials
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("ldap bind failed (%d): %s", code, diag)
+	}
+	attrs, err := p.attributes(conn, dn, p.groupAttr, p.nameAttr)
+	if err != nil {
+		return nil, err
+	}
+	role := mapRole(attrs[p.groupAttr], p.roleMap, p.defaultRole)
+	if role == "" {
+		return nil, errNoRole
+	}
+	display := username
+	if v := attrs[p.nameAttr]; len(v) > 0 && v[0] != "" {
+		display = v[0]
+	}
+	// directories match uids without regard to case, so one account is one id
+	id := "ldap#" + strings.ToLower(p.url.Host) + "#" + strings.ToLower(username)
+	return &User{ID: id, Role: role, Provider: p.name(), Name: display}, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// LegendEntry is one swatch of a layer legend. A style renders as a single
+// entry, or one per item of style.classes (or style.rules), each item
+// overriding the base style and carrying its label.
+type LegendEntry struct {
+	Label   string  `json:"label"`
+	Type    string  `json:"type"`
+	Color   string  `json:"color,omitempty"`
+	Outline string  `json:"outline,omitempty"`
+	Opacity float64 `json:"opacity,omitempty"`
+	Radius  float64 `json:"radius,omitempty"`
+	Width   float64 `json:"width,omitempty"`
+	Icon    string  `json:"icon,omitempty"`
+}
+
+// Legend is the JSON form of GET /layers/{id}/legend
+type Legend struct {
+	Layer   string        `json:"layer"`
+	Name    string        `json:"name"`
+	Entries []LegendEntry `json:"entries"`
+}
+
+func styleString(m bson.M, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+func styleNumber(m bson.M, key string) float64 {
+	switch v := m[key].(type) {
+	case float64:
+		return v
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case int:
+		return float64(v)
+	}
+	return 0
+}
+
+func legendEntry(style bson.M, label string) LegendEntry {
+	e := LegendEntry{
+		Label:   label,
+		Type:    styleString(style, "type"),
+		Color:   styleString(style, "color"),
+		Outline: styleString(style, "outline"),
+		Opacity: styleNumber(style, "opacity"),
+		Radius:  styleNumber(style, "radius"),
+		Width:   styleNumber(style, "width"),
+	}
+	if icon := styleString(style, "icon"); icon != "" {
+		e.Type, e.Icon = "icon", "/symbols/"+icon
+	}
+	if e.Type == "" {
+		e.Type = "fill"
+	}
+	return e
+}
+
+// buildLegend derives the entries from a layer style
+func buildLegend(l LayerDoc) Legend {
+	leg := Legend{Layer: l.ID, Name: l.Name, Entries: []LegendEntry{}}
+	base := l.Style
+	if base == nil {
+		base = bson.M{}
+	}
+	items, ok := asArray(base["classes"])
+	if !ok {
+		items, _ = asArray(base["rules"])
+	}
+	for i, item := range items {
+		m, ok := asMap(item)
+		if !ok {
+			continue
+		}
+		merged := bson.M{}
+		for k, v := range base {
+			merged[k] = v
+		}
+		for k, v := range m {
+			merged[k] = v
+		}
+		label := styleString(m, "label")
+		if label == "" {
+			label = l.Name + " " + strconv.Itoa(i+1)
+		}
+		leg.Entries = append(leg.Entries, legendEntry(merged, label))
+	}
+	if len(leg.Entries) == 0 {
+		leg.Entries = append(leg.Entries, legendEntry(base, l.Name))
+	}
+	return leg
+}
+
+// parseColor reads #rgb and #rrggbb, falling back to grey
+func parseColor(s string, alpha float64) color.NRGBA {
+	c := color.NRGBA{0x88, 0x88, 0x88, 0xff}
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if v, err := strconv.ParseUint(s, 16, 32); err == nil && len(s) == 6 {
+		c = color.NRGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+	}
+	if alpha > 0 && alpha < 1 {
+		c.A = uint8(math.Round(alpha * 255))
+	}
+	return c
+}
+
+const (
+	legendRow    = 20
+	legendSwatch = 16
+	legendPad    = 4
+)
+
+// symbolImage loads a PNG symbol for the strip; SVG symbols can't be
+// rasterized here and are drawn as a plain swatch instead
+func symbolImage(url string) image.Image {
+	var s Symbol
+	if err := symbols.FindOne(ctx, bson.M{"_id": strings.TrimPrefix(url, "/symbols/")}).Decode(&s); err != nil || s.ContentType != "image/png" {
+		return nil
+	}
+	img, err := png.Decode(bytes.NewReader(s.Data))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+func drawSwatch(img *image.RGBA, x, y int, e LegendEntry) {
+	fill := parseColor(e.Color, e.Opacity)
+	switch e.Type {
+	case "icon":
+		if icon := symbolImage(e.Icon); icon != nil {
+			// nearest-neighbour scale into the swatch box
+			b := icon.Bounds()
+			for dy := 0; dy < legendSwatch; dy++ {
+				for dx := 0; dx < legendSwatch; dx++ {
+					px := icon.At(b.Min.X+dx*b.Dx()/legendSwatch, b.Min.Y+dy*b.Dy()/legendSwatch)
+					draw.Draw(img, image.Rect(x+dx, y+dy, x+dx+1, y+dy+1), image.NewUniform(px), image.Point{}, draw.Over)
+				}
+			}
+			return
+		}
+		draw.Draw(img, image.Rect(x, y, x+legendSwatch, y+legendSwatch), image.NewUniform(fill), image.Point{}, draw.Over)
+	case "circle":
+		r := e.Radius
+		if r <= 0 || r > legendSwatch/2 {
+			r = legendSwatch / 2
+		}
+		cx, cy := float64(x)+legendSwatch/2, float64(y)+legendSwatch/2
+		for py := y; py < y+legendSwatch; py++ {
+			for px := x; px < x+legendSwatch; px++ {
+				if math.Hypot(float64(px)+0.5-cx, float64(py)+0.5-cy) <= r {
+					draw.Draw(img, image.Rect(px, py, px+1, py+1), image.NewUniform(fill), image.Point{}, draw.Over)
+				}
+			}
+		}
+	case "line":
+		width := int(math.Round(e.Width))
+		width = max(1, min(width, 6))
+		top := y + (legendSwatch-width)/2
+		draw.Draw(img, image.Rect(x, top, x+legendSwatch, top+width), image.NewUniform(fill), image.Point{}, draw.Over)
+	default:
+		draw.Draw(img, image.Rect(x, y, x+legendSwatch, y+legendSwatch), image.NewUniform(fill), image.Point{}, draw.Over)
+		if e.Outline != "" {
+			o := image.NewUniform(parseColor(e.Outline, 1))
+			for _, r := range []image.Rectangle{
+				image.Rect(x, y, x+legendSwatch, y+1), image.Rect(x, y+legendSwatch-1, x+legendSwatch, y+legendSwatch),
+				image.Rect(x, y, x+1, y+legendSwatch), image.Rect(x+legendSwatch-1, y, x+legendSwatch, y+legendSwatch),
+			} {
+				draw.Draw(img, r, o, image.Point{}, draw.Over)
+			}
+		}
+	}
+}
+
+// renderLegendPNG draws the entries as a vertical strip with the labels to
+// the right of their swatches
+func renderLegendPNG(leg Legend) ([]byte, error) {
+	longest := 0
+	for _, e := range leg.Entries {
+		longest = max(longest, len([]rune(e.Label)))
+	}
+	width := legendPad*3 + legendSwatch + longest*glyphAdvance
+	height := legendPad*2 + len(leg.Entries)*legendRow
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	for i, e := range leg.Entries {
+		y := legendPad + i*legendRow + (legendRow-legendSwatch)/2
+		drawSwatch(img, legendPad, y, e)
+		drawText(img, legendPad*2+legendSwatch, y+(legendSwatch-7)/2, e.Label, color.Black)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GET /layers/{id}/legend?format=json|png
+func layerLegendHandler(w http.ResponseWriter, r *http.Request) {
+	var l LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	leg := buildLegend(l)
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leg)
+	case "png":
+		out, err := renderLegendPNG(leg)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "render_error", "png encode error: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+		w.Write(out)
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid format", FieldError{Field: "format", Message: "must be json or png"})
+	}
+}
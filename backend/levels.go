@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Floors of multi-storey buildings, as IndoorGML's storeys and OSM's level
+// tag have them: a feature is on one level ("1", "-1" for a basement,
+// "0.5" for a mezzanine), several ("0;2") or a range ("0-3", a staircase).
+// The text is kept, normalized, in level and expanded into the numbers
+// it covers in levels, which ?level= matches on every read path that lists
+// features.
+
+const (
+	minLevel = -20
+	maxLevel = 200
+	// a range covers at most this many floors
+	maxLevelSpan = 100
+)
+
+// parseLevel reads one level or a range of levels
+func parseLevel(s string) (lo, hi float64, err error) {
+	s = strings.TrimSpace(s)
+	// the dash between two levels may follow a number or sit before a
+	// negative one: "-2--1", "0-3"
+	sep := -1
+	for i := 1; i < len(s); i++ {
+		if s[i] == '-' && s[i-1] != '-' && s[i-1] != 'e' && s[i-1] != 'E' {
+			sep = i
+			break
+		}
+	}
+	if sep > 0 {
+		var errHi error
+		lo, err = strconv.ParseFloat(strings.TrimSpace(s[:sep]), 64)
+		hi, errHi = strconv.ParseFloat(strings.TrimSpace(s[sep+1:]), 64)
+		if err == nil {
+			err = errHi
+		}
+	} else {
+		lo, err = strconv.ParseFloat(s, 64)
+		hi = lo
+	}
+	switch {
+	case err != nil || math.IsNaN(lo) || math.IsNaN(hi):
+		return 0, 0, fmt.Errorf("%q is not a level or a range like 0-3", s)
+	case lo > hi:
+		return 0, 0, fmt.Errorf("range %q runs downwards", s)
+	case lo < minLevel || hi > maxLevel:
+		return 0, 0, fmt.Errorf("levels go from %d to %d", minLevel, maxLevel)
+	case hi-lo > maxLevelSpan:
+		return 0, 0, fmt.Errorf("range %q spans more than %d levels", s, maxLevelSpan)
+	}
+	return lo, hi, nil
+}
+
+// levelText formats a level the way it is stored
+func levelText(lo, hi float64) string {
+	s := strconv.FormatFloat(lo, 'f', -1, 64)
+	if hi != lo {
+		s += "-" + strconv.FormatFloat(hi, 'f', -1, 64)
+	}
+	return s
+}
+
+// expandLevels parses a feature's level into its normalized text and the
+// sorted levels it is on. A range takes both ends and the whole floors
+// between them.
+func expandLevels(s string) (string, []float64, error) {
+	var parts []string
+	seen := map[float64]bool{}
+	var levels []float64
+	add := func(l float64) {
+		if !seen[l] {
+			seen[l] = true
+			levels = append(levels, l)
+		}
+	}
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		lo, hi, err := parseLevel(part)
+		if err != nil {
+			return "", nil, err
+		}
+		parts = append(parts, levelText(lo, hi))
+		add(lo)
+		for l := math.Ceil(lo); l < hi; l++ {
+			add(l)
+		}
+		add(hi)
+	}
+	if len(parts) == 0 {
+		return "", nil, errors.New("empty level")
+	}
+	sort.Float64s(levels)
+	return strings.Join(parts, ";"), levels, nil
+}
+
+// validateLevel checks the level of a FeatureInput, a number or text like
+// "0;2" or "1-3", leaving what is stored in in.level and in.levels
+func (in *FeatureInput) validateLevel() []FieldError {
+	var s string
+	switch v := in.Level.(type) {
+	case nil:
+		return nil
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		s = v
+	default:
+		return []FieldError{{Field: "level", Message: "must be a number or text like 0;2 or 1-3"}}
+	}
+	text, levels, err := expandLevels(s)
+	if err != nil {
+		return []FieldError{{Field: "level", Message: err.Error()}}
+	}
+	in.level, in.levels = text, levels
+	return nil
+}
+
+// applyLevelFilter narrows q to the features on ?level=, which takes the
+// same syntax features do: level=2, level=0;1, level=-1-1. A feature
+// matches when any of its levels is on one asked for. It writes a 400 on
+// a malformed level.
+func applyLevelFilter(w http.ResponseWriter, r *http.Request, q bson.M) bool {
+	s := r.URL.Query().Get("level")
+	if s == "" {
+		return true
+	}
+	var points bson.A
+	var or bson.A
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		lo, hi, err := parseLevel(part)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid level", FieldError{Field: "level", Message: err.Error()})
+			return false
+		}
+		if lo == hi {
+			points = append(points, lo)
+		} else {
+			or = append(or, bson.M{"levels": bson.M{"$elemMatch": bson.M{"$gte": lo, "$lte": hi}}})
+		}
+	}
+	if len(points) > 0 {
+		or = append(or, bson.M{"levels": bson.M{"$in": points}})
+	}
+	switch len(or) {
+	case 0:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid level", FieldError{Field: "level", Message: "empty level"})
+		return false
+	case 1:
+		for k, v := range or[0].(bson.M) {
+			q[k] = v
+		}
+	default:
+		and, _ := asArray(q["$and"])
+		q["$and"] = append(append(bson.A{}, and...), bson.M{"$or": or})
+	}
+	return true
+}
+
+func setupLevels() {
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "layer", Value: 1}, {Key: "levels", Value: 1}},
+	})
+	if err != nil {
+		log.Printf("levels index create warning: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// LayerLicense is where a layer's data comes from and the terms it may be
+// used under. It travels with the data: zip and multi-part exports carry it
+// in their manifests and GeoJSON files, zips add ATTRIBUTION.txt, the
+// ArcGIS service reports it as copyrightText and vector tiles' TileJSON as
+// attribution.
+type LayerLicense struct {
+	// License is an SPDX identifier such as ODbL-1.0 or CC-BY-4.0, or the
+	// name of other terms
+	License     string `bson:"license,omitempty" json:"license,omitempty"`
+	URL         string `bson:"url,omitempty" json:"url,omitempty"`
+	Source      string `bson:"source,omitempty" json:"source,omitempty"`
+	Attribution string `bson:"attribution,omitempty" json:"attribution,omitempty"`
+}
+
+const maxLicenseText = 1000
+
+func validateLicense(l *LayerLicense) []FieldError {
+	var errs []FieldError
+	if l.License == "" && l.Source == "" && l.Attribution == "" {
+		errs = append(errs, FieldError{Field: "license", Message: "set at least one of license, source and attribution"})
+	}
+	for field, v := range map[string]string{"license": l.License, "url": l.URL, "source": l.Source, "attribution": l.Attribution} {
+		if len(v) > maxLicenseText {
+			errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf("at most %d characters", maxLicenseText)})
+		}
+	}
+	if l.URL != "" {
+		if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, FieldError{Field: "url", Message: "must be an http(s) URL"})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+// text is the credit line to show with the data: the attribution, or
+// else the source and license
+func (l *LayerLicense) text() string {
+	if l == nil {
+		return ""
+	}
+	if l.Attribution != "" {
+		return l.Attribution
+	}
+	var parts []string
+	if l.Source != "" {
+		parts = append(parts, "Source: "+l.Source)
+	}
+	if l.License != "" {
+		parts = append(parts, "License: "+l.License)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// layerLicense is the license of one layer, nil when it has none
+func layerLicense(id string) (*LayerLicense, error) {
+	var doc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": id}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return doc.License, nil
+}
+
+// writeAttribution writes ATTRIBUTION.txt for the files of an export,
+// listing those with a license
+func writeAttribution(out io.Writer, names []string, licenses map[string]*LayerLicense) {
+	fmt.Fprintln(out, "Data sources and licenses of this export")
+	for _, name := range names {
+		l := licenses[name]
+		if l == nil {
+			continue
+		}
+		fmt.Fprintf(out, "\n%s\n", name)
+		for _, line := range [][2]string{{"Attribution", l.Attribution}, {"Source", l.Source}, {"License", l.License}, {"Terms", l.URL}} {
+			if line[1] != "" {
+				fmt.Fprintf(out, "  %s: %s\n", line[0], line[1])
+			}
+		}
+	}
+}
+
+// PUT /layers/{id}/license { license, url, source, attribution }
+func putLayerLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var body LayerLicense
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if errs := validateLicense(&body); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid license", errs...)
+		return
+	}
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}, bson.M{"$set": bson.M{"license": body, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// DELETE /layers/{id}/license
+func deleteLayerLicenseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}, bson.M{"$unset": bson.M{"license": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// most vertices a densify/resample result may have
+const maxLineVertices = 100000
+
+// haversine distance in meters
+func haversine(a, b Position) float64 {
+	lat1, lat2 := a[1]*math.Pi/180, b[1]*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b[0] - a[0]) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func lineLength(ps []Position) float64 {
+	var l float64
+	for i := 1; i < len(ps); i++ {
+		l += haversine(ps[i-1], ps[i])
+	}
+	return l
+}
+
+// locateOnLine finds the closest position to p on the line, treating each
+// segment as planar around p, with its distance along the line and from p
+func locateOnLine(ps []Position, p Position) (q Position, along, dist float64) {
+	k := math.Cos(p[1] * math.Pi / 180)
+	dist = math.Inf(1)
+	walked := 0.0
+	for j := 1; j < len(ps); j++ {
+		a, b := ps[j-1], ps[j]
+		ax, ay := (a[0]-p[0])*k, a[1]-p[1]
+		bx, by := (b[0]-p[0])*k, b[1]-p[1]
+		t := 0.0
+		if l2 := (bx-ax)*(bx-ax) + (by-ay)*(by-ay); l2 > 0 {
+			t = math.Max(0, math.Min(1, -(ax*(bx-ax)+ay*(by-ay))/l2))
+		}
+		c := lerp(a, b, t)
+		if d := haversine(p, c); d < dist {
+			q, along, dist = c, walked+haversine(a, c), d
+		}
+		walked += haversine(a, b)
+	}
+	return q, along, dist
+}
+
+// densifyLine inserts vertices so no segment is longer than maxSeg meters.
+// Original vertices are kept, so the shape doesn't change.
+func densifyLine(ps []Position, maxSeg float64) []Position {
+	if len(ps) < 2 {
+		return ps
+	}
+	out := []Position{ps[0]}
+	for i := 1; i < len(ps); i++ {
+		a, b := ps[i-1], ps[i]
+		n := int(math.Ceil(haversine(a, b) / maxSeg))
+		for k := 1; k < n; k++ {
+			out = append(out, lerp(a, b, float64(k)/float64(n)))
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// resampleLine returns n vertices spaced evenly along the line, including both
+// ends
+func resampleLine(ps []Position, n int) []Position {
+	if len(ps) < 2 || n < 2 {
+		return ps
+	}
+	total := lineLength(ps)
+	out := make([]Position, 0, n)
+	out = append(out, ps[0])
+	seg, segStart := 1, 0.0
+	segLen := haversine(ps[0], ps[1])
+	for k := 1; k < n-1; k++ {
+		target := total * float64(k) / float64(n-1)
+		for seg < len(ps)-1 && segStart+segLen < target {
+			segStart += segLen
+			seg++
+			segLen = haversine(ps[seg-1], ps[seg])
+		}
+		t := 0.0
+		if segLen > 0 {
+			t = (target - segStart) / segLen
+		}
+		out = append(out, lerp(ps[seg-1], ps[seg], math.Min(1, t)))
+	}
+	return append(out, ps[len(ps)-1])
+}
+
+// lineInput reads { geometry } or { id } (an approved feature) and returns the
+// line geometry, writing the error response itself on failure
+func lineInput(w http.ResponseWriter, r *http.Request, id string, raw interface{}) (Geometry, bool) {
+	if id != "" {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_id", "invalid id", FieldError{Field: "id", Message: "must be a feature id"})
+			return Geometry{}, false
+		}
+		var doc FeatureDoc
+		q := bson.M{"_id": oid, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+		applyVisibilityFilter(r, q)
+		err = collection.FindOne(r.Context(), q).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusNotFound, "not_found", "feature not found")
+			return Geometry{}, false
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return Geometry{}, false
+		}
+		raw = doc.Geometry
+	}
+	g, err := parseGeometry(raw)
+	if err == nil && g.Type != "LineString" && g.Type != "MultiLineString" && g.Type != "Polygon" {
+		err = fmt.Errorf("geometry must be a LineString, MultiLineString or Polygon")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid geometry", FieldError{Field: "geometry", Message: err.Error()})
+		return Geometry{}, false
+	}
+	return g, true
+}
+
+func countVertices(g Geometry) int {
+	return len(g.allPositions())
+}
+
+// POST /geometry/densify { geometry | id, max_segment }
+// max_segment is in meters; polygon rings are densified too
+func densifyHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID         string      `json:"id"`
+		Geometry   interface{} `json:"geometry"`
+		MaxSegment float64     `json:"max_segment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if body.MaxSegment <= 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid max_segment", FieldError{Field: "max_segment", Message: "must be a positive length in meters"})
+		return
+	}
+	g, ok := lineInput(w, r, body.ID, body.Geometry)
+	if !ok {
+		return
+	}
+
+	estimate := lineLength(g.Points) / body.MaxSegment
+	for _, ring := range g.Rings {
+		estimate += lineLength(ring) / body.MaxSegment
+	}
+	if estimate > maxLineVertices {
+		writeError(w, http.StatusRequestEntityTooLarge, "result_too_large", fmt.Sprintf("result would exceed %d vertices; increase max_segment", maxLineVertices))
+		return
+	}
+
+	out := Geometry{Type: g.Type}
+	if g.Type == "LineString" {
+		out.Points = densifyLine(g.Points, body.MaxSegment)
+	} else {
+		for _, ring := range g.Rings {
+			out.Rings = append(out.Rings, densifyLine(ring, body.MaxSegment))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"geometry": out.BSON(), "vertices": countVertices(out)})
+}
+
+// POST /geometry/resample { geometry | id, count }
+// Returns count vertices evenly spaced by distance along each line
+func resampleHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ID       string      `json:"id"`
+		Geometry interface{} `json:"geometry"`
+		Count    int         `json:"count"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if body.Count < 2 || body.Count > maxLineVertices {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid count", FieldError{Field: "count", Message: fmt.Sprintf("must be between 2 and %d", maxLineVertices)})
+		return
+	}
+	g, ok := lineInput(w, r, body.ID, body.Geometry)
+	if !ok {
+		return
+	}
+	if g.Type != "LineString" && g.Type != "MultiLineString" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "resample needs a LineString or MultiLineString", FieldError{Field: "geometry", Message: "must be a LineString or MultiLineString"})
+		return
+	}
+
+	out := Geometry{Type: g.Type}
+	if g.Type == "LineString" {
+		out.Points = resampleLine(g.Points, body.Count)
+	} else {
+		for _, l := range g.Rings {
+			out.Rings = append(out.Rings, resampleLine(l, body.Count))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"geometry": out.BSON(), "vertices": countVertices(out)})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Brute-force protection for /auth/login. Failed attempts are counted per
+// username and per client address in Mongo, so every instance sees them.
+// After each failure the next attempt has to wait LOGIN_DELAY (1s), doubled
+// per further failure up to a minute; LOGIN_MAX_FAILURES (5) failures lock
+// the username for LOGIN_LOCKOUT (15m) and LOGIN_MAX_IP_FAILURES (20) lock
+// the address, which catches one client trying many usernames. A successful
+// login clears the username's count. Counts are forgotten after a day
+// without failures. Every attempt is recorded in auth_events.
+type LoginAttempts struct {
+	Key         string     `bson:"_id" json:"key"`
+	Failures    int        `bson:"failures" json:"failures"`
+	LastFailure time.Time  `bson:"last_failure" json:"last_failure"`
+	LockedUntil *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+}
+
+// AuthEvent is an audit entry for a login attempt
+type AuthEvent struct {
+	At       time.Time `bson:"at" json:"at"`
+	Event    string    `bson:"event" json:"event"`
+	Username string    `bson:"username,omitempty" json:"username,omitempty"`
+	IP       string    `bson:"ip" json:"ip"`
+	Provider string    `bson:"provider,omitempty" json:"provider,omitempty"`
+	Reason   string    `bson:"reason,omitempty" json:"reason,omitempty"`
+}
+
+const maxLoginDelay = time.Minute
+
+var (
+	loginAttempts     *mongo.Collection
+	authEvents        *mongo.Collection
+	loginDelay        = time.Second
+	loginLockout      = 15 * time.Minute
+	loginMaxFailures  = 5
+	loginMaxIPFailure = 20
+	// login_succeeded, login_failed, locked_out, login_blocked and
+	// invalid_token counts
+	authMetrics = new(expvar.Map)
+)
+
+func setupLockout() {
+	expvar.Publish("auth", authMetrics)
+	loginAttempts = db.Collection(getenv("MONGO_LOGIN_ATTEMPTS_COLLECTION", "login_attempts"))
+	authEvents = db.Collection(getenv("MONGO_AUTH_EVENTS_COLLECTION", "auth_events"))
+	if d, err := time.ParseDuration(getenv("LOGIN_DELAY", "")); err == nil && d >= 0 {
+		loginDelay = d
+	}
+	if d, err := time.ParseDuration(getenv("LOGIN_LOCKOUT", "")); err == nil && d > 0 {
+		loginLockout = d
+	}
+	if n, err := strconv.Atoi(getenv("LOGIN_MAX_FAILURES", "")); err == nil && n > 0 {
+		loginMaxFailures = n
+	}
+	if n, err := strconv.Atoi(getenv("LOGIN_MAX_IP_FAILURES", "")); err == nil && n > 0 {
+		loginMaxIPFailure = n
+	}
+	if _, err := loginAttempts.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_failure", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32((24 * time.Hour).Seconds())),
+	}); err != nil {
+		log.Printf("login attempts index create warning: %v", err)
+	}
+	ttl := 90 * 24 * time.Hour
+	if d, err := time.ParseDuration(getenv("AUTH_EVENTS_TTL", "")); err == nil && d > 0 {
+		ttl = d
+	}
+	if _, err := authEvents.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds()))},
+		{Keys: bson.D{{Key: "username", Value: 1}, {Key: "at", Value: -1}}},
+	}); err != nil {
+		log.Printf("auth events index create warning: %v", err)
+	}
+}
+
+func auditAuth(e AuthEvent) {
+	authMetrics.Add(e.Event, 1)
+	e.At = time.Now().UTC()
+	if _, err := authEvents.InsertOne(ctx, e); err != nil {
+		log.Printf("auth event write warning: %v", err)
+	}
+}
+
+func attemptKeys(username, ip string) []string {
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+strings.ToLower(username))
+	}
+	return keys
+}
+
+// loginWait is how long the caller must wait before trying again, zero when
+// an attempt may be made now
+func loginWait(username, ip string, now time.Time) (time.Duration, string, error) {
+	cur, err := loginAttempts.Find(ctx, bson.M{"_id": bson.M{"$in": attemptKeys(username, ip)}})
+	if err != nil {
+		return 0, "", err
+	}
+	var docs []LoginAttempts
+	if err := cur.All(ctx, &docs); err != nil {
+		return 0, "", err
+	}
+	var wait time.Duration
+	reason := ""
+	for _, d := range docs {
+		if d.LockedUntil != nil && d.LockedUntil.After(now) {
+			if w := d.LockedUntil.Sub(now); w > wait {
+				wait, reason = w, "locked"
+			}
+			continue
+		}
+		if d.Failures == 0 || loginDelay == 0 {
+			continue
+		}
+		delay := time.Duration(float64(loginDelay) * math.Pow(2, float64(d.Failures-1)))
+		if delay > maxLoginDelay || delay <= 0 {
+			delay = maxLoginDelay
+		}
+		if w := d.LastFailure.Add(delay).Sub(now); w > wait && reason != "locked" {
+			wait, reason = w, "delayed"
+		}
+	}
+	return wait, reason, nil
+}
+
+// recordLoginFailure counts a failure and locks keys that reach their
+// limit; it reports whether a lock was set
+func recordLoginFailure(username, ip string, now time.Time) bool {
+	locked := false
+	for _, key := range attemptKeys(username, ip) {
+		var d LoginAttempts
+		err := loginAttempts.FindOneAndUpdate(ctx, bson.M{"_id": key},
+			bson.M{"$inc": bson.M{"failures": 1}, "$set": bson.M{"last_failure": now}},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&d)
+		if err != nil {
+			log.Printf("login attempt write warning: %v", err)
+			continue
+		}
+		limit := loginMaxFailures
+		if strings.HasPrefix(key, "ip:") {
+			limit = loginMaxIPFailure
+		}
+		if d.Failures >= limit {
+			// the count restarts, so after the lockout the delays do too
+			until := now.Add(loginLockout)
+			loginAttempts.UpdateByID(ctx, key, bson.M{"$set": bson.M{"locked_until": until, "failures": 0}})
+			locked = true
+		}
+	}
+	return locked
+}
+
+func clearLoginFailures(username string) {
+	if _, err := loginAttempts.DeleteOne(ctx, bson.M{"_id": "user:" + strings.ToLower(username)}); err != nil {
+		log.Printf("login attempt clear warning: %v", err)
+	}
+}
+
+// GET /admin/auth-events?username=&event=&limit=100
+func authEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	query := r.URL.Query()
+	q := bson.M{}
+	if u := query.Get("username"); u != "" {
+		q["username"] = strings.ToLower(u)
+	}
+	if e := query.Get("event"); e != "" {
+		q["event"] = e
+	}
+	limit := int64(100)
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 || n > 1000 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and 1000"})
+			return
+		}
+		limit = n
+	}
+	cur, err := authEvents.Find(ctx, q, options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(limit))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []AuthEvent{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /admin/login-lockouts lists usernames and addresses with failures or
+// a lock
+func listLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	cur, err := loginAttempts.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "last_failure", Value: -1}}).SetLimit(1000))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LoginAttempts{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// DELETE /admin/login-lockouts/{key} lifts a lock; key is user:<name> or
+// ip:<address> as listed
+func clearLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	key := mux.Vars(r)["key"]
+	res, err := loginAttempts.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no failures recorded for "+key)
+		return
+	}
+	ev := AuthEvent{Event: "lockout_cleared", IP: clientIP(r), Reason: "cleared " + key + " by " + userID(r)}
+	if name, ok := strings.CutPrefix(key, "user:"); ok {
+		ev.Username = name
+	}
+	auditAuth(ev)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -23,10 +23,28 @@ type FeatureDoc struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty" json:"-"`
 	Name        string             `bson:"name" json:"name"`
 	Description string             `bson:"description,omitempty" json:"description,omitempty"`
+	Layer       string             `bson:"layer,omitempty" json:"layer,omitempty"`
+	ExternalID  string             `bson:"external_id,omitempty" json:"external_id,omitempty"`
 	Geometry    bson.M             `bson:"geometry" json:"geometry"` // GeoJSON object
 	Properties  bson.M             `bson:"properties,omitempty" json:"properties,omitempty"`
-	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
-	UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+	Status      string             `bson:"status,omitempty" json:"status,omitempty"`
+	Moderation  *ModerationInfo    `bson:"moderation,omitempty" json:"moderation,omitempty"`
+	Visibility  string             `bson:"visibility,omitempty" json:"visibility,omitempty"`
+	// Translations are the name and description in other languages, see
+	// i18n.go; Language is the one served
+	Translations map[string]FeatureTranslation `bson:"translations,omitempty" json:"translations,omitempty"`
+	Language     string                        `bson:"-" json:"-"`
+	CreatedBy    string                        `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	UpdatedBy    string                        `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt    time.Time                     `bson:"created_at" json:"created_at"`
+	UpdatedAt    time.Time                     `bson:"updated_at" json:"updated_at"`
+	// Maintenance is rolled up from the feature's work orders
+	Maintenance *MaintenanceRollup `bson:"maintenance,omitempty" json:"maintenance,omitempty"`
+	// Annotation is set on features of annotation layers, see annotations.go
+	Annotation *Annotation `bson:"annotation,omitempty" json:"annotation,omitempty"`
+	// Level is the floor text, Levels the floors it covers, see levels.go
+	Level  string    `bson:"level,omitempty" json:"level,omitempty"`
+	Levels []float64 `bson:"levels,omitempty" json:"-"`
 }
 
 // GeoJSONFeature for response
@@ -42,8 +60,52 @@ type GeoJSONFeatureCollection struct {
 	Features []GeoJSONFeature `json:"features"`
 }
 
+// featureToGeoJSON merges the stored fields into the GeoJSON properties
+func featureToGeoJSON(doc FeatureDoc) GeoJSONFeature {
+	props := bson.M{
+		"name":        doc.Name,
+		"description": doc.Description,
+		"id":          doc.ID.Hex(),
+	}
+	if doc.Layer != "" {
+		props["layer"] = doc.Layer
+	}
+	if doc.ExternalID != "" {
+		props["external_id"] = doc.ExternalID
+	}
+	if doc.Status != "" {
+		props["status"] = doc.Status
+	}
+	if doc.Visibility != "" {
+		props["visibility"] = doc.Visibility
+	}
+	if doc.Level != "" {
+		props["level"] = doc.Level
+	}
+	if doc.CreatedBy != "" {
+		props["created_by"] = doc.CreatedBy
+	}
+	if doc.UpdatedBy != "" {
+		props["updated_by"] = doc.UpdatedBy
+	}
+	if doc.Properties != nil {
+		for k, v := range doc.Properties {
+			props[k] = v
+		}
+	}
+	translationProperties(doc, props)
+	maintenanceProperties(doc, props)
+	annotationProperties(doc, props)
+	return GeoJSONFeature{
+		Type:       "Feature",
+		Geometry:   doc.Geometry,
+		Properties: props,
+	}
+}
+
 var (
 	client     *mongo.Client
+	db         *mongo.Database
 	collection *mongo.Collection
 	ctx        context.Context
 )
@@ -58,10 +120,25 @@ func getenv(key, def string) string {
 func main() {
 	ctx = context.Background()
 
-	mongoURI := getenv("MONGO_URI", "mongodb://localhost:27017")
+	mongoURI := getsecret("MONGO_URI", "mongodb://localhost:27017")
+	// collections are held all over, so a new URI needs a restart
+	watchSecret("MONGO_URI", func(string) {
+		log.Printf("MONGO_URI changed, restart to connect with it")
+	})
 	dbName := getenv("MONGO_DB", "gisdb")
 	collName := getenv("MONGO_COLLECTION", "features")
 	port := getenv("PORT", "3000")
+	if v, err := strconv.ParseFloat(getenv("MAX_RADIUS_METERS", ""), 64); err == nil && v > 0 {
+		maxRadiusMeters = v
+	}
+	if v, err := strconv.ParseInt(getenv("MAX_FEATURES", ""), 10, 64); err == nil && v > 0 {
+		maxFeatures = v
+	}
+	guardMode = getenv("GUARD_MODE", guardMode)
+	loadAuthTokens()
+	setupAuthProviders()
+	enforceOwnership = getenv("ENFORCE_OWNERSHIP", "") == "true"
+	strictJSON = getenv("STRICT_JSON", "") == "true"
 
 	// connect to Mongo
 	var err error
@@ -73,7 +150,9 @@ func main() {
 	if err = client.Ping(ctx, nil); err != nil {
 		log.Fatalf("mongo ping error: %v", err)
 	}
-	collection = client.Database(dbName).Collection(collName)
+	db = client.Database(dbName)
+	collection = db.Collection(collName)
+	setupConcerns()
 	log.Println("Connected to Mongo:", mongoURI, "DB:", dbName, "Collection:", collName)
 
 	// create 2dsphere index on geometry
@@ -86,28 +165,325 @@ func main() {
 	} else {
 		log.Println("Created/ensured 2dsphere index on geometry")
 	}
+	if _, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}}}); err != nil {
+		log.Printf("layer index create warning: %v", err)
+	}
+
+	setupSortIndexes(getenv("SORTABLE_PROPERTIES", ""))
+	setupBoundaries()
+	setupNotifiers()
+	setupConfirmSecret()
+	setupMigrations()
+	setupIdempotency()
+	setupLayers()
+	setupRelations()
+	setupProjects()
+	setupOrgs()
+	setupInvitations()
+	setupSettings()
+	setupBasemaps()
+	setupI18n()
+	setupSuggest()
+	setupFavorites()
+	setupPermalinks()
+	setupWorkOrders()
+	setupInspections()
+	setupReports()
+	setupReportGateways()
+	setupSituationReports()
+	setupExternalIDs()
+	setupLevels()
+	setupCoordGuard()
+	setupBBoxCache()
+	setupVectorTiles()
+	setupLayerStats()
+	setupArcGIS()
+	setupCoalescing()
+	setupSearch()
+	setupSymbols()
+	setupReadReplicas()
+	setupSnapshots()
+	setupNetworks()
+	setupGeocoding()
+	setupProxies()
+	setupUsers()
+	setupSessionCookies()
+	setupLockout()
+	setupFieldEncryption()
+	setupQuotas()
+	setupAccessStats()
+	setupJobs()
+	setupDeadLetters()
+	setupUploads()
+	setupOverpass()
+	setupPublishing()
+	setupReleases()
+	setupOutliers()
+	setupNameRules()
+	setupWorkerPool()
+
+	// `server ctl <command>` (or gisctl) runs an ops task and exits, see
+	// gisctl.go
+	if args, ok := ctlArgs(); ok {
+		runCtlCommand(args)
+		return
+	}
 
 	// router setup
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	r.Use(proxyMiddleware)
+	r.Use(requestIDMiddleware)
 	r.Use(corsMiddleware)
+	r.Use(authMiddleware)
+	r.Use(quotaMiddleware)
+	r.Use(writeTrackerMiddleware)
 
-	r.HandleFunc("/features", listFeaturesHandler).Methods("GET", "OPTIONS")
-	r.HandleFunc("/features", createFeatureHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/features", accessCounted("", bboxCached(coalesced(listFeaturesHandler)))).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features", idempotent(createFeatureHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/features/suggest", suggestHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features/{id}", getFeatureHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/features/{id}", updateFeatureHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/features/{id}", patchFeatureHandler).Methods("PATCH", "OPTIONS")
 	r.HandleFunc("/features/{id}", deleteFeatureHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/features/by-external-id/{key}", upsertByExternalIDHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/features/{id}/translations", getTranslationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features/{id}/translations/{lang}", putTranslationHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/features/{id}/translations/{lang}", deleteTranslationHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/features/{id}/work-orders", featureWorkOrdersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features/{id}/inspections", featureInspectionsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features/{id}/qr", featureQRHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/features/{id}/favorite", putFavoriteHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/features/{id}/favorite", deleteFavoriteHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/features/{id}/views", recordViewHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/features/{id}/relations", featureRelationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/relations", createRelationHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/relations/{id}", deleteRelationHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/arcgis/rest/info", arcgisInfoHandler).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/arcgis/rest/services/{service}/FeatureServer", arcgisServiceHandler).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/arcgis/rest/services/{service}/FeatureServer/{layer:[0-9]+}", arcgisLayerHandler).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/arcgis/rest/services/{service}/FeatureServer/{layer:[0-9]+}/query", arcgisQueryHandler).Methods("GET", "POST", "OPTIONS")
+	r.HandleFunc("/networks", listNetworksHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/networks", buildNetworkHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/networks/{id}", deleteNetworkHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/networks/{id}/route", routeHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/networks/{id}/trace", traceHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/networks/{id}/service-area", serviceAreaHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/search", searchHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/geocode", geocodeHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/export/zip", accessCounted("zip", exportZipHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/export/xlsx", accessCounted("xlsx", exportXLSXHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/export/parts", exportPartsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/export/parts/{part}", accessCounted("parts", exportPartHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/import/geojson", idempotent(importGeoJSONHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/import/osm", importOSMHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/import/overpass", importOverpassHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/uploads", createUploadHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", headUploadHandler).Methods("HEAD")
+	r.HandleFunc("/uploads/{id}", getUploadHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", patchUploadHandler).Methods("PATCH", "OPTIONS")
+	r.HandleFunc("/uploads/{id}", deleteUploadHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/uploads/{id}/import", retryUploadImportHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers", listLayersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers", createLayerHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}", getLayerHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/clone", cloneLayerHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}/classify", classifyHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/snapshots", layerSnapshotsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/legend", layerLegendHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/leaders", annotationLeadersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tiles/{layer}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.mvt", accessCounted("tiles", vectorTileHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/tiles/{layer}.json", tileJSONHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/stats", layerStatsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/quality", layerQualityHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/outliers", listOutliersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/outliers/{id}/review", reviewOutlierHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}/names/duplicates", nameDuplicatesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/names/normalize", normalizeNamesHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/names/rules", getNameRulesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/names/rules/{id}", putNameRulesHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/stats/layers", listLayerStatsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/stats/series", seriesStatsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/stats/usage", accessStatsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/extent", putLayerExtentHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/extent", deleteLayerExtentHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/geometry-type", putLayerGeometryTypeHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/geometry-type", deleteLayerGeometryTypeHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/multi", putLayerMultiHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/multi", deleteLayerMultiHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/extrusion", putLayerExtrusionHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/extrusion", deleteLayerExtrusionHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/sensitive", putLayerSensitivityHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/license", putLayerLicenseHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/license", deleteLayerLicenseHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/shares", listLayerSharesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/shares/{org}/{team}", putLayerShareHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/layers/{id}/shares/{org}/{team}", deleteLayerShareHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/publication", getPublicationHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/publication", deletePublicationHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/draft", draftLayerHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}/publish", publishLayerHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}/published", accessCounted("published", publishedLayerHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/versions", listLayerVersionsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/versions/{version}", accessCounted("published", publishedLayerHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/releases", listReleasesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/releases", createReleaseHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/layers/{id}/releases/{version}", getReleaseHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layers/{id}/releases/{version}/features", accessCounted("release", releaseFeaturesHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/symbols", listSymbolsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/symbols/{id}", getSymbolHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/symbols/{id}", putSymbolHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/symbols/{id}", deleteSymbolHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layer-templates", listLayerTemplatesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/layer-templates", createLayerTemplateHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/projects", listProjectsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/projects", createProjectHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/projects/{id}", getProjectHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/projects/{id}", updateProjectHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/projects/{id}/members/{user}", putProjectMemberHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/projects/{id}/members/{user}", deleteProjectMemberHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/projects/{id}/teams/{org}/{team}", putProjectTeamHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/projects/{id}/teams/{org}/{team}", deleteProjectTeamHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/orgs", listOrgsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/orgs", createOrgHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/orgs/{id}", getOrgHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/orgs/{id}", updateOrgHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/orgs/{id}", deleteOrgHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/members/{user}", putOrgMemberHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/members/{user}", deleteOrgMemberHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/teams", createTeamHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/teams/{team}", deleteTeamHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/teams/{team}/members/{user}", putTeamMemberHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/orgs/{id}/teams/{team}/members/{user}", deleteTeamMemberHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/layers/{id}/features", deleteLayerFeaturesHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/submissions", idempotent(submitFeatureHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/reports", createReportHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/reports/token", reportTokenHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/{id}/photo", reportPhotoHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/{id}/contact", reportContactHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/inbound/whatsapp", whatsappVerifyHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/reports/inbound/{gateway}", gatewayInboundHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/situation-reports", listSituationReportsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/situation-reports", createSituationReportHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}", getSituationReportHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}", updateSituationReportHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}", deleteSituationReportHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}/preview", previewSituationReportHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}/run", runSituationReportHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}/files", listSituationFilesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/situation-reports/{id}/files/{fid}", getSituationFileHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/moderation/queue", moderationQueueHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/moderation/{id}", moderateFeatureHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/analysis/hull", hullHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/analysis/voronoi", voronoiHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/analysis/idw", idwHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/analysis/map-match", mapMatchHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/geometry/densify", densifyHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/geometry/resample", resampleHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/geodesy/bearing", bearingHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/geodesy/destination", destinationHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/geodesy/midpoint", midpointHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/geodesy/great-circle", greatCircleHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/boundaries", listBoundariesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/boundaries", createBoundaryHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/boundaries/resolve", resolveBoundaryHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/boundaries/{code}", getBoundaryHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/boundaries/{code}/children", boundaryChildrenHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/migrations", listMigrationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/migrations/run", runMigrationsHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/indexes/analyze", analyzeIndexesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/snapshots/run", runSnapshotsHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/metrics", metricsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/auth-events", authEventsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/login-lockouts", listLockoutsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/login-lockouts/{key}", clearLockoutHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/admin/usage", listUsageHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/quotas", listQuotasHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/quotas/{tenant}", putQuotaHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/admin/quotas/{tenant}", deleteQuotaHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/admin/jobs", listJobsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/jobs/{name}", putJobHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/admin/jobs/{name}", deleteJobHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/admin/jobs/{name}/run", runJobHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/jobs/{name}/runs", jobRunsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/dead-letters", listDeadLettersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/dead-letters/{id}", getDeadLetterHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/dead-letters/{id}/retry", retryDeadLetterHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/dead-letters/{id}/cancel", cancelDeadLetterHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/subjects/{user}", locateSubjectHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/subjects/{user}", purgeSubjectHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/admin/subjects/{user}/export", exportSubjectHandler).Methods("GET", "OPTIONS")
+	if getenv("DEV_MODE", "") == "true" {
+		r.HandleFunc("/admin/seed", seedHandler).Methods("POST", "OPTIONS")
+	}
+	r.HandleFunc("/auth/login", loginHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/logout", logoutHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/me", meHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/usage", myUsageHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/auth/password-reset", passwordResetHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/work-orders", listWorkOrdersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/work-orders", createWorkOrderHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}", getWorkOrderHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}", updateWorkOrderHandler).Methods("PATCH", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}", deleteWorkOrderHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}/notes", addWorkOrderNoteHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}/attachments", addWorkOrderAttachmentHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}/attachments/{aid}", getWorkOrderAttachmentHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/work-orders/{id}/attachments/{aid}", deleteWorkOrderAttachmentHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/inspection-forms", listInspectionFormsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/inspection-forms", createInspectionFormHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}", getInspectionFormHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}", updateInspectionFormHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}", deleteInspectionFormHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}/submissions", listSubmissionsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}/submissions", createSubmissionHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}/submissions/{sid}", getSubmissionHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/inspection-forms/{id}/submissions/{sid}", deleteSubmissionHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/users/me", getProfileHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users/me", updateProfileHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/users/me/password", changePasswordHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/users/me/favorites", listFavoritesHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users/me/recent", listRecentViewsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users/me/recent", clearRecentViewsHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/users", listUsersHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users", createUserHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/users/{id}", getUserHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/users/{id}", updateUserHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/users/{id}", deleteUserHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/users/{id}/reset-token", resetTokenHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/basemaps", listBasemapsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/basemaps/{provider}/{z}/{x}/{y}", basemapTileHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/settings", getSettingsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/settings", putSettingsHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/settings", deleteSettingsHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/invitations", listInvitationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/invitations", createInvitationHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/invitations/{id}", revokeInvitationHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/invitations/{id}/resend", resendInvitationHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/invitations/accept", acceptInvitationHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/auth/invitations/{token}", getInvitationHandler).Methods("GET", "OPTIONS")
 	r.HandleFunc("/healthz", healthHandler).Methods("GET")
 
-	log.Printf("Server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	handler := setupFrontend(r, &r.NotFoundHandler)
+
+	serve(handler, port)
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// during dev you can allow all origins; restrict in production if needed
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, Idempotency-Key, X-Response-Envelope, X-CSRF-Token, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-Result-Truncated, X-BBox-Bucket, X-Cache, X-Search-Strategy, X-Permalink, Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+		tusHeaders(w, r)
 		if r.Method == "OPTIONS" {
+			// tus clients expect 204 from discovery
+			if w.Header().Get("Tus-Version") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -147,13 +523,85 @@ func parseBBox(q string) (minLon, minLat, maxLon, maxLat float64, ok bool) {
 	return
 }
 
-// List features, supports bbox and near queries
+// radius units, as meters per unit
+var distanceUnits = map[string]float64{
+	"m":  1,
+	"km": 1000,
+	"mi": 1609.344,
+	"ft": 0.3048,
+}
+
+// maximum accepted radius for near queries, in meters
+var maxRadiusMeters = 100000.0
+
+// parse a distance like 500, 500m, 2km or 1mi into meters. A bare number is
+// meters.
+func parseDistance(s string) (float64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	num, unit := s, "m"
+	for i, c := range s {
+		if (c < '0' || c > '9') && c != '.' {
+			num, unit = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i:])
+			break
+		}
+	}
+	factor, ok := distanceUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q (use m, km, mi or ft)", unit)
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", num)
+	}
+	return v * factor, nil
+}
+
+// parseRadius is parseDistance limited to maxRadiusMeters
+func parseRadius(s string) (float64, error) {
+	meters, err := parseDistance(s)
+	if err != nil {
+		return 0, err
+	}
+	if meters <= 0 || meters > maxRadiusMeters {
+		return 0, fmt.Errorf("must be greater than 0 and at most %gm", maxRadiusMeters)
+	}
+	return meters, nil
+}
+
+// List features, supports bbox, near, admin area and level queries and ?format=csv export
 func listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
 	q := bson.M{}
 	query := r.URL.Query()
+
+	// ?clip=bbox returns features crossing the bbox with their geometry cut
+	// to it, instead of only the features entirely inside
+	var clipBox *BBox
+	if clip := query.Get("clip"); clip != "" {
+		if clip != "bbox" || query.Get("bbox") == "" {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "clip=bbox requires a bbox", FieldError{Field: "clip", Message: "only clip=bbox together with bbox is supported"})
+			return
+		}
+	}
+
 	if bbox := query.Get("bbox"); bbox != "" {
 		minLon, minLat, maxLon, maxLat, ok := parseBBox(bbox)
-		if ok {
+		if ok && query.Get("clip") == "bbox" {
+			clipBox = &BBox{minLon, minLat, maxLon, maxLat}
+			q["geometry"] = bson.M{
+				"$geoIntersects": bson.M{
+					"$geometry": bson.M{
+						"type": "Polygon",
+						"coordinates": bson.A{bson.A{
+							bson.A{minLon, minLat},
+							bson.A{maxLon, minLat},
+							bson.A{maxLon, maxLat},
+							bson.A{minLon, maxLat},
+							bson.A{minLon, minLat},
+						}},
+					},
+				},
+			}
+		} else if ok {
 			// Mongo $geoWithin with $box expects [[minLon,minLat],[maxLon,maxLat]]
 			q["geometry"] = bson.M{
 				"$geoWithin": bson.M{
@@ -165,17 +613,20 @@ func listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	} else if near := query.Get("near"); near != "" {
-		// format near=lat,lon  and radius in meters ?radius=500
+		// format near=lat,lon  and radius ?radius=500 (meters) or ?radius=2km
 		parts := strings.Split(near, ",")
 		if len(parts) == 2 {
 			lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
 			lon, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 			if err1 == nil && err2 == nil {
-				maxDist := int64(5000)
-				if r.URL.Query().Get("radius") != "" {
-					if d, err := strconv.Atoi(r.URL.Query().Get("radius")); err == nil {
-						maxDist = int64(d)
+				maxDist := 5000.0
+				if radius := query.Get("radius"); radius != "" {
+					d, err := parseRadius(radius)
+					if err != nil {
+						writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid radius", FieldError{Field: "radius", Message: err.Error()})
+						return
 					}
+					maxDist = d
 				}
 				q["geometry"] = bson.M{
 					"$near": bson.M{
@@ -190,150 +641,435 @@ func listFeaturesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
+	if !applyStatusFilter(w, r, q) {
+		return
+	}
+	if layer := query.Get("layer"); layer != "" {
+		q["layer"] = layer
+	}
+	if !applyProjectFilter(w, r, q) {
+		return
+	}
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+
+	// ?mine=true limits results to features created by the caller
+	if mine, _ := strconv.ParseBool(query.Get("mine")); mine {
+		u := currentUser(r)
+		if u == nil {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required for mine=true")
+			return
+		}
+		q["created_by"] = u.ID
+	}
+
+	// ?admin=<boundary code> limits results to an administrative area
+	if code := query.Get("admin"); code != "" {
+		area, err := adminAreaFilter(code)
+		if err != nil {
+			writeAdminAreaError(w, code, err)
+			return
+		}
+		q["$and"] = bson.A{area}
+	}
+
+	// ?filter= takes a CQL2 expression (OGC API - Features Part 3)
+	if f := query.Get("filter"); f != "" {
+		if crs := query.Get("filter-crs"); crs != "" && !strings.HasSuffix(crs, "/CRS84") && !strings.HasSuffix(crs, "/4326") {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "unsupported filter-crs", FieldError{Field: "filter-crs", Message: "only CRS84 is supported"})
+			return
+		}
+		cq, err := parseCQL2(f, query.Get("filter-lang"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid filter: "+err.Error(), FieldError{Field: "filter", Message: err.Error()})
+			return
+		}
+		and, _ := asArray(q["$and"])
+		q["$and"] = append(append(bson.A{}, and...), cq)
+	}
+
+	// ?visibility=public|internal|private
+	switch v := query.Get("visibility"); v {
+	case "":
+	case visibilityPublic:
+		q["visibility"] = bson.M{"$nin": notPublic}
+	case visibilityInternal, visibilityPrivate:
+		q["visibility"] = v
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid visibility", validateVisibility(&v)...)
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if !applyLevelFilter(w, r, q) {
+		return
+	}
+
+	ctx2, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
-	cur, err := collection.Find(ctx2, q)
+	findOpts := options.Find()
+	var sortDoc bson.D
+	if sortSpec := query.Get("sort"); sortSpec != "" {
+		var err error
+		sortDoc, err = parseSort(sortSpec)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid sort", FieldError{Field: "sort", Message: err.Error()})
+			return
+		}
+		findOpts.SetSort(sortDoc)
+	}
+	// CSV is streamed row by row, so only the GeoJSON dump is held to
+	// maxFeatures
+	if query.Get("format") == "csv" {
+		if !applyPagination(w, r, findOpts) {
+			return
+		}
+	} else if !applyGuardrails(ctx2, w, r, q, findOpts) {
+		return
+	}
+	recordQueryShape(q, sortDoc)
+	// exports may go to a secondary, see HEAVY_READ_PREFERENCE
+	coll := collection
+	if query.Get("format") == "csv" {
+		coll = readsFor(r)
+	}
+	// the CSV streams for as long as the client reads it, without the
+	// listing's timeout
+	findCtx := ctx2
+	if query.Get("format") == "csv" {
+		findCtx = r.Context()
+	}
+	cur, err := coll.Find(findCtx, q, findOpts)
 	if err != nil {
-		http.Error(w, "db find error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(findCtx)
+
+	if query.Get("format") == "csv" {
+		writeFeaturesCSV(w, r, findCtx, coll, q, cur, query.Get("geometry"))
 		return
 	}
-	defer cur.Close(ctx2)
 
 	fc := GeoJSONFeatureCollection{Type: "FeatureCollection"}
 
+	var warnings []string
+	skipped := 0
+	var docs []FeatureDoc
 	for cur.Next(ctx2) {
 		var doc FeatureDoc
 		if err := cur.Decode(&doc); err != nil {
 			log.Println("decode warn:", err)
+			skipped++
 			continue
 		}
-		props := bson.M{
-			"name":        doc.Name,
-			"description": doc.Description,
-			"id":          doc.ID.Hex(),
-		}
-		if doc.Properties != nil {
-			for k, v := range doc.Properties {
-				props[k] = v
+		docs = append(docs, doc)
+	}
+	if clipBox != nil {
+		box := *clipBox
+		var clippedDocs []FeatureDoc
+		ok := runGeometry(w, r, func() {
+			for _, doc := range docs {
+				g, err := parseGeometry(doc.Geometry)
+				if err != nil {
+					continue
+				}
+				clipped, ok := clipGeometry(g, box)
+				if !ok {
+					continue
+				}
+				doc.Geometry = clipped.BSON()
+				clippedDocs = append(clippedDocs, doc)
 			}
+		})
+		if !ok {
+			return
 		}
-		feature := GeoJSONFeature{
-			Type:       "Feature",
-			Geometry:   doc.Geometry,
-			Properties: props,
+		docs = clippedDocs
+	}
+	for _, doc := range docs {
+		revealDoc(r, &doc)
+		countServed(r, doc.Layer, 1, doc.ID.Hex())
+		fc.Features = append(fc.Features, featureToGeoJSON(doc))
+	}
+	if skipped > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d features could not be decoded and were skipped", skipped))
+	}
+	// ?include=relations lists each feature's links to other features
+	if query.Get("include") == "relations" {
+		if err := attachRelations(r, &fc, q["status"]); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
 		}
-		fc.Features = append(fc.Features, feature)
 	}
+	var limit, offset int64
+	if findOpts.Limit != nil {
+		limit = *findOpts.Limit
+	}
+	if findOpts.Skip != nil {
+		offset = *findOpts.Skip
+	}
+	writeCollection(w, r, fc, limit, offset, warnings...)
+}
+
+// StoredFeature is what create and update return: the feature as stored,
+// with its id and timestamps next to the GeoJSON. The top-level id keeps
+// clients that read {id} working.
+type StoredFeature struct {
+	ID string `json:"id"`
+	GeoJSONFeature
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Warnings  []string  `json:"warnings,omitempty"`
+	// Parts are the ids of all features a create was split into, this one
+	// first, see layermulti.go
+	Parts []string `json:"parts,omitempty"`
+}
+
+func storedFeature(r *http.Request, doc FeatureDoc, warnings ...string) StoredFeature {
+	revealDoc(r, &doc)
+	return StoredFeature{
+		ID:             doc.ID.Hex(),
+		GeoJSONFeature: featureToGeoJSON(doc),
+		CreatedAt:      doc.CreatedAt,
+		UpdatedAt:      doc.UpdatedAt,
+		Warnings:       warnings,
+	}
+}
+
+func writeStoredFeature(w http.ResponseWriter, r *http.Request, doc FeatureDoc, warnings ...string) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(fc)
+	json.NewEncoder(w).Encode(storedFeature(r, doc, warnings...))
 }
 
 // Create feature (accept lat+lon or geojson geometry)
+// Team editors of the feature's layer may create it too, see orgs.go
 func createFeatureHandler(w http.ResponseWriter, r *http.Request) {
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	name, _ := body["name"].(string)
-	desc, _ := body["description"].(string)
-	now := time.Now().UTC()
+	insertFeature(w, r, statusApproved)
+}
 
-	var geometry interface{}
+// insertFeature decodes a feature from the request body and stores it with
+// the given moderation status. It returns the new id, or "" after writing an
+// error response.
+func insertFeature(w http.ResponseWriter, r *http.Request, status string) string {
+	var in FeatureInput
+	if !decodeJSON(w, r, &in) {
+		return ""
+	}
 
 	// accept { geojson: { type:..., coordinates:... } } OR lat+lon
-	if g, ok := body["geojson"]; ok {
-		geometry = g
-	} else if latv, okLat := body["lat"]; okLat {
-		if lonv, okLon := body["lon"]; okLon {
-			lat, _ := toFloat(latv)
-			lon, _ := toFloat(lonv)
-			geometry = bson.M{
-				"type":        "Point",
-				"coordinates": bson.A{lon, lat},
-			}
-		}
+	geometry, ok, errs := in.geometry(r)
+	if !ok {
+		errs = append(errs, FieldError{Field: "geojson", Message: "required unless lat and lon are given"})
 	}
-
-	if geometry == nil {
-		http.Error(w, "geometry (geojson) or lat+lon required", http.StatusBadRequest)
-		return
+	errs = append(errs, validateProperties(in.Properties)...)
+	errs = append(errs, validateVisibility(in.Visibility)...)
+	errs = append(errs, in.validateLevel()...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", errs...)
+		return ""
+	}
+	if status == statusApproved && !requireLayerRole(w, r, deref(in.Layer), "editor") {
+		return ""
+	}
+	// the layer may split a Multi geometry into features of their own
+	in.splits = true
+	if err := featureExtentCheck(&in, nil); err != nil {
+		writeExtentError(w, err)
+		return ""
+	}
+	geometry = in.parsed.BSON()
+	if aerrs, err := featureAnnotationCheck(&in, nil, false); !writeAnnotationCheck(w, aerrs, err) {
+		return ""
+	}
+	if herrs, err := checkLayerHeights(deref(in.Layer), in.Properties); !writeHeightCheck(w, herrs, err) {
+		return ""
 	}
 
+	now := time.Now().UTC()
 	doc := bson.M{
-		"name":        name,
-		"description": desc,
+		"name":        deref(in.Name),
+		"description": deref(in.Description),
 		"geometry":    geometry,
+		"status":      status,
 		"created_at":  now,
 		"updated_at":  now,
 	}
+	if layer := deref(in.Layer); layer != "" {
+		doc["layer"] = layer
+	}
+	if v := deref(in.Visibility); v != "" {
+		doc["visibility"] = v
+	}
+	if in.annotation != nil {
+		doc["annotation"] = in.annotation
+	}
+	if in.level != "" {
+		doc["level"] = in.level
+		doc["levels"] = in.levels
+	}
+	if len(in.Properties) > 0 {
+		if err := sealProperties(deref(in.Layer), in.Properties); err != nil {
+			writeSealError(w, err)
+			return ""
+		}
+		doc["properties"] = in.Properties
+	}
+	if uid := userID(r); uid != "" {
+		doc["created_by"] = uid
+		doc["updated_by"] = uid
+	}
 
+	if len(in.parts) > 1 {
+		return insertFeatureParts(w, r, doc, in)
+	}
 	res, err := collection.InsertOne(ctx, doc)
 	if err != nil {
-		http.Error(w, "db insert error: "+err.Error(), http.StatusInternalServerError)
-		return
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return ""
 	}
 
-	id := res.InsertedID.(primitive.ObjectID).Hex()
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(bson.M{"id": id})
+	doc["_id"] = res.InsertedID
+	var stored FeatureDoc
+	if raw, err := bson.Marshal(doc); err == nil {
+		bson.Unmarshal(raw, &stored)
+	}
+	writeStoredFeature(w, r, stored, in.warnings...)
+	return stored.ID.Hex()
 }
 
+// PUT /features/{id} sets the fields that are sent; properties, when given,
+// replace the whole object
 func updateFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	writeFeatureUpdate(w, r, false)
+}
+
+// PATCH /features/{id} takes a JSON merge patch: null clears description,
+// layer or properties, and properties are merged with null removing a key
+func patchFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	writeFeatureUpdate(w, r, true)
+}
+
+func writeFeatureUpdate(w http.ResponseWriter, r *http.Request, patch bool) {
 	vars := mux.Vars(r)
 	idHex := vars["id"]
 
 	oid, err := primitive.ObjectIDFromHex(idHex)
 	if err != nil {
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
 		return
 	}
 
-	var body map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "invalid json", http.StatusBadRequest)
+	if !requireFeatureRole(w, r, oid, "editor") || !checkOwnership(w, r, oid) {
 		return
 	}
 
-	update := bson.M{}
-
-	if name, ok := body["name"].(string); ok {
-		update["name"] = name
+	var in FeatureInput
+	var clear []string
+	if patch {
+		var ok bool
+		if clear, ok = decodePatch(w, r, &in); !ok {
+			return
+		}
+	} else if !decodeJSON(w, r, &in) {
+		return
+	}
+	geometry, hasGeometry, errs := in.geometry(r)
+	errs = append(errs, validateProperties(in.Properties)...)
+	errs = append(errs, validateVisibility(in.Visibility)...)
+	errs = append(errs, in.validateLevel()...)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", errs...)
+		return
+	}
+	// moving a feature takes editing rights on the layer it moves to
+	if in.Layer != nil && !requireLayerRole(w, r, *in.Layer, "editor") {
+		return
 	}
-	if desc, ok := body["description"].(string); ok {
-		update["description"] = desc
+	// the layer decides which properties are sensitive
+	layer := deref(in.Layer)
+	clearsAnnotation := false
+	for _, f := range clear {
+		clearsAnnotation = clearsAnnotation || f == "annotation"
+	}
+	if hasGeometry || in.Layer != nil || len(in.Properties) > 0 || in.Annotation != nil || clearsAnnotation {
+		var existing FeatureDoc
+		err := collection.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"layer": 1, "geometry": 1, "annotation": 1})).Decode(&existing)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusNotFound, "not_found", "feature not found")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		if err := featureExtentCheck(&in, &existing); err != nil {
+			writeExtentError(w, err)
+			return
+		}
+		if in.parsed != nil {
+			geometry, hasGeometry = in.parsed.BSON(), true
+		}
+		if aerrs, err := featureAnnotationCheck(&in, &existing, clearsAnnotation); !writeAnnotationCheck(w, aerrs, err) {
+			return
+		}
+		if in.Layer == nil {
+			layer = existing.Layer
+		}
+	}
+	if herrs, err := checkLayerHeights(layer, in.Properties); !writeHeightCheck(w, herrs, err) {
+		return
+	}
+	if err := sealProperties(layer, in.Properties); err != nil {
+		writeSealError(w, err)
+		return
 	}
 
-	if g, ok := body["geojson"]; ok {
-		update["geometry"] = g
-	} else if latv, okLat := body["lat"]; okLat {
-		if lonv, okLon := body["lon"]; okLon {
-			lat, _ := toFloat(latv)
-			lon, _ := toFloat(lonv)
-			update["geometry"] = bson.M{
-				"type":        "Point",
-				"coordinates": bson.A{lon, lat},
+	update := in.setFields(geometry, hasGeometry)
+	unset := bson.M{}
+	if patch {
+		for k, v := range in.Properties {
+			if v == nil {
+				unset["properties."+k] = ""
+			} else {
+				update["properties."+k] = v
 			}
 		}
+		for _, f := range clear {
+			unset[f] = ""
+			if f == "level" {
+				unset["levels"] = ""
+			}
+		}
+	} else if in.Properties != nil {
+		update["properties"] = in.Properties
 	}
 
-	if len(update) == 0 {
-		http.Error(w, "nothing to update", http.StatusBadRequest)
+	if len(update) == 0 && len(unset) == 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "nothing to update")
 		return
 	}
 
 	update["updated_at"] = time.Now().UTC()
+	if uid := userID(r); uid != "" {
+		update["updated_by"] = uid
+	}
+	change := bson.M{"$set": update}
+	if len(unset) > 0 {
+		change["$unset"] = unset
+	}
 
-	_, err = collection.UpdateByID(ctx, oid, bson.M{"$set": update})
-	if err != nil {
-		http.Error(w, "db update error: "+err.Error(), http.StatusInternalServerError)
+	var stored FeatureDoc
+	err = collection.FindOneAndUpdate(ctx, bson.M{"_id": oid}, change,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&stored)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(bson.M{"ok": true})
+	writeStoredFeature(w, r, stored, in.warnings...)
 }
 
 func deleteFeatureHandler(w http.ResponseWriter, r *http.Request) {
@@ -342,19 +1078,76 @@ func deleteFeatureHandler(w http.ResponseWriter, r *http.Request) {
 
 	oid, err := primitive.ObjectIDFromHex(idHex)
 	if err != nil {
-		http.Error(w, "invalid id", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	if !requireFeatureRole(w, r, oid, "editor") || !checkOwnership(w, r, oid) {
 		return
 	}
 
 	_, err = collection.DeleteOne(ctx, bson.M{"_id": oid})
 	if err != nil {
-		http.Error(w, "db delete error: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
 		return
 	}
+	if err := deleteFeatureDependents([]primitive.ObjectID{oid}); err != nil {
+		log.Printf("relation cleanup warning for %s: %v", idHex, err)
+	}
 
 	json.NewEncoder(w).Encode(bson.M{"ok": true})
 }
 
+// featureIDs lists the ids of the features matching q
+func featureIDs(ctx context.Context, q bson.M) ([]primitive.ObjectID, error) {
+	ids, err := collection.Distinct(ctx, "_id", q)
+	if err != nil {
+		return nil, err
+	}
+	oids := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if oid, ok := id.(primitive.ObjectID); ok {
+			oids = append(oids, oid)
+		}
+	}
+	return oids, nil
+}
+
+// deleteFeatureDependents removes what points at deleted features: their
+// relations and report photos go, their open work orders are cancelled
+func deleteFeatureDependents(oids []primitive.ObjectID) error {
+	if len(oids) == 0 {
+		return nil
+	}
+	cancelWorkOrdersOf(oids...)
+	if _, err := reportPhotos.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": oids}}); err != nil {
+		return err
+	}
+	_, err := relations.DeleteMany(ctx, relationFilter(oids, "both", ""))
+	return err
+}
+
+// checkOwnership loads the feature's creator and rejects the request when the
+// caller isn't allowed to modify it
+func checkOwnership(w http.ResponseWriter, r *http.Request, oid primitive.ObjectID) bool {
+	if !authEnabled || !enforceOwnership {
+		return true
+	}
+	var doc FeatureDoc
+	err := collection.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"created_by": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return false
+	}
+	if !canModify(r, doc.CreatedBy) {
+		writeError(w, http.StatusForbidden, "not_owner", "you can only modify your own features")
+		return false
+	}
+	return true
+}
+
 func toFloat(v interface{}) (float64, error) {
 	switch t := v.(type) {
 	case float64:
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Map matching snaps a noisy GPS trace onto a network with a hidden Markov
+// model (Newson & Krumm): the hidden states are positions on nearby edges,
+// emissions score the GPS error of each candidate and transitions prefer
+// moves whose network distance is close to the straight-line distance
+// between fixes. The most likely sequence is decoded with Viterbi and each
+// fix's confidence is the posterior probability of its matched candidate.
+const (
+	maxMatchPoints     = 5000
+	maxMatchCandidates = 8
+)
+
+// matchCandidate is a position on an edge near a GPS fix
+type matchCandidate struct {
+	edge   int
+	offset float64 // meters from the edge's From node
+	pos    Position
+	dist   float64 // meters from the fix
+}
+
+// matchStep is a fix with candidates; trans[i][j] is the log probability of
+// moving from candidate i of the previous step to candidate j, nil where the
+// trace breaks and a new segment starts
+type matchStep struct {
+	point int
+	cands []matchCandidate
+	trans [][]float64
+}
+
+func (g *roadGraph) buildEdgeGrid() {
+	g.edgeGrid = map[[2]int][]int{}
+	for i, pts := range g.points {
+		cells := map[[2]int]bool{}
+		for j := 1; j < len(pts); j++ {
+			a, b := pts[j-1], pts[j]
+			for x := int(math.Floor(math.Min(a[0], b[0]) / graphCell)); x <= int(math.Floor(math.Max(a[0], b[0])/graphCell)); x++ {
+				for y := int(math.Floor(math.Min(a[1], b[1]) / graphCell)); y <= int(math.Floor(math.Max(a[1], b[1])/graphCell)); y++ {
+					cells[[2]int{x, y}] = true
+				}
+			}
+		}
+		for k := range cells {
+			g.edgeGrid[k] = append(g.edgeGrid[k], i)
+		}
+	}
+}
+
+// candidates are the closest positions on each edge within radius meters of
+// p, nearest first
+func (g *roadGraph) candidates(p Position, radius float64) []matchCandidate {
+	g.edgeGridOnce.Do(g.buildEdgeGrid)
+	dLat := radius / degToMeters
+	dLon := dLat / math.Max(math.Cos(toRad(p[1])), 0.01)
+	seen := map[int]bool{}
+	var out []matchCandidate
+	for x := int(math.Floor((p[0] - dLon) / graphCell)); x <= int(math.Floor((p[0]+dLon)/graphCell)); x++ {
+		for y := int(math.Floor((p[1] - dLat) / graphCell)); y <= int(math.Floor((p[1]+dLat)/graphCell)); y++ {
+			for _, i := range g.edgeGrid[[2]int{x, y}] {
+				if seen[i] {
+					continue
+				}
+				seen[i] = true
+				if c, ok := g.project(i, p); ok && c.dist <= radius {
+					out = append(out, c)
+				}
+			}
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].dist < out[b].dist })
+	if len(out) > maxMatchCandidates {
+		out = out[:maxMatchCandidates]
+	}
+	return out
+}
+
+// project finds the closest position to p on edge i
+func (g *roadGraph) project(i int, p Position) (matchCandidate, bool) {
+	pts := g.points[i]
+	if len(pts) < 2 {
+		return matchCandidate{}, false
+	}
+	q, along, d := locateOnLine(pts, p)
+	return matchCandidate{edge: i, offset: math.Min(along, g.edges[i].LengthM), pos: q, dist: d}, true
+}
+
+// exits are the nodes a vehicle at c can drive to along its edge, with the
+// distance to each
+func (g *roadGraph) exits(c matchCandidate) map[int]float64 {
+	e := g.edges[c.edge]
+	out := map[int]float64{e.To: e.LengthM - c.offset}
+	if !e.Oneway {
+		if d, ok := out[e.From]; !ok || c.offset < d {
+			out[e.From] = c.offset
+		}
+	}
+	return out
+}
+
+// entries are the nodes c can be reached from along its edge, with the
+// distance from each
+func (g *roadGraph) entries(c matchCandidate) map[int]float64 {
+	e := g.edges[c.edge]
+	out := map[int]float64{e.From: c.offset}
+	if !e.Oneway {
+		if d, ok := out[e.To]; !ok || e.LengthM-c.offset < d {
+			out[e.To] = e.LengthM - c.offset
+		}
+	}
+	return out
+}
+
+// dijkstraFrom is dijkstra from several sources with starting distances,
+// over maps since a bounded search touches few nodes
+func (g *roadGraph) dijkstraFrom(starts map[int]float64, limit float64) (map[int]float64, map[int]graphArc) {
+	dist := map[int]float64{}
+	prev := map[int]graphArc{}
+	q := &distQueue{}
+	for n, d := range starts {
+		dist[n] = d
+		prev[n] = graphArc{to: -1, edge: -1}
+		heap.Push(q, pqItem{n, d})
+	}
+	for q.Len() > 0 {
+		it := heap.Pop(q).(pqItem)
+		if it.dist > dist[it.node] {
+			continue
+		}
+		if it.dist > limit {
+			break
+		}
+		for _, a := range g.adj[it.node] {
+			if d, seen := dist[a.to]; !seen || it.dist+a.length < d {
+				dist[a.to] = it.dist + a.length
+				prev[a.to] = graphArc{to: it.node, edge: a.edge, length: a.length}
+				heap.Push(q, pqItem{a.to, it.dist + a.length})
+			}
+		}
+	}
+	return dist, prev
+}
+
+// routeDistance is the driving distance from a to b given the search from
+// a's exits, and the entry node used (-1 when staying on the same edge)
+func (g *roadGraph) routeDistance(a, b matchCandidate, dist map[int]float64) (float64, int) {
+	best, via := math.Inf(1), -1
+	if a.edge == b.edge && (b.offset >= a.offset || !g.edges[a.edge].Oneway) {
+		best = math.Abs(b.offset - a.offset)
+	}
+	for n, d := range g.entries(b) {
+		if dn, ok := dist[n]; ok && dn+d < best {
+			best, via = dn+d, n
+		}
+	}
+	return best, via
+}
+
+// subLine is the part of ps between from and to meters along it
+func subLine(ps []Position, from, to float64) []Position {
+	if to <= from {
+		head := lineUpTo(ps, from)
+		return []Position{head[len(head)-1], head[len(head)-1]}
+	}
+	return reversed(lineUpTo(reversed(lineUpTo(ps, to)), to-from))
+}
+
+// between is the driven geometry from a to b and the edges it uses
+func (g *roadGraph) between(a, b matchCandidate, limit float64) ([]Position, []int) {
+	dist, prev := g.dijkstraFrom(g.exits(a), limit)
+	_, via := g.routeDistance(a, b, dist)
+	if via < 0 {
+		if a.edge != b.edge {
+			return []Position{a.pos, b.pos}, nil
+		}
+		pts := g.points[a.edge]
+		if b.offset >= a.offset {
+			return subLine(pts, a.offset, b.offset), []int{a.edge}
+		}
+		return reversed(subLine(pts, b.offset, a.offset)), []int{a.edge}
+	}
+	origin := via
+	for prev[origin].edge >= 0 {
+		origin = prev[origin].to
+	}
+	e := g.edges[a.edge]
+	var coords []Position
+	if origin == e.To {
+		coords = subLine(g.points[a.edge], a.offset, e.LengthM)
+	} else {
+		coords = reversed(subLine(g.points[a.edge], 0, a.offset))
+	}
+	middle, edges := g.pathVia(func(n int) graphArc { return prev[n] }, origin, via)
+	coords = append(coords, middle[1:]...)
+	eb := g.edges[b.edge]
+	if via == eb.From {
+		coords = append(coords, subLine(g.points[b.edge], 0, b.offset)[1:]...)
+	} else {
+		coords = append(coords, reversed(subLine(g.points[b.edge], b.offset, eb.LengthM))[1:]...)
+	}
+	edges = append(append([]int{a.edge}, edges...), b.edge)
+	return coords, edges
+}
+
+// transitions scores every move between two candidate sets; the network
+// search is bounded so impossible moves cost nothing to rule out
+func (g *roadGraph) transitions(from, to []matchCandidate, gc, beta, limit float64) [][]float64 {
+	out := make([][]float64, len(from))
+	possible := false
+	for i, a := range from {
+		out[i] = make([]float64, len(to))
+		dist, _ := g.dijkstraFrom(g.exits(a), limit)
+		for j, b := range to {
+			d, _ := g.routeDistance(a, b, dist)
+			if d > limit {
+				out[i][j] = math.Inf(-1)
+				continue
+			}
+			out[i][j] = -math.Abs(d-gc)/beta - math.Log(beta)
+			possible = true
+		}
+	}
+	if !possible {
+		return nil
+	}
+	return out
+}
+
+func logSumExp(vs []float64) float64 {
+	m := math.Inf(-1)
+	for _, v := range vs {
+		m = math.Max(m, v)
+	}
+	if math.IsInf(m, -1) {
+		return m
+	}
+	s := 0.0
+	for _, v := range vs {
+		s += math.Exp(v - m)
+	}
+	return m + math.Log(s)
+}
+
+// decode runs Viterbi over one segment of steps, returning the chosen
+// candidate and its posterior probability per step
+func decode(steps []matchStep, emission [][]float64) ([]int, []float64) {
+	n := len(steps)
+	score := make([][]float64, n)
+	back := make([][]int, n)
+	fwd := make([][]float64, n)
+	score[0], fwd[0] = emission[0], emission[0]
+	for t := 1; t < n; t++ {
+		k := len(steps[t].cands)
+		score[t], back[t], fwd[t] = make([]float64, k), make([]int, k), make([]float64, k)
+		for j := 0; j < k; j++ {
+			best, arg := math.Inf(-1), 0
+			terms := make([]float64, len(steps[t-1].cands))
+			for i := range steps[t-1].cands {
+				if s := score[t-1][i] + steps[t].trans[i][j]; s > best {
+					best, arg = s, i
+				}
+				terms[i] = fwd[t-1][i] + steps[t].trans[i][j]
+			}
+			score[t][j], back[t][j] = best+emission[t][j], arg
+			fwd[t][j] = logSumExp(terms) + emission[t][j]
+		}
+	}
+	bwd := make([][]float64, n)
+	bwd[n-1] = make([]float64, len(steps[n-1].cands))
+	for t := n - 2; t >= 0; t-- {
+		bwd[t] = make([]float64, len(steps[t].cands))
+		for i := range bwd[t] {
+			terms := make([]float64, len(steps[t+1].cands))
+			for j := range terms {
+				terms[j] = steps[t+1].trans[i][j] + emission[t+1][j] + bwd[t+1][j]
+			}
+			bwd[t][i] = logSumExp(terms)
+		}
+	}
+	z := logSumExp(fwd[n-1])
+	chosen := make([]int, n)
+	conf := make([]float64, n)
+	for j, s := range score[n-1] {
+		if s > score[n-1][chosen[n-1]] {
+			chosen[n-1] = j
+		}
+	}
+	for t := n - 1; t >= 0; t-- {
+		if t < n-1 {
+			chosen[t] = back[t+1][chosen[t+1]]
+		}
+		conf[t] = math.Exp(fwd[t][chosen[t]] + bwd[t][chosen[t]] - z)
+	}
+	return chosen, conf
+}
+
+// MatchedPoint is the match of one fix of the trace
+type MatchedPoint struct {
+	Index      int         `json:"index"`
+	Matched    interface{} `json:"matched"`
+	Feature    string      `json:"feature,omitempty"`
+	DistanceM  float64     `json:"distance_m,omitempty"`
+	AlongM     float64     `json:"along_m,omitempty"`
+	Confidence float64     `json:"confidence"`
+	Time       string      `json:"time,omitempty"`
+}
+
+// POST /analysis/map-match { network, trace, timestamps, sigma_m, beta_m,
+// search_radius_m }
+// trace is a LineString or MultiPoint geometry, or a Feature with one, of
+// GPS fixes in driving order; timestamps optionally gives each fix's
+// RFC 3339 time. The response is the matched path as a Feature (a
+// MultiLineString where the trace could not be followed on the network)
+// and the match of every fix; fixes with no edge within search_radius_m
+// are left unmatched. along_m is the driven distance from the start of the
+// fix's segment, so differences between timed fixes give travel speeds.
+func mapMatchHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Network    string      `json:"network"`
+		Trace      interface{} `json:"trace"`
+		Timestamps []string    `json:"timestamps"`
+		SigmaM     float64     `json:"sigma_m"`
+		BetaM      float64     `json:"beta_m"`
+		RadiusM    float64     `json:"search_radius_m"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if m, ok := asMap(body.Trace); ok && m["type"] == "Feature" {
+		body.Trace = m["geometry"]
+	}
+	geom, err := parseGeometry(body.Trace)
+	if err != nil || (geom.Type != "LineString" && geom.Type != "MultiPoint") {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid trace", FieldError{Field: "trace", Message: "must be a LineString or MultiPoint of GPS fixes"})
+		return
+	}
+	pts := geom.Points
+	if len(pts) < 2 || len(pts) > maxMatchPoints {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid trace", FieldError{Field: "trace", Message: fmt.Sprintf("must have between 2 and %d points", maxMatchPoints)})
+		return
+	}
+	var times []time.Time
+	if len(body.Timestamps) > 0 {
+		if len(body.Timestamps) != len(pts) {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid timestamps", FieldError{Field: "timestamps", Message: "must have one entry per trace point"})
+			return
+		}
+		for i, s := range body.Timestamps {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "validation_failed", "invalid timestamps", FieldError{Field: fmt.Sprintf("timestamps[%d]", i), Message: "expected RFC 3339"})
+				return
+			}
+			times = append(times, t)
+		}
+	}
+	if body.SigmaM <= 0 {
+		body.SigmaM = 10
+	}
+	if body.BetaM <= 0 {
+		body.BetaM = 5
+	}
+	if body.RadiusM <= 0 {
+		body.RadiusM = 50
+	}
+	if body.RadiusM > 500 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid search_radius_m", FieldError{Field: "search_radius_m", Message: "must be at most 500"})
+		return
+	}
+
+	_, g, ok := loadGraph(w, body.Network)
+	if !ok {
+		return
+	}
+	limitFor := func(gc float64) float64 { return 3*gc + 2*body.RadiusM }
+	var segments [][]Position
+	matched := make([]MatchedPoint, len(pts))
+	var totalM float64
+	if !runGeometry(w, r, func() {
+		var steps []matchStep
+		for t, p := range pts {
+			matched[t] = MatchedPoint{Index: t}
+			cs := g.candidates(p, body.RadiusM)
+			if len(cs) == 0 {
+				continue
+			}
+			st := matchStep{point: t, cands: cs}
+			if len(steps) > 0 {
+				prev := steps[len(steps)-1]
+				gc := haversine(pts[prev.point], p)
+				st.trans = g.transitions(prev.cands, cs, gc, body.BetaM, limitFor(gc))
+			}
+			steps = append(steps, st)
+		}
+		for start := 0; start < len(steps); {
+			end := start + 1
+			for end < len(steps) && steps[end].trans != nil {
+				end++
+			}
+			seg := steps[start:end]
+			emission := make([][]float64, len(seg))
+			for t, st := range seg {
+				emission[t] = make([]float64, len(st.cands))
+				for j, c := range st.cands {
+					z := c.dist / body.SigmaM
+					emission[t][j] = -0.5*z*z - math.Log(math.Sqrt(2*math.Pi)*body.SigmaM)
+				}
+			}
+			chosen, conf := decode(seg, emission)
+			line := []Position{seg[0].cands[chosen[0]].pos}
+			along := 0.0
+			for t, st := range seg {
+				c := st.cands[chosen[t]]
+				if t > 0 {
+					a := seg[t-1].cands[chosen[t-1]]
+					part, _ := g.between(a, c, limitFor(haversine(pts[seg[t-1].point], pts[st.point])))
+					along += lineLength(part)
+					line = append(line, part[1:]...)
+				}
+				matched[st.point] = MatchedPoint{
+					Index:      st.point,
+					Matched:    pointJSON(c.pos),
+					Feature:    g.edges[c.edge].Feature.Hex(),
+					DistanceM:  math.Round(c.dist*100) / 100,
+					AlongM:     math.Round(along*100) / 100,
+					Confidence: math.Round(conf[t]*1000) / 1000,
+				}
+			}
+			totalM += along
+			if len(line) > 1 {
+				segments = append(segments, line)
+			}
+			start = end
+		}
+	}) {
+		return
+	}
+	if len(segments) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "no part of the trace could be matched to the network")
+		return
+	}
+	for i := range matched {
+		if matched[i].Matched == nil {
+			matched[i].Confidence = 0
+		}
+		if times != nil {
+			matched[i].Time = body.Timestamps[i]
+		}
+	}
+	out := Geometry{Type: "LineString", Points: segments[0]}
+	if len(segments) > 1 {
+		out = Geometry{Type: "MultiLineString", Rings: segments}
+	}
+	props := bson.M{"network": body.Network, "length_m": math.Round(totalM*100) / 100, "segments": len(segments)}
+	if times != nil {
+		if secs := times[len(times)-1].Sub(times[0]).Seconds(); secs > 0 {
+			props["duration_s"] = secs
+			props["avg_speed_kmh"] = math.Round(totalM/secs*3.6*10) / 10
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   GeoJSONFeature{Type: "Feature", Geometry: out.BSON(), Properties: props},
+		"points": matched,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration is one versioned structural change. Versions must be unique and
+// are applied in ascending order; Up must be safe to re-run if it fails
+// halfway.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context) error
+}
+
+// migration registry; append new migrations with the next version number
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "backfill_feature_status",
+		Up: func(ctx context.Context) error {
+			_, err := collection.UpdateMany(ctx,
+				bson.M{"status": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"status": statusApproved}})
+			return err
+		},
+	},
+}
+
+// AppliedMigration is stored in the applied-migrations collection
+type AppliedMigration struct {
+	Version    int       `bson:"_id" json:"version"`
+	Name       string    `bson:"name" json:"name"`
+	AppliedAt  time.Time `bson:"applied_at" json:"applied_at"`
+	DurationMs int64     `bson:"duration_ms" json:"duration_ms"`
+}
+
+var (
+	appliedMigrations *mongo.Collection
+	migrationLocks    *mongo.Collection
+)
+
+func setupMigrations() {
+	appliedMigrations = db.Collection(getenv("MONGO_MIGRATIONS_COLLECTION", "schema_migrations"))
+	migrationLocks = db.Collection("schema_migrations_lock")
+	// a crashed run would otherwise hold the lock forever
+	migrationLocks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "locked_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(600),
+	})
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	if getenv("MIGRATE_ON_STARTUP", "true") == "true" {
+		applied, err := runMigrations(ctx)
+		if err != nil {
+			log.Printf("migrations error: %v", err)
+		} else if len(applied) > 0 {
+			log.Printf("Applied %d migration(s)", len(applied))
+		}
+	}
+}
+
+// runMigrations applies all pending migrations in order. A lock document
+// keeps replicas starting at the same time from running them twice.
+func runMigrations(ctx context.Context) ([]AppliedMigration, error) {
+	_, err := migrationLocks.InsertOne(ctx, bson.M{"_id": "lock", "locked_at": time.Now().UTC()})
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("migrations are already running elsewhere")
+	} else if err != nil {
+		return nil, err
+	}
+	defer migrationLocks.DeleteOne(ctx, bson.M{"_id": "lock"})
+
+	done, err := appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var applied []AppliedMigration
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		start := time.Now()
+		if err := m.Up(ctx); err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		a := AppliedMigration{
+			Version:    m.Version,
+			Name:       m.Name,
+			AppliedAt:  time.Now().UTC(),
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if _, err := appliedMigrations.InsertOne(ctx, a); err != nil {
+			return applied, err
+		}
+		log.Printf("Applied migration %d (%s)", m.Version, m.Name)
+		applied = append(applied, a)
+	}
+	return applied, nil
+}
+
+func appliedVersions(ctx context.Context) (map[int]bool, error) {
+	cur, err := appliedMigrations.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	var rows []AppliedMigration
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	done := map[int]bool{}
+	for _, a := range rows {
+		done[a.Version] = true
+	}
+	return done, nil
+}
+
+// GET /admin/migrations lists registered migrations and whether they ran
+func listMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	cur, err := appliedMigrations.Find(ctx, bson.M{})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	var rows []AppliedMigration
+	if err := cur.All(ctx, &rows); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db decode error: "+err.Error())
+		return
+	}
+	byVersion := map[int]AppliedMigration{}
+	for _, a := range rows {
+		byVersion[a.Version] = a
+	}
+	out := []bson.M{}
+	for _, m := range migrations {
+		row := bson.M{"version": m.Version, "name": m.Name, "applied": false}
+		if a, ok := byVersion[m.Version]; ok {
+			row["applied"] = true
+			row["applied_at"] = a.AppliedAt
+		}
+		out = append(out, row)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /admin/migrations/run applies pending migrations
+func runMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	applied, err := runMigrations(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "migration error: "+err.Error())
+		return
+	}
+	if applied == nil {
+		applied = []AppliedMigration{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"applied": applied})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// moderation statuses. Features created before moderation existed have no
+// status and are treated as approved.
+const (
+	statusPending  = "pending"
+	statusApproved = "approved"
+	statusRejected = "rejected"
+)
+
+// ModerationInfo records the last review decision on a feature
+type ModerationInfo struct {
+	ReviewedBy string    `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewedAt time.Time `bson:"reviewed_at" json:"reviewed_at"`
+	Note       string    `bson:"note,omitempty" json:"note,omitempty"`
+}
+
+// applyStatusFilter restricts listings to approved features unless an editor
+// asks for another status with ?status=
+func applyStatusFilter(w http.ResponseWriter, r *http.Request, q bson.M) bool {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", statusApproved:
+		q["status"] = bson.M{"$nin": bson.A{statusPending, statusRejected}}
+		return true
+	case statusPending, statusRejected, "all":
+		if !requireRole(w, r, "editor") {
+			return false
+		}
+		if status != "all" {
+			q["status"] = status
+		}
+		return true
+	}
+	writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid status", FieldError{Field: "status", Message: "must be one of pending, approved, rejected, all"})
+	return false
+}
+
+// POST /submissions accepts the same body as POST /features from anyone and
+// stores it as pending
+func submitFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	id := insertFeature(w, r, statusPending)
+	if id == "" {
+		return
+	}
+	notify(Event{
+		Type:    eventModerationRequested,
+		Subject: "New submission awaiting moderation",
+		Message: "Feature " + id + " was submitted and is waiting in the moderation queue.",
+		Data:    map[string]interface{}{"id": id, "submitted_by": userID(r)},
+	})
+}
+
+// GET /moderation/queue lists pending submissions, oldest first
+func moderationQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}})
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if limit == 0 || limit > maxFeatures {
+		limit = maxFeatures
+	}
+	opts.SetLimit(limit).SetSkip(offset)
+
+	cur, err := collection.Find(ctx, bson.M{"status": statusPending}, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			log.Println("decode warn:", err)
+			continue
+		}
+		revealDoc(r, &doc)
+		fc.Features = append(fc.Features, featureToGeoJSON(doc))
+	}
+	writeCollection(w, r, fc, limit, offset)
+}
+
+// POST /moderation/{id} { status: approved|rejected, note }
+func moderateFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json")
+		return
+	}
+	if body.Status != statusApproved && body.Status != statusRejected {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid status", FieldError{Field: "status", Message: "must be approved or rejected"})
+		return
+	}
+
+	now := time.Now().UTC()
+	update := bson.M{"$set": bson.M{
+		"status": body.Status,
+		"moderation": ModerationInfo{
+			ReviewedBy: userID(r),
+			ReviewedAt: now,
+			Note:       body.Note,
+		},
+		"updated_at": now,
+	}}
+	// a rejected report keeps no photo of the reporter's surroundings
+	if body.Status == statusRejected {
+		update["$unset"] = bson.M{"properties.photo": ""}
+	}
+	res, err := collection.UpdateOne(ctx, bson.M{"_id": oid, "status": statusPending}, update)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no pending submission with this id")
+		return
+	}
+	if body.Status == statusRejected {
+		if _, err := reportPhotos.DeleteOne(ctx, bson.M{"_id": oid}); err != nil {
+			log.Printf("report photo delete warning for %s: %v", oid.Hex(), err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"ok": true, "status": body.Status})
+}
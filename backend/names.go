@@ -0,0 +1,463 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Name normalization. Names are cleaned up by rules: abbreviations are
+// expanded ("Jl." becomes "Jalan"), words are title-cased except known
+// acronyms, and spacing is tidied. Each name also gets a match key
+// (lower case, no diacritics or punctuation) that similar names are
+// compared by. Rules are stored in name_rules: "default" applies
+// everywhere and a rule set with a layer's id adds to it for that layer.
+type NameRules struct {
+	ID string `bson:"_id" json:"id"`
+	// Expansions maps an abbreviation, lower case and without its dot, to
+	// what it stands for
+	Expansions map[string]string `bson:"expansions,omitempty" json:"expansions,omitempty"`
+	// Acronyms stay upper case
+	Acronyms []string `bson:"acronyms,omitempty" json:"acronyms,omitempty"`
+	// FoldDiacritics strips diacritics from the normalized name too, not
+	// only from the match key
+	FoldDiacritics bool `bson:"fold_diacritics,omitempty" json:"fold_diacritics,omitempty"`
+	// Threshold is the similarity, 0 to 1, from which names are suggested
+	// as the same
+	Threshold float64   `bson:"threshold,omitempty" json:"threshold,omitempty"`
+	UpdatedBy string    `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// builtinNameRules are the default rules until an admin stores their own
+var builtinNameRules = NameRules{
+	ID: "default",
+	Expansions: map[string]string{
+		"jl": "jalan", "jln": "jalan", "gg": "gang", "ds": "desa", "kel": "kelurahan", "kec": "kecamatan",
+		"kab": "kabupaten", "prov": "provinsi", "rs": "rumah sakit", "rsud": "rumah sakit umum daerah",
+		"pusk": "puskesmas", "univ": "universitas", "mesjid": "masjid", "sdn": "SD negeri",
+		"smpn": "SMP negeri", "sman": "SMA negeri", "smkn": "SMK negeri",
+	},
+	Acronyms:  []string{"SD", "SMP", "SMA", "SMK", "TK", "MI", "MTS", "MA", "RT", "RW", "KUA", "SPBU", "ATM", "PT", "CV", "UPT", "PLN", "PDAM", "BPJS"},
+	Threshold: 0.85,
+}
+
+const (
+	// most distinct names of a layer compared for duplicates
+	maxNameCandidates = 20000
+	maxNormalizeNames = 1000
+)
+
+var (
+	nameRules *mongo.Collection
+	// a dot glued to the next word, as in "Jl.Merdeka"
+	gluedDot = regexp.MustCompile(`\.(\pL)`)
+)
+
+func setupNameRules() {
+	nameRules = db.Collection(getenv("MONGO_NAME_RULES_COLLECTION", "name_rules"))
+}
+
+// effectiveNameRules is the default rule set with layer's on top
+func effectiveNameRules(r *http.Request, layer string) (NameRules, error) {
+	out := NameRules{ID: "default", Expansions: map[string]string{}}
+	ids := bson.A{"default"}
+	if layer != "" {
+		ids = append(ids, layer)
+	}
+	cur, err := nameRules.Find(r.Context(), bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return out, err
+	}
+	var stored []NameRules
+	if err := cur.All(r.Context(), &stored); err != nil {
+		return out, err
+	}
+	sets := []NameRules{builtinNameRules}
+	for _, s := range stored {
+		if s.ID == "default" {
+			sets[0] = s
+		}
+	}
+	for _, s := range stored {
+		if s.ID != "default" {
+			sets = append(sets, s)
+		}
+	}
+	for _, s := range sets {
+		for k, v := range s.Expansions {
+			out.Expansions[k] = v
+		}
+		out.Acronyms = append(out.Acronyms, s.Acronyms...)
+		out.FoldDiacritics = out.FoldDiacritics || s.FoldDiacritics
+		if s.Threshold > 0 {
+			out.Threshold = s.Threshold
+		}
+		if s.ID == layer {
+			out.ID = layer
+		}
+	}
+	if out.Threshold == 0 {
+		out.Threshold = builtinNameRules.Threshold
+	}
+	return out, nil
+}
+
+// foldDiacritics removes combining marks: "Café" becomes "Cafe"
+func foldDiacritics(s string) string {
+	var b strings.Builder
+	for _, c := range norm.NFD.String(s) {
+		if !unicode.Is(unicode.Mn, c) {
+			b.WriteRune(c)
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// normalizeName applies the rules to a name
+func (rules NameRules) normalizeName(name string) string {
+	acronyms := map[string]bool{}
+	for _, a := range rules.Acronyms {
+		acronyms[strings.ToUpper(a)] = true
+	}
+	if rules.FoldDiacritics {
+		name = foldDiacritics(name)
+	}
+	name = gluedDot.ReplaceAllString(name, ". $1")
+	var words []string
+	for _, w := range strings.Fields(name) {
+		if exp, ok := rules.Expansions[strings.ToLower(strings.TrimSuffix(w, "."))]; ok {
+			words = append(words, strings.Fields(exp)...)
+			continue
+		}
+		words = append(words, w)
+	}
+	for i, w := range words {
+		if acronyms[strings.ToUpper(strings.Trim(w, ".,"))] {
+			words[i] = strings.ToUpper(w)
+		} else {
+			words[i] = titleWord(w)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// titleWord upper-cases the first letter of w and of each part after a
+// hyphen, slash or bracket, lower-casing the rest
+func titleWord(w string) string {
+	rs := []rune(strings.ToLower(w))
+	start := true
+	for i, c := range rs {
+		if start && unicode.IsLetter(c) {
+			rs[i] = unicode.ToUpper(c)
+		}
+		start = c == '-' || c == '/' || c == '(' || (start && !unicode.IsLetter(c) && !unicode.IsDigit(c))
+	}
+	return string(rs)
+}
+
+// nameKey is what names are matched by: the normalized name in lower
+// case without diacritics or punctuation
+func (rules NameRules) nameKey(name string) string {
+	s := strings.ToLower(foldDiacritics(rules.normalizeName(name)))
+	var b strings.Builder
+	space := false
+	for _, c := range s {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(c)
+			space = false
+		} else {
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// nameSimilarity is the Dice coefficient of the letter pairs of two keys,
+// 1 for equal keys
+func nameSimilarity(a, b string) float64 {
+	if a == b {
+		return 1
+	}
+	pairs := func(s string) map[string]int {
+		rs := []rune(" " + s + " ")
+		m := map[string]int{}
+		for i := 0; i+1 < len(rs); i++ {
+			m[string(rs[i:i+2])]++
+		}
+		return m
+	}
+	pa, pb := pairs(a), pairs(b)
+	common, total := 0, 0
+	for k, n := range pa {
+		total += n
+		if m := pb[k]; m > 0 {
+			common += min(n, m)
+		}
+	}
+	for _, n := range pb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(common) / float64(total)
+}
+
+// NameVariant is one spelling of a name with the features using it
+type NameVariant struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NameCluster is a group of names that look like the same one. Canonical
+// is the normalized form of the most used spelling.
+type NameCluster struct {
+	Canonical string        `json:"canonical"`
+	Key       string        `json:"key"`
+	Features  int           `json:"features"`
+	Variants  []NameVariant `json:"variants"`
+}
+
+// layerNames counts the features of each distinct name in layer
+func layerNames(r *http.Request, layer string) ([]NameVariant, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"layer": layer, "name": bson.M{"$nin": bson.A{"", nil}}, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$name", "n": bson.M{"$sum": 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "n", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: maxNameCandidates}},
+	}
+	cur, err := heavyReads.Aggregate(r.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Name string `bson:"_id"`
+		N    int    `bson:"n"`
+	}
+	if err := cur.All(r.Context(), &rows); err != nil {
+		return nil, err
+	}
+	out := make([]NameVariant, len(rows))
+	for i, row := range rows {
+		out[i] = NameVariant{Name: row.Name, Count: row.N}
+	}
+	return out, nil
+}
+
+// clusterNames groups names by key, then merges the groups whose keys are
+// at least threshold alike. Keys are only compared within the same first
+// letter, which keeps large layers tractable.
+func clusterNames(rules NameRules, names []NameVariant) []NameCluster {
+	byKey := map[string]*NameCluster{}
+	var keys []string
+	for _, n := range names {
+		k := rules.nameKey(n.Name)
+		if k == "" {
+			continue
+		}
+		c := byKey[k]
+		if c == nil {
+			c = &NameCluster{Key: k}
+			byKey[k] = c
+			keys = append(keys, k)
+		}
+		c.Variants = append(c.Variants, n)
+		c.Features += n.Count
+	}
+	// the most used keys absorb the others
+	sort.Slice(keys, func(i, j int) bool {
+		if byKey[keys[i]].Features != byKey[keys[j]].Features {
+			return byKey[keys[i]].Features > byKey[keys[j]].Features
+		}
+		return keys[i] < keys[j]
+	})
+	merged := map[string]bool{}
+	var out []NameCluster
+	for i, k := range keys {
+		if merged[k] {
+			continue
+		}
+		c := byKey[k]
+		for _, other := range keys[i+1:] {
+			if merged[other] || []rune(other)[0] != []rune(k)[0] {
+				continue
+			}
+			if nameSimilarity(k, other) >= rules.Threshold {
+				merged[other] = true
+				c.Variants = append(c.Variants, byKey[other].Variants...)
+				c.Features += byKey[other].Features
+			}
+		}
+		sort.SliceStable(c.Variants, func(a, b int) bool { return c.Variants[a].Count > c.Variants[b].Count })
+		c.Canonical = rules.normalizeName(c.Variants[0].Name)
+		out = append(out, *c)
+	}
+	return out
+}
+
+// NameSuggestion is a canonical name offered for an input
+type NameSuggestion struct {
+	Name     string  `json:"name"`
+	Features int     `json:"features"`
+	Score    float64 `json:"score"`
+}
+
+// NormalizedName is the answer for one input of POST /names/normalize
+type NormalizedName struct {
+	Input       string           `json:"input"`
+	Normalized  string           `json:"normalized"`
+	Key         string           `json:"key"`
+	Suggestions []NameSuggestion `json:"suggestions"`
+}
+
+// POST /names/normalize {names: [..], layer} normalizes names and, with a
+// layer, suggests the canonical names of that layer they look like
+func normalizeNamesHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Names []string `json:"names"`
+		Layer string   `json:"layer"`
+		Limit int      `json:"limit"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if len(body.Names) == 0 || len(body.Names) > maxNormalizeNames {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid names", FieldError{Field: "names", Message: "between 1 and 1000 names"})
+		return
+	}
+	if body.Limit <= 0 || body.Limit > 20 {
+		body.Limit = 5
+	}
+	rules, err := effectiveNameRules(r, body.Layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	hidden, err := hiddenLayers(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db distinct error: "+err.Error())
+		return
+	}
+	for _, h := range hidden {
+		if h == body.Layer {
+			// the working copy of an unpublished layer isn't suggested
+			body.Layer = ""
+		}
+	}
+	var clusters []NameCluster
+	if body.Layer != "" {
+		names, err := layerNames(r, body.Layer)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		clusters = clusterNames(rules, names)
+	}
+	out := make([]NormalizedName, len(body.Names))
+	for i, name := range body.Names {
+		n := NormalizedName{Input: name, Normalized: rules.normalizeName(name), Key: rules.nameKey(name), Suggestions: []NameSuggestion{}}
+		for _, c := range clusters {
+			if s := nameSimilarity(n.Key, c.Key); s >= rules.Threshold {
+				n.Suggestions = append(n.Suggestions, NameSuggestion{Name: c.Canonical, Features: c.Features, Score: float64(int(s*1000)) / 1000})
+			}
+		}
+		sort.SliceStable(n.Suggestions, func(a, b int) bool { return n.Suggestions[a].Score > n.Suggestions[b].Score })
+		if len(n.Suggestions) > body.Limit {
+			n.Suggestions = n.Suggestions[:body.Limit]
+		}
+		out[i] = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /layers/{id}/names/duplicates lists the names of a layer that are
+// spelled more than one way
+func nameDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	layer := mux.Vars(r)["id"]
+	rules, err := effectiveNameRules(r, layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	names, err := layerNames(r, layer)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	out := []NameCluster{}
+	for _, c := range clusterNames(rules, names) {
+		if len(c.Variants) > 1 || c.Variants[0].Name != c.Canonical {
+			out = append(out, c)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /names/rules?layer= shows the rules that apply
+func getNameRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := effectiveNameRules(r, r.URL.Query().Get("layer"))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// PUT /names/rules/{id} {expansions, acronyms, fold_diacritics, threshold}
+// stores the default rules or a layer's additions
+func putNameRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var body NameRules
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var errs []FieldError
+	if body.Threshold < 0 || body.Threshold > 1 {
+		errs = append(errs, FieldError{Field: "threshold", Message: "must be between 0 and 1"})
+	}
+	expansions := map[string]string{}
+	for k, v := range body.Expansions {
+		k = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(k), "."))
+		if k == "" || strings.ContainsAny(k, " \t") || strings.TrimSpace(v) == "" {
+			errs = append(errs, FieldError{Field: "expansions", Message: "abbreviations are single words with a non-empty expansion"})
+			break
+		}
+		expansions[k] = strings.TrimSpace(v)
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid name rules", errs...)
+		return
+	}
+	body.ID = mux.Vars(r)["id"]
+	body.Expansions = expansions
+	body.UpdatedBy = userID(r)
+	body.UpdatedAt = time.Now().UTC()
+	if _, err := nameRules.ReplaceOne(r.Context(), bson.M{"_id": body.ID}, body, options.Replace().SetUpsert(true)); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A network is a routing graph built from the LineString features of one
+// layer. Lines are noded where they share a vertex (within tolerance_m) and,
+// unless node_intersections is false, where they cross; each piece between
+// two nodes becomes an edge. Edges are stored in network_edges, so a built
+// network survives restarts and is loaded into memory on first use.
+type Network struct {
+	ID                string    `bson:"_id" json:"id"`
+	Layer             string    `bson:"layer" json:"layer"`
+	ToleranceM        float64   `bson:"tolerance_m" json:"tolerance_m"`
+	NodeIntersections bool      `bson:"node_intersections" json:"node_intersections"`
+	OnewayProperty    string    `bson:"oneway_property,omitempty" json:"oneway_property,omitempty"`
+	Nodes             int       `bson:"nodes" json:"nodes"`
+	Edges             int       `bson:"edges" json:"edges"`
+	BuiltBy           string    `bson:"built_by,omitempty" json:"built_by,omitempty"`
+	BuiltAt           time.Time `bson:"built_at" json:"built_at"`
+}
+
+// NetworkEdge is one stored edge; Geometry runs from From to To
+type NetworkEdge struct {
+	Network  string             `bson:"network"`
+	Index    int                `bson:"index"`
+	From     int                `bson:"from"`
+	To       int                `bson:"to"`
+	LengthM  float64            `bson:"length_m"`
+	Oneway   bool               `bson:"oneway,omitempty"`
+	Feature  primitive.ObjectID `bson:"feature"`
+	Geometry bson.M             `bson:"geometry"`
+}
+
+var (
+	networks     *mongo.Collection
+	networkEdges *mongo.Collection
+
+	graphsMu sync.Mutex
+	graphs   = map[string]*roadGraph{}
+)
+
+func setupNetworks() {
+	networks = db.Collection(getenv("MONGO_NETWORKS_COLLECTION", "networks"))
+	networkEdges = db.Collection(getenv("MONGO_NETWORK_EDGES_COLLECTION", "network_edges"))
+	if _, err := networkEdges.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "network", Value: 1}, {Key: "index", Value: 1}}}); err != nil {
+		log.Printf("network edge index create warning: %v", err)
+	}
+}
+
+/* ---------------- noding ---------------- */
+
+type networkLine struct {
+	feature primitive.ObjectID
+	oneway  bool
+	coords  []Position
+}
+
+// segIntersection returns where segments ab and cd cross, as the fraction
+// along each; parallel and touching-at-end cases are left to vertex noding
+func segIntersection(a, b, c, d Position) (t, u float64, ok bool) {
+	rx, ry := b[0]-a[0], b[1]-a[1]
+	sx, sy := d[0]-c[0], d[1]-c[1]
+	den := rx*sy - ry*sx
+	if den == 0 {
+		return 0, 0, false
+	}
+	qx, qy := c[0]-a[0], c[1]-a[1]
+	t = (qx*sy - qy*sx) / den
+	u = (qx*ry - qy*rx) / den
+	const eps = 1e-9
+	if t <= eps || t >= 1-eps || u <= eps || u >= 1-eps {
+		return 0, 0, false
+	}
+	return t, u, true
+}
+
+// nodeCrossings inserts a vertex into both lines wherever two segments
+// cross, using a grid so only nearby segments are compared
+func nodeCrossings(lines []networkLine) {
+	type seg struct{ line, i int }
+	const cell = 0.01
+	grid := map[[2]int][]seg{}
+	for li, l := range lines {
+		for i := 1; i < len(l.coords); i++ {
+			a, b := l.coords[i-1], l.coords[i]
+			x0, x1 := int(math.Floor(math.Min(a[0], b[0])/cell)), int(math.Floor(math.Max(a[0], b[0])/cell))
+			y0, y1 := int(math.Floor(math.Min(a[1], b[1])/cell)), int(math.Floor(math.Max(a[1], b[1])/cell))
+			for x := x0; x <= x1; x++ {
+				for y := y0; y <= y1; y++ {
+					grid[[2]int{x, y}] = append(grid[[2]int{x, y}], seg{li, i})
+				}
+			}
+		}
+	}
+	type cut struct {
+		t float64
+		p Position
+	}
+	cuts := map[seg][]cut{}
+	seen := map[[2]seg]bool{}
+	for _, segs := range grid {
+		for i := 0; i < len(segs); i++ {
+			for j := i + 1; j < len(segs); j++ {
+				s1, s2 := segs[i], segs[j]
+				if s1.line == s2.line && (s1.i-s2.i == 1 || s2.i-s1.i == 1) {
+					continue
+				}
+				pair := [2]seg{s1, s2}
+				if seen[pair] {
+					continue
+				}
+				seen[pair] = true
+				l1, l2 := lines[s1.line].coords, lines[s2.line].coords
+				a, b, c, d := l1[s1.i-1], l1[s1.i], l2[s2.i-1], l2[s2.i]
+				t, u, ok := segIntersection(a, b, c, d)
+				if !ok {
+					continue
+				}
+				p := Position{a[0] + t*(b[0]-a[0]), a[1] + t*(b[1]-a[1])}
+				cuts[s1] = append(cuts[s1], cut{t, p})
+				cuts[s2] = append(cuts[s2], cut{u, p})
+			}
+		}
+	}
+	for li := range lines {
+		old := lines[li].coords
+		out := []Position{old[0]}
+		for i := 1; i < len(old); i++ {
+			cs := cuts[seg{li, i}]
+			sort.Slice(cs, func(a, b int) bool { return cs[a].t < cs[b].t })
+			for _, c := range cs {
+				out = append(out, c.p)
+			}
+			out = append(out, old[i])
+		}
+		lines[li].coords = out
+	}
+}
+
+// buildEdges splits the lines at their nodes: endpoints, and vertices
+// shared by more than one line or visited twice by the same line
+func buildEdges(network string, lines []networkLine, tolerance float64) (nodes []Position, edges []NetworkEdge) {
+	step := tolerance / degToMeters
+	keyOf := func(p Position) [2]int64 {
+		return [2]int64{int64(math.Round(p[0] / step)), int64(math.Round(p[1] / step))}
+	}
+	uses := map[[2]int64]int{}
+	for _, l := range lines {
+		for _, p := range l.coords {
+			uses[keyOf(p)]++
+		}
+	}
+	ids := map[[2]int64]int{}
+	nodeOf := func(p Position) int {
+		k := keyOf(p)
+		if id, ok := ids[k]; ok {
+			return id
+		}
+		ids[k] = len(nodes)
+		nodes = append(nodes, p)
+		return ids[k]
+	}
+	for _, l := range lines {
+		start := 0
+		for i := 1; i < len(l.coords); i++ {
+			if i < len(l.coords)-1 && uses[keyOf(l.coords[i])] < 2 {
+				continue
+			}
+			piece := l.coords[start : i+1]
+			from, to := nodeOf(piece[0]), nodeOf(piece[len(piece)-1])
+			start = i
+			if from == to && len(piece) < 3 {
+				continue
+			}
+			g := Geometry{Type: "LineString", Points: append([]Position(nil), piece...)}
+			edges = append(edges, NetworkEdge{
+				Network: network, Index: len(edges), From: from, To: to,
+				LengthM: lineLength(piece), Oneway: l.oneway, Feature: l.feature, Geometry: g.BSON(),
+			})
+		}
+	}
+	return nodes, edges
+}
+
+func truthy(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		b, _ := strconv.ParseBool(t)
+		return b || t == "yes"
+	case float64:
+		return t != 0
+	case int32:
+		return t != 0
+	case int64:
+		return t != 0
+	}
+	return false
+}
+
+/* ---------------- graph ---------------- */
+
+type graphArc struct {
+	to     int
+	edge   int
+	length float64
+}
+
+type roadGraph struct {
+	builtAt time.Time
+	nodes   []Position
+	edges   []NetworkEdge
+	// points are the parsed edge geometries, From to To
+	points [][]Position
+	adj    [][]graphArc
+	// grid of node indices for snapping
+	grid map[[2]int][]int
+	// grid of edge indices by the cells their segments cover, built on
+	// first use by map matching
+	edgeGridOnce sync.Once
+	edgeGrid     map[[2]int][]int
+}
+
+const graphCell = 0.01
+
+func newRoadGraph(builtAt time.Time, edges []NetworkEdge) *roadGraph {
+	g := &roadGraph{builtAt: builtAt, edges: edges, grid: map[[2]int][]int{}}
+	n := 0
+	for _, e := range edges {
+		n = max(n, e.From+1, e.To+1)
+	}
+	g.nodes = make([]Position, n)
+	g.adj = make([][]graphArc, n)
+	g.points = make([][]Position, len(edges))
+	for i, e := range edges {
+		geom, err := parseGeometry(e.Geometry)
+		if err != nil || len(geom.Points) < 2 {
+			continue
+		}
+		g.points[i] = geom.Points
+		g.nodes[e.From], g.nodes[e.To] = geom.Points[0], geom.Points[len(geom.Points)-1]
+		g.adj[e.From] = append(g.adj[e.From], graphArc{to: e.To, edge: i, length: e.LengthM})
+		if !e.Oneway {
+			g.adj[e.To] = append(g.adj[e.To], graphArc{to: e.From, edge: i, length: e.LengthM})
+		}
+	}
+	for i, p := range g.nodes {
+		if p == nil {
+			continue
+		}
+		k := [2]int{int(math.Floor(p[0] / graphCell)), int(math.Floor(p[1] / graphCell))}
+		g.grid[k] = append(g.grid[k], i)
+	}
+	return g
+}
+
+// nearestNode searches outward ring by ring of grid cells, one ring past
+// the first hit since a closer node can sit in a neighbouring cell
+func (g *roadGraph) nearestNode(p Position) (int, float64) {
+	cx, cy := int(math.Floor(p[0]/graphCell)), int(math.Floor(p[1]/graphCell))
+	best, bestD, hitRing := -1, math.Inf(1), -1
+	for ring := 0; ring <= 50; ring++ {
+		for x := cx - ring; x <= cx+ring; x++ {
+			for y := cy - ring; y <= cy+ring; y++ {
+				if x != cx-ring && x != cx+ring && y != cy-ring && y != cy+ring {
+					continue
+				}
+				for _, i := range g.grid[[2]int{x, y}] {
+					if d := haversine(p, g.nodes[i]); d < bestD {
+						best, bestD = i, d
+					}
+				}
+			}
+		}
+		if best >= 0 && hitRing < 0 {
+			hitRing = ring
+		} else if hitRing >= 0 {
+			break
+		}
+	}
+	return best, bestD
+}
+
+type pqItem struct {
+	node int
+	dist float64
+}
+
+type distQueue []pqItem
+
+func (q distQueue) Len() int            { return len(q) }
+func (q distQueue) Less(i, j int) bool  { return q[i].dist < q[j].dist }
+func (q distQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *distQueue) Push(x interface{}) { *q = append(*q, x.(pqItem)) }
+func (q *distQueue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return it
+}
+
+// dijkstra runs from source until target is settled (target < 0 settles
+// everything within limit meters). prev holds the arc used to reach each
+// node.
+func (g *roadGraph) dijkstra(source, target int, limit float64) (dist []float64, prev []graphArc) {
+	dist = make([]float64, len(g.nodes))
+	prev = make([]graphArc, len(g.nodes))
+	for i := range dist {
+		dist[i] = math.Inf(1)
+		prev[i] = graphArc{to: -1, edge: -1}
+	}
+	dist[source] = 0
+	q := &distQueue{{source, 0}}
+	for q.Len() > 0 {
+		it := heap.Pop(q).(pqItem)
+		if it.dist > dist[it.node] {
+			continue
+		}
+		if it.node == target || it.dist > limit {
+			break
+		}
+		for _, a := range g.adj[it.node] {
+			if d := it.dist + a.length; d < dist[a.to] {
+				dist[a.to] = d
+				prev[a.to] = graphArc{to: it.node, edge: a.edge, length: a.length}
+				heap.Push(q, pqItem{a.to, d})
+			}
+		}
+	}
+	return dist, prev
+}
+
+// path walks prev back from target, returning the route coordinates and
+// the edges used in travel order
+func (g *roadGraph) path(prev []graphArc, source, target int) ([]Position, []int) {
+	return g.pathVia(func(n int) graphArc { return prev[n] }, source, target)
+}
+
+// pathVia is path for any representation of the predecessor arcs
+func (g *roadGraph) pathVia(prev func(int) graphArc, source, target int) ([]Position, []int) {
+	var edgeIdx []int
+	for n := target; n != source; n = prev(n).to {
+		if prev(n).edge < 0 {
+			return nil, nil
+		}
+		edgeIdx = append(edgeIdx, prev(n).edge)
+	}
+	coords := []Position{g.nodes[source]}
+	at := source
+	for i := len(edgeIdx) - 1; i >= 0; i-- {
+		e := g.edges[edgeIdx[i]]
+		pts := g.points[edgeIdx[i]]
+		if e.From != at {
+			pts = append([]Position(nil), pts...)
+			for a, b := 0, len(pts)-1; a < b; a, b = a+1, b-1 {
+				pts[a], pts[b] = pts[b], pts[a]
+			}
+			at = e.From
+		} else {
+			at = e.To
+		}
+		coords = append(coords, pts[1:]...)
+	}
+	for i, j := 0, len(edgeIdx)-1; i < j; i, j = i+1, j-1 {
+		edgeIdx[i], edgeIdx[j] = edgeIdx[j], edgeIdx[i]
+	}
+	return coords, edgeIdx
+}
+
+// loadGraph returns the in-memory graph of a network, reloading it when the
+// network was rebuilt since
+func loadGraph(w http.ResponseWriter, id string) (*Network, *roadGraph, bool) {
+	var n Network
+	err := networks.FindOne(ctx, bson.M{"_id": id}).Decode(&n)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "network not found")
+		return nil, nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, nil, false
+	}
+	graphsMu.Lock()
+	g := graphs[id]
+	graphsMu.Unlock()
+	if g != nil && g.builtAt.Equal(n.BuiltAt) {
+		return &n, g, true
+	}
+	cur, err := networkEdges.Find(ctx, bson.M{"network": id}, options.Find().SetSort(bson.D{{Key: "index", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, nil, false
+	}
+	var edges []NetworkEdge
+	if err := cur.All(ctx, &edges); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, nil, false
+	}
+	g = newRoadGraph(n.BuiltAt, edges)
+	graphsMu.Lock()
+	graphs[id] = g
+	graphsMu.Unlock()
+	return &n, g, true
+}
+
+/* ---------------- handlers ---------------- */
+
+// POST /networks { id, layer, tolerance_m, node_intersections, oneway_property }
+// (Re)builds a network from the layer's approved LineString features.
+func buildNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	body := struct {
+		ID                string  `json:"id"`
+		Layer             string  `json:"layer"`
+		ToleranceM        float64 `json:"tolerance_m"`
+		NodeIntersections *bool   `json:"node_intersections"`
+		OnewayProperty    string  `json:"oneway_property"`
+	}{}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var errs []FieldError
+	if !layerIDPattern.MatchString(body.ID) {
+		errs = append(errs, FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+	}
+	if body.Layer == "" {
+		errs = append(errs, FieldError{Field: "layer", Message: "required"})
+	}
+	if body.ToleranceM == 0 {
+		body.ToleranceM = 1
+	}
+	if body.ToleranceM < 0 || body.ToleranceM > 100 {
+		errs = append(errs, FieldError{Field: "tolerance_m", Message: "must be between 0 and 100"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid network", errs...)
+		return
+	}
+	nodeX := body.NodeIntersections == nil || *body.NodeIntersections
+
+	q := bson.M{
+		"layer":         body.Layer,
+		"status":        bson.M{"$nin": bson.A{statusPending, statusRejected}},
+		"geometry.type": bson.M{"$in": bson.A{"LineString", "MultiLineString"}},
+	}
+	cur, err := readsFor(r).Find(ctx, q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	var lines []networkLine
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		g, err := parseGeometry(doc.Geometry)
+		if err != nil {
+			continue
+		}
+		oneway := body.OnewayProperty != "" && truthy(doc.Properties[body.OnewayProperty])
+		parts := [][]Position{g.Points}
+		if g.Type == "MultiLineString" {
+			parts = g.Rings
+		}
+		for _, p := range parts {
+			if len(p) >= 2 {
+				lines = append(lines, networkLine{feature: doc.ID, oneway: oneway, coords: p})
+			}
+		}
+	}
+	cur.Close(ctx)
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db cursor error: "+err.Error())
+		return
+	}
+	if len(lines) == 0 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "layer "+body.Layer+" has no line features")
+		return
+	}
+
+	var nodes []Position
+	var edges []NetworkEdge
+	if !runGeometry(w, r, func() {
+		if nodeX {
+			nodeCrossings(lines)
+		}
+		nodes, edges = buildEdges(body.ID, lines, body.ToleranceM)
+	}) {
+		return
+	}
+
+	if _, err := networkEdges.DeleteMany(ctx, bson.M{"network": body.ID}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	for start := 0; start < len(edges); start += importBatchSize {
+		batch := []interface{}{}
+		for _, e := range edges[start:min(start+importBatchSize, len(edges))] {
+			batch = append(batch, e)
+		}
+		if _, err := networkEdges.InsertMany(ctx, batch); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+			return
+		}
+	}
+	n := Network{
+		ID: body.ID, Layer: body.Layer, ToleranceM: body.ToleranceM, NodeIntersections: nodeX,
+		OnewayProperty: body.OnewayProperty, Nodes: len(nodes), Edges: len(edges),
+		BuiltBy: userID(r), BuiltAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if _, err := networks.ReplaceOne(ctx, bson.M{"_id": n.ID}, n, options.Replace().SetUpsert(true)); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(n)
+}
+
+func listNetworksHandler(w http.ResponseWriter, r *http.Request) {
+	cur, err := networks.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []Network{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func deleteNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	res, err := networks.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "network not found")
+		return
+	}
+	if _, err := networkEdges.DeleteMany(ctx, bson.M{"network": id}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	graphsMu.Lock()
+	delete(graphs, id)
+	graphsMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /networks/{id}/route?from=lat,lon&to=lat,lon
+// Shortest path between the network nodes nearest to from and to, as a
+// GeoJSON LineString feature
+func routeHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseFromTo(w, r)
+	if !ok {
+		return
+	}
+	_, g, ok := loadGraph(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	var feature GeoJSONFeature
+	var failure string
+	if !runGeometry(w, r, func() {
+		src, dFrom := g.nearestNode(from)
+		dst, dTo := g.nearestNode(to)
+		if src < 0 || dst < 0 {
+			failure = "no network node near the given points"
+			return
+		}
+		dist, prev := g.dijkstra(src, dst, math.Inf(1))
+		if math.IsInf(dist[dst], 1) {
+			failure = "no route between the given points"
+			return
+		}
+		coords, used := g.path(prev, src, dst)
+		geom := Geometry{Type: "LineString", Points: coords}
+		if len(coords) < 2 {
+			geom = Geometry{Type: "Point", Point: coords[0]}
+		}
+		features := make([]string, 0, len(used))
+		for _, e := range used {
+			// consecutive edges of one road name it once
+			if id := g.edges[e].Feature.Hex(); len(features) == 0 || features[len(features)-1] != id {
+				features = append(features, id)
+			}
+		}
+		feature = GeoJSONFeature{Type: "Feature", Geometry: geom.BSON(), Properties: bson.M{
+			"length_m":    math.Round(dist[dst]*100) / 100,
+			"edges":       len(used),
+			"features":    features,
+			"snap_from_m": math.Round(dFrom*100) / 100,
+			"snap_to_m":   math.Round(dTo*100) / 100,
+		}}
+	}) {
+		return
+	}
+	if failure != "" {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", failure)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(feature)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// workflow event types that can be routed to notifiers
+const (
+	eventModerationRequested = "moderation.requested"
+	eventImportCompleted     = "import.completed"
+	eventFailureThreshold    = "deadletter.threshold"
+	eventWorkOrderAssigned   = "workorder.assigned"
+	eventWorkOrderStatus     = "workorder.status"
+)
+
+// Event is a workflow event sent to notifiers
+type Event struct {
+	Type    string                 `json:"type"`
+	Subject string                 `json:"subject"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// Notifier delivers events to an external channel
+type Notifier interface {
+	Name() string
+	Notify(ev Event) error
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookNotifier POSTs the event as JSON
+type webhookNotifier struct {
+	url string
+}
+
+func (n webhookNotifier) Name() string { return "webhook" }
+
+func (n webhookNotifier) Notify(ev Event) error {
+	b, _ := json.Marshal(ev)
+	resp, err := notifyClient.Post(n.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// telegramNotifier sends the message through a bot to one chat. The bot
+// token is looked up per message so a rotated secret file takes effect.
+type telegramNotifier struct {
+	chatID string
+}
+
+func (n telegramNotifier) Name() string { return "telegram" }
+
+func (n telegramNotifier) Notify(ev Event) error {
+	b, _ := json.Marshal(map[string]string{
+		"chat_id": n.chatID,
+		"text":    ev.Subject + "\n\n" + ev.Message,
+	})
+	resp, err := notifyClient.Post("https://api.telegram.org/bot"+getsecret("TELEGRAM_BOT_TOKEN", "")+"/sendMessage", "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("telegram returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpNotifier emails the event with PLAIN auth; like the telegram token,
+// SMTP_PASSWORD is read per message
+type smtpNotifier struct {
+	addr string
+	host string
+	user string
+	from string
+	to   []string
+}
+
+func (n smtpNotifier) Name() string { return "smtp" }
+
+func (n smtpNotifier) Notify(ev Event) error {
+	msg := "From: " + n.from + "\r\n" +
+		"To: " + strings.Join(n.to, ", ") + "\r\n" +
+		"Subject: " + ev.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		ev.Message + "\r\n"
+	var auth smtp.Auth
+	if n.user != "" {
+		auth = smtp.PlainAuth("", n.user, getsecret("SMTP_PASSWORD", ""), n.host)
+	}
+	return smtp.SendMail(n.addr, auth, n.from, n.to, []byte(msg))
+}
+
+// sendAttachment emails a generated file to the given recipients rather
+// than SMTP_TO, with the same server settings
+func (n smtpNotifier) sendAttachment(to []string, subject, body, filename, contentType string, data []byte) error {
+	b := make([]byte, 12)
+	rand.Read(b)
+	boundary := "gis-" + hex.EncodeToString(b)
+	var msg strings.Builder
+	msg.WriteString("From: " + n.from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=" + boundary + "\r\n\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		body + "\r\n" +
+		"--" + boundary + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"" + filename + "\"\r\n\r\n")
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		msg.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	msg.WriteString(enc + "\r\n--" + boundary + "--\r\n")
+	var auth smtp.Auth
+	if n.user != "" {
+		auth = smtp.PlainAuth("", n.user, getsecret("SMTP_PASSWORD", ""), n.host)
+	}
+	return smtp.SendMail(n.addr, auth, n.from, to, []byte(msg.String()))
+}
+
+var (
+	// event type -> notifiers, from NOTIFY_ROUTES
+	notifyRoutes = map[string][]Notifier{}
+	// configured notifiers by name, for retrying dead letters
+	notifiers = map[string]Notifier{}
+)
+
+// setupNotifiers builds the configured notifiers and routes events to them.
+// NOTIFY_ROUTES="moderation.requested=smtp,telegram;import.completed=webhook"
+func setupNotifiers() {
+	available := notifiers
+	if u := getsecret("NOTIFY_WEBHOOK_URL", ""); u != "" {
+		available["webhook"] = webhookNotifier{url: u}
+	}
+	if getsecret("TELEGRAM_BOT_TOKEN", "") != "" {
+		available["telegram"] = telegramNotifier{chatID: getenv("TELEGRAM_CHAT_ID", "")}
+	}
+	if h := getenv("SMTP_HOST", ""); h != "" {
+		// read now so a missing password file fails at startup
+		getsecret("SMTP_PASSWORD", "")
+		available["smtp"] = smtpNotifier{
+			addr: h + ":" + getenv("SMTP_PORT", "587"),
+			host: h,
+			user: getenv("SMTP_USER", ""),
+			from: getenv("SMTP_FROM", "gis@localhost"),
+			to:   strings.Split(getenv("SMTP_TO", ""), ","),
+		}
+	}
+
+	for _, route := range strings.Split(getenv("NOTIFY_ROUTES", ""), ";") {
+		parts := strings.SplitN(strings.TrimSpace(route), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		for _, name := range strings.Split(parts[1], ",") {
+			n, ok := available[strings.TrimSpace(name)]
+			if !ok {
+				log.Printf("notify: %s route uses unconfigured notifier %q", parts[0], name)
+				continue
+			}
+			notifyRoutes[parts[0]] = append(notifyRoutes[parts[0]], n)
+		}
+	}
+}
+
+// notify sends ev to every notifier routed for its type, in the background
+func notify(ev Event) {
+	targets := notifyRoutes[ev.Type]
+	if len(targets) == 0 {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	for _, n := range targets {
+		go func(n Notifier) {
+			if err := n.Notify(ev); err != nil {
+				log.Printf("notify %s via %s failed: %v", ev.Type, n.Name(), err)
+				deadLetterEvent(n, ev, err)
+			}
+		}(n)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcProvider accepts ID and access tokens issued by an OpenID Connect
+// provider. OIDC_ISSUER is the issuer URL; its signing keys are found
+// through the discovery document and refetched when a token names an
+// unknown key. OIDC_AUDIENCE, when set, must be among the token's aud.
+// Roles come from OIDC_ROLE_CLAIM (a dotted path, e.g. realm_access.roles
+// for Keycloak, holding a string or a list) mapped by
+// OIDC_ROLE_MAP="admin=gis-admins;editor=gis-editors"; the highest mapped
+// role wins and tokens without one get OIDC_DEFAULT_ROLE (empty rejects
+// them). Users are keyed on the token's iss and sub, which identify them
+// for as long as the account exists; OIDC_NAME_CLAIM, preferred_username
+// by default, only names them, since providers let it be changed or
+// reassigned.
+type oidcProvider struct {
+	issuer      string
+	audience    string
+	roleClaim   string
+	roleMap     map[string]string
+	defaultRole string
+	nameClaim   string
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// minimum time between key refetches, so tokens with made-up kids can't
+// hammer the identity provider
+const oidcRefetchInterval = time.Minute
+
+// parseRoleMap reads "role=value;role=value" into value -> role
+func parseRoleMap(spec string) map[string]string {
+	out := map[string]string{}
+	for _, entry := range strings.Split(spec, ";") {
+		role, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || value == "" {
+			continue
+		}
+		if _, known := roleRanks[role]; !known {
+			log.Printf("role map: ignoring unknown role %q", role)
+			continue
+		}
+		out[strings.ToLower(strings.TrimSpace(value))] = role
+	}
+	return out
+}
+
+// mapRole picks the highest role any of values maps to
+func mapRole(values []string, roleMap map[string]string, def string) string {
+	best := def
+	for _, v := range values {
+		if role, ok := roleMap[strings.ToLower(strings.TrimSpace(v))]; ok && roleRanks[role] > roleRanks[best] {
+			best = role
+		}
+	}
+	return best
+}
+
+func newOIDCProvider() *oidcProvider {
+	issuer := strings.TrimRight(getenv("OIDC_ISSUER", ""), "/")
+	if issuer == "" {
+		return nil
+	}
+	p := &oidcProvider{
+		issuer:      issuer,
+		audience:    getenv("OIDC_AUDIENCE", ""),
+		roleClaim:   getenv("OIDC_ROLE_CLAIM", "roles"),
+		roleMap:     parseRoleMap(getenv("OIDC_ROLE_MAP", "")),
+		defaultRole: getenv("OIDC_DEFAULT_ROLE", "viewer"),
+		nameClaim:   getenv("OIDC_NAME_CLAIM", "preferred_username"),
+	}
+	if getenv("OIDC_USER_CLAIM", "") != "" {
+		log.Printf("OIDC_USER_CLAIM is no longer read, users are keyed on iss and sub; set OIDC_NAME_CLAIM for their display name")
+	}
+	if _, ok := roleRanks[p.defaultRole]; !ok && p.defaultRole != "" {
+		log.Printf("OIDC_DEFAULT_ROLE %q is not a role, tokens without a mapped role are rejected", p.defaultRole)
+		p.defaultRole = ""
+	}
+	if err := p.fetchKeys(); err != nil {
+		// the provider may come up later; keys are fetched on first use
+		log.Printf("oidc key fetch warning: %v", err)
+	}
+	return p
+}
+
+func (p *oidcProvider) name() string { return "oidc" }
+
+func getJSON(url string, v interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// fetchKeys loads the issuer's JWKS; the caller must hold p.mu or be the
+// constructor
+func (p *oidcProvider) fetchKeys() error {
+	p.fetchedAt = time.Now()
+	var disc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(p.issuer+"/.well-known/openid-configuration", &disc); err != nil {
+		return err
+	}
+	if strings.TrimRight(disc.Issuer, "/") != p.issuer || disc.JWKSURI == "" {
+		return fmt.Errorf("discovery document of %s names issuer %q", p.issuer, disc.Issuer)
+	}
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := getJSON(disc.JWKSURI, &jwks); err != nil {
+		return err
+	}
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if use, _ := k["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		if key := jwkKey(k); key != nil {
+			kid, _ := k["kid"].(string)
+			keys[kid] = key
+		}
+	}
+	p.keys = keys
+	return nil
+}
+
+func (p *oidcProvider) key(kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.fetchedAt) < oidcRefetchInterval {
+		return nil, errors.New("unknown signing key")
+	}
+	if err := p.fetchKeys(); err != nil {
+		return nil, err
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func (p *oidcProvider) authenticate(token string) (*User, error) {
+	h, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, errNotMine
+	}
+	if strings.TrimRight(claims.str("iss"), "/") != p.issuer {
+		return nil, errNotMine
+	}
+	if h.Alg != "RS256" && h.Alg != "ES256" {
+		return nil, errors.New("unsupported algorithm " + h.Alg)
+	}
+	key, err := p.key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(h.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+	if err := checkJWTTimes(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	if p.audience != "" && !claims.audience(p.audience) && claims.str("azp") != p.audience {
+		return nil, errors.New("token is for another audience")
+	}
+	var values []string
+	switch v := claims.path(p.roleClaim).(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := mapRole(values, p.roleMap, p.defaultRole)
+	if role == "" {
+		return nil, errNoRole
+	}
+	sub := claims.str("sub")
+	if sub == "" {
+		return nil, errors.New("token names no user")
+	}
+	return &User{ID: p.issuer + "#" + sub, Role: role, Provider: p.name(), Name: claims.str(p.nameClaim)}, nil
+}
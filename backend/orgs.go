@@ -0,0 +1,795 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Organizations group users; teams within them are what projects and
+// layers are shared to, so access follows team membership instead of a
+// grant per user. A team is referred to as "<org>/<team>".
+type OrgDoc struct {
+	ID          string      `bson:"_id" json:"id"`
+	Name        string      `bson:"name" json:"name"`
+	Description string      `bson:"description,omitempty" json:"description,omitempty"`
+	Members     []OrgMember `bson:"members" json:"members"`
+	Teams       []OrgTeam   `bson:"teams" json:"teams"`
+	CreatedBy   string      `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt   time.Time   `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time   `bson:"updated_at" json:"updated_at"`
+}
+
+// OrgMember is member or admin; org admins manage members and teams
+type OrgMember struct {
+	UserID string `bson:"user_id" json:"user_id"`
+	Role   string `bson:"role" json:"role"`
+}
+
+// OrgTeam is a named set of org members
+type OrgTeam struct {
+	ID      string   `bson:"id" json:"id"`
+	Name    string   `bson:"name" json:"name"`
+	Members []string `bson:"members" json:"members"`
+}
+
+// TeamGrant gives every member of a team a role (viewer, editor, admin)
+// on a project or layer
+type TeamGrant struct {
+	Team string `bson:"team" json:"team"`
+	Role string `bson:"role" json:"role"`
+}
+
+const (
+	orgMember = "member"
+	orgAdmin  = "admin"
+)
+
+var orgs *mongo.Collection
+
+func setupOrgs() {
+	orgs = db.Collection(getenv("MONGO_ORGS_COLLECTION", "organizations"))
+	for _, key := range []string{"members.user_id", "teams.members"} {
+		if _, err := orgs.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: key, Value: 1}}}); err != nil {
+			log.Printf("organizations index create warning: %v", err)
+		}
+	}
+	if _, err := projects.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "teams.team", Value: 1}}}); err != nil {
+		log.Printf("projects index create warning: %v", err)
+	}
+}
+
+func teamRef(org, team string) string {
+	return org + "/" + team
+}
+
+// userTeams lists the "<org>/<team>" refs of the teams the caller is in
+func userTeams(r *http.Request) ([]string, error) {
+	uid := userID(r)
+	if uid == "" {
+		return nil, nil
+	}
+	cur, err := orgs.Find(r.Context(), bson.M{"teams.members": uid}, options.Find().SetProjection(bson.M{"teams": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []OrgDoc
+	if err := cur.All(r.Context(), &docs); err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, o := range docs {
+		for _, t := range o.Teams {
+			for _, m := range t.Members {
+				if m == uid {
+					out = append(out, teamRef(o.ID, t.ID))
+					break
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// grantedRole is the highest role grants give to any of teams
+func grantedRole(grants []TeamGrant, teams []string) string {
+	role := ""
+	for _, g := range grants {
+		for _, t := range teams {
+			if g.Team == t && roleRanks[g.Role] > roleRanks[role] {
+				role = g.Role
+			}
+		}
+	}
+	return role
+}
+
+// teamsRole is what grants give the caller through team membership. A
+// failed lookup grants nothing and is logged.
+func teamsRole(r *http.Request, grants []TeamGrant) string {
+	if len(grants) == 0 {
+		return ""
+	}
+	teams, err := userTeams(r)
+	if err != nil {
+		log.Printf("team lookup warning: %v", err)
+		return ""
+	}
+	return grantedRole(grants, teams)
+}
+
+// layerRole is the caller's role for one layer's features: their global
+// role, raised by any team the layer is shared to
+func layerRole(r *http.Request, layer string) string {
+	if !authEnabled {
+		return "admin"
+	}
+	u := currentUser(r)
+	if u == nil {
+		return ""
+	}
+	role := u.Role
+	if layer == "" || u.hasRole("admin") {
+		return role
+	}
+	var doc LayerDoc
+	err := layers.FindOne(r.Context(), bson.M{"_id": layer}, options.FindOne().SetProjection(bson.M{"shares": 1})).Decode(&doc)
+	if err != nil {
+		return role
+	}
+	if g := teamsRole(r, doc.Shares); roleRanks[g] > roleRanks[role] {
+		role = g
+	}
+	return role
+}
+
+// requireLayerRole is requireRole for the features of one layer
+func requireLayerRole(w http.ResponseWriter, r *http.Request, layer, role string) bool {
+	if !authEnabled || currentUser(r).hasRole(role) {
+		return true
+	}
+	if currentUser(r) == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return false
+	}
+	if roleRanks[layerRole(r, layer)] < roleRanks[role] {
+		writeError(w, http.StatusForbidden, "forbidden", "forbidden")
+		return false
+	}
+	return true
+}
+
+// requireFeatureRole is requireLayerRole for the layer of a stored feature
+func requireFeatureRole(w http.ResponseWriter, r *http.Request, oid primitive.ObjectID, role string) bool {
+	if !authEnabled || currentUser(r).hasRole(role) {
+		return true
+	}
+	if currentUser(r) == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return false
+	}
+	var doc FeatureDoc
+	err := collection.FindOne(ctx, bson.M{"_id": oid}, options.FindOne().SetProjection(bson.M{"layer": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return false
+	}
+	return requireLayerRole(w, r, doc.Layer, role)
+}
+
+// sharedLayers lists the layers shared to any of the caller's teams
+func sharedLayers(r *http.Request) ([]string, error) {
+	teams, err := userTeams(r)
+	if err != nil || len(teams) == 0 {
+		return nil, err
+	}
+	ids, err := layers.Distinct(r.Context(), "_id", bson.M{"shares.team": bson.M{"$in": teams}})
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, v := range ids {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// orgRole is the caller's role in o; global admins act as org admins
+func orgRole(r *http.Request, o *OrgDoc) string {
+	if !authEnabled {
+		return orgAdmin
+	}
+	u := currentUser(r)
+	if u == nil {
+		return ""
+	}
+	if u.hasRole("admin") {
+		return orgAdmin
+	}
+	for _, m := range o.Members {
+		if m.UserID == u.ID {
+			return m.Role
+		}
+	}
+	return ""
+}
+
+// loadOrg fetches the org and checks the caller's role in it. Orgs the
+// caller doesn't belong to are reported as not found.
+func loadOrg(w http.ResponseWriter, r *http.Request, id string, admin bool) (*OrgDoc, bool) {
+	var o OrgDoc
+	err := orgs.FindOne(ctx, bson.M{"_id": id}).Decode(&o)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "organization not found")
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	have := orgRole(r, &o)
+	if have == "" {
+		writeError(w, http.StatusNotFound, "not_found", "organization not found")
+		return nil, false
+	}
+	if admin && have != orgAdmin {
+		writeError(w, http.StatusForbidden, "forbidden", "requires admin role in organization "+id)
+		return nil, false
+	}
+	return &o, true
+}
+
+func (o *OrgDoc) team(id string) *OrgTeam {
+	for i := range o.Teams {
+		if o.Teams[i].ID == id {
+			return &o.Teams[i]
+		}
+	}
+	return nil
+}
+
+func (o *OrgDoc) member(uid string) bool {
+	for _, m := range o.Members {
+		if m.UserID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+func saveOrg(w http.ResponseWriter, o *OrgDoc) bool {
+	o.UpdatedAt = time.Now().UTC()
+	_, err := orgs.UpdateOne(ctx, bson.M{"_id": o.ID}, bson.M{"$set": bson.M{
+		"name": o.Name, "description": o.Description, "members": o.Members, "teams": o.Teams, "updated_at": o.UpdatedAt,
+	}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// dropTeamGrants removes the grants of teams matching ref from projects
+// and layers, ref being a team or "<org>/" for all of an org's teams
+func dropTeamGrants(ref string) {
+	match := bson.M{"team": ref}
+	if strings.HasSuffix(ref, "/") {
+		match = bson.M{"team": bson.M{"$regex": "^" + regexp.QuoteMeta(ref)}}
+	}
+	if _, err := projects.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"teams": match}}); err != nil {
+		log.Printf("project team grant cleanup warning for %s: %v", ref, err)
+	}
+	if _, err := layers.UpdateMany(ctx, bson.M{}, bson.M{"$pull": bson.M{"shares": match}}); err != nil {
+		log.Printf("layer share cleanup warning for %s: %v", ref, err)
+	}
+}
+
+// GET /orgs lists the organizations the caller belongs to, or all of them
+// for admins
+func listOrgsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	filter := bson.M{}
+	if u := currentUser(r); authEnabled && !u.hasRole("admin") {
+		filter["members.user_id"] = u.ID
+	}
+	cur, err := orgs.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []OrgDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /orgs { id, name, description }
+// The creator becomes an org admin
+func createOrgHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var o OrgDoc
+	if !decodeJSON(w, r, &o) {
+		return
+	}
+	if !layerIDPattern.MatchString(o.ID) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid organization id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+	if o.Name == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid organization", FieldError{Field: "name", Message: "required"})
+		return
+	}
+	o.Members = []OrgMember{}
+	if uid := userID(r); uid != "" {
+		o.Members = append(o.Members, OrgMember{UserID: uid, Role: orgAdmin})
+	}
+	o.Teams = []OrgTeam{}
+	now := time.Now().UTC()
+	o.CreatedBy = userID(r)
+	o.CreatedAt, o.UpdatedAt = now, now
+	if _, err := orgs.InsertOne(ctx, o); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "organization "+o.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func getOrgHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadOrg(w, r, mux.Vars(r)["id"], false)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// PUT /orgs/{id} { name, description }
+func updateOrgHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadOrg(w, r, mux.Vars(r)["id"], true)
+	if !ok {
+		return
+	}
+	var body struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Name != nil {
+		if *body.Name == "" {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid organization", FieldError{Field: "name", Message: "required"})
+			return
+		}
+		o.Name = *body.Name
+	}
+	if body.Description != nil {
+		o.Description = *body.Description
+	}
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// DELETE /orgs/{id} removes the org and every grant to its teams
+func deleteOrgHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadOrg(w, r, mux.Vars(r)["id"], true)
+	if !ok {
+		return
+	}
+	if _, err := orgs.DeleteOne(ctx, bson.M{"_id": o.ID}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	dropTeamGrants(o.ID + "/")
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
+
+// PUT /orgs/{id}/members/{user} { role }
+func putOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	o, ok := loadOrg(w, r, vars["id"], true)
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Role != orgMember && body.Role != orgAdmin {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid role", FieldError{Field: "role", Message: "must be member or admin"})
+		return
+	}
+	found := false
+	for i := range o.Members {
+		if o.Members[i].UserID == vars["user"] {
+			o.Members[i].Role = body.Role
+			found = true
+		}
+	}
+	if !found {
+		o.Members = append(o.Members, OrgMember{UserID: vars["user"], Role: body.Role})
+	}
+	if !orgHasAdmin(o) {
+		writeError(w, http.StatusConflict, "conflict", "an organization needs at least one admin")
+		return
+	}
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o.Members)
+}
+
+// DELETE /orgs/{id}/members/{user} also takes the user off the org's
+// teams. The last org admin can't be removed.
+func deleteOrgMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	o, ok := loadOrg(w, r, vars["id"], true)
+	if !ok {
+		return
+	}
+	uid := vars["user"]
+	if !o.member(uid) {
+		writeError(w, http.StatusNotFound, "not_found", "not a member of this organization")
+		return
+	}
+	kept := []OrgMember{}
+	for _, m := range o.Members {
+		if m.UserID != uid {
+			kept = append(kept, m)
+		}
+	}
+	o.Members = kept
+	if !orgHasAdmin(o) {
+		writeError(w, http.StatusConflict, "conflict", "an organization needs at least one admin")
+		return
+	}
+	for i := range o.Teams {
+		o.Teams[i].Members = removeString(o.Teams[i].Members, uid)
+	}
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o.Members)
+}
+
+func orgHasAdmin(o *OrgDoc) bool {
+	for _, m := range o.Members {
+		if m.Role == orgAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	out := []string{}
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// POST /orgs/{id}/teams { id, name, members }
+// Members must already belong to the org
+func createTeamHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadOrg(w, r, mux.Vars(r)["id"], true)
+	if !ok {
+		return
+	}
+	var t OrgTeam
+	if !decodeJSON(w, r, &t) {
+		return
+	}
+	var errs []FieldError
+	if !layerIDPattern.MatchString(t.ID) {
+		errs = append(errs, FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+	}
+	if t.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "required"})
+	}
+	members := []string{}
+	for _, m := range t.Members {
+		if !o.member(m) {
+			errs = append(errs, FieldError{Field: "members", Message: m + " is not a member of the organization"})
+		}
+		members = append(removeString(members, m), m)
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid team", errs...)
+		return
+	}
+	if o.team(t.ID) != nil {
+		writeError(w, http.StatusConflict, "conflict", "team "+t.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+		return
+	}
+	t.Members = members
+	o.Teams = append(o.Teams, t)
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// DELETE /orgs/{id}/teams/{team} removes the team and its grants
+func deleteTeamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	o, ok := loadOrg(w, r, vars["id"], true)
+	if !ok {
+		return
+	}
+	if o.team(vars["team"]) == nil {
+		writeError(w, http.StatusNotFound, "not_found", "team not found")
+		return
+	}
+	kept := []OrgTeam{}
+	for _, t := range o.Teams {
+		if t.ID != vars["team"] {
+			kept = append(kept, t)
+		}
+	}
+	o.Teams = kept
+	if !saveOrg(w, o) {
+		return
+	}
+	dropTeamGrants(teamRef(o.ID, vars["team"]))
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
+
+// PUT /orgs/{id}/teams/{team}/members/{user}
+func putTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	o, ok := loadOrg(w, r, vars["id"], true)
+	if !ok {
+		return
+	}
+	t := o.team(vars["team"])
+	if t == nil {
+		writeError(w, http.StatusNotFound, "not_found", "team not found")
+		return
+	}
+	if !o.member(vars["user"]) {
+		writeError(w, http.StatusBadRequest, "validation_failed", vars["user"]+" is not a member of the organization")
+		return
+	}
+	t.Members = append(removeString(t.Members, vars["user"]), vars["user"])
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// DELETE /orgs/{id}/teams/{team}/members/{user}
+func deleteTeamMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	o, ok := loadOrg(w, r, vars["id"], true)
+	if !ok {
+		return
+	}
+	t := o.team(vars["team"])
+	if t == nil {
+		writeError(w, http.StatusNotFound, "not_found", "team not found")
+		return
+	}
+	kept := removeString(t.Members, vars["user"])
+	if len(kept) == len(t.Members) {
+		writeError(w, http.StatusNotFound, "not_found", "not a member of this team")
+		return
+	}
+	t.Members = kept
+	if !saveOrg(w, o) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// decodeTeamGrant reads { role } for a grant to the {org}/{team} in the
+// path, checking the team exists
+func decodeTeamGrant(w http.ResponseWriter, r *http.Request) (TeamGrant, bool) {
+	vars := mux.Vars(r)
+	var body struct {
+		Role string `json:"role"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return TeamGrant{}, false
+	}
+	if _, ok := roleRanks[body.Role]; !ok {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid role", FieldError{Field: "role", Message: "must be viewer, editor or admin"})
+		return TeamGrant{}, false
+	}
+	n, err := orgs.CountDocuments(ctx, bson.M{"_id": vars["org"], "teams.id": vars["team"]})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return TeamGrant{}, false
+	}
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "team not found")
+		return TeamGrant{}, false
+	}
+	return TeamGrant{Team: teamRef(vars["org"], vars["team"]), Role: body.Role}, true
+}
+
+func setGrant(grants []TeamGrant, g TeamGrant) []TeamGrant {
+	for i := range grants {
+		if grants[i].Team == g.Team {
+			grants[i].Role = g.Role
+			return grants
+		}
+	}
+	return append(grants, g)
+}
+
+func dropGrant(grants []TeamGrant, team string) ([]TeamGrant, bool) {
+	kept := []TeamGrant{}
+	for _, g := range grants {
+		if g.Team != team {
+			kept = append(kept, g)
+		}
+	}
+	return kept, len(kept) != len(grants)
+}
+
+// PUT /projects/{id}/teams/{org}/{team} { role }
+func putProjectTeamHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := loadProject(w, r, mux.Vars(r)["id"], "admin")
+	if !ok {
+		return
+	}
+	g, ok := decodeTeamGrant(w, r)
+	if !ok {
+		return
+	}
+	p.Teams = setGrant(p.Teams, g)
+	if !saveProjectTeams(w, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Teams)
+}
+
+// DELETE /projects/{id}/teams/{org}/{team}
+func deleteProjectTeamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p, ok := loadProject(w, r, vars["id"], "admin")
+	if !ok {
+		return
+	}
+	var found bool
+	if p.Teams, found = dropGrant(p.Teams, teamRef(vars["org"], vars["team"])); !found {
+		writeError(w, http.StatusNotFound, "not_found", "team has no grant on this project")
+		return
+	}
+	if !saveProjectTeams(w, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Teams)
+}
+
+func saveProjectTeams(w http.ResponseWriter, p *ProjectDoc) bool {
+	_, err := projects.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"teams": p.Teams, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// loadLayerShares fetches a layer for managing its shares, which takes a
+// global admin or an admin grant on the layer
+func loadLayerShares(w http.ResponseWriter, r *http.Request) (*LayerDoc, bool) {
+	id := mux.Vars(r)["id"]
+	if !requireLayerRole(w, r, id, "admin") {
+		return nil, false
+	}
+	var layer LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": id}).Decode(&layer)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	if layer.Shares == nil {
+		layer.Shares = []TeamGrant{}
+	}
+	return &layer, true
+}
+
+// GET /layers/{id}/shares
+func listLayerSharesHandler(w http.ResponseWriter, r *http.Request) {
+	layer, ok := loadLayerShares(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(layer.Shares)
+}
+
+// PUT /layers/{id}/shares/{org}/{team} { role }
+// Team editors may add, change and delete the layer's features; any
+// grant lets the team see a layer's working copy under publishing.
+func putLayerShareHandler(w http.ResponseWriter, r *http.Request) {
+	layer, ok := loadLayerShares(w, r)
+	if !ok {
+		return
+	}
+	g, ok := decodeTeamGrant(w, r)
+	if !ok {
+		return
+	}
+	layer.Shares = setGrant(layer.Shares, g)
+	if !saveLayerShares(w, layer) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(layer.Shares)
+}
+
+// DELETE /layers/{id}/shares/{org}/{team}
+func deleteLayerShareHandler(w http.ResponseWriter, r *http.Request) {
+	layer, ok := loadLayerShares(w, r)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(r)
+	var found bool
+	if layer.Shares, found = dropGrant(layer.Shares, teamRef(vars["org"], vars["team"])); !found {
+		writeError(w, http.StatusNotFound, "not_found", "layer is not shared to this team")
+		return
+	}
+	if !saveLayerShares(w, layer) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(layer.Shares)
+}
+
+func saveLayerShares(w http.ResponseWriter, layer *LayerDoc) bool {
+	_, err := layers.UpdateOne(ctx, bson.M{"_id": layer.ID}, bson.M{"$set": bson.M{"shares": layer.Shares, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return false
+	}
+	writeGeneration.Add(1)
+	return true
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// OpenStreetMap extracts. POST /import/osm?layer=&filter=&dryRun= takes an
+// .osm.pbf file and imports the nodes and ways whose tags match filter as
+// points, lines and (closed ways tagged as areas) polygons, with the tags
+// as properties plus osm_type and osm_id. The file is spooled to disk and
+// read twice: once to find the matching ways and the nodes they use, and
+// once to collect those nodes' coordinates, so memory grows with the
+// matches rather than the extract. Relations, multipolygons included, are
+// not imported. Features go through the GeoJSON importer and get its
+// report.
+//
+// A filter is alternatives separated by |, each conditions joined by &:
+//
+//	amenity=hospital             tag equals a value
+//	amenity=hospital,clinic      one of several values
+//	amenity                      tag present, as is amenity=*
+//	amenity!=parking             tag missing or another value
+//	amenity=hospital|healthcare=hospital&name
+type osmFilter [][]osmCondition
+
+type osmCondition struct {
+	key    string
+	values []string // nil for any value
+	negate bool
+}
+
+func parseOSMFilter(s string) (osmFilter, error) {
+	var f osmFilter
+	for _, alt := range strings.Split(s, "|") {
+		var conds []osmCondition
+		for _, term := range strings.Split(alt, "&") {
+			term = strings.TrimSpace(term)
+			if term == "" {
+				return nil, fmt.Errorf("empty condition in %q", alt)
+			}
+			var c osmCondition
+			key, value, hasValue := strings.Cut(term, "=")
+			if strings.HasSuffix(key, "!") {
+				c.negate, key = true, strings.TrimSuffix(key, "!")
+			}
+			c.key = strings.TrimSpace(key)
+			if c.key == "" {
+				return nil, fmt.Errorf("condition %q has no key", term)
+			}
+			if value = strings.TrimSpace(value); hasValue && value != "*" {
+				for _, v := range strings.Split(value, ",") {
+					c.values = append(c.values, strings.TrimSpace(v))
+				}
+			}
+			if c.negate && c.values == nil {
+				return nil, fmt.Errorf("%q needs a value to compare with", term)
+			}
+			conds = append(conds, c)
+		}
+		f = append(f, conds)
+	}
+	return f, nil
+}
+
+func (f osmFilter) match(tags map[string]string) bool {
+	for _, conds := range f {
+		ok := true
+		for _, c := range conds {
+			v, present := tags[c.key]
+			hit := present
+			if present && c.values != nil {
+				hit = false
+				for _, want := range c.values {
+					if v == want {
+						hit = true
+						break
+					}
+				}
+			}
+			if hit == c.negate {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// osmAreaKeys make a closed way a polygon unless area=no
+var osmAreaKeys = []string{"building", "landuse", "amenity", "leisure", "natural", "place", "shop", "tourism",
+	"man_made", "military", "aeroway", "historic", "office", "water", "boundary", "craft", "healthcare"}
+
+func osmIsArea(refs []int64, tags map[string]string) bool {
+	if len(refs) < 4 || refs[0] != refs[len(refs)-1] || tags["area"] == "no" {
+		return false
+	}
+	if tags["area"] == "yes" {
+		return true
+	}
+	for _, k := range osmAreaKeys {
+		if _, ok := tags[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+/* ---------------- PBF decoding ---------------- */
+
+// pbfMessage walks the fields of an encoded protobuf message
+type pbfMessage struct {
+	b []byte
+}
+
+var errPBFTruncated = errors.New("truncated protobuf message")
+
+// next returns the next field: its number, and for varint fields the
+// value, for length-delimited ones the bytes. Fixed width fields are
+// skipped over and returned empty.
+func (m *pbfMessage) next() (field int, v uint64, b []byte, err error) {
+	key, n := binary.Uvarint(m.b)
+	if n <= 0 {
+		return 0, 0, nil, errPBFTruncated
+	}
+	m.b = m.b[n:]
+	field = int(key >> 3)
+	switch key & 7 {
+	case 0:
+		if v, n = binary.Uvarint(m.b); n <= 0 {
+			return 0, 0, nil, errPBFTruncated
+		}
+		m.b = m.b[n:]
+	case 1, 5:
+		size := 8
+		if key&7 == 5 {
+			size = 4
+		}
+		if len(m.b) < size {
+			return 0, 0, nil, errPBFTruncated
+		}
+		m.b = m.b[size:]
+	case 2:
+		l, n := binary.Uvarint(m.b)
+		if n <= 0 || uint64(len(m.b)-n) < l {
+			return 0, 0, nil, errPBFTruncated
+		}
+		b, m.b = m.b[n:n+int(l)], m.b[n+int(l):]
+	default:
+		return 0, 0, nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+	}
+	return field, v, b, nil
+}
+
+func (m *pbfMessage) more() bool { return len(m.b) > 0 }
+
+func zigzag(v uint64) int64 { return int64(v>>1) ^ -int64(v&1) }
+
+// pbfPacked decodes a packed repeated varint field
+func pbfPacked(b []byte) ([]uint64, error) {
+	var out []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errPBFTruncated
+		}
+		out = append(out, v)
+		b = b[n:]
+	}
+	return out, nil
+}
+
+// osmElement is a node or way as read from a block
+type osmElement struct {
+	way  bool
+	id   int64
+	lon  float64
+	lat  float64
+	tags map[string]string
+	refs []int64
+}
+
+// maxPBFBlob is the largest blob the format allows
+const maxPBFBlob = 32 << 20
+
+// readPBF calls fn with every node and way of the file
+func readPBF(r io.Reader, fn func(e *osmElement) error) error {
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		if size > 64<<10 {
+			return fmt.Errorf("blob header of %d bytes is too large", size)
+		}
+		hb := make([]byte, size)
+		if _, err := io.ReadFull(r, hb); err != nil {
+			return err
+		}
+		var typ string
+		var dataSize uint64
+		h := pbfMessage{hb}
+		for h.more() {
+			field, v, b, err := h.next()
+			if err != nil {
+				return err
+			}
+			switch field {
+			case 1:
+				typ = string(b)
+			case 3:
+				dataSize = v
+			}
+		}
+		if dataSize > maxPBFBlob {
+			return fmt.Errorf("blob of %d bytes is too large", dataSize)
+		}
+		blob := make([]byte, dataSize)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return err
+		}
+		data, err := pbfBlobData(blob)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case "OSMHeader":
+			if err := checkPBFHeader(data); err != nil {
+				return err
+			}
+		case "OSMData":
+			if err := readPBFBlock(data, fn); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func pbfBlobData(blob []byte) ([]byte, error) {
+	m := pbfMessage{blob}
+	var rawSize uint64
+	var raw, compressed []byte
+	for m.more() {
+		field, v, b, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			raw = b
+		case 2:
+			rawSize = v
+		case 3:
+			compressed = b
+		case 4, 5, 6, 7:
+			return nil, fmt.Errorf("only zlib compressed PBF files are supported")
+		}
+	}
+	if compressed == nil {
+		return raw, nil
+	}
+	if rawSize > maxPBFBlob {
+		return nil, fmt.Errorf("blob of %d bytes is too large", rawSize)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	out := make([]byte, 0, rawSize)
+	buf := bytes.NewBuffer(out)
+	if _, err := io.Copy(buf, io.LimitReader(zr, maxPBFBlob)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkPBFHeader refuses files that need features this reader lacks, such
+// as history extracts
+func checkPBFHeader(data []byte) error {
+	m := pbfMessage{data}
+	for m.more() {
+		field, _, b, err := m.next()
+		if err != nil {
+			return err
+		}
+		if field == 4 {
+			switch string(b) {
+			case "OsmSchema-V0.6", "DenseNodes":
+			default:
+				return fmt.Errorf("PBF feature %s is not supported", b)
+			}
+		}
+	}
+	return nil
+}
+
+// pbfBlock is what the elements of a block are decoded with: its string
+// table and coordinate encoding
+type pbfBlock struct {
+	strs                              []string
+	granularity, latOffset, lonOffset int64
+}
+
+func (k *pbfBlock) str(i uint64) string {
+	if i < uint64(len(k.strs)) {
+		return k.strs[i]
+	}
+	return ""
+}
+
+func (k *pbfBlock) lat(v int64) float64 { return float64(k.latOffset+k.granularity*v) * 1e-9 }
+func (k *pbfBlock) lon(v int64) float64 { return float64(k.lonOffset+k.granularity*v) * 1e-9 }
+
+func (k *pbfBlock) tags(keys, vals []uint64) map[string]string {
+	if len(keys) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(keys))
+	for i := range keys {
+		if i < len(vals) {
+			tags[k.str(keys[i])] = k.str(vals[i])
+		}
+	}
+	return tags
+}
+
+func readPBFBlock(data []byte, fn func(e *osmElement) error) error {
+	k := &pbfBlock{granularity: 100}
+	var groups [][]byte
+	m := pbfMessage{data}
+	for m.more() {
+		field, v, b, err := m.next()
+		if err != nil {
+			return err
+		}
+		switch field {
+		case 1:
+			st := pbfMessage{b}
+			for st.more() {
+				f, _, s, err := st.next()
+				if err != nil {
+					return err
+				}
+				if f == 1 {
+					k.strs = append(k.strs, string(s))
+				}
+			}
+		case 2:
+			groups = append(groups, b)
+		case 17:
+			k.granularity = int64(v)
+		case 19:
+			k.latOffset = int64(v)
+		case 20:
+			k.lonOffset = int64(v)
+		}
+	}
+
+	for _, g := range groups {
+		gm := pbfMessage{g}
+		for gm.more() {
+			field, _, b, err := gm.next()
+			if err != nil {
+				return err
+			}
+			var e *osmElement
+			var elems []*osmElement
+			switch field {
+			case 1:
+				e, err = k.node(b)
+				elems = []*osmElement{e}
+			case 2:
+				elems, err = k.dense(b)
+			case 3:
+				e, err = k.way(b)
+				elems = []*osmElement{e}
+			default:
+				// relations and changesets
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range elems {
+				if err := fn(e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (k *pbfBlock) node(b []byte) (*osmElement, error) {
+	e := &osmElement{}
+	var keys, vals []uint64
+	var lat, lon int64
+	m := pbfMessage{b}
+	for m.more() {
+		field, v, p, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			e.id = zigzag(v)
+		case 2:
+			if keys, err = pbfPacked(p); err != nil {
+				return nil, err
+			}
+		case 3:
+			if vals, err = pbfPacked(p); err != nil {
+				return nil, err
+			}
+		case 8:
+			lat = zigzag(v)
+		case 9:
+			lon = zigzag(v)
+		}
+	}
+	e.tags = k.tags(keys, vals)
+	e.lat, e.lon = k.lat(lat), k.lon(lon)
+	return e, nil
+}
+
+func (k *pbfBlock) dense(b []byte) ([]*osmElement, error) {
+	var ids, lats, lons, kv []uint64
+	m := pbfMessage{b}
+	for m.more() {
+		field, _, p, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			ids, err = pbfPacked(p)
+		case 8:
+			lats, err = pbfPacked(p)
+		case 9:
+			lons, err = pbfPacked(p)
+		case 10:
+			kv, err = pbfPacked(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return nil, fmt.Errorf("dense nodes have %d ids but %d lats and %d lons", len(ids), len(lats), len(lons))
+	}
+	out := make([]*osmElement, len(ids))
+	var id, lat, lon int64
+	j := 0
+	for i := range ids {
+		id += zigzag(ids[i])
+		lat += zigzag(lats[i])
+		lon += zigzag(lons[i])
+		e := &osmElement{id: id, lat: k.lat(lat), lon: k.lon(lon)}
+		// keys_vals is key, value pairs per node, each list ended by 0
+		for j < len(kv) && kv[j] != 0 {
+			if j+1 >= len(kv) {
+				return nil, errPBFTruncated
+			}
+			if e.tags == nil {
+				e.tags = map[string]string{}
+			}
+			e.tags[k.str(kv[j])] = k.str(kv[j+1])
+			j += 2
+		}
+		j++
+		out[i] = e
+	}
+	return out, nil
+}
+
+func (k *pbfBlock) way(b []byte) (*osmElement, error) {
+	e := &osmElement{way: true}
+	var keys, vals, refs []uint64
+	m := pbfMessage{b}
+	for m.more() {
+		field, v, p, err := m.next()
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case 1:
+			e.id = int64(v)
+		case 2:
+			keys, err = pbfPacked(p)
+		case 3:
+			vals, err = pbfPacked(p)
+		case 8:
+			refs, err = pbfPacked(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.tags = k.tags(keys, vals)
+	var ref int64
+	e.refs = make([]int64, len(refs))
+	for i, d := range refs {
+		ref += zigzag(d)
+		e.refs[i] = ref
+	}
+	return e, nil
+}
+
+/* ---------------- import ---------------- */
+
+// osmProperties are an element's tags plus its type and id
+func osmProperties(kind string, id int64, tags map[string]string) map[string]interface{} {
+	props := map[string]interface{}{"osm_type": kind, "osm_id": id}
+	for k, v := range tags {
+		props[k] = v
+	}
+	return props
+}
+
+// osmFeature is a matched element as a GeoJSON Feature for the importer
+func osmFeature(kind string, id int64, tags map[string]string, geometry map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "Feature", "geometry": geometry, "properties": osmProperties(kind, id, tags)}
+}
+
+// POST /import/osm?layer=&filter=&dryRun=true
+func importOSMHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	filter, err := parseOSMFilter(r.URL.Query().Get("filter"))
+	if r.URL.Query().Get("filter") == "" {
+		err = fmt.Errorf("required, such as amenity=hospital")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid filter", FieldError{Field: "filter", Message: err.Error()})
+		return
+	}
+	f, err := os.CreateTemp("", "import-*.osm.pbf")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "spooling upload: "+err.Error())
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(r.Body, uploadMaxSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "reading body: "+err.Error())
+		return
+	}
+	if n > uploadMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("extracts are limited to %d bytes, send a smaller region", uploadMaxSize))
+		return
+	}
+
+	// first pass: the matching ways and the nodes they are drawn with
+	var ways []*osmElement
+	needed := map[int64][]float64{}
+	err = readPBF(f, func(e *osmElement) error {
+		if e.way && e.tags != nil && filter.match(e.tags) {
+			ways = append(ways, e)
+			for _, ref := range e.refs {
+				needed[ref] = nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "invalid OSM PBF: "+err.Error())
+		return
+	}
+
+	// second pass, feeding the GeoJSON importer as it goes: matching
+	// nodes, then the ways once every coordinate is known
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		io.WriteString(pw, `{"type":"FeatureCollection","features":[`)
+		sep := ""
+		emit := func(feature map[string]interface{}) error {
+			if _, err := io.WriteString(pw, sep); err != nil {
+				return err
+			}
+			sep = ","
+			return enc.Encode(feature)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		err := readPBF(f, func(e *osmElement) error {
+			if e.way {
+				return nil
+			}
+			if _, ok := needed[e.id]; ok {
+				needed[e.id] = []float64{e.lon, e.lat}
+			}
+			if e.tags != nil && filter.match(e.tags) {
+				return emit(osmFeature("node", e.id, e.tags, map[string]interface{}{"type": "Point", "coordinates": []float64{e.lon, e.lat}}))
+			}
+			return nil
+		})
+		for _, e := range ways {
+			if err != nil {
+				break
+			}
+			coords := make([][]float64, 0, len(e.refs))
+			for _, ref := range e.refs {
+				if p := needed[ref]; p != nil {
+					coords = append(coords, p)
+				}
+			}
+			// ways cut at the extract's edge lose their outside nodes
+			geometry := map[string]interface{}{"type": "LineString", "coordinates": coords}
+			if osmIsArea(e.refs, e.tags) && len(coords) == len(e.refs) {
+				geometry = map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{coords}}
+			}
+			err = emit(osmFeature("way", e.id, e.tags, geometry))
+		}
+		if err == nil {
+			_, err = io.WriteString(pw, "]}")
+		}
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	r2 := r.Clone(r.Context())
+	r2.Body = pr
+	r2.URL.RawQuery = url.Values{"layer": {r.URL.Query().Get("layer")}, "dryRun": {r.URL.Query().Get("dryRun")}}.Encode()
+	importGeoJSONHandler(w, r2)
+}
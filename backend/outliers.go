@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outlier detection. The outliers job kind scans one layer and flags
+// features whose numeric properties, polygon area, line length or distance
+// to their nearest neighbours stand out from the rest of the layer, by a
+// robust (median / MAD) z-score. Areas, lengths and distances are compared
+// on a log scale, so a footprint 100x the median area scores the same as
+// one 100x smaller. Flags are kept in outlier_flags; editors review them
+// with POST /outliers/{id}/review, and reviewed flags survive later runs.
+type OutlierFlag struct {
+	ID      string `bson:"_id" json:"id"`
+	Layer   string `bson:"layer" json:"layer"`
+	Feature string `bson:"feature" json:"feature"`
+	Name    string `bson:"name,omitempty" json:"name,omitempty"`
+	// Check is property:<key>, area, length or position
+	Check      string     `bson:"check" json:"check"`
+	Value      float64    `bson:"value" json:"value"`
+	Median     float64    `bson:"median" json:"median"`
+	Score      float64    `bson:"score" json:"score"`
+	Magnitude  float64    `bson:"magnitude" json:"-"`
+	Status     string     `bson:"status" json:"status"`
+	FlaggedAt  time.Time  `bson:"flagged_at" json:"flagged_at"`
+	ReviewedBy string     `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+	Note       string     `bson:"note,omitempty" json:"note,omitempty"`
+}
+
+// outlier flag statuses
+const (
+	outlierOpen      = "open"
+	outlierConfirmed = "confirmed"
+	outlierDismissed = "dismissed"
+)
+
+const (
+	defaultOutlierThreshold = 3.5
+	defaultOutlierNeighbors = 5
+	defaultOutlierMinValues = 10
+)
+
+var outlierFlags *mongo.Collection
+
+func setupOutliers() {
+	outlierFlags = db.Collection(getenv("MONGO_OUTLIER_FLAGS_COLLECTION", "outlier_flags"))
+	if _, err := outlierFlags.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "status", Value: 1}, {Key: "magnitude", Value: -1}}}); err != nil {
+		log.Printf("outlier flag index create warning: %v", err)
+	}
+}
+
+// robustScores is the modified z-score of each value, nil when the values
+// are too alike to tell outliers apart
+func robustScores(vals []float64) (scores []float64, median float64) {
+	if len(vals) == 0 {
+		return nil, 0
+	}
+	median = medianOf(vals)
+	dev := make([]float64, len(vals))
+	sum := 0.0
+	for i, v := range vals {
+		dev[i] = math.Abs(v - median)
+		sum += dev[i]
+	}
+	scale := medianOf(dev) / 0.6745
+	if scale == 0 {
+		// more than half the values are equal; fall back to the mean
+		// absolute deviation
+		scale = sum / float64(len(vals)) * 1.2533
+	}
+	if scale == 0 {
+		return nil, median
+	}
+	scores = make([]float64, len(vals))
+	for i, v := range vals {
+		scores[i] = (v - median) / scale
+	}
+	return scores, median
+}
+
+func medianOf(vals []float64) float64 {
+	s := append([]float64(nil), vals...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// neighborDistances is the mean distance in meters from each point to its
+// k nearest others, found through a grid of cells about as big as the
+// average spacing
+func neighborDistances(pts []Position, k int) []float64 {
+	n := len(pts)
+	out := make([]float64, n)
+	if n <= k {
+		return out
+	}
+	pl := newPlanar(pts)
+	xs, ys := make([]float64, n), make([]float64, n)
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for i, p := range pts {
+		xs[i], ys[i] = pl.xy(p)
+		minX, minY = math.Min(minX, xs[i]), math.Min(minY, ys[i])
+		maxX, maxY = math.Max(maxX, xs[i]), math.Max(maxY, ys[i])
+	}
+	cell := math.Max(math.Sqrt((maxX-minX)*(maxY-minY)/float64(n))*2, 1)
+	grid := map[[2]int][]int{}
+	key := func(x, y float64) [2]int { return [2]int{int((x - minX) / cell), int((y - minY) / cell)} }
+	for i := range pts {
+		c := key(xs[i], ys[i])
+		grid[c] = append(grid[c], i)
+	}
+	span := int(math.Max(maxX-minX, maxY-minY)/cell) + 1
+	for i := range pts {
+		c := key(xs[i], ys[i])
+		var best []float64
+		for ring := 0; ring <= span; ring++ {
+			for dx := -ring; dx <= ring; dx++ {
+				for dy := -ring; dy <= ring; dy++ {
+					if ring > 0 && dx != -ring && dx != ring && dy != -ring && dy != ring {
+						continue
+					}
+					for _, j := range grid[[2]int{c[0] + dx, c[1] + dy}] {
+						if j != i {
+							best = append(best, math.Hypot(xs[i]-xs[j], ys[i]-ys[j]))
+						}
+					}
+				}
+			}
+			sort.Float64s(best)
+			if len(best) > k {
+				best = best[:k]
+			}
+			// anything further out is at least ring*cell away
+			if len(best) == k && best[k-1] <= float64(ring)*cell {
+				break
+			}
+		}
+		sum := 0.0
+		for _, d := range best {
+			sum += d
+		}
+		out[i] = sum / float64(len(best))
+	}
+	return out
+}
+
+// outlierSample is what the checks need of one feature
+type outlierSample struct {
+	id, name string
+	props    map[string]float64
+	area     float64
+	length   float64
+	anchor   Position
+}
+
+func numericValue(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, !math.IsNaN(t) && !math.IsInf(t, 0)
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	}
+	return 0, false
+}
+
+// findOutliers runs every check over the samples. properties limits the
+// property checks to those keys, all numeric properties when empty.
+func findOutliers(layer string, samples []outlierSample, properties []string, threshold float64, neighbors, minValues int) []OutlierFlag {
+	var flags []OutlierFlag
+	check := func(name string, idx []int, vals []float64, logScale bool) {
+		if len(vals) < minValues {
+			return
+		}
+		in := vals
+		if logScale {
+			in = make([]float64, len(vals))
+			for i, v := range vals {
+				in[i] = math.Log10(v)
+			}
+		}
+		scores, median := robustScores(in)
+		if logScale {
+			median = math.Pow(10, median)
+		}
+		for i, z := range scores {
+			if math.Abs(z) > threshold {
+				s := samples[idx[i]]
+				h := fnv.New32a()
+				h.Write([]byte(name))
+				flags = append(flags, OutlierFlag{
+					ID: fmt.Sprintf("%s-%08x", s.id, h.Sum32()), Layer: layer, Feature: s.id, Name: s.name, Check: name,
+					Value: vals[i], Median: median, Score: math.Round(z*100) / 100, Magnitude: math.Round(math.Abs(z)*100) / 100,
+				})
+			}
+		}
+	}
+
+	keys := properties
+	if len(keys) == 0 {
+		seen := map[string]bool{}
+		for _, s := range samples {
+			for k := range s.props {
+				if !seen[k] {
+					seen[k] = true
+					keys = append(keys, k)
+				}
+			}
+		}
+		sort.Strings(keys)
+	}
+	for _, k := range keys {
+		var idx []int
+		var vals []float64
+		for i, s := range samples {
+			if v, ok := s.props[k]; ok {
+				idx, vals = append(idx, i), append(vals, v)
+			}
+		}
+		check("property:"+k, idx, vals, false)
+	}
+
+	var areaIdx, lengthIdx, posIdx []int
+	var areas, lengths []float64
+	var pts []Position
+	for i, s := range samples {
+		if s.area > 0 {
+			areaIdx, areas = append(areaIdx, i), append(areas, s.area)
+		}
+		if s.length > 0 {
+			lengthIdx, lengths = append(lengthIdx, i), append(lengths, s.length)
+		}
+		if s.anchor != nil {
+			posIdx, pts = append(posIdx, i), append(pts, s.anchor)
+		}
+	}
+	check("area", areaIdx, areas, true)
+	check("length", lengthIdx, lengths, true)
+	if neighbors > 0 && len(pts) > neighbors {
+		dists := neighborDistances(pts, neighbors)
+		var idx []int
+		var vals []float64
+		for i, d := range dists {
+			// stacked points are for the duplicate check of the quality
+			// report, not this one
+			if d > 0 {
+				idx, vals = append(idx, posIdx[i]), append(vals, d)
+			}
+		}
+		check("position", idx, vals, true)
+	}
+	return flags
+}
+
+// outliers {layer, properties: [..], threshold: 3.5, neighbors: 5, min_values: 10}
+func validateOutliers(params bson.M) []FieldError {
+	var errs []FieldError
+	if paramString(params, "layer") == "" {
+		errs = append(errs, FieldError{Field: "params.layer", Message: "required"})
+	}
+	if v, ok := params["threshold"]; ok {
+		if f, ok := numericValue(v); !ok || f <= 0 {
+			errs = append(errs, FieldError{Field: "params.threshold", Message: "must be a positive number"})
+		}
+	}
+	if paramInt(params, "neighbors", defaultOutlierNeighbors) < 0 {
+		errs = append(errs, FieldError{Field: "params.neighbors", Message: "must not be negative, 0 skips the position check"})
+	}
+	if paramInt(params, "min_values", defaultOutlierMinValues) < 3 {
+		errs = append(errs, FieldError{Field: "params.min_values", Message: "must be at least 3"})
+	}
+	if v, ok := params["properties"]; ok {
+		list, ok := asArray(v)
+		for _, p := range list {
+			if _, isString := p.(string); !isString {
+				ok = false
+			}
+		}
+		if !ok {
+			errs = append(errs, FieldError{Field: "params.properties", Message: "must be a list of property names"})
+		}
+	}
+	return errs
+}
+
+func runOutliers(c context.Context, j JobDoc) (string, error) {
+	layer := paramString(j.Params, "layer")
+	threshold := defaultOutlierThreshold
+	if f, ok := numericValue(j.Params["threshold"]); ok {
+		threshold = f
+	}
+	var properties []string
+	list, _ := asArray(j.Params["properties"])
+	for _, p := range list {
+		if s, ok := p.(string); ok {
+			properties = append(properties, s)
+		}
+	}
+
+	q := bson.M{"layer": layer, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	cur, err := heavyReads.Find(c, q, options.Find().SetProjection(bson.M{"name": 1, "geometry": 1, "properties": 1}))
+	if err != nil {
+		return "", err
+	}
+	defer cur.Close(c)
+	var samples []outlierSample
+	for cur.Next(c) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		s := outlierSample{id: doc.ID.Hex(), name: doc.Name, props: map[string]float64{}}
+		for k, v := range doc.Properties {
+			if f, ok := numericValue(v); ok {
+				s.props[k] = f
+			}
+		}
+		if g, err := parseGeometry(doc.Geometry); err == nil {
+			s.length, s.area = geometryMeasures(g)
+		}
+		if p, ok := featureAnchor(&doc); ok {
+			s.anchor = p
+		}
+		samples = append(samples, s)
+	}
+	if err := cur.Err(); err != nil {
+		return "", err
+	}
+
+	flags := findOutliers(layer, samples, properties, threshold, paramInt(j.Params, "neighbors", defaultOutlierNeighbors), paramInt(j.Params, "min_values", defaultOutlierMinValues))
+	now := time.Now().UTC()
+	for _, f := range flags {
+		// reviewed flags keep their review, with the latest numbers
+		_, err := outlierFlags.UpdateOne(c, bson.M{"_id": f.ID}, bson.M{
+			"$set": bson.M{"layer": f.Layer, "feature": f.Feature, "name": f.Name, "check": f.Check,
+				"value": f.Value, "median": f.Median, "score": f.Score, "magnitude": f.Magnitude, "flagged_at": now},
+			"$setOnInsert": bson.M{"status": outlierOpen},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return "", err
+		}
+	}
+	// open flags this run didn't raise again are resolved
+	res, err := outlierFlags.DeleteMany(c, bson.M{"layer": layer, "status": outlierOpen, "flagged_at": bson.M{"$lt": now}})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d features checked, %d flags, %d resolved", len(samples), len(flags), res.DeletedCount), nil
+}
+
+// GET /layers/{id}/outliers?status=open|confirmed|dismissed|all&check=
+func listOutliersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	query := r.URL.Query()
+	q := bson.M{"layer": mux.Vars(r)["id"]}
+	switch status := query.Get("status"); status {
+	case "":
+		q["status"] = outlierOpen
+	case outlierOpen, outlierConfirmed, outlierDismissed:
+		q["status"] = status
+	case "all":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid status", FieldError{Field: "status", Message: "must be one of open, confirmed, dismissed, all"})
+		return
+	}
+	if check := query.Get("check"); check != "" {
+		q["check"] = check
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if limit == 0 || limit > maxFeatures {
+		limit = maxFeatures
+	}
+	// the biggest deviations first
+	opts := options.Find().SetSort(bson.D{{Key: "magnitude", Value: -1}, {Key: "_id", Value: 1}}).SetLimit(limit).SetSkip(offset)
+	cur, err := outlierFlags.Find(r.Context(), q, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []OutlierFlag{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /outliers/{id}/review {status: confirmed|dismissed|open, note}
+func reviewOutlierHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Status != outlierConfirmed && body.Status != outlierDismissed && body.Status != outlierOpen {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid review", FieldError{Field: "status", Message: "must be one of confirmed, dismissed, open"})
+		return
+	}
+	now := time.Now().UTC()
+	var f OutlierFlag
+	err := outlierFlags.FindOneAndUpdate(r.Context(), bson.M{"_id": mux.Vars(r)["id"]},
+		bson.M{"$set": bson.M{"status": body.Status, "note": body.Note, "reviewed_by": userID(r), "reviewed_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "outlier flag not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
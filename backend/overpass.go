@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Overpass imports. POST /import/overpass runs an Overpass QL query
+// against OVERPASS_URL and upserts the tagged nodes and ways it returns
+// into a layer, keyed by external id osm:<type>:<id>, so running the same
+// query again refreshes them; the overpass job kind does that on a
+// schedule. Ways need their geometry in the result: "out geom", or their
+// nodes through "(._;>;); out". A way with only "out center" becomes a
+// point. Relations are skipped.
+var (
+	overpassURL    = "https://overpass-api.de/api/interpreter"
+	overpassClient = &http.Client{Timeout: 5 * time.Minute}
+)
+
+const maxOverpassBytes = 256 << 20
+
+var (
+	overpassOutSetting = regexp.MustCompile(`\[\s*out\s*:\s*(\w+)\s*\]`)
+	htmlTag            = regexp.MustCompile(`<[^>]+>`)
+)
+
+func setupOverpass() {
+	overpassURL = getenv("OVERPASS_URL", overpassURL)
+	if d, err := time.ParseDuration(getenv("OVERPASS_TIMEOUT", "")); err == nil && d > 0 {
+		overpassClient.Timeout = d
+	}
+}
+
+// overpassQuery makes sure q answers in JSON
+func overpassQuery(q string) (string, error) {
+	q = strings.TrimSpace(q)
+	if q == "" {
+		return "", fmt.Errorf("required")
+	}
+	if m := overpassOutSetting.FindStringSubmatch(q); m != nil {
+		if m[1] != "json" {
+			return "", fmt.Errorf("must use [out:json], not [out:%s]", m[1])
+		}
+		return q, nil
+	}
+	return "[out:json];" + q, nil
+}
+
+type overpassElement struct {
+	Type     string            `json:"type"`
+	ID       int64             `json:"id"`
+	Lat      *float64          `json:"lat"`
+	Lon      *float64          `json:"lon"`
+	Tags     map[string]string `json:"tags"`
+	Nodes    []int64           `json:"nodes"`
+	Geometry []*struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"geometry"`
+	Center *struct {
+		Lat float64 `json:"lat"`
+		Lon float64 `json:"lon"`
+	} `json:"center"`
+}
+
+// runOverpass runs query and turns the tagged elements of the result into
+// upsert records, counting the elements skipped
+func runOverpass(c context.Context, query string) ([]syncRecord, int, error) {
+	q, err := overpassQuery(query)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(c, "POST", overpassURL, strings.NewReader(url.Values{"data": {q}}.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := overpassClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 2048))
+		return nil, 0, fmt.Errorf("overpass returned %s: %s", res.Status, overpassRemark(msg))
+	}
+	var out struct {
+		Remark   string            `json:"remark"`
+		Elements []overpassElement `json:"elements"`
+	}
+	body := io.LimitReader(res.Body, maxOverpassBytes)
+	if err := json.NewDecoder(body).Decode(&out); err != nil {
+		return nil, 0, fmt.Errorf("invalid overpass response: %v", err)
+	}
+	// a query that runs out of time or memory still answers 200
+	if strings.Contains(out.Remark, "runtime error") {
+		return nil, 0, fmt.Errorf("overpass: %s", out.Remark)
+	}
+
+	nodes := map[int64][]float64{}
+	for _, e := range out.Elements {
+		if e.Type == "node" && e.Lat != nil && e.Lon != nil {
+			nodes[e.ID] = []float64{*e.Lon, *e.Lat}
+		}
+	}
+	var records []syncRecord
+	skipped := 0
+	for _, e := range out.Elements {
+		if len(e.Tags) == 0 || (e.Type != "node" && e.Type != "way") {
+			// way nodes and relations
+			skipped++
+			continue
+		}
+		var geometry map[string]interface{}
+		switch {
+		case e.Type == "node" && e.Lat != nil && e.Lon != nil:
+			geometry = map[string]interface{}{"type": "Point", "coordinates": []float64{*e.Lon, *e.Lat}}
+		case e.Type == "way":
+			var coords [][]float64
+			for _, p := range e.Geometry {
+				if p != nil {
+					coords = append(coords, []float64{p.Lon, p.Lat})
+				}
+			}
+			if len(e.Geometry) == 0 {
+				for _, id := range e.Nodes {
+					if p := nodes[id]; p != nil {
+						coords = append(coords, p)
+					}
+				}
+			}
+			switch {
+			case len(coords) >= 2 && osmIsArea(e.Nodes, e.Tags) && len(coords) == len(e.Nodes):
+				geometry = map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{coords}}
+			case len(coords) >= 2:
+				geometry = map[string]interface{}{"type": "LineString", "coordinates": coords}
+			case e.Center != nil:
+				geometry = map[string]interface{}{"type": "Point", "coordinates": []float64{e.Center.Lon, e.Center.Lat}}
+			}
+		}
+		rec := syncRecord{key: fmt.Sprintf("osm:%s:%d", e.Type, e.ID)}
+		if geometry == nil {
+			rec.err = fmt.Errorf("%s/%d has no geometry, use out geom", e.Type, e.ID)
+		}
+		rec.in = map[string]interface{}{"geojson": geometry, "properties": osmProperties(e.Type, e.ID, e.Tags)}
+		if name := e.Tags["name"]; name != "" {
+			rec.in["name"] = name
+		}
+		records = append(records, rec)
+	}
+	return records, skipped, nil
+}
+
+// overpassRemark is the gist of an Overpass error page
+func overpassRemark(page []byte) string {
+	s := htmlTag.ReplaceAllString(string(page), " ")
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// OverpassInput is the body of POST /import/overpass
+type OverpassInput struct {
+	Query  string `json:"query"`
+	Layer  string `json:"layer"`
+	DryRun bool   `json:"dry_run"`
+}
+
+// OverpassReport summarizes an Overpass import
+type OverpassReport struct {
+	DryRun   bool   `json:"dry_run"`
+	Features int    `json:"features"`
+	Skipped  int    `json:"skipped"`
+	Created  int    `json:"created"`
+	Updated  int    `json:"updated"`
+	Failed   int    `json:"failed"`
+	Error    string `json:"first_error,omitempty"`
+}
+
+// POST /import/overpass {query, layer, dry_run}
+func importOverpassHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var in OverpassInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	var errs []FieldError
+	if _, err := overpassQuery(in.Query); err != nil {
+		errs = append(errs, FieldError{Field: "query", Message: err.Error()})
+	}
+	if in.Layer == "" {
+		errs = append(errs, FieldError{Field: "layer", Message: "required"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid overpass import", errs...)
+		return
+	}
+	records, skipped, err := runOverpass(r.Context(), in.Query)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "upstream_error", err.Error())
+		return
+	}
+	rep := OverpassReport{DryRun: in.DryRun, Features: len(records), Skipped: skipped}
+	if in.DryRun {
+		for _, rec := range records {
+			if rec.err != nil {
+				rep.Failed++
+				if rep.Error == "" {
+					rep.Error = rec.err.Error()
+				}
+			}
+		}
+	} else {
+		var firstErr error
+		rep.Created, rep.Updated, rep.Failed, firstErr = upsertSyncRecords(records, in.Layer, func(key string, body io.Reader) *http.Request {
+			req, _ := http.NewRequestWithContext(r.Context(), "PUT", "/features/by-external-id/"+url.PathEscape(key), body)
+			return mux.SetURLVars(req, map[string]string{"key": key})
+		})
+		if firstErr != nil {
+			rep.Error = firstErr.Error()
+		}
+		notify(Event{
+			Type:    eventImportCompleted,
+			Subject: "Overpass import completed",
+			Message: fmt.Sprintf("%d created, %d updated and %d failed in layer %q.", rep.Created, rep.Updated, rep.Failed, in.Layer),
+			Data:    map[string]interface{}{"layer": in.Layer, "created": rep.Created, "updated": rep.Updated, "failed": rep.Failed},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
+
+// overpass {query, layer}: the same import as a job
+func validateOverpassJob(params bson.M) []FieldError {
+	var errs []FieldError
+	if _, err := overpassQuery(paramString(params, "query")); err != nil {
+		errs = append(errs, FieldError{Field: "params.query", Message: err.Error()})
+	}
+	if paramString(params, "layer") == "" {
+		errs = append(errs, FieldError{Field: "params.layer", Message: "required"})
+	}
+	return errs
+}
+
+func runOverpassJob(c context.Context, j JobDoc) (string, error) {
+	records, skipped, err := runOverpass(c, paramString(j.Params, "query"))
+	if err != nil {
+		return "", err
+	}
+	created, updated, failed, firstErr := upsertSyncRecords(records, paramString(j.Params, "layer"), func(key string, body io.Reader) *http.Request {
+		return jobRequest(j, "PUT", "/features/by-external-id/"+url.PathEscape(key), body, map[string]string{"key": key})
+	})
+	msg := fmt.Sprintf("%d created, %d updated, %d failed, %d skipped", created, updated, failed, skipped)
+	if failed > 0 {
+		return msg, firstErr
+	}
+	return msg, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A small PDF writer for generated documents: A4 pages, the standard
+// Helvetica fonts in WinAnsi encoding, so nothing is embedded, and vector
+// drawing. Positions are in points from the top left of the page; the
+// writer flips them into PDF's bottom-left space.
+
+const (
+	pdfPageW = 595.28
+	pdfPageH = 841.89
+)
+
+// pdfColor is RGB, each 0 to 1
+type pdfColor [3]float64
+
+func pdfRGB(hex uint32) pdfColor {
+	return pdfColor{float64(hex>>16&0xff) / 255, float64(hex>>8&0xff) / 255, float64(hex&0xff) / 255}
+}
+
+type pdfDoc struct {
+	Title string
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+}
+
+func (d *pdfDoc) addPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+}
+
+// pdfNum formats a coordinate without trailing zeros
+func pdfNum(v float64) string {
+	s := strconv.FormatFloat(v, 'f', 2, 64)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	if s == "-0" || s == "" {
+		return "0"
+	}
+	return s
+}
+
+func (d *pdfDoc) op(args ...interface{}) {
+	for i, a := range args {
+		if i > 0 {
+			d.page.WriteByte(' ')
+		}
+		switch v := a.(type) {
+		case float64:
+			d.page.WriteString(pdfNum(v))
+		default:
+			fmt.Fprint(d.page, v)
+		}
+	}
+	d.page.WriteByte('\n')
+}
+
+func (d *pdfDoc) fill(c pdfColor)   { d.op(c[0], c[1], c[2], "rg") }
+func (d *pdfDoc) stroke(c pdfColor) { d.op(c[0], c[1], c[2], "RG") }
+func (d *pdfDoc) lineWidth(w float64) {
+	d.op(w, "w")
+}
+func (d *pdfDoc) save()    { d.op("q") }
+func (d *pdfDoc) restore() { d.op("Q") }
+
+// rect adds a rectangle to the path; paint it with f, S or B
+func (d *pdfDoc) rect(x, y, w, h float64, paint string) {
+	d.op(x, pdfPageH-y-h, w, h, "re", paint)
+}
+
+func (d *pdfDoc) line(x1, y1, x2, y2 float64) {
+	d.op(x1, pdfPageH-y1, "m", x2, pdfPageH-y2, "l", "S")
+}
+
+// path adds a polyline, closed when it is a ring, without painting it, so
+// several rings can make one even-odd filled polygon
+func (d *pdfDoc) path(pts [][2]float64, closed bool) {
+	for i, p := range pts {
+		if i == 0 {
+			d.op(p[0], pdfPageH-p[1], "m")
+		} else {
+			d.op(p[0], pdfPageH-p[1], "l")
+		}
+	}
+	if closed {
+		d.op("h")
+	}
+}
+
+func (d *pdfDoc) paint(paint string) { d.op(paint) }
+
+// circle adds a circle from four Bézier arcs and paints it
+func (d *pdfDoc) circle(x, y, r float64, paint string) {
+	const k = 0.5523
+	y = pdfPageH - y
+	d.op(x+r, y, "m")
+	d.op(x+r, y+r*k, x+r*k, y+r, x, y+r, "c")
+	d.op(x-r*k, y+r, x-r, y+r*k, x-r, y, "c")
+	d.op(x-r, y-r*k, x-r*k, y-r, x, y-r, "c")
+	d.op(x+r*k, y-r, x+r, y-r*k, x+r, y, "c")
+	d.op(paint)
+}
+
+// clip limits drawing to the rectangle until the matching restore
+func (d *pdfDoc) clip(x, y, w, h float64) {
+	d.save()
+	d.op(x, pdfPageH-y-h, w, h, "re", "W", "n")
+}
+
+// text writes s with its baseline at y
+func (d *pdfDoc) text(x, y, size float64, bold bool, s string) {
+	font := "/F1"
+	if bold {
+		font = "/F2"
+	}
+	d.op("BT", font, size, "Tf", x, pdfPageH-y, "Td", pdfString(s), "Tj", "ET")
+}
+
+// textRight writes s ending at x
+func (d *pdfDoc) textRight(x, y, size float64, bold bool, s string) {
+	d.text(x-pdfTextWidth(s, size, bold), y, size, bold, s)
+}
+
+// pdfFit shortens s with an ellipsis to fit width
+func pdfFit(s string, width, size float64, bold bool) string {
+	if pdfTextWidth(s, size, bold) <= width {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && pdfTextWidth(string(r)+"…", size, bold) > width {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "…"
+}
+
+// pdfWrap breaks s into lines no wider than width
+func pdfWrap(s string, width, size float64, bold bool) []string {
+	var lines []string
+	line := ""
+	for _, w := range strings.Fields(s) {
+		next := w
+		if line != "" {
+			next = line + " " + w
+		}
+		if line != "" && pdfTextWidth(next, size, bold) > width {
+			lines = append(lines, line)
+			next = w
+		}
+		line = next
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Helvetica and Helvetica-Bold advance widths for ASCII 32 to 126, in
+// thousandths of the font size
+var pdfWidths = [2][95]uint16{{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}, {
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}}
+
+func pdfTextWidth(s string, size float64, bold bool) float64 {
+	font := 0
+	if bold {
+		font = 1
+	}
+	var w int
+	for _, c := range pdfEncode(s) {
+		if c >= 32 && c <= 126 {
+			w += int(pdfWidths[font][c-32])
+		} else {
+			// close enough for the accented letters
+			w += 556
+		}
+	}
+	return float64(w) * size / 1000
+}
+
+// WinAnsi codes for the characters outside Latin-1 that reports use
+var pdfWinAnsi = map[rune]byte{'€': 0x80, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97}
+
+func pdfEncode(s string) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r >= 32 && r <= 126 || r >= 160 && r <= 255:
+			out = append(out, byte(r))
+		case pdfWinAnsi[r] != 0:
+			out = append(out, pdfWinAnsi[r])
+		default:
+			out = append(out, '?')
+		}
+	}
+	return out
+}
+
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range pdfEncode(s) {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c > 126:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// bytes assembles the document
+func (d *pdfDoc) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range d.pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfNum(pdfPageW), pdfNum(pdfPageH), 6+2*i))
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(p.Bytes())
+		zw.Close()
+		obj(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.String()))
+	}
+	obj("<< /Title " + pdfString(d.Title) + " /Producer (gis-mongo-backend) >>")
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, len(offsets), xref)
+	return out.Bytes()
+}
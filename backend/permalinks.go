@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Feature permalinks and the QR codes printed on asset tags. A permalink is
+// FEATURE_PERMALINK_URL with {id} replaced, by default this server's
+// /?feature={id}. It can carry a share token, "<expiry unix, 0 for
+// never>.<signature>", that lets whoever holds it read that one feature
+// even when it is private, so a tag on a restricted asset still opens for
+// the field crew scanning it. Tokens are signed with SHARE_SECRET; changing
+// it revokes every token handed out. Unlike the other signing keys the one
+// it replaces is not kept: share tokens may never expire, so there is no
+// grace period to wait out.
+
+const (
+	defaultQRScale = 8
+	maxQRScale     = 40
+	maxShareTTL    = 5 * 365 * 24 * time.Hour
+)
+
+var (
+	shareKeys        keyRing
+	featurePermalink string
+)
+
+func setupPermalinks() {
+	featurePermalink = getenv("FEATURE_PERMALINK_URL", "")
+	watchSecret("SHARE_SECRET", func(v string) {
+		if v != "" {
+			shareKeys.reset([]byte(v))
+		}
+	})
+	if s := getsecret("SHARE_SECRET", ""); s != "" {
+		shareKeys.reset([]byte(s))
+		return
+	}
+	log.Printf("SHARE_SECRET not set: feature share tokens stop working on restart")
+	key := make([]byte, 32)
+	rand.Read(key)
+	shareKeys.reset(key)
+}
+
+func signShare(key []byte, id string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("share|" + id + "|" + strconv.FormatInt(expires, 10)))
+	// 128 bits is plenty and keeps the QR code small
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// makeShareToken grants reading feature id until exp, forever when exp is
+// zero
+func makeShareToken(id string, exp time.Time) string {
+	var unix int64
+	if !exp.IsZero() {
+		unix = exp.Unix()
+	}
+	return strconv.FormatInt(unix, 10) + "." + signShare(shareKeys.current(), id, unix)
+}
+
+func checkShareToken(token, id string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || exp < 0 || exp != 0 && time.Now().Unix() > exp {
+		return false
+	}
+	for _, key := range shareKeys.all() {
+		if hmac.Equal([]byte(parts[1]), []byte(signShare(key, id, exp))) {
+			return true
+		}
+	}
+	return false
+}
+
+// permalinkFor is the link that opens feature id in the map, with the share
+// token when there is one
+func permalinkFor(r *http.Request, id, token string) string {
+	link := requestBaseURL(r) + "/?feature={id}"
+	if featurePermalink != "" {
+		link = featurePermalink
+	}
+	link = strings.ReplaceAll(link, "{id}", url.PathEscape(id))
+	if token != "" {
+		// keep a #fragment, if the template has one, at the end
+		base, frag, hasFrag := strings.Cut(link, "#")
+		sep := "?"
+		if strings.Contains(base, "?") {
+			sep = "&"
+		}
+		link = base + sep + "share=" + url.QueryEscape(token)
+		if hasFrag {
+			link += "#" + frag
+		}
+	}
+	return link
+}
+
+// loadSharedFeature reads feature id as the caller may see it, or as anyone
+// may with a valid ?share= token for it. It writes the error response and
+// returns false when there is nothing to show.
+func loadSharedFeature(w http.ResponseWriter, r *http.Request) (FeatureDoc, string, bool) {
+	var doc FeatureDoc
+	id := mux.Vars(r)["id"]
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return doc, "", false
+	}
+	q := bson.M{"_id": oid}
+	if !applyStatusFilter(w, r, q) || !applyPublicationFilter(w, r, q) {
+		return doc, "", false
+	}
+	token := r.URL.Query().Get("share")
+	if token != "" && !checkShareToken(token, id) {
+		writeError(w, http.StatusForbidden, "forbidden", "invalid or expired share token")
+		return doc, "", false
+	}
+	if token == "" {
+		applyVisibilityFilter(r, q)
+	}
+	err = readsFor(r).FindOne(r.Context(), q).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return doc, "", false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return doc, "", false
+	}
+	return doc, token, true
+}
+
+// GET /features/{id}?share= is the feature the permalink opens
+func getFeatureHandler(w http.ResponseWriter, r *http.Request) {
+	doc, _, ok := loadSharedFeature(w, r)
+	if !ok {
+		return
+	}
+	revealDoc(r, &doc)
+	w.Header().Set("Content-Type", "application/geo+json")
+	json.NewEncoder(w).Encode(featureToGeoJSON(doc))
+}
+
+// GET /features/{id}/qr?format=png|svg&scale=8&ec=L|M|Q|H&share=
+// encodes the permalink. A valid ?share= token is carried over into the
+// link; editors get a new one with ?share=new and an optional ttl=720h
+// (without it the token never expires, as printed tags usually should).
+func featureQRHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid format", FieldError{Field: "format", Message: "must be png or svg"})
+		return
+	}
+	scale := defaultQRScale
+	if s := query.Get("scale"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxQRScale {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid scale", FieldError{Field: "scale", Message: "pixels per module, between 1 and " + strconv.Itoa(maxQRScale)})
+			return
+		}
+		scale = n
+	}
+	lvl := qrLevelM
+	if s := query.Get("ec"); s != "" {
+		l, ok := qrLevels[strings.ToUpper(s)]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid ec", FieldError{Field: "ec", Message: "must be L, M, Q or H"})
+			return
+		}
+		lvl = l
+	}
+
+	var token string
+	if query.Get("share") == "new" {
+		oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+			return
+		}
+		if !requireFeatureRole(w, r, oid, "editor") {
+			return
+		}
+		var exp time.Time
+		if s := query.Get("ttl"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 || d > maxShareTTL {
+				writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid ttl", FieldError{Field: "ttl", Message: "a duration such as 720h, at most five years"})
+				return
+			}
+			exp = time.Now().Add(d)
+		}
+		// the feature must exist for the token to mean anything
+		n, err := collection.CountDocuments(r.Context(), bson.M{"_id": oid}, options.Count().SetLimit(1))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+			return
+		}
+		if n == 0 {
+			writeError(w, http.StatusNotFound, "not_found", "feature not found")
+			return
+		}
+		token = makeShareToken(oid.Hex(), exp)
+	} else {
+		_, t, ok := loadSharedFeature(w, r)
+		if !ok {
+			return
+		}
+		token = t
+	}
+
+	link := permalinkFor(r, mux.Vars(r)["id"], token)
+	code, err := encodeQR([]byte(link), lvl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error()+": "+link)
+		return
+	}
+	w.Header().Set("X-Permalink", link)
+	if token != "" {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(code.SVG())
+		return
+	}
+	out, err := code.PNG(scale)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "render_error", "png encode error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.Write(out)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Report photos come from phones and carry where and when they were taken,
+// and with what. stripPhotoMetadata removes the EXIF, XMP, IPTC and text
+// blocks without decoding the image, so pixels and colour profile stay as
+// they were.
+
+var errPhotoFormat = errors.New("not a well-formed image")
+
+func stripPhotoMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	}
+	return nil, errPhotoFormat
+}
+
+// stripJPEGMetadata drops the APP1 (EXIF, XMP), APP13 (IPTC) and comment
+// segments ahead of the scan data
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errPhotoFormat
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xff {
+			return nil, errPhotoFormat
+		}
+		marker := data[i+1:]
+		if len(marker) == 0 {
+			return nil, errPhotoFormat
+		}
+		switch m := marker[0]; {
+		case m == 0xff: // fill byte
+			i++
+			continue
+		case m == 0x01 || m >= 0xd0 && m <= 0xd7: // no length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		case m == 0xd9: // end of image
+			out.Write(data[i : i+2])
+			return out.Bytes(), nil
+		}
+		if i+4 > len(data) {
+			return nil, errPhotoFormat
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return nil, errPhotoFormat
+		}
+		switch data[i+1] {
+		case 0xe1, 0xed, 0xfe:
+		case 0xda: // start of scan: the rest is image data
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return nil, errPhotoFormat
+}
+
+// PNG chunks holding metadata rather than pixels
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(sig)) {
+		return nil, errPhotoFormat
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(sig)
+	for i := len(sig); i+12 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + n
+		if n < 0 || end > len(data) || end < i {
+			return nil, errPhotoFormat
+		}
+		typ := string(data[i+4 : i+8])
+		if !pngMetadataChunks[typ] {
+			out.Write(data[i:end])
+		}
+		if typ == "IEND" {
+			return out.Bytes(), nil
+		}
+		i = end
+	}
+	return nil, errPhotoFormat
+}
+
+// stripWebPMetadata drops the EXIF and XMP chunks and their VP8X flags
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errPhotoFormat
+	}
+	out := make([]byte, 12, len(data))
+	copy(out, data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errPhotoFormat
+		}
+		n := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + n + n&1
+		if n < 0 || end > len(data)+n&1 || end < i {
+			return nil, errPhotoFormat
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		switch fourcc := string(data[i : i+4]); fourcc {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := len(out)
+			out = append(out, data[i:end]...)
+			if n > 0 {
+				out[start+8] &^= 0x08 | 0x04 // EXIF and XMP present
+			}
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
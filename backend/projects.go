@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ProjectMember gives a user a role (viewer, editor, admin) within a project
+type ProjectMember struct {
+	UserID string `bson:"user_id" json:"user_id"`
+	Role   string `bson:"role" json:"role"`
+}
+
+// MapSettings is the initial map view for a project
+type MapSettings struct {
+	Center  []float64 `bson:"center,omitempty" json:"center,omitempty"` // lon, lat
+	Zoom    float64   `bson:"zoom,omitempty" json:"zoom,omitempty"`
+	Basemap string    `bson:"basemap,omitempty" json:"basemap,omitempty"`
+}
+
+// ProjectDoc groups layers and members for one mapping initiative
+type ProjectDoc struct {
+	ID          string          `bson:"_id" json:"id"`
+	Name        string          `bson:"name" json:"name"`
+	Description string          `bson:"description,omitempty" json:"description,omitempty"`
+	Layers      []string        `bson:"layers" json:"layers"`
+	Members     []ProjectMember `bson:"members" json:"members"`
+	// Teams grants roles to whole teams, see orgs.go
+	Teams []TeamGrant `bson:"teams,omitempty" json:"teams,omitempty"`
+	Map   MapSettings `bson:"map" json:"map"`
+	// public projects can be read by anyone; private ones only by members
+	Public    bool      `bson:"public" json:"public"`
+	CreatedBy string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+var projects *mongo.Collection
+
+func setupProjects() {
+	projects = db.Collection(getenv("MONGO_PROJECTS_COLLECTION", "projects"))
+	if _, err := projects.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "members.user_id", Value: 1}}}); err != nil {
+		log.Printf("projects index create warning: %v", err)
+	}
+}
+
+// projectRole is the caller's effective role in p, the highest of its
+// member and team grants: global admins act as project admins, and with
+// auth disabled everyone is.
+func projectRole(r *http.Request, p *ProjectDoc) string {
+	if !authEnabled {
+		return "admin"
+	}
+	u := currentUser(r)
+	if u == nil {
+		if p.Public {
+			return "viewer"
+		}
+		return ""
+	}
+	if u.hasRole("admin") {
+		return "admin"
+	}
+	role := ""
+	if p.Public {
+		role = "viewer"
+	}
+	for _, m := range p.Members {
+		if m.UserID == u.ID && roleRanks[m.Role] > roleRanks[role] {
+			role = m.Role
+		}
+	}
+	if g := teamsRole(r, p.Teams); roleRanks[g] > roleRanks[role] {
+		role = g
+	}
+	return role
+}
+
+// loadProject fetches the project and checks the caller holds at least role
+// in it. Private projects the caller can't see are reported as not found.
+func loadProject(w http.ResponseWriter, r *http.Request, id, role string) (*ProjectDoc, bool) {
+	var p ProjectDoc
+	err := projects.FindOne(ctx, bson.M{"_id": id}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "project not found")
+		return nil, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	have := projectRole(r, &p)
+	if have == "" {
+		writeError(w, http.StatusNotFound, "not_found", "project not found")
+		return nil, false
+	}
+	if roleRanks[have] < roleRanks[role] {
+		writeError(w, http.StatusForbidden, "forbidden", "requires "+role+" role in project "+id)
+		return nil, false
+	}
+	return &p, true
+}
+
+func validateProject(p *ProjectDoc) []FieldError {
+	var errs []FieldError
+	if p.Name == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "required"})
+	}
+	for _, l := range p.Layers {
+		if !layerIDPattern.MatchString(l) {
+			errs = append(errs, FieldError{Field: "layers", Message: "invalid layer id " + l})
+		}
+	}
+	for _, m := range p.Members {
+		if m.UserID == "" {
+			errs = append(errs, FieldError{Field: "members", Message: "user_id required"})
+		}
+		if _, ok := roleRanks[m.Role]; !ok {
+			errs = append(errs, FieldError{Field: "members", Message: "role must be viewer, editor or admin"})
+		}
+	}
+	if c := p.Map.Center; c != nil && (len(c) != 2 || c[0] < -180 || c[0] > 180 || c[1] < -90 || c[1] > 90) {
+		errs = append(errs, FieldError{Field: "map.center", Message: "expected [lon, lat]"})
+	}
+	if p.Map.Zoom < 0 || p.Map.Zoom > 24 {
+		errs = append(errs, FieldError{Field: "map.zoom", Message: "must be between 0 and 24"})
+	}
+	return errs
+}
+
+// GET /projects lists the projects the caller can see
+func listProjectsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if u := currentUser(r); authEnabled && !u.hasRole("admin") {
+		or := bson.A{bson.M{"public": true}}
+		if u != nil {
+			or = append(or, bson.M{"members.user_id": u.ID})
+			teams, err := userTeams(r)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+				return
+			}
+			if len(teams) > 0 {
+				or = append(or, bson.M{"teams.team": bson.M{"$in": teams}})
+			}
+		}
+		filter["$or"] = or
+	}
+	cur, err := projects.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []ProjectDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /projects { id, name, description, layers, members, map, public }
+// The creator becomes a project admin
+func createProjectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var p ProjectDoc
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if !layerIDPattern.MatchString(p.ID) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid project id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, at most 64 characters"})
+		return
+	}
+	if p.Layers == nil {
+		p.Layers = []string{}
+	}
+	uid := userID(r)
+	if uid != "" {
+		p.Members = setMember(p.Members, ProjectMember{UserID: uid, Role: "admin"})
+	}
+	if p.Members == nil {
+		p.Members = []ProjectMember{}
+	}
+	// teams are granted through /projects/{id}/teams once it exists
+	p.Teams = nil
+	if errs := validateProject(&p); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid project", errs...)
+		return
+	}
+	now := time.Now().UTC()
+	p.CreatedBy = uid
+	p.CreatedAt, p.UpdatedAt = now, now
+	if _, err := projects.InsertOne(ctx, p); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "project "+p.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func getProjectHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := loadProject(w, r, mux.Vars(r)["id"], "viewer")
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// PUT /projects/{id} { name, description, layers, map, public }
+// Project editors may change layers and map settings; renaming and
+// visibility need a project admin. Members are managed separately.
+func updateProjectHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := loadProject(w, r, mux.Vars(r)["id"], "editor")
+	if !ok {
+		return
+	}
+	var body struct {
+		Name        *string      `json:"name"`
+		Description *string      `json:"description"`
+		Layers      []string     `json:"layers"`
+		Map         *MapSettings `json:"map"`
+		Public      *bool        `json:"public"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if (body.Name != nil || body.Public != nil) && projectRole(r, p) != "admin" {
+		writeError(w, http.StatusForbidden, "forbidden", "requires admin role in project "+p.ID)
+		return
+	}
+	if body.Name != nil {
+		p.Name = *body.Name
+	}
+	if body.Description != nil {
+		p.Description = *body.Description
+	}
+	if body.Layers != nil {
+		p.Layers = body.Layers
+	}
+	if body.Map != nil {
+		p.Map = *body.Map
+	}
+	if body.Public != nil {
+		p.Public = *body.Public
+	}
+	if errs := validateProject(p); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid project", errs...)
+		return
+	}
+	p.UpdatedAt = time.Now().UTC()
+	_, err := projects.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{
+		"name": p.Name, "description": p.Description, "layers": p.Layers, "map": p.Map, "public": p.Public, "updated_at": p.UpdatedAt,
+	}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func setMember(members []ProjectMember, m ProjectMember) []ProjectMember {
+	for i := range members {
+		if members[i].UserID == m.UserID {
+			members[i].Role = m.Role
+			return members
+		}
+	}
+	return append(members, m)
+}
+
+// PUT /projects/{id}/members/{user} { role }
+func putProjectMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p, ok := loadProject(w, r, vars["id"], "admin")
+	if !ok {
+		return
+	}
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	if _, ok := roleRanks[body.Role]; !ok {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid role", FieldError{Field: "role", Message: "must be viewer, editor or admin"})
+		return
+	}
+	p.Members = setMember(p.Members, ProjectMember{UserID: vars["user"], Role: body.Role})
+	if !saveProjectMembers(w, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Members)
+}
+
+// DELETE /projects/{id}/members/{user}
+// The last project admin can't be removed
+func deleteProjectMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	p, ok := loadProject(w, r, vars["id"], "admin")
+	if !ok {
+		return
+	}
+	kept := []ProjectMember{}
+	admins := 0
+	for _, m := range p.Members {
+		if m.UserID == vars["user"] {
+			continue
+		}
+		if m.Role == "admin" {
+			admins++
+		}
+		kept = append(kept, m)
+	}
+	if len(kept) == len(p.Members) {
+		writeError(w, http.StatusNotFound, "not_found", "not a member of this project")
+		return
+	}
+	if admins == 0 {
+		writeError(w, http.StatusConflict, "conflict", "a project needs at least one admin")
+		return
+	}
+	p.Members = kept
+	if !saveProjectMembers(w, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Members)
+}
+
+func saveProjectMembers(w http.ResponseWriter, p *ProjectDoc) bool {
+	_, err := projects.UpdateOne(ctx, bson.M{"_id": p.ID}, bson.M{"$set": bson.M{"members": p.Members, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// applyProjectFilter limits a feature listing to ?project=<id>'s layers,
+// after checking the caller may view the project
+func applyProjectFilter(w http.ResponseWriter, r *http.Request, q bson.M) bool {
+	id := r.URL.Query().Get("project")
+	if id == "" {
+		return true
+	}
+	p, ok := loadProject(w, r, id, "viewer")
+	if !ok {
+		return false
+	}
+	if layer, ok := q["layer"].(string); ok {
+		// a layer outside the project matches nothing
+		in := false
+		for _, l := range p.Layers {
+			in = in || l == layer
+		}
+		if !in {
+			q["layer"] = bson.M{"$in": bson.A{}}
+		}
+		return true
+	}
+	q["layer"] = bson.M{"$in": p.Layers}
+	return true
+}
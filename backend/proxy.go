@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Behind a reverse proxy the peer address is the proxy's and the scheme and
+// host are the proxy's upstream ones. TRUSTED_PROXIES lists the addresses or
+// CIDR ranges (e.g. 127.0.0.1,10.0.0.0/8) whose Forwarded or
+// X-Forwarded-For/-Proto/-Host headers are believed; from anyone else those
+// headers are ignored, since clients can send them too. ACCESS_LOG=true logs
+// every request with the resolved client address.
+var (
+	trustedProxies []*net.IPNet
+	accessLog      bool
+)
+
+const clientCtxKey ctxKey = "client"
+
+// clientInfo is where a request really came from
+type clientInfo struct {
+	ip     string
+	scheme string
+	host   string
+}
+
+func setupProxies() {
+	for _, s := range strings.Split(getenv("TRUSTED_PROXIES", ""), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Printf("TRUSTED_PROXIES: ignoring %q: %v", s, err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, n)
+	}
+	accessLog = getenv("ACCESS_LOG", "") == "true"
+}
+
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedElements parses an RFC 7239 Forwarded header into its elements,
+// nearest hop last
+func forwardedElements(h string) []map[string]string {
+	var out []map[string]string
+	for _, elem := range strings.Split(h, ",") {
+		m := map[string]string{}
+		for _, pair := range strings.Split(elem, ";") {
+			k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			v = strings.Trim(v, `"`)
+			if k = strings.ToLower(k); k == "for" {
+				// [2001:db8::1]:4711 and 192.0.2.1:80 carry ports
+				if host, _, err := net.SplitHostPort(v); err == nil {
+					v = host
+				}
+				v = strings.Trim(v, "[]")
+			}
+			m[k] = v
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+// resolveClient works out the client of r. The forwarding chain is walked
+// from the nearest hop back while hops are trusted proxies; the first
+// untrusted address is the client.
+func resolveClient(r *http.Request) clientInfo {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	c := clientInfo{ip: peer, scheme: "http", host: r.Host}
+	if r.TLS != nil {
+		c.scheme = "https"
+	}
+	if !trustedProxy(peer) {
+		return c
+	}
+	var hops []string
+	var elems []map[string]string
+	var proto, host string
+	if h := r.Header.Values("Forwarded"); len(h) > 0 {
+		elems = forwardedElements(strings.Join(h, ","))
+		for _, e := range elems {
+			hops = append(hops, e["for"])
+		}
+	} else {
+		for _, h := range r.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(h, ",") {
+				hops = append(hops, strings.TrimSpace(ip))
+			}
+		}
+		proto = strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0])
+		host = strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Host"), ",")[0])
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// obfuscated or unknown identifiers end the usable chain
+			break
+		}
+		c.ip = hops[i]
+		if elems != nil {
+			// each element was added by the proxy that received the request
+			// from its for address; the outermost trusted one saw it as the
+			// client sent it
+			proto, host = elems[i]["proto"], elems[i]["host"]
+		}
+		if !trustedProxy(hops[i]) {
+			break
+		}
+	}
+	if proto = strings.ToLower(proto); proto == "http" || proto == "https" {
+		c.scheme = proto
+	}
+	if host != "" && !strings.ContainsAny(host, "/ \\") {
+		c.host = host
+	}
+	return c
+}
+
+// proxyMiddleware resolves the client of every request, so handlers read
+// clientIP and requestBaseURL instead of RemoteAddr and Host
+func proxyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := resolveClient(r)
+		r = r.WithContext(context.WithValue(r.Context(), clientCtxKey, c))
+		if !accessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		log.Printf("%s %s %s %d %s %s", c.ip, r.Method, r.URL.RequestURI(), rec.status, time.Since(start).Round(time.Millisecond), w.Header().Get("X-Request-ID"))
+	})
+}
+
+func requestClient(r *http.Request) clientInfo {
+	if c, ok := r.Context().Value(clientCtxKey).(clientInfo); ok {
+		return c
+	}
+	return resolveClient(r)
+}
+
+// clientIP is the address of the client behind any trusted proxies
+func clientIP(r *http.Request) string {
+	return requestClient(r).ip
+}
+
+// requestBaseURL is scheme://host as the client addressed the server, for
+// building absolute links
+func requestBaseURL(r *http.Request) string {
+	c := requestClient(r)
+	return c.scheme + "://" + c.host
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Publishing. A layer under the publishing workflow has a publication
+// state: its live features are a working copy only editors see, and
+// POST /layers/{id}/publish freezes the approved features into a numbered
+// version that anyone can read from /layers/{id}/published. Versions are
+// never changed afterwards, so what was released stays what was reviewed.
+const (
+	publicationDraft     = "draft"
+	publicationPublished = "published"
+)
+
+// LayerPublication is the publication state of a layer
+type LayerPublication struct {
+	State string `bson:"state" json:"state"`
+	// Version is the latest published version, 0 before the first
+	Version     int        `bson:"version" json:"version"`
+	PublishedAt *time.Time `bson:"published_at,omitempty" json:"published_at,omitempty"`
+	PublishedBy string     `bson:"published_by,omitempty" json:"published_by,omitempty"`
+}
+
+// LayerVersion describes one published version of a layer
+type LayerVersion struct {
+	ID          string        `bson:"_id" json:"-"`
+	Layer       string        `bson:"layer" json:"layer"`
+	Version     int           `bson:"version" json:"version"`
+	Note        string        `bson:"note,omitempty" json:"note,omitempty"`
+	Features    int           `bson:"features" json:"features"`
+	License     *LayerLicense `bson:"license,omitempty" json:"license,omitempty"`
+	PublishedBy string        `bson:"published_by,omitempty" json:"published_by,omitempty"`
+	PublishedAt time.Time     `bson:"published_at" json:"published_at"`
+	// Complete is set once all features are copied, only complete versions
+	// are served
+	Complete bool `bson:"complete" json:"-"`
+}
+
+var (
+	layerVersions     *mongo.Collection
+	publishedFeatures *mongo.Collection
+)
+
+const publishBatch = 1000
+
+func setupPublishing() {
+	layerVersions = db.Collection(getenv("MONGO_LAYER_VERSIONS_COLLECTION", "layer_versions"))
+	publishedFeatures = db.Collection(getenv("MONGO_PUBLISHED_FEATURES_COLLECTION", "published_features"))
+	if _, err := layerVersions.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "version", Value: -1}}}); err != nil {
+		log.Printf("layer version index create warning: %v", err)
+	}
+	if _, err := publishedFeatures.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "version", Value: 1}}}); err != nil {
+		log.Printf("published feature index create warning: %v", err)
+	}
+}
+
+// hiddenLayers lists the layers whose live features the caller may not
+// see: those under the publishing workflow, unless the caller is an editor
+// or the layer is shared to one of their teams
+func hiddenLayers(r *http.Request) ([]string, error) {
+	if !authEnabled || currentUser(r).hasRole("editor") {
+		return nil, nil
+	}
+	ids, err := layers.Distinct(r.Context(), "_id", bson.M{"publication": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	shared, err := sharedLayers(r)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, v := range ids {
+		s, ok := v.(string)
+		for _, l := range shared {
+			ok = ok && l != s
+		}
+		if ok {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
+// applyPublicationFilter keeps the working copy of layers under the
+// publishing workflow out of a feature listing for non-editors
+func applyPublicationFilter(w http.ResponseWriter, r *http.Request, q bson.M) bool {
+	hidden, err := hiddenLayers(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db distinct error: "+err.Error())
+		return false
+	}
+	if len(hidden) == 0 {
+		return true
+	}
+	switch l := q["layer"].(type) {
+	case string:
+		for _, h := range hidden {
+			if l == h {
+				q["layer"] = bson.M{"$in": bson.A{}}
+			}
+		}
+	case bson.M:
+		m := bson.M{"$nin": hidden}
+		for k, v := range l {
+			m[k] = v
+		}
+		q["layer"] = m
+	default:
+		q["layer"] = bson.M{"$nin": hidden}
+	}
+	return true
+}
+
+// loadPublication is the publication state of layer id, writing 404 when
+// the layer doesn't exist
+func loadPublication(w http.ResponseWriter, r *http.Request) (*LayerDoc, bool) {
+	var doc LayerDoc
+	err := layers.FindOne(r.Context(), bson.M{"_id": mux.Vars(r)["id"]}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	return &doc, true
+}
+
+// GET /layers/{id}/publication
+func getPublicationHandler(w http.ResponseWriter, r *http.Request) {
+	doc, ok := loadPublication(w, r)
+	if !ok {
+		return
+	}
+	if doc.Publication == nil {
+		writeError(w, http.StatusNotFound, "not_found", "layer is not under the publishing workflow")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(doc.Publication)
+}
+
+// POST /layers/{id}/draft puts a layer under the publishing workflow, or
+// back into draft. The published versions stay readable.
+func draftLayerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	doc, ok := loadPublication(w, r)
+	if !ok {
+		return
+	}
+	p := LayerPublication{State: publicationDraft}
+	if doc.Publication != nil {
+		p = *doc.Publication
+		p.State = publicationDraft
+	}
+	if !savePublication(w, r, doc.ID, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// DELETE /layers/{id}/publication takes a layer out of the publishing
+// workflow: its live features become public again. Admins only, as that
+// releases whatever is in the working copy.
+func deletePublicationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	res, err := layers.UpdateOne(r.Context(), bson.M{"_id": mux.Vars(r)["id"]}, bson.M{"$unset": bson.M{"publication": ""}, "$set": bson.M{"updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	writeGeneration.Add(1)
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
+
+func savePublication(w http.ResponseWriter, r *http.Request, layer string, p LayerPublication) bool {
+	_, err := layers.UpdateOne(r.Context(), bson.M{"_id": layer}, bson.M{"$set": bson.M{"publication": p, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return false
+	}
+	writeGeneration.Add(1)
+	return true
+}
+
+// POST /layers/{id}/publish { note } copies the approved features of a
+// layer into a new immutable version and serves it to the public
+func publishLayerHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 && !decodeJSON(w, r, &body) {
+		return
+	}
+	doc, ok := loadPublication(w, r)
+	if !ok {
+		return
+	}
+	if doc.Publication == nil {
+		writeError(w, http.StatusConflict, "conflict", "layer is not under the publishing workflow, POST /layers/"+doc.ID+"/draft first")
+		return
+	}
+	// the version record is written first and claims the number, a
+	// concurrent publish of the same version fails on its _id
+	version := doc.Publication.Version + 1
+	now := time.Now().UTC()
+	v := LayerVersion{
+		ID: fmt.Sprintf("%s|%d", doc.ID, version), Layer: doc.ID, Version: version, Note: body.Note,
+		License: doc.License, PublishedBy: userID(r), PublishedAt: now,
+	}
+	if _, err := layerVersions.InsertOne(r.Context(), v); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "version "+strconv.Itoa(version)+" is being published concurrently")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	n, err := freezeFeatures(r, doc.ID, strconv.Itoa(version), bson.M{"version": version})
+	if err == nil {
+		v.Features, v.Complete = n, true
+		_, err = layerVersions.UpdateOne(r.Context(), bson.M{"_id": v.ID}, bson.M{"$set": bson.M{"features": n, "complete": true}})
+	}
+	if err != nil {
+		// drop the partial copy, it was never served
+		publishedFeatures.DeleteMany(ctx, bson.M{"layer": doc.ID, "version": version})
+		layerVersions.DeleteOne(ctx, bson.M{"_id": v.ID})
+		writeError(w, http.StatusInternalServerError, "db_error", "publish error: "+err.Error())
+		return
+	}
+	p := LayerPublication{State: publicationPublished, Version: version, PublishedAt: &now, PublishedBy: userID(r)}
+	if !savePublication(w, r, doc.ID, p) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+// freezeFeatures copies the approved, public features of layer into
+// published_features, tagged with fields ({version} or {release}). Each
+// feature is kept as it is stored so sensitive properties stay encrypted.
+func freezeFeatures(r *http.Request, layer, tag string, fields bson.M) (int, error) {
+	q := bson.M{"layer": layer, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}, "visibility": bson.M{"$nin": notPublic}}
+	cur, err := heavyReads.Find(r.Context(), q, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(r.Context())
+	n := 0
+	var batch []interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := publishedFeatures.InsertMany(r.Context(), batch, options.InsertMany().SetOrdered(false))
+		batch = batch[:0]
+		return err
+	}
+	for cur.Next(r.Context()) {
+		var f bson.Raw
+		if err := cur.Decode(&f); err != nil {
+			return n, err
+		}
+		id := f.Lookup("_id").ObjectID()
+		doc := bson.M{"_id": layer + "|" + tag + "|" + id.Hex(), "layer": layer, "feature": f}
+		for k, v := range fields {
+			doc[k] = v
+		}
+		batch = append(batch, doc)
+		n++
+		if len(batch) == publishBatch {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// publishedCursor yields the features stored in a version
+type publishedCursor struct {
+	*mongo.Cursor
+}
+
+func (c publishedCursor) Decode(v interface{}) error {
+	var doc struct {
+		Feature bson.Raw `bson:"feature"`
+	}
+	if err := c.Cursor.Decode(&doc); err != nil {
+		return err
+	}
+	return bson.Unmarshal(doc.Feature, v)
+}
+
+// GET /layers/{id}/versions lists the published versions, newest first
+func listLayerVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: -1}})
+	cur, err := layerVersions.Find(r.Context(), bson.M{"layer": mux.Vars(r)["id"], "complete": true}, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LayerVersion{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /layers/{id}/published serves the latest published version as
+// GeoJSON, GET /layers/{id}/versions/{version} an earlier one
+func publishedLayerHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["id"]
+	q := bson.M{"layer": layer, "complete": true}
+	opts := options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})
+	if s, ok := mux.Vars(r)["version"]; ok {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid version", FieldError{Field: "version", Message: "must be a positive integer"})
+			return
+		}
+		q["version"] = n
+	}
+	var v LayerVersion
+	err := layerVersions.FindOne(r.Context(), q, opts).Decode(&v)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "no published version")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	// a version never changes
+	etag := fmt.Sprintf(`"%s-v%d"`, layer, v.Version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Layer-Version", strconv.Itoa(v.Version))
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	cur, err := publishedFeatures.Find(r.Context(), bson.M{"layer": layer, "version": v.Version}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeGeoJSONCursor(w, r, publishedCursor{cur}, v.License)
+}
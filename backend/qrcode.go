@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// A QR code encoder (ISO/IEC 18004) for the permalinks printed on asset
+// tags. It only does byte mode, which is all a URL needs, and picks the
+// smallest version that holds the data at the requested error correction
+// level and the mask with the lowest penalty, as the standard describes.
+
+type qrLevel int
+
+const (
+	qrLevelL qrLevel = iota
+	qrLevelM
+	qrLevelQ
+	qrLevelH
+)
+
+// qrLevels maps ?ec= to a level
+var qrLevels = map[string]qrLevel{"L": qrLevelL, "M": qrLevelM, "Q": qrLevelQ, "H": qrLevelH}
+
+// the format information bits of each level
+var qrLevelBits = [4]int{1, 0, 3, 2}
+
+// error correction codewords per block and number of blocks, by level and
+// version (index 0 unused)
+var qrECCPerBlock = [4][41]int{
+	{0, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{0, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{0, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var qrBlocks = [4][41]int{
+	{0, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{0, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{0, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+var errQRTooLong = errors.New("data too long for a QR code")
+
+// QRCode is an encoded symbol; Modules[y][x] is true for dark modules
+type QRCode struct {
+	Version int
+	Size    int
+	Modules [][]bool
+
+	function [][]bool
+}
+
+// qrRawModules is the number of modules of a version available for data
+// and error correction, remainder bits included
+func qrRawModules(ver int) int {
+	n := (16*ver+128)*ver + 64
+	if ver >= 2 {
+		align := ver/7 + 2
+		n -= (25*align-10)*align - 55
+		if ver >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// qrDataCodewords is the number of data codewords of a version and level
+func qrDataCodewords(ver int, lvl qrLevel) int {
+	return qrRawModules(ver)/8 - qrECCPerBlock[lvl][ver]*qrBlocks[lvl][ver]
+}
+
+// qrAlignment lists the centre coordinates of the alignment patterns
+func qrAlignment(ver int) []int {
+	if ver == 1 {
+		return nil
+	}
+	n := ver/7 + 2
+	step := (ver*8 + n*3 + 5) / (n*4 - 4) * 2
+	out := make([]int, n)
+	out[0] = 6
+	for i, pos := n-1, ver*4+10; i >= 1; i, pos = i-1, pos-step {
+		out[i] = pos
+	}
+	return out
+}
+
+// encodeQR encodes data in byte mode at level lvl
+func encodeQR(data []byte, lvl qrLevel) (*QRCode, error) {
+	ver := 1
+	for ; ver <= 40; ver++ {
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= qrDataCodewords(ver, lvl)*8 {
+			break
+		}
+	}
+	if ver > 40 {
+		return nil, errQRTooLong
+	}
+	codewords := qrAddECC(qrDataBits(data, ver, lvl), ver, lvl)
+
+	q := &QRCode{Version: ver, Size: ver*4 + 17}
+	q.Modules = make([][]bool, q.Size)
+	q.function = make([][]bool, q.Size)
+	for i := range q.Modules {
+		q.Modules[i] = make([]bool, q.Size)
+		q.function[i] = make([]bool, q.Size)
+	}
+	q.drawFunctionPatterns(lvl)
+	q.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(lvl, mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		// masking is its own inverse
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(lvl, best)
+	return q, nil
+}
+
+// qrDataBits lays out the mode, length and data, then the terminator and
+// padding up to the version's data capacity
+func qrDataBits(data []byte, ver int, lvl qrLevel) []byte {
+	var bits []bool
+	put := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	put(0b0100, 4)
+	if ver >= 10 {
+		put(len(data), 16)
+	} else {
+		put(len(data), 8)
+	}
+	for _, b := range data {
+		put(int(b), 8)
+	}
+	capacity := qrDataCodewords(ver, lvl) * 8
+	put(0, min(4, capacity-len(bits)))
+	put(0, (8-len(bits)%8)%8)
+	for pad := 0xec; len(bits) < capacity; pad ^= 0xec ^ 0x11 {
+		put(pad, 8)
+	}
+	out := make([]byte, len(bits)/8)
+	for i, b := range bits {
+		if b {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// qrAddECC splits data into blocks, appends each block's Reed-Solomon
+// codewords and interleaves them
+func qrAddECC(data []byte, ver int, lvl qrLevel) []byte {
+	blocks, eccLen := qrBlocks[lvl][ver], qrECCPerBlock[lvl][ver]
+	raw := qrRawModules(ver) / 8
+	short := blocks - raw%blocks
+	shortLen := raw / blocks
+	divisor := rsDivisor(eccLen)
+	var out [][]byte
+	k := 0
+	for i := 0; i < blocks; i++ {
+		n := shortLen - eccLen
+		if i >= short {
+			n++
+		}
+		dat := data[k : k+n]
+		k += n
+		block := append([]byte{}, dat...)
+		if i < short {
+			// a placeholder so all blocks line up when interleaving
+			block = append(block, 0)
+		}
+		out = append(out, append(block, rsRemainder(dat, divisor)...))
+	}
+	var result []byte
+	for i := range out[0] {
+		for j, b := range out {
+			if i != shortLen-eccLen || j >= short {
+				result = append(result, b[i])
+			}
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMul(x, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		hi := z >> 7
+		z = z<<1 ^ hi*0x1d
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// rsDivisor is the generator polynomial of the given degree, highest
+// coefficient (always 1) dropped
+func rsDivisor(degree int) []byte {
+	out := make([]byte, degree)
+	out[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range out {
+			out[j] = gfMul(out[j], root)
+			if j+1 < len(out) {
+				out[j] ^= out[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return out
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	out := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ out[0]
+		copy(out, out[1:])
+		out[len(out)-1] = 0
+		for i, c := range divisor {
+			out[i] ^= gfMul(c, factor)
+		}
+	}
+	return out
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.Modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns(lvl qrLevel) {
+	for i := 0; i < q.Size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.Size - 4, 3}, {3, q.Size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < q.Size && y >= 0 && y < q.Size {
+					d := max(iabs(dx), iabs(dy))
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	align := qrAlignment(q.Version)
+	last := len(align) - 1
+	for i, ay := range align {
+		for j, ax := range align {
+			// the corners taken by the finder patterns
+			if i == 0 && j == 0 || i == 0 && j == last || i == last && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(ax+dx, ay+dy, max(iabs(dx), iabs(dy)) != 1)
+				}
+			}
+		}
+	}
+	// reserve the format areas; drawFormat fills them in
+	q.drawFormat(lvl, 0)
+	if q.Version >= 7 {
+		rem := q.Version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := q.Version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.Size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+func (q *QRCode) drawFormat(lvl qrLevel, mask int) {
+	data := qrLevelBits[lvl]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.Size-15+i, bit(i))
+	}
+	q.set(8, q.Size-8, true)
+}
+
+// drawCodewords fills the non-function modules in the zigzag order, two
+// columns at a time from the bottom right
+func (q *QRCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// skip the vertical timing pattern
+			right = 5
+		}
+		for vert := 0; vert < q.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.Size - 1 - vert
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.Modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.function[y][x] {
+				q.Modules[y][x] = !q.Modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the four rules of the standard: runs of one
+// colour, 2x2 blocks, finder-like patterns and the dark/light balance
+func (q *QRCode) penalty() int {
+	n := q.Size
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return q.Modules[x][y]
+		}
+		return q.Modules[y][x]
+	}
+	score := 0
+	for _, t := range []bool{false, true} {
+		for y := 0; y < n; y++ {
+			run := 1
+			for x := 1; x <= n; x++ {
+				if x < n && at(x, y, t) == at(x-1, y, t) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			// 1:1:3:1:1 with four light modules on either side
+			for x := 0; x+7 <= n; x++ {
+				if !(at(x, y, t) && !at(x+1, y, t) && at(x+2, y, t) && at(x+3, y, t) && at(x+4, y, t) && !at(x+5, y, t) && at(x+6, y, t)) {
+					continue
+				}
+				light := func(from, to int) bool {
+					for i := from; i < to; i++ {
+						if i >= 0 && i < n && at(i, y, t) {
+							return false
+						}
+					}
+					return true
+				}
+				if light(x-4, x) || light(x+7, x+11) {
+					score += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.Modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.Modules[y][x]
+				if q.Modules[y][x+1] == c && q.Modules[y+1][x] == c && q.Modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	k := (iabs(dark*20-total*10)+total-1)/total - 1
+	return score + max(k, 0)*10
+}
+
+// qrQuietZone is the light border the standard asks for, in modules
+const qrQuietZone = 4
+
+// PNG renders the symbol with scale pixels per module
+func (q *QRCode) PNG(scale int) ([]byte, error) {
+	side := (q.Size + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y, row := range q.Modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetGray((x+qrQuietZone)*scale+px, (y+qrQuietZone)*scale+py, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG renders the symbol as one path, one unit per module
+func (q *QRCode) SVG() []byte {
+	side := strconv.Itoa(q.Size + 2*qrQuietZone)
+	var path strings.Builder
+	for y, row := range q.Modules {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x+1 < len(row) && row[x+1] {
+				x++
+			}
+			path.WriteString("M" + strconv.Itoa(start+qrQuietZone) + " " + strconv.Itoa(y+qrQuietZone) + "h" + strconv.Itoa(x-start+1) + "v1h-" + strconv.Itoa(x-start+1) + "z")
+		}
+	}
+	return []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 ` + side + ` ` + side + `" shape-rendering="crispEdges">` +
+		`<rect width="100%" height="100%" fill="#fff"/><path d="` + path.String() + `" fill="#000"/></svg>` + "\n")
+}
+
+func iabs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
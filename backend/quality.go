@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// QualityReport scores the data of one layer for QA: how complete the
+// schema's properties are, how many geometries are valid, how many
+// features look like duplicates and how many haven't been touched for a
+// long time. Score is the mean of the four rates, 0 to 100.
+type QualityReport struct {
+	Layer        string                `json:"layer"`
+	Features     int                   `json:"features"`
+	Score        float64               `json:"score"`
+	Completeness QualityCompleteness   `json:"completeness"`
+	Geometry     QualityGeometry       `json:"geometry"`
+	Duplicates   QualityDuplicates     `json:"duplicates"`
+	Staleness    QualityStaleness      `json:"staleness"`
+	Issues       []QualityFeatureIssue `json:"issues"`
+	// IssuesTruncated is set when more features have issues than listed
+	IssuesTruncated bool      `json:"issues_truncated,omitempty"`
+	ComputedAt      time.Time `json:"computed_at"`
+}
+
+// QualityCompleteness counts features that have each schema field set.
+// Rate covers the required fields only, or all fields when none is
+// required.
+type QualityCompleteness struct {
+	Rate   float64                 `json:"rate"`
+	Fields map[string]QualityField `json:"fields"`
+}
+
+type QualityField struct {
+	Required bool    `json:"required,omitempty"`
+	Present  int     `json:"present"`
+	Rate     float64 `json:"rate"`
+}
+
+type QualityGeometry struct {
+	Valid   int     `json:"valid"`
+	Invalid int     `json:"invalid"`
+	Rate    float64 `json:"rate"`
+}
+
+// QualityDuplicates counts features that repeat an earlier one: the same
+// geometry, or the same name within DistanceM of it
+type QualityDuplicates struct {
+	Suspected int     `json:"suspected"`
+	DistanceM float64 `json:"distance_m"`
+	Rate      float64 `json:"rate"`
+}
+
+type QualityStaleness struct {
+	StaleDays int        `json:"stale_days"`
+	Stale     int        `json:"stale"`
+	Oldest    *time.Time `json:"oldest_update,omitempty"`
+	Rate      float64    `json:"rate"`
+}
+
+// QualityFeatureIssue flags what is wrong with one feature. Flags are
+// missing:<field>, invalid_geometry, duplicate and stale.
+type QualityFeatureIssue struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name,omitempty"`
+	Flags       []string `json:"flags"`
+	Detail      string   `json:"detail,omitempty"`
+	DuplicateOf string   `json:"duplicate_of,omitempty"`
+}
+
+const (
+	defaultQualityStaleDays  = 365
+	defaultQualityIssueLimit = 1000
+	defaultDuplicateDistance = 10.0
+)
+
+// qualityChecker accumulates a report feature by feature
+type qualityChecker struct {
+	rep       QualityReport
+	fields    []LayerField
+	staleAt   time.Time
+	geomKeys  map[string]string
+	named     map[string][]qualityAnchor
+	maxIssues int
+}
+
+type qualityAnchor struct {
+	id string
+	at Position
+}
+
+func newQualityChecker(layer string, fields []LayerField, staleDays int, dupDistance float64, maxIssues int, now time.Time) *qualityChecker {
+	c := &qualityChecker{
+		rep: QualityReport{
+			Layer:        layer,
+			Completeness: QualityCompleteness{Fields: map[string]QualityField{}},
+			Duplicates:   QualityDuplicates{DistanceM: dupDistance},
+			Staleness:    QualityStaleness{StaleDays: staleDays},
+			Issues:       []QualityFeatureIssue{},
+			ComputedAt:   now,
+		},
+		fields:    fields,
+		staleAt:   now.AddDate(0, 0, -staleDays),
+		geomKeys:  map[string]string{},
+		named:     map[string][]qualityAnchor{},
+		maxIssues: maxIssues,
+	}
+	for _, f := range fields {
+		c.rep.Completeness.Fields[f.Name] = QualityField{Required: f.Required}
+	}
+	return c
+}
+
+func (c *qualityChecker) add(doc FeatureDoc) {
+	c.rep.Features++
+	issue := QualityFeatureIssue{ID: doc.ID.Hex(), Name: doc.Name}
+
+	for _, f := range c.fields {
+		qf := c.rep.Completeness.Fields[f.Name]
+		if v, ok := doc.Properties[f.Name]; ok && v != nil && v != "" {
+			qf.Present++
+		} else if f.Required {
+			issue.Flags = append(issue.Flags, "missing:"+f.Name)
+		}
+		c.rep.Completeness.Fields[f.Name] = qf
+	}
+
+	g, err := parseGeometry(doc.Geometry)
+	if err == nil {
+		err = g.Validate()
+	}
+	if err != nil {
+		c.rep.Geometry.Invalid++
+		issue.Flags = append(issue.Flags, "invalid_geometry")
+		issue.Detail = err.Error()
+	} else {
+		c.rep.Geometry.Valid++
+		if of := c.duplicateOf(issue.ID, doc, g); of != "" {
+			c.rep.Duplicates.Suspected++
+			issue.Flags = append(issue.Flags, "duplicate")
+			issue.DuplicateOf = of
+		}
+	}
+
+	if doc.UpdatedAt.Before(c.staleAt) {
+		c.rep.Staleness.Stale++
+		issue.Flags = append(issue.Flags, "stale")
+	}
+	if !doc.UpdatedAt.IsZero() && (c.rep.Staleness.Oldest == nil || doc.UpdatedAt.Before(*c.rep.Staleness.Oldest)) {
+		t := doc.UpdatedAt
+		c.rep.Staleness.Oldest = &t
+	}
+
+	if len(issue.Flags) > 0 {
+		if len(c.rep.Issues) < c.maxIssues {
+			c.rep.Issues = append(c.rep.Issues, issue)
+		} else {
+			c.rep.IssuesTruncated = true
+		}
+	}
+}
+
+// duplicateOf is the id of an earlier feature that g repeats exactly or
+// that has the same name close by, "" if none
+func (c *qualityChecker) duplicateOf(id string, doc FeatureDoc, g Geometry) string {
+	key := g.Type + " " + g.WKT()
+	if of, ok := c.geomKeys[key]; ok {
+		return of
+	}
+	c.geomKeys[key] = id
+
+	name := strings.ToLower(strings.Join(strings.Fields(doc.Name), " "))
+	if name == "" {
+		return ""
+	}
+	at, ok := featureAnchor(&doc)
+	if !ok {
+		return ""
+	}
+	for _, a := range c.named[name] {
+		if haversine(a.at, at) <= c.rep.Duplicates.DistanceM {
+			return a.id
+		}
+	}
+	c.named[name] = append(c.named[name], qualityAnchor{id: id, at: at})
+	return ""
+}
+
+func (c *qualityChecker) report() QualityReport {
+	rep := c.rep
+	rate := func(n int) float64 {
+		if rep.Features == 0 {
+			return 1
+		}
+		return math.Round(float64(n)/float64(rep.Features)*10000) / 10000
+	}
+	var sum float64
+	var counted int
+	anyRequired := false
+	for _, f := range c.fields {
+		anyRequired = anyRequired || f.Required
+	}
+	for _, f := range c.fields {
+		qf := rep.Completeness.Fields[f.Name]
+		qf.Rate = rate(qf.Present)
+		rep.Completeness.Fields[f.Name] = qf
+		if f.Required || !anyRequired {
+			sum += qf.Rate
+			counted++
+		}
+	}
+	rep.Completeness.Rate = 1
+	if counted > 0 {
+		rep.Completeness.Rate = math.Round(sum/float64(counted)*10000) / 10000
+	}
+	rep.Geometry.Rate = rate(rep.Geometry.Valid)
+	rep.Duplicates.Rate = rate(rep.Duplicates.Suspected)
+	rep.Staleness.Rate = rate(rep.Staleness.Stale)
+	if rep.Features == 0 {
+		rep.Duplicates.Rate, rep.Staleness.Rate = 0, 0
+	}
+	score := (rep.Completeness.Rate + rep.Geometry.Rate + (1 - rep.Duplicates.Rate) + (1 - rep.Staleness.Rate)) / 4
+	rep.Score = math.Round(score*1000) / 10
+	sort.SliceStable(rep.Issues, func(i, j int) bool { return len(rep.Issues[i].Flags) > len(rep.Issues[j].Flags) })
+	return rep
+}
+
+// GET /layers/{id}/quality?stale_days=365&duplicate_distance=10m&max_issues=1000
+func layerQualityHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	query := r.URL.Query()
+	staleDays := defaultQualityStaleDays
+	if v := query.Get("stale_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid stale_days", FieldError{Field: "stale_days", Message: "must be a positive integer"})
+			return
+		}
+		staleDays = n
+	}
+	dupDistance := defaultDuplicateDistance
+	if v := query.Get("duplicate_distance"); v != "" {
+		d, err := parseDistance(v)
+		if err != nil || d < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid duplicate_distance", FieldError{Field: "duplicate_distance", Message: "must be a distance such as 10m"})
+			return
+		}
+		dupDistance = d
+	}
+	maxIssues := defaultQualityIssueLimit
+	if v := query.Get("max_issues"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid max_issues", FieldError{Field: "max_issues", Message: "must be a non-negative integer"})
+			return
+		}
+		maxIssues = n
+	}
+
+	id := mux.Vars(r)["id"]
+	var layer LayerDoc
+	err := layers.FindOne(r.Context(), bson.M{"_id": id}).Decode(&layer)
+	if err != nil && err != mongo.ErrNoDocuments {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	noLayer := err == mongo.ErrNoDocuments
+	c := newQualityChecker(id, layer.Fields, staleDays, dupDistance, maxIssues, time.Now().UTC())
+	q := bson.M{"layer": id, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	cur, err := heavyReads.Find(r.Context(), q, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	for cur.Next(r.Context()) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		c.add(doc)
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if c.rep.Features == 0 && noLayer {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.report())
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usage quotas per tenant. A tenant is the authenticated user, so each API
+// key of AUTH_TOKENS is one; anonymous callers and admins aren't metered.
+// Requests are counted per calendar month (UTC) and buffered in memory,
+// reaching Mongo every QUOTA_FLUSH_INTERVAL (10s), so instances share the
+// count at the cost of a few seconds' overshoot. Storage is the number and
+// BSON size of the features a tenant created, recomputed every
+// QUOTA_STORAGE_INTERVAL (10m). Limits come from the quotas collection or
+// the defaults QUOTA_MONTHLY_REQUESTS, QUOTA_STORAGE_MB and QUOTA_FEATURES;
+// 0 is unlimited. Past the request limit calls get 429 until the month
+// ends; past a storage limit writes get 403 while reads and deletes go on.
+type QuotaDoc struct {
+	Tenant          string    `bson:"_id" json:"tenant"`
+	MonthlyRequests int64     `bson:"monthly_requests" json:"monthly_requests"`
+	StorageBytes    int64     `bson:"storage_bytes" json:"storage_bytes"`
+	Features        int64     `bson:"features" json:"features"`
+	UpdatedBy       string    `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt       time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// UsageDoc is one tenant's usage in one month
+type UsageDoc struct {
+	ID           string    `bson:"_id" json:"-"`
+	Tenant       string    `bson:"tenant" json:"tenant"`
+	Month        string    `bson:"month" json:"month"`
+	Requests     int64     `bson:"requests" json:"requests"`
+	Writes       int64     `bson:"writes" json:"writes"`
+	StorageBytes int64     `bson:"storage_bytes" json:"storage_bytes"`
+	Features     int64     `bson:"features" json:"features"`
+	UpdatedAt    time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+type usageCounts struct {
+	// stored is the count in Mongo when last read, inflight what is being
+	// written and pending what this instance hasn't written yet
+	stored, inflight, pending, pendingWrites int64
+}
+
+type storageUsage struct {
+	bytes, features int64
+}
+
+var (
+	quotas        *mongo.Collection
+	usage         *mongo.Collection
+	defaultQuota  QuotaDoc
+	usageMu       sync.Mutex
+	usageCounters = map[string]*usageCounts{}
+	storageByUser = map[string]storageUsage{}
+
+	quotaMu    sync.Mutex
+	quotaCache = map[string]cachedQuota{}
+)
+
+type cachedQuota struct {
+	quota   QuotaDoc
+	expires time.Time
+}
+
+var monthPattern = regexp.MustCompile(`^\d{4}-\d{2}$`)
+
+func usageMonth(t time.Time) string { return t.UTC().Format("2006-01") }
+
+func setupQuotas() {
+	quotas = db.Collection(getenv("MONGO_QUOTAS_COLLECTION", "quotas"))
+	usage = db.Collection(getenv("MONGO_USAGE_COLLECTION", "usage"))
+	if v, err := strconv.ParseInt(getenv("QUOTA_MONTHLY_REQUESTS", ""), 10, 64); err == nil && v > 0 {
+		defaultQuota.MonthlyRequests = v
+	}
+	if v, err := strconv.ParseInt(getenv("QUOTA_STORAGE_MB", ""), 10, 64); err == nil && v > 0 {
+		defaultQuota.StorageBytes = v << 20
+	}
+	if v, err := strconv.ParseInt(getenv("QUOTA_FEATURES", ""), 10, 64); err == nil && v > 0 {
+		defaultQuota.Features = v
+	}
+	if _, err := usage.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "month", Value: 1}, {Key: "tenant", Value: 1}}}); err != nil {
+		log.Printf("usage index create warning: %v", err)
+	}
+	flush := 10 * time.Second
+	if d, err := time.ParseDuration(getenv("QUOTA_FLUSH_INTERVAL", "")); err == nil && d > 0 {
+		flush = d
+	}
+	storage := 10 * time.Minute
+	if d, err := time.ParseDuration(getenv("QUOTA_STORAGE_INTERVAL", "")); err == nil && d > 0 {
+		storage = d
+	}
+	go func() {
+		for range time.Tick(flush) {
+			flushUsage()
+		}
+	}()
+	go func() {
+		for {
+			if err := refreshStorageUsage(); err != nil {
+				log.Printf("storage usage refresh warning: %v", err)
+			}
+			time.Sleep(storage)
+		}
+	}()
+}
+
+func loadQuota(tenant string) QuotaDoc {
+	quotaMu.Lock()
+	c, ok := quotaCache[tenant]
+	quotaMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.quota
+	}
+	q := defaultQuota
+	q.Tenant = tenant
+	if err := quotas.FindOne(ctx, bson.M{"_id": tenant}).Decode(&q); err != nil && err != mongo.ErrNoDocuments {
+		// keep enforcing the last known limits while Mongo is unreachable
+		log.Printf("quota load warning: %v", err)
+		if ok {
+			return c.quota
+		}
+	}
+	quotaMu.Lock()
+	quotaCache[tenant] = cachedQuota{quota: q, expires: time.Now().Add(layerExtentTTL)}
+	quotaMu.Unlock()
+	return q
+}
+
+func forgetQuota(tenant string) {
+	quotaMu.Lock()
+	delete(quotaCache, tenant)
+	quotaMu.Unlock()
+}
+
+// countRequest adds a request to the tenant's month and returns the total
+func countRequest(tenant string, write bool) int64 {
+	key := tenant + "|" + usageMonth(time.Now())
+	usageMu.Lock()
+	c, ok := usageCounters[key]
+	usageMu.Unlock()
+	if !ok {
+		// first request this month seen here: start from the shared count
+		var doc UsageDoc
+		if err := usage.FindOne(ctx, bson.M{"_id": key}).Decode(&doc); err != nil && err != mongo.ErrNoDocuments {
+			log.Printf("usage load warning: %v", err)
+		}
+		usageMu.Lock()
+		if c, ok = usageCounters[key]; !ok {
+			c = &usageCounts{stored: doc.Requests}
+			usageCounters[key] = c
+		}
+		usageMu.Unlock()
+	}
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	c.pending++
+	if write {
+		c.pendingWrites++
+	}
+	return c.stored + c.inflight + c.pending
+}
+
+func flushUsage() {
+	usageMu.Lock()
+	batch := map[string]usageCounts{}
+	for key, c := range usageCounters {
+		if c.pending > 0 {
+			batch[key] = *c
+			c.inflight += c.pending
+			c.pending, c.pendingWrites = 0, 0
+		}
+	}
+	month := usageMonth(time.Now())
+	for key := range usageCounters {
+		// counters of past months are done once flushed
+		if c := usageCounters[key]; key[len(key)-7:] != month && c.pending == 0 && c.inflight == 0 {
+			delete(usageCounters, key)
+		}
+	}
+	usageMu.Unlock()
+	for key, c := range batch {
+		tenant, m := key[:len(key)-8], key[len(key)-7:]
+		var doc UsageDoc
+		err := usage.FindOneAndUpdate(ctx, bson.M{"_id": key}, bson.M{
+			"$inc":         bson.M{"requests": c.pending, "writes": c.pendingWrites},
+			"$set":         bson.M{"updated_at": time.Now().UTC()},
+			"$setOnInsert": bson.M{"tenant": tenant, "month": m},
+		}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+		usageMu.Lock()
+		cur := usageCounters[key]
+		cur.inflight -= c.pending
+		if err != nil {
+			log.Printf("usage flush warning: %v", err)
+			// try again next time
+			cur.pending += c.pending
+			cur.pendingWrites += c.pendingWrites
+		} else {
+			cur.stored = doc.Requests
+		}
+		usageMu.Unlock()
+	}
+}
+
+func refreshStorageUsage() error {
+	cur, err := collection.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"created_by": bson.M{"$exists": true, "$ne": ""}}},
+		bson.M{"$group": bson.M{"_id": "$created_by", "features": bson.M{"$sum": 1}, "bytes": bson.M{"$sum": bson.M{"$bsonSize": "$$ROOT"}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var rows []struct {
+		Tenant   string `bson:"_id"`
+		Features int64  `bson:"features"`
+		Bytes    int64  `bson:"bytes"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return err
+	}
+	next := map[string]storageUsage{}
+	month := usageMonth(time.Now())
+	for _, row := range rows {
+		next[row.Tenant] = storageUsage{bytes: row.Bytes, features: row.Features}
+		// the month's record keeps the latest storage figures
+		if _, err := usage.UpdateByID(ctx, row.Tenant+"|"+month, bson.M{
+			"$set":         bson.M{"storage_bytes": row.Bytes, "features": row.Features, "updated_at": time.Now().UTC()},
+			"$setOnInsert": bson.M{"tenant": row.Tenant, "month": month},
+		}, options.Update().SetUpsert(true)); err != nil {
+			return err
+		}
+	}
+	usageMu.Lock()
+	storageByUser = next
+	usageMu.Unlock()
+	return nil
+}
+
+// endOfMonth is when request counts start over
+func endOfMonth(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// quotaMiddleware meters authenticated requests and refuses those past the
+// tenant's limits
+func quotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := currentUser(r)
+		if r.Method == http.MethodOptions || u == nil || u.hasRole("admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead
+		q := loadQuota(u.ID)
+		n := countRequest(u.ID, write)
+		if q.MonthlyRequests > 0 {
+			remaining := q.MonthlyRequests - n
+			if remaining < 0 {
+				remaining = 0
+			}
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(q.MonthlyRequests, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			if n > q.MonthlyRequests {
+				reset := endOfMonth(time.Now())
+				w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+				writeError(w, http.StatusTooManyRequests, "quota_exceeded", "monthly request quota of "+strconv.FormatInt(q.MonthlyRequests, 10)+" used up, it resets "+reset.Format(time.RFC3339))
+				return
+			}
+		}
+		if write && r.Method != http.MethodDelete && (q.StorageBytes > 0 || q.Features > 0) {
+			usageMu.Lock()
+			s := storageByUser[u.ID]
+			usageMu.Unlock()
+			if (q.StorageBytes > 0 && s.bytes >= q.StorageBytes) || (q.Features > 0 && s.features >= q.Features) {
+				writeError(w, http.StatusForbidden, "storage_quota_exceeded", "storage quota reached; delete features or ask for a higher quota")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// usageReport is a tenant's usage this month next to its limits
+func usageReport(tenant string) bson.M {
+	month := usageMonth(time.Now())
+	var doc UsageDoc
+	if err := usage.FindOne(ctx, bson.M{"_id": tenant + "|" + month}).Decode(&doc); err != nil && err != mongo.ErrNoDocuments {
+		log.Printf("usage load warning: %v", err)
+	}
+	usageMu.Lock()
+	if c, ok := usageCounters[tenant+"|"+month]; ok && c.stored+c.inflight+c.pending > doc.Requests {
+		doc.Requests = c.stored + c.inflight + c.pending
+	}
+	if s, ok := storageByUser[tenant]; ok {
+		doc.StorageBytes, doc.Features = s.bytes, s.features
+	}
+	usageMu.Unlock()
+	doc.Tenant, doc.Month = tenant, month
+	return bson.M{"usage": doc, "quota": loadQuota(tenant), "resets_at": endOfMonth(time.Now())}
+}
+
+// GET /usage is the caller's own usage and quota
+func myUsageHandler(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageReport(u.ID))
+}
+
+// GET /admin/usage?month=YYYY-MM lists every tenant's usage in a month,
+// the current one by default
+func listUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = usageMonth(time.Now())
+	} else if !monthPattern.MatchString(month) {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid month", FieldError{Field: "month", Message: "expected YYYY-MM"})
+		return
+	}
+	cur, err := usage.Find(ctx, bson.M{"month": month}, options.Find().SetSort(bson.D{{Key: "requests", Value: -1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []UsageDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"month": month, "tenants": out})
+}
+
+// GET /admin/quotas lists the tenants with their own limits and the
+// defaults everyone else gets
+func listQuotasHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	cur, err := quotas.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []QuotaDoc{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"default": defaultQuota, "quotas": out})
+}
+
+// PUT /admin/quotas/{tenant} { monthly_requests, storage_bytes, features }
+// sets a tenant's limits; DELETE returns it to the defaults
+func putQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var body QuotaDoc
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	var errs []FieldError
+	for name, v := range map[string]int64{"monthly_requests": body.MonthlyRequests, "storage_bytes": body.StorageBytes, "features": body.Features} {
+		if v < 0 {
+			errs = append(errs, FieldError{Field: name, Message: "must be 0 (unlimited) or more"})
+		}
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid quota", errs...)
+		return
+	}
+	body.Tenant = mux.Vars(r)["tenant"]
+	body.UpdatedBy = userID(r)
+	body.UpdatedAt = time.Now().UTC()
+	if _, err := quotas.ReplaceOne(ctx, bson.M{"_id": body.Tenant}, body, options.Replace().SetUpsert(true)); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	forgetQuota(body.Tenant)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+func deleteQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	tenant := mux.Vars(r)["tenant"]
+	res, err := quotas.DeleteOne(ctx, bson.M{"_id": tenant})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "no quota set for "+tenant)
+		return
+	}
+	forgetQuota(tenant)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deepest traversal GET /features/{id}/relations allows
+const maxRelationDepth = 5
+
+var relationTypePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// RelationDoc is a typed, directed link between two features, read as
+// "from <type> to", e.g. hydrant serves building
+type RelationDoc struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	From      primitive.ObjectID `bson:"from" json:"from"`
+	To        primitive.ObjectID `bson:"to" json:"to"`
+	Type      string             `bson:"type" json:"type"`
+	CreatedBy string             `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+var relations *mongo.Collection
+
+func setupRelations() {
+	relations = db.Collection(getenv("MONGO_RELATIONS_COLLECTION", "relations"))
+	_, err := relations.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "from", Value: 1}, {Key: "type", Value: 1}, {Key: "to", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "to", Value: 1}, {Key: "type", Value: 1}}},
+	})
+	if err != nil {
+		log.Printf("relations index create warning: %v", err)
+	}
+}
+
+// POST /relations { from, to, type }
+func createRelationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+		return
+	}
+	var errs []FieldError
+	from, err := primitive.ObjectIDFromHex(body.From)
+	if err != nil {
+		errs = append(errs, FieldError{Field: "from", Message: "must be a feature id"})
+	}
+	to, err := primitive.ObjectIDFromHex(body.To)
+	if err != nil {
+		errs = append(errs, FieldError{Field: "to", Message: "must be a feature id"})
+	}
+	if !relationTypePattern.MatchString(body.Type) {
+		errs = append(errs, FieldError{Field: "type", Message: "lowercase letters, digits and _, e.g. serves"})
+	}
+	if len(errs) == 0 && from == to {
+		errs = append(errs, FieldError{Field: "to", Message: "a feature cannot relate to itself"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid relation", errs...)
+		return
+	}
+	n, err := collection.CountDocuments(ctx, bson.M{"_id": bson.M{"$in": bson.A{from, to}}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	if n != 2 {
+		writeError(w, http.StatusNotFound, "not_found", "both features must exist")
+		return
+	}
+	if !checkOwnership(w, r, from) {
+		return
+	}
+
+	doc := RelationDoc{From: from, To: to, Type: body.Type, CreatedBy: userID(r), CreatedAt: time.Now().UTC()}
+	res, err := relations.InsertOne(ctx, doc)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "relation already exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	doc.ID = res.InsertedID.(primitive.ObjectID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(doc)
+}
+
+func deleteRelationHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	var rel RelationDoc
+	err = relations.FindOne(ctx, bson.M{"_id": oid}).Decode(&rel)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "relation not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if !checkOwnership(w, r, rel.From) {
+		return
+	}
+	if _, err := relations.DeleteOne(ctx, bson.M{"_id": oid}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(bson.M{"ok": true})
+}
+
+// relationFilter matches relations touching any of ids in the given
+// direction (out, in or both)
+func relationFilter(ids []primitive.ObjectID, direction, typ string) bson.M {
+	var q bson.M
+	switch direction {
+	case "out":
+		q = bson.M{"from": bson.M{"$in": ids}}
+	case "in":
+		q = bson.M{"to": bson.M{"$in": ids}}
+	default:
+		q = bson.M{"$or": bson.A{bson.M{"from": bson.M{"$in": ids}}, bson.M{"to": bson.M{"$in": ids}}}}
+	}
+	if typ != "" {
+		q["type"] = typ
+	}
+	return q
+}
+
+// GET /features/{id}/relations?type=&direction=out|in|both&depth=1
+// Features reachable from the feature through relations, breadth first.
+// Each result carries the relation that reached it and its depth.
+func featureRelationsHandler(w http.ResponseWriter, r *http.Request) {
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	query := r.URL.Query()
+	direction := query.Get("direction")
+	if direction == "" {
+		direction = "both"
+	}
+	if direction != "out" && direction != "in" && direction != "both" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid direction", FieldError{Field: "direction", Message: "must be out, in or both"})
+		return
+	}
+	depth := 1
+	if v := query.Get("depth"); v != "" {
+		depth, err = strconv.Atoi(v)
+		if err != nil || depth < 1 || depth > maxRelationDepth {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid depth", FieldError{Field: "depth", Message: "must be between 1 and " + strconv.Itoa(maxRelationDepth)})
+			return
+		}
+	}
+	typ := query.Get("type")
+
+	type hop struct {
+		rel       RelationDoc
+		direction string
+		depth     int
+	}
+	seen := map[primitive.ObjectID]bool{oid: true}
+	reached := map[primitive.ObjectID]hop{}
+	var order []primitive.ObjectID
+	frontier := []primitive.ObjectID{oid}
+	for d := 1; d <= depth && len(frontier) > 0; d++ {
+		cur, err := relations.Find(ctx, relationFilter(frontier, direction, typ))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		var rels []RelationDoc
+		if err := cur.All(ctx, &rels); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		inFrontier := map[primitive.ObjectID]bool{}
+		for _, id := range frontier {
+			inFrontier[id] = true
+		}
+		var next []primitive.ObjectID
+		for _, rel := range rels {
+			other, dir := rel.To, "out"
+			if !inFrontier[rel.From] || (direction == "in" && inFrontier[rel.To]) {
+				other, dir = rel.From, "in"
+			}
+			if seen[other] {
+				continue
+			}
+			seen[other] = true
+			reached[other] = hop{rel, dir, d}
+			order = append(order, other)
+			next = append(next, other)
+		}
+		frontier = next
+	}
+
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	if len(order) > 0 {
+		q := bson.M{"_id": bson.M{"$in": order}, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+		applyVisibilityFilter(r, q)
+		cur, err := collection.Find(ctx, q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		byID := map[primitive.ObjectID]FeatureDoc{}
+		for cur.Next(ctx) {
+			var doc FeatureDoc
+			if err := cur.Decode(&doc); err != nil {
+				log.Println("decode warn:", err)
+				continue
+			}
+			byID[doc.ID] = doc
+		}
+		cur.Close(ctx)
+		// relations to deleted or hidden features are skipped
+		for _, id := range order {
+			doc, ok := byID[id]
+			if !ok {
+				continue
+			}
+			revealDoc(r, &doc)
+			f := featureToGeoJSON(doc)
+			h := reached[id]
+			if props, ok := f.Properties.(bson.M); ok {
+				props["relation"] = bson.M{"id": h.rel.ID.Hex(), "type": h.rel.Type, "direction": h.direction, "depth": h.depth}
+			}
+			fc.Features = append(fc.Features, f)
+		}
+	}
+	writeCollection(w, r, fc, 0, 0)
+}
+
+// attachRelations adds a relations list to each feature's properties for
+// ?include=relations. Entries name the other feature so clients can link to
+// it without another request. The other ends are read under the listing's
+// status condition and the caller's visibility and publication filters;
+// relations to features the caller can't see are left out.
+func attachRelations(r *http.Request, fc *GeoJSONFeatureCollection, status interface{}) error {
+	ctx := r.Context()
+	ids := make([]primitive.ObjectID, 0, len(fc.Features))
+	for _, f := range fc.Features {
+		props, _ := f.Properties.(bson.M)
+		if id, ok := props["id"].(string); ok {
+			if oid, err := primitive.ObjectIDFromHex(id); err == nil {
+				ids = append(ids, oid)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	cur, err := relations.Find(ctx, relationFilter(ids, "both", ""))
+	if err != nil {
+		return err
+	}
+	var rels []RelationDoc
+	if err := cur.All(ctx, &rels); err != nil {
+		return err
+	}
+
+	others := map[primitive.ObjectID]bool{}
+	for _, rel := range rels {
+		others[rel.From], others[rel.To] = true, true
+	}
+	otherIDs := make([]primitive.ObjectID, 0, len(others))
+	for id := range others {
+		otherIDs = append(otherIDs, id)
+	}
+	names := map[primitive.ObjectID]string{}
+	q := bson.M{"_id": bson.M{"$in": otherIDs}}
+	if status != nil {
+		q["status"] = status
+	}
+	hidden, err := hiddenLayers(r)
+	if err != nil {
+		return err
+	}
+	if len(hidden) > 0 {
+		q["layer"] = bson.M{"$nin": hidden}
+	}
+	applyVisibilityFilter(r, q)
+	cur, err = collection.Find(ctx, q, options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return err
+	}
+	for cur.Next(ctx) {
+		var doc struct {
+			ID   primitive.ObjectID `bson:"_id"`
+			Name string             `bson:"name"`
+		}
+		if cur.Decode(&doc) == nil {
+			names[doc.ID] = doc.Name
+		}
+	}
+	cur.Close(ctx)
+
+	byFeature := map[string][]bson.M{}
+	for _, rel := range rels {
+		if _, ok := names[rel.From]; !ok {
+			continue
+		}
+		if _, ok := names[rel.To]; !ok {
+			continue
+		}
+		byFeature[rel.From.Hex()] = append(byFeature[rel.From.Hex()], bson.M{
+			"id": rel.ID.Hex(), "type": rel.Type, "direction": "out", "feature_id": rel.To.Hex(), "feature_name": names[rel.To],
+		})
+		byFeature[rel.To.Hex()] = append(byFeature[rel.To.Hex()], bson.M{
+			"id": rel.ID.Hex(), "type": rel.Type, "direction": "in", "feature_id": rel.From.Hex(), "feature_name": names[rel.From],
+		})
+	}
+	for _, f := range fc.Features {
+		props, ok := f.Properties.(bson.M)
+		if !ok {
+			continue
+		}
+		id, _ := props["id"].(string)
+		list := byFeature[id]
+		if list == nil {
+			list = []bson.M{}
+		}
+		props["relations"] = list
+	}
+	return nil
+}
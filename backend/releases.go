@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Releases are named, versioned and immutable cuts of a layer that
+// analyses can cite, such as roads v2024.2. A release either freezes the
+// layer's approved features at the time it is cut or references a
+// published version (see publishing.go) without copying it again. Once
+// cut a release is never changed or removed, so its features and exports
+// stay reproducible.
+type LayerRelease struct {
+	ID      string `bson:"_id" json:"-"`
+	Layer   string `bson:"layer" json:"layer"`
+	Version string `bson:"version" json:"version"`
+	Title   string `bson:"title,omitempty" json:"title,omitempty"`
+	Notes   string `bson:"notes,omitempty" json:"notes,omitempty"`
+	// PublishedVersion is the published version the release references, 0
+	// when it has its own frozen copy
+	PublishedVersion int           `bson:"published_version,omitempty" json:"published_version,omitempty"`
+	Features         int           `bson:"features" json:"features"`
+	Fields           []LayerField  `bson:"fields,omitempty" json:"fields,omitempty"`
+	License          *LayerLicense `bson:"license,omitempty" json:"license,omitempty"`
+	CreatedBy        string        `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt        time.Time     `bson:"created_at" json:"created_at"`
+	Complete         bool          `bson:"complete" json:"-"`
+}
+
+var layerReleases *mongo.Collection
+
+// release versions are semantic (1.4.0, 2.0.0-rc.1) or calendar (2024.2)
+// numbers, with an optional leading v
+var releaseVersionPattern = regexp.MustCompile(`^v?(\d+(?:\.\d+){0,2})(?:-([0-9A-Za-z.-]+))?$`)
+
+func setupReleases() {
+	layerReleases = db.Collection(getenv("MONGO_LAYER_RELEASES_COLLECTION", "layer_releases"))
+	if _, err := layerReleases.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}}}); err != nil {
+		log.Printf("layer release index create warning: %v", err)
+	}
+	if _, err := publishedFeatures.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "release", Value: 1}}}); err != nil {
+		log.Printf("released feature index create warning: %v", err)
+	}
+}
+
+// parseReleaseVersion normalizes v, dropping the leading v
+func parseReleaseVersion(v string) (string, error) {
+	m := releaseVersionPattern.FindStringSubmatch(strings.TrimSpace(v))
+	if m == nil {
+		return "", fmt.Errorf("must be a version like 1.2.0, 2024.2 or 2.0.0-rc.1")
+	}
+	return strings.TrimPrefix(strings.TrimSpace(v), "v"), nil
+}
+
+// releaseLess orders versions numerically, a pre-release before its
+// release
+func releaseLess(a, b string) bool {
+	ma, mb := releaseVersionPattern.FindStringSubmatch(a), releaseVersionPattern.FindStringSubmatch(b)
+	if ma == nil || mb == nil {
+		return a < b
+	}
+	pa, pb := strings.Split(ma[1], "."), strings.Split(mb[1], ".")
+	for i := 0; i < 3; i++ {
+		var x, y int
+		if i < len(pa) {
+			x, _ = strconv.Atoi(pa[i])
+		}
+		if i < len(pb) {
+			y, _ = strconv.Atoi(pb[i])
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	if (ma[2] == "") != (mb[2] == "") {
+		return ma[2] != ""
+	}
+	return ma[2] < mb[2]
+}
+
+// CreateReleaseInput is the body of POST /layers/{id}/releases
+type CreateReleaseInput struct {
+	Version string `json:"version"`
+	Title   string `json:"title"`
+	Notes   string `json:"notes"`
+	// FromVersion references a published version instead of freezing the
+	// current features
+	FromVersion int `json:"from_version"`
+}
+
+// POST /layers/{id}/releases cuts a release
+func createReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	var in CreateReleaseInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	version, err := parseReleaseVersion(in.Version)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid release", FieldError{Field: "version", Message: err.Error()})
+		return
+	}
+	doc, ok := loadPublication(w, r)
+	if !ok {
+		return
+	}
+	rel := LayerRelease{
+		ID: doc.ID + "|" + version, Layer: doc.ID, Version: version, Title: in.Title, Notes: in.Notes,
+		Fields: doc.Fields, License: doc.License, CreatedBy: userID(r), CreatedAt: time.Now().UTC(),
+	}
+	if in.FromVersion != 0 {
+		var v LayerVersion
+		err := layerVersions.FindOne(r.Context(), bson.M{"layer": doc.ID, "version": in.FromVersion, "complete": true}).Decode(&v)
+		if err == mongo.ErrNoDocuments {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid release", FieldError{Field: "from_version", Message: "no such published version"})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		rel.PublishedVersion, rel.Features, rel.License, rel.Complete = v.Version, v.Features, v.License, true
+	}
+	// the release record claims the version before anything is copied
+	if _, err := layerReleases.InsertOne(r.Context(), rel); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "release "+version+" of layer "+doc.ID+" already exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	if !rel.Complete {
+		n, err := freezeFeatures(r, doc.ID, "release-"+version, bson.M{"release": version})
+		if err == nil {
+			rel.Features, rel.Complete = n, true
+			_, err = layerReleases.UpdateOne(r.Context(), bson.M{"_id": rel.ID}, bson.M{"$set": bson.M{"features": n, "complete": true}})
+		}
+		if err != nil {
+			publishedFeatures.DeleteMany(ctx, bson.M{"layer": doc.ID, "release": version})
+			layerReleases.DeleteOne(ctx, bson.M{"_id": rel.ID})
+			writeError(w, http.StatusInternalServerError, "db_error", "release error: "+err.Error())
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rel)
+}
+
+// GET /layers/{id}/releases lists the releases, newest version first
+func listReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := layerReleaseList(r, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func layerReleaseList(r *http.Request, layer string) ([]LayerRelease, error) {
+	cur, err := layerReleases.Find(r.Context(), bson.M{"layer": layer, "complete": true})
+	if err != nil {
+		return nil, err
+	}
+	out := []LayerRelease{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return releaseLess(out[j].Version, out[i].Version) })
+	return out, nil
+}
+
+// loadRelease resolves {version} of layer {id}; "latest" is the highest
+// version that isn't a pre-release
+func loadRelease(w http.ResponseWriter, r *http.Request) (*LayerRelease, bool) {
+	layer, want := mux.Vars(r)["id"], mux.Vars(r)["version"]
+	if want == "latest" {
+		list, err := layerReleaseList(r, layer)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return nil, false
+		}
+		for _, rel := range list {
+			if !strings.Contains(rel.Version, "-") {
+				return &rel, true
+			}
+		}
+		writeError(w, http.StatusNotFound, "not_found", "layer has no release")
+		return nil, false
+	}
+	version, err := parseReleaseVersion(want)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid version", FieldError{Field: "version", Message: err.Error()})
+		return nil, false
+	}
+	var rel LayerRelease
+	err = layerReleases.FindOne(r.Context(), bson.M{"_id": layer + "|" + version, "complete": true}).Decode(&rel)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "release not found")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	return &rel, true
+}
+
+// GET /layers/{id}/releases/{version}
+func getReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	rel, ok := loadRelease(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rel)
+}
+
+// GET /layers/{id}/releases/{version}/features?bbox=&limit=&offset=&format=geojson|csv&geom=
+// serves the features of a release, as an attachment named after it for
+// csv
+func releaseFeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "geojson"
+	}
+	if format != "geojson" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid format", FieldError{Field: "format", Message: "must be geojson or csv"})
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	rel, ok := loadRelease(w, r)
+	if !ok {
+		return
+	}
+	q := bson.M{"layer": rel.Layer, "release": rel.Version}
+	if rel.PublishedVersion > 0 {
+		q = bson.M{"layer": rel.Layer, "version": rel.PublishedVersion}
+	}
+	if bbox := query.Get("bbox"); bbox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(bbox)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid bbox", FieldError{Field: "bbox", Message: "must be minLon,minLat,maxLon,maxLat"})
+			return
+		}
+		q["feature.geometry"] = bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{minLon, minLat}, bson.A{maxLon, maxLat}}}}
+	}
+
+	// a release never changes, so the same request always gets the same
+	// answer
+	h := fnv.New64a()
+	h.Write([]byte(r.URL.RawQuery))
+	etag := fmt.Sprintf(`"%s-%s-%x"`, rel.Layer, rel.Version, h.Sum64())
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Layer-Release", rel.Version)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(offset)
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+	cur, err := publishedFeatures.Find(r.Context(), q, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	if format == "csv" {
+		keys, err := releasePropertyKeys(r, q)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-v%s.csv"`, rel.Layer, rel.Version))
+		encodeFeaturesCSV(w, r, r.Context(), keys, publishedCursor{cur}, query.Get("geom"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	writeGeoJSONCursor(w, r, publishedCursor{cur}, rel.License)
+}
+
+// releasePropertyKeys is propertyKeys for frozen features
+func releasePropertyKeys(r *http.Request, q bson.M) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: q}},
+		{{Key: "$project", Value: bson.M{"k": bson.M{"$objectToArray": bson.M{"$ifNull": bson.A{"$feature.properties", bson.M{}}}}}}},
+		{{Key: "$unwind", Value: "$k"}},
+		{{Key: "$group", Value: bson.M{"_id": "$k.k"}}},
+	}
+	cur, err := publishedFeatures.Aggregate(r.Context(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(r.Context())
+	var keys []string
+	for cur.Next(r.Context()) {
+		var row struct {
+			ID string `bson:"_id"`
+		}
+		if cur.Decode(&row) != nil {
+			continue
+		}
+		switch row.ID {
+		case "id", "name", "description":
+		default:
+			keys = append(keys, row.ID)
+		}
+	}
+	sort.Strings(keys)
+	return keys, cur.Err()
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// heavyReads is the features collection with HEAVY_READ_PREFERENCE
+// (primary, primaryPreferred, secondary, secondaryPreferred, nearest) and
+// HEAVY_READ_CONCERN for exports and analytics. It is the plain collection
+// when neither is set.
+var heavyReads *mongo.Collection
+
+// callers that wrote within this window read from the primary so they see
+// their own changes
+var readYourWritesWindow = 10 * time.Second
+
+var (
+	lastWritesMu sync.Mutex
+	lastWrites   = map[string]time.Time{}
+)
+
+func setupReadReplicas() {
+	base := heavyReadConcern(collection)
+	heavyReads = base
+	mode := getenv("HEAVY_READ_PREFERENCE", "primary")
+	if d, err := time.ParseDuration(getenv("READ_YOUR_WRITES_WINDOW", "10s")); err == nil {
+		readYourWritesWindow = d
+	}
+	if mode == "primary" {
+		return
+	}
+	m, err := readpref.ModeFromString(mode)
+	if err != nil {
+		log.Printf("HEAVY_READ_PREFERENCE %q invalid, using primary", mode)
+		return
+	}
+	var opts []readpref.Option
+	if s := getenv("HEAVY_READ_MAX_STALENESS", ""); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			opts = append(opts, readpref.WithMaxStaleness(d))
+		} else {
+			log.Printf("HEAVY_READ_MAX_STALENESS %q invalid, ignored", s)
+		}
+	}
+	rp, err := readpref.New(m, opts...)
+	if err != nil {
+		log.Printf("heavy read preference: %v, using primary", err)
+		return
+	}
+	heavyReads, err = base.Clone(options.Collection().SetReadPreference(rp))
+	if err != nil {
+		log.Printf("heavy read collection: %v, using primary", err)
+		heavyReads = base
+		return
+	}
+	log.Printf("exports and analytics read with preference %s", mode)
+}
+
+// writerKey identifies a caller for read-your-writes tracking: the user when
+// authenticated, else the client address
+func writerKey(r *http.Request) string {
+	if uid := userID(r); uid != "" {
+		return "u:" + uid
+	}
+	return "a:" + clientIP(r)
+}
+
+// writeTrackerMiddleware remembers when each caller last made a successful
+// write
+func writeTrackerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status < 400 {
+			writeGeneration.Add(1)
+			now := time.Now()
+			lastWritesMu.Lock()
+			lastWrites[writerKey(r)] = now
+			// drop stale entries now and then so the map stays small
+			if len(lastWrites) > 10000 {
+				for k, t := range lastWrites {
+					if now.Sub(t) > readYourWritesWindow {
+						delete(lastWrites, k)
+					}
+				}
+			}
+			lastWritesMu.Unlock()
+		}
+	})
+}
+
+// statusRecorder captures the response status only
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses streaming through the recorder
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+// readsFor picks the collection a heavy read should use: the replica
+// preference, unless the caller wrote recently or asked for
+// ?consistency=strong
+func readsFor(r *http.Request) *mongo.Collection {
+	if heavyReads == collection || r.URL.Query().Get("consistency") == "strong" {
+		return collection
+	}
+	lastWritesMu.Lock()
+	t, ok := lastWrites[writerKey(r)]
+	lastWritesMu.Unlock()
+	if ok && time.Since(t) < readYourWritesWindow {
+		return collection
+	}
+	return heavyReads
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Reports by SMS or WhatsApp, for people without a smartphone or a data
+// plan to open the public map with. A message gateway posts each inbound
+// message to POST /reports/inbound/{gateway}:
+//   - twilio: Twilio SMS and WhatsApp webhooks, checked against
+//     X-Twilio-Signature with TWILIO_AUTH_TOKEN;
+//   - whatsapp: the WhatsApp Cloud API, checked against
+//     X-Hub-Signature-256 with WHATSAPP_APP_SECRET; GET answers the
+//     subscription check with WHATSAPP_VERIFY_TOKEN, and replies are sent
+//     through the Graph API when WHATSAPP_ACCESS_TOKEN is set;
+//   - generic: {id, from, text, lat, lon, via} from any other gateway that
+//     sends REPORT_GATEWAY_TOKEN in X-Gateway-Token, answered with {reply}.
+//
+// A gateway is enabled by setting its secret. A text message is parsed as
+// "<category> <lat>,<lon> <description>", the coordinates (or a maps link)
+// anywhere in it; a shared WhatsApp
+// location is used as sent, with the category and description from a text
+// the same number sent in the half hour before. The report then goes
+// through fileReport like one from the web form, limited to REPORT_RATE per
+// number and hour, with the number kept as the contact.
+
+const (
+	gatewayDraftTTL   = 30 * time.Minute
+	gatewayDedupTTL   = 24 * time.Hour
+	maxGatewayBody    = 1 << 20
+	gatewayHelpText   = "To report, send the category and the location, e.g. \"pothole -6.2000, 106.8166 hole in the left lane\". Categories: "
+	gatewayFailedText = "Sorry, your report could not be saved. Please try again later."
+)
+
+var (
+	twilioKeys          keyRing
+	whatsappKeys        keyRing
+	gatewayKeys         keyRing
+	whatsappVerifyToken string
+	whatsappAccessToken string
+	whatsappAPIURL      = "https://graph.facebook.com/v19.0"
+	whatsappClient      = &http.Client{Timeout: 10 * time.Second}
+
+	// a lat, lon pair with decimals, so house and phone numbers don't match;
+	// also finds the one in a maps link such as ?q=-6.2,106.8 or @-6.2,106.8
+	reportCoordPattern = regexp.MustCompile(`(-?\d{1,2}\.\d+)\s*[,;\s]\s*(-?\d{1,3}\.\d+)`)
+)
+
+func setupReportGateways() {
+	for key, ring := range map[string]*keyRing{
+		"TWILIO_AUTH_TOKEN":    &twilioKeys,
+		"WHATSAPP_APP_SECRET":  &whatsappKeys,
+		"REPORT_GATEWAY_TOKEN": &gatewayKeys,
+	} {
+		watchSecret(key, func(v string) {
+			if v != "" {
+				ring.set([]byte(v))
+			}
+		})
+		if s := getsecret(key, ""); s != "" {
+			ring.set([]byte(s))
+		}
+	}
+	whatsappVerifyToken = getsecret("WHATSAPP_VERIFY_TOKEN", "")
+	whatsappAccessToken = getsecret("WHATSAPP_ACCESS_TOKEN", "")
+	whatsappAPIURL = strings.TrimRight(getenv("WHATSAPP_API_URL", whatsappAPIURL), "/")
+}
+
+// gatewayMessage is an inbound message, whichever gateway it came from
+type gatewayMessage struct {
+	ID   string
+	From string
+	// Via is sms or whatsapp
+	Via      string
+	Text     string
+	Lat, Lon *float64
+	// Place is the name or address sent along with a shared location
+	Place string
+}
+
+// parseReportText finds the location, category and description in a
+// message. The category is "other" when none is named.
+func parseReportText(text string) (rep reportInput, located bool) {
+	if m := reportCoordPattern.FindStringSubmatchIndex(text); m != nil {
+		rep.Lat, _ = strconv.ParseFloat(text[m[2]:m[3]], 64)
+		rep.Lon, _ = strconv.ParseFloat(text[m[4]:m[5]], 64)
+		text = text[:m[0]] + " " + text[m[1]:]
+		located = true
+	}
+	words := strings.Fields(text)
+	rep.Category = "other"
+	for n := 2; n >= 1; n-- {
+		if len(words) < n {
+			continue
+		}
+		c := strings.ToLower(strings.Join(words[:n], "_"))
+		if oneOf(c, reportCategories) {
+			rep.Category = c
+			words = words[n:]
+			break
+		}
+	}
+	rep.Description = strings.Join(words, " ")
+	if d := []rune(rep.Description); len(d) > maxReportText {
+		rep.Description = string(d[:maxReportText])
+	}
+	return rep, located
+}
+
+// handleGatewayMessage files the report a message makes, or keeps its text
+// until the location follows, and returns the reply for the sender (empty
+// for a message already handled)
+func handleGatewayMessage(r *http.Request, m gatewayMessage) string {
+	ctx := r.Context()
+	now := time.Now().UTC()
+	// gateways retry webhooks they see no answer to
+	if m.ID != "" {
+		_, err := reportLimits.InsertOne(ctx, bson.M{"_id": "msg|" + m.Via + "|" + m.ID, "expires_at": now.Add(gatewayDedupTTL)})
+		if mongo.IsDuplicateKeyError(err) {
+			return ""
+		} else if err != nil {
+			log.Printf("report gateway dedup warning: %v", err)
+		}
+	}
+	sender := m.Via + ":" + m.From
+	text := strings.TrimSpace(m.Text)
+	rep, located := parseReportText(text)
+	if m.Lat != nil && m.Lon != nil {
+		if text == "" {
+			var draft struct {
+				Text string `bson:"text"`
+			}
+			if err := reportLimits.FindOneAndDelete(ctx, bson.M{"_id": "draft|" + sender}).Decode(&draft); err == nil {
+				rep, _ = parseReportText(draft.Text)
+			} else if err != mongo.ErrNoDocuments {
+				log.Printf("report gateway draft warning: %v", err)
+			}
+		}
+		rep.Lat, rep.Lon, located = *m.Lat, *m.Lon, true
+		if m.Place != "" && rep.Description == "" {
+			rep.Description = m.Place
+		}
+	}
+	if !located {
+		if text == "" {
+			return gatewayHelpText + strings.Join(reportCategories, ", ") + "."
+		}
+		_, err := reportLimits.ReplaceOne(ctx, bson.M{"_id": "draft|" + sender},
+			bson.M{"text": text, "expires_at": now.Add(gatewayDraftTTL)}, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Printf("report gateway draft warning: %v", err)
+			return gatewayFailedText
+		}
+		if m.Via == "whatsapp" {
+			return "Thanks. Now share the location, or reply with its coordinates, e.g. -6.2000, 106.8166."
+		}
+		return "Thanks. Now reply with the coordinates of the location, e.g. -6.2000, 106.8166."
+	}
+
+	ok, _, err := reportAllowed(r, sender, now)
+	if err != nil {
+		log.Printf("report gateway rate limit error: %v", err)
+		return gatewayFailedText
+	}
+	if !ok {
+		return "Too many reports from this number. Please try again in an hour."
+	}
+	rep.Contact, rep.Via = m.From, m.Via
+	id, _, errs, err := fileReport(r, rep)
+	if len(errs) > 0 {
+		return "That location could not be used: " + errs[0].Message
+	}
+	if _, outside := err.(extentError); outside {
+		return "That location is outside the area we cover."
+	} else if err != nil {
+		log.Printf("report gateway error: %v", err)
+		return gatewayFailedText
+	}
+	return "Thanks, your " + strings.ReplaceAll(rep.Category, "_", " ") + " report (" + id + ") was received and will be reviewed."
+}
+
+// validTwilioSignature checks X-Twilio-Signature: the HMAC-SHA1 of the
+// webhook URL followed by the sorted form parameters
+func validTwilioSignature(r *http.Request) bool {
+	var b strings.Builder
+	b.WriteString(requestBaseURL(r) + r.URL.RequestURI())
+	keys := make([]string, 0, len(r.PostForm))
+	for k := range r.PostForm {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range r.PostForm[k] {
+			b.WriteString(k + v)
+		}
+	}
+	got := r.Header.Get("X-Twilio-Signature")
+	for _, key := range twilioKeys.all() {
+		mac := hmac.New(sha1.New, key)
+		mac.Write([]byte(b.String()))
+		if hmac.Equal([]byte(got), []byte(base64.StdEncoding.EncodeToString(mac.Sum(nil)))) {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /reports/inbound/twilio answers with TwiML, so Twilio sends the
+// reply back to the reporter
+func twilioInboundHandler(w http.ResponseWriter, r *http.Request) {
+	if twilioKeys.current() == nil {
+		writeError(w, http.StatusNotFound, "not_found", "gateway not configured")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxGatewayBody)
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "invalid form: "+err.Error())
+		return
+	}
+	if !validTwilioSignature(r) {
+		writeError(w, http.StatusForbidden, "forbidden", "invalid signature")
+		return
+	}
+	m := gatewayMessage{
+		ID:    r.PostFormValue("MessageSid"),
+		From:  r.PostFormValue("From"),
+		Via:   "sms",
+		Text:  r.PostFormValue("Body"),
+		Place: strings.TrimSpace(r.PostFormValue("Label") + " " + r.PostFormValue("Address")),
+	}
+	if from, ok := strings.CutPrefix(m.From, "whatsapp:"); ok {
+		m.From, m.Via = from, "whatsapp"
+	}
+	lat, errLat := strconv.ParseFloat(r.PostFormValue("Latitude"), 64)
+	lon, errLon := strconv.ParseFloat(r.PostFormValue("Longitude"), 64)
+	if errLat == nil && errLon == nil {
+		m.Lat, m.Lon = &lat, &lon
+	}
+	if m.From == "" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "missing From")
+		return
+	}
+	reply := handleGatewayMessage(r, m)
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if reply == "" {
+		io.WriteString(w, "<Response/>")
+		return
+	}
+	var esc bytes.Buffer
+	xml.EscapeText(&esc, []byte(reply))
+	io.WriteString(w, "<Response><Message>"+esc.String()+"</Message></Response>")
+}
+
+// GET /reports/inbound/whatsapp is the Cloud API's webhook verification
+func whatsappVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if whatsappVerifyToken == "" || q.Get("hub.mode") != "subscribe" ||
+		!hmac.Equal([]byte(q.Get("hub.verify_token")), []byte(whatsappVerifyToken)) {
+		writeError(w, http.StatusForbidden, "forbidden", "verification failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, q.Get("hub.challenge"))
+}
+
+type whatsappWebhook struct {
+	Entry []struct {
+		Changes []struct {
+			Value struct {
+				Metadata struct {
+					PhoneNumberID string `json:"phone_number_id"`
+				} `json:"metadata"`
+				Messages []struct {
+					ID   string `json:"id"`
+					From string `json:"from"`
+					Type string `json:"type"`
+					Text struct {
+						Body string `json:"body"`
+					} `json:"text"`
+					Location struct {
+						Latitude  float64 `json:"latitude"`
+						Longitude float64 `json:"longitude"`
+						Name      string  `json:"name"`
+						Address   string  `json:"address"`
+					} `json:"location"`
+				} `json:"messages"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+// POST /reports/inbound/whatsapp takes Cloud API message notifications;
+// status updates and other message types are acknowledged and ignored
+func whatsappInboundHandler(w http.ResponseWriter, r *http.Request) {
+	if whatsappKeys.current() == nil {
+		writeError(w, http.StatusNotFound, "not_found", "gateway not configured")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGatewayBody))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "read error: "+err.Error())
+		return
+	}
+	got, _ := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	valid := false
+	for _, key := range whatsappKeys.all() {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(body)
+		valid = valid || hmac.Equal([]byte(got), []byte(hex.EncodeToString(mac.Sum(nil))))
+	}
+	if !valid {
+		writeError(w, http.StatusForbidden, "forbidden", "invalid signature")
+		return
+	}
+	var hook whatsappWebhook
+	if err := json.Unmarshal(body, &hook); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid JSON: "+err.Error())
+		return
+	}
+	for _, e := range hook.Entry {
+		for _, c := range e.Changes {
+			for _, msg := range c.Value.Messages {
+				m := gatewayMessage{ID: msg.ID, From: msg.From, Via: "whatsapp"}
+				switch msg.Type {
+				case "text":
+					m.Text = msg.Text.Body
+				case "location":
+					lat, lon := msg.Location.Latitude, msg.Location.Longitude
+					m.Lat, m.Lon = &lat, &lon
+					m.Place = strings.TrimSpace(msg.Location.Name + " " + msg.Location.Address)
+				default:
+					continue
+				}
+				if reply := handleGatewayMessage(r, m); reply != "" {
+					go sendWhatsAppReply(c.Value.Metadata.PhoneNumberID, m.From, reply)
+				}
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendWhatsAppReply sends text to a reporter through the Graph API, when
+// WHATSAPP_ACCESS_TOKEN allows it
+func sendWhatsAppReply(phoneNumberID, to, text string) {
+	if whatsappAccessToken == "" || phoneNumberID == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              "text",
+		"text":              map[string]string{"body": text},
+	})
+	req, err := http.NewRequestWithContext(context.Background(), "POST", whatsappAPIURL+"/"+phoneNumberID+"/messages", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("whatsapp reply error: %v", err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+whatsappAccessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := whatsappClient.Do(req)
+	if err != nil {
+		log.Printf("whatsapp reply error: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("whatsapp reply error: %s", resp.Status)
+	}
+}
+
+// POST /reports/inbound/generic { id, from, text, lat, lon, via }
+func genericInboundHandler(w http.ResponseWriter, r *http.Request) {
+	if gatewayKeys.current() == nil {
+		writeError(w, http.StatusNotFound, "not_found", "gateway not configured")
+		return
+	}
+	valid := false
+	for _, key := range gatewayKeys.all() {
+		valid = valid || hmac.Equal([]byte(r.Header.Get("X-Gateway-Token")), key)
+	}
+	if !valid {
+		writeError(w, http.StatusForbidden, "forbidden", "invalid gateway token")
+		return
+	}
+	var body struct {
+		ID   string   `json:"id"`
+		From string   `json:"from"`
+		Text string   `json:"text"`
+		Lat  *float64 `json:"lat"`
+		Lon  *float64 `json:"lon"`
+		Via  string   `json:"via"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Via == "" {
+		body.Via = "sms"
+	}
+	var errs []FieldError
+	if body.From == "" {
+		errs = append(errs, FieldError{Field: "from", Message: "required"})
+	}
+	if !oneOf(body.Via, []string{"sms", "whatsapp"}) {
+		errs = append(errs, FieldError{Field: "via", Message: "must be sms or whatsapp"})
+	}
+	if (body.Lat == nil) != (body.Lon == nil) {
+		errs = append(errs, FieldError{Field: "lat", Message: "lat and lon go together"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid message", errs...)
+		return
+	}
+	reply := handleGatewayMessage(r, gatewayMessage{ID: body.ID, From: body.From, Via: body.Via, Text: body.Text, Lat: body.Lat, Lon: body.Lon})
+	writeJSON(w, http.StatusOK, map[string]string{"reply": reply})
+}
+
+// gatewayInboundHandler routes POST /reports/inbound/{gateway}
+func gatewayInboundHandler(w http.ResponseWriter, r *http.Request) {
+	switch mux.Vars(r)["gateway"] {
+	case "twilio":
+		twilioInboundHandler(w, r)
+	case "whatsapp":
+		whatsappInboundHandler(w, r)
+	case "generic":
+		genericInboundHandler(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "unknown gateway")
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Citizen incident reports from the public map. POST /reports takes a
+// form (multipart when there is a photo) with lat, lon, category,
+// description and photo, and files it as a pending feature of
+// REPORTS_LAYER, so it shows up in the moderation queue like any other
+// submission. Anonymous posting invites spam, so each report must pass:
+//   - a captcha, when REPORT_CAPTCHA (turnstile, hcaptcha or recaptcha)
+//     and REPORT_CAPTCHA_SECRET are set, or else a form token from
+//     GET /reports/token, single use and at least REPORT_MIN_FILL old;
+//   - a honeypot: the website field is hidden from people, so a report
+//     that fills it in is dropped while looking accepted;
+//   - REPORT_RATE reports per client address per hour (default 5),
+//     counted in Mongo so every instance shares the limit.
+// Coordinates outside COORD_EXTENT are refused rather than warned about.
+
+var reportCaptchaURLs = map[string]string{
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+}
+
+// the form fields the captcha widgets put their response in
+var reportCaptchaFields = []string{"captcha", "cf-turnstile-response", "h-captcha-response", "g-recaptcha-response"}
+
+const (
+	reportTokenTTL  = time.Hour
+	maxReportText   = 2000
+	reportHoneypot  = "website"
+	reportFormBytes = 64 << 10
+	// the feature field holding the reporter's contact, never a property
+	reportContactField = "reporter_contact"
+)
+
+var (
+	reportsLayer        = "reports"
+	reportCategories    = []string{"pothole", "flooding", "streetlight", "garbage", "fallen_tree", "other"}
+	reportRate          = 5
+	reportMinFill       = 3 * time.Second
+	reportPhotoBytes    = 5 << 20
+	reportCaptcha       string
+	reportCaptchaKey    string
+	reportCaptchaClient = &http.Client{Timeout: 10 * time.Second}
+	reportPhotos        *mongo.Collection
+	reportLimits        *mongo.Collection
+)
+
+func setupReports() {
+	reportsLayer = getenv("REPORTS_LAYER", reportsLayer)
+	if s := getenv("REPORT_CATEGORIES", ""); s != "" {
+		reportCategories = nil
+		for _, c := range strings.Split(s, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				reportCategories = append(reportCategories, c)
+			}
+		}
+	}
+	if n, err := strconv.Atoi(getenv("REPORT_RATE", "")); err == nil && n >= 0 {
+		reportRate = n
+	}
+	if d, err := time.ParseDuration(getenv("REPORT_MIN_FILL", "")); err == nil && d >= 0 {
+		reportMinFill = d
+	}
+	if n, err := strconv.Atoi(getenv("REPORT_PHOTO_MAX_BYTES", "")); err == nil && n > 0 && n <= 15<<20 {
+		reportPhotoBytes = n
+	}
+	if c := getenv("REPORT_CAPTCHA", ""); c != "" {
+		if _, ok := reportCaptchaURLs[c]; !ok {
+			log.Printf("REPORT_CAPTCHA %q unknown, using form tokens", c)
+		} else if reportCaptchaKey = getsecret("REPORT_CAPTCHA_SECRET", ""); reportCaptchaKey == "" {
+			log.Printf("REPORT_CAPTCHA_SECRET not set, using form tokens")
+		} else {
+			reportCaptcha = c
+		}
+	}
+	reportPhotos = db.Collection(getenv("MONGO_REPORT_PHOTOS_COLLECTION", "report_photos"))
+	reportLimits = db.Collection(getenv("MONGO_REPORT_LIMITS_COLLECTION", "report_limits"))
+	ttl := mongo.IndexModel{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)}
+	if _, err := reportLimits.Indexes().CreateOne(ctx, ttl); err != nil {
+		log.Printf("report limits index create warning: %v", err)
+	}
+	// reports filed before the contact had a field of its own kept it
+	// among the properties
+	moved, err := collection.UpdateMany(ctx, bson.M{"layer": reportsLayer, "properties.contact": bson.M{"$exists": true}}, mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{reportContactField: "$properties.contact"}}},
+		{{Key: "$unset", Value: "properties.contact"}},
+	})
+	if err != nil {
+		log.Printf("report contact migration warning: %v", err)
+	} else if moved.ModifiedCount > 0 {
+		log.Printf("moved the contact of %d reports out of their properties", moved.ModifiedCount)
+	}
+}
+
+func signReportToken(key []byte, issued int64, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("report|" + strconv.FormatInt(issued, 10) + "|" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// GET /reports/token hands the report form a token to send back, and says
+// which captcha, if any, it has to show instead
+func reportTokenHandler(w http.ResponseWriter, r *http.Request) {
+	out := map[string]interface{}{"categories": reportCategories}
+	if reportCaptcha != "" {
+		out["captcha"] = reportCaptcha
+	} else {
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		n := base64.RawURLEncoding.EncodeToString(nonce)
+		issued := time.Now().Unix()
+		out["token"] = strconv.FormatInt(issued, 10) + "." + n + "." + signReportToken(confirmKeys.current(), issued, n)
+		out["expires_at"] = time.Unix(issued, 0).Add(reportTokenTTL).UTC()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(out)
+}
+
+// checkReportToken verifies a form token and uses it up
+func checkReportToken(r *http.Request, token string, now time.Time) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "a form token from GET /reports/token is required"
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "invalid form token"
+	}
+	valid := false
+	for _, key := range confirmKeys.all() {
+		valid = valid || hmac.Equal([]byte(parts[2]), []byte(signReportToken(key, issued, parts[1])))
+	}
+	switch at := time.Unix(issued, 0); {
+	case !valid:
+		return "invalid form token"
+	case now.Sub(at) > reportTokenTTL:
+		return "the form token expired, reload the form"
+	case now.Sub(at) < reportMinFill:
+		return "the form was sent too quickly"
+	}
+	_, err = reportLimits.InsertOne(r.Context(), bson.M{"_id": "token|" + parts[1], "expires_at": time.Unix(issued, 0).Add(reportTokenTTL)})
+	if mongo.IsDuplicateKeyError(err) {
+		return "the form token was already used"
+	} else if err != nil {
+		log.Printf("report token check warning: %v", err)
+	}
+	return ""
+}
+
+// checkReportCaptcha asks the captcha provider about the response
+func checkReportCaptcha(r *http.Request, response string) (string, error) {
+	if response == "" {
+		return "captcha required", nil
+	}
+	form := url.Values{"secret": {reportCaptchaKey}, "response": {response}, "remoteip": {clientIP(r)}}
+	resp, err := reportCaptchaClient.PostForm(reportCaptchaURLs[reportCaptcha], form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out); err != nil {
+		return "", fmt.Errorf("captcha verify: %v", err)
+	}
+	if !out.Success {
+		return "captcha failed", nil
+	}
+	return "", nil
+}
+
+// reportAllowed counts a report against the sender's hourly REPORT_RATE;
+// sender is the client address or the phone number a message came from
+func reportAllowed(r *http.Request, sender string, now time.Time) (bool, time.Duration, error) {
+	if reportRate == 0 {
+		return true, 0, nil
+	}
+	hour := now.Truncate(time.Hour)
+	var doc struct {
+		Count int `bson:"count"`
+	}
+	err := reportLimits.FindOneAndUpdate(r.Context(),
+		bson.M{"_id": "rate|" + sender + "|" + strconv.FormatInt(hour.Unix(), 10)},
+		bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"expires_at": hour.Add(time.Hour)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&doc)
+	if err != nil {
+		return false, 0, err
+	}
+	return doc.Count <= reportRate, hour.Add(time.Hour).Sub(now), nil
+}
+
+// POST /reports (public) lat, lon, category, description, photo, plus the
+// captcha response or token
+func createReportHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, int64(reportPhotoBytes+reportFormBytes))
+	err := r.ParseMultipartForm(int64(reportPhotoBytes + reportFormBytes))
+	if err == http.ErrNotMultipart {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "invalid form: "+err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	if r.PostFormValue(reportHoneypot) != "" {
+		// look accepted so the bot moves on
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(bson.M{"status": statusPending})
+		return
+	}
+
+	var msg string
+	if reportCaptcha != "" {
+		var response string
+		for _, f := range reportCaptchaFields {
+			if response == "" {
+				response = r.PostFormValue(f)
+			}
+		}
+		if msg, err = checkReportCaptcha(r, response); err != nil {
+			writeError(w, http.StatusBadGateway, "captcha_unavailable", "captcha verification failed: "+err.Error())
+			return
+		}
+	} else {
+		msg = checkReportToken(r, r.PostFormValue("token"), now)
+	}
+	if msg != "" {
+		writeError(w, http.StatusForbidden, "verification_failed", msg)
+		return
+	}
+	ok, wait, err := reportAllowed(r, clientIP(r), now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		writeError(w, http.StatusTooManyRequests, "rate_limited", "too many reports from this address, try again later")
+		return
+	}
+
+	rep := reportInput{
+		Category:    r.PostFormValue("category"),
+		Description: strings.TrimSpace(r.PostFormValue("description")),
+		Via:         "public",
+	}
+	errs := rep.validate()
+	var errLat, errLon error
+	rep.Lat, errLat = strconv.ParseFloat(r.PostFormValue("lat"), 64)
+	rep.Lon, errLon = strconv.ParseFloat(r.PostFormValue("lon"), 64)
+	if errLat != nil || errLon != nil {
+		errs = append(errs, FieldError{Field: "lat", Message: "lat and lon are required numbers"})
+	}
+	if file, _, err := r.FormFile("photo"); err == nil {
+		rep.Photo, err = io.ReadAll(io.LimitReader(file, int64(reportPhotoBytes)+1))
+		file.Close()
+		rep.PhotoType = http.DetectContentType(rep.Photo)
+		switch {
+		case err != nil:
+			errs = append(errs, FieldError{Field: "photo", Message: "read error: " + err.Error()})
+		case len(rep.Photo) > reportPhotoBytes:
+			errs = append(errs, FieldError{Field: "photo", Message: fmt.Sprintf("up to %d MB", reportPhotoBytes>>20)})
+		case rep.PhotoType != "image/jpeg" && rep.PhotoType != "image/png" && rep.PhotoType != "image/webp":
+			errs = append(errs, FieldError{Field: "photo", Message: "must be a JPEG, PNG or WebP image"})
+		default:
+			// the location and camera the photo was taken with don't go
+			// out with the approved report
+			if rep.Photo, err = stripPhotoMetadata(rep.Photo, rep.PhotoType); err != nil {
+				errs = append(errs, FieldError{Field: "photo", Message: err.Error()})
+			}
+		}
+	} else if err != http.ErrMissingFile {
+		errs = append(errs, FieldError{Field: "photo", Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid report", errs...)
+		return
+	}
+
+	id, warnings, errs, err := fileReport(r, rep)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid report", errs...)
+		return
+	}
+	if err != nil {
+		writeReportError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(bson.M{"id": id, "status": statusPending, "warnings": warnings})
+}
+
+// reportInput is a report as it arrived, from the web form or a message
+// gateway
+type reportInput struct {
+	Lat, Lon    float64
+	Category    string
+	Description string
+	// Contact is how moderators can reach the reporter, if known
+	Contact string
+	// Via is the channel: public, sms or whatsapp
+	Via       string
+	Photo     []byte
+	PhotoType string
+}
+
+func (rep *reportInput) validate() []FieldError {
+	var errs []FieldError
+	if !oneOf(rep.Category, reportCategories) {
+		errs = append(errs, FieldError{Field: "category", Message: "must be one of " + strings.Join(reportCategories, ", ")})
+	}
+	if len([]rune(rep.Description)) > maxReportText {
+		errs = append(errs, FieldError{Field: "description", Message: fmt.Sprintf("up to %d characters", maxReportText)})
+	}
+	return errs
+}
+
+// fileReport stores a validated report as a pending REPORTS_LAYER feature
+// and tells the moderators. It returns the feature id and any coordinate
+// warnings, field errors for a bad location, or an error for
+// writeReportError.
+func fileReport(r *http.Request, rep reportInput) (string, []string, []FieldError, error) {
+	// the public can't turn the coordinate guard off
+	q := r.URL.Query()
+	q.Set("coord_guard", "reject")
+	r.URL.RawQuery = q.Encode()
+	layer := reportsLayer
+	in := FeatureInput{Lat: &rep.Lat, Lon: &rep.Lon, Layer: &layer}
+	geometry, _, errs := in.geometry(r)
+	if len(errs) > 0 {
+		return "", nil, errs, nil
+	}
+	if err := featureExtentCheck(&in, nil); err != nil {
+		return "", nil, nil, err
+	}
+	geometry = in.parsed.BSON()
+	id := primitive.NewObjectID()
+	props := map[string]interface{}{"category": rep.Category, "reported_via": rep.Via}
+	if rep.Photo != nil {
+		props["photo"] = "/reports/" + id.Hex() + "/photo"
+	}
+	if err := sealProperties(layer, props); err == errNoFieldKey {
+		return "", nil, nil, err
+	} else if err != nil {
+		return "", nil, nil, fmt.Errorf("db find error: %v", err)
+	}
+	now := time.Now().UTC()
+	doc := bson.M{
+		"_id":         id,
+		"name":        strings.ReplaceAll(rep.Category, "_", " "),
+		"description": rep.Description,
+		"layer":       layer,
+		"geometry":    geometry,
+		"properties":  props,
+		"status":      statusPending,
+		"created_at":  now,
+		"updated_at":  now,
+	}
+	if uid := userID(r); uid != "" {
+		doc["created_by"] = uid
+	}
+	// the contact is kept outside the properties, which are served with
+	// the feature once it is approved; reportContactHandler reads it
+	if rep.Contact != "" {
+		doc[reportContactField] = rep.Contact
+	}
+	if rep.Photo != nil {
+		photo := bson.M{"_id": id, "content_type": rep.PhotoType, "data": rep.Photo, "created_at": now}
+		if uid := userID(r); uid != "" {
+			photo["created_by"] = uid
+		}
+		if _, err := reportPhotos.InsertOne(r.Context(), photo); err != nil {
+			return "", nil, nil, fmt.Errorf("db insert error: %v", err)
+		}
+	}
+	if _, err := collection.InsertOne(r.Context(), doc); err != nil {
+		reportPhotos.DeleteOne(r.Context(), bson.M{"_id": id})
+		return "", nil, nil, fmt.Errorf("db insert error: %v", err)
+	}
+	notify(Event{
+		Type:    eventModerationRequested,
+		Subject: "New public report awaiting moderation",
+		Message: "A " + rep.Category + " report (" + id.Hex() + ") was sent via " + rep.Via + " and is waiting in the moderation queue.",
+		Data:    map[string]interface{}{"id": id.Hex(), "category": rep.Category, "layer": layer, "via": rep.Via},
+	})
+	return id.Hex(), in.warnings, nil, nil
+}
+
+func writeReportError(w http.ResponseWriter, err error) {
+	if _, ok := err.(extentError); ok {
+		writeExtentError(w, err)
+	} else if err == errNoFieldKey {
+		writeSealError(w, err)
+	} else {
+		writeError(w, http.StatusInternalServerError, "db_error", err.Error())
+	}
+}
+
+// GET /reports/{id}/contact is how the reporter can be reached, for
+// editors
+func reportContactHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	var doc struct {
+		Contact string `bson:"reporter_contact"`
+	}
+	err = collection.FindOne(r.Context(), bson.M{"_id": oid, "layer": reportsLayer}, options.FindOne().SetProjection(bson.M{reportContactField: 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "report not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	if doc.Contact == "" {
+		writeError(w, http.StatusNotFound, "not_found", "report has no contact")
+		return
+	}
+	// moved out of the properties of a sensitive reports layer
+	if isSealed(doc.Contact) {
+		v, err := openValue("contact", doc.Contact)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", "contact decrypt error: "+err.Error())
+			return
+		}
+		doc.Contact, _ = v.(string)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(bson.M{"contact": doc.Contact})
+}
+
+// GET /reports/{id}/photo is public once the report was approved, for
+// editors before
+func reportPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	q := bson.M{"_id": oid}
+	if authEnabled && !currentUser(r).hasRole("editor") {
+		q["status"] = bson.M{"$nin": bson.A{statusPending, statusRejected}}
+		applyVisibilityFilter(r, q)
+	}
+	if n, err := collection.CountDocuments(r.Context(), q, options.Count().SetLimit(1)); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	} else if n == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "report not found")
+		return
+	}
+	var p struct {
+		ContentType string `bson:"content_type"`
+		Data        []byte `bson:"data"`
+	}
+	err = reportPhotos.FindOne(r.Context(), bson.M{"_id": oid}).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "report has no photo")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", p.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.Data)))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(p.Data)
+}
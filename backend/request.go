@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// strictJSON rejects unknown fields in request bodies. STRICT_JSON=true turns
+// it on for every request, ?strict=true for a single one.
+var strictJSON bool
+
+// FeatureInput is the body of feature create and update requests. Pointer
+// fields tell "absent" from "empty" so updates only touch what was sent.
+type FeatureInput struct {
+	Name        *string                `json:"name"`
+	Description *string                `json:"description"`
+	Layer       *string                `json:"layer"`
+	GeoJSON     interface{}            `json:"geojson"`
+	Lat         *float64               `json:"lat"`
+	Lon         *float64               `json:"lon"`
+	Properties  map[string]interface{} `json:"properties"`
+	// Visibility is public (the default), internal or private
+	Visibility *string `json:"visibility"`
+	// Annotation is for features of annotation layers, see annotations.go
+	Annotation *AnnotationInput `json:"annotation"`
+	// Level is the floor the feature is on, a number or text like "0;2"
+	// or "1-3", see levels.go
+	Level interface{} `json:"level"`
+
+	warnings []string
+	// parsed is the geometry geometry() accepted
+	parsed *Geometry
+	// annotation is the Annotation featureAnnotationCheck accepted
+	annotation *Annotation
+	// splits is set by writes that can store the parts of a geometry its
+	// layer splits as features of their own, which featureExtentCheck
+	// leaves in parts
+	splits bool
+	parts  []Geometry
+	// level and levels are what validateLevel accepted
+	level  string
+	levels []float64
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Float32, reflect.Float64, reflect.Int, reflect.Int32, reflect.Int64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	return t.String()
+}
+
+func strictRequest(r *http.Request) bool {
+	if s, err := strconv.ParseBool(r.URL.Query().Get("strict")); err == nil {
+		return s
+	}
+	return strictJSON
+}
+
+// decodeJSON decodes the request body into v, writing a 400 that names the
+// offending field on failure
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	if strictRequest(r) {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(v)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after the JSON body")
+	}
+	if err == nil {
+		return true
+	}
+	writeDecodeError(w, err)
+	return false
+}
+
+// writeDecodeError turns a json decoding error into a 400 naming the field
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		writeError(w, http.StatusBadRequest, "invalid_json", "request body required")
+	case errors.As(err, &syntaxErr):
+		writeError(w, http.StatusBadRequest, "invalid_json", fmt.Sprintf("invalid json at byte %d: %v", syntaxErr.Offset, err))
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "body"
+		}
+		writeError(w, http.StatusBadRequest, "validation_failed", "wrong type for "+field,
+			FieldError{Field: field, Message: "must be a " + jsonTypeName(typeErr.Type) + ", got " + typeErr.Value})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeError(w, http.StatusBadRequest, "validation_failed", "unknown field "+field, FieldError{Field: field, Message: "not a recognised field"})
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_json", "invalid json: "+err.Error())
+	}
+}
+
+// clearableFields can be removed by sending null in a PATCH
+var clearableFields = map[string]bool{"description": true, "layer": true, "properties": true, "visibility": true, "annotation": true, "level": true}
+
+// decodePatch reads a JSON merge patch body (RFC 7396): fields set to null are
+// returned in clear, the rest is decoded into in. A null property value means
+// the key is removed and stays in in.Properties as nil.
+func decodePatch(w http.ResponseWriter, r *http.Request, in *FeatureInput) (clear []string, ok bool) {
+	var raw map[string]json.RawMessage
+	if !decodeJSON(w, r, &raw) {
+		return nil, false
+	}
+	var errs []FieldError
+	for k, v := range raw {
+		if string(bytes.TrimSpace(v)) != "null" {
+			continue
+		}
+		if !clearableFields[k] {
+			errs = append(errs, FieldError{Field: k, Message: "cannot be cleared"})
+		}
+		clear = append(clear, k)
+		delete(raw, k)
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid patch", errs...)
+		return nil, false
+	}
+	rest, _ := json.Marshal(raw)
+	dec := json.NewDecoder(bytes.NewReader(rest))
+	if strictRequest(r) {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(in); err != nil {
+		writeDecodeError(w, err)
+		return nil, false
+	}
+	sort.Strings(clear)
+	return clear, true
+}
+
+// geometry returns the normalized geometry from geojson or lat+lon. ok is
+// false when neither was given. Coordinate warnings end up in in.warnings.
+func (in *FeatureInput) geometry(r *http.Request) (g bson.M, ok bool, errs []FieldError) {
+	var parsed Geometry
+	field := "geojson"
+	if in.GeoJSON != nil {
+		var err error
+		if parsed, err = parseGeometry(in.GeoJSON); err != nil {
+			return nil, true, []FieldError{{Field: field, Message: err.Error()}}
+		}
+	} else if in.Lat == nil && in.Lon == nil {
+		return nil, false, nil
+	} else if in.Lat == nil || in.Lon == nil {
+		return nil, true, []FieldError{{Field: "lat", Message: "lat and lon must be given together"}}
+	} else {
+		field = "lat"
+		parsed = Geometry{Type: "Point", Point: Position{*in.Lon, *in.Lat}}
+	}
+	if err := checkGeometry(r, parsed, &in.warnings); err != nil {
+		return nil, true, []FieldError{{Field: field, Message: err.Error()}}
+	}
+	in.parsed = &parsed
+	return parsed.BSON(), true, nil
+}
+
+// checkGeometry validates g and runs the coordinate guard, appending its
+// warnings to warnings
+func checkGeometry(r *http.Request, g Geometry, warnings *[]string) error {
+	if err := g.Validate(); err != nil {
+		for _, p := range g.allPositions() {
+			if validatePosition(p) != nil {
+				return fmt.Errorf("%v%s", err, swappedHint(p))
+			}
+		}
+		return err
+	}
+	ws, err := guardCoordinates(r, g)
+	if warnings != nil {
+		*warnings = append(*warnings, ws...)
+	}
+	return err
+}
+
+// setFields is the $set document for the top-level fields that were sent
+func (in *FeatureInput) setFields(geometry bson.M, hasGeometry bool) bson.M {
+	set := bson.M{}
+	if in.Name != nil {
+		set["name"] = *in.Name
+	}
+	if in.Description != nil {
+		set["description"] = *in.Description
+	}
+	if in.Layer != nil {
+		set["layer"] = *in.Layer
+	}
+	if in.Visibility != nil {
+		set["visibility"] = *in.Visibility
+	}
+	if hasGeometry {
+		set["geometry"] = geometry
+	}
+	if in.annotation != nil {
+		set["annotation"] = in.annotation
+	}
+	if in.level != "" {
+		set["level"] = in.level
+		set["levels"] = in.levels
+	}
+	return set
+}
+
+// validateProperties checks property keys are storable field names
+func validateProperties(props map[string]interface{}) []FieldError {
+	var errs []FieldError
+	for k := range props {
+		if k == "" || strings.HasPrefix(k, "$") || strings.Contains(k, ".") {
+			errs = append(errs, FieldError{Field: "properties." + k, Message: "keys must be non-empty and contain no '.' or leading '$'"})
+		}
+	}
+	return errs
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Text search over name, description and SEARCH_PROPERTIES, optionally
+// limited to a bbox. Mongo can't use the text and 2dsphere indexes in one
+// stage, so the pipeline starts from whichever side is more selective:
+//
+//	text  $text match first (text index), bbox checked on its results
+//	geo   bbox match first (2dsphere index), terms then matched as
+//	      case-insensitive word prefixes on the same fields
+//
+// strategy=auto counts the bbox up to searchGeoFirstMax features and goes
+// geo-first when it holds fewer; a view over a small area is cheaper to scan
+// than every text hit across the collection.
+const (
+	searchDefaultLimit = 50
+	searchMaxLimit     = 500
+)
+
+var (
+	searchGeoFirstMax int64 = 5000
+	searchFields            = []string{"name", "description"}
+)
+
+func setupSearch() {
+	if v, err := strconv.ParseInt(getenv("SEARCH_GEO_FIRST_MAX", ""), 10, 64); err == nil && v >= 0 {
+		searchGeoFirstMax = v
+	}
+	keys := bson.D{{Key: "name", Value: "text"}, {Key: "description", Value: "text"}}
+	weights := bson.M{"name": 10, "description": 2}
+	for _, k := range strings.Split(getenv("SEARCH_PROPERTIES", ""), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, bson.E{Key: "properties." + k, Value: "text"})
+			searchFields = append(searchFields, "properties."+k)
+		}
+	}
+	model := mongo.IndexModel{Keys: keys, Options: options.Index().SetName("feature_text").SetWeights(weights)}
+	if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+		log.Printf("text index create warning: %v", err)
+	}
+}
+
+var searchTerm = regexp.MustCompile(`[\pL\pN]+`)
+
+// prefixMatch is the geo-first stand-in for $text: every term has to start
+// a word in one of the search fields
+func prefixMatch(text string) bson.M {
+	and := bson.A{}
+	for _, t := range searchTerm.FindAllString(text, -1) {
+		re := primitive.Regex{Pattern: `(^|[^\pL\pN])` + regexp.QuoteMeta(t), Options: "i"}
+		or := bson.A{}
+		for _, f := range searchFields {
+			or = append(or, bson.M{f: re})
+		}
+		and = append(and, bson.M{"$or": or})
+	}
+	if len(and) == 0 {
+		return matchNothing
+	}
+	return bson.M{"$and": and}
+}
+
+// GET /search?q=school&bbox=&layer=&level=&limit=&strategy=auto|text|geo
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	text := strings.TrimSpace(query.Get("q"))
+	if text == "" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "q is required", FieldError{Field: "q", Message: "required"})
+		return
+	}
+	limit := int64(searchDefaultLimit)
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 || n > searchMaxLimit {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(searchMaxLimit)})
+			return
+		}
+		limit = n
+	}
+	strategy := query.Get("strategy")
+	switch strategy {
+	case "":
+		strategy = "auto"
+	case "auto", "text", "geo":
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid strategy", FieldError{Field: "strategy", Message: "must be auto, text or geo"})
+		return
+	}
+
+	q := bson.M{}
+	if !applyStatusFilter(w, r, q) {
+		return
+	}
+	if layer := query.Get("layer"); layer != "" {
+		q["layer"] = layer
+	}
+	if !applyProjectFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if !applyPublicationFilter(w, r, q) || !applyLevelFilter(w, r, q) {
+		return
+	}
+	var geo bson.M
+	if bbox := query.Get("bbox"); bbox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(bbox)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid bbox", FieldError{Field: "bbox", Message: "expected minLon,minLat,maxLon,maxLat"})
+			return
+		}
+		geo = bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{minLon, minLat}, bson.A{maxLon, maxLat}}}}
+	} else if strategy == "geo" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "strategy=geo requires a bbox", FieldError{Field: "bbox", Message: "required for strategy=geo"})
+		return
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if strategy == "auto" {
+		strategy = "text"
+		if geo != nil {
+			gq := bson.M{"geometry": geo}
+			for k, v := range q {
+				gq[k] = v
+			}
+			n, err := collection.CountDocuments(ctx2, gq, options.Count().SetLimit(searchGeoFirstMax))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+				return
+			}
+			if n < searchGeoFirstMax {
+				strategy = "geo"
+			}
+		}
+	}
+
+	var pipeline mongo.Pipeline
+	if strategy == "text" {
+		first := bson.M{"$text": bson.M{"$search": text}}
+		for k, v := range q {
+			first[k] = v
+		}
+		pipeline = mongo.Pipeline{{{Key: "$match", Value: first}}}
+		if geo != nil {
+			pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"geometry": geo}}})
+		}
+		pipeline = append(pipeline,
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "score", Value: bson.M{"$meta": "textScore"}}, {Key: "_id", Value: 1}}}},
+		)
+	} else {
+		first := bson.M{"geometry": geo}
+		for k, v := range q {
+			first[k] = v
+		}
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: first}},
+			{{Key: "$match", Value: prefixMatch(text)}},
+			{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}}},
+		}
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+
+	cur, err := collection.Aggregate(ctx2, pipeline)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	defer cur.Close(ctx2)
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for cur.Next(ctx2) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		revealDoc(r, &doc)
+		fc.Features = append(fc.Features, featureToGeoJSON(doc))
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db cursor error: "+err.Error())
+		return
+	}
+	w.Header().Set("X-Search-Strategy", strategy)
+	writeCollection(w, r, fc, limit, 0)
+}
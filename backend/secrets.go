@@ -0,0 +1,197 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets can come from files instead of the environment, for Docker and
+// Kubernetes secrets. getsecret(KEY) reads the file named by KEY_FILE, else
+// the KEY variable, else SECRETS_DIR/<key in lower case> (/run/secrets by
+// default) when that file exists. Files are checked again every
+// SECRETS_RELOAD_INTERVAL (30s); when one changes its new value is used
+// from then on and watchers registered with watchSecret are told, so keys
+// can be rotated without a restart.
+type watchedFile struct {
+	path     string
+	mod      time.Time
+	size     int64
+	onChange []func()
+}
+
+var (
+	secretsMu     sync.Mutex
+	secretValues  = map[string]string{}
+	secretFiles   = map[string]*watchedFile{}
+	secretWatches = map[string][]func(string){}
+	reloadOnce    sync.Once
+)
+
+func secretPath(key string) string {
+	if p := os.Getenv(key + "_FILE"); p != "" {
+		return p
+	}
+	if os.Getenv(key) != "" {
+		return ""
+	}
+	p := filepath.Join(getenv("SECRETS_DIR", "/run/secrets"), strings.ToLower(key))
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	return ""
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// editors and `echo` leave a trailing newline
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// getsecret is getenv for secrets, see above. A configured file that can't
+// be read is fatal, since running without the secret would be worse.
+func getsecret(key, def string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	if v, ok := secretValues[key]; ok {
+		if v == "" {
+			return def
+		}
+		return v
+	}
+	path := secretPath(key)
+	if path == "" {
+		return getenv(key, def)
+	}
+	v, err := readSecretFile(path)
+	if err != nil {
+		log.Fatalf("secret %s: %v", key, err)
+	}
+	secretValues[key] = v
+	watchFileLocked(path, func() { reloadSecret(key, path) })
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// watchSecret calls fn with the new value whenever the file behind key
+// changes; keys set in the environment never do
+func watchSecret(key string, fn func(string)) {
+	secretsMu.Lock()
+	secretWatches[key] = append(secretWatches[key], fn)
+	secretsMu.Unlock()
+}
+
+// watchFile calls fn when path is replaced or modified
+func watchFile(path string, fn func()) {
+	secretsMu.Lock()
+	watchFileLocked(path, fn)
+	secretsMu.Unlock()
+}
+
+func watchFileLocked(path string, fn func()) {
+	f, ok := secretFiles[path]
+	if !ok {
+		f = &watchedFile{path: path}
+		if st, err := os.Stat(path); err == nil {
+			f.mod, f.size = st.ModTime(), st.Size()
+		}
+		secretFiles[path] = f
+	}
+	f.onChange = append(f.onChange, fn)
+	reloadOnce.Do(func() { go reloadSecrets() })
+}
+
+func reloadSecret(key, path string) {
+	v, err := readSecretFile(path)
+	if err != nil {
+		// mid-rotation the file may briefly be missing; keep the old value
+		log.Printf("secret %s reload warning: %v", key, err)
+		return
+	}
+	secretsMu.Lock()
+	changed := secretValues[key] != v
+	secretValues[key] = v
+	watches := secretWatches[key]
+	secretsMu.Unlock()
+	if !changed {
+		return
+	}
+	log.Printf("secret %s reloaded from %s", key, path)
+	for _, fn := range watches {
+		fn(v)
+	}
+}
+
+func reloadSecrets() {
+	interval := 30 * time.Second
+	if d, err := time.ParseDuration(getenv("SECRETS_RELOAD_INTERVAL", "")); err == nil && d > 0 {
+		interval = d
+	}
+	for range time.Tick(interval) {
+		var changed []func()
+		secretsMu.Lock()
+		for _, f := range secretFiles {
+			// os.Stat follows the symlinks Kubernetes swaps on update
+			st, err := os.Stat(f.path)
+			if err != nil || (st.ModTime().Equal(f.mod) && st.Size() == f.size) {
+				continue
+			}
+			f.mod, f.size = st.ModTime(), st.Size()
+			changed = append(changed, f.onChange...)
+		}
+		secretsMu.Unlock()
+		for _, fn := range changed {
+			fn()
+		}
+	}
+}
+
+// keyRing is a signing key that can be rotated. The key it replaced still
+// verifies, so tokens signed just before a rotation stay valid until they
+// expire.
+type keyRing struct {
+	mu   sync.RWMutex
+	keys [][]byte
+}
+
+func (k *keyRing) set(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.keys) > 0 {
+		k.keys = [][]byte{key, k.keys[0]}
+	} else {
+		k.keys = [][]byte{key}
+	}
+}
+
+// reset makes key the only one, so nothing signed before verifies
+func (k *keyRing) reset(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = [][]byte{key}
+}
+
+// current is the key to sign with, nil before one is set
+func (k *keyRing) current() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[0]
+}
+
+// all is the keys to verify with, newest first
+func (k *keyRing) all() [][]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//go:embed seed/*.geojson
+var seedFiles embed.FS
+
+// seedDataset is one bundled demo dataset. Boundary datasets go into the
+// boundaries collection, the others into a feature layer.
+type seedDataset struct {
+	Name     string
+	File     string
+	Layer    string
+	Template string
+}
+
+var seedDatasets = []seedDataset{
+	{Name: "districts", File: "seed/districts.geojson"},
+	{Name: "pois", File: "seed/pois.geojson", Layer: "demo-pois", Template: "poi"},
+	{Name: "roads", File: "seed/roads.geojson", Layer: "demo-roads", Template: "roads"},
+}
+
+// seedData loads the named datasets (all when names is empty). Reseeding
+// replaces what an earlier run loaded, so it can be repeated safely.
+func seedData(r *http.Request, names []string) (map[string]int, error) {
+	want := map[string]bool{}
+	for _, n := range names {
+		known := false
+		for _, ds := range seedDatasets {
+			known = known || ds.Name == n
+		}
+		if !known {
+			return nil, errUnknownDataset(n)
+		}
+		want[n] = true
+	}
+	loaded := map[string]int{}
+	for _, ds := range seedDatasets {
+		if len(want) > 0 && !want[ds.Name] {
+			continue
+		}
+		raw, err := seedFiles.ReadFile(ds.File)
+		if err != nil {
+			return loaded, err
+		}
+		var fc struct {
+			Features []interface{} `json:"features"`
+		}
+		if err := json.Unmarshal(raw, &fc); err != nil {
+			return loaded, fmt.Errorf("%s: %v", ds.File, err)
+		}
+		var n int
+		if ds.Layer == "" {
+			n, err = seedBoundaries(fc.Features)
+		} else {
+			n, err = seedLayer(r, ds, fc.Features)
+		}
+		if err != nil {
+			return loaded, fmt.Errorf("%s: %v", ds.Name, err)
+		}
+		loaded[ds.Name] = n
+	}
+	return loaded, nil
+}
+
+type errUnknownDataset string
+
+func (e errUnknownDataset) Error() string { return fmt.Sprintf("unknown dataset %q", string(e)) }
+
+func seedBoundaries(features []interface{}) (int, error) {
+	now := time.Now().UTC()
+	for i, raw := range features {
+		f, _ := asMap(raw)
+		props, _ := asMap(f["properties"])
+		g, err := parseGeometry(f["geometry"])
+		if err != nil {
+			return i, err
+		}
+		code, _ := props["code"].(string)
+		name, _ := props["name"].(string)
+		level, _ := props["level"].(string)
+		parent, _ := props["parent_code"].(string)
+		_, err = boundaries.UpdateOne(ctx, bson.M{"code": code}, bson.M{
+			"$set": bson.M{
+				"name": name, "level": level, "parent_code": parent,
+				"geometry": g.BSON(), "updated_at": now,
+			},
+			"$setOnInsert": bson.M{"created_at": now},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(features), nil
+}
+
+func seedLayer(r *http.Request, ds seedDataset, features []interface{}) (int, error) {
+	now := time.Now().UTC()
+	var t LayerTemplate
+	if err := layerTemplates.FindOne(ctx, bson.M{"_id": ds.Template}).Decode(&t); err != nil {
+		return 0, fmt.Errorf("template %s: %v", ds.Template, err)
+	}
+	_, err := layers.UpdateOne(ctx, bson.M{"_id": ds.Layer}, bson.M{
+		"$set": bson.M{
+			"name": "Demo " + strings.ToLower(t.Name), "fields": t.Fields, "style": t.Style,
+			"template": t.ID, "updated_at": now,
+		},
+		"$setOnInsert": bson.M{"created_at": now},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := collection.DeleteMany(ctx, bson.M{"layer": ds.Layer}); err != nil {
+		return 0, err
+	}
+	docs := make([]interface{}, 0, len(features))
+	for i, raw := range features {
+		parts, err := importFeatureDoc(raw, r, ds.Layer, now, nil)
+		if err != nil {
+			return 0, fmt.Errorf("feature %d: %v", i, err)
+		}
+		for _, doc := range parts {
+			docs = append(docs, doc)
+		}
+	}
+	if _, err := collection.InsertMany(ctx, docs); err != nil {
+		return 0, err
+	}
+	return len(docs), nil
+}
+
+// POST /admin/seed?dataset=pois&dataset=roads
+// Only registered when DEV_MODE=true
+func seedHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	loaded, err := seedData(r, r.URL.Query()["dataset"])
+	if err != nil {
+		if _, ok := err.(errUnknownDataset); ok {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error(), FieldError{Field: "dataset", Message: "one of districts, pois, roads"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "seed error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"loaded": loaded})
+}
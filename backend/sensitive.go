@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LayerSensitivity lists the properties of a layer that hold personal data.
+// Their values are stored encrypted with AES-256-GCM under
+// FIELD_ENCRYPTION_KEY (32 bytes, base64 or hex) and only returned to
+// admins and the listed readers: user ids, or role:<role> for everyone with
+// at least that role. Other callers get the features without them.
+// Encrypted values can't be filtered, sorted or searched on.
+type LayerSensitivity struct {
+	Fields  []string `bson:"fields" json:"fields"`
+	Readers []string `bson:"readers,omitempty" json:"readers,omitempty"`
+}
+
+// sealed values are "enc:v1:<key id>:<base64 nonce+ciphertext>" strings,
+// so readers recognise them without looking up the layer
+const sealedPrefix = "enc:v1:"
+
+var (
+	fieldKeys     fieldKeyRing
+	errNoFieldKey = errors.New("FIELD_ENCRYPTION_KEY is not configured")
+)
+
+// fieldKeyRing is the field encryption key and every key it replaced,
+// looked up by the key id sealed values carry. Unlike a signing keyRing
+// it never forgets a key: values sealed under one stay readable until
+// they are resealed. Keys replaced before a restart come back through
+// FIELD_ENCRYPTION_OLD_KEYS.
+type fieldKeyRing struct {
+	mu   sync.RWMutex
+	cur  []byte
+	byID map[string][]byte
+}
+
+// set makes key the one to seal with, keeping the one it replaces
+func (k *fieldKeyRing) set(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cur = key
+	k.addLocked(key)
+}
+
+// add keeps an older key for opening values
+func (k *fieldKeyRing) add(key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.addLocked(key)
+}
+
+func (k *fieldKeyRing) addLocked(key []byte) {
+	if k.byID == nil {
+		k.byID = map[string][]byte{}
+	}
+	k.byID[fieldKeyID(key)] = key
+}
+
+// current is the key to seal with, nil before one is set
+func (k *fieldKeyRing) current() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.cur
+}
+
+// lookup is the key with id kid, nil when it is unknown
+func (k *fieldKeyRing) lookup(kid string) []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.byID[kid]
+}
+
+func parseFieldKey(s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("FIELD_ENCRYPTION_KEY must be 32 bytes, base64 or hex encoded")
+}
+
+// FIELD_ENCRYPTION_OLD_KEYS lists keys FIELD_ENCRYPTION_KEY replaced,
+// comma separated, for values not yet resealed when the server restarts.
+// When the key is rotated, or old keys are configured, every sensitive
+// layer is resealed under the current key in the background; the
+// reseal_fields job does the same on demand.
+func setupFieldEncryption() {
+	old := 0
+	for _, s := range strings.Split(getsecret("FIELD_ENCRYPTION_OLD_KEYS", ""), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		key, err := parseFieldKey(s)
+		if err != nil {
+			log.Fatalf("FIELD_ENCRYPTION_OLD_KEYS: %v", err)
+		}
+		fieldKeys.add(key)
+		old++
+	}
+	if s := getsecret("FIELD_ENCRYPTION_KEY", ""); s != "" {
+		key, err := parseFieldKey(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fieldKeys.set(key)
+		if old > 0 {
+			go resealInBackground()
+		}
+	}
+	watchSecret("FIELD_ENCRYPTION_KEY", func(v string) {
+		key, err := parseFieldKey(v)
+		if err != nil {
+			log.Printf("field encryption key reload warning: %v", err)
+			return
+		}
+		if fieldKeyID(key) == fieldKeyID(fieldKeys.current()) {
+			return
+		}
+		fieldKeys.set(key)
+		go resealInBackground()
+	})
+}
+
+func resealInBackground() {
+	n, err := resealAllLayers()
+	if err != nil {
+		log.Printf("field reseal warning after %d features: %v", n, err)
+		return
+	}
+	log.Printf("field reseal: %d features rewritten under key %s", n, fieldKeyID(fieldKeys.current()))
+}
+
+// resealAllLayers reseals the values of every layer with sensitive fields
+// under the current key
+func resealAllLayers() (int, error) {
+	cur, err := layers.Find(ctx, bson.M{"sensitive.fields.0": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"sensitive": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var ls []LayerDoc
+	if err := cur.All(ctx, &ls); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, l := range ls {
+		n, err := resealLayer(l.ID, l.Sensitive.Fields)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("layer %s: %w", l.ID, err)
+		}
+	}
+	return total, nil
+}
+
+func runResealJob(c context.Context, j JobDoc) (string, error) {
+	if fieldKeys.current() == nil {
+		return "", errNoFieldKey
+	}
+	n, err := resealAllLayers()
+	return fmt.Sprintf("%d features resealed", n), err
+}
+
+func fieldKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func isSealed(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(s, sealedPrefix)
+}
+
+// sealValue encrypts v as JSON, so numbers and booleans keep their type.
+// The property name is authenticated too, so a value can't be moved to
+// another property.
+func sealValue(name string, v interface{}) (string, error) {
+	key := fieldKeys.current()
+	if key == nil {
+		return "", errNoFieldKey
+	}
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	out := gcm.Seal(nonce, nonce, plain, []byte(name))
+	return sealedPrefix + fieldKeyID(key) + ":" + base64.RawStdEncoding.EncodeToString(out), nil
+}
+
+func openValue(name, s string) (interface{}, error) {
+	kid, data, ok := strings.Cut(strings.TrimPrefix(s, sealedPrefix), ":")
+	if !ok {
+		return nil, errors.New("malformed encrypted value")
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, errors.New("malformed encrypted value")
+	}
+	key := fieldKeys.lookup(kid)
+	if key == nil {
+		return nil, fmt.Errorf("encrypted with unknown key %s, list it in FIELD_ENCRYPTION_OLD_KEYS", kid)
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	if len(raw) < gcm.NonceSize() {
+		return nil, errors.New("malformed encrypted value")
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	err = json.Unmarshal(plain, &v)
+	return v, err
+}
+
+// cached sensitivity so writes and reads don't look up the layer every time
+type cachedSensitivity struct {
+	fields  map[string]bool
+	readers []string
+	expires time.Time
+}
+
+var (
+	sensitivityMu    sync.Mutex
+	sensitivityCache = map[string]cachedSensitivity{}
+)
+
+func forgetSensitivity(layer string) {
+	sensitivityMu.Lock()
+	delete(sensitivityCache, layer)
+	sensitivityMu.Unlock()
+}
+
+func loadSensitivity(layer string) (cachedSensitivity, error) {
+	sensitivityMu.Lock()
+	c, ok := sensitivityCache[layer]
+	sensitivityMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c, nil
+	}
+	var doc LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": layer}, options.FindOne().SetProjection(bson.M{"sensitive": 1})).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return c, err
+	}
+	c = cachedSensitivity{fields: map[string]bool{}, expires: time.Now().Add(layerExtentTTL)}
+	if doc.Sensitive != nil {
+		for _, f := range doc.Sensitive.Fields {
+			c.fields[f] = true
+		}
+		c.readers = doc.Sensitive.Readers
+	}
+	sensitivityMu.Lock()
+	sensitivityCache[layer] = c
+	sensitivityMu.Unlock()
+	return c, nil
+}
+
+// sealProperties encrypts the sensitive properties of layer in props. It
+// is for values from clients, so one that looks sealed is sealed again
+// like any other text: passing it through would store whatever a client
+// sent behind the prefix unencrypted. resealLayer is the one path that
+// handles values already sealed.
+func sealProperties(layer string, props map[string]interface{}) error {
+	if layer == "" || len(props) == 0 {
+		return nil
+	}
+	s, err := loadSensitivity(layer)
+	if err != nil {
+		return err
+	}
+	for k, v := range props {
+		if !s.fields[k] || v == nil {
+			continue
+		}
+		if props[k], err = sealValue(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSealError answers a failed sealProperties
+func writeSealError(w http.ResponseWriter, err error) {
+	if err == errNoFieldKey {
+		writeError(w, http.StatusInternalServerError, "internal_error", "layer has sensitive fields but "+err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+}
+
+func canReadSensitive(r *http.Request, readers []string) bool {
+	// without auth everyone passes, as with requireRole
+	if !authEnabled {
+		return true
+	}
+	u := currentUser(r)
+	if u.hasRole("admin") {
+		return true
+	}
+	for _, p := range readers {
+		if role, ok := strings.CutPrefix(p, "role:"); ok {
+			if u.hasRole(role) {
+				return true
+			}
+		} else if u != nil && p == u.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// revealProperties decrypts the encrypted values in props for callers
+// allowed to read them and drops them for everyone else. A value that
+// can't be decrypted is left sealed, so a write of the feature doesn't
+// lose it.
+func revealProperties(r *http.Request, layer string, props map[string]interface{}) {
+	allowed := -1
+	for k, v := range props {
+		if !isSealed(v) {
+			continue
+		}
+		if allowed < 0 {
+			allowed = 0
+			if s, err := loadSensitivity(layer); err == nil && canReadSensitive(r, s.readers) {
+				allowed = 1
+			}
+		}
+		if allowed == 0 {
+			delete(props, k)
+			continue
+		}
+		plain, err := openValue(k, v.(string))
+		if err != nil {
+			log.Printf("layer %s property %s decrypt warning: %v", layer, k, err)
+			continue
+		}
+		props[k] = plain
+	}
+}
+
+// revealDoc prepares a stored feature for the caller: sensitive properties
+// they may read are decrypted and name and description are localized
+func revealDoc(r *http.Request, doc *FeatureDoc) {
+	revealProperties(r, doc.Layer, doc.Properties)
+	localizeDoc(r, doc)
+}
+
+func validateSensitivity(s *LayerSensitivity) []FieldError {
+	var errs []FieldError
+	for i, f := range s.Fields {
+		if f == "" || strings.ContainsAny(f, ".$") {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("fields[%d]", i), Message: "must be a property name"})
+		}
+	}
+	for i, p := range s.Readers {
+		if role, ok := strings.CutPrefix(p, "role:"); ok {
+			if _, known := roleRanks[role]; !known {
+				errs = append(errs, FieldError{Field: fmt.Sprintf("readers[%d]", i), Message: "unknown role " + role})
+			}
+		} else if p == "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("readers[%d]", i), Message: "must be a user id or role:<role>"})
+		}
+	}
+	if len(s.Fields) > 0 && fieldKeys.current() == nil {
+		errs = append(errs, FieldError{Field: "fields", Message: errNoFieldKey.Error()})
+	}
+	return errs
+}
+
+// PUT /layers/{id}/sensitive { fields, readers } sets which properties are
+// encrypted and who may read them. Existing features are rewritten to
+// match: newly sensitive values are encrypted, values of fields no longer
+// listed are decrypted, and values under an older key are re-encrypted with
+// the current one.
+func putLayerSensitivityHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	var body LayerSensitivity
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if body.Fields == nil {
+		body.Fields = []string{}
+	}
+	if errs := validateSensitivity(&body); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid sensitivity", errs...)
+		return
+	}
+	res, err := layers.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"sensitive": body, "updated_at": time.Now().UTC()}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "layer not found")
+		return
+	}
+	forgetSensitivity(id)
+	n, err := resealLayer(id, body.Fields)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", fmt.Sprintf("db update error after %d features: %v", n, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"sensitive": body, "features_updated": n})
+}
+
+func resealLayer(layer string, fields []string) (int, error) {
+	want := map[string]bool{}
+	for _, f := range fields {
+		want[f] = true
+	}
+	current := fieldKeyID(fieldKeys.current())
+	cur, err := collection.Find(ctx, bson.M{"layer": layer}, options.Find().SetProjection(bson.M{"properties": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	var models []mongo.WriteModel
+	n := 0
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		n += len(models)
+		models = models[:0]
+		return err
+	}
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		set := bson.M{}
+		for k, v := range doc.Properties {
+			sealed := isSealed(v)
+			switch {
+			case want[k] && v != nil && !sealed:
+				s, err := sealValue(k, v)
+				if err != nil {
+					return n, err
+				}
+				set["properties."+k] = s
+			case sealed && (!want[k] || !strings.HasPrefix(v.(string), sealedPrefix+current+":")):
+				plain, err := openValue(k, v.(string))
+				if err != nil {
+					log.Printf("layer %s feature %s property %s decrypt warning: %v", layer, doc.ID.Hex(), k, err)
+					continue
+				}
+				if want[k] {
+					if plain, err = sealValue(k, plain); err != nil {
+						return n, err
+					}
+				}
+				set["properties."+k] = plain
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": doc.ID}).SetUpdate(bson.M{"$set": set}))
+		if len(models) == 500 {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, flush()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// lineUpTo is the start of ps up to d meters along it
+func lineUpTo(ps []Position, d float64) []Position {
+	out := []Position{ps[0]}
+	for i := 1; i < len(ps); i++ {
+		seg := haversine(ps[i-1], ps[i])
+		if seg >= d {
+			if seg > 0 {
+				f := d / seg
+				out = append(out, Position{ps[i-1][0] + f*(ps[i][0]-ps[i-1][0]), ps[i-1][1] + f*(ps[i][1]-ps[i-1][1])})
+			}
+			return out
+		}
+		d -= seg
+		out = append(out, ps[i])
+	}
+	return out
+}
+
+func reversed(ps []Position) []Position {
+	out := make([]Position, len(ps))
+	for i, p := range ps {
+		out[len(ps)-1-i] = p
+	}
+	return out
+}
+
+// reachable collects the network geometry within limit meters of source:
+// whole edges whose far end is in reach and the reachable part of the
+// others, entered from whichever ends traffic may use
+func (g *roadGraph) reachable(source int, limit float64) ([]Position, int) {
+	dist, _ := g.dijkstra(source, -1, limit)
+	var ps []Position
+	nodes := 0
+	for _, d := range dist {
+		if d <= limit {
+			nodes++
+		}
+	}
+	for i, e := range g.edges {
+		pts := g.points[i]
+		if len(pts) < 2 {
+			continue
+		}
+		if d := dist[e.From]; d <= limit {
+			ps = append(ps, lineUpTo(pts, limit-d)...)
+		}
+		if d := dist[e.To]; d <= limit && !e.Oneway {
+			ps = append(ps, lineUpTo(reversed(pts), limit-d)...)
+		}
+	}
+	return ps, nodes
+}
+
+// GET /networks/{id}/service-area?from=lat,lon&distance=2000
+//
+//	&minutes=10&speed_kmh=30   cost as travel time instead of distance
+//	&alpha=200                 concave hull alpha in meters; 0 = convex hull
+//
+// The polygon covering every part of the network reachable from the origin
+// within the budget, computed on the internal graph.
+func serviceAreaHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, err := parseLatLon(query.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid from", FieldError{Field: "from", Message: err.Error()})
+		return
+	}
+	number := func(name string, def float64) (float64, bool) {
+		s := query.Get(name)
+		if s == "" {
+			return def, true
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid "+name, FieldError{Field: name, Message: "must be a non-negative number"})
+			return 0, false
+		}
+		return v, true
+	}
+	limit, ok := number("distance", 0)
+	if !ok {
+		return
+	}
+	minutes, ok := number("minutes", 0)
+	if !ok {
+		return
+	}
+	speed, ok := number("speed_kmh", 30)
+	if !ok {
+		return
+	}
+	if minutes > 0 {
+		limit = speed * 1000 / 60 * minutes
+	}
+	if limit <= 0 || limit > maxRadiusMeters {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "distance or minutes required", FieldError{Field: "distance", Message: fmt.Sprintf("must be between 0 and %.0f meters", maxRadiusMeters)})
+		return
+	}
+	alpha, ok := number("alpha", math.Max(50, limit/10))
+	if !ok {
+		return
+	}
+
+	_, g, ok := loadGraph(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	source, snap := g.nearestNode(from)
+	if source < 0 {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "no network node near from")
+		return
+	}
+
+	var geom Geometry
+	var failure string
+	var nodes int
+	if !runGeometry(w, r, func() {
+		var ps []Position
+		ps, nodes = g.reachable(source, limit)
+		ps = uniquePositions(ps)
+		// thin evenly so the triangulation stays within bounds
+		if len(ps) > maxAnalysisPoints {
+			step := float64(len(ps)) / maxAnalysisPoints
+			thin := make([]Position, 0, maxAnalysisPoints)
+			for i := 0.0; int(i) < len(ps); i += step {
+				thin = append(thin, ps[int(i)])
+			}
+			ps = thin
+		}
+		if alpha > 0 {
+			if polys := alphaShape(ps, alpha); len(polys) == 1 {
+				geom = Geometry{Type: "Polygon", Rings: polys[0]}
+				return
+			} else if len(polys) > 1 {
+				geom = Geometry{Type: "MultiPolygon", Polygons: polys}
+				return
+			}
+		}
+		ring := convexHull(ps)
+		if ring == nil {
+			failure = "too little of the network is reachable to form a polygon"
+			return
+		}
+		geom = Geometry{Type: "Polygon", Rings: [][]Position{ring}}
+	}) {
+		return
+	}
+	if failure != "" {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", failure)
+		return
+	}
+	props := bson.M{
+		"distance_m":  math.Round(limit),
+		"nodes":       nodes,
+		"snap_from_m": math.Round(snap*100) / 100,
+		"from":        pointJSON(from),
+	}
+	if minutes > 0 {
+		props["minutes"], props["speed_kmh"] = minutes, speed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GeoJSONFeature{Type: "Feature", Geometry: geom.BSON(), Properties: props})
+}
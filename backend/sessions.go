@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Cookie sessions for the bundled frontend, so browsers don't have to keep
+// tokens where scripts can read them. POST /auth/login with cookie: true
+// puts the session token in an HttpOnly cookie instead of the response, and
+// authMiddleware accepts that cookie when no Authorization header is sent.
+// Cookies are sent by the browser on its own, so writes authenticated by
+// one must also carry X-CSRF-Token: a value derived from the session token
+// that the frontend reads from the csrf cookie or the login response.
+// SESSION_COOKIE_SAMESITE is lax (default), strict or none.
+const (
+	sessionCookie = "gis_session"
+	csrfCookie    = "gis_csrf"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var sessionSameSite = http.SameSiteLaxMode
+
+func setupSessionCookies() {
+	switch strings.ToLower(getenv("SESSION_COOKIE_SAMESITE", "")) {
+	case "strict":
+		sessionSameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers only accept SameSite=None on Secure cookies, which
+		// setSessionCookies sets when the client is on HTTPS
+		sessionSameSite = http.SameSiteNoneMode
+	}
+}
+
+// csrfToken is bound to the session token, so it needs no storage and stops
+// working with the session
+func csrfToken(key []byte, session string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("csrf:" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF accepts tokens made with the current or the previous session
+// key, like the session itself
+func validCSRF(got, session string) bool {
+	for _, key := range sessionKeys.all() {
+		if hmac.Equal([]byte(got), []byte(csrfToken(key, session))) {
+			return true
+		}
+	}
+	return false
+}
+
+func setSessionCookies(w http.ResponseWriter, r *http.Request, token string, exp time.Time) string {
+	secure := requestClient(r).scheme == "https"
+	csrf := csrfToken(sessionKeys.current(), token)
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/", Expires: exp,
+		HttpOnly: true, Secure: secure, SameSite: sessionSameSite,
+	})
+	// readable by the frontend's scripts, which echo it in csrfHeader
+	http.SetCookie(w, &http.Cookie{
+		Name: csrfCookie, Value: csrf, Path: "/", Expires: exp,
+		Secure: secure, SameSite: sessionSameSite,
+	})
+	return csrf
+}
+
+func clearSessionCookies(w http.ResponseWriter, r *http.Request) {
+	secure := requestClient(r).scheme == "https"
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: name == sessionCookie, Secure: secure, SameSite: sessionSameSite})
+	}
+}
+
+// sessionFromCookie authenticates the session cookie of r, if any. An
+// expired or revoked session is dropped and the request goes on anonymous,
+// so logging in again works; ok is false when a write lacks its CSRF token
+// and the response has been written.
+func sessionFromCookie(w http.ResponseWriter, r *http.Request) (u *User, ok bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" || sessionKeys.current() == nil {
+		return nil, true
+	}
+	u, err = sessionTokens{}.authenticate(c.Value)
+	if err != nil {
+		clearSessionCookies(w, r)
+		return nil, true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if !validCSRF(r.Header.Get(csrfHeader), c.Value) {
+			writeError(w, http.StatusForbidden, "csrf_failed", "missing or wrong "+csrfHeader+" header")
+			return nil, false
+		}
+	}
+	return u, true
+}
+
+// POST /auth/logout clears the session cookies. Bearer session tokens
+// can't be revoked and simply expire.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	clearSessionCookies(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// AppSettings customizes the frontend without rebuilding it: the SPA
+// fetches GET /settings at startup. Admins replace them with PUT /settings;
+// until then the defaults from the SETTINGS_* variables apply.
+type AppSettings struct {
+	ID string `bson:"_id" json:"-"`
+	// Basemap is the id the map starts on, Basemaps the ones offered
+	Basemap  string   `bson:"basemap" json:"basemap"`
+	Basemaps []string `bson:"basemaps,omitempty" json:"basemaps,omitempty"`
+	// Extent is the initial view, [minLon, minLat, maxLon, maxLat]
+	Extent []float64 `bson:"extent,omitempty" json:"extent,omitempty"`
+	// Tools are the frontend tools that are switched on; empty means all
+	Tools     []string    `bson:"tools" json:"tools"`
+	Branding  AppBranding `bson:"branding" json:"branding"`
+	UpdatedBy string      `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	UpdatedAt *time.Time  `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+type AppBranding struct {
+	Title    string `bson:"title,omitempty" json:"title,omitempty"`
+	Subtitle string `bson:"subtitle,omitempty" json:"subtitle,omitempty"`
+	// Footer is shown under the map, e.g. the agency's name
+	Footer  string `bson:"footer,omitempty" json:"footer,omitempty"`
+	LogoURL string `bson:"logo_url,omitempty" json:"logo_url,omitempty"`
+	Color   string `bson:"color,omitempty" json:"color,omitempty"`
+}
+
+const appSettingsID = "app"
+
+var (
+	appSettings   *mongo.Collection
+	toolIDPattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,63}$`)
+	colorPattern  = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+)
+
+func setupSettings() {
+	appSettings = db.Collection(getenv("MONGO_SETTINGS_COLLECTION", "settings"))
+}
+
+// defaultSettings applies until an admin saves settings
+func defaultSettings() AppSettings {
+	s := AppSettings{
+		ID:      appSettingsID,
+		Basemap: getenv("SETTINGS_BASEMAP", "osm"),
+		Tools:   []string{},
+		Branding: AppBranding{
+			Title: getenv("SETTINGS_TITLE", "GIS"),
+		},
+	}
+	if minLon, minLat, maxLon, maxLat, ok := parseBBox(getenv("SETTINGS_EXTENT", "")); ok {
+		s.Extent = []float64{minLon, minLat, maxLon, maxLat}
+	}
+	return s
+}
+
+func validateSettings(s *AppSettings) []FieldError {
+	var errs []FieldError
+	s.Basemap = strings.TrimSpace(s.Basemap)
+	if !toolIDPattern.MatchString(s.Basemap) {
+		errs = append(errs, FieldError{Field: "basemap", Message: "a basemap id: lowercase letters, digits, _ and -"})
+	}
+	for _, b := range s.Basemaps {
+		if !toolIDPattern.MatchString(b) {
+			errs = append(errs, FieldError{Field: "basemaps", Message: "invalid basemap id " + b})
+		}
+	}
+	if len(s.Basemaps) > 0 {
+		offered := false
+		for _, b := range s.Basemaps {
+			offered = offered || b == s.Basemap
+		}
+		if !offered {
+			errs = append(errs, FieldError{Field: "basemap", Message: "must be one of basemaps"})
+		}
+	}
+	if e := s.Extent; e != nil && (len(e) != 4 || e[0] < -180 || e[2] > 180 || e[1] < -90 || e[3] > 90 || e[0] >= e[2] || e[1] >= e[3]) {
+		errs = append(errs, FieldError{Field: "extent", Message: "expected [minLon, minLat, maxLon, maxLat]"})
+	}
+	if s.Tools == nil {
+		s.Tools = []string{}
+	}
+	for _, t := range s.Tools {
+		if !toolIDPattern.MatchString(t) {
+			errs = append(errs, FieldError{Field: "tools", Message: "invalid tool id " + t})
+		}
+	}
+	b := &s.Branding
+	for _, f := range []struct {
+		name  string
+		value *string
+		max   int
+	}{{"branding.title", &b.Title, 100}, {"branding.subtitle", &b.Subtitle, 200}, {"branding.footer", &b.Footer, 500}} {
+		*f.value = strings.TrimSpace(*f.value)
+		if len([]rune(*f.value)) > f.max {
+			errs = append(errs, FieldError{Field: f.name, Message: "too long"})
+		}
+	}
+	// a logo is served from elsewhere or from this server, e.g. /symbols/logo
+	if b.LogoURL != "" && !strings.HasPrefix(b.LogoURL, "/") {
+		if u, err := url.Parse(b.LogoURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, FieldError{Field: "branding.logo_url", Message: "must be an http(s) URL or a path on this server"})
+		}
+	}
+	if b.Color != "" && !colorPattern.MatchString(b.Color) {
+		errs = append(errs, FieldError{Field: "branding.color", Message: "must be a hex color such as #1a73e8"})
+	}
+	return errs
+}
+
+func loadSettings(r *http.Request) (AppSettings, error) {
+	var s AppSettings
+	err := appSettings.FindOne(r.Context(), bson.M{"_id": appSettingsID}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return defaultSettings(), nil
+	}
+	if s.Tools == nil {
+		s.Tools = []string{}
+	}
+	return s, err
+}
+
+func writeSettings(w http.ResponseWriter, r *http.Request, s AppSettings) {
+	b, _ := json.Marshal(s)
+	sum := sha256.Sum256(b)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+// GET /settings is public, the frontend needs it before anyone logs in
+func getSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	s, err := loadSettings(r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeSettings(w, r, s)
+}
+
+// PUT /settings { basemap, basemaps, extent, tools, branding }
+// replaces the settings
+func putSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var body AppSettings
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if errs := validateSettings(&body); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid settings", errs...)
+		return
+	}
+	now := time.Now().UTC()
+	body.ID = appSettingsID
+	body.UpdatedBy = userID(r)
+	body.UpdatedAt = &now
+	if _, err := appSettings.ReplaceOne(r.Context(), bson.M{"_id": appSettingsID}, body, options.Replace().SetUpsert(true)); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	writeSettings(w, r, body)
+}
+
+// DELETE /settings goes back to the defaults
+func deleteSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	if _, err := appSettings.DeleteOne(r.Context(), bson.M{"_id": appSettingsID}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	writeSettings(w, r, defaultSettings())
+}
@@ -0,0 +1,1208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Situation reports: PDFs summing up some layers over the last period_days
+// for people who won't open the map. An admin defines a report under
+// /situation-reports (title, layers, optional bbox, the sections to
+// include and who gets it by email); it is generated on demand with
+// POST /situation-reports/{id}/run or on a schedule by a situation_report
+// job {report: id}. Each generated PDF is stored in situation_report_files
+// for SITUATION_REPORT_TTL (365 days) and emailed through the SMTP
+// notifier. Dates are printed in JOBS_TIMEZONE.
+
+// SituationReport is a report definition
+type SituationReport struct {
+	ID         string   `bson:"_id" json:"id"`
+	Title      string   `bson:"title" json:"title"`
+	Layers     []string `bson:"layers" json:"layers"`
+	BBox       string   `bson:"bbox,omitempty" json:"bbox,omitempty"`
+	PeriodDays int      `bson:"period_days" json:"period_days"`
+	Sections   []string `bson:"sections" json:"sections"`
+	Recipients []string `bson:"recipients,omitempty" json:"recipients,omitempty"`
+	// MaxRows caps the feature and work order tables
+	MaxRows   int       `bson:"max_rows" json:"max_rows"`
+	CreatedBy string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	UpdatedBy string    `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// SituationReportFile is one generated PDF
+type SituationReportFile struct {
+	ID          primitive.ObjectID `bson:"_id" json:"id"`
+	Report      string             `bson:"report" json:"report"`
+	Title       string             `bson:"title" json:"title"`
+	From        time.Time          `bson:"from" json:"from"`
+	To          time.Time          `bson:"to" json:"to"`
+	Trigger     string             `bson:"trigger" json:"trigger"`
+	By          string             `bson:"by,omitempty" json:"by,omitempty"`
+	Size        int                `bson:"size" json:"size"`
+	EmailedTo   []string           `bson:"emailed_to,omitempty" json:"emailed_to,omitempty"`
+	EmailError  string             `bson:"email_error,omitempty" json:"email_error,omitempty"`
+	GeneratedAt time.Time          `bson:"generated_at" json:"generated_at"`
+	Data        []byte             `bson:"data" json:"-"`
+}
+
+// the sections a report can have, in the order they are printed
+var sitReportSections = []string{"summary", "map", "categories", "trend", "work_orders", "moderation", "features"}
+
+const (
+	defaultSitReportDays = 7
+	defaultSitReportRows = 50
+	maxSitReportRows     = 500
+	sitMargin            = 40.0
+	sitWidth             = pdfPageW - 2*sitMargin
+)
+
+var (
+	situationReports  *mongo.Collection
+	situationFiles    *mongo.Collection
+	sitReportMapLimit = int64(5000)
+	sitPalette        = []uint32{0x1f77b4, 0xff7f0e, 0x2ca02c, 0x9467bd, 0x8c564b, 0xe377c2, 0x17becf, 0xbcbd22, 0x7f7f7f, 0xd62728}
+	sitInk            = pdfRGB(0x222222)
+	sitMuted          = pdfRGB(0x777777)
+	sitRule           = pdfRGB(0xcccccc)
+	sitShade          = pdfRGB(0xf0f0f0)
+	sitReportTimeout  = 5 * time.Minute
+)
+
+func setupSituationReports() {
+	situationReports = db.Collection(getenv("MONGO_SITUATION_REPORTS_COLLECTION", "situation_reports"))
+	situationFiles = db.Collection(getenv("MONGO_SITUATION_FILES_COLLECTION", "situation_report_files"))
+	if n, err := strconv.ParseInt(getenv("SITUATION_REPORT_MAP_FEATURES", ""), 10, 64); err == nil && n > 0 {
+		sitReportMapLimit = n
+	}
+	ttl := 365 * 24 * time.Hour
+	if d, err := time.ParseDuration(getenv("SITUATION_REPORT_TTL", "")); err == nil && d > 0 {
+		ttl = d
+	}
+	if _, err := situationFiles.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "generated_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(ttl.Seconds()))},
+		{Keys: bson.D{{Key: "report", Value: 1}, {Key: "generated_at", Value: -1}}},
+	}); err != nil {
+		log.Printf("situation report files index create warning: %v", err)
+	}
+}
+
+func validateSituationReport(rep *SituationReport) []FieldError {
+	var errs []FieldError
+	if rep.Title = strings.TrimSpace(rep.Title); rep.Title == "" {
+		errs = append(errs, FieldError{Field: "title", Message: "required"})
+	}
+	for i, l := range rep.Layers {
+		if l == "" {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("layers[%d]", i), Message: "must not be empty"})
+		}
+	}
+	if rep.BBox != "" {
+		if _, _, _, _, ok := parseBBox(rep.BBox); !ok {
+			errs = append(errs, FieldError{Field: "bbox", Message: "expected minLon,minLat,maxLon,maxLat"})
+		}
+	}
+	if rep.PeriodDays == 0 {
+		rep.PeriodDays = defaultSitReportDays
+	} else if rep.PeriodDays < 1 || rep.PeriodDays > 366 {
+		errs = append(errs, FieldError{Field: "period_days", Message: "must be between 1 and 366"})
+	}
+	if len(rep.Sections) == 0 {
+		rep.Sections = sitReportSections
+	}
+	for i, s := range rep.Sections {
+		if !oneOf(s, sitReportSections) {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("sections[%d]", i), Message: "must be one of " + strings.Join(sitReportSections, ", ")})
+		}
+	}
+	for i, to := range rep.Recipients {
+		if _, err := mail.ParseAddress(to); err != nil {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("recipients[%d]", i), Message: "not an email address"})
+		}
+	}
+	if rep.MaxRows == 0 {
+		rep.MaxRows = defaultSitReportRows
+	} else if rep.MaxRows < 1 || rep.MaxRows > maxSitReportRows {
+		errs = append(errs, FieldError{Field: "max_rows", Message: fmt.Sprintf("must be between 1 and %d", maxSitReportRows)})
+	}
+	return errs
+}
+
+func loadSituationReport(w http.ResponseWriter, r *http.Request) (SituationReport, bool) {
+	var rep SituationReport
+	err := situationReports.FindOne(r.Context(), bson.M{"_id": mux.Vars(r)["id"]}).Decode(&rep)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "situation report not found")
+		return rep, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return rep, false
+	}
+	return rep, true
+}
+
+// GET /situation-reports
+func listSituationReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	cur, err := situationReports.Find(r.Context(), bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []SituationReport{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// GET /situation-reports/{id}
+func getSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	if rep, ok := loadSituationReport(w, r); ok {
+		writeJSON(w, http.StatusOK, rep)
+	}
+}
+
+// POST /situation-reports { id, title, layers, bbox, period_days, sections,
+// recipients, max_rows }; no layers means every layer
+func createSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var rep SituationReport
+	if !decodeJSON(w, r, &rep) {
+		return
+	}
+	errs := validateSituationReport(&rep)
+	if !layerIDPattern.MatchString(rep.ID) {
+		errs = append(errs, FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, up to 64 characters"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid situation report", errs...)
+		return
+	}
+	now := time.Now().UTC()
+	rep.CreatedBy, rep.UpdatedBy = userID(r), userID(r)
+	rep.CreatedAt, rep.UpdatedAt = now, now
+	if _, err := situationReports.InsertOne(r.Context(), rep); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			writeError(w, http.StatusConflict, "conflict", "situation report "+rep.ID+" already exists", FieldError{Field: "id", Message: "already exists"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Location", "/situation-reports/"+rep.ID)
+	writeJSON(w, http.StatusCreated, rep)
+}
+
+// PUT /situation-reports/{id} replaces the definition
+func updateSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	old, ok := loadSituationReport(w, r)
+	if !ok {
+		return
+	}
+	var rep SituationReport
+	if !decodeJSON(w, r, &rep) {
+		return
+	}
+	if errs := validateSituationReport(&rep); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid situation report", errs...)
+		return
+	}
+	rep.ID, rep.CreatedBy, rep.CreatedAt = old.ID, old.CreatedBy, old.CreatedAt
+	rep.UpdatedBy, rep.UpdatedAt = userID(r), time.Now().UTC()
+	if _, err := situationReports.ReplaceOne(r.Context(), bson.M{"_id": rep.ID}, rep); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, rep)
+}
+
+// DELETE /situation-reports/{id} removes the definition and its files
+func deleteSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	res, err := situationReports.DeleteOne(r.Context(), bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "situation report not found")
+		return
+	}
+	if _, err := situationFiles.DeleteMany(r.Context(), bson.M{"report": id}); err != nil {
+		log.Printf("situation report %s files delete warning: %v", id, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GET /situation-reports/{id}/preview renders the PDF without storing or
+// sending it
+func previewSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	rep, ok := loadSituationReport(w, r)
+	if !ok {
+		return
+	}
+	out, _, err := renderSituationReport(r.Context(), rep, time.Now().UTC())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "report error: "+err.Error())
+		return
+	}
+	writePDF(w, rep.ID+".pdf", out)
+}
+
+// POST /situation-reports/{id}/run?email=false generates, stores and
+// (unless email=false) emails the report now
+func runSituationReportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	rep, ok := loadSituationReport(w, r)
+	if !ok {
+		return
+	}
+	f, err := generateSituationReport(r.Context(), rep, "manual", userID(r), r.URL.Query().Get("email") != "false")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "report error: "+err.Error())
+		return
+	}
+	w.Header().Set("Location", "/situation-reports/"+rep.ID+"/files/"+f.ID.Hex())
+	writeJSON(w, http.StatusCreated, f)
+}
+
+// GET /situation-reports/{id}/files lists the stored PDFs, newest first
+func listSituationFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "generated_at", Value: -1}}).SetProjection(bson.M{"data": 0}).SetLimit(limit).SetSkip(offset)
+	cur, err := situationFiles.Find(r.Context(), bson.M{"report": mux.Vars(r)["id"]}, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []SituationReportFile{}
+	if err := cur.All(r.Context(), &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// GET /situation-reports/{id}/files/{fid} downloads a stored PDF
+func getSituationFileHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	vars := mux.Vars(r)
+	oid, err := primitive.ObjectIDFromHex(vars["fid"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return
+	}
+	var f SituationReportFile
+	err = situationFiles.FindOne(r.Context(), bson.M{"_id": oid, "report": vars["id"]}).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "report file not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	writePDF(w, f.Report+"-"+f.To.In(jobLocation).Format("2006-01-02")+".pdf", f.Data)
+}
+
+func writePDF(w http.ResponseWriter, name string, data []byte) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// situation_report {report: id}
+func validateSituationJob(params bson.M) []FieldError {
+	if paramString(params, "report") == "" {
+		return []FieldError{{Field: "params.report", Message: "required"}}
+	}
+	return nil
+}
+
+func runSituationJob(c context.Context, j JobDoc) (string, error) {
+	var rep SituationReport
+	if err := situationReports.FindOne(c, bson.M{"_id": paramString(j.Params, "report")}).Decode(&rep); err != nil {
+		return "", fmt.Errorf("situation report %s: %v", paramString(j.Params, "report"), err)
+	}
+	f, err := generateSituationReport(c, rep, "job:"+j.Name, "", true)
+	if err != nil {
+		return "", err
+	}
+	msg := fmt.Sprintf("%d byte report %s", f.Size, f.ID.Hex())
+	if len(f.EmailedTo) > 0 {
+		msg += fmt.Sprintf(", emailed to %d", len(f.EmailedTo))
+	}
+	if f.EmailError != "" {
+		return msg, fmt.Errorf("email failed: %s", f.EmailError)
+	}
+	return msg, nil
+}
+
+// generateSituationReport renders the report up to now, stores it and
+// emails it to the recipients when email is set. A failed email is
+// recorded on the file rather than losing the report.
+func generateSituationReport(c context.Context, rep SituationReport, trigger, by string, email bool) (SituationReportFile, error) {
+	c, cancel := context.WithTimeout(c, sitReportTimeout)
+	defer cancel()
+	now := time.Now().UTC()
+	data, from, err := renderSituationReport(c, rep, now)
+	if err != nil {
+		return SituationReportFile{}, err
+	}
+	f := SituationReportFile{
+		ID: primitive.NewObjectID(), Report: rep.ID, Title: rep.Title, From: from, To: now,
+		Trigger: trigger, By: by, Size: len(data), GeneratedAt: now, Data: data,
+	}
+	if email && len(rep.Recipients) > 0 {
+		n, ok := notifiers["smtp"].(smtpNotifier)
+		if !ok {
+			f.EmailError = "SMTP_HOST is not configured"
+		} else if err := n.sendAttachment(rep.Recipients, rep.Title, sitReportEmailBody(rep, from, now),
+			rep.ID+"-"+now.In(jobLocation).Format("2006-01-02")+".pdf", "application/pdf", data); err != nil {
+			f.EmailError = err.Error()
+		} else {
+			f.EmailedTo = rep.Recipients
+		}
+	}
+	if _, err := situationFiles.InsertOne(c, f); err != nil {
+		return f, fmt.Errorf("db insert error: %v", err)
+	}
+	return f, nil
+}
+
+func sitReportEmailBody(rep SituationReport, from, to time.Time) string {
+	return rep.Title + "\r\n\r\nThe situation report for " + sitDate(from) + " to " + sitDate(to) +
+		" is attached.\r\n"
+}
+
+func sitDate(t time.Time) string { return t.In(jobLocation).Format("2 Jan 2006") }
+
+// sitPage lays content out top to bottom, starting new pages as needed
+type sitPage struct {
+	d *pdfDoc
+	y float64
+}
+
+func (p *sitPage) need(h float64) {
+	if p.d.page == nil || p.y+h > pdfPageH-50 {
+		p.d.addPage()
+		p.y = 50
+	}
+}
+
+func (p *sitPage) heading(s string) {
+	p.need(60)
+	p.y += 22
+	p.d.fill(sitInk)
+	p.d.text(sitMargin, p.y, 13, true, s)
+	p.y += 5
+	p.d.stroke(sitRule)
+	p.d.lineWidth(0.7)
+	p.d.line(sitMargin, p.y, sitMargin+sitWidth, p.y)
+	p.y += 12
+}
+
+func (p *sitPage) para(s string, size float64, color pdfColor) {
+	for _, l := range pdfWrap(s, sitWidth, size, false) {
+		p.need(size + 4)
+		p.y += size + 3
+		p.d.fill(color)
+		p.d.text(sitMargin, p.y, size, false, l)
+	}
+	p.y += 4
+}
+
+type sitCol struct {
+	Title string
+	Width float64
+	Right bool
+}
+
+// table prints rows under a shaded header row, repeated on each page
+func (p *sitPage) table(cols []sitCol, rows [][]string) {
+	const rowH = 14.0
+	header := func() {
+		p.d.fill(sitShade)
+		p.d.rect(sitMargin, p.y, sitWidth, rowH, "f")
+		p.cells(cols, nil, true)
+	}
+	p.need(2 * rowH)
+	header()
+	for i, row := range rows {
+		if p.y+rowH > pdfPageH-50 {
+			p.need(2 * rowH)
+			header()
+		}
+		if i%2 == 1 {
+			p.d.fill(pdfRGB(0xfafafa))
+			p.d.rect(sitMargin, p.y, sitWidth, rowH, "f")
+		}
+		p.cells(cols, row, false)
+	}
+	p.y += 6
+}
+
+func (p *sitPage) cells(cols []sitCol, row []string, header bool) {
+	x := sitMargin
+	p.d.fill(sitInk)
+	for i, c := range cols {
+		s := c.Title
+		if !header {
+			s = ""
+			if i < len(row) {
+				s = row[i]
+			}
+		}
+		s = pdfFit(s, c.Width-8, 8.5, header)
+		if c.Right {
+			p.d.textRight(x+c.Width-4, p.y+10, 8.5, header, s)
+		} else {
+			p.d.text(x+4, p.y+10, 8.5, header, s)
+		}
+		x += c.Width
+	}
+	p.y += 14
+}
+
+type sitBar struct {
+	Label string
+	Value float64
+}
+
+// bars draws a horizontal bar chart
+func (p *sitPage) bars(items []sitBar, color pdfColor) {
+	const rowH, labelW, valueW = 14.0, 150.0, 50.0
+	max := 0.0
+	for _, it := range items {
+		max = math.Max(max, it.Value)
+	}
+	for _, it := range items {
+		p.need(rowH)
+		p.d.fill(sitInk)
+		p.d.text(sitMargin, p.y+10, 8.5, false, pdfFit(it.Label, labelW-6, 8.5, false))
+		if max > 0 {
+			p.d.fill(color)
+			p.d.rect(sitMargin+labelW, p.y+2, (sitWidth-labelW-valueW)*it.Value/max, rowH-4, "f")
+		}
+		p.d.fill(sitInk)
+		p.d.textRight(sitMargin+sitWidth, p.y+10, 8.5, false, sitCount(it.Value))
+		p.y += rowH
+	}
+	p.y += 6
+}
+
+type sitSeries struct {
+	Name   string
+	Color  pdfColor
+	Values []float64 // per date, NaN for none
+}
+
+// lines draws series over dates as a line chart with a legend
+func (p *sitPage) lines(dates []string, series []sitSeries) {
+	const h, axisW = 170.0, 40.0
+	p.need(h + 40)
+	top := p.y + 6
+	x0, w := sitMargin+axisW, sitWidth-axisW
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, s := range series {
+		for _, v := range s.Values {
+			if !math.IsNaN(v) {
+				lo, hi = math.Min(lo, v), math.Max(hi, v)
+			}
+		}
+	}
+	if lo > hi {
+		return
+	}
+	lo = math.Min(lo, 0)
+	step := sitNiceStep((hi - lo) / 4)
+	hi = math.Ceil(hi/step) * step
+	if hi <= lo {
+		hi = lo + step
+	}
+	yOf := func(v float64) float64 { return top + h - (v-lo)/(hi-lo)*h }
+	xOf := func(i int) float64 {
+		if len(dates) < 2 {
+			return x0 + w/2
+		}
+		return x0 + w*float64(i)/float64(len(dates)-1)
+	}
+	p.d.lineWidth(0.5)
+	for v := lo; v <= hi+step/2; v += step {
+		p.d.stroke(sitRule)
+		p.d.line(x0, yOf(v), x0+w, yOf(v))
+		p.d.fill(sitMuted)
+		p.d.textRight(x0-4, yOf(v)+3, 7.5, false, sitCount(v))
+	}
+	for _, i := range []int{0, len(dates) / 2, len(dates) - 1} {
+		label := dates[i]
+		lw := pdfTextWidth(label, 7.5, false)
+		x := math.Max(x0, math.Min(xOf(i)-lw/2, x0+w-lw))
+		p.d.text(x, top+h+11, 7.5, false, label)
+	}
+	p.d.lineWidth(1.5)
+	for _, s := range series {
+		var pts [][2]float64
+		flush := func() {
+			if len(pts) == 1 {
+				p.d.fill(s.Color)
+				p.d.circle(pts[0][0], pts[0][1], 1.5, "f")
+			} else if len(pts) > 1 {
+				p.d.stroke(s.Color)
+				p.d.path(pts, false)
+				p.d.paint("S")
+			}
+			pts = nil
+		}
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				flush()
+				continue
+			}
+			pts = append(pts, [2]float64{xOf(i), yOf(v)})
+		}
+		flush()
+	}
+	p.y = top + h + 18
+	p.legend(series)
+}
+
+func (p *sitPage) legend(series []sitSeries) {
+	x := sitMargin
+	p.need(14)
+	for _, s := range series {
+		lw := pdfTextWidth(s.Name, 8, false) + 22
+		if x+lw > sitMargin+sitWidth {
+			x = sitMargin
+			p.y += 12
+			p.need(14)
+		}
+		p.d.fill(s.Color)
+		p.d.rect(x, p.y+3, 8, 8, "f")
+		p.d.fill(sitInk)
+		p.d.text(x+12, p.y+10, 8, false, s.Name)
+		x += lw
+	}
+	p.y += 18
+}
+
+// sitNiceStep rounds a step up to 1, 2 or 5 times a power of ten
+func sitNiceStep(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	mag := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if v <= m*mag {
+			return math.Max(m*mag, 1)
+		}
+	}
+	return 10 * mag
+}
+
+func sitCount(v float64) string {
+	if v == math.Trunc(v) {
+		s := strconv.FormatInt(int64(v), 10)
+		// thousands separators
+		for i := len(s) - 3; i > 0 && s[i-1] != '-'; i -= 3 {
+			s = s[:i] + "," + s[i:]
+		}
+		return s
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+func sitLayerColor(layers []string, layer string) pdfColor {
+	for i, l := range layers {
+		if l == layer {
+			return pdfRGB(sitPalette[i%len(sitPalette)])
+		}
+	}
+	return sitMuted
+}
+
+// sitReport holds what renderSituationReport collects for the sections
+type sitReport struct {
+	rep      SituationReport
+	layers   []string
+	from, to time.Time
+	c        context.Context
+	p        *sitPage
+}
+
+// base is the filter for the report's published features
+func (s *sitReport) base() bson.M {
+	q := bson.M{"layer": bson.M{"$in": s.layers}, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	if minLon, minLat, maxLon, maxLat, ok := parseBBox(s.rep.BBox); ok {
+		q["geometry"] = bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{minLon, minLat}, bson.A{maxLon, maxLat}}}}
+	}
+	return q
+}
+
+func (s *sitReport) inPeriod() bson.M {
+	return bson.M{"$gte": s.from, "$lt": s.to}
+}
+
+// renderSituationReport builds the PDF for the period_days before to and
+// returns it with the period start
+func renderSituationReport(c context.Context, rep SituationReport, to time.Time) ([]byte, time.Time, error) {
+	s := &sitReport{rep: rep, layers: rep.Layers, to: to, from: to.Add(-time.Duration(rep.PeriodDays) * 24 * time.Hour), c: c}
+	if len(s.layers) == 0 {
+		ids, err := heavyReads.Distinct(c, "layer", bson.M{"layer": bson.M{"$exists": true, "$ne": ""}})
+		if err != nil {
+			return nil, s.from, err
+		}
+		for _, v := range ids {
+			if l, ok := v.(string); ok {
+				s.layers = append(s.layers, l)
+			}
+		}
+		sort.Strings(s.layers)
+	}
+	d := &pdfDoc{Title: rep.Title}
+	s.p = &sitPage{d: d}
+	s.p.need(80)
+	d.fill(sitInk)
+	d.text(sitMargin, s.p.y+16, 20, true, pdfFit(rep.Title, sitWidth, 20, true))
+	s.p.y += 24
+	s.p.para(fmt.Sprintf("%s to %s · %s", sitDate(s.from), sitDate(s.to), strings.Join(s.layers, ", ")), 10, sitMuted)
+
+	sections := map[string]func() error{
+		"summary":     s.summary,
+		"map":         s.drawMap,
+		"categories":  s.categories,
+		"trend":       s.trend,
+		"work_orders": s.workOrders,
+		"moderation":  s.moderation,
+		"features":    s.features,
+	}
+	for _, name := range sitReportSections {
+		if !oneOf(name, rep.Sections) {
+			continue
+		}
+		if err := sections[name](); err != nil {
+			return nil, s.from, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	generated := "Generated " + s.to.In(jobLocation).Format("2 Jan 2006 15:04 MST")
+	for i, page := range d.pages {
+		d.page = page
+		d.fill(sitMuted)
+		d.text(sitMargin, pdfPageH-25, 7.5, false, generated)
+		d.textRight(sitMargin+sitWidth, pdfPageH-25, 7.5, false, fmt.Sprintf("%s · page %d of %d", pdfFit(rep.Title, 250, 7.5, false), i+1, len(d.pages)))
+	}
+	return d.bytes(), s.from, nil
+}
+
+func (s *sitReport) aggregate(coll *mongo.Collection, pipeline bson.A, out interface{}) error {
+	cur, err := coll.Aggregate(s.c, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	return cur.All(s.c, out)
+}
+
+func (s *sitReport) summary() error {
+	match := s.base()
+	delete(match, "status")
+	visible := bson.M{"$not": bson.M{"$in": bson.A{"$status", bson.A{statusPending, statusRejected}}}}
+	inPeriod := func(field string) bson.M {
+		return bson.M{"$and": bson.A{bson.M{"$gte": bson.A{field, s.from}}, bson.M{"$lt": bson.A{field, s.to}}}}
+	}
+	count := func(cond interface{}) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{cond, 1, 0}}}
+	}
+	var rows []struct {
+		Layer   string `bson:"_id"`
+		Total   int64  `bson:"total"`
+		New     int64  `bson:"new"`
+		Updated int64  `bson:"updated"`
+		Pending int64  `bson:"pending"`
+	}
+	err := s.aggregate(heavyReads, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id":     "$layer",
+			"total":   count(visible),
+			"new":     count(bson.M{"$and": bson.A{visible, inPeriod("$created_at")}}),
+			"updated": count(bson.M{"$and": bson.A{visible, inPeriod("$updated_at"), bson.M{"$lt": bson.A{"$created_at", s.from}}}}),
+			"pending": count(bson.M{"$eq": bson.A{"$status", statusPending}}),
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}, &rows)
+	if err != nil {
+		return err
+	}
+	s.p.heading("Summary")
+	var table [][]string
+	var total, added, updated, pending int64
+	for _, r := range rows {
+		table = append(table, []string{r.Layer, sitCount(float64(r.Total)), sitCount(float64(r.New)), sitCount(float64(r.Updated)), sitCount(float64(r.Pending))})
+		total, added, updated, pending = total+r.Total, added+r.New, updated+r.Updated, pending+r.Pending
+	}
+	if len(rows) > 1 {
+		table = append(table, []string{"All layers", sitCount(float64(total)), sitCount(float64(added)), sitCount(float64(updated)), sitCount(float64(pending))})
+	}
+	if len(table) == 0 {
+		s.p.para("No features in these layers.", 9, sitMuted)
+		return nil
+	}
+	s.p.table([]sitCol{{"Layer", 195, false}, {"Features", 80, true}, {"New", 80, true}, {"Updated", 80, true}, {"Pending review", 80.28, true}}, table)
+	return nil
+}
+
+func (s *sitReport) drawMap() error {
+	opts := options.Find().SetProjection(bson.M{"geometry": 1, "layer": 1, "created_at": 1}).
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(sitReportMapLimit)
+	cur, err := heavyReads.Find(s.c, s.base(), opts)
+	if err != nil {
+		return err
+	}
+	type item struct {
+		g     Geometry
+		layer string
+		isNew bool
+	}
+	var items []item
+	ext := BBox{MinLon: 180, MinLat: 90, MaxLon: -180, MaxLat: -90}
+	for cur.Next(s.c) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		g, err := parseGeometry(doc.Geometry)
+		if err != nil {
+			continue
+		}
+		for _, p := range g.allPositions() {
+			ext = BBox{math.Min(ext.MinLon, p[0]), math.Min(ext.MinLat, p[1]), math.Max(ext.MaxLon, p[0]), math.Max(ext.MaxLat, p[1])}
+		}
+		items = append(items, item{g, doc.Layer, !doc.CreatedAt.Before(s.from)})
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	cur.Close(s.c)
+	if minLon, minLat, maxLon, maxLat, ok := parseBBox(s.rep.BBox); ok {
+		ext = BBox{minLon, minLat, maxLon, maxLat}
+	}
+
+	s.p.heading("Map")
+	if len(items) == 0 {
+		s.p.para("No features to map.", 9, sitMuted)
+		return nil
+	}
+	const boxH = 380.0
+	s.p.need(boxH + 40)
+	top := s.p.y
+	merc := func(lon, lat float64) (float64, float64) {
+		lat = math.Max(-85, math.Min(85, lat))
+		return lon * math.Pi / 180, math.Log(math.Tan(math.Pi/4 + lat*math.Pi/360))
+	}
+	x1, y1 := merc(ext.MinLon, ext.MinLat)
+	x2, y2 := merc(ext.MaxLon, ext.MaxLat)
+	// a single point still needs an area around it
+	pad := math.Max(math.Max(x2-x1, y2-y1)*0.05, 0.0005)
+	x1, y1, x2, y2 = x1-pad, y1-pad, x2+pad, y2+pad
+	scale := math.Min(sitWidth/(x2-x1), boxH/(y2-y1))
+	offX := sitMargin + (sitWidth-(x2-x1)*scale)/2
+	offY := top + (boxH-(y2-y1)*scale)/2
+	proj := func(p Position) [2]float64 {
+		x, y := merc(p[0], p[1])
+		return [2]float64{offX + (x-x1)*scale, offY + (y2-y)*scale}
+	}
+
+	d := s.p.d
+	d.fill(pdfRGB(0xf4f6f8))
+	d.rect(sitMargin, top, sitWidth, boxH, "f")
+	d.clip(sitMargin, top, sitWidth, boxH)
+	var newCount int
+	for i := len(items) - 1; i >= 0; i-- {
+		it := items[i]
+		if it.isNew {
+			newCount++
+		}
+		s.drawGeometry(it.g, proj, sitLayerColor(s.layers, it.layer), it.isNew)
+	}
+	d.restore()
+	d.stroke(sitRule)
+	d.lineWidth(0.7)
+	d.rect(sitMargin, top, sitWidth, boxH, "S")
+
+	// scale bar in the bottom left corner, at most 100pt long
+	metersPerPt := 6371008.8 * math.Cos((ext.MinLat+ext.MaxLat)/2*math.Pi/180) / scale
+	barM := sitNiceStep(metersPerPt * 100)
+	for barM > metersPerPt*100 {
+		barM /= 2
+	}
+	barW := barM / metersPerPt
+	label := sitCount(barM) + " m"
+	if barM >= 1000 {
+		label = sitCount(barM/1000) + " km"
+	}
+	d.fill(pdfRGB(0xffffff))
+	d.rect(sitMargin+6, top+boxH-22, barW+pdfTextWidth(label, 7.5, false)+16, 16, "f")
+	d.stroke(sitInk)
+	d.lineWidth(1.5)
+	d.line(sitMargin+10, top+boxH-12, sitMargin+10+barW, top+boxH-12)
+	d.fill(sitInk)
+	d.text(sitMargin+14+barW, top+boxH-9, 7.5, false, label)
+	s.p.y = top + boxH + 8
+	var legend []sitSeries
+	for _, l := range s.layers {
+		legend = append(legend, sitSeries{Name: l, Color: sitLayerColor(s.layers, l)})
+	}
+	s.p.legend(legend)
+	note := fmt.Sprintf("%s features; the %s added in the period are outlined.", sitCount(float64(len(items))), sitCount(float64(newCount)))
+	if int64(len(items)) == sitReportMapLimit {
+		note += fmt.Sprintf(" Only the newest %s are drawn.", sitCount(float64(sitReportMapLimit)))
+	}
+	s.p.para(note, 8, sitMuted)
+	return nil
+}
+
+func (s *sitReport) drawGeometry(g Geometry, proj func(Position) [2]float64, color pdfColor, isNew bool) {
+	d := s.p.d
+	ring := func(pts []Position) [][2]float64 {
+		out := make([][2]float64, len(pts))
+		for i, p := range pts {
+			out[i] = proj(p)
+		}
+		return out
+	}
+	point := func(p Position) {
+		xy := proj(p)
+		d.fill(color)
+		if isNew {
+			d.stroke(sitInk)
+			d.lineWidth(0.8)
+			d.circle(xy[0], xy[1], 3.2, "B")
+		} else {
+			d.circle(xy[0], xy[1], 2.2, "f")
+		}
+	}
+	width := 1.0
+	if isNew {
+		width = 2
+	}
+	light := pdfColor{0.6 + 0.4*color[0], 0.6 + 0.4*color[1], 0.6 + 0.4*color[2]}
+	switch g.Type {
+	case "Point":
+		point(g.Point)
+	case "MultiPoint":
+		for _, p := range g.Points {
+			point(p)
+		}
+	case "LineString", "MultiLineString":
+		lines := g.Rings
+		if g.Type == "LineString" {
+			lines = [][]Position{g.Points}
+		}
+		d.stroke(color)
+		d.lineWidth(width)
+		for _, l := range lines {
+			d.path(ring(l), false)
+		}
+		d.paint("S")
+	case "Polygon", "MultiPolygon":
+		polys := g.Polygons
+		if g.Type == "Polygon" {
+			polys = [][][]Position{g.Rings}
+		}
+		d.fill(light)
+		d.stroke(color)
+		d.lineWidth(width * 0.7)
+		for _, poly := range polys {
+			for _, r := range poly {
+				d.path(ring(r), true)
+			}
+		}
+		d.paint("B*")
+	case "GeometryCollection":
+		for _, sub := range g.Geometries {
+			s.drawGeometry(sub, proj, color, isNew)
+		}
+	}
+}
+
+func (s *sitReport) categories() error {
+	var rows []struct {
+		ID struct {
+			Layer    string      `bson:"layer"`
+			Category interface{} `bson:"category"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	err := s.aggregate(heavyReads, bson.A{
+		bson.M{"$match": s.base()},
+		bson.M{"$group": bson.M{"_id": bson.M{"layer": "$layer", "category": "$properties." + snapshotCategory}, "count": bson.M{"$sum": 1}}},
+		bson.M{"$sort": bson.D{{Key: "_id.layer", Value: 1}, {Key: "count", Value: -1}}},
+	}, &rows)
+	if err != nil {
+		return err
+	}
+	s.p.heading("Features by " + strings.ReplaceAll(snapshotCategory, "_", " "))
+	const top = 10
+	byLayer := map[string][]sitBar{}
+	for _, r := range rows {
+		label := "(none)"
+		if r.ID.Category != nil {
+			label = fmt.Sprint(r.ID.Category)
+		}
+		bars := byLayer[r.ID.Layer]
+		if len(bars) == top {
+			bars[top-1].Label = "everything else"
+			bars[top-1].Value += float64(r.Count)
+		} else {
+			bars = append(bars, sitBar{label, float64(r.Count)})
+		}
+		byLayer[r.ID.Layer] = bars
+	}
+	if len(byLayer) == 0 {
+		s.p.para("No features in these layers.", 9, sitMuted)
+	}
+	for _, l := range s.layers {
+		if len(byLayer[l]) == 0 {
+			continue
+		}
+		s.p.need(40)
+		s.p.y += 12
+		s.p.d.fill(sitInk)
+		s.p.d.text(sitMargin, s.p.y, 10, true, l)
+		s.p.y += 6
+		s.p.bars(byLayer[l], sitLayerColor(s.layers, l))
+	}
+	return nil
+}
+
+func (s *sitReport) trend() error {
+	from, to := s.from.Format("2006-01-02"), s.to.Format("2006-01-02")
+	cur, err := layerSnapshots.Find(s.c, bson.M{"layer": bson.M{"$in": s.layers}, "date": bson.M{"$gte": from, "$lte": to}},
+		options.Find().SetSort(bson.D{{Key: "date", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var snaps []LayerSnapshot
+	if err := cur.All(s.c, &snaps); err != nil {
+		return err
+	}
+	s.p.heading("Daily feature count")
+	var dates []string
+	for d := s.from; !d.After(s.to); d = d.Add(24 * time.Hour) {
+		dates = append(dates, d.Format("2006-01-02"))
+	}
+	index := map[string]int{}
+	for i, d := range dates {
+		index[d] = i
+	}
+	values := map[string][]float64{}
+	for _, sn := range snaps {
+		v, ok := values[sn.Layer]
+		if !ok {
+			v = make([]float64, len(dates))
+			for i := range v {
+				v[i] = math.NaN()
+			}
+			values[sn.Layer] = v
+		}
+		if i, ok := index[sn.Date]; ok {
+			v[i] = float64(sn.Count)
+		}
+	}
+	var series []sitSeries
+	for _, l := range s.layers {
+		if v, ok := values[l]; ok {
+			series = append(series, sitSeries{Name: l, Color: sitLayerColor(s.layers, l), Values: v})
+		}
+	}
+	if len(series) == 0 {
+		s.p.para("No daily snapshots in the period; they are taken every SNAPSHOT_INTERVAL or by a snapshot_stats job.", 9, sitMuted)
+		return nil
+	}
+	s.p.lines(dates, series)
+	return nil
+}
+
+func (s *sitReport) workOrders() error {
+	q := bson.M{"layer": bson.M{"$in": s.layers}}
+	var counts []struct {
+		Status string `bson:"_id"`
+		Count  int64  `bson:"count"`
+		Closed int64  `bson:"closed"`
+	}
+	err := s.aggregate(workOrders, bson.A{
+		bson.M{"$match": q},
+		bson.M{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}, "closed": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$and": bson.A{bson.M{"$gte": bson.A{"$closed_at", s.from}}, bson.M{"$lt": bson.A{"$closed_at", s.to}}}}, 1, 0,
+		}}}}},
+	}, &counts)
+	if err != nil {
+		return err
+	}
+	s.p.heading("Work orders")
+	byStatus := map[string][2]int64{}
+	for _, c := range counts {
+		byStatus[c.Status] = [2]int64{c.Count, c.Closed}
+	}
+	var table [][]string
+	for _, st := range workOrderStatuses {
+		c := byStatus[st]
+		closed := "–"
+		if isClosed(st) {
+			closed = sitCount(float64(c[1]))
+		}
+		table = append(table, []string{strings.ReplaceAll(st, "_", " "), sitCount(float64(c[0])), closed})
+	}
+	s.p.table([]sitCol{{"Status", 275, false}, {"Work orders", 120, true}, {"Closed in period", 120.28, true}}, table)
+
+	q["status"] = bson.M{"$in": bson.A{workOrderOpen, workOrderInProgress, workOrderOnHold}}
+	q["due_date"] = bson.M{"$lt": s.to}
+	cur, err := workOrders.Find(s.c, q, options.Find().SetSort(bson.D{{Key: "due_date", Value: 1}}).SetLimit(int64(s.rep.MaxRows)).
+		SetProjection(bson.M{"notes": 0, "attachments": 0}))
+	if err != nil {
+		return err
+	}
+	var overdue []WorkOrder
+	if err := cur.All(s.c, &overdue); err != nil {
+		return err
+	}
+	if len(overdue) == 0 {
+		s.p.para("No overdue work orders.", 9, sitMuted)
+		return nil
+	}
+	s.p.need(40)
+	s.p.y += 12
+	s.p.d.fill(sitInk)
+	s.p.d.text(sitMargin, s.p.y, 10, true, "Overdue")
+	s.p.y += 6
+	table = nil
+	for _, o := range overdue {
+		table = append(table, []string{o.Title, o.Layer, o.Priority, o.Assignee, sitDate(*o.DueDate)})
+	}
+	s.p.table([]sitCol{{"Title", 190, false}, {"Layer", 95, false}, {"Priority", 60, false}, {"Assignee", 90, false}, {"Due", 80.28, true}}, table)
+	return nil
+}
+
+func (s *sitReport) moderation() error {
+	q := s.base()
+	delete(q, "status")
+	var rows []struct {
+		Layer    string `bson:"_id"`
+		Pending  int64  `bson:"pending"`
+		Approved int64  `bson:"approved"`
+		Rejected int64  `bson:"rejected"`
+	}
+	reviewed := func(status string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{"$status", status}},
+			bson.M{"$gte": bson.A{"$moderation.reviewed_at", s.from}},
+			bson.M{"$lt": bson.A{"$moderation.reviewed_at", s.to}},
+		}}, 1, 0}}}
+	}
+	err := s.aggregate(heavyReads, bson.A{
+		bson.M{"$match": q},
+		bson.M{"$match": bson.M{"$or": bson.A{bson.M{"status": statusPending}, bson.M{"moderation.reviewed_at": s.inPeriod()}}}},
+		bson.M{"$group": bson.M{
+			"_id":      "$layer",
+			"pending":  bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$status", statusPending}}, 1, 0}}},
+			"approved": reviewed(statusApproved),
+			"rejected": reviewed(statusRejected),
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}, &rows)
+	if err != nil {
+		return err
+	}
+	s.p.heading("Moderation")
+	if len(rows) == 0 {
+		s.p.para("Nothing waiting for review and nothing reviewed in the period.", 9, sitMuted)
+		return nil
+	}
+	var table [][]string
+	for _, r := range rows {
+		table = append(table, []string{r.Layer, sitCount(float64(r.Pending)), sitCount(float64(r.Approved)), sitCount(float64(r.Rejected))})
+	}
+	s.p.table([]sitCol{{"Layer", 215, false}, {"Waiting", 100, true}, {"Approved in period", 100, true}, {"Rejected in period", 100.28, true}}, table)
+	return nil
+}
+
+func (s *sitReport) features() error {
+	q := s.base()
+	q["created_at"] = s.inPeriod()
+	total, err := heavyReads.CountDocuments(s.c, q)
+	if err != nil {
+		return err
+	}
+	cur, err := heavyReads.Find(s.c, q, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(s.rep.MaxRows)).
+		SetProjection(bson.M{"name": 1, "layer": 1, "created_at": 1, "properties." + snapshotCategory: 1}))
+	if err != nil {
+		return err
+	}
+	var docs []FeatureDoc
+	if err := cur.All(s.c, &docs); err != nil {
+		return err
+	}
+	s.p.heading("New features")
+	if len(docs) == 0 {
+		s.p.para("No features were added in the period.", 9, sitMuted)
+		return nil
+	}
+	var table [][]string
+	for _, doc := range docs {
+		category := ""
+		if v, ok := doc.Properties[snapshotCategory]; ok && v != nil {
+			category = fmt.Sprint(v)
+		}
+		table = append(table, []string{doc.Name, doc.Layer, category, doc.CreatedAt.In(jobLocation).Format("2 Jan 15:04")})
+	}
+	s.p.table([]sitCol{{"Name", 215, false}, {"Layer", 110, false}, {"Category", 110, false}, {"Added", 80.28, true}}, table)
+	if total > int64(len(docs)) {
+		s.p.para(fmt.Sprintf("The newest %d of %s.", len(docs), sitCount(float64(total))), 8, sitMuted)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LayerSnapshot records a layer's aggregate metrics for one day. Snapshots
+// are keyed by layer and UTC date, so rerunning a day overwrites it and
+// several instances running the job don't duplicate rows.
+type LayerSnapshot struct {
+	ID         string           `bson:"_id" json:"-"`
+	Layer      string           `bson:"layer" json:"layer"`
+	Date       string           `bson:"date" json:"date"`
+	Count      int64            `bson:"count" json:"count"`
+	Categories map[string]int64 `bson:"categories,omitempty" json:"categories,omitempty"`
+	LengthM    float64          `bson:"length_m" json:"length_m"`
+	AreaM2     float64          `bson:"area_m2" json:"area_m2"`
+	TakenAt    time.Time        `bson:"taken_at" json:"taken_at"`
+}
+
+var (
+	layerSnapshots   *mongo.Collection
+	snapshotInterval = 24 * time.Hour
+	// SNAPSHOT_CATEGORY_PROPERTY is the feature property counts are split by
+	snapshotCategory = "category"
+)
+
+func setupSnapshots() {
+	layerSnapshots = db.Collection(getenv("MONGO_SNAPSHOTS_COLLECTION", "layer_snapshots"))
+	snapshotCategory = getenv("SNAPSHOT_CATEGORY_PROPERTY", snapshotCategory)
+	if _, err := layerSnapshots.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "layer", Value: 1}, {Key: "date", Value: 1}}}); err != nil {
+		log.Printf("snapshot index create warning: %v", err)
+	}
+	if d, err := time.ParseDuration(getenv("SNAPSHOT_INTERVAL", "")); err == nil {
+		snapshotInterval = d
+	}
+	if snapshotInterval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if _, err := takeSnapshots(time.Now().UTC()); err != nil {
+				log.Printf("layer snapshot warning: %v", err)
+			}
+			time.Sleep(snapshotInterval)
+		}
+	}()
+}
+
+// sphericalRingArea is the area in m² of a lon/lat ring on the sphere
+func sphericalRingArea(ring []Position) float64 {
+	if len(ring) < 4 {
+		return 0
+	}
+	var sum float64
+	for i := 0; i < len(ring)-1; i++ {
+		a, b := ring[i], ring[i+1]
+		sum += toRad(b[0]-a[0]) * (2 + math.Sin(toRad(a[1])) + math.Sin(toRad(b[1])))
+	}
+	return math.Abs(sum * earthRadiusMeters * earthRadiusMeters / 2)
+}
+
+// geometryMeasures returns the length of linear and the area of polygonal
+// geometries, in meters and square meters
+func geometryMeasures(g Geometry) (length, area float64) {
+	polygonArea := func(rings [][]Position) float64 {
+		a := 0.0
+		for i, ring := range rings {
+			if i == 0 {
+				a += sphericalRingArea(ring)
+			} else {
+				a -= sphericalRingArea(ring)
+			}
+		}
+		return math.Max(a, 0)
+	}
+	switch g.Type {
+	case "LineString":
+		length = lineLength(g.Points)
+	case "MultiLineString":
+		for _, l := range g.Rings {
+			length += lineLength(l)
+		}
+	case "Polygon":
+		area = polygonArea(g.Rings)
+	case "MultiPolygon":
+		for _, p := range g.Polygons {
+			area += polygonArea(p)
+		}
+	case "GeometryCollection":
+		for _, sub := range g.Geometries {
+			l, a := geometryMeasures(sub)
+			length, area = length+l, area+a
+		}
+	}
+	return length, area
+}
+
+// takeSnapshots records the metrics of every layer for the day of at
+func takeSnapshots(at time.Time) (int, error) {
+	ids, err := heavyReads.Distinct(ctx, "layer", bson.M{"layer": bson.M{"$exists": true, "$ne": ""}})
+	if err != nil {
+		return 0, err
+	}
+	date := at.Format("2006-01-02")
+	n := 0
+	for _, v := range ids {
+		layer, ok := v.(string)
+		if !ok {
+			continue
+		}
+		s, err := snapshotLayer(layer, date, at)
+		if err != nil {
+			return n, fmt.Errorf("layer %s: %v", layer, err)
+		}
+		if _, err := layerSnapshots.ReplaceOne(ctx, bson.M{"_id": s.ID}, s, options.Replace().SetUpsert(true)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// snapshotLayer streams the visible features of a layer, reading only the
+// geometry and the category property
+func snapshotLayer(layer, date string, at time.Time) (LayerSnapshot, error) {
+	s := LayerSnapshot{ID: layer + "|" + date, Layer: layer, Date: date, Categories: map[string]int64{}, TakenAt: at}
+	q := bson.M{"layer": layer, "status": bson.M{"$nin": bson.A{statusPending, statusRejected}}}
+	opts := options.Find().SetProjection(bson.M{"geometry": 1, "properties." + snapshotCategory: 1})
+	cur, err := heavyReads.Find(ctx, q, opts)
+	if err != nil {
+		return s, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		s.Count++
+		if c, ok := doc.Properties[snapshotCategory]; ok && c != nil {
+			s.Categories[fmt.Sprint(c)]++
+		}
+		if g, err := parseGeometry(doc.Geometry); err == nil {
+			l, a := geometryMeasures(g)
+			s.LengthM += l
+			s.AreaM2 += a
+		}
+	}
+	s.LengthM = math.Round(s.LengthM*100) / 100
+	s.AreaM2 = math.Round(s.AreaM2*100) / 100
+	if len(s.Categories) == 0 {
+		s.Categories = nil
+	}
+	return s, cur.Err()
+}
+
+// GET /layers/{id}/snapshots?from=2024-01-01&to=2024-12-31
+// Returns the layer's daily snapshots in date order, for trend charts
+func layerSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	q := bson.M{"layer": mux.Vars(r)["id"]}
+	date := bson.M{}
+	for _, p := range []struct{ param, op string }{{"from", "$gte"}, {"to", "$lte"}} {
+		v := r.URL.Query().Get(p.param)
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid "+p.param, FieldError{Field: p.param, Message: "expected YYYY-MM-DD"})
+			return
+		}
+		date[p.op] = v
+	}
+	if len(date) > 0 {
+		q["date"] = date
+	}
+	cur, err := layerSnapshots.Find(ctx, q, options.Find().SetSort(bson.D{{Key: "date", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LayerSnapshot{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /admin/snapshots/run takes today's snapshots now
+func runSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	n, err := takeSnapshots(time.Now().UTC())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "snapshot error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"layers": n})
+}
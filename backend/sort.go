@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// top-level fields clients may sort on
+var sortableFields = map[string]bool{
+	"name":       true,
+	"created_at": true,
+	"updated_at": true,
+	"layer":      true,
+	"status":     true,
+}
+
+// property keys clients may sort on, from SORTABLE_PROPERTIES. Each one gets
+// an index so sorts don't fall back to in-memory sorting.
+var sortableProperties = map[string]bool{}
+
+const maxSortKeys = 5
+
+func setupSortIndexes(spec string) {
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}},
+		{Keys: bson.D{{Key: "updated_at", Value: 1}}},
+	}
+	for _, k := range strings.Split(spec, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		sortableProperties[k] = true
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: "properties." + k, Value: 1}}})
+	}
+	if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+		log.Printf("sort index create warning: %v", err)
+	}
+}
+
+// parseSort turns ?sort=-updated_at,name,properties.population into a sort
+// document. A leading "-" sorts descending. _id is appended as a tiebreaker so
+// pagination is stable.
+func parseSort(s string) (bson.D, error) {
+	var out bson.D
+	keys := strings.Split(s, ",")
+	if len(keys) > maxSortKeys {
+		return nil, fmt.Errorf("at most %d sort keys allowed", maxSortKeys)
+	}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		k = strings.TrimSpace(k)
+		dir := 1
+		if strings.HasPrefix(k, "-") {
+			dir = -1
+			k = k[1:]
+		} else if strings.HasPrefix(k, "+") {
+			k = k[1:]
+		}
+		switch {
+		case sortableFields[k]:
+		case strings.HasPrefix(k, "properties.") && sortableProperties[strings.TrimPrefix(k, "properties.")]:
+		default:
+			return nil, fmt.Errorf("cannot sort by %q", k)
+		}
+		// Mongo refuses a sort naming a field twice
+		if seen[k] {
+			return nil, fmt.Errorf("%q is given more than once", k)
+		}
+		seen[k] = true
+		out = append(out, bson.E{Key: k, Value: dir})
+	}
+	return append(out, bson.E{Key: "_id", Value: 1}), nil
+}
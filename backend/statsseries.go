@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /stats/series counts features per time bucket, optionally summing a
+// numeric property and split into series, in the shape chart libraries
+// take: one list of bucket starts and per series an equally long list of
+// values, zero where nothing fell in a bucket.
+
+const (
+	maxSeriesBuckets = 1000
+	defaultSeriesTop = 10
+	maxSeriesTop     = 50
+	// the series the features beyond top are folded into
+	seriesOtherKey = "_other"
+)
+
+var seriesIntervals = []string{"hour", "day", "week", "month", "year"}
+
+// SeriesLine is one series of a SeriesReport
+type SeriesLine struct {
+	Key    string    `json:"key"`
+	Label  string    `json:"label"`
+	Counts []int64   `json:"counts"`
+	Sums   []float64 `json:"sums,omitempty"`
+	Total  int64     `json:"total"`
+	Sum    *float64  `json:"sum,omitempty"`
+}
+
+// SeriesReport is the GET /stats/series response
+type SeriesReport struct {
+	Interval  string       `json:"interval"`
+	TimeField string       `json:"time_field"`
+	Timezone  string       `json:"timezone"`
+	From      time.Time    `json:"from"`
+	To        time.Time    `json:"to"`
+	GroupBy   string       `json:"group_by,omitempty"`
+	SumOf     string       `json:"sum_of,omitempty"`
+	Buckets   []time.Time  `json:"buckets"`
+	Series    []SeriesLine `json:"series"`
+	Totals    SeriesLine   `json:"totals"`
+}
+
+// truncateTo is the start of t's bucket, matching $dateTrunc with weeks
+// starting on Monday
+func truncateTo(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch interval {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	case "week":
+		return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+func nextBucket(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	case "year":
+		return t.AddDate(1, 0, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// parseSeriesTime takes RFC 3339 or a YYYY-MM-DD date in loc
+func parseSeriesTime(s string, loc *time.Location) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// GET /stats/series?interval=hour|day|week|month|year&time=created_at|updated_at
+// &from=&to=&tz=&group_by=layer|status|prop.<name>|admin&level=&parent=
+// &sum=<property>&top=10&layer=&project=&bbox=&admin=
+// from defaults to 30 intervals before to, to to now; a date-only to
+// includes that day. group_by=admin splits by the areas of one boundary
+// level (district by default), placing each feature by its first
+// coordinate like split=admin exports do.
+func seriesStatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var errs []FieldError
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if !oneOf(interval, seriesIntervals) {
+		errs = append(errs, FieldError{Field: "interval", Message: "must be one of " + strings.Join(seriesIntervals, ", ")})
+	}
+	timeField := query.Get("time")
+	if timeField == "" {
+		timeField = "created_at"
+	}
+	if timeField != "created_at" && timeField != "updated_at" {
+		errs = append(errs, FieldError{Field: "time", Message: "must be created_at or updated_at"})
+	}
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "tz", Message: "unknown time zone"})
+		} else {
+			loc = l
+		}
+	}
+	to := time.Now()
+	if v := query.Get("to"); v != "" {
+		t, ok := parseSeriesTime(v, loc)
+		if !ok {
+			errs = append(errs, FieldError{Field: "to", Message: "expected RFC 3339 or YYYY-MM-DD"})
+		} else if len(v) == len("2006-01-02") {
+			to = t.AddDate(0, 0, 1)
+		} else {
+			to = t
+		}
+	}
+	from := time.Time{}
+	if v := query.Get("from"); v != "" {
+		t, ok := parseSeriesTime(v, loc)
+		if !ok {
+			errs = append(errs, FieldError{Field: "from", Message: "expected RFC 3339 or YYYY-MM-DD"})
+		}
+		from = t
+	}
+	groupBy := query.Get("group_by")
+	if groupBy != "" && groupBy != "layer" && groupBy != "status" && groupBy != "admin" &&
+		(!strings.HasPrefix(groupBy, "prop.") || len(groupBy) == len("prop.")) {
+		errs = append(errs, FieldError{Field: "group_by", Message: "must be layer, status, admin or prop.<name>"})
+	}
+	level := query.Get("level")
+	if groupBy == "admin" {
+		if level == "" {
+			level = "district"
+		}
+		if adminLevelRank(level) < 0 {
+			errs = append(errs, FieldError{Field: "level", Message: "one of " + strings.Join(adminLevels, ", ")})
+		}
+	}
+	top := defaultSeriesTop
+	if v := query.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSeriesTop {
+			errs = append(errs, FieldError{Field: "top", Message: fmt.Sprintf("must be between 1 and %d", maxSeriesTop)})
+		}
+		top = n
+	}
+	sumOf := query.Get("sum")
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid series parameters", errs...)
+		return
+	}
+
+	if !from.IsZero() && !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "from must be before to", FieldError{Field: "from", Message: "must be before to"})
+		return
+	}
+	// the buckets, all of them, so series line up without gaps
+	var buckets []time.Time
+	if from.IsZero() {
+		from = truncateTo(to.Add(-time.Nanosecond), interval, loc)
+		for i := 0; i < 29; i++ {
+			from = truncateTo(from.Add(-time.Minute), interval, loc)
+		}
+	}
+	for b := truncateTo(from, interval, loc); b.Before(to); b = nextBucket(b, interval) {
+		if len(buckets) == maxSeriesBuckets {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "too many buckets",
+				FieldError{Field: "interval", Message: fmt.Sprintf("at most %d buckets; use a longer interval or a shorter range", maxSeriesBuckets)})
+			return
+		}
+		buckets = append(buckets, b)
+	}
+	index := map[int64]int{}
+	for i, b := range buckets {
+		index[b.Unix()] = i
+	}
+
+	q := bson.M{timeField: bson.M{"$gte": from, "$lt": to}}
+	if layer := query.Get("layer"); layer != "" {
+		q["layer"] = layer
+	}
+	if !applyStatusFilter(w, r, q) || !applyProjectFilter(w, r, q) || !applyPublicationFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if minLon, minLat, maxLon, maxLat, ok := parseBBox(query.Get("bbox")); ok {
+		q["geometry"] = bson.M{"$geoWithin": bson.M{"$box": bson.A{bson.A{minLon, minLat}, bson.A{maxLon, maxLat}}}}
+	}
+	if code := query.Get("admin"); code != "" {
+		area, err := adminAreaFilter(code)
+		if err != nil {
+			writeAdminAreaError(w, code, err)
+			return
+		}
+		q["$and"] = bson.A{area}
+	}
+
+	trunc := bson.M{"$dateTrunc": bson.M{"date": "$" + timeField, "unit": interval, "timezone": loc.String(), "startOfWeek": "monday"}}
+	value := interface{}(0)
+	if sumOf != "" {
+		value = bson.M{"$convert": bson.M{"input": "$properties." + sumOf, "to": "double", "onError": nil, "onNull": nil}}
+	}
+	var pipeline bson.A
+	var areas *adminPartAreas
+	if groupBy == "admin" {
+		var err error
+		if areas, err = loadPartAreas(partSpec{level: level, parent: query.Get("parent")}); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		// features are placed in areas here, so each comes back with its
+		// bucket and anchor
+		pipeline = bson.A{
+			bson.M{"$match": q},
+			bson.M{"$project": bson.M{"_id": 0, "b": trunc, "p": bson.M{"$arrayElemAt": bson.A{flattenCoords, 0}}, "n": bson.M{"$literal": 1}, "s": value}},
+		}
+	} else {
+		key := interface{}(nil)
+		switch {
+		case groupBy == "layer" || groupBy == "status":
+			key = "$" + groupBy
+		case strings.HasPrefix(groupBy, "prop."):
+			key = "$properties." + strings.TrimPrefix(groupBy, "prop.")
+		}
+		pipeline = bson.A{
+			bson.M{"$match": q},
+			bson.M{"$group": bson.M{"_id": bson.M{"b": trunc, "k": key}, "n": bson.M{"$sum": 1}, "s": bson.M{"$sum": value}}},
+			bson.M{"$project": bson.M{"_id": 0, "b": "$_id.b", "k": "$_id.k", "n": 1, "s": 1}},
+		}
+	}
+	cur, err := readsFor(r).Aggregate(r.Context(), pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+
+	byKey := map[string]*SeriesLine{}
+	line := func(key, label string) *SeriesLine {
+		l, ok := byKey[key]
+		if !ok {
+			l = &SeriesLine{Key: key, Label: label, Counts: make([]int64, len(buckets))}
+			if sumOf != "" {
+				l.Sums = make([]float64, len(buckets))
+			}
+			byKey[key] = l
+		}
+		return l
+	}
+	for cur.Next(r.Context()) {
+		var row struct {
+			Bucket time.Time   `bson:"b"`
+			Key    interface{} `bson:"k"`
+			P      []float64   `bson:"p"`
+			Count  int64       `bson:"n"`
+			Sum    float64     `bson:"s"`
+		}
+		if err := cur.Decode(&row); err != nil {
+			continue
+		}
+		i, ok := index[row.Bucket.Unix()]
+		if !ok {
+			continue
+		}
+		key, label := "", ""
+		switch {
+		case areas != nil:
+			a := -1
+			if len(row.P) >= 2 {
+				a = areas.assign(Position(row.P))
+			}
+			if a < 0 {
+				// outside every area of the level
+				continue
+			}
+			key, label = areas.areas[a].Code, areas.areas[a].Name
+		case groupBy == "":
+			key, label = "all", "All features"
+		case row.Key == nil:
+			key, label = "", "(none)"
+		default:
+			key = fmt.Sprint(row.Key)
+			label = key
+		}
+		l := line(key, label)
+		l.Counts[i] += row.Count
+		l.Total += row.Count
+		if l.Sums != nil {
+			l.Sums[i] += row.Sum
+		}
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db aggregate error: "+err.Error())
+		return
+	}
+
+	series := make([]*SeriesLine, 0, len(byKey))
+	for _, l := range byKey {
+		series = append(series, l)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Total != series[j].Total {
+			return series[i].Total > series[j].Total
+		}
+		return series[i].Key < series[j].Key
+	})
+	report := SeriesReport{
+		Interval: interval, TimeField: timeField, Timezone: loc.String(), From: from, To: to,
+		GroupBy: groupBy, SumOf: sumOf, Buckets: buckets, Series: []SeriesLine{},
+		Totals: SeriesLine{Key: "total", Label: "Total", Counts: make([]int64, len(buckets))},
+	}
+	if sumOf != "" {
+		report.Totals.Sums = make([]float64, len(buckets))
+	}
+	var other *SeriesLine
+	for n, l := range series {
+		for i := range buckets {
+			report.Totals.Counts[i] += l.Counts[i]
+			if l.Sums != nil {
+				report.Totals.Sums[i] += l.Sums[i]
+			}
+		}
+		report.Totals.Total += l.Total
+		if n < top {
+			report.Series = append(report.Series, *l)
+			continue
+		}
+		if other == nil {
+			other = &SeriesLine{Key: seriesOtherKey, Label: "Other", Counts: make([]int64, len(buckets))}
+			if sumOf != "" {
+				other.Sums = make([]float64, len(buckets))
+			}
+		}
+		for i := range buckets {
+			other.Counts[i] += l.Counts[i]
+			if l.Sums != nil {
+				other.Sums[i] += l.Sums[i]
+			}
+		}
+		other.Total += l.Total
+	}
+	if other != nil {
+		report.Series = append(report.Series, *other)
+	}
+	if sumOf != "" {
+		for i := range report.Series {
+			report.Series[i].Sum = sumOfSums(report.Series[i].Sums)
+		}
+		report.Totals.Sum = sumOfSums(report.Totals.Sums)
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func sumOfSums(v []float64) *float64 {
+	var s float64
+	for _, x := range v {
+		s += x
+	}
+	return &s
+}
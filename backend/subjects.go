@@ -0,0 +1,417 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Data subject requests. GET /admin/subjects/{user} finds everything stored
+// about a user, .../export downloads it, and DELETE purges it for good with
+// the same dry run + confirm token flow as bulk layer deletes. Features the
+// user created are deleted, with their copies in published versions and
+// releases, and so are their favorites, views and attachments; records
+// that merely mention them (edits, reviews, layers, work orders,
+// inspections, ...) keep existing with the reference replaced by
+// erasedUser, and they leave member lists and recipient lists. ?props=owner,contact also finds features whose listed
+// properties equal the user id or one of ?alias= (an email address, a
+// name); purging removes those properties. Encrypted properties can't be
+// matched this way.
+type subject struct {
+	id      string
+	props   []string
+	aliases []string
+}
+
+// erasedUser replaces the user id in records that outlive a purge
+const erasedUser = "erased-user"
+
+// subjectSource is one place a user's data can be. New subsystems that
+// store user ids add theirs to subjectSources.
+type subjectSource struct {
+	name   string
+	coll   func() *mongo.Collection
+	filter func(s subject) bson.M
+	// projection hides secrets from exports
+	projection bson.M
+	// purge removes matches of q, returning how many documents changed
+	purge func(s subject, q bson.M) (int64, error)
+}
+
+func deleteDocs(coll func() *mongo.Collection) func(subject, bson.M) (int64, error) {
+	return func(_ subject, q bson.M) (int64, error) {
+		res, err := coll().DeleteMany(ctx, q)
+		if err != nil {
+			return 0, err
+		}
+		return res.DeletedCount, nil
+	}
+}
+
+func anonymizeField(coll func() *mongo.Collection, field string) func(subject, bson.M) (int64, error) {
+	return func(_ subject, q bson.M) (int64, error) {
+		res, err := coll().UpdateMany(ctx, q, bson.M{"$set": bson.M{field: erasedUser}})
+		if err != nil {
+			return 0, err
+		}
+		return res.ModifiedCount, nil
+	}
+}
+
+// anonymizeElements replaces the user id in field of the elements of
+// array that hold it
+func anonymizeElements(coll func() *mongo.Collection, array, field string) func(subject, bson.M) (int64, error) {
+	return func(s subject, q bson.M) (int64, error) {
+		res, err := coll().UpdateMany(ctx, q, bson.M{"$set": bson.M{array + ".$[e]." + field: erasedUser}},
+			options.Update().SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"e." + field: s.id}}}))
+		if err != nil {
+			return 0, err
+		}
+		return res.ModifiedCount, nil
+	}
+}
+
+// pullValues removes the user id, and with aliases its aliases, from the
+// array field
+func pullValues(coll func() *mongo.Collection, field string, aliases bool) func(subject, bson.M) (int64, error) {
+	return func(s subject, q bson.M) (int64, error) {
+		values := []string{s.id}
+		if aliases {
+			values = append(values, s.aliases...)
+		}
+		res, err := coll().UpdateMany(ctx, q, bson.M{"$pull": bson.M{field: bson.M{"$in": values}}})
+		if err != nil {
+			return 0, err
+		}
+		return res.ModifiedCount, nil
+	}
+}
+
+func byField(field string) func(subject) bson.M {
+	return func(s subject) bson.M { return bson.M{field: s.id} }
+}
+
+// byValue matches field against the user id and its aliases, for emails
+func byValue(field string) func(subject) bson.M {
+	return func(s subject) bson.M { return bson.M{field: bson.M{"$in": append([]string{s.id}, s.aliases...)}} }
+}
+
+// featureReferences finds the features, stored under prefix, whose ?props=
+// name the user without being theirs, and purges those properties
+func featureReferences(coll func() *mongo.Collection, prefix string) (func(subject) bson.M, func(subject, bson.M) (int64, error)) {
+	filter := func(s subject) bson.M {
+		if len(s.props) == 0 {
+			return nil
+		}
+		values := append([]string{s.id}, s.aliases...)
+		var or bson.A
+		for _, p := range s.props {
+			or = append(or, bson.M{prefix + "properties." + p: bson.M{"$in": values}})
+		}
+		return bson.M{"$or": or, prefix + "created_by": bson.M{"$ne": s.id}}
+	}
+	purge := func(s subject, _ bson.M) (int64, error) {
+		values := append([]string{s.id}, s.aliases...)
+		var n int64
+		for _, p := range s.props {
+			res, err := coll().UpdateMany(ctx, bson.M{prefix + "properties." + p: bson.M{"$in": values}, prefix + "created_by": bson.M{"$ne": s.id}},
+				bson.M{"$unset": bson.M{prefix + "properties." + p: ""}})
+			if err != nil {
+				return n, err
+			}
+			n += res.ModifiedCount
+		}
+		return n, nil
+	}
+	return filter, purge
+}
+
+// notTheirs matches field against the user where the feature, stored
+// under prefix, was created by someone else
+func notTheirs(prefix, field string) func(subject) bson.M {
+	return func(s subject) bson.M {
+		return bson.M{prefix + field: s.id, prefix + "created_by": bson.M{"$ne": s.id}}
+	}
+}
+
+func subjectSources() []subjectSource {
+	features := func() *mongo.Collection { return collection }
+	relationsColl := func() *mongo.Collection { return relations }
+	layersColl := func() *mongo.Collection { return layers }
+	projectsColl := func() *mongo.Collection { return projects }
+	published := func() *mongo.Collection { return publishedFeatures }
+	workOrdersColl := func() *mongo.Collection { return workOrders }
+	orgsColl := func() *mongo.Collection { return orgs }
+	invitationsColl := func() *mongo.Collection { return invitations }
+	sitReportsColl := func() *mongo.Collection { return situationReports }
+	sitFilesColl := func() *mongo.Collection { return situationFiles }
+	referenceFilter, referencePurge := featureReferences(features, "")
+	publishedRefFilter, publishedRefPurge := featureReferences(published, "feature.")
+	return []subjectSource{
+		{name: "features", coll: features, filter: byField("created_by"), purge: func(s subject, q bson.M) (int64, error) {
+			oids, err := featureIDs(ctx, q)
+			if err != nil {
+				return 0, err
+			}
+			if err := deleteFeatureDependents(oids); err != nil {
+				return 0, err
+			}
+			return deleteDocs(features)(s, q)
+		}},
+		{name: "feature_edits", coll: features, filter: notTheirs("", "updated_by"), purge: anonymizeField(features, "updated_by")},
+		{name: "feature_reviews", coll: features, filter: notTheirs("", "moderation.reviewed_by"), purge: anonymizeField(features, "moderation.reviewed_by")},
+		{name: "feature_references", coll: features, filter: referenceFilter, purge: referencePurge},
+		// published versions and releases are frozen copies: the user's
+		// features leave them too, whatever was cut
+		{name: "published_features", coll: published, filter: byField("feature.created_by"), purge: deleteDocs(published)},
+		{name: "published_feature_edits", coll: published, filter: notTheirs("feature.", "updated_by"), purge: anonymizeField(published, "feature.updated_by")},
+		{name: "published_feature_reviews", coll: published, filter: notTheirs("feature.", "moderation.reviewed_by"),
+			purge: anonymizeField(published, "feature.moderation.reviewed_by")},
+		{name: "published_feature_references", coll: published, filter: publishedRefFilter, purge: publishedRefPurge},
+		{name: "layer_versions", coll: func() *mongo.Collection { return layerVersions }, filter: byField("published_by"),
+			purge: anonymizeField(func() *mongo.Collection { return layerVersions }, "published_by")},
+		{name: "layer_releases", coll: func() *mongo.Collection { return layerReleases }, filter: byField("created_by"),
+			purge: anonymizeField(func() *mongo.Collection { return layerReleases }, "created_by")},
+		{name: "favorites", coll: func() *mongo.Collection { return favorites }, filter: byField("user"),
+			purge: deleteDocs(func() *mongo.Collection { return favorites })},
+		{name: "recent_views", coll: func() *mongo.Collection { return recentViews }, filter: byField("user"),
+			purge: deleteDocs(func() *mongo.Collection { return recentViews })},
+		{name: "work_orders", coll: workOrdersColl, filter: byField("created_by"), purge: anonymizeField(workOrdersColl, "created_by")},
+		{name: "work_order_edits", coll: workOrdersColl, filter: byField("updated_by"), purge: anonymizeField(workOrdersColl, "updated_by")},
+		{name: "work_order_assignments", coll: workOrdersColl, filter: byField("assignee"), purge: anonymizeField(workOrdersColl, "assignee")},
+		{name: "work_order_notes", coll: workOrdersColl, filter: byField("notes.by"), projection: bson.M{"title": 1, "notes": 1},
+			purge: anonymizeElements(workOrdersColl, "notes", "by")},
+		{name: "work_order_attachments", coll: workOrdersColl, filter: byField("attachments.by"), projection: bson.M{"title": 1, "attachments": 1},
+			purge: deleteWorkOrderAttachmentsBy},
+		{name: "inspection_submissions", coll: func() *mongo.Collection { return inspectionSubmissions }, filter: byField("inspector"),
+			purge: anonymizeField(func() *mongo.Collection { return inspectionSubmissions }, "inspector")},
+		{name: "organizations", coll: orgsColl, filter: byField("created_by"), purge: anonymizeField(orgsColl, "created_by")},
+		{name: "organization_members", coll: orgsColl, filter: byField("members.user_id"), projection: bson.M{"name": 1, "members": 1},
+			purge: func(s subject, q bson.M) (int64, error) {
+				res, err := orgs.UpdateMany(ctx, q, bson.M{"$pull": bson.M{"members": bson.M{"user_id": s.id}}})
+				if err != nil {
+					return 0, err
+				}
+				return res.ModifiedCount, nil
+			}},
+		{name: "team_members", coll: orgsColl, filter: byField("teams.members"), projection: bson.M{"name": 1, "teams": 1},
+			purge: pullValues(orgsColl, "teams.$[].members", false)},
+		{name: "invitations", coll: invitationsColl, filter: func(s subject) bson.M {
+			return bson.M{"$or": bson.A{bson.M{"accepted_by": s.id}, byValue("email")(s)}}
+		}, projection: bson.M{"token_hash": 0}, purge: deleteDocs(invitationsColl)},
+		{name: "invitations_sent", coll: invitationsColl, filter: byField("invited_by"), projection: bson.M{"token_hash": 0},
+			purge: anonymizeField(invitationsColl, "invited_by")},
+		{name: "situation_reports", coll: sitReportsColl, filter: byField("created_by"), purge: anonymizeField(sitReportsColl, "created_by")},
+		{name: "situation_report_edits", coll: sitReportsColl, filter: byField("updated_by"), purge: anonymizeField(sitReportsColl, "updated_by")},
+		{name: "situation_report_recipients", coll: sitReportsColl, filter: byValue("recipients"), purge: pullValues(sitReportsColl, "recipients", true)},
+		{name: "situation_report_files", coll: sitFilesColl, filter: byField("by"), projection: bson.M{"data": 0}, purge: anonymizeField(sitFilesColl, "by")},
+		{name: "situation_report_emails", coll: sitFilesColl, filter: byValue("emailed_to"), projection: bson.M{"data": 0},
+			purge: pullValues(sitFilesColl, "emailed_to", true)},
+		{name: "report_photos", coll: func() *mongo.Collection { return reportPhotos }, filter: byField("created_by"), projection: bson.M{"data": 0},
+			purge: deleteDocs(func() *mongo.Collection { return reportPhotos })},
+		{name: "relations", coll: relationsColl, filter: byField("created_by"), purge: anonymizeField(relationsColl, "created_by")},
+		{name: "layers", coll: layersColl, filter: byField("created_by"), purge: anonymizeField(layersColl, "created_by")},
+		{name: "layer_publications", coll: layersColl, filter: byField("publication.published_by"), projection: bson.M{"publication": 1},
+			purge: anonymizeField(layersColl, "publication.published_by")},
+		{name: "layer_sensitive_readers", coll: layersColl, filter: byField("sensitive.readers"), projection: bson.M{"sensitive": 1},
+			purge: func(s subject, q bson.M) (int64, error) {
+				res, err := layers.UpdateMany(ctx, q, bson.M{"$pull": bson.M{"sensitive.readers": s.id}})
+				if err != nil {
+					return 0, err
+				}
+				return res.ModifiedCount, nil
+			}},
+		{name: "projects", coll: projectsColl, filter: byField("created_by"), purge: anonymizeField(projectsColl, "created_by")},
+		{name: "project_memberships", coll: projectsColl, filter: byField("members.user_id"), projection: bson.M{"name": 1, "members": 1},
+			purge: func(s subject, q bson.M) (int64, error) {
+				res, err := projects.UpdateMany(ctx, q, bson.M{"$pull": bson.M{"members": bson.M{"user_id": s.id}}})
+				if err != nil {
+					return 0, err
+				}
+				return res.ModifiedCount, nil
+			}},
+		{name: "symbols", coll: func() *mongo.Collection { return symbols }, filter: byField("created_by"), projection: bson.M{"data": 0},
+			purge: anonymizeField(func() *mongo.Collection { return symbols }, "created_by")},
+		{name: "networks", coll: func() *mongo.Collection { return networks }, filter: byField("built_by"),
+			purge: anonymizeField(func() *mongo.Collection { return networks }, "built_by")},
+		{name: "account", coll: func() *mongo.Collection { return users }, filter: byField("_id"),
+			projection: bson.M{"password_hash": 0, "reset_token_hash": 0, "reset_expires": 0},
+			purge:      deleteDocs(func() *mongo.Collection { return users })},
+		{name: "auth_events", coll: func() *mongo.Collection { return authEvents }, filter: func(s subject) bson.M {
+			return bson.M{"username": strings.ToLower(s.id)}
+		}, purge: deleteDocs(func() *mongo.Collection { return authEvents })},
+		{name: "usage", coll: func() *mongo.Collection { return usage }, filter: byField("tenant"),
+			purge: deleteDocs(func() *mongo.Collection { return usage })},
+		{name: "quotas", coll: func() *mongo.Collection { return quotas }, filter: byField("_id"),
+			purge: deleteDocs(func() *mongo.Collection { return quotas })},
+		{name: "login_attempts", coll: func() *mongo.Collection { return loginAttempts }, filter: func(s subject) bson.M {
+			return bson.M{"_id": "user:" + strings.ToLower(s.id)}
+		}, purge: deleteDocs(func() *mongo.Collection { return loginAttempts })},
+		{name: "jobs", coll: func() *mongo.Collection { return jobs }, filter: byField("updated_by"),
+			purge: anonymizeField(func() *mongo.Collection { return jobs }, "updated_by")},
+		{name: "dead_letters", coll: func() *mongo.Collection { return deadLetters }, filter: byField("closed_by"),
+			purge: anonymizeField(func() *mongo.Collection { return deadLetters }, "closed_by")},
+		{name: "uploads", coll: func() *mongo.Collection { return uploads }, filter: byField("created_by"), purge: deleteUploads},
+	}
+}
+
+func parseSubject(r *http.Request) subject {
+	s := subject{id: mux.Vars(r)["user"]}
+	query := r.URL.Query()
+	for _, p := range strings.Split(query.Get("props"), ",") {
+		if p = strings.TrimSpace(p); p != "" && !strings.ContainsAny(p, ".$") {
+			s.props = append(s.props, p)
+		}
+	}
+	for _, a := range query["alias"] {
+		if a = strings.TrimSpace(a); a != "" {
+			s.aliases = append(s.aliases, a)
+		}
+	}
+	sort.Strings(s.props)
+	sort.Strings(s.aliases)
+	return s
+}
+
+// canon binds confirm tokens to the user and the matching options
+func (s subject) canon() string {
+	return "subject|" + s.id + "|" + strings.Join(s.props, ",") + "|" + strings.Join(s.aliases, ",")
+}
+
+type subjectCount struct {
+	Source string `json:"source"`
+	Count  int64  `json:"count"`
+}
+
+func countSubject(s subject) ([]subjectCount, int64, error) {
+	var out []subjectCount
+	var total int64
+	for _, src := range subjectSources() {
+		q := src.filter(s)
+		if q == nil {
+			continue
+		}
+		n, err := src.coll().CountDocuments(ctx, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		out = append(out, subjectCount{Source: src.name, Count: n})
+		total += n
+	}
+	return out, total, nil
+}
+
+// GET /admin/subjects/{user}?props=&alias= counts the user's records per
+// source and returns the token DELETE needs
+func locateSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	s := parseSubject(r)
+	counts, total, err := countSubject(s)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	token, exp := makeConfirmToken(s.canon(), total)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{
+		"user":          s.id,
+		"sources":       counts,
+		"total":         total,
+		"confirm_token": token,
+		"expires_at":    exp.UTC(),
+	})
+}
+
+// GET /admin/subjects/{user}/export downloads every record found, with
+// encrypted properties decrypted
+func exportSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	s := parseSubject(r)
+	data := bson.M{}
+	for _, src := range subjectSources() {
+		q := src.filter(s)
+		if q == nil {
+			continue
+		}
+		opts := options.Find()
+		if src.projection != nil {
+			opts.SetProjection(src.projection)
+		}
+		cur, err := src.coll().Find(ctx, q, opts)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		docs := []bson.M{}
+		if err := cur.All(ctx, &docs); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		for _, d := range docs {
+			if props, ok := d["properties"].(bson.M); ok {
+				layer, _ := d["layer"].(string)
+				revealProperties(r, layer, props)
+			}
+		}
+		data[src.name] = docs
+	}
+	w.Header().Set("Content-Type", "application/json")
+	now := time.Now().UTC()
+	w.Header().Set("Content-Disposition", `attachment; filename="subject-`+now.Format("20060102-150405")+`.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(bson.M{"user": s.id, "generated_at": now, "data": data})
+}
+
+// DELETE /admin/subjects/{user}?confirm=<token> purges the records counted
+// by the GET with the same parameters
+func purgeSubjectHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	s := parseSubject(r)
+	token := r.URL.Query().Get("confirm")
+	if token == "" {
+		writeError(w, http.StatusBadRequest, "confirmation_required", "confirmation required: call GET /admin/subjects/{user} first and pass its confirm_token as ?confirm=")
+		return
+	}
+	_, total, err := countSubject(s)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+err.Error())
+		return
+	}
+	if !checkConfirmToken(token, s.canon(), total) {
+		writeError(w, http.StatusConflict, "confirmation_invalid", "confirmation token invalid, expired, or the user's records changed; repeat the lookup")
+		return
+	}
+	purged := map[string]int64{}
+	for _, src := range subjectSources() {
+		q := src.filter(s)
+		if q == nil {
+			continue
+		}
+		n, err := src.purge(s, q)
+		purged[src.name] = n
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db purge error in "+src.name+": "+err.Error())
+			return
+		}
+	}
+	// the purge itself is recorded, without the name it was for
+	sum := sha256.Sum256([]byte(s.id))
+	auditAuth(AuthEvent{Event: "subject_purged", IP: clientIP(r), Reason: "subject " + hex.EncodeToString(sum[:8]) + " by " + userID(r)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bson.M{"ok": true, "purged": purged})
+}
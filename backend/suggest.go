@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Autocomplete for the map search box. Every feature carries a suggest
+// field with the edge n-grams (word prefixes) of its name and translated
+// names, case and diacritics folded, plus its name length and centre, so
+// GET /features/suggest is one index lookup on suggest.grams that never
+// touches geometries. A background loop keeps the field current for
+// features updated since its last pass, and at startup fills it in for
+// features that have none.
+type FeatureSuggest struct {
+	Grams []string  `bson:"grams"`
+	Len   int       `bson:"len"`
+	At    []float64 `bson:"at,omitempty"`
+}
+
+// Suggestion is one autocomplete entry
+type Suggestion struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Layer  string    `json:"layer,omitempty"`
+	Center []float64 `json:"center,omitempty"`
+
+	rank int
+	dist float64
+}
+
+const (
+	maxSuggestGram     = 15
+	suggestDefaultSize = 10
+	suggestMaxSize     = 50
+	suggestBatch       = 500
+)
+
+var suggestRefreshInterval = 15 * time.Second
+
+func setupSuggest() {
+	if d, err := time.ParseDuration(getenv("SUGGEST_REFRESH_INTERVAL", "")); err == nil && d > 0 {
+		suggestRefreshInterval = d
+	}
+	model := mongo.IndexModel{Keys: bson.D{{Key: "suggest.grams", Value: 1}, {Key: "suggest.len", Value: 1}}}
+	if _, err := collection.Indexes().CreateOne(ctx, model); err != nil {
+		log.Printf("suggest index create warning: %v", err)
+	}
+	go func() {
+		since := time.Now().UTC()
+		if err := refreshSuggest(bson.M{"suggest": bson.M{"$exists": false}}); err != nil {
+			log.Printf("suggest backfill warning: %v", err)
+		}
+		for range time.Tick(suggestRefreshInterval) {
+			// a little overlap so writes in flight at the last pass are seen
+			next := time.Now().UTC()
+			if err := refreshSuggest(bson.M{"updated_at": bson.M{"$gte": since.Add(-time.Second)}}); err != nil {
+				log.Printf("suggest refresh warning: %v", err)
+				continue
+			}
+			since = next
+		}
+	}()
+}
+
+// suggestWords splits s into folded, lowercased words
+func suggestWords(s string) []string {
+	return searchTerm.FindAllString(strings.ToLower(foldDiacritics(s)), -1)
+}
+
+// suggestGram is the indexed prefix of a query term
+func suggestGram(term string) string {
+	if rs := []rune(term); len(rs) > maxSuggestGram {
+		return string(rs[:maxSuggestGram])
+	}
+	return term
+}
+
+// suggestFields builds the suggest field of a feature
+func suggestFields(doc FeatureDoc) FeatureSuggest {
+	s := FeatureSuggest{Grams: []string{}, Len: len([]rune(doc.Name))}
+	seen := map[string]bool{}
+	names := []string{doc.Name}
+	for _, t := range doc.Translations {
+		names = append(names, t.Name)
+	}
+	for _, n := range names {
+		for _, w := range suggestWords(n) {
+			rs := []rune(w)
+			for i := 1; i <= len(rs) && i <= maxSuggestGram; i++ {
+				if g := string(rs[:i]); !seen[g] {
+					seen[g] = true
+					s.Grams = append(s.Grams, g)
+				}
+			}
+		}
+	}
+	if g, err := parseGeometry(doc.Geometry); err == nil {
+		if c, ok := geometryCenter(g); ok {
+			s.At = []float64{c[0], c[1]}
+		}
+	}
+	return s
+}
+
+// geometryCenter is the area centroid of the largest polygon, or else the
+// mean of the vertices
+func geometryCenter(g Geometry) (Position, bool) {
+	var best [][]Position
+	bestArea := 0.0
+	for _, p := range polygonsOf(g) {
+		if len(p) == 0 || len(p[0]) < 3 {
+			continue
+		}
+		pl := newPlanar(p[0])
+		ring := make([]xy, len(p[0]))
+		for i, q := range p[0] {
+			ring[i].x, ring[i].y = pl.xy(q)
+		}
+		if a := math.Abs(ringArea(ring)); a > bestArea {
+			best, bestArea = p, a
+		}
+	}
+	if best != nil {
+		pl := newPlanar(best[0])
+		var cx, cy, a float64
+		ps := best[0]
+		for i := 0; i+1 < len(ps); i++ {
+			x0, y0 := pl.xy(ps[i])
+			x1, y1 := pl.xy(ps[i+1])
+			f := x0*y1 - x1*y0
+			cx += (x0 + x1) * f
+			cy += (y0 + y1) * f
+			a += f
+		}
+		if a != 0 {
+			return pl.lonlat(cx/(3*a), cy/(3*a)), true
+		}
+	}
+	ps := g.allPositions()
+	if len(ps) == 0 {
+		return Position{}, false
+	}
+	var lon, lat float64
+	for _, p := range ps {
+		lon += p[0]
+		lat += p[1]
+	}
+	n := float64(len(ps))
+	return Position{lon / n, lat / n}, true
+}
+
+// refreshSuggest recomputes the suggest field of the features matching
+// filter
+func refreshSuggest(filter bson.M) error {
+	opts := options.Find().SetProjection(bson.M{"name": 1, "translations": 1, "geometry": 1}).SetBatchSize(suggestBatch)
+	// the primary: a lagging replica would index the names from before a
+	// write and the next pass wouldn't look at the feature again
+	cur, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		models = models[:0]
+		return err
+	}
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": doc.ID}).SetUpdate(bson.M{"$set": bson.M{"suggest": suggestFields(doc)}}))
+		if len(models) >= suggestBatch {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// suggestRank is 0 for a name equal to the query, 1 for a name starting
+// with it and 2 for one whose words start with the terms
+func suggestRank(name string, terms []string) int {
+	words := suggestWords(name)
+	for _, t := range terms {
+		found := false
+		for _, w := range words {
+			found = found || strings.HasPrefix(w, t)
+		}
+		if !found {
+			return -1
+		}
+	}
+	joined, q := strings.Join(words, " "), strings.Join(terms, " ")
+	switch {
+	case joined == q:
+		return 0
+	case strings.HasPrefix(joined, q):
+		return 1
+	}
+	return 2
+}
+
+// GET /features/suggest?q=rumah sa&limit=10&layer=&near=lon,lat
+// The terms are matched as word prefixes; exact and leading matches come
+// first, then those nearest to near, then shorter names.
+func suggestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	terms := suggestWords(query.Get("q"))
+	if len(terms) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "q is required", FieldError{Field: "q", Message: "required"})
+		return
+	}
+	limit := suggestDefaultSize
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > suggestMaxSize {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid limit", FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(suggestMaxSize)})
+			return
+		}
+		limit = n
+	}
+	var near Position
+	if s := query.Get("near"); s != "" {
+		parts := strings.Split(s, ",")
+		var errLon, errLat error
+		var lon, lat float64
+		if len(parts) == 2 {
+			lon, errLon = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+			lat, errLat = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		}
+		if len(parts) != 2 || errLon != nil || errLat != nil || lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid near", FieldError{Field: "near", Message: "expected lon,lat"})
+			return
+		}
+		near = Position{lon, lat}
+	}
+
+	grams := bson.A{}
+	for _, t := range terms {
+		grams = append(grams, suggestGram(t))
+	}
+	q := bson.M{"suggest.grams": bson.M{"$all": grams}}
+	if !applyStatusFilter(w, r, q) {
+		return
+	}
+	if layer := query.Get("layer"); layer != "" {
+		q["layer"] = layer
+	}
+	if !applyProjectFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	if !applyPublicationFilter(w, r, q) {
+		return
+	}
+	// more candidates than asked for, so ranking has something to choose from
+	opts := options.Find().
+		SetProjection(bson.M{"name": 1, "layer": 1, "translations": 1, "suggest.at": 1}).
+		SetSort(bson.D{{Key: "suggest.len", Value: 1}}).
+		SetLimit(int64(limit * 5))
+	cur, err := readsFor(r).Find(r.Context(), q, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+	out := []Suggestion{}
+	for cur.Next(r.Context()) {
+		var doc struct {
+			FeatureDoc `bson:",inline"`
+			Suggest    FeatureSuggest `bson:"suggest"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		// rank on whichever name matched best, show the caller's language
+		rank := suggestRank(doc.Name, terms)
+		for _, t := range doc.Translations {
+			if tr := suggestRank(t.Name, terms); tr >= 0 && (rank < 0 || tr < rank) {
+				rank = tr
+			}
+		}
+		if rank < 0 {
+			continue
+		}
+		localizeDoc(r, &doc.FeatureDoc)
+		s := Suggestion{ID: doc.ID.Hex(), Name: doc.Name, Layer: doc.Layer, rank: rank, dist: math.Inf(1)}
+		if len(doc.Suggest.At) == 2 {
+			s.Center = doc.Suggest.At
+			if near != nil {
+				s.dist = haversine(near, Position(doc.Suggest.At))
+			}
+		}
+		out = append(out, s)
+	}
+	if err := cur.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].rank != out[j].rank {
+			return out[i].rank < out[j].rank
+		}
+		if near != nil && out[i].dist != out[j].dist {
+			return out[i].dist < out[j].dist
+		}
+		return len(out[i].Name) < len(out[j].Name)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Symbols are the SVG and PNG icons layer styles point at with
+// style.icon = "<symbol id>". They live in Mongo next to the layers so a
+// style editor can list them and maps can load them from the API.
+const maxSymbolBytes = 256 << 10
+
+// Symbol is a stored icon; Data is left out of listings
+type Symbol struct {
+	ID          string    `bson:"_id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	Tags        []string  `bson:"tags,omitempty" json:"tags,omitempty"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int       `bson:"size" json:"size"`
+	ETag        string    `bson:"etag" json:"etag"`
+	Data        []byte    `bson:"data,omitempty" json:"-"`
+	CreatedBy   string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at" json:"updated_at"`
+	// URL is the absolute address the image is served at, filled in for
+	// responses
+	URL string `bson:"-" json:"url"`
+}
+
+var symbols *mongo.Collection
+
+func setupSymbols() {
+	symbols = db.Collection(getenv("MONGO_SYMBOLS_COLLECTION", "symbols"))
+}
+
+// symbolContentType sniffs the upload; only PNG and SVG are accepted
+func symbolContentType(data []byte) (string, error) {
+	if http.DetectContentType(data) == "image/png" {
+		return "image/png", nil
+	}
+	head := strings.ToLower(string(data[:min(len(data), 1024)]))
+	if strings.Contains(head, "<svg") {
+		return "image/svg+xml", nil
+	}
+	return "", fmt.Errorf("symbol must be a PNG or SVG image")
+}
+
+// GET /symbols?tag=
+func listSymbolsHandler(w http.ResponseWriter, r *http.Request) {
+	q := bson.M{}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		q["tags"] = tag
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetProjection(bson.M{"data": 0})
+	cur, err := symbols.Find(ctx, q, opts)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []Symbol{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	for i := range out {
+		out[i].URL = requestBaseURL(r) + "/symbols/" + out[i].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /symbols/{id} serves the image; the ETag is its content hash, so
+// clients revalidate cheaply after the max-age
+func getSymbolHandler(w http.ResponseWriter, r *http.Request) {
+	var s Symbol
+	err := symbols.FindOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "symbol not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	etag := `"` + s.ETag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", s.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.Data)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// scripts in an uploaded SVG must not run when it is opened directly
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Write(s.Data)
+}
+
+// PUT /symbols/{id}?name=&tags=a,b with the PNG or SVG as the body.
+// Creates the symbol or replaces its image and metadata.
+func putSymbolHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if !layerIDPattern.MatchString(id) {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid symbol id", FieldError{Field: "id", Message: "lowercase letters, digits, _ and -, up to 64 characters"})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSymbolBytes+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "read error: "+err.Error())
+		return
+	}
+	if len(data) == 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "image body required")
+		return
+	}
+	if len(data) > maxSymbolBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("symbols are limited to %d KB", maxSymbolBytes>>10))
+		return
+	}
+	contentType, err := symbolContentType(data)
+	if err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		name = id
+	}
+	var tags []string
+	for _, t := range strings.Split(query.Get("tags"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	sum := sha256.Sum256(data)
+	now := time.Now().UTC()
+	res, err := symbols.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{
+			"name": name, "tags": tags, "content_type": contentType, "size": len(data),
+			"etag": hex.EncodeToString(sum[:16]), "data": data, "updated_at": now,
+		},
+		"$setOnInsert": bson.M{"created_by": userID(r), "created_at": now},
+	}, options.Update().SetUpsert(true))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	var s Symbol
+	if err := symbols.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"data": 0})).Decode(&s); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	s.URL = requestBaseURL(r) + "/symbols/" + id
+	w.Header().Set("Content-Type", "application/json")
+	if res.UpsertedCount > 0 {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+// DELETE /symbols/{id}?force=true
+// Symbols still referenced by a layer style are kept unless forced.
+func deleteSymbolHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if force, _ := strconv.ParseBool(r.URL.Query().Get("force")); !force {
+		var used []string
+		cur, err := layers.Find(ctx, bson.M{"style.icon": id}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		var docs []LayerDoc
+		if err := cur.All(ctx, &docs); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		for _, d := range docs {
+			used = append(used, d.ID)
+		}
+		if len(used) > 0 {
+			writeError(w, http.StatusConflict, "conflict", "symbol is used by layers: "+strings.Join(used, ", ")+"; pass force=true to delete anyway")
+			return
+		}
+	}
+	res, err := symbols.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "symbol not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Mapbox Vector Tiles (spec 2.1) of one layer, for MapLibre sources. The
+// protobuf is written by hand like osm.go reads it. Tiles are flat, so the
+// lowest altitude of a 3D feature goes in an elevation property next to
+// height and min_height, for fill-extrusion layers. Each layer has a
+// TileJSON document pointing at its tiles and carrying its attribution.
+
+const (
+	mvtExtent = 4096
+	// geometry reaching this far past the tile edge is kept, so strokes
+	// and extrusions don't end in seams
+	mvtBuffer  = 64
+	mvtMaxZoom = 22
+	// web mercator stops here
+	mvtMaxLat = 85.0511287798
+)
+
+// elevationProperty is the lowest altitude of a 3D feature in its tile
+const elevationProperty = "elevation"
+
+var vectorTileMaxFeatures = 20000
+
+func setupVectorTiles() {
+	if n, err := strconv.Atoi(getenv("VECTOR_TILE_MAX_FEATURES", "")); err == nil && n > 0 {
+		vectorTileMaxFeatures = n
+	}
+}
+
+// pb builds protobuf messages
+type pb []byte
+
+func (b pb) key(field, wire int) pb { return binary.AppendUvarint(b, uint64(field<<3|wire)) }
+func (b pb) uint(field int, v uint64) pb {
+	return binary.AppendUvarint(b.key(field, 0), v)
+}
+func (b pb) bytes(field int, v []byte) pb {
+	b = binary.AppendUvarint(b.key(field, 2), uint64(len(v)))
+	return append(b, v...)
+}
+func (b pb) double(field int, v float64) pb {
+	return binary.LittleEndian.AppendUint64(b.key(field, 1), math.Float64bits(v))
+}
+func (b pb) packed(field int, vs []uint32) pb {
+	var body []byte
+	for _, v := range vs {
+		body = binary.AppendUvarint(body, uint64(v))
+	}
+	return b.bytes(field, body)
+}
+
+func mvtZigzag(v int32) uint32 { return uint32((v << 1) ^ (v >> 31)) }
+
+func mvtCommand(id, count int) uint32 { return uint32(id&7 | count<<3) }
+
+// mvtLayer collects the features of one tile layer with their shared key
+// and value tables
+type mvtLayer struct {
+	name     string
+	features []byte
+	keys     []string
+	keyIndex map[string]int
+	values   [][]byte
+	valIndex map[interface{}]int
+}
+
+func (l *mvtLayer) tag(k string, v interface{}) (uint32, uint32, bool) {
+	var enc pb
+	switch t := v.(type) {
+	case string:
+		enc = enc.bytes(1, []byte(t))
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return 0, 0, false
+		}
+		enc = enc.double(3, t)
+	case int32:
+		v = float64(t)
+		enc = enc.double(3, float64(t))
+	case int64:
+		v = float64(t)
+		enc = enc.double(3, float64(t))
+	case int:
+		v = float64(t)
+		enc = enc.double(3, float64(t))
+	case bool:
+		b := uint64(0)
+		if t {
+			b = 1
+		}
+		enc = enc.uint(7, b)
+	case nil:
+		return 0, 0, false
+	default:
+		// nested values travel as JSON text
+		v = csvValue(t)
+		enc = enc.bytes(1, []byte(v.(string)))
+	}
+	ki, ok := l.keyIndex[k]
+	if !ok {
+		ki = len(l.keys)
+		l.keyIndex[k] = ki
+		l.keys = append(l.keys, k)
+	}
+	vi, ok := l.valIndex[v]
+	if !ok {
+		vi = len(l.values)
+		l.valIndex[v] = vi
+		l.values = append(l.values, enc)
+	}
+	return uint32(ki), uint32(vi), true
+}
+
+func (l *mvtLayer) add(id uint64, props bson.M, kind int, geom []uint32) {
+	var tags []uint32
+	for k, v := range props {
+		if ki, vi, ok := l.tag(k, v); ok {
+			tags = append(tags, ki, vi)
+		}
+	}
+	var f pb
+	f = f.uint(1, id)
+	if len(tags) > 0 {
+		f = f.packed(2, tags)
+	}
+	f = f.uint(3, uint64(kind))
+	f = f.packed(4, geom)
+	l.features = pb(l.features).bytes(2, f)
+}
+
+func (l *mvtLayer) bytes() []byte {
+	var b pb
+	b = b.uint(15, 2)
+	b = b.bytes(1, []byte(l.name))
+	b = append(b, l.features...)
+	for _, k := range l.keys {
+		b = b.bytes(3, []byte(k))
+	}
+	for _, v := range l.values {
+		b = b.bytes(4, v)
+	}
+	b = b.uint(5, mvtExtent)
+	var tile pb
+	return tile.bytes(3, b)
+}
+
+// mvtGeometry turns g into tile commands, projected into tile z/x/y
+type mvtGeometry struct {
+	n, x, y float64
+	cmds    []uint32
+	cx, cy  int32
+}
+
+func (m *mvtGeometry) point(p Position) (int32, int32) {
+	lat := math.Max(-mvtMaxLat, math.Min(mvtMaxLat, p[1]))
+	return int32(math.Round((tileX(p[0], m.n) - m.x) * mvtExtent)), int32(math.Round((tileY(lat, m.n) - m.y) * mvtExtent))
+}
+
+// path appends a line or ring, dropping repeated pixels; false when too
+// little of it is left
+func (m *mvtGeometry) path(ps []Position, ring bool) bool {
+	if ring && len(ps) > 1 && samePosition(ps[0], ps[len(ps)-1]) {
+		ps = ps[:len(ps)-1]
+	}
+	var pts [][2]int32
+	for _, p := range ps {
+		x, y := m.point(p)
+		if len(pts) > 0 && pts[len(pts)-1] == [2]int32{x, y} {
+			continue
+		}
+		pts = append(pts, [2]int32{x, y})
+	}
+	if ring && len(pts) > 1 && pts[0] == pts[len(pts)-1] {
+		pts = pts[:len(pts)-1]
+	}
+	if len(pts) < 2 || ring && len(pts) < 3 {
+		return false
+	}
+	m.cmds = append(m.cmds, mvtCommand(1, 1), mvtZigzag(pts[0][0]-m.cx), mvtZigzag(pts[0][1]-m.cy))
+	m.cmds = append(m.cmds, mvtCommand(2, len(pts)-1))
+	for i := 1; i < len(pts); i++ {
+		m.cmds = append(m.cmds, mvtZigzag(pts[i][0]-pts[i-1][0]), mvtZigzag(pts[i][1]-pts[i-1][1]))
+	}
+	m.cx, m.cy = pts[len(pts)-1][0], pts[len(pts)-1][1]
+	if ring {
+		m.cmds = append(m.cmds, mvtCommand(7, 1))
+	}
+	return true
+}
+
+// polygon writes the outer ring with a positive area in tile coordinates
+// and holes negative, as the spec wants, flipping rings as needed
+func (m *mvtGeometry) polygon(rings [][]Position) {
+	for i, ring := range rings {
+		area := 0.0
+		for j := range ring {
+			ax, ay := m.point(ring[j])
+			bx, by := m.point(ring[(j+1)%len(ring)])
+			area += float64(ax)*float64(by) - float64(bx)*float64(ay)
+		}
+		if area == 0 {
+			if i == 0 {
+				return
+			}
+			continue
+		}
+		if (area > 0) != (i == 0) {
+			rev := make([]Position, len(ring))
+			for j, p := range ring {
+				rev[len(ring)-1-j] = p
+			}
+			ring = rev
+		}
+		if !m.path(ring, true) && i == 0 {
+			return
+		}
+	}
+}
+
+// encode returns the MVT geometry type and commands for g, 0 when nothing
+// of it shows at this zoom
+func (m *mvtGeometry) encode(g Geometry) int {
+	switch g.Type {
+	case "Point", "MultiPoint":
+		pts := g.Points
+		if g.Type == "Point" {
+			pts = []Position{g.Point}
+		}
+		m.cmds = append(m.cmds, mvtCommand(1, len(pts)))
+		for _, p := range pts {
+			x, y := m.point(p)
+			m.cmds = append(m.cmds, mvtZigzag(x-m.cx), mvtZigzag(y-m.cy))
+			m.cx, m.cy = x, y
+		}
+		return 1
+	case "LineString", "MultiLineString":
+		lines := g.Rings
+		if g.Type == "LineString" {
+			lines = [][]Position{g.Points}
+		}
+		for _, l := range lines {
+			m.path(l, false)
+		}
+		if len(m.cmds) > 0 {
+			return 2
+		}
+	case "Polygon", "MultiPolygon":
+		polys := g.Polygons
+		if g.Type == "Polygon" {
+			polys = [][][]Position{g.Rings}
+		}
+		for _, p := range polys {
+			m.polygon(p)
+		}
+		if len(m.cmds) > 0 {
+			return 3
+		}
+	}
+	return 0
+}
+
+// encodeVectorTile clips docs to box and encodes them as the tile layer,
+// returning it with the number of features that showed
+func encodeVectorTile(layer string, docs []FeatureDoc, z, x, y int, box BBox) (*mvtLayer, int) {
+	n := 1 << z
+	out := &mvtLayer{name: layer, keyIndex: map[string]int{}, valIndex: map[interface{}]int{}}
+	served := 0
+	for _, doc := range docs {
+		g, err := parseGeometry(doc.Geometry)
+		if err != nil {
+			continue
+		}
+		clipped, ok := clipGeometry(g, box)
+		if !ok {
+			continue
+		}
+		props, _ := featureToGeoJSON(doc).Properties.(bson.M)
+		if _, set := props[elevationProperty]; !set && g.hasZ() {
+			low := math.Inf(1)
+			for _, p := range g.allPositions() {
+				low = math.Min(low, p[2])
+			}
+			props[elevationProperty] = low
+		}
+		parts := []Geometry{clipped}
+		if clipped.Type == "GeometryCollection" {
+			parts = clipped.Geometries
+		}
+		id := uint64(objectIDOf(doc))
+		shown := false
+		for _, part := range parts {
+			m := &mvtGeometry{n: float64(n), x: float64(x), y: float64(y)}
+			if kind := m.encode(part); kind != 0 {
+				out.add(id, props, kind, m.cmds)
+				shown = true
+			}
+		}
+		if shown {
+			served++
+		}
+	}
+	return out, served
+}
+
+// GET /tiles/{layer}/{z}/{x}/{y}.mvt
+// One MVT layer named after the layer, with each feature's properties as
+// GeoJSON exports have them and nested values as JSON text. Geometry
+// collections are split into one tile feature per member. ?level= gives
+// the tiles of one floor.
+func vectorTileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	layer := vars["layer"]
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.Atoi(vars["x"])
+	y, errY := strconv.Atoi(vars["y"])
+	n := 1 << max(z, 0)
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > mvtMaxZoom || x < 0 || y < 0 || x >= n || y >= n {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid tile", FieldError{Field: "z", Message: "zoom 0 to " + strconv.Itoa(mvtMaxZoom) + " with x and y inside it"})
+		return
+	}
+	q := bson.M{"layer": layer}
+	if pre := tilePrefilter(z, x, y); pre != nil {
+		q["geometry"] = pre
+	}
+	if !applyStatusFilter(w, r, q) || !applyPublicationFilter(w, r, q) || !applyLevelFilter(w, r, q) {
+		return
+	}
+	applyVisibilityFilter(r, q)
+	cur, err := readsFor(r).Find(r.Context(), q, options.Find().SetLimit(int64(vectorTileMaxFeatures)))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	defer cur.Close(r.Context())
+
+	var docs []FeatureDoc
+	for cur.Next(r.Context()) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		revealDoc(r, &doc)
+		docs = append(docs, doc)
+	}
+
+	tb := tileBounds(z, x, y)
+	padLon := (tb.MaxLon - tb.MinLon) * mvtBuffer / mvtExtent
+	padLat := (tb.MaxLat - tb.MinLat) * mvtBuffer / mvtExtent
+	box := BBox{tb.MinLon - padLon, tb.MinLat - padLat, tb.MaxLon + padLon, tb.MaxLat + padLat}
+	var out *mvtLayer
+	served := 0
+	// clipping and encoding up to vectorTileMaxFeatures is CPU work for
+	// the geometry pool
+	if !runGeometry(w, r, func() { out, served = encodeVectorTile(layer, docs, z, x, y, box) }) {
+		return
+	}
+	countServed(r, layer, served)
+	w.Header().Set("Content-Type", "application/vnd.mapbox-vector-tile")
+	if served == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Write(out.bytes())
+}
+
+// tileJSONFieldType names a schema field's type the way TileJSON's
+// vector_layers list them
+func tileJSONFieldType(t string) string {
+	switch t {
+	case "number":
+		return "Number"
+	case "boolean":
+		return "Boolean"
+	}
+	return "String"
+}
+
+// GET /tiles/{layer}.json
+// TileJSON 3.0.0 for the layer's vector tiles, so MapLibre sources can
+// point at it and show the layer's license as attribution. ?level= is
+// passed on to the tile URLs.
+func tileJSONHandler(w http.ResponseWriter, r *http.Request) {
+	layer := mux.Vars(r)["layer"]
+	var l LayerDoc
+	err := layers.FindOne(ctx, bson.M{"_id": layer}).Decode(&l)
+	if err == mongo.ErrNoDocuments {
+		// layers that only exist through their features have tiles too
+		n, cerr := collection.CountDocuments(ctx, bson.M{"layer": layer}, options.Count().SetLimit(1))
+		if cerr != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db count error: "+cerr.Error())
+			return
+		}
+		if n == 0 {
+			writeError(w, http.StatusNotFound, "not_found", "layer not found")
+			return
+		}
+		l = LayerDoc{ID: layer, Name: layer}
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+
+	tiles := requestBaseURL(r) + "/tiles/" + url.PathEscape(layer) + "/{z}/{x}/{y}.mvt"
+	if level := r.URL.Query().Get("level"); level != "" {
+		tiles += "?level=" + url.QueryEscape(level)
+	}
+	fields := bson.M{"id": "String", "name": "String", "description": "String"}
+	for _, f := range l.Fields {
+		fields[f.Name] = tileJSONFieldType(f.Type)
+	}
+	doc := bson.M{
+		"tilejson": "3.0.0",
+		"name":     l.Name,
+		"tiles":    []string{tiles},
+		"minzoom":  0,
+		"maxzoom":  mvtMaxZoom,
+		"vector_layers": []bson.M{{
+			"id": layer, "fields": fields, "minzoom": 0, "maxzoom": mvtMaxZoom, "description": l.Description,
+		}},
+	}
+	if l.Description != "" {
+		doc["description"] = l.Description
+	}
+	if a := l.License.text(); a != "" {
+		doc["attribution"] = a
+	}
+	var s LayerStats
+	if err := layerStats.FindOne(ctx, bson.M{"_id": layer}).Decode(&s); err == nil && len(s.Extent) == 4 {
+		doc["bounds"] = s.Extent
+	}
+	writeJSON(w, http.StatusOK, doc)
+}
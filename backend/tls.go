@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// hstsMiddleware tells browsers to stick to HTTPS once they've seen it
+func hstsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on httpsPort
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// certReloader serves TLS_CERT_FILE/TLS_KEY_FILE and loads them again when
+// either changes, so renewed certificates are picked up without a restart
+type certReloader struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	reload := func() {
+		// the pair may be written one file at a time; a mismatch keeps the
+		// old certificate until the next change
+		if err := c.load(); err != nil {
+			log.Printf("tls certificate reload warning: %v", err)
+			return
+		}
+		log.Printf("tls certificate reloaded from %s", certFile)
+	}
+	watchFile(certFile, reload)
+	watchFile(keyFile, reload)
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// serve starts the HTTP server. Without TLS config it listens on PORT as
+// before. TLS comes from TLS_CERT_FILE/TLS_KEY_FILE or, with ACME_DOMAINS,
+// from Let's Encrypt certificates cached in ACME_CACHE_DIR; it is served on
+// TLS_PORT and HTTP_REDIRECT_PORT redirects plain HTTP there. HTTP/2 is on
+// for TLS unless HTTP2=false; H2C=true also allows it in cleartext for use
+// behind a proxy.
+func serve(handler http.Handler, port string) {
+	certFile, keyFile := getenv("TLS_CERT_FILE", ""), getenv("TLS_KEY_FILE", "")
+	acmeDomains := getenv("ACME_DOMAINS", "")
+	tlsPort := getenv("TLS_PORT", "443")
+	redirectPort := getenv("HTTP_REDIRECT_PORT", "")
+
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(getenv("HTTP2", "true") != "false")
+	protocols.SetUnencryptedHTTP2(getenv("H2C", "") == "true")
+	srv.Protocols = protocols
+
+	if certFile == "" && acmeDomains == "" {
+		srv.Addr = ":" + port
+		log.Printf("Server listening on :%s", port)
+		log.Fatal(srv.ListenAndServe())
+	}
+
+	srv.Addr = ":" + tlsPort
+	srv.Handler = hstsMiddleware(handler)
+	redirect := redirectToHTTPS(tlsPort)
+
+	if acmeDomains != "" {
+		var hosts []string
+		for _, d := range strings.Split(acmeDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				hosts = append(hosts, d)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(getenv("ACME_CACHE_DIR", "certs")),
+			Email:      getenv("ACME_EMAIL", ""),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		srv.TLSConfig.MinVersion = tls.VersionTLS12
+		// the HTTP-01 challenge needs port 80
+		if redirectPort == "" {
+			redirectPort = "80"
+		}
+		redirect = m.HTTPHandler(redirect)
+	} else {
+		certs, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			log.Fatalf("tls certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: certs.get}
+	}
+
+	if redirectPort != "" {
+		go func() {
+			log.Printf("HTTP redirect listening on :%s", redirectPort)
+			rs := &http.Server{Addr: ":" + redirectPort, Handler: redirect, ReadHeaderTimeout: 10 * time.Second}
+			log.Fatal(rs.ListenAndServe())
+		}()
+	}
+	log.Printf("Server listening with TLS on :%s", tlsPort)
+	// the certificate comes from TLSConfig
+	log.Fatal(srv.ListenAndServeTLS("", ""))
+}
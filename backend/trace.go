@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Utility tracing walks a network along the digitized direction of its
+// lines: downstream follows each line from its first vertex to its last
+// (the flow direction of pipes and feeders), upstream against it, connected
+// both ways. Barriers stop the walk: barrier_features are network lines that
+// are closed, barrier_layer holds point features (valves, switches) closing
+// the node they sit on.
+const maxTraceSnapMeters = 10.0
+
+// TraceRequest is the body of POST /networks/{id}/trace
+type TraceRequest struct {
+	From              string   `json:"from"`
+	Direction         string   `json:"direction"`
+	BarrierFeatures   []string `json:"barrier_features"`
+	BarrierLayer      string   `json:"barrier_layer"`
+	CollectLayer      string   `json:"collect_layer"`
+	CollectToleranceM float64  `json:"collect_tolerance_m"`
+}
+
+// snappedNodes maps point features of a layer to the network nodes they lie
+// on, within tolerance meters. Only points the caller may see take part.
+func snappedNodes(r *http.Request, g *roadGraph, layer string, tolerance float64) (map[int][]FeatureDoc, error) {
+	ctx := r.Context()
+	q := bson.M{
+		"layer":         layer,
+		"status":        bson.M{"$nin": bson.A{statusPending, statusRejected}},
+		"geometry.type": "Point",
+	}
+	applyVisibilityFilter(r, q)
+	cur, err := collection.Find(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	out := map[int][]FeatureDoc{}
+	for cur.Next(ctx) {
+		var doc FeatureDoc
+		if err := cur.Decode(&doc); err != nil {
+			continue
+		}
+		pg, err := parseGeometry(doc.Geometry)
+		if err != nil {
+			continue
+		}
+		if n, d := g.nearestNode(pg.Point); n >= 0 && d <= tolerance {
+			out[n] = append(out[n], doc)
+		}
+	}
+	return out, cur.Err()
+}
+
+// POST /networks/{id}/trace { from: "lat,lon", direction, barrier_features,
+// barrier_layer, collect_layer, collect_tolerance_m }
+// Returns the traced lines as a FeatureCollection; with collect_layer the
+// point features of that layer on reached nodes (customers, meters) are
+// listed under collected.
+func traceHandler(w http.ResponseWriter, r *http.Request) {
+	var body TraceRequest
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	start, err := parseLatLon(body.From)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid from", FieldError{Field: "from", Message: err.Error()})
+		return
+	}
+	if body.Direction == "" {
+		body.Direction = "downstream"
+	}
+	if body.Direction != "downstream" && body.Direction != "upstream" && body.Direction != "connected" {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid direction", FieldError{Field: "direction", Message: "must be downstream, upstream or connected"})
+		return
+	}
+	closed := map[primitive.ObjectID]bool{}
+	for i, id := range body.BarrierFeatures {
+		oid, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "validation_failed", "invalid barrier feature", FieldError{Field: "barrier_features[" + strconv.Itoa(i) + "]", Message: "not a feature id"})
+			return
+		}
+		closed[oid] = true
+	}
+	if body.CollectToleranceM <= 0 {
+		body.CollectToleranceM = maxTraceSnapMeters
+	}
+
+	_, g, ok := loadGraph(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	blocked := map[int]bool{}
+	if body.BarrierLayer != "" {
+		nodes, err := snappedNodes(r, g, body.BarrierLayer, maxTraceSnapMeters)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+		for n := range nodes {
+			blocked[n] = true
+		}
+	}
+	var collect map[int][]FeatureDoc
+	if body.CollectLayer != "" {
+		if collect, err = snappedNodes(r, g, body.CollectLayer, body.CollectToleranceM); err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+			return
+		}
+	}
+	source, d := g.nearestNode(start)
+	if source < 0 || d > maxTraceSnapMeters {
+		writeError(w, http.StatusUnprocessableEntity, "analysis_failed", "from is not on the network")
+		return
+	}
+
+	var reached map[int]bool
+	var edges []int
+	if !runGeometry(w, r, func() {
+		reached, edges = g.trace(source, body.Direction, closed, blocked)
+	}) {
+		return
+	}
+
+	fc := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	features := map[string]bool{}
+	for _, i := range edges {
+		e := g.edges[i]
+		features[e.Feature.Hex()] = true
+		fc.Features = append(fc.Features, GeoJSONFeature{Type: "Feature", Geometry: e.Geometry, Properties: bson.M{
+			"feature": e.Feature.Hex(), "length_m": math.Round(e.LengthM*100) / 100,
+		}})
+	}
+	collected := []GeoJSONFeature{}
+	for n := range reached {
+		for _, doc := range collect[n] {
+			revealDoc(r, &doc)
+			collected = append(collected, featureToGeoJSON(doc))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"direction": body.Direction,
+		"nodes":     len(reached),
+		"features":  len(features),
+		"lines":     fc,
+		"collected": GeoJSONFeatureCollection{Type: "FeatureCollection", Features: collected},
+	})
+}
+
+// trace is a breadth-first walk from source. A blocked node is reached but
+// not passed; the start node itself is never blocked, so tracing from a
+// valve traces what it feeds.
+func (g *roadGraph) trace(source int, direction string, closed map[primitive.ObjectID]bool, blocked map[int]bool) (map[int]bool, []int) {
+	out := make([][]int, len(g.nodes))
+	in := make([][]int, len(g.nodes))
+	for i, e := range g.edges {
+		out[e.From] = append(out[e.From], i)
+		in[e.To] = append(in[e.To], i)
+	}
+	reached := map[int]bool{source: true}
+	usedEdge := map[int]bool{}
+	var edges []int
+	queue := []int{source}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n != source && blocked[n] {
+			continue
+		}
+		step := func(list []int, downstream bool) {
+			for _, i := range list {
+				e := g.edges[i]
+				if closed[e.Feature] || usedEdge[i] {
+					continue
+				}
+				usedEdge[i] = true
+				edges = append(edges, i)
+				next := e.To
+				if !downstream {
+					next = e.From
+				}
+				if !reached[next] {
+					reached[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		if direction != "upstream" {
+			step(out[n], true)
+		}
+		if direction != "downstream" {
+			step(in[n], false)
+		}
+	}
+	return reached, edges
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Resumable uploads speak tus 1.0 (core plus the creation,
+// creation-with-upload, termination and expiration extensions) so an import
+// file survives a dropped connection. The client creates an upload with
+// POST /uploads and Upload-Length, sends the file with PATCH requests
+// starting at the Upload-Offset a HEAD reports, and the import runs once
+// the last byte is in; GET /uploads/{id} has its report. Bytes are kept in
+// Mongo in chunks, so any instance can take the next PATCH. Upload-Metadata
+// names the import: layer, dryRun and format (geojson, or osm with a
+// filter). An upload nobody has written to for UPLOAD_EXPIRY (24h)
+// is deleted.
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,creation-with-upload,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+)
+
+const (
+	uploadUploading = "uploading"
+	uploadImporting = "importing"
+	uploadDone      = "done"
+	uploadFailed    = "failed"
+)
+
+// Upload is a resumable upload and, once complete, the import it fed
+type Upload struct {
+	ID       string            `bson:"_id" json:"id"`
+	Length   int64             `bson:"length" json:"length"`
+	Offset   int64             `bson:"offset" json:"offset"`
+	Format   string            `bson:"format" json:"format"`
+	Layer    string            `bson:"layer,omitempty" json:"layer,omitempty"`
+	DryRun   bool              `bson:"dry_run" json:"dry_run"`
+	Filename string            `bson:"filename,omitempty" json:"filename,omitempty"`
+	Metadata map[string]string `bson:"metadata,omitempty" json:"metadata,omitempty"`
+	Status   string            `bson:"status" json:"status"`
+	Report   *ImportReport     `bson:"report,omitempty" json:"report,omitempty"`
+	Error    string            `bson:"error,omitempty" json:"error,omitempty"`
+	// CreatedBy alone may write to, import from and delete the upload,
+	// besides admins
+	CreatedBy string    `bson:"created_by" json:"created_by"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// uploadChunk is a run of bytes at Offset; each PATCH adds one or more
+type uploadChunk struct {
+	ID     string `bson:"_id"`
+	Upload string `bson:"upload"`
+	Offset int64  `bson:"offset"`
+	Data   []byte `bson:"data"`
+}
+
+var (
+	uploads      *mongo.Collection
+	uploadChunks *mongo.Collection
+
+	uploadMaxSize   int64 = 2 << 30
+	uploadChunkSize       = 4 << 20
+	uploadExpiry          = 24 * time.Hour
+)
+
+// uploadFormats are the importers an upload can feed, as the handler, the
+// target it is called with and the metadata passed on as parameters
+// besides layer and dryRun
+var uploadFormats = map[string]struct {
+	handler http.HandlerFunc
+	target  string
+	params  []string
+}{
+	"geojson": {importGeoJSONHandler, "/import/geojson", nil},
+	"osm":     {importOSMHandler, "/import/osm", []string{"filter"}},
+}
+
+func setupUploads() {
+	uploads = db.Collection(getenv("MONGO_UPLOADS_COLLECTION", "uploads"))
+	uploadChunks = db.Collection(getenv("MONGO_UPLOAD_CHUNKS_COLLECTION", "upload_chunks"))
+	if n, err := strconv.ParseInt(getenv("UPLOAD_MAX_SIZE", ""), 10, 64); err == nil && n > 0 {
+		uploadMaxSize = n
+	}
+	// a chunk is one document, so it stays well under the 16MB limit
+	if n, err := strconv.Atoi(getenv("UPLOAD_CHUNK_SIZE", "")); err == nil && n > 0 && n <= 8<<20 {
+		uploadChunkSize = n
+	}
+	if d, err := time.ParseDuration(getenv("UPLOAD_EXPIRY", "")); err == nil && d > 0 {
+		uploadExpiry = d
+	}
+	if _, err := uploadChunks.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "upload", Value: 1}, {Key: "offset", Value: 1}}}); err != nil {
+		log.Printf("upload chunks index create warning: %v", err)
+	}
+	if _, err := uploads.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "expires_at", Value: 1}}}); err != nil {
+		log.Printf("uploads index create warning: %v", err)
+	}
+	if _, ctl := ctlArgs(); ctl {
+		return
+	}
+	// expiry is swept rather than left to a TTL index, since the chunks
+	// have to go with the upload
+	go func() {
+		for {
+			sweepUploads()
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
+
+func sweepUploads() {
+	cur, err := uploads.Find(ctx, bson.M{"expires_at": bson.M{"$lt": time.Now()}, "status": bson.M{"$ne": uploadImporting}},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		log.Printf("upload sweep warning: %v", err)
+		return
+	}
+	var expired []Upload
+	if err := cur.All(ctx, &expired); err != nil {
+		log.Printf("upload sweep warning: %v", err)
+		return
+	}
+	for _, u := range expired {
+		if err := deleteUpload(u.ID); err != nil {
+			log.Printf("upload sweep warning: %v", err)
+		}
+	}
+}
+
+// deleteUpload removes an upload and its bytes, chunks first so a failure
+// leaves the upload to be swept again
+func deleteUpload(id string) error {
+	if _, err := uploadChunks.DeleteMany(ctx, bson.M{"upload": id}); err != nil {
+		return err
+	}
+	_, err := uploads.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// tusHeaders marks responses under /uploads as tus; OPTIONS there is the
+// protocol's discovery request
+func tusHeaders(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/uploads" && !strings.HasPrefix(r.URL.Path, "/uploads/") {
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadMaxSize, 10))
+	}
+}
+
+// checkTus refuses requests from clients speaking another tus version
+func checkTus(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, "unsupported_version", "Tus-Resumable must be "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata reads Upload-Metadata: comma separated keys, each
+// with an optional base64 value
+func parseUploadMetadata(h string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(h, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, enc, _ := strings.Cut(pair, " ")
+		v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+		if err != nil {
+			return nil, fmt.Errorf("value of %q is not base64", key)
+		}
+		meta[key] = string(v)
+	}
+	return meta, nil
+}
+
+// loadUpload finds the upload of the request, writing 404 when it doesn't
+// exist or belongs to someone else
+func loadUpload(w http.ResponseWriter, r *http.Request) (*Upload, bool) {
+	var u Upload
+	err := uploads.FindOne(ctx, bson.M{"_id": mux.Vars(r)["id"]}).Decode(&u)
+	if err == mongo.ErrNoDocuments || (err == nil && u.CreatedBy != userID(r) && !currentUser(r).hasRole("admin")) {
+		writeError(w, http.StatusNotFound, "not_found", "upload not found")
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return nil, false
+	}
+	return &u, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, u *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// POST /uploads creates an upload from Upload-Length and Upload-Metadata;
+// a body sent along is its first bytes
+func createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") || !checkTus(w, r) {
+		return
+	}
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, http.StatusBadRequest, "invalid_header", "Upload-Defer-Length is not supported, send Upload-Length")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_header", "Upload-Length must be a non-negative integer")
+		return
+	}
+	if length > uploadMaxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("uploads are limited to %d bytes", uploadMaxSize))
+		return
+	}
+	meta, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_header", "invalid Upload-Metadata: "+err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	b := make([]byte, 16)
+	rand.Read(b)
+	u := Upload{
+		ID: hex.EncodeToString(b), Length: length, Format: meta["format"], Layer: meta["layer"],
+		Filename: meta["filename"], Metadata: meta, Status: uploadUploading,
+		CreatedBy: userID(r), CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(uploadExpiry),
+	}
+	u.DryRun, _ = strconv.ParseBool(meta["dryRun"])
+	if u.Format == "" {
+		u.Format = "geojson"
+	}
+	if _, ok := uploadFormats[u.Format]; !ok {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "unsupported import format "+u.Format,
+			FieldError{Field: "format", Message: "must be geojson or osm"})
+		return
+	}
+	// catch what the importer would refuse before the bytes are sent
+	if u.Format == "osm" {
+		if _, err := parseOSMFilter(meta["filter"]); err != nil || meta["filter"] == "" {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "osm uploads need a valid filter in Upload-Metadata",
+				FieldError{Field: "filter", Message: "a tag filter such as amenity=hospital"})
+			return
+		}
+	}
+	if _, err := uploads.InsertOne(ctx, u); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	w.Header().Set("Location", requestBaseURL(r)+"/uploads/"+u.ID)
+	if r.Header.Get("Content-Type") == tusContentType {
+		if !writeUploadBody(w, r, &u) {
+			return
+		}
+	}
+	setUploadHeaders(w, &u)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HEAD /uploads/{id} reports how much of the upload the server has
+func headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+	u, ok := loadUpload(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// PATCH /uploads/{id} appends the body at Upload-Offset
+func patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != tusContentType {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "Content-Type must be "+tusContentType)
+		return
+	}
+	u, ok := loadUpload(w, r)
+	if !ok {
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_header", "Upload-Offset must be an integer")
+		return
+	}
+	if u.Status != uploadUploading || offset != u.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+		writeError(w, http.StatusConflict, "offset_mismatch", fmt.Sprintf("upload is at offset %d", u.Offset))
+		return
+	}
+	if !writeUploadBody(w, r, u) {
+		return
+	}
+	setUploadHeaders(w, u)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeUploadBody stores the request body at u.Offset a chunk at a time,
+// so whatever arrived before a connection drops is kept, and starts the
+// import when the upload is complete. u.Offset is advanced as it goes.
+func writeUploadBody(w http.ResponseWriter, r *http.Request, u *Upload) bool {
+	body := io.LimitReader(r.Body, u.Length-u.Offset+1)
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, readErr := io.ReadFull(body, buf)
+		if u.Offset+int64(n) > u.Length {
+			writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("body goes past Upload-Length %d", u.Length))
+			return false
+		}
+		if n > 0 {
+			chunk := uploadChunk{ID: fmt.Sprintf("%s|%016d", u.ID, u.Offset), Upload: u.ID, Offset: u.Offset, Data: buf[:n]}
+			if _, err := uploadChunks.InsertOne(ctx, chunk); err != nil {
+				if mongo.IsDuplicateKeyError(err) {
+					writeError(w, http.StatusConflict, "offset_mismatch", "another request is writing this upload")
+				} else {
+					writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+				}
+				return false
+			}
+			now := time.Now().UTC()
+			next := u.Offset + int64(n)
+			res, err := uploads.UpdateOne(ctx, bson.M{"_id": u.ID, "offset": u.Offset},
+				bson.M{"$set": bson.M{"offset": next, "updated_at": now, "expires_at": now.Add(uploadExpiry)}})
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+				return false
+			}
+			if res.MatchedCount == 0 {
+				uploadChunks.DeleteOne(ctx, bson.M{"_id": chunk.ID})
+				writeError(w, http.StatusConflict, "offset_mismatch", "another request is writing this upload")
+				return false
+			}
+			u.Offset, u.UpdatedAt, u.ExpiresAt = next, now, now.Add(uploadExpiry)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			// the client went away; what arrived is kept for the next PATCH
+			writeError(w, http.StatusBadRequest, "incomplete_body", "reading body: "+readErr.Error())
+			return false
+		}
+	}
+	if u.Offset == u.Length {
+		startUploadImport(r, u)
+	}
+	return true
+}
+
+// startUploadImport runs the import of a complete upload in the background
+// as the user who finished it, unless it is already running
+func startUploadImport(r *http.Request, u *Upload) bool {
+	res, err := uploads.UpdateOne(ctx, bson.M{"_id": u.ID, "offset": u.Length, "status": bson.M{"$in": bson.A{uploadUploading, uploadFailed}}},
+		bson.M{"$set": bson.M{"status": uploadImporting, "updated_at": time.Now().UTC()}, "$unset": bson.M{"error": "", "report": ""}})
+	if err != nil || res.ModifiedCount == 0 {
+		return false
+	}
+	u.Status = uploadImporting
+	var user *User
+	if cu := currentUser(r); cu != nil {
+		c := *cu
+		user = &c
+	}
+	go runUploadImport(*u, user)
+	return true
+}
+
+func runUploadImport(u Upload, user *User) {
+	format := uploadFormats[u.Format]
+	q := url.Values{"layer": {u.Layer}, "dryRun": {strconv.FormatBool(u.DryRun)}}
+	for _, p := range format.params {
+		if v := u.Metadata[p]; v != "" {
+			q.Set(p, v)
+		}
+	}
+	r, _ := http.NewRequest("POST", format.target+"?"+q.Encode(), &chunkReader{upload: u.ID})
+	if user != nil {
+		r = r.WithContext(context.WithValue(r.Context(), userCtxKey, user))
+	}
+	var out bytes.Buffer
+	set := bson.M{"updated_at": time.Now().UTC(), "expires_at": time.Now().Add(uploadExpiry)}
+	if err := callHandler(format.handler, r, &out); err != nil {
+		set["status"], set["error"] = uploadFailed, err.Error()
+	} else {
+		var rep ImportReport
+		json.Unmarshal(out.Bytes(), &rep)
+		set["status"], set["report"] = uploadDone, rep
+		if !u.DryRun {
+			writeGeneration.Add(1)
+		}
+	}
+	if _, err := uploads.UpdateOne(ctx, bson.M{"_id": u.ID}, bson.M{"$set": set}); err != nil {
+		log.Printf("upload %s: status update warning: %v", u.ID, err)
+	}
+	// a failed import keeps the bytes so it can be retried without
+	// uploading again
+	if set["status"] == uploadDone {
+		if _, err := uploadChunks.DeleteMany(ctx, bson.M{"upload": u.ID}); err != nil {
+			log.Printf("upload %s: chunk delete warning: %v", u.ID, err)
+		}
+	}
+}
+
+// chunkReader reads an upload's chunks back in order
+type chunkReader struct {
+	upload string
+	cur    *mongo.Cursor
+	buf    []byte
+	err    error
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.cur == nil && c.err == nil {
+		c.cur, c.err = uploadChunks.Find(ctx, bson.M{"upload": c.upload}, options.Find().SetSort(bson.D{{Key: "offset", Value: 1}}))
+	}
+	for len(c.buf) == 0 && c.err == nil {
+		if !c.cur.Next(ctx) {
+			if c.err = c.cur.Err(); c.err == nil {
+				c.err = io.EOF
+			}
+			c.cur.Close(ctx)
+			break
+		}
+		var chunk uploadChunk
+		if c.err = c.cur.Decode(&chunk); c.err == nil {
+			c.buf = chunk.Data
+		}
+	}
+	if len(c.buf) == 0 {
+		return 0, c.err
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// GET /uploads/{id} is the upload's progress and, once imported, the
+// import report
+func getUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := loadUpload(w, r)
+	if !ok {
+		return
+	}
+	setUploadHeaders(w, u)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// POST /uploads/{id}/import runs a failed import again from the stored
+// bytes
+func retryUploadImportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "editor") {
+		return
+	}
+	u, ok := loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if u.Status != uploadFailed {
+		writeError(w, http.StatusConflict, "invalid_state", "upload is "+u.Status+", only failed imports can be retried")
+		return
+	}
+	if !startUploadImport(r, u) {
+		writeError(w, http.StatusConflict, "invalid_state", "upload changed, reload it")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(u)
+}
+
+// DELETE /uploads/{id} is tus termination: the upload and its bytes go
+func deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !checkTus(w, r) {
+		return
+	}
+	u, ok := loadUpload(w, r)
+	if !ok {
+		return
+	}
+	if u.Status == uploadImporting {
+		writeError(w, http.StatusConflict, "invalid_state", "upload is being imported")
+		return
+	}
+	if err := deleteUpload(u.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUploads purges the uploads matching q along with their bytes
+func deleteUploads(_ subject, q bson.M) (int64, error) {
+	cur, err := uploads.Find(ctx, q, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var found []Upload
+	if err := cur.All(ctx, &found); err != nil {
+		return 0, err
+	}
+	for _, u := range found {
+		if err := deleteUpload(u.ID); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(found)), nil
+}
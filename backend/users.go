@@ -0,0 +1,578 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Local accounts, for installations without SSO. LOCAL_ACCOUNTS=true makes
+// them a password provider for /auth/login; LOCAL_ADMIN_PASSWORD creates an
+// admin account named admin while there are no accounts yet, so the first
+// real ones can be made. Passwords are bcrypt hashed. Admins hand out
+// password reset tokens, which only the token's hash is stored for.
+const (
+	resetTokenTTL = time.Hour
+	maxPassword   = 72 // bcrypt ignores anything longer
+)
+
+var (
+	users             *mongo.Collection
+	localAccounts     bool
+	minPasswordLength = 8
+	usernamePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+	// compared against for unknown users, so they take as long as wrong
+	// passwords
+	dummyHash []byte
+)
+
+// LocalUser is a local account
+type LocalUser struct {
+	ID                string     `bson:"_id" json:"id"`
+	Name              string     `bson:"name,omitempty" json:"name,omitempty"`
+	Email             string     `bson:"email,omitempty" json:"email,omitempty"`
+	Role              string     `bson:"role" json:"role"`
+	Disabled          bool       `bson:"disabled,omitempty" json:"disabled,omitempty"`
+	PasswordHash      string     `bson:"password_hash,omitempty" json:"-"`
+	PasswordChangedAt time.Time  `bson:"password_changed_at,omitempty" json:"password_changed_at,omitempty"`
+	ResetTokenHash    string     `bson:"reset_token_hash,omitempty" json:"-"`
+	ResetExpires      *time.Time `bson:"reset_expires,omitempty" json:"-"`
+	LastLoginAt       *time.Time `bson:"last_login_at,omitempty" json:"last_login_at,omitempty"`
+	CreatedAt         time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt         time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+func setupUsers() {
+	users = db.Collection(getenv("MONGO_USERS_COLLECTION", "users"))
+	if v, err := strconv.Atoi(getenv("PASSWORD_MIN_LENGTH", "")); err == nil && v > 0 {
+		minPasswordLength = v
+	}
+	if _, err := users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string"}}),
+	}); err != nil {
+		log.Printf("users index create warning: %v", err)
+	}
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	if pw := getsecret("LOCAL_ADMIN_PASSWORD", ""); pw != "" && localAccounts {
+		n, err := users.CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+		if err != nil {
+			log.Printf("local admin check warning: %v", err)
+			return
+		}
+		if n == 0 && foreignUserID("admin") {
+			log.Printf("local admin not created: AUTH_TOKENS already has a user admin")
+		} else if n == 0 {
+			hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("local admin password warning: %v", err)
+				return
+			}
+			now := time.Now().UTC()
+			if _, err := users.InsertOne(ctx, LocalUser{ID: "admin", Role: "admin", PasswordHash: string(hash), PasswordChangedAt: now, CreatedAt: now, UpdatedAt: now}); err != nil {
+				log.Printf("local admin create warning: %v", err)
+			} else {
+				log.Printf("created local admin account")
+			}
+		}
+	}
+}
+
+// localPasswords is the passwordProvider for local accounts
+type localPasswords struct{}
+
+func (localPasswords) name() string { return "local" }
+
+func (localPasswords) login(username, password string) (*User, error) {
+	var u LocalUser
+	err := users.FindOne(ctx, bson.M{"_id": strings.ToLower(username)}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+	if u.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return nil, errInvalidCredentials
+	}
+	if u.Disabled {
+		return nil, errAccountDisabled
+	}
+	now := time.Now().UTC()
+	users.UpdateByID(ctx, u.ID, bson.M{"$set": bson.M{"last_login_at": now}})
+	return &User{ID: u.ID, Role: u.Role, Provider: "local"}, nil
+}
+
+// foreignUserID reports whether another provider already authenticates a
+// user as id. Local ids are bare names and OIDC and LDAP ids carry a '#'
+// namespace, so only AUTH_TOKENS entries can collide; a local account of
+// the same name would share that user's features, roles and sessions.
+func foreignUserID(id string) bool {
+	apiTokensMu.RLock()
+	defer apiTokensMu.RUnlock()
+	for _, u := range apiTokens {
+		if strings.EqualFold(u.ID, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// localSession checks a session token of a local account against the
+// account: tokens of disabled or deleted accounts and tokens issued before a
+// password change stop working, and role changes apply at once. It returns
+// the account's current role.
+func localSession(id string, issued time.Time) (string, error) {
+	var u LocalUser
+	err := users.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"disabled": 1, "role": 1, "password_changed_at": 1})).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		return "", errors.New("account no longer exists")
+	} else if err != nil {
+		return "", err
+	}
+	if u.Disabled {
+		return "", errAccountDisabled
+	}
+	// iat has second precision
+	if u.PasswordChangedAt.Truncate(time.Second).After(issued) {
+		return "", errors.New("password changed, log in again")
+	}
+	return u.Role, nil
+}
+
+func validatePassword(pw string) *FieldError {
+	if len(pw) < minPasswordLength || len(pw) > maxPassword {
+		return &FieldError{Field: "password", Message: fmt.Sprintf("must be %d to %d characters", minPasswordLength, maxPassword)}
+	}
+	return nil
+}
+
+func hashPassword(w http.ResponseWriter, pw string) (string, bool) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "password hash error: "+err.Error())
+		return "", false
+	}
+	return string(hash), true
+}
+
+// writeUserError turns insert/update errors into responses, reporting a
+// taken id or email as a conflict
+func writeUserError(w http.ResponseWriter, err error) {
+	if mongo.IsDuplicateKeyError(err) {
+		field := "id"
+		if strings.Contains(err.Error(), "email") {
+			field = "email"
+		}
+		writeError(w, http.StatusConflict, "conflict", field+" already in use", FieldError{Field: field, Message: "already in use"})
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "db_error", "db write error: "+err.Error())
+}
+
+func loadUser(w http.ResponseWriter, id string) (LocalUser, bool) {
+	var u LocalUser
+	err := users.FindOne(ctx, bson.M{"_id": id}).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "user not found")
+		return u, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return u, false
+	}
+	return u, true
+}
+
+// UserInput is the body of user create and update requests; pointers tell
+// absent from empty
+type UserInput struct {
+	ID       string  `json:"id"`
+	Name     *string `json:"name"`
+	Email    *string `json:"email"`
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+	Password *string `json:"password"`
+}
+
+// validate checks the fields that were sent; self marks profile updates,
+// which can't change role or disabled
+func (in *UserInput) validate(self bool) []FieldError {
+	var errs []FieldError
+	if in.Email != nil {
+		*in.Email = strings.ToLower(strings.TrimSpace(*in.Email))
+		if *in.Email != "" && !strings.Contains(*in.Email, "@") {
+			errs = append(errs, FieldError{Field: "email", Message: "not an email address"})
+		}
+	}
+	if in.Role != nil {
+		if self {
+			errs = append(errs, FieldError{Field: "role", Message: "can't be changed on your own profile"})
+		} else if _, ok := roleRanks[*in.Role]; !ok {
+			errs = append(errs, FieldError{Field: "role", Message: "must be viewer, editor or admin"})
+		}
+	}
+	if in.Disabled != nil && self {
+		errs = append(errs, FieldError{Field: "disabled", Message: "can't be changed on your own profile"})
+	}
+	if in.Password != nil {
+		if self {
+			errs = append(errs, FieldError{Field: "password", Message: "use POST /users/me/password"})
+		} else if fe := validatePassword(*in.Password); fe != nil {
+			errs = append(errs, *fe)
+		}
+	}
+	return errs
+}
+
+// updates builds the $set/$unset for the sent fields
+func (in *UserInput) updates(w http.ResponseWriter) (bson.M, bool) {
+	set, unset := bson.M{"updated_at": time.Now().UTC()}, bson.M{}
+	if in.Name != nil {
+		set["name"] = strings.TrimSpace(*in.Name)
+	}
+	if in.Email != nil {
+		if *in.Email == "" {
+			unset["email"] = ""
+		} else {
+			set["email"] = *in.Email
+		}
+	}
+	if in.Role != nil {
+		set["role"] = *in.Role
+	}
+	if in.Disabled != nil {
+		set["disabled"] = *in.Disabled
+	}
+	if in.Password != nil {
+		hash, ok := hashPassword(w, *in.Password)
+		if !ok {
+			return nil, false
+		}
+		set["password_hash"], set["password_changed_at"] = hash, time.Now().UTC()
+		unset["reset_token_hash"], unset["reset_expires"] = "", ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, true
+}
+
+// GET /users
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	cur, err := users.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	out := []LocalUser{}
+	if err := cur.All(ctx, &out); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// POST /users { id, name, email, role, password }
+// Without a password the account can't log in until a reset token is used.
+func createUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var in UserInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	in.ID = strings.ToLower(in.ID)
+	errs := in.validate(false)
+	// /users/me is the caller's profile
+	if !usernamePattern.MatchString(in.ID) || in.ID == "me" {
+		errs = append(errs, FieldError{Field: "id", Message: "lowercase letters, digits, ., _ and -, at most 64 characters"})
+	}
+	if foreignUserID(in.ID) {
+		writeError(w, http.StatusConflict, "conflict", "id already in use", FieldError{Field: "id", Message: "already used by another auth provider"})
+		return
+	}
+	if in.Role == nil {
+		errs = append(errs, FieldError{Field: "role", Message: "required"})
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid user", errs...)
+		return
+	}
+	now := time.Now().UTC()
+	u := LocalUser{ID: in.ID, Role: *in.Role, CreatedAt: now, UpdatedAt: now}
+	if in.Name != nil {
+		u.Name = strings.TrimSpace(*in.Name)
+	}
+	if in.Email != nil {
+		u.Email = *in.Email
+	}
+	if in.Disabled != nil {
+		u.Disabled = *in.Disabled
+	}
+	if in.Password != nil {
+		hash, ok := hashPassword(w, *in.Password)
+		if !ok {
+			return
+		}
+		u.PasswordHash, u.PasswordChangedAt = hash, now
+	}
+	if _, err := users.InsertOne(ctx, u); err != nil {
+		writeUserError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// GET /users/{id}
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	u, ok := loadUser(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// updateUser applies in to account id and writes the updated account
+func updateUser(w http.ResponseWriter, id string, in UserInput) {
+	update, ok := in.updates(w)
+	if !ok {
+		return
+	}
+	var u LocalUser
+	err := users.FindOneAndUpdate(ctx, bson.M{"_id": id}, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&u)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	} else if err != nil {
+		writeUserError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// PUT /users/{id} { name, email, role, disabled, password }
+func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	var in UserInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if errs := in.validate(false); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid user", errs...)
+		return
+	}
+	updateUser(w, mux.Vars(r)["id"], in)
+}
+
+// DELETE /users/{id}
+func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if u := currentUser(r); u != nil && u.Provider == "local" && u.ID == id {
+		writeError(w, http.StatusConflict, "conflict", "you can't delete your own account")
+		return
+	}
+	res, err := users.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if res.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /users/{id}/reset-token
+// Returns a one-time token, valid for an hour, that sets the account's
+// password through POST /auth/password-reset. Issuing a new token voids the
+// previous one.
+func resetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	b := make([]byte, 24)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	exp := time.Now().UTC().Add(resetTokenTTL)
+	res, err := users.UpdateByID(ctx, mux.Vars(r)["id"], bson.M{"$set": bson.M{"reset_token_hash": hex.EncodeToString(sum[:]), "reset_expires": exp}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "user not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": exp})
+}
+
+// POST /auth/password-reset { token, password }
+func passwordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	if fe := validatePassword(body.Password); fe != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid password", *fe)
+		return
+	}
+	hash, ok := hashPassword(w, body.Password)
+	if !ok {
+		return
+	}
+	sum := sha256.Sum256([]byte(body.Token))
+	now := time.Now().UTC()
+	res, err := users.UpdateOne(ctx,
+		bson.M{"reset_token_hash": hex.EncodeToString(sum[:]), "reset_expires": bson.M{"$gt": now}},
+		bson.M{
+			"$set":   bson.M{"password_hash": hash, "password_changed_at": now, "updated_at": now},
+			"$unset": bson.M{"reset_token_hash": "", "reset_expires": ""},
+		})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if body.Token == "" || res.MatchedCount == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_token", "invalid or expired reset token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireLocalUser writes 401/404 unless the caller is logged in with a
+// local account
+func requireLocalUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	u := currentUser(r)
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+		return nil, false
+	}
+	if u.Provider != "local" {
+		writeError(w, http.StatusNotFound, "not_found", "no local account for "+u.ID)
+		return nil, false
+	}
+	return u, true
+}
+
+// GET /users/me
+func getProfileHandler(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireLocalUser(w, r)
+	if !ok {
+		return
+	}
+	u, ok := loadUser(w, me.ID)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// PUT /users/me { name, email }
+func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireLocalUser(w, r)
+	if !ok {
+		return
+	}
+	var in UserInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if errs := in.validate(true); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid profile", errs...)
+		return
+	}
+	updateUser(w, me.ID, in)
+}
+
+// POST /users/me/password { current, password }
+// Changing the password ends the account's other sessions; the response
+// carries a fresh session token, or renews the cookies of a cookie session.
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireLocalUser(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Current  string `json:"current"`
+		Password string `json:"password"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	u, ok := loadUser(w, me.ID)
+	if !ok {
+		return
+	}
+	if u.PasswordHash == "" || bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(body.Current)) != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "wrong password", FieldError{Field: "current", Message: "does not match"})
+		return
+	}
+	if fe := validatePassword(body.Password); fe != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid password", *fe)
+		return
+	}
+	hash, ok := hashPassword(w, body.Password)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := users.UpdateByID(ctx, me.ID, bson.M{"$set": bson.M{"password_hash": hash, "password_changed_at": now, "updated_at": now}}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	token, exp, err := issueSession(me)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "session error: "+err.Error())
+		return
+	}
+	out := map[string]interface{}{"expires_at": exp.UTC()}
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		out["csrf_token"] = setSessionCookies(w, r, token, exp)
+	} else {
+		out["token"] = token
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(out)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Feature visibility. A feature is public unless its visibility says
+// otherwise: internal features are only served to signed-in users, private
+// ones to editors and whoever created them, e.g. while they are still
+// being digitized. Every read path applies applyVisibilityFilter, and
+// published versions and releases only take public features.
+const (
+	visibilityPublic   = "public"
+	visibilityInternal = "internal"
+	visibilityPrivate  = "private"
+)
+
+var notPublic = bson.A{visibilityInternal, visibilityPrivate}
+
+func validateVisibility(v *string) []FieldError {
+	if v == nil {
+		return nil
+	}
+	switch *v {
+	case visibilityPublic, visibilityInternal, visibilityPrivate:
+		return nil
+	}
+	return []FieldError{{Field: "visibility", Message: "must be one of public, internal, private"}}
+}
+
+// visibilityFilter is the condition limiting features to those the caller
+// may see, nil when they may see all
+func visibilityFilter(r *http.Request) bson.M {
+	if !authEnabled {
+		return nil
+	}
+	u := currentUser(r)
+	switch {
+	case u.hasRole("editor"):
+		return nil
+	case u == nil:
+		return bson.M{"visibility": bson.M{"$nin": notPublic}}
+	}
+	return bson.M{"$or": bson.A{bson.M{"visibility": bson.M{"$ne": visibilityPrivate}}, bson.M{"created_by": u.ID}}}
+}
+
+// applyVisibilityFilter adds visibilityFilter to a feature query
+func applyVisibilityFilter(r *http.Request, q bson.M) {
+	f := visibilityFilter(r)
+	if f == nil {
+		return
+	}
+	if v, ok := f["visibility"]; ok && q["visibility"] == nil {
+		q["visibility"] = v
+		return
+	}
+	if or, ok := f["$or"]; ok && q["$or"] == nil {
+		q["$or"] = or
+		return
+	}
+	and, _ := asArray(q["$and"])
+	q["$and"] = append(append(bson.A{}, and...), f)
+}
+
+// visibleFeatureAs is the field visibleFeatureLookup joins into, empty when
+// the caller may not see the feature
+const visibleFeatureAs = "_visible"
+
+// visibleFeatureLookup joins the feature a document names in field, for
+// collections that hold feature ids (work orders, inspections), when it
+// passes visibilityFilter. nil when the caller may see every feature.
+func visibleFeatureLookup(r *http.Request, field string) bson.D {
+	f := visibilityFilter(r)
+	if f == nil {
+		return nil
+	}
+	return bson.D{{Key: "$lookup", Value: bson.M{
+		"from":         collection.Name(),
+		"localField":   field,
+		"foreignField": "_id",
+		"pipeline":     bson.A{bson.M{"$match": f}, bson.M{"$project": bson.M{"_id": 1}}},
+		"as":           visibleFeatureAs,
+	}}}
+}
+
+// visibleFeatureStages keeps the documents whose feature in field the
+// caller may see
+func visibleFeatureStages(r *http.Request, field string) mongo.Pipeline {
+	lookup := visibleFeatureLookup(r, field)
+	if lookup == nil {
+		return nil
+	}
+	return mongo.Pipeline{
+		lookup,
+		{{Key: "$match", Value: bson.M{visibleFeatureAs: bson.M{"$ne": bson.A{}}}}},
+		{{Key: "$project", Value: bson.M{visibleFeatureAs: 0}}},
+	}
+}
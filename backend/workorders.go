@@ -0,0 +1,821 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Work orders are maintenance jobs on features: a status, who does it, when
+// it is due, notes and attachments (photos, reports). Every change rolls
+// the feature's open orders up into its maintenance field, served as the
+// maintenance_* properties, so a layer can be styled by what needs doing.
+// Orders keep the centre of their feature so they can be filtered by area
+// without a join.
+const (
+	workOrderOpen       = "open"
+	workOrderInProgress = "in_progress"
+	workOrderOnHold     = "on_hold"
+	workOrderDone       = "done"
+	workOrderCancelled  = "cancelled"
+)
+
+var workOrderStatuses = []string{workOrderOpen, workOrderInProgress, workOrderOnHold, workOrderDone, workOrderCancelled}
+
+var workOrderPriorities = []string{"low", "normal", "high", "urgent"}
+
+const (
+	maxWorkOrderNotes       = 500
+	maxWorkOrderAttachments = 20
+	defaultWorkOrderLimit   = 100
+	maxWorkOrderLimit       = 1000
+)
+
+// WorkOrder is a maintenance job on a feature
+type WorkOrder struct {
+	ID          primitive.ObjectID    `bson:"_id,omitempty" json:"id"`
+	Feature     primitive.ObjectID    `bson:"feature" json:"feature"`
+	Layer       string                `bson:"layer,omitempty" json:"layer,omitempty"`
+	Location    bson.M                `bson:"location,omitempty" json:"-"`
+	Title       string                `bson:"title" json:"title"`
+	Description string                `bson:"description,omitempty" json:"description,omitempty"`
+	Status      string                `bson:"status" json:"status"`
+	Priority    string                `bson:"priority" json:"priority"`
+	Assignee    string                `bson:"assignee,omitempty" json:"assignee,omitempty"`
+	DueDate     *time.Time            `bson:"due_date,omitempty" json:"due_date,omitempty"`
+	Notes       []WorkOrderNote       `bson:"notes" json:"notes"`
+	Attachments []WorkOrderAttachment `bson:"attachments" json:"attachments"`
+	CreatedBy   string                `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	UpdatedBy   string                `bson:"updated_by,omitempty" json:"updated_by,omitempty"`
+	CreatedAt   time.Time             `bson:"created_at" json:"created_at"`
+	UpdatedAt   time.Time             `bson:"updated_at" json:"updated_at"`
+	ClosedAt    *time.Time            `bson:"closed_at,omitempty" json:"closed_at,omitempty"`
+}
+
+type WorkOrderNote struct {
+	ID   string    `bson:"id" json:"id"`
+	Text string    `bson:"text" json:"text"`
+	By   string    `bson:"by,omitempty" json:"by,omitempty"`
+	At   time.Time `bson:"at" json:"at"`
+}
+
+// WorkOrderAttachment describes a file; its bytes are in
+// work_order_files under the same id
+type WorkOrderAttachment struct {
+	ID          string    `bson:"id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	ContentType string    `bson:"content_type" json:"content_type"`
+	Size        int       `bson:"size" json:"size"`
+	By          string    `bson:"by,omitempty" json:"by,omitempty"`
+	At          time.Time `bson:"at" json:"at"`
+}
+
+// MaintenanceRollup summarizes a feature's work orders
+type MaintenanceRollup struct {
+	// Status is the furthest along of the open orders: in_progress, open
+	// or on_hold; empty when nothing is open
+	Status   string     `bson:"status,omitempty" json:"status,omitempty"`
+	Open     int        `bson:"open" json:"open"`
+	NextDue  *time.Time `bson:"next_due,omitempty" json:"next_due,omitempty"`
+	LastDone *time.Time `bson:"last_done,omitempty" json:"last_done,omitempty"`
+}
+
+var (
+	workOrders            *mongo.Collection
+	workOrderFiles        *mongo.Collection
+	maxWorkOrderFileBytes = 10 << 20
+)
+
+func setupWorkOrders() {
+	workOrders = db.Collection(getenv("MONGO_WORK_ORDERS_COLLECTION", "work_orders"))
+	workOrderFiles = db.Collection(getenv("MONGO_WORK_ORDER_FILES_COLLECTION", "work_order_files"))
+	// documents are capped at 16 MB, leave room for the rest
+	if n, err := strconv.Atoi(getenv("WORK_ORDER_MAX_FILE_BYTES", "")); err == nil && n > 0 && n <= 15<<20 {
+		maxWorkOrderFileBytes = n
+	}
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "feature", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "due_date", Value: 1}}},
+		{Keys: bson.D{{Key: "assignee", Value: 1}, {Key: "status", Value: 1}}},
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+	}
+	if _, err := workOrders.Indexes().CreateMany(ctx, indexes); err != nil {
+		log.Printf("work orders index create warning: %v", err)
+	}
+}
+
+func isClosed(status string) bool {
+	return status == workOrderDone || status == workOrderCancelled
+}
+
+func oneOf(v string, options []string) bool {
+	for _, o := range options {
+		if v == o {
+			return true
+		}
+	}
+	return false
+}
+
+// featureLocation is the point a work order is filed under
+func featureLocation(doc FeatureDoc) bson.M {
+	g, err := parseGeometry(doc.Geometry)
+	if err != nil {
+		return nil
+	}
+	c, ok := geometryCenter(g)
+	if !ok {
+		return nil
+	}
+	return bson.M{"type": "Point", "coordinates": bson.A{c[0], c[1]}}
+}
+
+// rollupWorkOrders recomputes the maintenance field of a feature and moves
+// its orders to where the feature is now
+func rollupWorkOrders(feature primitive.ObjectID) {
+	cur, err := workOrders.Find(ctx, bson.M{"feature": feature}, options.Find().SetProjection(bson.M{"status": 1, "due_date": 1, "closed_at": 1}))
+	if err != nil {
+		log.Printf("work order rollup for %s failed: %v", feature.Hex(), err)
+		return
+	}
+	var orders []WorkOrder
+	if err := cur.All(ctx, &orders); err != nil {
+		log.Printf("work order rollup for %s failed: %v", feature.Hex(), err)
+		return
+	}
+	var m MaintenanceRollup
+	rank := map[string]int{workOrderOnHold: 1, workOrderOpen: 2, workOrderInProgress: 3}
+	for _, o := range orders {
+		if isClosed(o.Status) {
+			if o.Status == workOrderDone && o.ClosedAt != nil && (m.LastDone == nil || o.ClosedAt.After(*m.LastDone)) {
+				m.LastDone = o.ClosedAt
+			}
+			continue
+		}
+		m.Open++
+		if rank[o.Status] > rank[m.Status] {
+			m.Status = o.Status
+		}
+		if o.DueDate != nil && (m.NextDue == nil || o.DueDate.Before(*m.NextDue)) {
+			m.NextDue = o.DueDate
+		}
+	}
+	update := bson.M{"$set": bson.M{"maintenance": m}}
+	if len(orders) == 0 {
+		update = bson.M{"$unset": bson.M{"maintenance": ""}}
+	}
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": feature}, update); err != nil {
+		log.Printf("work order rollup for %s failed: %v", feature.Hex(), err)
+	}
+	var doc FeatureDoc
+	if err := collection.FindOne(ctx, bson.M{"_id": feature}, options.FindOne().SetProjection(bson.M{"geometry": 1, "layer": 1})).Decode(&doc); err == nil {
+		if loc := featureLocation(doc); loc != nil {
+			workOrders.UpdateMany(ctx, bson.M{"feature": feature}, bson.M{"$set": bson.M{"location": loc, "layer": doc.Layer}})
+		}
+	}
+}
+
+// maintenanceProperties adds the rollup to the GeoJSON properties
+func maintenanceProperties(doc FeatureDoc, props bson.M) {
+	m := doc.Maintenance
+	if m == nil {
+		return
+	}
+	props["maintenance_open"] = m.Open
+	if m.Status != "" {
+		props["maintenance_status"] = m.Status
+	}
+	if m.NextDue != nil {
+		props["maintenance_next_due"] = m.NextDue
+		props["maintenance_overdue"] = m.NextDue.Before(time.Now())
+	}
+	if m.LastDone != nil {
+		props["maintenance_last_done"] = m.LastDone
+	}
+}
+
+// workOrderInput is the body of POST and PATCH /work-orders; fields left
+// out of a PATCH are kept
+type workOrderInput struct {
+	Feature     string  `json:"feature"`
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+	Priority    *string `json:"priority"`
+	Assignee    *string `json:"assignee"`
+	// DueDate is RFC 3339 or YYYY-MM-DD; "" clears it
+	DueDate *string `json:"due_date"`
+}
+
+// apply validates in and copies it onto o
+func (in workOrderInput) apply(o *WorkOrder, now time.Time) []FieldError {
+	var errs []FieldError
+	if in.Title != nil {
+		o.Title = strings.TrimSpace(*in.Title)
+	}
+	if o.Title == "" || len([]rune(o.Title)) > 200 {
+		errs = append(errs, FieldError{Field: "title", Message: "required, up to 200 characters"})
+	}
+	if in.Description != nil {
+		o.Description = strings.TrimSpace(*in.Description)
+	}
+	if in.Status != nil {
+		if !oneOf(*in.Status, workOrderStatuses) {
+			errs = append(errs, FieldError{Field: "status", Message: "must be one of " + strings.Join(workOrderStatuses, ", ")})
+		} else if *in.Status != o.Status {
+			o.Status = *in.Status
+			o.ClosedAt = nil
+			if isClosed(o.Status) {
+				o.ClosedAt = &now
+			}
+		}
+	}
+	if in.Priority != nil {
+		if !oneOf(*in.Priority, workOrderPriorities) {
+			errs = append(errs, FieldError{Field: "priority", Message: "must be one of " + strings.Join(workOrderPriorities, ", ")})
+		} else {
+			o.Priority = *in.Priority
+		}
+	}
+	if in.Assignee != nil {
+		o.Assignee = strings.TrimSpace(*in.Assignee)
+	}
+	if in.DueDate != nil {
+		switch s := strings.TrimSpace(*in.DueDate); {
+		case s == "":
+			o.DueDate = nil
+		default:
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				t, err = time.Parse("2006-01-02", s)
+			}
+			if err != nil {
+				errs = append(errs, FieldError{Field: "due_date", Message: "expected RFC 3339 or YYYY-MM-DD"})
+			} else {
+				t = t.UTC()
+				o.DueDate = &t
+			}
+		}
+	}
+	return errs
+}
+
+func notifyWorkOrder(o WorkOrder, typ, subject, message string) {
+	notify(Event{
+		Type:    typ,
+		Subject: subject,
+		Message: message,
+		Data:    map[string]interface{}{"id": o.ID.Hex(), "feature": o.Feature.Hex(), "status": o.Status, "assignee": o.Assignee},
+	})
+}
+
+// workOrderVisibility is the pipeline stages keeping the work orders the
+// caller may see: those of features visible to them, in layers published
+// to them, and the orders assigned to them. nil when they see every order.
+func workOrderVisibility(r *http.Request) (mongo.Pipeline, error) {
+	lookup := visibleFeatureLookup(r, "feature")
+	hidden, err := hiddenLayers(r)
+	if err != nil || lookup == nil && len(hidden) == 0 {
+		return nil, err
+	}
+	var stages mongo.Pipeline
+	visible := bson.M{}
+	if lookup != nil {
+		stages = append(stages, lookup)
+		visible[visibleFeatureAs] = bson.M{"$ne": bson.A{}}
+	}
+	if len(hidden) > 0 {
+		visible["layer"] = bson.M{"$nin": hidden}
+	}
+	match := visible
+	if uid := userID(r); uid != "" {
+		match = bson.M{"$or": bson.A{visible, bson.M{"assignee": uid}}}
+	}
+	stages = append(stages, bson.D{{Key: "$match", Value: match}})
+	if lookup != nil {
+		stages = append(stages, bson.D{{Key: "$project", Value: bson.M{visibleFeatureAs: 0}}})
+	}
+	return stages, nil
+}
+
+// findWorkOrders runs q through workOrderVisibility, sorted, skipping and
+// limiting after the orders the caller can't see are left out
+func findWorkOrders(r *http.Request, q bson.M, order bson.D, offset, limit int64) ([]WorkOrder, error) {
+	stages, err := workOrderVisibility(r)
+	if err != nil {
+		return nil, err
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: q}}}
+	if len(order) > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$sort", Value: order}})
+	}
+	pipeline = append(pipeline, stages...)
+	if offset > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$skip", Value: offset}})
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	cur, err := workOrders.Aggregate(r.Context(), pipeline)
+	if err != nil {
+		return nil, err
+	}
+	out := []WorkOrder{}
+	err = cur.All(r.Context(), &out)
+	return out, err
+}
+
+// loadWorkOrder reads {id}, writing 404 when there is none or the caller
+// may not see it
+func loadWorkOrder(w http.ResponseWriter, r *http.Request) (WorkOrder, bool) {
+	var o WorkOrder
+	oid, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_id", "invalid id")
+		return o, false
+	}
+	found, err := findWorkOrders(r, bson.M{"_id": oid}, nil, 0, 1)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return o, false
+	}
+	if len(found) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "work order not found")
+		return o, false
+	}
+	return found[0], true
+}
+
+// canWorkOn is whether the caller may add notes, attachments and status
+// changes: editors of the feature's layer and the assignee
+func canWorkOn(w http.ResponseWriter, r *http.Request, o WorkOrder) bool {
+	if uid := userID(r); authEnabled && uid != "" && uid == o.Assignee {
+		return true
+	}
+	return requireLayerRole(w, r, o.Layer, "editor")
+}
+
+func writeWorkOrder(w http.ResponseWriter, status int, o WorkOrder) {
+	if o.Notes == nil {
+		o.Notes = []WorkOrderNote{}
+	}
+	if o.Attachments == nil {
+		o.Attachments = []WorkOrderAttachment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(o)
+}
+
+// GET /work-orders?status=open,in_progress&assignee=|me&feature=&layer=
+// &bbox=&admin=&overdue=true&sort=created|due|updated&limit=&offset=
+// Lists the orders the caller may see, see workOrderVisibility.
+func listWorkOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	query := r.URL.Query()
+	q := bson.M{}
+	if s := query.Get("status"); s != "" {
+		statuses := strings.Split(s, ",")
+		for _, st := range statuses {
+			if !oneOf(st, workOrderStatuses) {
+				writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid status", FieldError{Field: "status", Message: "must be a list of " + strings.Join(workOrderStatuses, ", ")})
+				return
+			}
+		}
+		q["status"] = bson.M{"$in": statuses}
+	}
+	if a := query.Get("assignee"); a == "me" {
+		q["assignee"] = userID(r)
+	} else if a != "" {
+		q["assignee"] = a
+	}
+	if f := query.Get("feature"); f != "" {
+		oid, err := primitive.ObjectIDFromHex(f)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid feature", FieldError{Field: "feature", Message: "must be a feature id"})
+			return
+		}
+		q["feature"] = oid
+	}
+	if l := query.Get("layer"); l != "" {
+		q["layer"] = l
+	}
+	if bbox := query.Get("bbox"); bbox != "" {
+		minLon, minLat, maxLon, maxLat, ok := parseBBox(bbox)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid bbox", FieldError{Field: "bbox", Message: "expected minLon,minLat,maxLon,maxLat"})
+			return
+		}
+		q["location"] = bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+			"type": "Polygon",
+			"coordinates": bson.A{bson.A{
+				bson.A{minLon, minLat}, bson.A{maxLon, minLat}, bson.A{maxLon, maxLat}, bson.A{minLon, maxLat}, bson.A{minLon, minLat},
+			}},
+		}}}
+	} else if code := query.Get("admin"); code != "" {
+		area, err := adminAreaFilter(code)
+		if err != nil {
+			writeAdminAreaError(w, code, err)
+			return
+		}
+		q["location"] = area["geometry"]
+	}
+	if query.Get("overdue") == "true" {
+		q["due_date"] = bson.M{"$lt": time.Now().UTC()}
+		if q["status"] == nil {
+			q["status"] = bson.M{"$nin": bson.A{workOrderDone, workOrderCancelled}}
+		}
+	}
+	var order bson.D
+	switch query.Get("sort") {
+	case "", "created":
+		order = bson.D{{Key: "created_at", Value: -1}}
+	case "due":
+		// soonest first, only the orders that have a due date
+		order = bson.D{{Key: "due_date", Value: 1}, {Key: "created_at", Value: 1}}
+		if q["due_date"] == nil {
+			q["due_date"] = bson.M{"$ne": nil}
+		}
+	case "updated":
+		order = bson.D{{Key: "updated_at", Value: -1}}
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "invalid sort", FieldError{Field: "sort", Message: "must be created, due or updated"})
+		return
+	}
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultWorkOrderLimit
+	}
+	limit = min(limit, maxWorkOrderLimit)
+	out, err := findWorkOrders(r, q, order, offset, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	for i := range out {
+		if out[i].Notes == nil {
+			out[i].Notes = []WorkOrderNote{}
+		}
+		if out[i].Attachments == nil {
+			out[i].Attachments = []WorkOrderAttachment{}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// GET /features/{id}/work-orders is the same list for one feature
+func featureWorkOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	q.Set("feature", mux.Vars(r)["id"])
+	r.URL.RawQuery = q.Encode()
+	listWorkOrdersHandler(w, r)
+}
+
+// GET /work-orders/{id}
+func getWorkOrderHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	o, ok := loadWorkOrder(w, r)
+	if !ok {
+		return
+	}
+	writeWorkOrder(w, http.StatusOK, o)
+}
+
+// POST /work-orders { feature, title, description, status, priority,
+// assignee, due_date }
+func createWorkOrderHandler(w http.ResponseWriter, r *http.Request) {
+	var in workOrderInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	fid, err := primitive.ObjectIDFromHex(in.Feature)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid feature", FieldError{Field: "feature", Message: "must be a feature id"})
+		return
+	}
+	if !requireFeatureRole(w, r, fid, "editor") {
+		return
+	}
+	var doc FeatureDoc
+	err = collection.FindOne(r.Context(), bson.M{"_id": fid}, options.FindOne().SetProjection(bson.M{"geometry": 1, "layer": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		writeError(w, http.StatusNotFound, "not_found", "feature not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	now := time.Now().UTC()
+	o := WorkOrder{
+		ID:          primitive.NewObjectID(),
+		Feature:     fid,
+		Layer:       doc.Layer,
+		Location:    featureLocation(doc),
+		Status:      workOrderOpen,
+		Priority:    "normal",
+		Notes:       []WorkOrderNote{},
+		Attachments: []WorkOrderAttachment{},
+		CreatedBy:   userID(r),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if errs := in.apply(&o, now); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid work order", errs...)
+		return
+	}
+	if _, err := workOrders.InsertOne(r.Context(), o); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	rollupWorkOrders(fid)
+	if o.Assignee != "" {
+		notifyWorkOrder(o, eventWorkOrderAssigned, "Work order assigned: "+o.Title, "Work order "+o.ID.Hex()+" on feature "+fid.Hex()+" was assigned to "+o.Assignee+".")
+	}
+	w.Header().Set("Location", "/work-orders/"+o.ID.Hex())
+	writeWorkOrder(w, http.StatusCreated, o)
+}
+
+// PATCH /work-orders/{id} updates the fields given. The assignee may only
+// change the status.
+func updateWorkOrderHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadWorkOrder(w, r)
+	if !ok {
+		return
+	}
+	var in workOrderInput
+	if !decodeJSON(w, r, &in) {
+		return
+	}
+	if in.Feature != "" && in.Feature != o.Feature.Hex() {
+		writeError(w, http.StatusBadRequest, "validation_failed", "work orders cannot move to another feature", FieldError{Field: "feature", Message: "read-only"})
+		return
+	}
+	statusOnly := in.Title == nil && in.Description == nil && in.Priority == nil && in.Assignee == nil && in.DueDate == nil
+	if statusOnly && !canWorkOn(w, r, o) || !statusOnly && !requireLayerRole(w, r, o.Layer, "editor") {
+		return
+	}
+	prev := o
+	now := time.Now().UTC()
+	if errs := in.apply(&o, now); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid work order", errs...)
+		return
+	}
+	o.UpdatedAt = now
+	o.UpdatedBy = userID(r)
+	set := bson.M{
+		"title": o.Title, "description": o.Description, "status": o.Status, "priority": o.Priority,
+		"assignee": o.Assignee, "due_date": o.DueDate, "closed_at": o.ClosedAt,
+		"updated_at": o.UpdatedAt, "updated_by": o.UpdatedBy,
+	}
+	// compare-and-set on updated_at so concurrent edits don't undo each other
+	res, err := workOrders.UpdateOne(r.Context(), bson.M{"_id": o.ID, "updated_at": prev.UpdatedAt}, bson.M{"$set": set})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusConflict, "conflict", "work order was changed concurrently, retry")
+		return
+	}
+	rollupWorkOrders(o.Feature)
+	if o.Assignee != "" && o.Assignee != prev.Assignee {
+		notifyWorkOrder(o, eventWorkOrderAssigned, "Work order assigned: "+o.Title, "Work order "+o.ID.Hex()+" on feature "+o.Feature.Hex()+" was assigned to "+o.Assignee+".")
+	}
+	if o.Status != prev.Status {
+		notifyWorkOrder(o, eventWorkOrderStatus, "Work order "+strings.ReplaceAll(o.Status, "_", " ")+": "+o.Title, "Work order "+o.ID.Hex()+" went from "+prev.Status+" to "+o.Status+".")
+	}
+	writeWorkOrder(w, http.StatusOK, o)
+}
+
+// DELETE /work-orders/{id}
+func deleteWorkOrderHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadWorkOrder(w, r)
+	if !ok {
+		return
+	}
+	if !requireLayerRole(w, r, o.Layer, "editor") {
+		return
+	}
+	if _, err := workOrders.DeleteOne(r.Context(), bson.M{"_id": o.ID}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db delete error: "+err.Error())
+		return
+	}
+	if _, err := workOrderFiles.DeleteMany(r.Context(), bson.M{"work_order": o.ID}); err != nil {
+		log.Printf("work order %s attachments delete warning: %v", o.ID.Hex(), err)
+	}
+	rollupWorkOrders(o.Feature)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// POST /work-orders/{id}/notes { text }
+func addWorkOrderNoteHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadWorkOrder(w, r)
+	if !ok || !canWorkOn(w, r, o) {
+		return
+	}
+	var body struct {
+		Text string `json:"text"`
+	}
+	if !decodeJSON(w, r, &body) {
+		return
+	}
+	body.Text = strings.TrimSpace(body.Text)
+	if body.Text == "" || len([]rune(body.Text)) > 5000 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid note", FieldError{Field: "text", Message: "required, up to 5000 characters"})
+		return
+	}
+	now := time.Now().UTC()
+	n := WorkOrderNote{ID: primitive.NewObjectID().Hex(), Text: body.Text, By: userID(r), At: now}
+	res, err := workOrders.UpdateOne(r.Context(),
+		bson.M{"_id": o.ID, "notes." + strconv.Itoa(maxWorkOrderNotes-1): bson.M{"$exists": false}},
+		bson.M{"$push": bson.M{"notes": n}, "$set": bson.M{"updated_at": now, "updated_by": n.By}})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if res.MatchedCount == 0 {
+		writeError(w, http.StatusConflict, "too_many_notes", fmt.Sprintf("work orders hold at most %d notes", maxWorkOrderNotes))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(n)
+}
+
+// POST /work-orders/{id}/attachments?name=photo.jpg with the file as the
+// body
+func addWorkOrderAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadWorkOrder(w, r)
+	if !ok || !canWorkOn(w, r, o) {
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" || len(name) > 200 || strings.ContainsAny(name, "/\\\"\r\n") {
+		writeError(w, http.StatusBadRequest, "validation_failed", "invalid name", FieldError{Field: "name", Message: "a file name, up to 200 characters"})
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(maxWorkOrderFileBytes)+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "read error: "+err.Error())
+		return
+	}
+	if len(data) == 0 {
+		writeError(w, http.StatusBadRequest, "validation_failed", "file body required")
+		return
+	}
+	if len(data) > maxWorkOrderFileBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("attachments are limited to %d MB", maxWorkOrderFileBytes>>20))
+		return
+	}
+	now := time.Now().UTC()
+	a := WorkOrderAttachment{
+		ID:          primitive.NewObjectID().Hex(),
+		Name:        name,
+		ContentType: http.DetectContentType(data),
+		Size:        len(data),
+		By:          userID(r),
+		At:          now,
+	}
+	if _, err := workOrderFiles.InsertOne(r.Context(), bson.M{"_id": a.ID, "work_order": o.ID, "data": data}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db insert error: "+err.Error())
+		return
+	}
+	res, err := workOrders.UpdateOne(r.Context(),
+		bson.M{"_id": o.ID, "attachments." + strconv.Itoa(maxWorkOrderAttachments-1): bson.M{"$exists": false}},
+		bson.M{"$push": bson.M{"attachments": a}, "$set": bson.M{"updated_at": now, "updated_by": a.By}})
+	if err != nil || res.MatchedCount == 0 {
+		workOrderFiles.DeleteOne(r.Context(), bson.M{"_id": a.ID})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		} else {
+			writeError(w, http.StatusConflict, "too_many_attachments", fmt.Sprintf("work orders hold at most %d attachments", maxWorkOrderAttachments))
+		}
+		return
+	}
+	w.Header().Set("Location", "/work-orders/"+o.ID.Hex()+"/attachments/"+a.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func findAttachment(w http.ResponseWriter, o WorkOrder, id string) (WorkOrderAttachment, bool) {
+	for _, a := range o.Attachments {
+		if a.ID == id {
+			return a, true
+		}
+	}
+	writeError(w, http.StatusNotFound, "not_found", "attachment not found")
+	return WorkOrderAttachment{}, false
+}
+
+// GET /work-orders/{id}/attachments/{aid}
+func getWorkOrderAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "viewer") {
+		return
+	}
+	o, ok := loadWorkOrder(w, r)
+	if !ok {
+		return
+	}
+	a, ok := findAttachment(w, o, mux.Vars(r)["aid"])
+	if !ok {
+		return
+	}
+	var file struct {
+		Data []byte `bson:"data"`
+	}
+	if err := workOrderFiles.FindOne(r.Context(), bson.M{"_id": a.ID}).Decode(&file); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db find error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.Data)))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+a.Name+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(file.Data)
+}
+
+// DELETE /work-orders/{id}/attachments/{aid}
+func deleteWorkOrderAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	o, ok := loadWorkOrder(w, r)
+	if !ok || !canWorkOn(w, r, o) {
+		return
+	}
+	a, ok := findAttachment(w, o, mux.Vars(r)["aid"])
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := workOrders.UpdateOne(r.Context(), bson.M{"_id": o.ID},
+		bson.M{"$pull": bson.M{"attachments": bson.M{"id": a.ID}}, "$set": bson.M{"updated_at": now, "updated_by": userID(r)}}); err != nil {
+		writeError(w, http.StatusInternalServerError, "db_error", "db update error: "+err.Error())
+		return
+	}
+	if _, err := workOrderFiles.DeleteOne(r.Context(), bson.M{"_id": a.ID}); err != nil {
+		log.Printf("work order attachment %s delete warning: %v", a.ID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelWorkOrdersOf closes the open orders of deleted features; the
+// orders stay as their maintenance history
+func cancelWorkOrdersOf(features ...primitive.ObjectID) {
+	now := time.Now().UTC()
+	_, err := workOrders.UpdateMany(ctx,
+		bson.M{"feature": bson.M{"$in": features}, "status": bson.M{"$nin": bson.A{workOrderDone, workOrderCancelled}}},
+		bson.M{"$set": bson.M{"status": workOrderCancelled, "closed_at": now, "updated_at": now}})
+	if err != nil {
+		log.Printf("work order cancel warning for %d features: %v", len(features), err)
+	}
+}
+
+// deleteWorkOrderAttachmentsBy is the subject purge of the files a user
+// attached to work orders
+func deleteWorkOrderAttachmentsBy(s subject, q bson.M) (int64, error) {
+	cur, err := workOrders.Find(ctx, q, options.Find().SetProjection(bson.M{"attachments": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var found []WorkOrder
+	if err := cur.All(ctx, &found); err != nil {
+		return 0, err
+	}
+	var ids []string
+	for _, o := range found {
+		for _, a := range o.Attachments {
+			if a.By == s.id {
+				ids = append(ids, a.ID)
+			}
+		}
+	}
+	if len(ids) > 0 {
+		if _, err := workOrderFiles.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return 0, err
+		}
+	}
+	res, err := workOrders.UpdateMany(ctx, q, bson.M{"$pull": bson.M{"attachments": bson.M{"by": s.id}}})
+	if err != nil {
+		return 0, err
+	}
+	return res.ModifiedCount, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var errPoolBusy = errors.New("geometry worker queue is full")
+
+type poolJob struct {
+	ctx      context.Context
+	fn       func()
+	done     chan struct{}
+	enqueued time.Time
+	// err is the job's panic, set before done is closed
+	err error
+}
+
+// workPool runs CPU-heavy geometry work (clipping, validation, analysis) on a
+// fixed number of goroutines so bursts of it can't take every core from
+// plain CRUD requests. Jobs beyond the queue capacity are refused.
+type workPool struct {
+	jobs chan *poolJob
+	size int
+
+	queued    atomic.Int64
+	running   atomic.Int64
+	completed atomic.Int64
+	rejected  atomic.Int64
+	canceled  atomic.Int64
+	panicked  atomic.Int64
+	waitNanos atomic.Int64
+}
+
+var geomPool *workPool
+
+func newWorkPool(size, queue int) *workPool {
+	p := &workPool{jobs: make(chan *poolJob, queue), size: size}
+	for i := 0; i < size; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *workPool) worker() {
+	for job := range p.jobs {
+		p.queued.Add(-1)
+		p.waitNanos.Add(int64(time.Since(job.enqueued)))
+		if job.ctx.Err() != nil {
+			// the caller gave up while queued
+			p.canceled.Add(1)
+			close(job.done)
+			continue
+		}
+		p.running.Add(1)
+		job.err = p.exec(job.fn)
+		p.running.Add(-1)
+		p.completed.Add(1)
+		close(job.done)
+	}
+}
+
+// exec runs fn, keeping a panicking job from taking the worker, and the
+// server with it, down
+func (p *workPool) exec(fn func()) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			p.panicked.Add(1)
+			log.Printf("geometry job panic: %v\n%s", v, debug.Stack())
+			err = fmt.Errorf("geometry job failed: %v", v)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// run executes fn on the pool and waits for it. It returns errPoolBusy when
+// the queue is full, the panic as an error when fn panics, or the context
+// error if ctx ends first (fn may then still run, so it must not write to
+// the response itself).
+func (p *workPool) run(ctx context.Context, fn func()) error {
+	job := &poolJob{ctx: ctx, fn: fn, done: make(chan struct{}), enqueued: time.Now()}
+	p.queued.Add(1)
+	select {
+	case p.jobs <- job:
+	default:
+		p.queued.Add(-1)
+		p.rejected.Add(1)
+		return errPoolBusy
+	}
+	select {
+	case <-job.done:
+		return job.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *workPool) stats() map[string]interface{} {
+	return map[string]interface{}{
+		"size":          p.size,
+		"capacity":      cap(p.jobs),
+		"queued":        p.queued.Load(),
+		"running":       p.running.Load(),
+		"completed":     p.completed.Load(),
+		"rejected":      p.rejected.Load(),
+		"canceled":      p.canceled.Load(),
+		"panicked":      p.panicked.Load(),
+		"wait_ms_total": p.waitNanos.Load() / int64(time.Millisecond),
+	}
+}
+
+// GEOMETRY_WORKERS defaults to the number of CPUs, GEOMETRY_QUEUE to 64 jobs
+// per worker
+func setupWorkerPool() {
+	size := runtime.NumCPU()
+	if n, err := strconv.Atoi(getenv("GEOMETRY_WORKERS", "")); err == nil && n > 0 {
+		size = n
+	}
+	queue := size * 64
+	if n, err := strconv.Atoi(getenv("GEOMETRY_QUEUE", "")); err == nil && n > 0 {
+		queue = n
+	}
+	geomPool = newWorkPool(size, queue)
+	expvar.Publish("geometry_pool", expvar.Func(func() interface{} { return geomPool.stats() }))
+}
+
+// runGeometry runs fn on the geometry pool for a request, writing 503 and
+// returning false when the pool is saturated or the client went away, 500
+// when fn panicked
+func runGeometry(w http.ResponseWriter, r *http.Request, fn func()) bool {
+	err := geomPool.run(r.Context(), fn)
+	if err == nil {
+		return true
+	}
+	if err == errPoolBusy {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusServiceUnavailable, "server_busy", "server is busy with geometry work, retry shortly")
+		return false
+	}
+	if r.Context().Err() == nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return false
+	}
+	writeError(w, http.StatusServiceUnavailable, "request_canceled", "request canceled: "+err.Error())
+	return false
+}
+
+// GET /admin/metrics exposes expvar counters, including the geometry pool
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireRole(w, r, "admin") {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
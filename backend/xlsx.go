@@ -0,0 +1,275 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A streaming writer for Office Open XML workbooks: sheets are written
+// row by row straight into the zip, with inline strings so nothing has to
+// be held for a shared string table, and the workbook parts that list the
+// sheets go in last.
+
+const (
+	xlsxMaxRows = 1048576
+	xlsxMaxCell = 32767
+)
+
+// cell styles, the order of cellXfs in xlsxStyles
+const (
+	xlsxStyleNone = iota
+	xlsxStyleHeader
+	xlsxStyleDateTime
+	xlsxStyleDate
+)
+
+// xlsxDate is a cell value shown as a date without a time
+type xlsxDate time.Time
+
+type xlsxWriter struct {
+	zw     *zip.Writer
+	loc    *time.Location
+	sheets []string
+	open   *xlsxSheet
+}
+
+type xlsxSheet struct {
+	x    *xlsxWriter
+	out  io.Writer
+	cols int
+	rows int
+}
+
+func newXLSX(w io.Writer, loc *time.Location) *xlsxWriter {
+	return &xlsxWriter{zw: zip.NewWriter(w), loc: loc}
+}
+
+// xlsxSheetName makes name valid for a sheet tab: at most 31 characters,
+// none of []:*?/\ and unique among taken, ignoring case
+func xlsxSheetName(name string, taken []string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, strings.Trim(strings.TrimSpace(name), "'"))
+	if name == "" {
+		name = "Sheet"
+	}
+	base := name
+	for n := 2; ; n++ {
+		if utf8.RuneCountInString(name) > 31 {
+			r := []rune(name)
+			name = string(r[:31])
+		}
+		clash := false
+		for _, t := range taken {
+			clash = clash || strings.EqualFold(t, name)
+		}
+		if !clash {
+			return name
+		}
+		suffix := fmt.Sprintf(" (%d)", n)
+		r := []rune(base)
+		if len(r)+len(suffix) > 31 {
+			r = r[:31-len(suffix)]
+		}
+		name = string(r) + suffix
+	}
+}
+
+func xlsxColumn(i int) string {
+	s := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		s = string(rune('A'+(i-1)%26)) + s
+	}
+	return s
+}
+
+// sheet starts a new sheet with a bold header row frozen above the data.
+// widths are in characters, one per header column.
+func (x *xlsxWriter) sheet(name string, header []string, widths []float64) (*xlsxSheet, error) {
+	if x.open != nil {
+		x.open.close()
+	}
+	name = xlsxSheetName(name, x.sheets)
+	x.sheets = append(x.sheets, name)
+	out, err := x.zw.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(x.sheets)))
+	if err != nil {
+		return nil, err
+	}
+	s := &xlsxSheet{x: x, out: out, cols: len(header)}
+	io.WriteString(out, xml.Header)
+	io.WriteString(out, `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	io.WriteString(out, `<sheetViews><sheetView workbookViewId="0"`)
+	if len(x.sheets) == 1 {
+		io.WriteString(out, ` tabSelected="1"`)
+	}
+	io.WriteString(out, `><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	if len(widths) > 0 {
+		io.WriteString(out, "<cols>")
+		for i, wd := range widths {
+			fmt.Fprintf(out, `<col min="%d" max="%d" width="%s" customWidth="1"/>`, i+1, i+1, strconv.FormatFloat(wd, 'f', -1, 64))
+		}
+		io.WriteString(out, "</cols>")
+	}
+	io.WriteString(out, "<sheetData>")
+	cells := make([]interface{}, len(header))
+	for i, h := range header {
+		cells[i] = h
+	}
+	s.write(cells, xlsxStyleHeader)
+	x.open = s
+	return s, nil
+}
+
+// row writes one data row. Values are typed by their Go type: numbers,
+// bools, time.Time as a date and time, xlsxDate as a date, anything else
+// as text; nil leaves the cell empty. Callers stop at xlsxMaxRows.
+func (s *xlsxSheet) row(cells ...interface{}) {
+	s.write(cells, xlsxStyleNone)
+}
+
+func (s *xlsxSheet) write(cells []interface{}, style int) {
+	s.rows++
+	fmt.Fprintf(s.out, `<row r="%d">`, s.rows)
+	for i, v := range cells {
+		ref := xlsxColumn(i) + strconv.Itoa(s.rows)
+		st := ""
+		if style != xlsxStyleNone {
+			st = fmt.Sprintf(` s="%d"`, style)
+		}
+		switch t := v.(type) {
+		case nil:
+			continue
+		case bool:
+			b := 0
+			if t {
+				b = 1
+			}
+			fmt.Fprintf(s.out, `<c r="%s"%s t="b"><v>%d</v></c>`, ref, st, b)
+		case int:
+			fmt.Fprintf(s.out, `<c r="%s"%s><v>%d</v></c>`, ref, st, t)
+		case int32:
+			fmt.Fprintf(s.out, `<c r="%s"%s><v>%d</v></c>`, ref, st, t)
+		case int64:
+			fmt.Fprintf(s.out, `<c r="%s"%s><v>%d</v></c>`, ref, st, t)
+		case float64:
+			if math.IsNaN(t) || math.IsInf(t, 0) {
+				continue
+			}
+			fmt.Fprintf(s.out, `<c r="%s"%s><v>%s</v></c>`, ref, st, strconv.FormatFloat(t, 'g', -1, 64))
+		case time.Time:
+			if t.IsZero() {
+				continue
+			}
+			fmt.Fprintf(s.out, `<c r="%s" s="%d"><v>%s</v></c>`, ref, xlsxStyleDateTime, s.x.serial(t))
+		case xlsxDate:
+			// a calendar date, so not moved into the time zone
+			d := time.Time(t)
+			days := time.Date(d.Year(), d.Month(), d.Day(), 0, 0, 0, 0, time.UTC).Unix()/86400 + 25569
+			fmt.Fprintf(s.out, `<c r="%s" s="%d"><v>%d</v></c>`, ref, xlsxStyleDate, days)
+		default:
+			text := fmt.Sprint(t)
+			if str, ok := t.(string); ok {
+				text = str
+			}
+			if text == "" {
+				continue
+			}
+			if len(text) > xlsxMaxCell {
+				text = strings.ToValidUTF8(text[:xlsxMaxCell], "")
+			}
+			fmt.Fprintf(s.out, `<c r="%s"%s t="inlineStr"><is><t xml:space="preserve">`, ref, st)
+			xml.EscapeText(s.out, []byte(text))
+			io.WriteString(s.out, "</t></is></c>")
+		}
+	}
+	io.WriteString(s.out, "</row>")
+}
+
+// serial is t as an Excel day number in the writer's time zone. Excel has
+// no zones, so the wall clock is what is stored.
+func (x *xlsxWriter) serial(t time.Time) string {
+	wall := t.In(x.loc)
+	_, offset := wall.Zone()
+	days := float64(wall.Unix()+int64(offset))/86400 + float64(wall.Nanosecond())/86400e9 + 25569
+	return strconv.FormatFloat(days, 'f', -1, 64)
+}
+
+func (s *xlsxSheet) close() {
+	io.WriteString(s.out, "</sheetData>")
+	if s.cols > 0 && s.rows > 1 {
+		fmt.Fprintf(s.out, `<autoFilter ref="A1:%s%d"/>`, xlsxColumn(s.cols-1), s.rows)
+	}
+	io.WriteString(s.out, "</worksheet>")
+	s.x.open = nil
+}
+
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="yyyy-mm-dd"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="3"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill>` +
+	`<fill><patternFill patternType="solid"><fgColor rgb="FFE7ECF1"/><bgColor indexed="64"/></patternFill></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="4"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="2" borderId="0" xfId="0" applyFont="1" applyFill="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>` +
+	`<cellStyles count="1"><cellStyle name="Normal" xfId="0" builtinId="0"/></cellStyles></styleSheet>`
+
+// close writes the workbook parts and finishes the zip
+func (x *xlsxWriter) close() error {
+	if x.open != nil {
+		x.open.close()
+	}
+	if len(x.sheets) == 0 {
+		// a workbook needs at least one sheet
+		if _, err := x.sheet("Sheet1", nil, nil); err != nil {
+			return err
+		}
+		x.open.close()
+	}
+	var book, rels, types strings.Builder
+	book.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	rels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">`)
+	types.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	for i, name := range x.sheets {
+		book.WriteString(`<sheet name="`)
+		xml.EscapeText(&book, []byte(name))
+		fmt.Fprintf(&book, `" sheetId="%d" r:id="rId%d"/>`, i+1, i+1)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+	}
+	book.WriteString("</sheets></workbook>")
+	fmt.Fprintf(&rels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/></Relationships>`, len(x.sheets)+1)
+	types.WriteString("</Types>")
+
+	parts := [][2]string{
+		{"xl/workbook.xml", book.String()},
+		{"xl/_rels/workbook.xml.rels", rels.String()},
+		{"xl/styles.xml", xlsxStyles},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+		{"[Content_Types].xml", types.String()},
+	}
+	for _, p := range parts {
+		f, err := x.zw.Create(p[0])
+		if err != nil {
+			return err
+		}
+		io.WriteString(f, p[1])
+	}
+	return x.zw.Close()
+}
@@ -110,6 +110,17 @@ function showSpinner(on = true) {
   s.style.display = on ? "flex" : "none";
 }
 
+// read the message out of the backend's {"error": {code, message}} body,
+// falling back to the raw text
+async function errorText(res) {
+  const txt = await res.text().catch(() => "");
+  try {
+    const obj = JSON.parse(txt);
+    if (obj && obj.error && obj.error.message) return obj.error.message;
+  } catch (e) {}
+  return txt;
+}
+
 function escapeHtml(s) {
   if (!s) return "";
   return String(s).replace(/[&<>"']/g, (m) => ({ "&":"&amp;","<":"&lt;",">":"&gt;","\"":"&quot;","'":"&#39;" }[m]));
@@ -122,7 +133,7 @@ async function fetchFeaturesBBox() {
   try {
     const res = await fetch(`${API_BASE}/features?bbox=${encodeURIComponent(bbox)}`, { cache: "no-store" });
     if (!res.ok) {
-      const txt = await res.text().catch(() => "");
+      const txt = await errorText(res);
       throw new Error(`HTTP ${res.status} ${res.statusText}${txt ? ': ' + txt : ''}`);
     }
     const json = await res.json().catch(() => null);
@@ -197,7 +208,7 @@ map.on(L.Draw.Event.CREATED, async (e) => {
       body: JSON.stringify({ name: out.name, description: out.description, geojson: geo })
     });
     if (!r.ok) {
-      const txt = await r.text().catch(() => "");
+      const txt = await errorText(r);
       throw new Error(`HTTP ${r.status} ${r.statusText}${txt ? ': ' + txt : ''}`);
     }
     const j = await r.json().catch(() => null);
@@ -232,7 +243,7 @@ map.on(L.Draw.Event.EDITED, async (e) => {
         body: JSON.stringify({ geojson: u.geo })
       });
       if (!res.ok) {
-        const txt = await res.text().catch(() => "");
+        const txt = await errorText(res);
         throw new Error(`HTTP ${res.status} ${res.statusText}${txt ? ': ' + txt : ''}`);
       }
     }
@@ -260,7 +271,7 @@ map.on(L.Draw.Event.DELETED, async (e) => {
     for (const id of dels) {
       const r = await fetch(`${API_BASE}/features/${id}`, { method: "DELETE" });
       if (!r.ok) {
-        const txt = await r.text().catch(() => "");
+        const txt = await errorText(r);
         throw new Error(`HTTP ${r.status} ${r.statusText}${txt ? ': ' + txt : ''}`);
       }
     }
@@ -280,7 +291,7 @@ async function deleteFeature(id) {
     showSpinner(true);
     const r = await fetch(`${API_BASE}/features/${id}`, { method: "DELETE" });
     if (!r.ok) {
-      const txt = await r.text().catch(() => "");
+      const txt = await errorText(r);
       throw new Error(`HTTP ${r.status} ${r.statusText}${txt ? ': ' + txt : ''}`);
     }
     showToast("Deleted");
@@ -325,7 +336,7 @@ function openInlineEdit(id, layer) {
           body: JSON.stringify({ name, description })
         });
         if (!res.ok) {
-          const txt = await res.text().catch(() => "");
+          const txt = await errorText(res);
           throw new Error(`HTTP ${res.status} ${res.statusText}${txt ? ': ' + txt : ''}`);
         }
         showToast("Updated");
@@ -668,7 +679,7 @@ document.getElementById("import-file")?.addEventListener("change", async (ev) =>
       const p = feat.properties || {};
       const r = await fetch(`${API_BASE}/features`, { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify({ name: p.name || "import", description: p.description || "", geojson: geo }) });
       if (!r.ok) {
-        const txt = await r.text().catch(() => "");
+        const txt = await errorText(r);
         throw new Error(`HTTP ${r.status} ${r.statusText}${txt ? ': ' + txt : ''}`);
       }
     }
@@ -765,7 +776,7 @@ map.on("click", async (e) => {
         const body = { name: out.name, description: out.description, geojson: { type: "Point", coordinates: [lng, lat] } };
         const r = await fetch(`${API_BASE}/features`, { method: "POST", headers: { "Content-Type": "application/json" }, body: JSON.stringify(body) });
         if (!r.ok) {
-          const txt = await r.text().catch(() => "");
+          const txt = await errorText(r);
           throw new Error(`HTTP ${r.status} ${r.statusText}${txt ? ': ' + txt : ''}`);
         }
         showToast("Saved");